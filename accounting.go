@@ -126,7 +126,17 @@ func (a *AcctRequest) Validate() error {
 			return err
 		}
 	}
-	return nil
+	args, err := validateArgs(a.Args)
+	if err != nil {
+		return err
+	}
+	// each arg is preceded by its length
+	return validateLengths(AcctRequestLen+len(a.Args),
+		fieldLength{"user", a.User.Len(), maxByteFieldLength},
+		fieldLength{"port", a.Port.Len(), maxByteFieldLength},
+		fieldLength{"rem_addr", a.RemAddr.Len(), maxByteFieldLength},
+		fieldLength{"args", args, int(MaxBodyLength)},
+	)
 }
 
 // MarshalBinary marshals AccountingRequest to tacacs bytes
@@ -220,7 +230,7 @@ func (a AcctRequest) Len() int {
 
 // Fields returns fields from this packet compatible with a structured logger
 func (a AcctRequest) Fields() map[string]string {
-	return map[string]string{
+	return portFields(map[string]string{
 		"packet-type": "AcctRequest",
 		"flags":       a.Flags.String(),
 		"method":      a.Method.String(),
@@ -231,7 +241,7 @@ func (a AcctRequest) Fields() map[string]string {
 		"port":        a.Port.String(),
 		"rem-addr":    a.RemAddr.String(),
 		"args":        a.Args.String(),
-	}
+	}, a.Port)
 }
 
 // AcctReplyLen minumum length of this packet type
@@ -283,7 +293,8 @@ func NewAccountingReplyFromBytes(data []byte) (*AcctReply, error) {
 	return t, t.UnmarshalBinary(data)
 }
 
-// Validate all fields on this type
+// Validate all fields on this type and that they fit the packet.  MarshalBinary calls it, but
+// handlers may also call it to find a reply that cannot be sent before committing to it.
 func (a *AcctReply) Validate() error {
 	// validate
 	for _, t := range []Field{a.Status, a.ServerMsg, a.Data} {
@@ -291,7 +302,10 @@ func (a *AcctReply) Validate() error {
 			return err
 		}
 	}
-	return nil
+	return validateLengths(AcctReplyLen,
+		fieldLength{"server_msg", a.ServerMsg.Len(), maxFieldLength},
+		fieldLength{"data", a.Data.Len(), maxFieldLength},
+	)
 }
 
 // MarshalBinary marshals AccountingReply to tacacs bytes
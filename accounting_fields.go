@@ -23,12 +23,26 @@ const (
 	AcctReplyStatusSuccess AcctReplyStatus = 0x01
 	// AcctReplyStatusError per rfc
 	AcctReplyStatusError AcctReplyStatus = 0x02
+	// AcctReplyStatusFollow is deprecated by rfc8907 and must not be sent.  It is known so that it can
+	// be recognized in logs, but fails validation.
+	AcctReplyStatusFollow AcctReplyStatus = 0x21
 )
 
+// IsKnown reports if t is one of the values defined by the rfc
+func (t AcctReplyStatus) IsKnown() bool {
+	switch t {
+	case AcctReplyStatusSuccess, AcctReplyStatusError, AcctReplyStatusFollow:
+		return true
+	}
+	return false
+}
+
 // Validate characterics of type based on rfc and usage.
 func (t AcctReplyStatus) Validate(condition interface{}) error {
-	switch t {
-	case AcctReplyStatusSuccess, AcctReplyStatusError:
+	if t == AcctReplyStatusFollow {
+		return fmt.Errorf("AcctReplyStatusFollow is deprecated by rfc8907")
+	}
+	if t.IsKnown() {
 		return nil
 	}
 	return fmt.Errorf("unknown AcctReplyStatus value [%v]", t)
@@ -46,8 +60,10 @@ func (t AcctReplyStatus) String() string {
 		return "AcctReplyStatusSuccess"
 	case AcctReplyStatusError:
 		return "AcctReplyStatusError"
+	case AcctReplyStatusFollow:
+		return "AcctReplyStatusFollow"
 	}
-	return fmt.Sprintf("unknown AcctReplyStatus[%d]", uint8(t))
+	return unknownValue(uint8(t))
 }
 
 // AcctServerMsg is a string that may be presented to the user.  The
@@ -411,20 +427,31 @@ func (b *AcctRequestFlag) Toggle(f AcctRequestFlag) { *b = *b ^ f }
 // Has returns true when b has the f bit set.
 func (b *AcctRequestFlag) Has(f AcctRequestFlag) bool { return *b&f != 0 }
 
-// String to satisfy Fields interface
+// acctFlagsKnown are the bits of AcctRequestFlag defined by the rfc
+const acctFlagsKnown = AcctFlagStart | AcctFlagStop | AcctFlagWatchdog
+
+// IsKnown reports if t has no bits set other than those defined by the rfc
+func (t AcctRequestFlag) IsKnown() bool {
+	return t&^acctFlagsKnown == 0
+}
+
+// String to satisfy Fields interface.  AcctFlagWatchdogWithUpdate is the start and watchdog bits
+// together, so it is only named when both are set.
 func (t AcctRequestFlag) String() string {
-	flags := make([]string, 0, 4) // 4 supported flags
-	if t.Has(AcctFlagStart) {
+	flags := make([]string, 0, 4) // 3 supported flags and unknown bits
+	switch {
+	case t&AcctFlagWatchdogWithUpdate == AcctFlagWatchdogWithUpdate:
+		flags = append(flags, "AcctFlagWatchdogWithUpdate")
+	case t.Has(AcctFlagStart):
 		flags = append(flags, "AcctFlagStart")
+	case t.Has(AcctFlagWatchdog):
+		flags = append(flags, "AcctFlagWatchdog")
 	}
 	if t.Has(AcctFlagStop) {
 		flags = append(flags, "AcctFlagStop")
 	}
-	if t.Has(AcctFlagWatchdog) {
-		flags = append(flags, "AcctFlagWatchdog")
-	}
-	if t.Has(AcctFlagWatchdogWithUpdate) {
-		flags = append(flags, "AcctFlagWatchdogWithUpdate")
+	if unknown := t &^ acctFlagsKnown; unknown != 0 {
+		flags = append(flags, unknownValue(uint8(unknown)))
 	}
 	return strings.Join(flags, "|")
 }
@@ -0,0 +1,44 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+// AcctRecordSchema is the schema version of AcctRecord.  Versions only ever add fields, so a
+// reader of an older version reads newer records as they are.  Records without a schema are 1.0.
+//
+//   - 1.0: the fields of the AcctRequest, and system_event
+//   - 1.1: schema, and transport
+//   - 1.2: raw
+const AcctRecordSchema = "1.2"
+
+// AcctRecord is the json record accounters write for an accounting request
+type AcctRecord struct {
+	AcctRequest
+	Schema string `json:"schema"`
+	// SystemEvent marks system event records with their kind, so they can be told apart from
+	// commands
+	SystemEvent SystemEventKind `json:"system_event,omitempty"`
+	// Transport is how the request reached the server, it is missing for requests that were not
+	// served by a Server
+	Transport *Transport `json:"transport,omitempty"`
+	// Raw holds the fields of the request as the device sent them, if they were normalized, see
+	// StringNormalization
+	Raw *RawFields `json:"raw,omitempty"`
+}
+
+// NewAcctRecord returns the record of the accounting request body, received as request
+func NewAcctRecord(request Request, body AcctRequest) AcctRecord {
+	r := AcctRecord{AcctRequest: body, Schema: AcctRecordSchema}
+	r.SystemEvent, _ = body.Args.SystemEvent()
+	if t, ok := RequestTransport(request.Context); ok {
+		r.Transport = &t
+	}
+	if raw, ok := RequestRawFields(request.Context); ok {
+		r.Raw = &raw
+	}
+	return r
+}
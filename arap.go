@@ -0,0 +1,79 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"crypto/des"
+	"crypto/subtle"
+	"fmt"
+)
+
+// ARAPDataLength is the length of the data field of an ARAP AuthenStart
+const ARAPDataLength = 24
+
+// arapMaxPassword is the longest password ARAP can use, it is the DES key
+const arapMaxPassword = 8
+
+// ARAPData is the data field of an AuthenStart of AuthenTypeARAP.  Per rfc8907 5.4.2.4 it is the
+// concatenation of the 8 octet challenge the NAS sent to the remote, the 8 octet challenge the
+// remote sent to the NAS, and the 8 octet response of the remote to the NAS challenge.
+type ARAPData struct {
+	NASChallenge    [8]byte
+	RemoteChallenge [8]byte
+	RemoteResponse  [8]byte
+}
+
+// ParseARAP parses the data field of an ARAP AuthenStart
+func ParseARAP(data AuthenData) (*ARAPData, error) {
+	if len(data) != ARAPDataLength {
+		return nil, fmt.Errorf("arap data must be %v bytes, got %v", ARAPDataLength, len(data))
+	}
+	var a ARAPData
+	copy(a.NASChallenge[:], data[0:8])
+	copy(a.RemoteChallenge[:], data[8:16])
+	copy(a.RemoteResponse[:], data[16:24])
+	return &a, nil
+}
+
+// ARAPResponse computes the response to challenge for password.  ARAP encrypts the challenge with
+// DES, keyed with the password padded with nulls to 8 bytes and each byte shifted left by one bit,
+// as DES ignores the low bit of every key byte.
+func ARAPResponse(password string, challenge [8]byte) ([8]byte, error) {
+	var response [8]byte
+	if len(password) > arapMaxPassword {
+		return response, fmt.Errorf("arap passwords are at most %v bytes", arapMaxPassword)
+	}
+	var key [8]byte
+	for i := 0; i < len(password); i++ {
+		key[i] = password[i] << 1
+	}
+	block, err := des.NewCipher(key[:])
+	if err != nil {
+		return response, err
+	}
+	block.Encrypt(response[:], challenge[:])
+	return response, nil
+}
+
+// Verify reports if the remote response matches password.  It also returns the response to the
+// remote challenge, which the NAS expects in the data field of a passing AuthenReply so the remote
+// can authenticate the NAS in turn.
+func (a ARAPData) Verify(password string) ([8]byte, bool, error) {
+	expected, err := ARAPResponse(password, a.NASChallenge)
+	if err != nil {
+		return [8]byte{}, false, err
+	}
+	if subtle.ConstantTimeCompare(expected[:], a.RemoteResponse[:]) != 1 {
+		return [8]byte{}, false, nil
+	}
+	nasResponse, err := ARAPResponse(password, a.RemoteChallenge)
+	if err != nil {
+		return [8]byte{}, false, err
+	}
+	return nasResponse, true, nil
+}
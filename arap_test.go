@@ -0,0 +1,56 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// arapPassword shifted left by one bit is the DES key 133457799bbcdff1 of the textbook vector,
+// which encrypts 0123456789abcdef to 85e813540f0ab405.  DES ignores the low bit of each key byte.
+const arapPassword = "\x09\x1a\x2b\x3c\x4d\x5e\x6f\x78"
+
+func TestARAPKnownVector(t *testing.T) {
+	response, err := ARAPResponse(arapPassword, [8]byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef})
+	assert.NoError(t, err)
+	assert.Equal(t, [8]byte{0x85, 0xe8, 0x13, 0x54, 0x0f, 0x0a, 0xb4, 0x05}, response)
+}
+
+func TestARAPVerify(t *testing.T) {
+	data := AuthenData(
+		"\x01\x23\x45\x67\x89\xab\xcd\xef" + // nas challenge
+			"\x11\x22\x33\x44\x55\x66\x77\x88" + // remote challenge
+			"\x85\xe8\x13\x54\x0f\x0a\xb4\x05", // remote response
+	)
+	a, err := ParseARAP(data)
+	assert.NoError(t, err)
+	assert.Equal(t, [8]byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88}, a.RemoteChallenge)
+
+	nasResponse, ok, err := a.Verify(arapPassword)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	expected, err := ARAPResponse(arapPassword, a.RemoteChallenge)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, nasResponse)
+
+	_, ok, err = a.Verify("wrong")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	_, _, err = a.Verify("too long a password")
+	assert.Error(t, err)
+}
+
+func TestParseARAPMalformedLength(t *testing.T) {
+	for _, data := range []AuthenData{"", "\x01\x23\x45\x67\x89\xab\xcd\xef", AuthenData(make([]byte, ARAPDataLength+1))} {
+		_, err := ParseARAP(data)
+		assert.Error(t, err, len(data))
+	}
+}
@@ -0,0 +1,93 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// AuthenMethods are the authen_types a device group may authenticate with, by authen action.  An
+// action without types allows none, eg a hardened group that allows PAP logins only has
+// {login: [pap]}.
+type AuthenMethods map[AuthenAction]map[AuthenType]bool
+
+// ParseAuthenMethods parses a json object of action name to a list of authen_type names, eg
+// {"login": ["pap"], "sendauth": ["chap"]}, see AuthenAction.Name and AuthenType.Name.  Unknown
+// names are an error, as a typo would silently deny every device of the group.
+func ParseAuthenMethods(v string) (AuthenMethods, error) {
+	var raw map[string][]string
+	if err := json.Unmarshal([]byte(v), &raw); err != nil {
+		return nil, fmt.Errorf("authen methods must be a json object of action to authen_types; %w", err)
+	}
+	m := make(AuthenMethods, len(raw))
+	for actionName, typeNames := range raw {
+		action, ok := AuthenActionByName(actionName)
+		if !ok {
+			return nil, fmt.Errorf("unknown authen action [%v], expected login, chpass or sendauth", actionName)
+		}
+		types := make(map[AuthenType]bool, len(typeNames))
+		for _, typeName := range typeNames {
+			atype, ok := AuthenTypeByName(typeName)
+			if !ok {
+				return nil, fmt.Errorf("unknown authen_type [%v] for authen action [%v]", typeName, actionName)
+			}
+			types[atype] = true
+		}
+		m[action] = types
+	}
+	return m, nil
+}
+
+// Allows reports if m allows authenticating with atype for action
+func (m AuthenMethods) Allows(action AuthenAction, atype AuthenType) bool {
+	return m[action][atype]
+}
+
+// Types returns the authen_types m allows for action, in ascending order
+func (m AuthenMethods) Types(action AuthenAction) []AuthenType {
+	types := make([]AuthenType, 0, len(m[action]))
+	for atype, ok := range m[action] {
+		if ok {
+			types = append(types, atype)
+		}
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
+// Empty reports if m allows no method at all
+func (m AuthenMethods) Empty() bool {
+	for action := range m {
+		if len(m.Types(action)) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// AuthenMethodDenial is how a start for a method the device group does not allow is answered
+type AuthenMethodDenial string
+
+const (
+	// AuthenMethodDenialFail answers with a fail, ending the authentication
+	AuthenMethodDenialFail AuthenMethodDenial = "fail"
+	// AuthenMethodDenialRestart answers with a restart whose data lists the authen_types allowed
+	// for the action, one byte each, so the client may start again with one of them
+	AuthenMethodDenialRestart AuthenMethodDenial = "restart"
+)
+
+// ParseAuthenMethodDenial returns the AuthenMethodDenial named v, fail or restart
+func ParseAuthenMethodDenial(v string) (AuthenMethodDenial, error) {
+	switch d := AuthenMethodDenial(v); d {
+	case AuthenMethodDenialFail, AuthenMethodDenialRestart:
+		return d, nil
+	}
+	return "", fmt.Errorf("unknown authen method denial [%v], expected fail or restart", v)
+}
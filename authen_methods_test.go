@@ -0,0 +1,55 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAuthenMethods(t *testing.T) {
+	m, err := ParseAuthenMethods(`{"LOGIN": ["pap", "chap"], "sendauth": []}`)
+	require.NoError(t, err)
+	assert.True(t, m.Allows(AuthenActionLogin, AuthenTypePAP))
+	assert.False(t, m.Allows(AuthenActionLogin, AuthenTypeASCII))
+	assert.False(t, m.Allows(AuthenActionPass, AuthenTypePAP))
+	assert.Equal(t, []AuthenType{AuthenTypePAP, AuthenTypeCHAP}, m.Types(AuthenActionLogin))
+	assert.False(t, m.Empty())
+
+	m, err = ParseAuthenMethods(`{"login": []}`)
+	require.NoError(t, err)
+	assert.True(t, m.Empty())
+
+	for _, v := range []string{`["pap"]`, `{"logon": ["pap"]}`, `{"login": ["telnet"]}`} {
+		_, err := ParseAuthenMethods(v)
+		assert.Error(t, err, v)
+	}
+}
+
+func TestAuthenMethodNames(t *testing.T) {
+	for _, action := range []AuthenAction{AuthenActionLogin, AuthenActionPass, AuthenActionSendAuth} {
+		parsed, ok := AuthenActionByName(action.Name())
+		assert.True(t, ok)
+		assert.Equal(t, action, parsed)
+	}
+	for atype := range authenTypeNames {
+		parsed, ok := AuthenTypeByName(atype.Name())
+		assert.True(t, ok)
+		assert.Equal(t, atype, parsed)
+	}
+	assert.Equal(t, "unknown", AuthenType(0x2a).Name())
+	assert.Equal(t, "unknown", AuthenAction(0x2a).Name())
+
+	d, err := ParseAuthenMethodDenial("restart")
+	require.NoError(t, err)
+	assert.Equal(t, AuthenMethodDenialRestart, d)
+	_, err = ParseAuthenMethodDenial("drop")
+	assert.Error(t, err)
+}
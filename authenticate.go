@@ -110,7 +110,12 @@ func (a *AuthenStart) Validate() error {
 			return err
 		}
 	}
-	return nil
+	return validateLengths(AuthenStartLen,
+		fieldLength{"user", a.User.Len(), maxByteFieldLength},
+		fieldLength{"port", a.Port.Len(), maxByteFieldLength},
+		fieldLength{"rem_addr", a.RemAddr.Len(), maxByteFieldLength},
+		fieldLength{"data", a.Data.Len(), maxByteFieldLength},
+	)
 }
 
 // MarshalBinary encodes AuthenStart to tacacs bytes
@@ -181,7 +186,7 @@ func (a AuthenStart) Len() int {
 
 // Fields returns fields from this packet compatible with a structured logger
 func (a AuthenStart) Fields() map[string]string {
-	return map[string]string{
+	return portFields(map[string]string{
 		"packet-type": "AuthenStart",
 		"action":      a.Action.String(),
 		"priv-lvl":    a.PrivLvl.String(),
@@ -191,7 +196,7 @@ func (a AuthenStart) Fields() map[string]string {
 		"port":        a.Port.String(),
 		"rem-addr":    a.RemAddr.String(),
 		"data":        a.Data.String(),
-	}
+	}, a.Port)
 }
 
 // AuthenContinueLen minumum length of this packet type
@@ -250,7 +255,10 @@ func (a *AuthenContinue) Validate() error {
 			return err
 		}
 	}
-	return nil
+	return validateLengths(AuthenContinueLen,
+		fieldLength{"user_msg", a.UserMessage.Len(), maxFieldLength},
+		fieldLength{"data", a.Data.Len(), maxFieldLength},
+	)
 }
 
 // MarshalBinary encodes AuthenContinue to tacacs bytes
@@ -362,7 +370,8 @@ type AuthenReply struct {
 	Data      AuthenData
 }
 
-// Validate all fields on this type
+// Validate all fields on this type and that they fit the packet.  MarshalBinary calls it, but
+// handlers may also call it to find a reply that cannot be sent before committing to it.
 func (a *AuthenReply) Validate() error {
 	// validate
 	for _, t := range []Field{a.Status} {
@@ -370,7 +379,11 @@ func (a *AuthenReply) Validate() error {
 			return err
 		}
 	}
-	return nil
+	// status, flags, server_msg_len and data_len
+	return validateLengths(6,
+		fieldLength{"server_msg", a.ServerMsg.Len(), maxFieldLength},
+		fieldLength{"data", a.Data.Len(), maxFieldLength},
+	)
 }
 
 // MarshalBinary encodes AuthenReply to tacacs bytes
@@ -7,7 +7,10 @@
 
 package tacquito
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 // NB a general note on encoding. Tacacs is generally a text protocol, eg:
 // https://datatracker.ietf.org/doc/html/rfc8907#section-3.7
@@ -48,10 +51,18 @@ const (
 	AuthenActionSendAuth AuthenAction = 0x04
 )
 
-// Validate characterics of type based on rfc and usage.
-func (t AuthenAction) Validate(condition interface{}) error {
+// IsKnown reports if t is one of the values defined by the rfc
+func (t AuthenAction) IsKnown() bool {
 	switch t {
 	case AuthenActionLogin, AuthenActionPass, AuthenActionSendAuth:
+		return true
+	}
+	return false
+}
+
+// Validate characterics of type based on rfc and usage.
+func (t AuthenAction) Validate(condition interface{}) error {
+	if t.IsKnown() {
 		return nil
 	}
 	return fmt.Errorf("unknown AuthenAction value [%v]", t)
@@ -72,7 +83,33 @@ func (t AuthenAction) String() string {
 	case AuthenActionSendAuth:
 		return "AuthenActionSendAuth"
 	}
-	return fmt.Sprintf("unknown AuthenAction[%d]", uint8(t))
+	return unknownValue(uint8(t))
+}
+
+// authenActionNames are the names of the actions in config, by action
+var authenActionNames = map[AuthenAction]string{
+	AuthenActionLogin:    "login",
+	AuthenActionPass:     "chpass",
+	AuthenActionSendAuth: "sendauth",
+}
+
+// Name returns the short name of t used in config, eg login, or unknown for values outside of the
+// rfc
+func (t AuthenAction) Name() string {
+	if name, ok := authenActionNames[t]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// AuthenActionByName returns the action with the short name name, as returned by Name
+func AuthenActionByName(name string) (AuthenAction, bool) {
+	for t, n := range authenActionNames {
+		if strings.EqualFold(n, name) {
+			return t, true
+		}
+	}
+	return 0, false
 }
 
 // PrivLvl indicates the privilege level that the User is authenticating
@@ -95,9 +132,14 @@ func (t PrivLvl) Len() int {
 	return 1
 }
 
+// IsKnown reports if t is within the rfc range of 0-15
+func (t PrivLvl) IsKnown() bool {
+	return t <= PrivLvlMax
+}
+
 // Validate has a valid range of 0-15
 func (t PrivLvl) Validate(condition interface{}) error {
-	if t <= 15 {
+	if t.IsKnown() {
 		return nil
 	}
 	return fmt.Errorf("invalid PrivLvl: [%v]", t)
@@ -113,14 +155,17 @@ func (t PrivLvl) String() string {
 	case PrivLvlRoot:
 		return "PrivLvlRoot"
 	}
-	return fmt.Sprintf("unknown PrivLvl[%d]", uint8(t))
+	if t.IsKnown() {
+		return fmt.Sprintf("PrivLvl%d", uint8(t))
+	}
+	return unknownValue(uint8(t))
 }
 
 // AuthenType is the type of authentication.
 type AuthenType uint8
 
 const (
-	// AuthenTypeNotSet only valid for Authorization/Accounting Requests (https://datatracker.ietf.org/doc/html/rfc8907#section-6.1)
+	// AuthenTypeNotSet only valid for Authorization/Accounting Requests (https://datatracker.ietf.org/doc/html/rfc8907#section-3.6)
 	AuthenTypeNotSet AuthenType = 0x00
 	// AuthenTypeASCII per rfc
 	AuthenTypeASCII AuthenType = 0x01
@@ -136,14 +181,20 @@ const (
 	AuthenTypeMSCHAPV2 AuthenType = 0x06
 )
 
-// Validate characterics of type based on rfc and usage.
-// Validate characterics of type based on rfc and usage.
-func (t AuthenType) Validate(condition interface{}) error {
+// IsKnown reports if t is one of the values defined by the rfc
+func (t AuthenType) IsKnown() bool {
 	switch t {
 	case AuthenTypeNotSet, AuthenTypeASCII, AuthenTypePAP, AuthenTypeCHAP, AuthenTypeARAP, AuthenTypeMSCHAP, AuthenTypeMSCHAPV2:
-		return nil
+		return true
 	}
-	return fmt.Errorf("unknown AuthenType value [%v]", t)
+	return false
+}
+
+// Validate characterics of type based on rfc and usage.  Vendors extend authen_type with types
+// of their own, so values outside of the rfc are valid.  They are kept as sent and can be told
+// apart with IsKnown.  A server replies to an authen_type it does not support with a fail.
+func (t AuthenType) Validate(condition interface{}) error {
+	return nil
 }
 
 // Len returns the length of AuthenType.
@@ -169,7 +220,37 @@ func (t AuthenType) String() string {
 	case AuthenTypeMSCHAPV2:
 		return "AuthenTypeMSCHAPV2"
 	}
-	return fmt.Sprintf("unknown AuthenType[%d]", uint8(t))
+	return unknownValue(uint8(t))
+}
+
+// authenTypeNames are the names of the authen_types in config, by type
+var authenTypeNames = map[AuthenType]string{
+	AuthenTypeNotSet:   "notset",
+	AuthenTypeASCII:    "ascii",
+	AuthenTypePAP:      "pap",
+	AuthenTypeCHAP:     "chap",
+	AuthenTypeARAP:     "arap",
+	AuthenTypeMSCHAP:   "mschap",
+	AuthenTypeMSCHAPV2: "mschapv2",
+}
+
+// Name returns the short name of t used in config, eg pap, or unknown for values outside of the
+// rfc
+func (t AuthenType) Name() string {
+	if name, ok := authenTypeNames[t]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// AuthenTypeByName returns the authen_type with the short name name, as returned by Name
+func AuthenTypeByName(name string) (AuthenType, bool) {
+	for t, n := range authenTypeNames {
+		if strings.EqualFold(n, name) {
+			return t, true
+		}
+	}
+	return 0, false
 }
 
 // AuthenService is the service that is requesting the authentication.
@@ -203,10 +284,18 @@ const (
 	AuthenServiceFwProxy AuthenService = 0x09
 )
 
-// Validate characterics of type based on rfc and usage.
-func (t AuthenService) Validate(condition interface{}) error {
+// IsKnown reports if t is one of the values defined by the rfc
+func (t AuthenService) IsKnown() bool {
 	switch t {
 	case AuthenServiceNone, AuthenServiceLogin, AuthenServiceEnable, AuthenServicePPP, AuthenServiceARAP, AuthenServicePT, AuthenServiceRCMD, AuthenServiceX25, AuthenServiceNASI, AuthenServiceFwProxy:
+		return true
+	}
+	return false
+}
+
+// Validate characterics of type based on rfc and usage.
+func (t AuthenService) Validate(condition interface{}) error {
+	if t.IsKnown() {
 		return nil
 	}
 	return fmt.Errorf("unknown AuthenService value [%v]", t)
@@ -241,7 +330,40 @@ func (t AuthenService) String() string {
 	case AuthenServiceFwProxy:
 		return "AuthenServiceFwProxy"
 	}
-	return fmt.Sprintf("unknown AuthenService[%d]", uint8(t))
+	return unknownValue(uint8(t))
+}
+
+// authenServiceNames are the names of the services in config, by service
+var authenServiceNames = map[AuthenService]string{
+	AuthenServiceNone:    "none",
+	AuthenServiceLogin:   "login",
+	AuthenServiceEnable:  "enable",
+	AuthenServicePPP:     "ppp",
+	AuthenServiceARAP:    "arap",
+	AuthenServicePT:      "pt",
+	AuthenServiceRCMD:    "rcmd",
+	AuthenServiceX25:     "x25",
+	AuthenServiceNASI:    "nasi",
+	AuthenServiceFwProxy: "fwproxy",
+}
+
+// Name returns the short name of t used in config, eg enable, or unknown for values outside of
+// the rfc
+func (t AuthenService) Name() string {
+	if name, ok := authenServiceNames[t]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// AuthenServiceByName returns the service with the short name name, as returned by Name
+func AuthenServiceByName(name string) (AuthenService, bool) {
+	for t, n := range authenServiceNames {
+		if strings.EqualFold(n, name) {
+			return t, true
+		}
+	}
+	return 0, false
 }
 
 // AuthenStatus is the current status of the authentication.
@@ -262,12 +384,26 @@ const (
 	AuthenStatusRestart AuthenStatus = 0x06
 	// AuthenStatusError per rfc
 	AuthenStatusError AuthenStatus = 0x07
+	// AuthenStatusFollow is deprecated by rfc8907 and must not be sent.  It is known so that it can
+	// be recognized in logs, but fails validation.
+	AuthenStatusFollow AuthenStatus = 0x21
 )
 
+// IsKnown reports if t is one of the values defined by the rfc
+func (t AuthenStatus) IsKnown() bool {
+	switch t {
+	case AuthenStatusPass, AuthenStatusFail, AuthenStatusGetData, AuthenStatusGetUser, AuthenStatusGetPass, AuthenStatusRestart, AuthenStatusError, AuthenStatusFollow:
+		return true
+	}
+	return false
+}
+
 // Validate characterics of type based on rfc and usage.
 func (t AuthenStatus) Validate(condition interface{}) error {
-	switch t {
-	case AuthenStatusPass, AuthenStatusFail, AuthenStatusGetData, AuthenStatusGetUser, AuthenStatusGetPass, AuthenStatusRestart, AuthenStatusError:
+	if t == AuthenStatusFollow {
+		return fmt.Errorf("AuthenStatusFollow is deprecated by rfc8907")
+	}
+	if t.IsKnown() {
 		return nil
 	}
 	return fmt.Errorf("unknown AuthenStatus value [%v]", t)
@@ -295,8 +431,10 @@ func (t AuthenStatus) String() string {
 		return "AuthenStatusRestart"
 	case AuthenStatusError:
 		return "AuthenStatusError"
+	case AuthenStatusFollow:
+		return "AuthenStatusFollow"
 	}
-	return fmt.Sprintf("unknown AuthenStatus[%d]", uint8(t))
+	return unknownValue(uint8(t))
 }
 
 // AuthenServerMsg see packet type for use information.
@@ -377,13 +515,12 @@ func (t AuthenData) String() string {
 // AuthenUser see packet type for use information.
 type AuthenUser string
 
-// Validate characterics of type based on rfc and usage.
+// Validate characterics of type based on rfc and usage.  Devices send the field in utf-8, latin-1 or
+// whatever their locale is, so any bytes are accepted; the server canonicalizes them with the
+// StringNormalization of the device before handlers decode them.
 func (t AuthenUser) Validate(condition interface{}) error {
 	// https://datatracker.ietf.org/doc/html/rfc8907#section-3.6
-	if isAllASCII(string(t)) {
-		return nil
-	}
-	return fmt.Errorf("AuthenUser is not all ascii, but it must be, [%v]", t)
+	return nil
 }
 
 // Len returns the length of AuthenUser.
@@ -399,13 +536,12 @@ func (t AuthenUser) String() string {
 // AuthenPort see packet type for use information.
 type AuthenPort string
 
-// Validate characterics of type based on rfc and usage.
+// Validate characterics of type based on rfc and usage.  Devices send the field in utf-8, latin-1 or
+// whatever their locale is, so any bytes are accepted; the server canonicalizes them with the
+// StringNormalization of the device before handlers decode them.
 func (t AuthenPort) Validate(condition interface{}) error {
 	// https://datatracker.ietf.org/doc/html/rfc8907#section-3.6
-	if isAllASCII(string(t)) {
-		return nil
-	}
-	return fmt.Errorf("AuthenPort is not all ascii, but it must be, [%v]", t)
+	return nil
 }
 
 // Len returns the length of AuthenPort.
@@ -421,13 +557,12 @@ func (t AuthenPort) String() string {
 // AuthenRemAddr see packet type for use information.
 type AuthenRemAddr string
 
-// Validate characterics of type based on rfc and usage.
+// Validate characterics of type based on rfc and usage.  Devices send the field in utf-8, latin-1 or
+// whatever their locale is, so any bytes are accepted; the server canonicalizes them with the
+// StringNormalization of the device before handlers decode them.
 func (t AuthenRemAddr) Validate(condition interface{}) error {
 	// https://datatracker.ietf.org/doc/html/rfc8907#section-3.6
-	if isAllASCII(string(t)) {
-		return nil
-	}
-	return fmt.Errorf("AuthenRemAddr is not all ascii, but it must be, [%v]", t)
+	return nil
 }
 
 // Len returns the length of AuthenRemAddr.
@@ -460,12 +595,21 @@ func (b *AuthenReplyFlag) Toggle(f AuthenReplyFlag) { *b = *b ^ f }
 // Has returns true when b has the f bit set.
 func (b *AuthenReplyFlag) Has(f AuthenReplyFlag) bool { return *b&f != 0 }
 
+// IsKnown reports if b has no bits set other than those defined by the rfc
+func (b AuthenReplyFlag) IsKnown() bool {
+	return b&^AuthenReplyFlagNoEcho == 0
+}
+
 // String to satisfy Fields interface
 func (b AuthenReplyFlag) String() string {
+	flags := make([]string, 0, 2)
 	if b.Has(AuthenReplyFlagNoEcho) {
-		return "AuthenReplyFlagNoEcho"
+		flags = append(flags, "AuthenReplyFlagNoEcho")
 	}
-	return ""
+	if !b.IsKnown() {
+		flags = append(flags, unknownValue(uint8(b&^AuthenReplyFlagNoEcho)))
+	}
+	return strings.Join(flags, "|")
 }
 
 // AuthenContinueFlag flags that modify the action to be taken.
@@ -488,10 +632,19 @@ func (b *AuthenContinueFlag) Toggle(f AuthenContinueFlag) { *b = *b ^ f }
 // Has returns true when b has the f bit set.
 func (b *AuthenContinueFlag) Has(f AuthenContinueFlag) bool { return *b&f != 0 }
 
+// IsKnown reports if b has no bits set other than those defined by the rfc
+func (b AuthenContinueFlag) IsKnown() bool {
+	return b&^AuthenContinueFlagAbort == 0
+}
+
 // String to satisfy Fields interface
 func (b AuthenContinueFlag) String() string {
+	flags := make([]string, 0, 2)
 	if b.Has(AuthenContinueFlagAbort) {
-		return "AuthenContinueFlagAbort"
+		flags = append(flags, "AuthenContinueFlagAbort")
+	}
+	if !b.IsKnown() {
+		flags = append(flags, unknownValue(uint8(b&^AuthenContinueFlagAbort)))
 	}
-	return ""
+	return strings.Join(flags, "|")
 }
@@ -0,0 +1,150 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"fmt"
+)
+
+// AuthorDecisionStatus is the outcome of an authorization policy, see AuthorDecision
+type AuthorDecisionStatus int
+
+const (
+	// AuthorDecisionPass authorizes the request with the args of the decision, as additions to the
+	// args of the request or as overrides of the values of its attributes.  The reply is a PassAdd
+	// if the decision only adds args and a PassRepl with every arg otherwise.
+	AuthorDecisionPass AuthorDecisionStatus = iota
+	// AuthorDecisionPassAdd authorizes the request and adds the args of the decision to its args,
+	// args the request already holds are not sent again
+	AuthorDecisionPassAdd
+	// AuthorDecisionPassRepl authorizes the request and replaces its args with the args of the
+	// decision, which must be complete
+	AuthorDecisionPassRepl
+	// AuthorDecisionFail denies the request
+	AuthorDecisionFail
+	// AuthorDecisionError fails the request as the policy could not decide it
+	AuthorDecisionError
+)
+
+// String returns the name of the status
+func (s AuthorDecisionStatus) String() string {
+	switch s {
+	case AuthorDecisionPass:
+		return "pass"
+	case AuthorDecisionPassAdd:
+		return "pass-add"
+	case AuthorDecisionPassRepl:
+		return "pass-repl"
+	case AuthorDecisionFail:
+		return "fail"
+	case AuthorDecisionError:
+		return "error"
+	}
+	return fmt.Sprintf("unknown(%d)", int(s))
+}
+
+// AuthorDecision is the outcome of an authorization policy for a request, which
+// NewAuthorReplyFromDecision turns into a reply
+type AuthorDecision struct {
+	Status AuthorDecisionStatus
+	// Args are the av pairs of a pass, they are not sent for a fail or an error
+	Args Args
+	// ServerMsg is optional
+	ServerMsg string
+}
+
+// NewAuthorReplyFromDecision returns the reply to an authorization request with args for decision
+// d, ready to marshal.  It applies the rfc8907 semantics of each status, which handlers building
+// replies by hand often get wrong: a PassAdd only carries args the device should add to those it
+// sent, and a PassRepl carries every arg the device should keep.  An error is returned if the
+// decision cannot be expressed as a valid reply.
+func NewAuthorReplyFromDecision(args Args, d AuthorDecision) (*AuthorReply, error) {
+	reply := &AuthorReply{ServerMsg: AuthorServerMsg(d.ServerMsg)}
+	switch d.Status {
+	case AuthorDecisionPass:
+		if merged, replaced := mergeArgs(args, d.Args); replaced {
+			reply.Status, reply.Args = AuthorStatusPassRepl, merged
+		} else {
+			reply.Status, reply.Args = AuthorStatusPassAdd, additionalArgs(args, d.Args)
+		}
+	case AuthorDecisionPassAdd:
+		reply.Status, reply.Args = AuthorStatusPassAdd, additionalArgs(args, d.Args)
+	case AuthorDecisionPassRepl:
+		if len(d.Args) == 0 {
+			return nil, fmt.Errorf("a pass-repl decision must hold every arg the device keeps")
+		}
+		reply.Status, reply.Args = AuthorStatusPassRepl, append(Args(nil), d.Args...)
+	case AuthorDecisionFail:
+		reply.Status = AuthorStatusFail
+	case AuthorDecisionError:
+		reply.Status = AuthorStatusError
+	default:
+		return nil, fmt.Errorf("unknown authorization decision [%v]", d.Status)
+	}
+	if err := reply.Validate(); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// additionalArgs returns the args of decision that args do not already hold
+func additionalArgs(args, decision Args) Args {
+	held := make(map[string]struct{}, len(args))
+	for _, arg := range args {
+		held[arg.String()] = struct{}{}
+	}
+	var added Args
+	for _, arg := range decision {
+		if _, ok := held[arg.String()]; ok {
+			continue
+		}
+		held[arg.String()] = struct{}{}
+		added = append(added, arg)
+	}
+	return added
+}
+
+// mergeArgs returns args with the values of every attribute decision also holds replaced by the
+// values decision holds for it, followed by the args of decision for other attributes.  replaced
+// reports if any arg of args changed.
+func mergeArgs(args, decision Args) (merged Args, replaced bool) {
+	overrides := make(map[string]Args, len(decision))
+	for _, arg := range decision {
+		a, _, _ := arg.ASV()
+		overrides[a] = append(overrides[a], arg)
+	}
+	held := make(map[string]Args, len(args))
+	for _, arg := range args {
+		a, _, _ := arg.ASV()
+		held[a] = append(held[a], arg)
+	}
+	used := make(map[string]bool, len(overrides))
+	for _, arg := range args {
+		a, _, _ := arg.ASV()
+		override, ok := overrides[a]
+		if !ok {
+			merged = append(merged, arg)
+			continue
+		}
+		if used[a] {
+			continue
+		}
+		used[a] = true
+		if override.String() != held[a].String() {
+			replaced = true
+		}
+		merged = append(merged, override...)
+	}
+	for _, arg := range decision {
+		a, _, _ := arg.ASV()
+		if !used[a] {
+			merged = append(merged, arg)
+		}
+	}
+	return merged, replaced
+}
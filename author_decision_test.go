@@ -0,0 +1,98 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// authorReplyWire assembles the body of an authorization reply per rfc8907 6.2
+func authorReplyWire(status AuthorStatus, msg string, args ...string) []byte {
+	b := []byte{byte(status), byte(len(args)), byte(len(msg) >> 8), byte(len(msg)), 0x00, 0x00}
+	for _, arg := range args {
+		b = append(b, byte(len(arg)))
+	}
+	b = append(b, msg...)
+	for _, arg := range args {
+		b = append(b, arg...)
+	}
+	return b
+}
+
+func TestNewAuthorReplyFromDecision(t *testing.T) {
+	request := Args{"service=shell", "cmd=", "priv-lvl=1"}
+	tests := []struct {
+		name     string
+		decision AuthorDecision
+		want     []byte
+	}{
+		{
+			name:     "pass without args authorizes the request as sent",
+			decision: AuthorDecision{Status: AuthorDecisionPass},
+			want:     authorReplyWire(AuthorStatusPassAdd, ""),
+		},
+		{
+			name:     "pass that only adds args",
+			decision: AuthorDecision{Status: AuthorDecisionPass, Args: Args{"priv-lvl=1", "idletime=10"}, ServerMsg: "ok"},
+			want:     authorReplyWire(AuthorStatusPassAdd, "ok", "idletime=10"),
+		},
+		{
+			name:     "pass that overrides a value replaces every arg",
+			decision: AuthorDecision{Status: AuthorDecisionPass, Args: Args{"priv-lvl=15", "shell:roles*admin", "shell:roles*user"}},
+			want:     authorReplyWire(AuthorStatusPassRepl, "", "service=shell", "cmd=", "priv-lvl=15", "shell:roles*admin", "shell:roles*user"),
+		},
+		{
+			name:     "pass-add leaves out args the request holds",
+			decision: AuthorDecision{Status: AuthorDecisionPassAdd, Args: Args{"service=shell", "timeout=60", "timeout=60"}},
+			want:     authorReplyWire(AuthorStatusPassAdd, "", "timeout=60"),
+		},
+		{
+			name:     "pass-repl sends the args of the decision",
+			decision: AuthorDecision{Status: AuthorDecisionPassRepl, Args: Args{"service=shell", "priv-lvl=15"}, ServerMsg: "replaced"},
+			want:     authorReplyWire(AuthorStatusPassRepl, "replaced", "service=shell", "priv-lvl=15"),
+		},
+		{
+			name:     "fail never carries args",
+			decision: AuthorDecision{Status: AuthorDecisionFail, Args: Args{"priv-lvl=15"}, ServerMsg: "denied by policy"},
+			want:     authorReplyWire(AuthorStatusFail, "denied by policy"),
+		},
+		{
+			name:     "error never carries args",
+			decision: AuthorDecision{Status: AuthorDecisionError, Args: Args{"priv-lvl=15"}, ServerMsg: "policy unavailable"},
+			want:     authorReplyWire(AuthorStatusError, "policy unavailable"),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reply, err := NewAuthorReplyFromDecision(request, test.decision)
+			require.NoError(t, err)
+			b, err := reply.MarshalBinary()
+			require.NoError(t, err)
+			assert.Equal(t, test.want, b)
+		})
+	}
+	// the request is left as it was
+	assert.Equal(t, Args{"service=shell", "cmd=", "priv-lvl=1"}, request)
+}
+
+func TestNewAuthorReplyFromDecisionInvalid(t *testing.T) {
+	for _, d := range []AuthorDecision{
+		// a replacement without args would strip the request of every arg
+		{Status: AuthorDecisionPassRepl},
+		{Status: AuthorDecisionStatus(42)},
+		// args must be ascii
+		{Status: AuthorDecisionPassAdd, Args: Args{"shell:roles*ädmin"}},
+	} {
+		_, err := NewAuthorReplyFromDecision(Args{"service=shell"}, d)
+		assert.Error(t, err, "%v", d.Status)
+	}
+	assert.Equal(t, "unknown(42)", AuthorDecisionStatus(42).String())
+}
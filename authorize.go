@@ -112,7 +112,17 @@ func (a *AuthorRequest) Validate() error {
 			return err
 		}
 	}
-	return nil
+	args, err := validateArgs(a.Args)
+	if err != nil {
+		return err
+	}
+	// each arg is preceded by its length
+	return validateLengths(AuthorRequestLen+len(a.Args),
+		fieldLength{"user", a.User.Len(), maxByteFieldLength},
+		fieldLength{"port", a.Port.Len(), maxByteFieldLength},
+		fieldLength{"rem_addr", a.RemAddr.Len(), maxByteFieldLength},
+		fieldLength{"args", args, int(MaxBodyLength)},
+	)
 }
 
 // MarshalBinary encodes AuthroRequest into tacacs bytes
@@ -204,7 +214,7 @@ func (a AuthorRequest) Len() int {
 
 // Fields returns fields from this packet compatible with a structured logger
 func (a AuthorRequest) Fields() map[string]string {
-	return map[string]string{
+	return portFields(map[string]string{
 		"packet-type": "AuthorRequest",
 		"method":      a.Method.String(),
 		"priv-lvl":    a.PrivLvl.String(),
@@ -214,7 +224,7 @@ func (a AuthorRequest) Fields() map[string]string {
 		"port":        a.Port.String(),
 		"rem-addr":    a.RemAddr.String(),
 		"args":        a.Args.String(),
-	}
+	}, a.Port)
 }
 
 // AuthorReplyLen minumum length of this packet type
@@ -278,7 +288,8 @@ func NewAuthorReplyFromBytes(data []byte) (*AuthorReply, error) {
 	return t, t.UnmarshalBinary(data)
 }
 
-// Validate all fields on this type
+// Validate all fields on this type and that they fit the packet.  MarshalBinary calls it, but
+// handlers may also call it to find a reply that cannot be sent before committing to it.
 func (a *AuthorReply) Validate() error {
 	// validate
 	for _, t := range []Field{a.Status, a.ServerMsg, a.Data} {
@@ -291,7 +302,16 @@ func (a *AuthorReply) Validate() error {
 			return err
 		}
 	}
-	return nil
+	args, err := validateArgs(a.Args)
+	if err != nil {
+		return err
+	}
+	// each arg is preceded by its length
+	return validateLengths(AuthorReplyLen+len(a.Args),
+		fieldLength{"server_msg", a.ServerMsg.Len(), maxFieldLength},
+		fieldLength{"data", a.Data.Len(), maxFieldLength},
+		fieldLength{"args", args, int(MaxBodyLength)},
+	)
 }
 
 // MarshalBinary encodes AuthorReply into tacacs bytes
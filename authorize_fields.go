@@ -37,12 +37,24 @@ const (
 	AuthenMethodGuest AuthenMethod = 0x08
 	// AuthenMethodRadius per rfc
 	AuthenMethodRadius AuthenMethod = 0x10
+	// AuthenMethodKrb4 per rfc
+	AuthenMethodKrb4 AuthenMethod = 0x11
+	// AuthenMethodRCMD per rfc
+	AuthenMethodRCMD AuthenMethod = 0x20
 )
 
+// IsKnown reports if t is one of the values defined by the rfc
+func (t AuthenMethod) IsKnown() bool {
+	switch t {
+	case AuthenMethodNotSet, AuthenMethodNone, AuthenMethodKrb5, AuthenMethodLine, AuthenMethodEnable, AuthenMethodLocal, AuthenMethodTacacsPlus, AuthenMethodGuest, AuthenMethodRadius, AuthenMethodKrb4, AuthenMethodRCMD:
+		return true
+	}
+	return false
+}
+
 // Validate characterics of type based on rfc and usage.
 func (t AuthenMethod) Validate(condition interface{}) error {
-	switch t {
-	case AuthenMethodNotSet, AuthenMethodNone, AuthenMethodKrb5, AuthenMethodLine, AuthenMethodEnable, AuthenMethodLocal, AuthenMethodTacacsPlus, AuthenMethodGuest, AuthenMethodRadius:
+	if t.IsKnown() {
 		return nil
 	}
 	return fmt.Errorf("unknown AuthenMethod value [%v]", t)
@@ -74,8 +86,12 @@ func (t AuthenMethod) String() string {
 		return "AuthenMethodGuest"
 	case AuthenMethodRadius:
 		return "AuthenMethodRadius"
+	case AuthenMethodKrb4:
+		return "AuthenMethodKrb4"
+	case AuthenMethodRCMD:
+		return "AuthenMethodRCMD"
 	}
-	return fmt.Sprintf("unknown AuthenMethod[%d]", uint8(t))
+	return unknownValue(uint8(t))
 }
 
 // Arg per rfc, The arguments describe the specifics of the authorization that is being requested.
@@ -240,12 +256,26 @@ const (
 	AuthorStatusFail AuthorStatus = 0x10
 	// AuthorStatusError per rfc
 	AuthorStatusError AuthorStatus = 0x11
+	// AuthorStatusFollow is deprecated by rfc8907 and must not be sent.  It is known so that it can
+	// be recognized in logs, but fails validation.
+	AuthorStatusFollow AuthorStatus = 0x21
 )
 
+// IsKnown reports if t is one of the values defined by the rfc
+func (t AuthorStatus) IsKnown() bool {
+	switch t {
+	case AuthorStatusPassAdd, AuthorStatusPassRepl, AuthorStatusFail, AuthorStatusError, AuthorStatusFollow:
+		return true
+	}
+	return false
+}
+
 // Validate characterics of type based on rfc and usage.
 func (t AuthorStatus) Validate(condition interface{}) error {
-	switch t {
-	case AuthorStatusPassAdd, AuthorStatusPassRepl, AuthorStatusFail, AuthorStatusError:
+	if t == AuthorStatusFollow {
+		return fmt.Errorf("AuthorStatusFollow is deprecated by rfc8907")
+	}
+	if t.IsKnown() {
 		return nil
 	}
 	return fmt.Errorf("unknown AuthorStatus value [%v]", t)
@@ -267,8 +297,10 @@ func (t AuthorStatus) String() string {
 		return "AuthorStatusFail"
 	case AuthorStatusError:
 		return "AuthorStatusError"
+	case AuthorStatusFollow:
+		return "AuthorStatusFollow"
 	}
-	return fmt.Sprintf("unknown AuthorStatus[%d]", uint8(t))
+	return unknownValue(uint8(t))
 }
 
 // AuthorServerMsg a printable US-ASCII string that may be presented to theuser.
@@ -0,0 +1,75 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"errors"
+	"fmt"
+)
+
+// BadSecretDetector decides if a decrypted packet read by the server was obfuscated with a
+// different secret than the one of its connection, see SetBadSecretDetector.  Detect returns a nil
+// error for a packet that is served.  A *BadSecretErr marks a bad secret, and the packet returned
+// with it, if any, is written to the device before the connection is closed.  An
+// *ErrWrongDirection marks a packet of the opposite direction.  Any other error closes the
+// connection as a read error.  Packets sent with the UnencryptedFlag are never given to Detect.
+type BadSecretDetector interface {
+	Detect(p *Packet) (*Packet, error)
+}
+
+// BadSecretDetectorFunc is an adapter to use a func as a BadSecretDetector
+type BadSecretDetectorFunc func(p *Packet) (*Packet, error)
+
+// Detect implements BadSecretDetector
+func (f BadSecretDetectorFunc) Detect(p *Packet) (*Packet, error) {
+	return f(p)
+}
+
+// DefaultBadSecretDetector is the detector of a server without SetBadSecretDetector.  A packet
+// whose body unmarshals as no request of its type, and as no reply either, is a bad secret,
+// answered with an error reply with a sequence number of 1.  A body that fails to unmarshal for
+// other reasons, such as a malformed field, is left to the handler.  Custom detectors may wrap it,
+// eg to log the packets it flags.
+var DefaultBadSecretDetector BadSecretDetector = BadSecretDetectorFunc(func(p *Packet) (*Packet, error) {
+	result, reply, err := crypter{role: roleServer}.detectBadSecret(p)
+	switch result {
+	case secretGood:
+		return nil, nil
+	case secretBad:
+		return reply, NewBadSecretErr(fmt.Sprintf("bad secret detected for sessionID [%v]", p.Header.SessionID))
+	}
+	return nil, err
+})
+
+// SetBadSecretDetector replaces DefaultBadSecretDetector, eg with a looser detector for a device
+// that sends malformed bodies which should not be taken for a bad secret.  nil restores the
+// default.
+func SetBadSecretDetector(d BadSecretDetector) Option {
+	return func(s *Server) {
+		s.badSecretDetector = d
+	}
+}
+
+// detect classifies p with the BadSecretDetector of c, or detectBadSecret without one
+func (c *crypter) detect(p *Packet) (secretResult, *Packet, error) {
+	if c.badSecretDetector == nil || p.Header.Flags.Has(UnencryptedFlag) {
+		return c.detectBadSecret(p)
+	}
+	reply, err := c.badSecretDetector.Detect(p)
+	var badSecret *BadSecretErr
+	var wrongDirection *ErrWrongDirection
+	switch {
+	case err == nil:
+		return secretGood, nil, nil
+	case errors.As(err, &wrongDirection):
+		return secretWrongDirection, nil, err
+	case errors.As(err, &badSecret):
+		return secretBad, reply, nil
+	}
+	return secretError, nil, err
+}
@@ -0,0 +1,117 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultBadSecretDetector(t *testing.T) {
+	decrypted := func(p *Packet, secret string) *Packet {
+		b, err := p.MarshalBinary()
+		require.NoError(t, err)
+		var packet Packet
+		require.NoError(t, Unmarshal(b, &packet))
+		require.NoError(t, crypt([]byte("fooman"), &packet))
+		require.NoError(t, crypt([]byte(secret), &packet))
+		return &packet
+	}
+	tests := []struct {
+		name   string
+		packet *Packet
+	}{
+		{name: "good", packet: decrypted(proxyTestPacket(), "fooman")},
+		{name: "bad secret", packet: decrypted(proxyTestPacket(), "not-fooman")},
+		{name: "wrong direction", packet: decrypted(wrongDirectionTestReply(), "fooman")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// a crypter with the default detector classifies exactly as one without a detector
+			result, reply, err := (&crypter{role: roleServer}).detect(test.packet)
+			detected, dReply, dErr := (&crypter{role: roleServer, badSecretDetector: DefaultBadSecretDetector}).detect(test.packet)
+			assert.Equal(t, result, detected)
+			assert.Equal(t, reply, dReply)
+			assert.Equal(t, err, dErr)
+		})
+	}
+}
+
+// badSecretLogin sends a login obfuscated with secret to cs and returns its reply, or the error
+// reading it
+func badSecretLogin(t *testing.T, cs *connectTestServer, secret string) (*Packet, error) {
+	conn, err := net.Dial("tcp6", cs.addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	c := newCrypter(roleClient, []byte(secret), conn, false)
+	_, err = c.write(proxyTestPacket())
+	require.NoError(t, err)
+	return c.read()
+}
+
+func TestSetBadSecretDetector(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		cs := startConnectServer(t)
+		bad := metricValue(crypterBadSecret)
+		_, err := badSecretLogin(t, cs, "not-fooman")
+		// the client cannot decrypt the bad secret reply with its own secret
+		var bs *BadSecretErr
+		assert.True(t, errors.As(err, &bs), err)
+		assert.Equal(t, CloseBadSecret, cs.reason(t))
+		assert.Equal(t, int32(0), atomic.LoadInt32(&cs.handled))
+		assert.Equal(t, bad+2, metricValue(crypterBadSecret), "counted by the server and the client")
+	})
+	t.Run("looser", func(t *testing.T) {
+		// every body is left to the handler, as for a device known to send malformed bodies
+		cs := startConnectServer(t, SetBadSecretDetector(BadSecretDetectorFunc(func(p *Packet) (*Packet, error) {
+			return nil, nil
+		})))
+		bad := metricValue(crypterBadSecret)
+		_, err := badSecretLogin(t, cs, "not-fooman")
+		// the reply is obfuscated with the secret of the server
+		var bs *BadSecretErr
+		assert.True(t, errors.As(err, &bs), err)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&cs.handled))
+		assert.Equal(t, bad+1, metricValue(crypterBadSecret), "counted by the client only")
+	})
+	t.Run("wrapping the default", func(t *testing.T) {
+		var flagged int32
+		cs := startConnectServer(t, SetBadSecretDetector(BadSecretDetectorFunc(func(p *Packet) (*Packet, error) {
+			reply, err := DefaultBadSecretDetector.Detect(p)
+			if err != nil {
+				atomic.AddInt32(&flagged, 1)
+			}
+			return reply, err
+		})))
+		reply, _, err := cs.login(t)
+		require.NoError(t, err)
+		assert.Equal(t, AuthenStatusPass, reply.Status)
+
+		_, err = badSecretLogin(t, cs, "not-fooman")
+		assert.Error(t, err)
+		assert.Equal(t, CloseBadSecret, cs.reason(t))
+		assert.Equal(t, int32(1), atomic.LoadInt32(&flagged))
+		assert.Equal(t, int32(1), atomic.LoadInt32(&cs.handled))
+	})
+	t.Run("error", func(t *testing.T) {
+		cs := startConnectServer(t, SetBadSecretDetector(BadSecretDetectorFunc(func(p *Packet) (*Packet, error) {
+			return nil, errors.New("detector failed")
+		})))
+		_, err := badSecretLogin(t, cs, "fooman")
+		assert.Error(t, err, "the connection is closed without a reply")
+		assert.Equal(t, CloseReadError, cs.reason(t))
+		assert.Equal(t, int32(0), atomic.LoadInt32(&cs.handled))
+	})
+}
@@ -0,0 +1,231 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// benchAllocTolerance is the fraction a workload may exceed its baseline allocations by, and
+// benchAllocSlack the number of allocations it may always exceed them by, before
+// TestBenchmarkAllocs fails
+const (
+	benchAllocTolerance = 0.1
+	benchAllocSlack     = 2
+)
+
+// benchWorkload is a workload of the benchmark suite.  The benchmark names are stable so results
+// can be compared across changes, treat renaming one like changing an api.  allocs is the
+// baseline allocations per run, asserted by TestBenchmarkAllocs so a plain go test catches
+// allocation regressions of the hot paths.
+type benchWorkload struct {
+	name   string
+	allocs float64
+	// bytes is the body length processed per run, for throughput
+	bytes int
+	// setup returns the func to run, it is torn down by tb.Cleanup
+	setup func(tb testing.TB) func()
+}
+
+// benchVersion is the version of every packet of the suite
+var benchVersion = Version{MajorVersion: MajorVersion, MinorVersion: MinorVersionDefault}
+
+// benchCrypt crypts a body of n bytes in place, every other run restores it
+func benchCrypt(n int) func(tb testing.TB) func() {
+	return func(tb testing.TB) func() {
+		p := &Packet{
+			Header: &Header{Version: benchVersion, SeqNo: 1, SessionID: 12345, Length: uint32(n)},
+			Body:   bytes.Repeat([]byte{0xa5}, n),
+		}
+		secret := []byte("fooman")
+		return func() {
+			if err := crypt(secret, p); err != nil {
+				tb.Fatal(err)
+			}
+		}
+	}
+}
+
+// benchDecode unmarshals v, once marshaled, into a new body from body
+func benchDecode(v EncoderDecoder, body func() EncoderDecoder) func(tb testing.TB) func() {
+	return func(tb testing.TB) func() {
+		b, err := v.MarshalBinary()
+		require.NoError(tb, err)
+		return func() {
+			if err := Unmarshal(b, body()); err != nil {
+				tb.Fatal(err)
+			}
+		}
+	}
+}
+
+// benchRoundTrip sends an authentication start and reads its reply over a single-connect
+// connection served by a server
+func benchRoundTrip(tb testing.TB) func() {
+	client, server := net.Pipe()
+	s := NewServer(nopLogger{}, nil, SetIdleTimeout(time.Minute))
+	done := make(chan struct{})
+	go func() {
+		s.handle(context.Background(), newCrypter(roleServer, []byte("fooman"), server, false), HandlerFunc(func(response Response, request Request) {
+			response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusPass)))
+		}))
+		close(done)
+	}()
+	tb.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+	c := newCrypter(roleClient, []byte("fooman"), client, false)
+	id := SessionID(0)
+	return func() {
+		id++
+		// write crypts the packet in place, so each run builds its own
+		if _, err := c.write(featureTestStart(id, SingleConnect, MinorVersionDefault, AuthenTypePAP)); err != nil {
+			tb.Fatal(err)
+		}
+		if _, err := c.read(); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+// benchBadSecret classifies an authentication start crypted with another secret
+func benchBadSecret(tb testing.TB) func() {
+	p := featureTestStart(12345, 0, MinorVersionDefault, AuthenTypePAP)
+	require.NoError(tb, crypt([]byte("not-fooman"), p))
+	require.NoError(tb, crypt([]byte("fooman"), p))
+	return func() {
+		if result, _, _ := (crypter{}).detectBadSecret(p); result != secretBad {
+			tb.Fatalf("expected a bad secret, got [%v]", result)
+		}
+	}
+}
+
+// tallyRequest records the observations of the i-th simulated request in t, those of a request
+// read, decided and answered by the server.  Every tenth request is denied.
+func tallyRequest(t *requestTally, i int) {
+	t.read()
+	t.pad(1)
+	if i%3 == 0 {
+		t.sessionHit()
+	} else {
+		t.sessionMiss()
+		t.sessionSet()
+	}
+	status := AuthenStatusPass.String()
+	if i%10 == 0 {
+		t.denial(Authenticate.String(), string(DenialBadCredential), IdentityUnknown)
+		status = AuthenStatusFail.String()
+	}
+	t.pad(2)
+	t.write()
+	t.outcome(Authenticate.String(), status, originHandler)
+}
+
+// benchTally records the observations of a request, in a tally committed once if batched and
+// as each is made otherwise
+func benchTally(batched bool) func(tb testing.TB) func() {
+	return func(tb testing.TB) func() {
+		var t *requestTally
+		if batched {
+			t = &requestTally{}
+		}
+		i := 0
+		return func() {
+			i++
+			tallyRequest(t, i)
+			t.commit()
+		}
+	}
+}
+
+// benchWorkloads is the benchmark suite
+var benchWorkloads = []benchWorkload{
+	{name: "Crypt/Small", allocs: 0, bytes: 64, setup: benchCrypt(64)},
+	{name: "Crypt/Large", allocs: 0, bytes: 16 << 10, setup: benchCrypt(16 << 10)},
+	{
+		name:   "Decode/AuthenStart",
+		allocs: 9,
+		setup: benchDecode(NewAuthenStart(SetAuthenStartAction(AuthenActionLogin), SetAuthenStartPrivLvl(PrivLvlUser), SetAuthenStartType(AuthenTypePAP),
+			SetAuthenStartService(AuthenServiceLogin), SetAuthenStartUser("cisco"), SetAuthenStartPort("tty0"), SetAuthenStartRemAddr("192.0.2.1"), SetAuthenStartData("password")),
+			func() EncoderDecoder { return &AuthenStart{} }),
+	},
+	{
+		name:   "Decode/AuthenContinue",
+		allocs: 3,
+		setup:  benchDecode(NewAuthenContinue(SetAuthenContinueUserMessage("password")), func() EncoderDecoder { return &AuthenContinue{} }),
+	},
+	{
+		name:   "Decode/AuthenReply",
+		allocs: 2,
+		setup:  benchDecode(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusGetPass), SetAuthenReplyServerMsg("password:")), func() EncoderDecoder { return &AuthenReply{} }),
+	},
+	{
+		name:   "Decode/AuthorRequest",
+		allocs: 7,
+		setup: benchDecode(NewAuthorRequest(SetAuthorRequestMethod(AuthenMethodTacacsPlus), SetAuthorRequestPrivLvl(PrivLvlRoot), SetAuthorRequestType(AuthenTypeASCII),
+			SetAuthorRequestService(AuthenServiceLogin), SetAuthorRequestUser("cisco"), SetAuthorRequestArgs(Args{"service=shell", "cmd=show", "cmd-arg=version"})),
+			func() EncoderDecoder { return &AuthorRequest{} }),
+	},
+	{
+		name:   "Decode/AuthorReply",
+		allocs: 3,
+		setup:  benchDecode(NewAuthorReply(SetAuthorReplyStatus(AuthorStatusPassAdd), SetAuthorReplyArgs("priv-lvl=15")), func() EncoderDecoder { return &AuthorReply{} }),
+	},
+	{
+		name:   "Decode/AcctRequest",
+		allocs: 6,
+		setup: benchDecode(NewAcctRequest(SetAcctRequestFlag(AcctFlagStart), SetAcctRequestMethod(AuthenMethodTacacsPlus), SetAcctRequestPrivLvl(PrivLvlRoot),
+			SetAcctRequestType(AuthenTypeASCII), SetAcctRequestService(AuthenServiceLogin), SetAcctRequestUser("cisco"), SetAcctRequestArgs(Args{"task_id=1", "service=shell"})),
+			func() EncoderDecoder { return &AcctRequest{} }),
+	},
+	{
+		name:   "Decode/AcctReply",
+		allocs: 1,
+		setup:  benchDecode(NewAcctReply(SetAcctReplyStatus(AcctReplyStatusSuccess)), func() EncoderDecoder { return &AcctReply{} }),
+	},
+	{name: "RoundTrip/AuthenStart", allocs: 85, setup: benchRoundTrip},
+	{name: "BadSecret/AuthenStart", allocs: 14, setup: benchBadSecret},
+	{name: "Tally/Unbatched", allocs: 1, setup: benchTally(false)},
+	{name: "Tally/Batched", allocs: 0, setup: benchTally(true)},
+}
+
+func BenchmarkSuite(b *testing.B) {
+	for _, w := range benchWorkloads {
+		b.Run(w.name, func(b *testing.B) {
+			run := w.setup(b)
+			if w.bytes > 0 {
+				b.SetBytes(int64(w.bytes))
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				run()
+			}
+		})
+	}
+}
+
+func TestBenchmarkAllocs(t *testing.T) {
+	for _, w := range benchWorkloads {
+		t.Run(w.name, func(t *testing.T) {
+			run := w.setup(t)
+			allocs := testing.AllocsPerRun(100, run)
+			t.Logf("%v: %v allocs per run", w.name, allocs)
+			assert.LessOrEqual(t, allocs, w.allocs+math.Max(benchAllocSlack, w.allocs*benchAllocTolerance), "allocations regressed from the baseline of [%v]", w.allocs)
+		})
+	}
+}
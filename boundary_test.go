@@ -0,0 +1,272 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fill returns a string of n bytes
+func fill(n int) string {
+	return strings.Repeat("x", n)
+}
+
+// maxArgs returns n args of 255 bytes each
+func maxArgs(n int) Args {
+	args := make(Args, n)
+	for i := range args {
+		args[i] = Arg("a=" + fill(maxByteFieldLength-2))
+	}
+	return args
+}
+
+// maxArgStrings returns maxArgs(n) as strings
+func maxArgStrings(n int) []string {
+	var args []string
+	for _, arg := range maxArgs(n) {
+		args = append(args, string(arg))
+	}
+	return args
+}
+
+// boundaryCase is a body at the limits of its field lengths
+type boundaryCase struct {
+	name string
+	t    HeaderType
+	seq  int
+	body EncoderDecoder
+	// decode is an empty body of the same type
+	decode EncoderDecoder
+}
+
+// boundaryCases are bodies of exactly MaxBodyLength, or with every uint8 length at its maximum
+// where the body cannot grow any further
+func boundaryCases() []boundaryCase {
+	return []boundaryCase{
+		{
+			name: "authen-start", t: Authenticate, seq: 1, decode: &AuthenStart{},
+			body: NewAuthenStart(
+				SetAuthenStartAction(AuthenActionLogin),
+				SetAuthenStartType(AuthenTypePAP),
+				SetAuthenStartService(AuthenServiceLogin),
+				SetAuthenStartUser(AuthenUser(fill(maxByteFieldLength))),
+				SetAuthenStartPort(AuthenPort(fill(maxByteFieldLength))),
+				SetAuthenStartRemAddr(AuthenRemAddr(fill(maxByteFieldLength))),
+				SetAuthenStartData(AuthenData(fill(maxByteFieldLength))),
+			),
+		},
+		{
+			name: "authen-continue", t: Authenticate, seq: 3, decode: &AuthenContinue{},
+			body: NewAuthenContinue(SetAuthenContinueUserMessage(AuthenUserMessage(fill(int(MaxBodyLength) - AuthenContinueLen)))),
+		},
+		{
+			name: "authen-reply", t: Authenticate, seq: 2, decode: &AuthenReply{},
+			body: NewAuthenReply(SetAuthenReplyStatus(AuthenStatusFail), SetAuthenReplyServerMsg(fill(int(MaxBodyLength)-6))),
+		},
+		{
+			name: "author-request", t: Authorize, seq: 1, decode: &AuthorRequest{},
+			body: NewAuthorRequest(
+				SetAuthorRequestMethod(AuthenMethodTacacsPlus),
+				SetAuthorRequestType(AuthenTypeASCII),
+				SetAuthorRequestService(AuthenServiceLogin),
+				SetAuthorRequestUser(AuthenUser(fill(int(MaxBodyLength)-AuthorRequestLen-maxArgCount*(maxByteFieldLength+1)))),
+				SetAuthorRequestArgs(maxArgs(maxArgCount)),
+			),
+		},
+		{
+			name: "author-reply", t: Authorize, seq: 2, decode: &AuthorReply{},
+			body: NewAuthorReply(
+				SetAuthorReplyStatus(AuthorStatusPassAdd),
+				SetAuthorReplyServerMsg(fill(int(MaxBodyLength)-AuthorReplyLen-maxArgCount*(maxByteFieldLength+1))),
+				SetAuthorReplyArgs(maxArgStrings(maxArgCount)...),
+			),
+		},
+		{
+			name: "acct-request", t: Accounting, seq: 1, decode: &AcctRequest{},
+			body: NewAcctRequest(
+				SetAcctRequestFlag(AcctFlagStop),
+				SetAcctRequestMethod(AuthenMethodTacacsPlus),
+				SetAcctRequestType(AuthenTypeASCII),
+				SetAcctRequestService(AuthenServiceLogin),
+				SetAcctRequestUser(AuthenUser(fill(int(MaxBodyLength)-AcctRequestLen-maxArgCount*(maxByteFieldLength+1)))),
+				SetAcctRequestArgs(maxArgs(maxArgCount)),
+			),
+		},
+		{
+			name: "acct-reply", t: Accounting, seq: 2, decode: &AcctReply{},
+			body: NewAcctReply(SetAcctReplyStatus(AcctReplyStatusSuccess), SetAcctReplyServerMsg(fill(int(MaxBodyLength)-AcctReplyLen))),
+		},
+	}
+}
+
+func TestBoundaryRoundTrip(t *testing.T) {
+	var golden bytes.Buffer
+	for _, test := range boundaryCases() {
+		t.Run(test.name, func(t *testing.T) {
+			body, err := test.body.MarshalBinary()
+			require.NoError(t, err)
+			if test.name != "authen-start" {
+				assert.Equal(t, int(MaxBodyLength), len(body))
+			}
+
+			h := NewHeader(
+				SetHeaderVersion(Version{MajorVersion: MajorVersion, MinorVersion: MinorVersionDefault}),
+				SetHeaderType(test.t),
+				SetHeaderSeqNo(test.seq),
+				SetHeaderSessionID(12345),
+			)
+			p := NewPacket(SetPacketHeader(h), SetPacketBody(body))
+			require.NoError(t, crypt([]byte("fooman"), p))
+			wire, err := p.MarshalBinary()
+			require.NoError(t, err)
+			fmt.Fprintf(&golden, "%v %v %x\n", test.name, len(wire), sha256.Sum256(wire))
+
+			raw, err := readRawPacket(bytes.NewReader(wire))
+			require.NoError(t, err)
+			var read Packet
+			require.NoError(t, Unmarshal(raw, &read))
+			require.NoError(t, crypt([]byte("fooman"), &read))
+			require.NoError(t, Unmarshal(read.Body, test.decode))
+			assert.Equal(t, test.body, test.decode)
+		})
+	}
+
+	// the wire bytes of every case are locked, so a change to the encoding is noticed
+	path := filepath.Join("testdata", "boundary.golden")
+	if *updateGolden {
+		require.NoError(t, os.WriteFile(path, golden.Bytes(), 0644))
+	}
+	want, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, string(want), golden.String())
+}
+
+func TestBoundaryLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		body interface{ Validate() error }
+		err  string
+	}{
+		{
+			name: "user",
+			body: NewAuthenStart(SetAuthenStartAction(AuthenActionLogin), SetAuthenStartType(AuthenTypePAP), SetAuthenStartService(AuthenServiceLogin), SetAuthenStartUser(AuthenUser(fill(maxByteFieldLength+1)))),
+			err:  "user length [256] exceeds the maximum of [255]",
+		},
+		{
+			name: "authen start data",
+			body: NewAuthenStart(SetAuthenStartAction(AuthenActionLogin), SetAuthenStartType(AuthenTypePAP), SetAuthenStartService(AuthenServiceLogin), SetAuthenStartData(AuthenData(fill(maxByteFieldLength+1)))),
+			err:  "data length [256] exceeds the maximum of [255]",
+		},
+		{
+			name: "rem_addr",
+			body: NewAuthorRequest(SetAuthorRequestType(AuthenTypeASCII), SetAuthorRequestRemAddr(AuthenRemAddr(fill(maxByteFieldLength+1)))),
+			err:  "rem_addr length [256] exceeds the maximum of [255]",
+		},
+		{
+			name: "author request args",
+			body: NewAuthorRequest(SetAuthorRequestType(AuthenTypeASCII), SetAuthorRequestArgs(maxArgs(maxArgCount+1))),
+			err:  "arg count [256] exceeds the maximum of [255]",
+		},
+		{
+			name: "acct request port",
+			body: NewAcctRequest(SetAcctRequestFlag(AcctFlagStart), SetAcctRequestPort(AuthenPort(fill(maxByteFieldLength+1)))),
+			err:  "port length [256] exceeds the maximum of [255]",
+		},
+		{
+			name: "acct request body",
+			body: NewAcctRequest(SetAcctRequestFlag(AcctFlagStart), SetAcctRequestUser(AuthenUser(fill(maxByteFieldLength))), SetAcctRequestArgs(maxArgs(maxArgCount))),
+			err:  "body length [65544] exceeds the maximum of [65536]",
+		},
+		{
+			name: "user_msg",
+			body: NewAuthenContinue(SetAuthenContinueUserMessage(AuthenUserMessage(fill(maxFieldLength + 1)))),
+			err:  "user_msg length [65536] exceeds the maximum of [65535]",
+		},
+		{
+			// a server_msg at its own maximum does not leave room for the rest of the body
+			name: "server_msg",
+			body: NewAuthenReply(SetAuthenReplyStatus(AuthenStatusFail), SetAuthenReplyServerMsg(fill(maxFieldLength))),
+			err:  "body length [65541] exceeds the maximum of [65536]",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.body.Validate()
+			assert.EqualError(t, err, test.err)
+			var lengthErr *LengthError
+			if strings.Contains(test.err, "length") {
+				assert.True(t, errors.As(err, &lengthErr))
+			}
+		})
+	}
+}
+
+func TestBoundaryDeclaredLength(t *testing.T) {
+	// a declared length over 2^31 is negative as an int on 32 bit platforms
+	h := make([]byte, MaxHeaderLength)
+	h[0], h[1], h[2] = 0xc1, byte(Authenticate), 1
+	binary.BigEndian.PutUint32(h[8:], 0xfffffff0)
+
+	_, err := readRawPacket(bytes.NewReader(h))
+	assert.True(t, errors.Is(err, errMaxBodyLength))
+	assert.EqualError(t, err, "declared body length exceeds MaxBodyLength; declared [4294967280] bytes, the maximum is [65536]")
+
+	client, server := net.Pipe()
+	defer client.Close()
+	c := lengthQuirkTestCrypter(server, -4)
+	go client.Write(h)
+	_, err = c.read()
+	assert.True(t, errors.Is(err, errMaxBodyLength))
+
+	var p Packet
+	var lengthErr *LengthError
+	assert.True(t, errors.As(p.UnmarshalBinary(h), &lengthErr))
+	assert.Equal(t, int64(0xfffffff0), lengthErr.Length)
+}
+
+func TestCryptLargePad(t *testing.T) {
+	// the header declares less than the body holds, the pad must still cover the body
+	body := bytes.Repeat([]byte{0x5a}, 4<<20)
+	p := &Packet{Header: &Header{Version: Version{MajorVersion: MajorVersion}, SessionID: 12345, SeqNo: 1, Length: 16}, Body: append([]byte(nil), body...)}
+	require.NoError(t, crypt([]byte("fooman"), p))
+	assert.NotEqual(t, body, p.Body)
+	require.NoError(t, crypt([]byte("fooman"), p))
+	assert.Equal(t, body, p.Body)
+
+	// the pad is built in one pass without allocating, so its cost grows linearly with its size
+	pad := make([]byte, 4<<20)
+	assert.Zero(t, testing.AllocsPerRun(1, func() {
+		PadInto(pad, []byte("fooman"), 12345, Version{MajorVersion: MajorVersion}, 1)
+	}))
+	elapsed := func(n int) time.Duration {
+		best := time.Duration(1<<63 - 1)
+		for i := 0; i < 3; i++ {
+			started := time.Now()
+			PadInto(pad[:n], []byte("fooman"), 12345, Version{MajorVersion: MajorVersion}, 1)
+			if d := time.Since(started); d < best {
+				best = d
+			}
+		}
+		return best
+	}
+	small, large := elapsed(1<<20), elapsed(4<<20)
+	assert.Less(t, int64(large), int64(16*small), "a 4x larger pad took [%v] against [%v]", large, small)
+}
@@ -0,0 +1,154 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/facebookincubator/tacquito/internal/canceltest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCrypterReadContext(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	c := newCrypter(roleClient, []byte("fooman"), client, false)
+
+	// the server never writes, so the read blocks until it is canceled
+	err := canceltest.ReturnsWithin(t, canceltest.Limit, func(ctx context.Context) error {
+		_, err := c.readContext(ctx)
+		return err
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// the deadline used to interrupt the read is cleared again
+	reply := NewPacket(
+		SetPacketHeader(NewHeader(SetHeaderType(Authenticate), SetHeaderSeqNo(2), SetHeaderSessionID(12345),
+			SetHeaderVersion(Version{MajorVersion: MajorVersion, MinorVersion: MinorVersionOne}))),
+		SetPacketBodyUnsafe(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusPass))),
+	)
+	go newCrypter(roleServer, []byte("fooman"), server, false).write(reply)
+	p, err := c.readContext(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, SessionID(12345), p.Header.SessionID)
+}
+
+func TestCrypterReadContextRestoresDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	c := newCrypter(roleClient, []byte("fooman"), client, false)
+	require.NoError(t, c.SetReadDeadline(time.Now().Add(canceltest.Limit)))
+
+	err := canceltest.ReturnsWithin(t, canceltest.Limit, func(ctx context.Context) error {
+		_, err := c.readContext(ctx)
+		return err
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// the deadline set before the read still applies, rather than being cleared
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.readContext(context.Background())
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	case <-time.After(time.Second):
+		t.Fatal("read deadline was cleared by the interrupted read")
+	}
+}
+
+func TestCrypterWriteContext(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	c := newCrypter(roleClient, []byte("fooman"), client, false)
+
+	// the server never reads, so the write blocks until it is canceled
+	err := canceltest.ReturnsWithin(t, canceltest.Limit, func(ctx context.Context) error {
+		_, err := c.writeContext(ctx, proxyTestPacket())
+		return err
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestClientSendContext(t *testing.T) {
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	// the server accepts the connection and never replies
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+
+	c, err := NewClient(SetClientDialerContext(context.Background(), "tcp6", listener.Addr().String(), []byte("fooman")))
+	require.NoError(t, err)
+	defer c.Close()
+	err = canceltest.ReturnsWithin(t, canceltest.Limit, func(ctx context.Context) error {
+		_, err := c.SendContext(ctx, proxyTestPacket())
+		return err
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestClientDialerContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := NewClient(SetClientDialerContext(ctx, "tcp6", "[::1]:49", []byte("fooman")))
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestServeContext(t *testing.T) {
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	require.NoError(t, err)
+	s := NewServer(nopLogger{}, maintenanceSecretProvider{})
+	canceltest.ReturnsWithin(t, canceltest.Limit, func(ctx context.Context) error {
+		return s.Serve(ctx, listener.(*net.TCPListener))
+	})
+}
+
+func TestServeContextClosesConnections(t *testing.T) {
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	require.NoError(t, err)
+	closed := make(chan CloseReason, 1)
+	s := NewServer(nopLogger{}, maintenanceSecretProvider{}, SetIdleTimeout(time.Hour), SetOnClose(func(ctx context.Context, remote net.Addr, reason CloseReason) {
+		closed <- reason
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Serve(ctx, listener.(*net.TCPListener))
+
+	// an idle connection is closed once the server is stopped, not once its idle timeout passes
+	conn, err := net.Dial("tcp6", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Eventually(t, func() bool {
+		s.retirement.mu.Lock()
+		defer s.retirement.mu.Unlock()
+		return len(s.retirement.conns) == 1
+	}, time.Second, time.Millisecond)
+	cancel()
+	select {
+	case reason := <-closed:
+		assert.Equal(t, CloseShutdown, reason)
+	case <-time.After(time.Second):
+		t.Fatal("idle connection was not closed when the server was stopped")
+	}
+}
@@ -0,0 +1,109 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// CapturedPacket is a single packet the server read or wrote, in both of its representations
+type CapturedPacket struct {
+	Direction Direction
+	// Time is when the packet was captured, from the clock set with SetClock
+	Time time.Time
+	// Remote is the address of the device, past any proxy
+	Remote string
+	// Raw is the packet as it was on the wire, header and obfuscated body, eg for a pcap writer.
+	// Raw of a read packet is captured before it is decrypted.
+	Raw []byte
+	// Packet is the packet with its body decrypted.  Packet of a read packet is captured once it
+	// was decrypted, and is nil for a packet sent with the wrong secret.
+	Packet *Packet
+}
+
+// PacketSink receives every packet on the connections of a server, see SetPacketSink.  Capture is
+// called on the connection's goroutine, so it must not block and must not modify p.
+type PacketSink interface {
+	Capture(p CapturedPacket)
+}
+
+// PacketSinkFunc is an adapter to allow the use of ordinary functions as a PacketSink
+type PacketSinkFunc func(p CapturedPacket)
+
+// Capture calls f(p)
+func (f PacketSinkFunc) Capture(p CapturedPacket) {
+	f(p)
+}
+
+// SetPacketSink captures every packet the server reads or writes to v, for auditing or debugging.
+// Passwords are not redacted from Packet, so v decides what it keeps.
+func SetPacketSink(v PacketSink) Option {
+	return func(s *Server) {
+		s.packetSink = v
+	}
+}
+
+// capture hands a packet to the sink of c, if there is one.  raw and p are copied, as the crypter
+// reuses them.
+func (c *crypter) capture(d Direction, raw []byte, p *Packet) {
+	if c.sink == nil {
+		return
+	}
+	now := time.Now()
+	if c.clock != nil {
+		now = c.clock()
+	}
+	cp := CapturedPacket{Direction: d, Time: now, Remote: c.device(), Raw: append([]byte(nil), raw...)}
+	if p != nil && p.Header != nil {
+		h := *p.Header
+		cp.Packet = &Packet{Header: &h, Body: append([]byte(nil), p.Body...)}
+	}
+	c.sink.Capture(cp)
+}
+
+// NewJSONPacketSink returns a PacketSink that writes every packet to w as a json line, with its
+// header and decoded body fields.  Fields that may hold passwords are redacted.
+func NewJSONPacketSink(w io.Writer) *JSONPacketSink {
+	return &JSONPacketSink{enc: json.NewEncoder(w)}
+}
+
+// JSONPacketSink is a PacketSink that logs decoded packets as json
+type JSONPacketSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// jsonPacket is a single line written by a JSONPacketSink
+type jsonPacket struct {
+	Direction Direction         `json:"direction"`
+	Time      time.Time         `json:"time"`
+	Remote    string            `json:"remote"`
+	Header    map[string]string `json:"header,omitempty"`
+	Body      map[string]string `json:"body,omitempty"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// Capture writes p as a json line
+func (j *JSONPacketSink) Capture(p CapturedPacket) {
+	line := jsonPacket{Direction: p.Direction, Time: p.Time, Remote: p.Remote}
+	if p.Packet != nil {
+		line.Header = p.Packet.Header.Fields()
+		switch body, err := decodeBody(p.Direction, p.Packet); {
+		case err != nil:
+			line.Error = err.Error()
+		case body != nil:
+			line.Body = summary{redact: true}.fields(body)
+		}
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.enc.Encode(line)
+}
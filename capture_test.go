@@ -0,0 +1,100 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// captureSink keeps every captured packet
+type captureSink struct {
+	mu      sync.Mutex
+	packets []CapturedPacket
+}
+
+func (c *captureSink) Capture(p CapturedPacket) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.packets = append(c.packets, p)
+}
+
+func (c *captureSink) captured() []CapturedPacket {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]CapturedPacket(nil), c.packets...)
+}
+
+func TestPacketSink(t *testing.T) {
+	sink := &captureSink{}
+	s := NewServer(nopLogger{}, nil, SetPacketSink(sink))
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.handle(context.Background(), newCrypter(roleServer, []byte("fooman"), server, false), authenStatusHandler(AuthenStatusPass))
+		close(done)
+	}()
+
+	request := proxyTestPacket()
+	clear, err := request.MarshalBinary()
+	require.NoError(t, err)
+	c := newCrypter(roleClient, []byte("fooman"), client, false)
+	_, err = c.write(request)
+	require.NoError(t, err)
+	// the request is left as it was, the wire bytes are a copy of it crypted
+	crypted := proxyTestPacket()
+	require.NoError(t, crypt([]byte("fooman"), crypted))
+	wire, err := crypted.MarshalBinary()
+	require.NoError(t, err)
+	_, err = c.read()
+	require.NoError(t, err)
+	client.Close()
+	<-done
+
+	packets := sink.captured()
+	require.Len(t, packets, 2)
+	read := packets[0]
+	assert.Equal(t, DirectionClient, read.Direction)
+	assert.Equal(t, wire, read.Raw)
+	assert.NotEqual(t, clear, read.Raw)
+	require.NotNil(t, read.Packet)
+	decoded, err := read.Packet.MarshalBinary()
+	require.NoError(t, err)
+	assert.Equal(t, clear, decoded)
+
+	written := packets[1]
+	assert.Equal(t, DirectionServer, written.Direction)
+	require.NotNil(t, written.Packet)
+	var reply AuthenReply
+	require.NoError(t, Unmarshal(written.Packet.Body, &reply))
+	assert.Equal(t, AuthenStatusPass, reply.Status)
+	assert.NotEqual(t, written.Packet.Body, written.Raw[MaxHeaderLength:])
+}
+
+func TestJSONPacketSink(t *testing.T) {
+	var b bytes.Buffer
+	sink := NewJSONPacketSink(&b)
+	request := outcomeTestRequest(Authenticate)
+	sink.Capture(CapturedPacket{Direction: DirectionClient, Remote: "192.0.2.1", Packet: request})
+
+	var line map[string]interface{}
+	require.NoError(t, json.Unmarshal(b.Bytes(), &line))
+	assert.Equal(t, "client", line["direction"])
+	assert.Equal(t, "192.0.2.1", line["remote"])
+	body, ok := line["body"].(map[string]interface{})
+	require.True(t, ok, line)
+	assert.Equal(t, "AuthenStart", body["packet-type"])
+	assert.Equal(t, "cisco", body["user"])
+}
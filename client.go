@@ -8,8 +8,14 @@
 package tacquito
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
 	"fmt"
 	"net"
+	"time"
+
+	"github.com/facebookincubator/tacquito/internal/testhooks"
 )
 
 // ClientOption is a setter type for Client
@@ -20,18 +26,13 @@ type ClientOption func(c *Client) error
 // with a nil source addr and a constructed TCPAddr from the provided network and address.
 // A secret for the connection must also be provided.
 func SetClientDialer(network, address string, secret []byte) ClientOption {
-	return func(c *Client) error {
-		tcpAddr, err := net.ResolveTCPAddr(network, address)
-		if err != nil {
-			return err
-		}
-		conn, err := net.DialTCP(network, nil, tcpAddr)
-		if err != nil {
-			return err
-		}
-		c.crypter = newCrypter(secret, conn, false)
-		return nil
-	}
+	return SetClientDialerContext(context.Background(), network, address, secret)
+}
+
+// SetClientDialerContext is SetClientDialer, giving up on resolving and dialing address once ctx
+// is done
+func SetClientDialerContext(ctx context.Context, network, address string, secret []byte) ClientOption {
+	return SetClientDialerWithLocalAddrContext(ctx, network, address, "", secret)
 }
 
 // SetClientDialerWithLocalAddr see net.ResolveTCPAddr for details, this follows
@@ -41,20 +42,46 @@ func SetClientDialer(network, address string, secret []byte) ClientOption {
 // with a nil source addr and a constructed TCPAddr from the provided network and address.
 // A secret for the connection must also be provided.
 func SetClientDialerWithLocalAddr(network, raddr, laddr string, secret []byte) ClientOption {
+	return SetClientDialerWithLocalAddrContext(context.Background(), network, raddr, laddr, secret)
+}
+
+// SetClientDialerWithLocalAddrContext is SetClientDialerWithLocalAddr, giving up on resolving and
+// dialing raddr once ctx is done
+func SetClientDialerWithLocalAddrContext(ctx context.Context, network, raddr, laddr string, secret []byte) ClientOption {
 	return func(c *Client) error {
-		localAddr, err := net.ResolveTCPAddr(network, laddr)
-		if err != nil {
-			fmt.Printf("unable to assign local address %v:%v, a default address will be chosen", laddr, err)
+		var d net.Dialer
+		if laddr != "" {
+			localAddr, err := net.ResolveTCPAddr(network, laddr)
+			if err != nil {
+				fmt.Printf("unable to assign local address %v:%v, a default address will be chosen", laddr, err)
+			} else {
+				d.LocalAddr = localAddr
+			}
 		}
-		tcpAddr, err := net.ResolveTCPAddr(network, raddr)
+		conn, err := d.DialContext(ctx, network, raddr)
 		if err != nil {
 			return err
 		}
-		conn, err := net.DialTCP(network, localAddr, tcpAddr)
-		if err != nil {
-			return err
+		c.crypter = newCrypter(roleClient, secret, conn, false)
+		return nil
+	}
+}
+
+func init() {
+	testhooks.ClientOption = func(h *testhooks.Hooks) interface{} { return setClientTestHooks(h) }
+}
+
+// setClientTestHooks replaces the session ids and clock of the client with those of h, see the
+// tacquitotest package, which applies it through testhooks.ClientOption.  A nil h keeps the
+// defaults.
+func setClientTestHooks(h *testhooks.Hooks) ClientOption {
+	return func(c *Client) error {
+		if h != nil && h.SessionID != nil {
+			c.sessionID = func() SessionID { return SessionID(h.SessionID()) }
+		}
+		if h != nil && h.Now != nil {
+			c.clock = h.Now
 		}
-		c.crypter = newCrypter(secret, conn, false)
 		return nil
 	}
 }
@@ -69,24 +96,56 @@ func NewClient(opts ...ClientOption) (*Client, error) {
 			return nil, err
 		}
 	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
 	return c, nil
 }
 
 // Client base client implementation for server/client communication
 type Client struct {
 	crypter *crypter
+	// sessionID returns the id of each session the client starts, see NewSessionID
+	sessionID func() SessionID
+	// clock returns the wall time, time.Now if nil
+	clock func() time.Time
+}
+
+// now returns the wall time of the client
+func (c *Client) now() time.Time {
+	if c.clock != nil {
+		return c.clock()
+	}
+	return time.Now()
+}
+
+// NewSessionID returns an id for a new session of the client.  Ids are cryptographically random,
+// as rfc8907 requires, unless the client was built with the session ids of the tacquitotest
+// package.
+func (c *Client) NewSessionID() SessionID {
+	if c.sessionID != nil {
+		return c.sessionID()
+	}
+	var b [4]byte
+	rand.Read(b[:])
+	return SessionID(binary.BigEndian.Uint32(b[:]))
 }
 
 // Send sends a packet to the server and decodes the response.  If multiple packet exchanges are
 // necessary, the caller will need to call this method repeatedly to achieve the desired
 // result.
 func (c *Client) Send(p *Packet) (*Packet, error) {
-	_, err := c.crypter.write(p)
-	if err != nil {
+	return c.SendContext(context.Background(), p)
+}
+
+// SendContext is Send, returning ctx.Err() once ctx is done, even part way through writing the
+// packet or reading the response.  An interrupted exchange leaves the connection part way through
+// a packet, so the client must be closed after one.
+func (c *Client) SendContext(ctx context.Context, p *Packet) (*Packet, error) {
+	if _, err := c.crypter.writeContext(ctx, p); err != nil {
 		return nil, err
 	}
-	return c.crypter.read()
-
+	return c.crypter.readContext(ctx)
 }
 
 // Close ...
@@ -0,0 +1,81 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/facebookincubator/tacquito/internal/testhooks"
+)
+
+// SetClock sets the wall clock that requests are stamped with, see ContextEventTime.  The default
+// is time.Now.  Durations never use it, they are measured on the monotonic clock from when each
+// packet was received, so a clock that steps backwards cannot make them negative.
+func SetClock(fn func() time.Time) Option {
+	return func(s *Server) {
+		s.clock = fn
+	}
+}
+
+func init() {
+	testhooks.ServerOption = func(h *testhooks.Hooks) interface{} { return setTestHooks(h) }
+}
+
+// setTestHooks replaces the wall clock and the idle read deadlines of the server with those of h,
+// see the tacquitotest package, which applies it through testhooks.ServerOption.  The clock also
+// stamps captured packets.  A nil h keeps the defaults.
+func setTestHooks(h *testhooks.Hooks) Option {
+	return func(s *Server) {
+		if h == nil {
+			return
+		}
+		if h.Now != nil {
+			s.clock = h.Now
+		}
+		if h.Deadline != nil {
+			s.deadline = h.Deadline
+		}
+	}
+}
+
+// idleDeadline returns the read deadline of a connection that may idle for d, lengthened by the
+// jitter of s
+func (s *Server) idleDeadline(d time.Duration) time.Time {
+	d = s.jitter(d)
+	if s.deadline != nil {
+		return s.deadline(d)
+	}
+	return time.Now().Add(d)
+}
+
+// stamp adds the wall time and the monotonic receive time of a packet received at received to ctx
+func (s *Server) stamp(ctx context.Context, received time.Time) context.Context {
+	ctx = context.WithValue(ctx, ContextEventTime, s.clock().UTC().Format(time.RFC3339Nano))
+	ctx = context.WithValue(ctx, ContextReceiveOffset, strconv.FormatInt(received.Sub(s.started).Microseconds(), 10))
+	return context.WithValue(ctx, contextReceived, received)
+}
+
+// Latency returns how long ago the packet of the request with ctx was received by the server.  It
+// is measured on the monotonic clock and is never negative.
+func Latency(ctx context.Context) (time.Duration, bool) {
+	if ctx == nil {
+		return 0, false
+	}
+	received, ok := ctx.Value(contextReceived).(time.Time)
+	if !ok {
+		return 0, false
+	}
+	d := time.Since(received)
+	if d < 0 {
+		// only reachable for a received time without a monotonic reading
+		d = 0
+	}
+	return d, true
+}
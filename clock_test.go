@@ -0,0 +1,74 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClockStepsBackwards(t *testing.T) {
+	// every reading of the wall clock is an hour before the last, as if ntp stepped it
+	wall := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time {
+		wall = wall.Add(-time.Hour)
+		return wall
+	}
+	contexts := make(chan context.Context, 2)
+	s := NewServer(nopLogger{}, nil, SetClock(clock), SetImplicitSessionReuse(true))
+	client, server := net.Pipe()
+	defer client.Close()
+	go s.handle(context.Background(), newCrypter(roleServer, []byte("fooman"), server, false), HandlerFunc(func(response Response, request Request) {
+		time.Sleep(time.Millisecond)
+		contexts <- request.Context
+		response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusPass)))
+	}))
+
+	c := newCrypter(roleClient, []byte("fooman"), client, false)
+	var events []time.Time
+	var offsets []int64
+	for _, id := range []SessionID{12345, 12346} {
+		p := outcomeTestRequest(Authenticate)
+		p.Header.SessionID = id
+		_, err := c.write(p)
+		assert.NoError(t, err)
+		_, err = c.read()
+		assert.NoError(t, err)
+
+		ctx := <-contexts
+		latency, ok := Latency(ctx)
+		assert.True(t, ok)
+		assert.GreaterOrEqual(t, latency, time.Millisecond)
+		event, err := time.Parse(time.RFC3339Nano, ctx.Value(ContextEventTime).(string))
+		assert.NoError(t, err)
+		offset, err := strconv.ParseInt(ctx.Value(ContextReceiveOffset).(string), 10, 64)
+		assert.NoError(t, err)
+		events = append(events, event)
+		offsets = append(offsets, offset)
+	}
+	assert.True(t, events[1].Before(events[0]), "the wall clock should have stepped backwards")
+	assert.GreaterOrEqual(t, offsets[0], int64(0))
+	assert.Greater(t, offsets[1], offsets[0], "receive offsets are monotonic")
+}
+
+func TestLatencyWithoutStamp(t *testing.T) {
+	_, ok := Latency(nil)
+	assert.False(t, ok)
+	_, ok = Latency(context.Background())
+	assert.False(t, ok)
+	// a received time read back from a record has no monotonic reading
+	ctx := context.WithValue(context.Background(), contextReceived, time.Now().Add(time.Hour).Round(0))
+	latency, ok := Latency(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), latency)
+}
@@ -0,0 +1,82 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+)
+
+// CloseReason is why the server closed a connection
+type CloseReason string
+
+const (
+	// CloseClientEOF is a connection the client closed
+	CloseClientEOF CloseReason = "client-eof"
+	// CloseIdleTimeout is a connection that sat idle longer than the idle timeout
+	CloseIdleTimeout CloseReason = "idle-timeout"
+	// CloseBadSecret is a connection from a client that does not share our secret
+	CloseBadSecret CloseReason = "bad-secret"
+	// CloseWrongDirection is a connection that sent a packet of the opposite direction, eg a reply
+	CloseWrongDirection CloseReason = "wrong-direction"
+	// CloseReadError is a connection that sent a packet which could not be read
+	CloseReadError CloseReason = "read-error"
+	// CloseSessionError is a connection that sent a packet for a session it may not use
+	CloseSessionError CloseReason = "session-error"
+	// CloseHandlerPanic is a connection whose handler panicked
+	CloseHandlerPanic CloseReason = "handler-panic"
+	// CloseShutdown is a connection closed because the server is shutting down
+	CloseShutdown CloseReason = "shutdown"
+	// CloseUnknownDevice is a connection from a source without a secret
+	CloseUnknownDevice CloseReason = "unknown-device"
+	// CloseProxyError is a proxied connection with a bad proxy header
+	CloseProxyError CloseReason = "proxy-error"
+	// CloseLifetime is a connection that outlived SetMaxConnectionLifetime
+	CloseLifetime CloseReason = "lifetime"
+	// CloseSecretRevoked is a connection whose secret was removed, see SetSecretGracePeriod
+	CloseSecretRevoked CloseReason = "secret-revoked"
+	// CloseSecretRotated is a connection retired after the secret of its device group was
+	// rotated, see RetireGroup
+	CloseSecretRotated CloseReason = "secret-rotated"
+	// CloseTLSHandshake is a TLS connection whose handshake failed, eg as no virtual host serves
+	// it, see SetTLSVirtualHosts
+	CloseTLSHandshake CloseReason = "tls-handshake"
+	// CloseRejected is a connection a ConnectFunc rejected, see SetOnConnect
+	CloseRejected CloseReason = "rejected"
+	// CloseUnencrypted is a connection that sent a packet with UnencryptedFlag to a server that
+	// rejects them, see SetRejectUnencrypted
+	CloseUnencrypted CloseReason = "unencrypted"
+)
+
+// CloseFunc is called once for every connection the server closes, see SetOnClose
+type CloseFunc func(ctx context.Context, remote net.Addr, reason CloseReason)
+
+// readCloseReason returns the reason to close a connection after a failed read
+func readCloseReason(err error) CloseReason {
+	var badSecret *BadSecretErr
+	var wrongDirection *ErrWrongDirection
+	var unencrypted *ErrUnencrypted
+	var netErr net.Error
+	switch {
+	case err == io.EOF:
+		return CloseClientEOF
+	case errors.As(err, &badSecret):
+		return CloseBadSecret
+	case errors.As(err, &wrongDirection):
+		return CloseWrongDirection
+	case errors.As(err, &unencrypted):
+		return CloseUnencrypted
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return CloseIdleTimeout
+	case isErrSequence(err):
+		return CloseSessionError
+	}
+	return CloseReadError
+}
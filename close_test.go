@@ -0,0 +1,85 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCloseReason(t *testing.T) {
+	pass := HandlerFunc(func(response Response, request Request) {
+		response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusPass)))
+	})
+	tests := []struct {
+		name    string
+		secret  string
+		send    bool
+		packet  *Packet
+		handler Handler
+		reason  CloseReason
+	}{
+		{name: "idle timeout", handler: pass, reason: CloseIdleTimeout},
+		{name: "bad secret", secret: "not-fooman", send: true, handler: pass, reason: CloseBadSecret},
+		{name: "client eof", send: true, handler: pass, reason: CloseClientEOF},
+		{
+			name: "handler panic",
+			send: true,
+			handler: HandlerFunc(func(response Response, request Request) {
+				panic("boom")
+			}),
+			reason: CloseHandlerPanic,
+		},
+		{name: "wrong direction", send: true, packet: wrongDirectionTestReply(), handler: pass, reason: CloseWrongDirection},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			secret := []byte("fooman")
+			if test.secret != "" {
+				secret = []byte(test.secret)
+			}
+			reasons := make(chan CloseReason, 1)
+			s := NewServer(nopLogger{}, nil, SetIdleTimeout(50*time.Millisecond), SetOnClose(func(ctx context.Context, remote net.Addr, reason CloseReason) {
+				reasons <- reason
+			}))
+			client, server := net.Pipe()
+			defer client.Close()
+			before := metricValue(connectionClosed.WithLabelValues(string(test.reason)))
+			go s.handle(context.Background(), newCrypter(roleServer, []byte("fooman"), server, false), test.handler)
+
+			if test.send {
+				c := newCrypter(roleClient, secret, client, false)
+				packet := test.packet
+				if packet == nil {
+					packet = outcomeTestRequest(Authenticate)
+				}
+				_, err := c.write(packet)
+				assert.NoError(t, err)
+				if test.reason != CloseHandlerPanic && test.reason != CloseWrongDirection {
+					// a client with a bad secret cannot decode the reply, so only wait for it
+					_, err = readRawPacket(client)
+					assert.NoError(t, err)
+				}
+				if test.reason == CloseClientEOF {
+					client.Close()
+				}
+			}
+			select {
+			case reason := <-reasons:
+				assert.Equal(t, test.reason, reason)
+			case <-time.After(5 * time.Second):
+				t.Fatal("connection was not closed")
+			}
+			assert.Equal(t, before+1, metricValue(connectionClosed.WithLabelValues(string(test.reason))))
+		})
+	}
+}
@@ -20,11 +20,12 @@ type asciiSequence struct {
 	validate func(response []byte)
 }
 
-func ascii(c *tq.Client) {
-	fmt.Println("execute ascii authentication")
+// ascii runs an ascii login for service, login or enable
+func ascii(c *tq.Client, service tq.AuthenService) {
+	fmt.Printf("execute ascii authentication for %v\n", service.Name())
 	var resp *tq.Packet
 	var err error
-	for _, s := range newASCIIAuthenSequence(getPassword()) {
+	for _, s := range newASCIIAuthenSequence(getPassword(), service) {
 		resp, err = c.Send(s.packet)
 		if err != nil {
 			fmt.Printf("%v\n", err)
@@ -34,7 +35,7 @@ func ascii(c *tq.Client) {
 	}
 	printASCIIResponse(resp)
 }
-func newASCIIAuthenSequence(password string) []asciiSequence {
+func newASCIIAuthenSequence(password string, service tq.AuthenService) []asciiSequence {
 	authenRequest := asciiSequence{
 		packet: tq.NewPacket(
 			tq.SetPacketHeader(
@@ -47,9 +48,9 @@ func newASCIIAuthenSequence(password string) []asciiSequence {
 			tq.SetPacketBodyUnsafe(
 				tq.NewAuthenStart(
 					tq.SetAuthenStartAction(tq.AuthenActionLogin),
-					tq.SetAuthenStartPrivLvl(tq.PrivLvlUser),
+					tq.SetAuthenStartPrivLvl(tq.PrivLvl(*privLvl)),
 					tq.SetAuthenStartType(tq.AuthenTypeASCII),
-					tq.SetAuthenStartService(tq.AuthenServiceLogin),
+					tq.SetAuthenStartService(service),
 					tq.SetAuthenStartPort(tq.AuthenPort("tty0")),
 					tq.SetAuthenStartRemAddr(tq.AuthenRemAddr("devvm2515")),
 				),
@@ -39,6 +39,7 @@ func newPAPRequest(password string) *tq.Packet {
 			tq.NewAuthenStart(
 				tq.SetAuthenStartType(tq.AuthenTypePAP),
 				tq.SetAuthenStartAction(tq.AuthenActionLogin),
+				tq.SetAuthenStartService(tq.AuthenServiceLogin),
 				tq.SetAuthenStartPrivLvl(tq.PrivLvl(*privLvl)),
 				tq.SetAuthenStartPort(tq.AuthenPort(*port)),
 				tq.SetAuthenStartRemAddr(tq.AuthenRemAddr(*remAddr)),
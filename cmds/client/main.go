@@ -27,7 +27,7 @@ var (
 	port       = flag.String("port", "", "the port the client is sourced from, tty0 for example.")
 	remAddr    = flag.String("rem-addr", "", "the remote address the client is coming from.")
 	secret     = flag.String("secret", "fooman", "the tacacs secret to be used.")
-	authenMode = flag.String("authen-mode", "pap", "valid choices, [pap ascii]")
+	authenMode = flag.String("authen-mode", "pap", "valid choices, [pap ascii enable]")
 )
 
 func main() {
@@ -44,7 +44,10 @@ func main() {
 	case "pap":
 		pap(c)
 	case "ascii":
-		ascii(c)
+		ascii(c, tq.AuthenServiceLogin)
+	case "enable":
+		// an enable request is an ascii login for the enable service, at the priv lvl requested
+		ascii(c, tq.AuthenServiceEnable)
 	default:
 		fmt.Printf("%v is an invalid mode", *authenMode)
 	}
@@ -0,0 +1,57 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+// decode reads recorded session fixtures and renders them in a human readable form
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	tq "github.com/facebookincubator/tacquito"
+)
+
+var (
+	fixturePath = flag.String("fixture", "", "path to a json encoded session fixture, reads stdin if empty")
+	mermaid     = flag.Bool("mermaid", false, "append a mermaid sequence diagram to the summary")
+	unredacted  = flag.Bool("unredacted", false, "do not redact fields that may contain passwords")
+)
+
+func main() {
+	flag.Parse()
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	in := os.Stdin
+	if *fixturePath != "" {
+		f, err := os.Open(*fixturePath)
+		if err != nil {
+			return fmt.Errorf("unable to open fixture; %w", err)
+		}
+		defer f.Close()
+		in = f
+	}
+	fixture, err := tq.ReadSessionFixture(in)
+	if err != nil {
+		return err
+	}
+	summary, err := tq.SummarizeSession(
+		fixture,
+		tq.SetSummaryMermaid(*mermaid),
+		tq.SetSummaryRedact(!*unredacted),
+	)
+	if err != nil {
+		return err
+	}
+	fmt.Print(summary)
+	return nil
+}
@@ -0,0 +1,122 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	tq "github.com/facebookincubator/tacquito"
+	"github.com/facebookincubator/tacquito/cmds/server/config/accounters/batch"
+)
+
+// spillCollectInterval is how often the spill files of a previous run are collected
+const spillCollectInterval = time.Hour
+
+// newBatchAccounter returns an accounter that writes the records of -acct-log-path in batches, as
+// json lines, per -acct-batch-size and -acct-batch-interval.  With -acct-arg-spill-dir, oversized
+// cmd-arg values are spilled while their records are held, and the values of each written record
+// are kept by hash in the directory -acct-log-path.args, which its args-spill field references.
+func newBatchAccounter(ctx context.Context, logger *defaultLogger) (*batch.Accounter, error) {
+	f, err := os.OpenFile(*accountingLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	opts := []batch.Option{batch.SetSize(*acctBatchSize), batch.SetInterval(*acctBatchInterval)}
+	var spill *tq.ArgSpill
+	if *acctArgSpillDir != "" {
+		spill, err = tq.NewArgSpill(*acctArgSpillDir, *acctArgSpillSize)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(*accountingLogPath+".args", 0700); err != nil {
+			return nil, fmt.Errorf("unable to create the directory of spilled values; %w", err)
+		}
+		opts = append(opts, batch.SetArgSpill(spill))
+		go collectSpill(ctx, logger, spill)
+	}
+	w := batch.WriterFunc(func(ctx context.Context, records []batch.Record) error {
+		var b bytes.Buffer
+		enc := json.NewEncoder(&b)
+		for _, r := range records {
+			if err := keepSpilled(spill, r); err != nil {
+				return err
+			}
+			if err := enc.Encode(r); err != nil {
+				return err
+			}
+		}
+		if _, err := f.Write(b.Bytes()); err != nil {
+			return err
+		}
+		return f.Sync()
+	})
+	return batch.New(logger, w, opts...)
+}
+
+// keepSpilled copies the spilled values of r, if any, to the directory -acct-log-path.args.  They
+// are streamed from the spill file, and values already kept for another record are not copied.
+func keepSpilled(spill *tq.ArgSpill, r batch.Record) error {
+	raw, ok := r["args-spill"]
+	if !ok || spill == nil {
+		return nil
+	}
+	ref, err := tq.ParseArgRef(raw)
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(*accountingLogPath+".args", ref.Hash)
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+	src, err := spill.Open(ref)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".keep-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, src); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to keep spilled values [%v]; %w", ref, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// collectSpill removes the spill files of a previous run once they are older than
+// -acct-arg-spill-retention, until ctx is done
+func collectSpill(ctx context.Context, logger *defaultLogger, spill *tq.ArgSpill) {
+	ticker := time.NewTicker(spillCollectInterval)
+	defer ticker.Stop()
+	for {
+		if n := spill.Collect(time.Now().Add(-*acctArgSpillKeep)); n > 0 {
+			logger.Infof(ctx, "removed [%v] spill files of a previous run", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,316 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+// Package admin serves an http api that operators use to query and control a running server:
+// its status, draining it, maintenance mode, the log level and reloading its config.  Every
+// request must pass the Auth the handler is built with.
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	tq "github.com/facebookincubator/tacquito"
+	"github.com/facebookincubator/tacquito/cmds/server/loader"
+)
+
+// server is the part of tq.Server the api controls
+type server interface {
+	Status() tq.ServerStatus
+	StartMaintenance(detail string)
+	StopMaintenance()
+}
+
+// levelController reads and sets the log level of the server
+type levelController interface {
+	Level() int
+	SetLevel(level int) error
+}
+
+// reloader reloads the config of the server, see fsnotify.Watcher.Reload
+type reloader interface {
+	Reload() error
+}
+
+// effectiveReporter reports the effective policy of a device or device group, see
+// loader.Loader.Effective
+type effectiveReporter interface {
+	Effective(ctx context.Context, query string) (loader.Effective, error)
+}
+
+// diagnoser runs a synthetic exercise, see tq.Diagnostics
+type diagnoser interface {
+	Run(ctx context.Context) (tq.DiagnosticReport, error)
+}
+
+// Controls are what the api operates on.  An endpoint whose control is unset answers 501.
+type Controls struct {
+	Server server
+	// Drain starts a graceful shutdown of the server, eg by cancelling the context it serves with
+	Drain  func()
+	Logger levelController
+	Config reloader
+	// Effective reports the policy a device or device group is served with.  It names users, which
+	// is why it is only served here, behind auth.
+	Effective effectiveReporter
+	// Diagnostics logs in to the server as a synthetic user, so it is only run here, behind auth.
+	Diagnostics diagnoser
+}
+
+// Auth decides if r may use the api, returning an error if it may not
+type Auth func(r *http.Request) error
+
+// TokenAuth authenticates requests that carry token as a bearer token in their Authorization
+// header
+func TokenAuth(token []byte) Auth {
+	return func(r *http.Request) error {
+		v := r.Header.Get("Authorization")
+		if !strings.HasPrefix(v, "Bearer ") {
+			return errors.New("a bearer token is required")
+		}
+		if subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(v, "Bearer ")), token) != 1 {
+			return errors.New("bad bearer token")
+		}
+		return nil
+	}
+}
+
+// NewHandler returns the api over c, for requests that pass auth.  It serves, as json:
+//
+//	GET /v1/status                   the tq.ServerStatus of the server
+//	POST /v1/drain                   starts a graceful shutdown, answered 202
+//	GET /v1/maintenance              the maintenance state
+//	POST /v1/maintenance?detail=...  starts maintenance mode
+//	DELETE /v1/maintenance           stops maintenance mode
+//	GET /v1/log-level                the log level
+//	PUT /v1/log-level?level=20       sets the log level
+//	POST /v1/reload                  reloads the config
+//	GET /v1/effective?query=...      the loader.Effective policy of an address or device group
+//	POST /v1/diagnostics             runs the synthetic exercise of tq.Diagnostics
+func NewHandler(c Controls, auth Auth) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/status", c.status)
+	mux.HandleFunc("/v1/drain", c.drain)
+	mux.HandleFunc("/v1/maintenance", c.maintenance)
+	mux.HandleFunc("/v1/log-level", c.logLevel)
+	mux.HandleFunc("/v1/reload", c.reload)
+	mux.HandleFunc("/v1/effective", c.effective)
+	mux.HandleFunc("/v1/diagnostics", c.diagnostics)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth == nil {
+			writeError(w, http.StatusForbidden, errors.New("the admin api has no auth configured"))
+			return
+		}
+		if err := auth(r); err != nil {
+			adminRequests.WithLabelValues("unauthorized").Inc()
+			writeError(w, http.StatusUnauthorized, err)
+			return
+		}
+		adminRequests.WithLabelValues("authorized").Inc()
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// ListenAndServe serves h on address until ctx is done.  Requests carry the bearer token of
+// TokenAuth, so h is served over tls with config.  Without config, plain http is only served on a
+// loopback address, where the token does not cross the network.
+func ListenAndServe(ctx context.Context, address string, h http.Handler, config *tls.Config) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	if config == nil {
+		if addr, ok := listener.Addr().(*net.TCPAddr); !ok || !addr.IP.IsLoopback() {
+			listener.Close()
+			return fmt.Errorf("the admin api serves plain http on a loopback address only, configure tls to serve it on [%v]", address)
+		}
+	} else {
+		listener = tls.NewListener(listener, config)
+	}
+	s := &http.Server{Handler: h, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		s.Close()
+	}()
+	log.Printf("starting admin api, listening [%v] tls [%v]", listener.Addr(), config != nil)
+	if err := s.Serve(listener); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// MaintenanceState is the body of the maintenance endpoint
+type MaintenanceState struct {
+	Maintenance bool   `json:"maintenance"`
+	Detail      string `json:"detail,omitempty"`
+}
+
+// LogLevel is the body of the log-level endpoint
+type LogLevel struct {
+	Level int `json:"level"`
+}
+
+// status serves the status of the server
+func (c Controls) status(w http.ResponseWriter, r *http.Request) {
+	if !allowed(w, r, http.MethodGet) || !available(w, c.Server != nil, "status") {
+		return
+	}
+	writeJSON(w, http.StatusOK, c.Server.Status())
+}
+
+// drain starts a graceful shutdown of the server
+func (c Controls) drain(w http.ResponseWriter, r *http.Request) {
+	if !allowed(w, r, http.MethodPost) || !available(w, c.Drain != nil, "drain") {
+		return
+	}
+	log.Printf("admin api: draining the server, requested by [%v]", r.RemoteAddr)
+	c.Drain()
+	writeJSON(w, http.StatusAccepted, struct {
+		Draining bool `json:"draining"`
+	}{true})
+}
+
+// maintenance reads or toggles maintenance mode
+func (c Controls) maintenance(w http.ResponseWriter, r *http.Request) {
+	if !allowed(w, r, http.MethodGet, http.MethodPost, http.MethodDelete) || !available(w, c.Server != nil, "maintenance") {
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		detail := r.URL.Query().Get("detail")
+		log.Printf("admin api: starting maintenance mode [%v], requested by [%v]", detail, r.RemoteAddr)
+		c.Server.StartMaintenance(detail)
+	case http.MethodDelete:
+		log.Printf("admin api: stopping maintenance mode, requested by [%v]", r.RemoteAddr)
+		c.Server.StopMaintenance()
+	}
+	s := c.Server.Status()
+	writeJSON(w, http.StatusOK, MaintenanceState{Maintenance: s.Maintenance, Detail: s.MaintenanceDetail})
+}
+
+// logLevel reads or sets the log level
+func (c Controls) logLevel(w http.ResponseWriter, r *http.Request) {
+	if !allowed(w, r, http.MethodGet, http.MethodPut) || !available(w, c.Logger != nil, "log level") {
+		return
+	}
+	if r.Method == http.MethodPut {
+		level, err := strconv.Atoi(r.URL.Query().Get("level"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("level must be a number; %v", err))
+			return
+		}
+		if err := c.Logger.SetLevel(level); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		log.Printf("admin api: log level set to [%v], requested by [%v]", level, r.RemoteAddr)
+	}
+	writeJSON(w, http.StatusOK, LogLevel{Level: c.Logger.Level()})
+}
+
+// reload reloads the config
+func (c Controls) reload(w http.ResponseWriter, r *http.Request) {
+	if !allowed(w, r, http.MethodPost) || !available(w, c.Config != nil, "reload") {
+		return
+	}
+	log.Printf("admin api: reloading the config, requested by [%v]", r.RemoteAddr)
+	if err := c.Config.Reload(); err != nil {
+		// the previous config stays in place
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Reloaded bool `json:"reloaded"`
+	}{true})
+}
+
+// effective serves the effective policy of the device or device group named by the query
+// parameter query
+func (c Controls) effective(w http.ResponseWriter, r *http.Request) {
+	if !allowed(w, r, http.MethodGet) || !available(w, c.Effective != nil, "effective") {
+		return
+	}
+	query := r.URL.Query().Get("query")
+	if query == "" {
+		writeError(w, http.StatusBadRequest, errors.New("query is an address or a device group"))
+		return
+	}
+	effective, err := c.Effective.Effective(r.Context(), query)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, effective)
+}
+
+// diagnostics runs the synthetic exercise and reports its per stage timings.  Runs over the rate
+// limit are answered with 429 and a Retry-After header.
+func (c Controls) diagnostics(w http.ResponseWriter, r *http.Request) {
+	if !allowed(w, r, http.MethodPost) || !available(w, c.Diagnostics != nil, "diagnostics") {
+		return
+	}
+	report, err := c.Diagnostics.Run(r.Context())
+	var le *tq.DiagnosticLimitError
+	if errors.As(err, &le) {
+		// a run in progress has no fixed end, a second is as good a guess as any
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(le.RetryAfter.Seconds())))))
+		writeError(w, http.StatusTooManyRequests, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// allowed answers 405 and returns false if r is not one of methods
+func allowed(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method [%v] is not allowed", r.Method))
+	return false
+}
+
+// available answers 501 and returns false if the control of endpoint is unset
+func available(w http.ResponseWriter, ok bool, endpoint string) bool {
+	if !ok {
+		writeError(w, http.StatusNotImplemented, fmt.Errorf("%v is not available on this server", endpoint))
+	}
+	return ok
+}
+
+// writeError writes err as the json error of a response with code
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
+
+// writeJSON writes v as the json body of a response with code
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("unable to write admin response; %v", err)
+	}
+}
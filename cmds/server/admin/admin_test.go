@@ -0,0 +1,322 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	tq "github.com/facebookincubator/tacquito"
+	"github.com/facebookincubator/tacquito/cmds/server/loader"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// secretProvider serves every device with one secret and a handler that passes
+type secretProvider struct{}
+
+// Get implements tq.SecretProvider
+func (secretProvider) Get(ctx context.Context, remote net.Addr) ([]byte, tq.Handler, error) {
+	return []byte("fooman"), tq.HandlerFunc(func(response tq.Response, request tq.Request) {
+		response.Reply(tq.NewAuthenReply(tq.SetAuthenReplyStatus(tq.AuthenStatusPass)))
+	}), nil
+}
+
+// nopLogger discards the logs of the server
+type nopLogger struct{}
+
+func (nopLogger) Infof(ctx context.Context, format string, args ...interface{})  {}
+func (nopLogger) Errorf(ctx context.Context, format string, args ...interface{}) {}
+func (nopLogger) Debugf(ctx context.Context, format string, args ...interface{}) {}
+func (nopLogger) Record(ctx context.Context, r map[string]string, obscure ...string) {
+}
+
+// levels is a levelController
+type levels struct{ level int }
+
+func (l *levels) Level() int { return l.level }
+
+func (l *levels) SetLevel(level int) error {
+	if level != 10 && level != 20 && level != 30 {
+		return fmt.Errorf("unknown log level [%v]", level)
+	}
+	l.level = level
+	return nil
+}
+
+// reloads is a reloader that counts its reloads, failing with err
+type reloads struct {
+	n   int
+	err error
+}
+
+func (r *reloads) Reload() error {
+	r.n++
+	return r.err
+}
+
+// effectives reports the effective policy of the device group core
+type effectives struct{}
+
+func (effectives) Effective(ctx context.Context, query string) (loader.Effective, error) {
+	if query != "core" {
+		return loader.Effective{}, fmt.Errorf("no device or device group [%v]", query)
+	}
+	return loader.Effective{Group: "core", SecretFingerprint: "0011223344556677"}, nil
+}
+
+const testToken = "s3cret-token"
+
+// adminTestServer is a tacquito server on a test listener with its admin api
+type adminTestServer struct {
+	*tq.Server
+	api     *httptest.Server
+	levels  *levels
+	reloads *reloads
+	// served is closed once the server stopped serving
+	served chan struct{}
+}
+
+// newAdminTestServer starts a server and serves its admin api
+func newAdminTestServer(t *testing.T) *adminTestServer {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	require.NoError(t, err)
+	s := &adminTestServer{
+		Server:  tq.NewServer(nopLogger{}, secretProvider{}, tq.SetShutdownBudget(time.Second)),
+		levels:  &levels{level: 20},
+		reloads: &reloads{},
+		served:  make(chan struct{}),
+	}
+	go func() {
+		s.Serve(ctx, listener.(*net.TCPListener))
+		close(s.served)
+	}()
+	s.api = httptest.NewServer(NewHandler(Controls{Server: s.Server, Drain: cancel, Logger: s.levels, Config: s.reloads, Effective: effectives{}}, TokenAuth([]byte(testToken))))
+	t.Cleanup(s.api.Close)
+	return s
+}
+
+// do sends an authenticated request to the api and decodes its json body into v, if set
+func (s *adminTestServer) do(t *testing.T, method, path string, v interface{}) int {
+	r, err := http.NewRequest(method, s.api.URL+path, nil)
+	require.NoError(t, err)
+	r.Header.Set("Authorization", "Bearer "+testToken)
+	resp, err := http.DefaultClient.Do(r)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	if v != nil {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+	}
+	return resp.StatusCode
+}
+
+func TestAuth(t *testing.T) {
+	s := newAdminTestServer(t)
+	for name, header := range map[string]string{
+		"no token":    "",
+		"bad token":   "Bearer not-" + testToken,
+		"basic auth":  "Basic " + testToken,
+		"token alone": testToken,
+	} {
+		t.Run(name, func(t *testing.T) {
+			r, err := http.NewRequest(http.MethodPost, s.api.URL+"/v1/maintenance", nil)
+			require.NoError(t, err)
+			if header != "" {
+				r.Header.Set("Authorization", header)
+			}
+			resp, err := http.DefaultClient.Do(r)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		})
+	}
+	_, on := s.Maintenance()
+	assert.False(t, on, "unauthorized requests change nothing")
+
+	// a handler without auth serves nothing
+	w := httptest.NewRecorder()
+	NewHandler(Controls{Server: s.Server}, nil).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/status", nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+// TestListenAndServeTLS asserts plain http is only served on loopback addresses
+func TestListenAndServeTLS(t *testing.T) {
+	h := NewHandler(Controls{}, TokenAuth([]byte(testToken)))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := ListenAndServe(ctx, ":0", h, nil)
+	require.Error(t, err, "plain http on every address")
+	assert.Contains(t, err.Error(), "loopback")
+	assert.NoError(t, ListenAndServe(ctx, "127.0.0.1:0", h, nil))
+
+	ts := httptest.NewTLSServer(h)
+	defer ts.Close()
+	assert.NoError(t, ListenAndServe(ctx, ":0", h, ts.TLS))
+}
+
+func TestStatus(t *testing.T) {
+	s := newAdminTestServer(t)
+	var status tq.ServerStatus
+	assert.Equal(t, http.StatusOK, s.do(t, http.MethodGet, "/v1/status", &status))
+	assert.Equal(t, tq.ShutdownServing, status.Shutdown)
+	assert.Equal(t, http.StatusMethodNotAllowed, s.do(t, http.MethodPost, "/v1/status", nil))
+}
+
+func TestMaintenance(t *testing.T) {
+	s := newAdminTestServer(t)
+	var state MaintenanceState
+	assert.Equal(t, http.StatusOK, s.do(t, http.MethodPost, "/v1/maintenance?detail=retry+in+5m", &state))
+	assert.Equal(t, MaintenanceState{Maintenance: true, Detail: "retry in 5m"}, state)
+	detail, on := s.Maintenance()
+	assert.True(t, on)
+	assert.Equal(t, "retry in 5m", detail)
+
+	state = MaintenanceState{}
+	assert.Equal(t, http.StatusOK, s.do(t, http.MethodGet, "/v1/maintenance", &state))
+	assert.True(t, state.Maintenance)
+
+	state = MaintenanceState{}
+	assert.Equal(t, http.StatusOK, s.do(t, http.MethodDelete, "/v1/maintenance", &state))
+	assert.Equal(t, MaintenanceState{}, state)
+	_, on = s.Maintenance()
+	assert.False(t, on)
+}
+
+func TestLogLevel(t *testing.T) {
+	s := newAdminTestServer(t)
+	var level LogLevel
+	assert.Equal(t, http.StatusOK, s.do(t, http.MethodGet, "/v1/log-level", &level))
+	assert.Equal(t, 20, level.Level)
+	assert.Equal(t, http.StatusOK, s.do(t, http.MethodPut, "/v1/log-level?level=30", &level))
+	assert.Equal(t, 30, level.Level)
+	assert.Equal(t, 30, s.levels.Level())
+
+	assert.Equal(t, http.StatusBadRequest, s.do(t, http.MethodPut, "/v1/log-level?level=debug", nil))
+	assert.Equal(t, http.StatusBadRequest, s.do(t, http.MethodPut, "/v1/log-level?level=40", nil))
+	assert.Equal(t, 30, s.levels.Level())
+}
+
+func TestReload(t *testing.T) {
+	s := newAdminTestServer(t)
+	assert.Equal(t, http.StatusOK, s.do(t, http.MethodPost, "/v1/reload", nil))
+	assert.Equal(t, 1, s.reloads.n)
+
+	s.reloads.err = errors.New("bad yaml")
+	var body struct{ Error string }
+	assert.Equal(t, http.StatusUnprocessableEntity, s.do(t, http.MethodPost, "/v1/reload", &body))
+	assert.Equal(t, "bad yaml", body.Error)
+	assert.Equal(t, http.StatusMethodNotAllowed, s.do(t, http.MethodGet, "/v1/reload", nil))
+}
+
+func TestEffective(t *testing.T) {
+	s := newAdminTestServer(t)
+	var e loader.Effective
+	assert.Equal(t, http.StatusOK, s.do(t, http.MethodGet, "/v1/effective?query=core", &e))
+	assert.Equal(t, "core", e.Group)
+	assert.Equal(t, "0011223344556677", e.SecretFingerprint)
+	assert.Equal(t, http.StatusNotFound, s.do(t, http.MethodGet, "/v1/effective?query=edge", nil))
+	assert.Equal(t, http.StatusBadRequest, s.do(t, http.MethodGet, "/v1/effective", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, s.do(t, http.MethodPost, "/v1/effective?query=core", nil))
+
+	// it names users, so it is not served without the token
+	resp, err := http.Get(s.api.URL + "/v1/effective?query=core")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+// diagnoserFunc adapts a func to a diagnoser
+type diagnoserFunc func(ctx context.Context) (tq.DiagnosticReport, error)
+
+func (f diagnoserFunc) Run(ctx context.Context) (tq.DiagnosticReport, error) { return f(ctx) }
+
+func TestDiagnostics(t *testing.T) {
+	report := tq.DiagnosticReport{
+		Started:      time.Date(2021, 4, 1, 12, 0, 0, 0, time.UTC),
+		Milliseconds: 12.5,
+		Stages: []tq.DiagnosticStageReport{
+			{Stage: tq.DiagnosticStageConnect, Milliseconds: 0.5, Passed: true, Result: "[::1]:5000"},
+			{Stage: tq.DiagnosticStageAuthenticate, Milliseconds: 12, Passed: false, Result: "authentication status [AuthenStatusFail]",
+				Baseline: &tq.DiagnosticBaseline{Type: "Authenticate", P50: 2, P99: 9, Deviation: "slow"}},
+		},
+		Failed: tq.DiagnosticStageAuthenticate,
+	}
+	var limit error
+	h := NewHandler(Controls{Diagnostics: diagnoserFunc(func(ctx context.Context) (tq.DiagnosticReport, error) {
+		if limit != nil {
+			return tq.DiagnosticReport{}, limit
+		}
+		return report, nil
+	})}, TokenAuth([]byte(testToken)))
+	do := func(method string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/v1/diagnostics", nil)
+		r.Header.Set("Authorization", "Bearer "+testToken)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	assert.Equal(t, http.StatusMethodNotAllowed, do(http.MethodGet).Code, "a GET must not exercise the server")
+	w := do(http.MethodPost)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var got tq.DiagnosticReport
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+	assert.Equal(t, report, got)
+
+	for retryAfter, header := range map[time.Duration]string{0: "1", 1500 * time.Millisecond: "2", 45 * time.Second: "45"} {
+		limit = &tq.DiagnosticLimitError{RetryAfter: retryAfter}
+		w = do(http.MethodPost)
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.Equal(t, header, w.Header().Get("Retry-After"), retryAfter)
+	}
+
+	// it logs in to the server, so it is not run without the token
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/diagnostics", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestDrain(t *testing.T) {
+	s := newAdminTestServer(t)
+	assert.Equal(t, http.StatusAccepted, s.do(t, http.MethodPost, "/v1/drain", nil))
+	select {
+	case <-s.served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server did not stop serving")
+	}
+	var status tq.ServerStatus
+	assert.Equal(t, http.StatusOK, s.do(t, http.MethodGet, "/v1/status", &status))
+	assert.NotEqual(t, tq.ShutdownServing, status.Shutdown)
+}
+
+func TestUnavailable(t *testing.T) {
+	// controls a server does not set answer 501
+	h := NewHandler(Controls{}, TokenAuth([]byte(testToken)))
+	for _, path := range []string{"/v1/status", "/v1/maintenance", "/v1/log-level", "/v1/effective?query=core"} {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("Authorization", "Bearer "+testToken)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusNotImplemented, w.Code, path)
+		b, err := io.ReadAll(w.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(b), "not available")
+	}
+}
@@ -0,0 +1,24 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package admin
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	adminRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tacquito",
+		Name:      "admin_requests",
+		Help:      "number of admin api requests, by result; authorized or unauthorized",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(adminRequests)
+}
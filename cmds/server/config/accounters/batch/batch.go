@@ -0,0 +1,384 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+// Package batch implements an accounter that accumulates records and writes them to a sink in
+// batches, for sinks such as databases or object storage that are more efficient with bulk writes.
+// A batch is flushed when it reaches its size or when the flush interval passes, whichever comes
+// first, and a final flush is made by Close or Shutdown.
+package batch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	tq "github.com/facebookincubator/tacquito"
+)
+
+// loggerProvider provides the logging implementation
+type loggerProvider interface {
+	Infof(ctx context.Context, format string, args ...interface{})
+	Errorf(ctx context.Context, format string, args ...interface{})
+}
+
+// Record is the fields of a single accounting request
+type Record map[string]string
+
+// Writer writes batches of records to a sink.  WriteBatch is never called concurrently.  If only
+// some records of a batch could be written, WriteBatch should return a *PartialError naming the
+// records that failed, so only those are retried.  Any other error retries the whole batch.  The
+// records of a Writer that implements tq.LimitedSink are cut to its limits before they are held.
+type Writer interface {
+	WriteBatch(ctx context.Context, records []Record) error
+}
+
+// WriterFunc is an adapter to use a func as a Writer
+type WriterFunc func(ctx context.Context, records []Record) error
+
+// WriteBatch implements Writer
+func (f WriterFunc) WriteBatch(ctx context.Context, records []Record) error {
+	return f(ctx, records)
+}
+
+// PartialError is returned by a Writer that wrote only some records of a batch
+type PartialError struct {
+	// Failed holds the indexes within the batch of the records that were not written
+	Failed []int
+	Err    error
+}
+
+// Error implements error
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("%v records of the batch were not written; %v", len(e.Failed), e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *PartialError) Unwrap() error {
+	return e.Err
+}
+
+// Option is the setter type for Accounter
+type Option func(a *Accounter)
+
+// SetSize sets how many records are accumulated before a batch is flushed.  The default is 100.
+func SetSize(v int) Option {
+	return func(a *Accounter) {
+		a.size = v
+	}
+}
+
+// SetInterval sets the longest a record waits before it is flushed.  The default is 5 seconds.
+func SetInterval(v time.Duration) Option {
+	return func(a *Accounter) {
+		a.interval = v
+	}
+}
+
+// SetMaxPending sets how many records, including those of failed batches awaiting a retry, may be
+// held before new requests are refused with an error.  The default is 10 batches.
+func SetMaxPending(v int) Option {
+	return func(a *Accounter) {
+		a.maxPending = v
+	}
+}
+
+// SetArgSpill keeps cmd-arg values over the threshold of s in it, so held records only carry a
+// reference to them in the args-spill field, see tq.Args.Spill.  A Writer that needs the values
+// opens the reference with s while it writes the batch.  The file of a record is released once the
+// record is written.  The values are spilled before the record is built, so records never hold
+// them.
+func SetArgSpill(s *tq.ArgSpill) Option {
+	return func(a *Accounter) {
+		a.spill = s
+	}
+}
+
+// New returns a batching accounter that writes to w and starts its flush loop.  Close must be
+// called on shutdown to flush the records that are still held.
+func New(l loggerProvider, w Writer, opts ...Option) (*Accounter, error) {
+	a := &Accounter{
+		loggerProvider: l,
+		writer:         w,
+		size:           100,
+		interval:       5 * time.Second,
+		kick:           make(chan struct{}, 1),
+		done:           make(chan struct{}),
+		stopped:        make(chan struct{}),
+	}
+	a.ctx, a.cancel = context.WithCancel(context.Background())
+	for _, opt := range opts {
+		opt(a)
+	}
+	if a.maxPending == 0 {
+		a.maxPending = 10 * a.size
+	}
+	switch {
+	case w == nil:
+		return nil, fmt.Errorf("a batch writer is required")
+	case a.size < 1:
+		return nil, fmt.Errorf("batch size must be at least 1, got [%v]", a.size)
+	case a.interval <= 0:
+		return nil, fmt.Errorf("batch interval must be positive, got [%v]", a.interval)
+	case a.maxPending < a.size:
+		return nil, fmt.Errorf("max pending [%v] must be at least the batch size [%v]", a.maxPending, a.size)
+	}
+	go a.loop()
+	return a, nil
+}
+
+// Accounter holds accounting records until they are written to its Writer.  A device is told of
+// success once its record is held, so records acknowledged since the last flush are only durable
+// once Close returns.
+type Accounter struct {
+	loggerProvider
+	writer     Writer
+	size       int
+	interval   time.Duration
+	maxPending int
+	spill      *tq.ArgSpill
+
+	mu      sync.Mutex
+	pending []Record
+	closed  bool
+
+	// ctx is cancelled on shutdown so a slow write does not hold up the final flush
+	ctx     context.Context
+	cancel  context.CancelFunc
+	kick    chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// New returns the accounter itself, every user shares its batches
+func (a *Accounter) New(options map[string]string) tq.Handler {
+	return a
+}
+
+// Handle holds the record of an accounting request for the next batch
+func (a *Accounter) Handle(response tq.Response, request tq.Request) {
+	var body tq.AcctRequest
+	if err := tq.Unmarshal(request.Body, &body); err != nil {
+		response.Reply(
+			tq.NewAcctReply(
+				tq.SetAcctReplyStatus(tq.AcctReplyStatusError),
+				tq.SetAcctReplyServerMsg("accounting failure"),
+			),
+		)
+		return
+	}
+	var ref tq.ArgRef
+	var spilled bool
+	if a.spill != nil {
+		// spilled before the record is built, so the record never holds the values
+		args, err := body.Args.Spill(a.spill)
+		if err != nil {
+			a.Errorf(request.Context, "[%v] unable to spill cmd-arg values, holding them in memory; %v", request.Header.SessionID, err)
+		}
+		body.Args = args
+		ref, spilled = args.Ref()
+	}
+	record := newRecord(request, body)
+	if ls, ok := a.writer.(tq.LimitedSink); ok {
+		ls.SinkLimits().TruncateFields(record)
+	}
+	if spilled {
+		// after the truncation, the reference must stay whole
+		record["args"], record["args-spill"] = body.Args.String(), ref.String()
+	}
+	if err := a.add(record); err != nil {
+		a.release(record)
+		batchRefused.Inc()
+		a.Errorf(request.Context, "[%v] accounting record refused; %v", request.Header.SessionID, err)
+		response.Reply(
+			tq.NewAcctReply(
+				tq.SetAcctReplyStatus(tq.AcctReplyStatusError),
+				tq.SetAcctReplyServerMsg("accounting failure"),
+			),
+		)
+		return
+	}
+	response.Reply(tq.NewAcctReply(tq.SetAcctReplyStatus(tq.AcctReplyStatusSuccess)))
+}
+
+// newRecord returns the fields of request, as by tq.Request.Fields, from its decoded body
+func newRecord(request tq.Request, body tq.AcctRequest) Record {
+	record := Record(request.Header.Fields())
+	if request.Context != nil {
+		for _, key := range []tq.ContextKey{tq.ContextConnRemoteAddr, tq.ContextEventTime} {
+			if v, ok := request.Context.Value(key).(string); ok {
+				record[string(key)] = v
+			}
+		}
+	}
+	for k, v := range body.Fields() {
+		record[k] = v
+	}
+	if t, ok := tq.RequestTransport(request.Context); ok {
+		for k, v := range t.Fields() {
+			record[k] = v
+		}
+	}
+	return record
+}
+
+// add holds r and wakes the flush loop once a batch is full
+func (a *Accounter) add(r Record) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return errors.New("accounter is closed")
+	}
+	if len(a.pending) >= a.maxPending {
+		return fmt.Errorf("[%v] records are pending, the sink is not keeping up", len(a.pending))
+	}
+	a.pending = append(a.pending, r)
+	if len(a.pending) >= a.size {
+		select {
+		case a.kick <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// loop flushes a batch when one is full or the interval passes, until Close or Shutdown
+func (a *Accounter) loop() {
+	defer close(a.stopped)
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.kick:
+		case <-ticker.C:
+		case <-a.done:
+			return
+		}
+		a.flush(a.ctx)
+	}
+}
+
+// flush writes every pending record, a batch at a time, until ctx is done and returns how many
+// were written.  Records that were not written are held for the next flush, ahead of those that
+// arrived since.
+func (a *Accounter) flush(ctx context.Context) int {
+	a.mu.Lock()
+	records := a.pending
+	a.pending = nil
+	a.mu.Unlock()
+
+	var flushed int
+	var retry []Record
+	for len(records) > 0 {
+		if ctx.Err() != nil {
+			retry = append(retry, records...)
+			break
+		}
+		n := a.size
+		if n > len(records) {
+			n = len(records)
+		}
+		batch := records[:n]
+		records = records[n:]
+		err := a.writer.WriteBatch(ctx, batch)
+		if err == nil {
+			batchFlushed.Inc()
+			flushed += len(batch)
+			a.release(batch...)
+			continue
+		}
+		var partial *PartialError
+		if errors.As(err, &partial) {
+			failed := make(map[int]bool, len(partial.Failed))
+			for _, i := range partial.Failed {
+				if i >= 0 && i < len(batch) {
+					failed[i] = true
+					retry = append(retry, batch[i])
+				}
+			}
+			for i, r := range batch {
+				if !failed[i] {
+					a.release(r)
+				}
+			}
+		} else {
+			retry = append(retry, batch...)
+		}
+		flushed += len(batch) - len(retry)
+		batchFailed.Add(float64(len(retry)))
+		a.Errorf(ctx, "failed to write accounting batch, [%v] records will be retried; %v", len(retry), err)
+		// the sink is failing, keep the rest for the next flush rather than hammering it
+		retry = append(retry, records...)
+		break
+	}
+	if len(retry) > 0 {
+		a.mu.Lock()
+		a.pending = append(retry, a.pending...)
+		a.mu.Unlock()
+	}
+	return flushed
+}
+
+// release releases the spilled cmd-arg values of records that are no longer held
+func (a *Accounter) release(records ...Record) {
+	if a.spill == nil {
+		return
+	}
+	for _, r := range records {
+		ref, err := tq.ParseArgRef(r["args-spill"])
+		if err != nil {
+			continue
+		}
+		if err := a.spill.Release(ref); err != nil {
+			a.Errorf(a.ctx, "unable to release spilled cmd-arg values; %v", err)
+		}
+	}
+}
+
+// Shutdown stops the flush loop and makes a final flush until ctx is done.  It returns how many
+// records the final flush wrote and the records that are still held, which the server spools on
+// shutdown, see tq.SetShutdownSink.  A write in progress when Shutdown is called is cancelled and
+// its records are retried by the final flush.
+func (a *Accounter) Shutdown(ctx context.Context) (int, []map[string]string, error) {
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.done)
+		a.cancel()
+	}
+	a.mu.Unlock()
+	select {
+	case <-a.stopped:
+	case <-ctx.Done():
+		return 0, a.held(), ctx.Err()
+	}
+	flushed := a.flush(ctx)
+	held := a.held()
+	if len(held) > 0 {
+		return flushed, held, fmt.Errorf("[%v] accounting records were not written before close", len(held))
+	}
+	return flushed, nil, nil
+}
+
+// held returns the records that are still pending
+func (a *Accounter) held() []map[string]string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	held := make([]map[string]string, 0, len(a.pending))
+	for _, r := range a.pending {
+		held = append(held, r)
+	}
+	return held
+}
+
+// Close stops the flush loop after a final flush.  It returns an error if records could not be
+// written, or if ctx is done before the final flush finishes.
+func (a *Accounter) Close(ctx context.Context) error {
+	_, _, err := a.Shutdown(ctx)
+	return err
+}
@@ -0,0 +1,343 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package batch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tq "github.com/facebookincubator/tacquito"
+	"github.com/facebookincubator/tacquito/internal/canceltest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type nopLogger struct{}
+
+func (nopLogger) Infof(ctx context.Context, format string, args ...interface{})  {}
+func (nopLogger) Errorf(ctx context.Context, format string, args ...interface{}) {}
+
+// statusResponse keeps the status of the reply
+type statusResponse struct {
+	status tq.AcctReplyStatus
+}
+
+func (r *statusResponse) Reply(v tq.EncoderDecoder) (int, error) {
+	r.status = v.(*tq.AcctReply).Status
+	return 0, nil
+}
+func (r *statusResponse) Write(p *tq.Packet) (int, error) { return 0, nil }
+func (r *statusResponse) Next(next tq.Handler)            {}
+func (r *statusResponse) RegisterWriter(io.Writer)        {}
+
+// mockWriter keeps the users of every batch it was given.  fail, if set, decides the error of
+// each call.
+type mockWriter struct {
+	mu      sync.Mutex
+	batches [][]string
+	fail    func(call int) error
+}
+
+func (w *mockWriter) WriteBatch(ctx context.Context, records []Record) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var users []string
+	for _, r := range records {
+		users = append(users, r["user"])
+	}
+	w.batches = append(w.batches, users)
+	if w.fail != nil {
+		return w.fail(len(w.batches))
+	}
+	return nil
+}
+
+func (w *mockWriter) written() [][]string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([][]string(nil), w.batches...)
+}
+
+func account(t *testing.T, a *Accounter, user string) tq.AcctReplyStatus {
+	body, err := tq.NewAcctRequest(
+		tq.SetAcctRequestFlag(tq.AcctFlagStart),
+		tq.SetAcctRequestMethod(tq.AuthenMethodTacacsPlus),
+		tq.SetAcctRequestPrivLvl(tq.PrivLvlUser),
+		tq.SetAcctRequestType(tq.AuthenTypeASCII),
+		tq.SetAcctRequestService(tq.AuthenServiceLogin),
+		tq.SetAcctRequestUser(tq.AuthenUser(user)),
+		tq.SetAcctRequestArgs(tq.Args{"service=shell", "task_id=1"}),
+	).MarshalBinary()
+	require.NoError(t, err)
+	r := &statusResponse{}
+	a.Handle(r, tq.Request{
+		Header:  *tq.NewHeader(tq.SetHeaderType(tq.Accounting), tq.SetHeaderSeqNo(1)),
+		Body:    body,
+		Context: context.Background(),
+	})
+	return r.status
+}
+
+func TestFlushOnSize(t *testing.T) {
+	w := &mockWriter{}
+	a, err := New(nopLogger{}, w, SetSize(3), SetInterval(time.Hour))
+	require.NoError(t, err)
+	defer a.Close(context.Background())
+
+	for _, user := range []string{"alice", "bob"} {
+		assert.Equal(t, tq.AcctReplyStatusSuccess, account(t, a, user))
+	}
+	// the batch is not full, nothing is written
+	time.Sleep(10 * time.Millisecond)
+	assert.Empty(t, w.written())
+
+	assert.Equal(t, tq.AcctReplyStatusSuccess, account(t, a, "carol"))
+	assert.Eventually(t, func() bool { return len(w.written()) == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, [][]string{{"alice", "bob", "carol"}}, w.written())
+}
+
+func TestFlushOnInterval(t *testing.T) {
+	w := &mockWriter{}
+	a, err := New(nopLogger{}, w, SetSize(100), SetInterval(10*time.Millisecond))
+	require.NoError(t, err)
+	defer a.Close(context.Background())
+
+	assert.Equal(t, tq.AcctReplyStatusSuccess, account(t, a, "alice"))
+	assert.Eventually(t, func() bool { return len(w.written()) == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, [][]string{{"alice"}}, w.written())
+}
+
+func TestFlushOnClose(t *testing.T) {
+	w := &mockWriter{}
+	a, err := New(nopLogger{}, w, SetSize(100), SetInterval(time.Hour))
+	require.NoError(t, err)
+
+	for _, user := range []string{"alice", "bob"} {
+		assert.Equal(t, tq.AcctReplyStatusSuccess, account(t, a, user))
+	}
+	assert.NoError(t, a.Close(context.Background()))
+	assert.Equal(t, [][]string{{"alice", "bob"}}, w.written())
+
+	// records are refused once closed
+	assert.Equal(t, tq.AcctReplyStatusError, account(t, a, "carol"))
+	assert.NoError(t, a.Close(context.Background()))
+}
+
+func TestPartialFailure(t *testing.T) {
+	w := &mockWriter{fail: func(call int) error {
+		if call == 1 {
+			return &PartialError{Failed: []int{1}, Err: errors.New("constraint violation")}
+		}
+		return nil
+	}}
+	a, err := New(nopLogger{}, w, SetSize(3), SetInterval(time.Hour))
+	require.NoError(t, err)
+
+	for _, user := range []string{"alice", "bob", "carol"} {
+		assert.Equal(t, tq.AcctReplyStatusSuccess, account(t, a, user))
+	}
+	assert.Eventually(t, func() bool { return len(w.written()) == 1 }, time.Second, time.Millisecond)
+
+	// only the failed record is retried, ahead of newer records
+	assert.Equal(t, tq.AcctReplyStatusSuccess, account(t, a, "dave"))
+	assert.NoError(t, a.Close(context.Background()))
+	assert.Equal(t, [][]string{{"alice", "bob", "carol"}, {"bob", "dave"}}, w.written())
+}
+
+func TestSinkFailure(t *testing.T) {
+	w := &mockWriter{fail: func(call int) error { return errors.New("sink unavailable") }}
+	a, err := New(nopLogger{}, w, SetSize(2), SetInterval(time.Hour), SetMaxPending(2))
+	require.NoError(t, err)
+
+	for _, user := range []string{"alice", "bob"} {
+		assert.Equal(t, tq.AcctReplyStatusSuccess, account(t, a, user))
+	}
+	assert.Eventually(t, func() bool { return len(w.written()) == 1 }, time.Second, time.Millisecond)
+
+	// the failed batch is held for a retry, which leaves no room for more
+	assert.Equal(t, tq.AcctReplyStatusError, account(t, a, "carol"))
+	assert.EqualError(t, a.Close(context.Background()), "[2] accounting records were not written before close")
+	assert.Equal(t, [][]string{{"alice", "bob"}, {"alice", "bob"}}, w.written())
+}
+
+func TestShutdownReturnsHeld(t *testing.T) {
+	// the sink blocks until it is cancelled, as a sink that stopped responding would
+	w := &mockWriter{}
+	blocked := WriterFunc(func(ctx context.Context, records []Record) error {
+		w.WriteBatch(ctx, records)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	a, err := New(nopLogger{}, blocked, SetSize(2), SetInterval(time.Hour))
+	require.NoError(t, err)
+
+	for _, user := range []string{"alice", "bob", "carol"} {
+		assert.Equal(t, tq.AcctReplyStatusSuccess, account(t, a, user))
+	}
+	assert.Eventually(t, func() bool { return len(w.written()) == 1 }, time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	flushed, held, err := a.Shutdown(ctx)
+	assert.Error(t, err)
+	assert.Equal(t, 0, flushed)
+	require.Len(t, held, 3)
+	// the cancelled batch is held ahead of the record that arrived after it
+	assert.Equal(t, []string{"alice", "bob", "carol"}, []string{held[0]["user"], held[1]["user"], held[2]["user"]})
+}
+
+func TestShutdownCanceled(t *testing.T) {
+	blocked := WriterFunc(func(ctx context.Context, records []Record) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	a, err := New(nopLogger{}, blocked, SetSize(100), SetInterval(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, tq.AcctReplyStatusSuccess, account(t, a, "alice"))
+
+	// the final flush blocks on the sink until shutdown is canceled
+	err = canceltest.ReturnsWithin(t, canceltest.Limit, func(ctx context.Context) error {
+		_, _, err := a.Shutdown(ctx)
+		return err
+	})
+	assert.Error(t, err)
+}
+
+func TestNewInvalid(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		w    Writer
+		opts []Option
+	}{
+		{name: "no writer"},
+		{name: "size", w: &mockWriter{}, opts: []Option{SetSize(0)}},
+		{name: "interval", w: &mockWriter{}, opts: []Option{SetInterval(0)}},
+		{name: "max pending", w: &mockWriter{}, opts: []Option{SetSize(10), SetMaxPending(5)}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := New(nopLogger{}, test.w, test.opts...)
+			assert.Error(t, err)
+		})
+	}
+}
+
+// accountConfig accounts a config push of user, whose cmd-arg values are size bytes
+func accountConfig(t *testing.T, a *Accounter, user string, size int) tq.AcctReplyStatus {
+	body, err := tq.NewAcctRequest(
+		tq.SetAcctRequestFlag(tq.AcctFlagStop),
+		tq.SetAcctRequestMethod(tq.AuthenMethodTacacsPlus),
+		tq.SetAcctRequestPrivLvl(tq.PrivLvlRoot),
+		tq.SetAcctRequestType(tq.AuthenTypeASCII),
+		tq.SetAcctRequestService(tq.AuthenServiceLogin),
+		tq.SetAcctRequestUser(tq.AuthenUser(user)),
+		tq.SetAcctRequestArgs(tq.Args{"service=shell", "cmd=configure", tq.Arg("cmd-arg=" + user + strings.Repeat("x", size))}),
+	).MarshalBinary()
+	require.NoError(t, err)
+	r := &statusResponse{}
+	a.Handle(r, tq.Request{
+		Header:  *tq.NewHeader(tq.SetHeaderType(tq.Accounting), tq.SetHeaderSeqNo(1)),
+		Body:    body,
+		Context: context.Background(),
+	})
+	return r.status
+}
+
+func TestArgSpillReleasedAfterFlush(t *testing.T) {
+	dir := t.TempDir()
+	spill, err := tq.NewArgSpill(dir, 64)
+	require.NoError(t, err)
+	files := func() int {
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		return len(entries)
+	}
+
+	// the sink reads the values of every spilled record, and fails bob the first time
+	var mu sync.Mutex
+	var values []string
+	calls := 0
+	w := WriterFunc(func(ctx context.Context, records []Record) error {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		for _, r := range records {
+			ref, err := tq.ParseArgRef(r["args-spill"])
+			if err != nil {
+				values = append(values, r["user"]+" in memory")
+				continue
+			}
+			assert.NotContains(t, r["args"], "xxxx")
+			// the writer runs on the flush loop, so failures are reported through values
+			f, err := spill.Open(ref)
+			if err != nil {
+				values = append(values, err.Error())
+				continue
+			}
+			b, err := io.ReadAll(f)
+			f.Close()
+			if err != nil || len(b) < len(r["user"]) {
+				values = append(values, fmt.Sprintf("%v read [%v] bytes; %v", r["user"], len(b), err))
+				continue
+			}
+			values = append(values, string(b[:len(r["user"])]))
+		}
+		if calls == 1 {
+			return &PartialError{Failed: []int{1}, Err: errors.New("constraint violation")}
+		}
+		return nil
+	})
+	a, err := New(nopLogger{}, w, SetSize(3), SetInterval(time.Hour), SetArgSpill(spill))
+	require.NoError(t, err)
+
+	assert.Equal(t, tq.AcctReplyStatusSuccess, accountConfig(t, a, "alice", 200))
+	assert.Equal(t, tq.AcctReplyStatusSuccess, accountConfig(t, a, "bob", 200))
+	assert.Equal(t, tq.AcctReplyStatusSuccess, accountConfig(t, a, "carol", 10))
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls == 1
+	}, time.Second, time.Millisecond)
+	// alice was written and released, bob is held for a retry with his file
+	assert.Equal(t, 1, files())
+
+	assert.NoError(t, a.Close(context.Background()))
+	assert.Equal(t, []string{"alice", "bob", "carol in memory", "bob"}, values)
+	assert.Equal(t, 0, files())
+}
+
+// limitedWriter is a mockWriter that declares the limits of its sink
+type limitedWriter struct {
+	mockWriter
+	limits tq.SinkLimits
+}
+
+func (w *limitedWriter) SinkLimits() tq.SinkLimits { return w.limits }
+
+func TestWriterLimits(t *testing.T) {
+	w := &limitedWriter{limits: tq.SinkLimits{Name: "warehouse", Value: 100}}
+	a, err := New(nopLogger{}, w, SetSize(2), SetInterval(time.Hour))
+	require.NoError(t, err)
+	defer a.Close(context.Background())
+
+	long := strings.Repeat("a", 200)
+	assert.Equal(t, tq.AcctReplyStatusSuccess, account(t, a, "alice"))
+	assert.Equal(t, tq.AcctReplyStatusSuccess, account(t, a, long))
+	assert.Eventually(t, func() bool { return len(w.written()) == 1 }, time.Second, time.Millisecond)
+	users := w.written()[0]
+	assert.Equal(t, "alice", users[0])
+	assert.Len(t, users[1], 100)
+	assert.True(t, strings.HasPrefix(users[1], "aaaa"))
+	assert.Contains(t, users[1], "...[truncated from 200 bytes sha256:")
+}
@@ -0,0 +1,36 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package batch
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	batchFlushed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "tacquito",
+		Name:      "batch_accounter_flushed",
+		Help:      "number of accounting batches written to the sink",
+	})
+	batchFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "tacquito",
+		Name:      "batch_accounter_failed_records",
+		Help:      "number of accounting records the sink failed to write, they are retried",
+	})
+	batchRefused = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "tacquito",
+		Name:      "batch_accounter_refused",
+		Help:      "number of accounting requests refused because too many records were pending",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(batchFlushed)
+	prometheus.MustRegister(batchFailed)
+	prometheus.MustRegister(batchRefused)
+}
@@ -51,7 +51,8 @@ func SetLogSink(l acctLogger) Option {
 	}
 }
 
-// Accounter that writes to system log service
+// Accounter that writes to system log service.  It is the full fidelity audit record, so it
+// declares no tq.SinkLimits and its records are never truncated.
 type Accounter struct {
 	loggerProvider            // local server event logger
 	sink           acctLogger // accounting log destination
@@ -88,7 +89,7 @@ func (a Accounter) Handle(response tq.Response, request tq.Request) {
 		return
 	}
 
-	jsonLog, err := json.Marshal(body)
+	jsonLog, err := json.Marshal(tq.NewAcctRecord(request, body))
 	if err != nil {
 		response.Reply(
 			tq.NewAcctReply(
@@ -28,6 +28,15 @@ type Accounter struct {
 	*syslog.Writer // syslog writer
 }
 
+// syslogLimits keep records within the 2KB message limit of many syslog daemons, leaving room for
+// the names of their fields
+var syslogLimits = tq.SinkLimits{Name: "syslog", Record: 1536}
+
+// SinkLimits implements tq.LimitedSink
+func (a Accounter) SinkLimits() tq.SinkLimits {
+	return syslogLimits
+}
+
 // New ...
 func New(l loggerProvider, writer *syslog.Writer) *Accounter {
 	return &Accounter{loggerProvider: l, Writer: writer}
@@ -51,7 +60,7 @@ func (a Accounter) Handle(response tq.Response, request tq.Request) {
 		return
 	}
 
-	jsonLog, err := json.Marshal(body)
+	jsonLog, err := json.Marshal(tq.NewAcctRecord(request, body))
 	if err != nil {
 		response.Reply(
 			tq.NewAcctReply(
@@ -0,0 +1,333 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+// Package transform rewrites the attributes of accounting requests before they reach an accounter.
+// It is used to drop or hash attributes that must not be stored, eg command arguments that carry
+// credentials or usernames subject to privacy rules.  Each accounter has its own rules, so a secured
+// audit store may receive full records while an analytics sink only receives hashed ones.
+package transform
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	tq "github.com/facebookincubator/tacquito"
+)
+
+// loggerProvider provides the logging implementation for local server events
+type loggerProvider interface {
+	Errorf(ctx context.Context, format string, args ...interface{})
+}
+
+// Action is what a Rule does to a matching attribute
+type Action string
+
+const (
+	// Passthrough leaves the attribute as is
+	Passthrough Action = "passthrough"
+	// Drop removes the attribute.  Body fields such as user are emptied instead.
+	Drop Action = "drop"
+	// Hash replaces the value of the attribute with its sha256, keeping records correlatable
+	Hash Action = "hash"
+	// HMAC replaces the value of the attribute with its hmac-sha256 under the key set with
+	// SetHMACKey.  Unlike Hash, values from a small space such as usernames cannot be recovered by
+	// hashing every candidate without the key.
+	HMAC Action = "hmac"
+)
+
+// correlationKey is the attribute that ties the start and stop records of a task together
+const correlationKey = "task_id"
+
+// Option is the setter type for Transformer
+type Option func(t *Transformer)
+
+// SetDefault sets the action for attributes no rule matches.  The default is Passthrough, which
+// makes the rules a denylist.  Drop makes them an allowlist; only attributes a passthrough, hash or
+// hmac rule matches are kept.
+func SetDefault(v Action) Option {
+	return func(t *Transformer) {
+		t.defaultAction = v
+	}
+}
+
+// SetHMACKey sets the key of the HMAC action
+func SetHMACKey(v []byte) Option {
+	return func(t *Transformer) {
+		t.hmacKey = v
+	}
+}
+
+// ParseOptions returns the options held in the attribute_default and attribute_hmac_key options
+// of an accounter
+func ParseOptions(options map[string]string) []Option {
+	var opts []Option
+	if v, ok := options["attribute_default"]; ok {
+		opts = append(opts, SetDefault(Action(v)))
+	}
+	if v, ok := options["attribute_hmac_key"]; ok {
+		opts = append(opts, SetHMACKey([]byte(v)))
+	}
+	return opts
+}
+
+// Rule applies Action to attributes whose name matches Attribute and, if set, whose value
+// matches Value.  Both are regular expressions anchored at both ends.  The body fields user, port
+// and rem-addr are matched by those names, every other name is an av pair name, eg cmd-arg.
+// If SystemEvent is set, the rule only applies to system event records of a matching kind, see
+// tq.Args.SystemEvent.
+type Rule struct {
+	Attribute   string `json:"attribute"`
+	Value       string `json:"value,omitempty"`
+	SystemEvent string `json:"system_event,omitempty"`
+	Action      Action `json:"action"`
+}
+
+// rule is a compiled Rule
+type rule struct {
+	attribute   *regexp.Regexp
+	value       *regexp.Regexp
+	systemEvent *regexp.Regexp
+	action      Action
+}
+
+// ParseRules decodes and compiles a json list of rules, as found in the attribute_rules option
+// of an accounter
+func ParseRules(raw string) ([]Rule, error) {
+	var rules []Rule
+	if err := json.Unmarshal([]byte(raw), &rules); err != nil {
+		return nil, fmt.Errorf("unable to decode attribute rules; %w", err)
+	}
+	if _, err := compile(rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func compile(rules []Rule) ([]rule, error) {
+	compiled := make([]rule, 0, len(rules))
+	for i, r := range rules {
+		switch r.Action {
+		case Passthrough, Drop, Hash, HMAC:
+		default:
+			return nil, fmt.Errorf("rule [%v] has unknown action [%v]", i, r.Action)
+		}
+		if r.Attribute == "" {
+			return nil, fmt.Errorf("rule [%v] has no attribute", i)
+		}
+		c := rule{action: r.Action}
+		var err error
+		if c.attribute, err = regexp.Compile("^(?:" + r.Attribute + ")$"); err != nil {
+			return nil, fmt.Errorf("rule [%v] has a bad attribute pattern; %w", i, err)
+		}
+		if r.Value != "" {
+			if c.value, err = regexp.Compile("^(?:" + r.Value + ")$"); err != nil {
+				return nil, fmt.Errorf("rule [%v] has a bad value pattern; %w", i, err)
+			}
+		}
+		if r.SystemEvent != "" {
+			if c.systemEvent, err = regexp.Compile("^(?:" + r.SystemEvent + ")$"); err != nil {
+				return nil, fmt.Errorf("rule [%v] has a bad system_event pattern; %w", i, err)
+			}
+			// the start and stop of a task must be correlatable by the same transformed value
+			if c.attribute.MatchString(correlationKey) && c.systemEvent.MatchString(string(tq.SystemEventStart)) != c.systemEvent.MatchString(string(tq.SystemEventStop)) {
+				return nil, fmt.Errorf("rule [%v] would treat %v differently in start and stop records", i, correlationKey)
+			}
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+// New wraps next with a handler that applies rules to every accounting request before passing
+// it on.  The first matching rule wins and attributes no rule matches get the default action.
+func New(l loggerProvider, rules []Rule, next tq.Handler, opts ...Option) (*Transformer, error) {
+	compiled, err := compile(rules)
+	if err != nil {
+		return nil, err
+	}
+	t := &Transformer{loggerProvider: l, rules: compiled, next: next, defaultAction: Passthrough}
+	for _, opt := range opts {
+		opt(t)
+	}
+	switch t.defaultAction {
+	case Passthrough, Drop, Hash, HMAC:
+	default:
+		return nil, fmt.Errorf("unknown default action [%v]", t.defaultAction)
+	}
+	if len(t.hmacKey) == 0 {
+		if t.defaultAction == HMAC {
+			return nil, fmt.Errorf("the hmac default action requires an hmac key")
+		}
+		for i, r := range compiled {
+			if r.action == HMAC {
+				return nil, fmt.Errorf("rule [%v] requires an hmac key", i)
+			}
+		}
+	}
+	return t, nil
+}
+
+// Transformer is a middleware handler that rewrites accounting attributes
+type Transformer struct {
+	loggerProvider
+	rules         []rule
+	next          tq.Handler
+	defaultAction Action
+	hmacKey       []byte
+}
+
+// Handle rewrites the AcctRequest in request and calls next with it
+func (t *Transformer) Handle(response tq.Response, request tq.Request) {
+	var body tq.AcctRequest
+	if err := tq.Unmarshal(request.Body, &body); err != nil {
+		// nothing reaches the accounter from a body it cannot decode either
+		t.next.Handle(response, request)
+		return
+	}
+	t.Transform(&body)
+	b, err := body.MarshalBinary()
+	if err != nil {
+		// never pass on the untransformed request
+		t.Errorf(request.Context, "unable to marshal transformed accounting request; %v", err)
+		response.Reply(
+			tq.NewAcctReply(
+				tq.SetAcctReplyStatus(tq.AcctReplyStatusError),
+				tq.SetAcctReplyServerMsg("accounting failure"),
+			),
+		)
+		return
+	}
+	request.Body = b
+	request.Header.Length = uint32(len(b))
+	t.next.Handle(response, request)
+}
+
+// Transform applies the rules to body in place
+func (t *Transformer) Transform(body *tq.AcctRequest) {
+	kind, _ := body.Args.SystemEvent()
+	t.transform(t.match(string(kind)), body)
+}
+
+// match returns the rules that apply to a record of the system event kind, or to any other
+// record if kind is empty
+func (t *Transformer) match(kind string) []rule {
+	rules := make([]rule, 0, len(t.rules))
+	for _, r := range t.rules {
+		if r.systemEvent != nil && (kind == "" || !r.systemEvent.MatchString(kind)) {
+			continue
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// transform applies rules to body in place
+func (t *Transformer) transform(rules []rule, body *tq.AcctRequest) {
+	apply := func(a, v string) (string, bool) { return t.apply(rules, a, v) }
+	if v, keep := apply("user", string(body.User)); keep {
+		body.User = tq.AuthenUser(v)
+	} else {
+		body.User = ""
+	}
+	if v, keep := apply("port", string(body.Port)); keep {
+		body.Port = tq.AuthenPort(v)
+	} else {
+		body.Port = ""
+	}
+	if v, keep := apply("rem-addr", string(body.RemAddr)); keep {
+		body.RemAddr = tq.AuthenRemAddr(v)
+	} else {
+		body.RemAddr = ""
+	}
+	args := make(tq.Args, 0, len(body.Args))
+	for _, arg := range body.Args {
+		a, s, v := arg.ASV()
+		if a == "" {
+			// an arg without a name can only be kept by a denylist
+			if t.defaultAction == Passthrough {
+				args = append(args, arg)
+			}
+			continue
+		}
+		// every occurrence of a repeated attribute, eg cmd-arg, is transformed on its own
+		if v, keep := apply(a, v); keep {
+			args = append(args, tq.Arg(a+s+v))
+		}
+	}
+	body.Args = args
+}
+
+// apply returns the transformed value of the attribute named a, and false if it is dropped
+func (t *Transformer) apply(rules []rule, a, v string) (string, bool) {
+	action := t.defaultAction
+	for _, r := range rules {
+		if r.attribute.MatchString(a) && (r.value == nil || r.value.MatchString(v)) {
+			action = r.action
+			break
+		}
+	}
+	switch action {
+	case Drop:
+		return "", false
+	case Hash:
+		if v == "" {
+			return v, true
+		}
+		sum := sha256.Sum256([]byte(v))
+		return "sha256:" + hex.EncodeToString(sum[:]), true
+	case HMAC:
+		if v == "" {
+			return v, true
+		}
+		mac := hmac.New(sha256.New, t.hmacKey)
+		mac.Write([]byte(v))
+		return "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil)), true
+	}
+	return v, true
+}
+
+// NewTruncator wraps next with a handler that cuts the values of every accounting request to
+// limits before passing it on, see tq.SinkLimits.  Requests with nothing to cut are passed on as
+// they are.
+func NewTruncator(l loggerProvider, limits tq.SinkLimits, next tq.Handler) *Truncator {
+	return &Truncator{loggerProvider: l, limits: limits, next: next}
+}
+
+// Truncator is a middleware handler that applies the limits of the sink it wraps
+type Truncator struct {
+	loggerProvider
+	limits tq.SinkLimits
+	next   tq.Handler
+}
+
+// Handle cuts the AcctRequest in request to the limits and calls next with it
+func (t *Truncator) Handle(response tq.Response, request tq.Request) {
+	var body tq.AcctRequest
+	if err := tq.Unmarshal(request.Body, &body); err != nil || t.limits.TruncateAcctRequest(&body) == 0 {
+		t.next.Handle(response, request)
+		return
+	}
+	b, err := body.MarshalBinary()
+	if err != nil {
+		t.Errorf(request.Context, "unable to marshal truncated accounting request; %v", err)
+		response.Reply(
+			tq.NewAcctReply(
+				tq.SetAcctReplyStatus(tq.AcctReplyStatusError),
+				tq.SetAcctReplyServerMsg("accounting failure"),
+			),
+		)
+		return
+	}
+	request.Body = b
+	request.Header.Length = uint32(len(b))
+	t.next.Handle(response, request)
+}
@@ -0,0 +1,238 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package transform
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	tq "github.com/facebookincubator/tacquito"
+	"github.com/stretchr/testify/assert"
+)
+
+type nopLogger struct{}
+
+func (nopLogger) Errorf(ctx context.Context, format string, args ...interface{}) {}
+
+// nopResponse discards replies
+type nopResponse struct{}
+
+func (nopResponse) Reply(v tq.EncoderDecoder) (int, error) { return 0, nil }
+func (nopResponse) Write(p *tq.Packet) (int, error)        { return 0, nil }
+func (nopResponse) Next(next tq.Handler)                   {}
+func (nopResponse) RegisterWriter(io.Writer)               {}
+
+func TestTransformHashUserDropCmdArg(t *testing.T) {
+	rules, err := ParseRules(`[
+		{"attribute": "user", "action": "hash"},
+		{"attribute": "cmd-arg", "value": "(?i)password.*", "action": "drop"},
+		{"attribute": "cmd-arg", "action": "passthrough"}
+	]`)
+	assert.NoError(t, err)
+
+	var got tq.AcctRequest
+	sink := tq.HandlerFunc(func(response tq.Response, request tq.Request) {
+		assert.NoError(t, tq.Unmarshal(request.Body, &got))
+		assert.Equal(t, uint32(len(request.Body)), request.Header.Length)
+	})
+	tr, err := New(nopLogger{}, rules, sink)
+	assert.NoError(t, err)
+
+	body, err := tq.NewAcctRequest(
+		tq.SetAcctRequestFlag(tq.AcctFlagStart),
+		tq.SetAcctRequestMethod(tq.AuthenMethodTacacsPlus),
+		tq.SetAcctRequestPrivLvl(tq.PrivLvlRoot),
+		tq.SetAcctRequestType(tq.AuthenTypeASCII),
+		tq.SetAcctRequestService(tq.AuthenServiceLogin),
+		tq.SetAcctRequestUser("mr_uses_group"),
+		tq.SetAcctRequestPort("tty0"),
+		tq.SetAcctRequestRemAddr("192.0.2.44"),
+		tq.SetAcctRequestArgs(tq.Args{"service=shell", "cmd=username", "cmd-arg=admin", "cmd-arg=password", "cmd-arg=hunter2"}),
+	).MarshalBinary()
+	assert.NoError(t, err)
+	tr.Handle(nopResponse{}, tq.Request{
+		Header:  *tq.NewHeader(tq.SetHeaderType(tq.Accounting), tq.SetHeaderSeqNo(1)),
+		Body:    body,
+		Context: context.Background(),
+	})
+
+	// sha256 of mr_uses_group
+	assert.Equal(t, tq.AuthenUser("sha256:190a1edef2ea4dad2d147019c178b3e3c1d963ae6062b72339d49c1ad6e0323e"), got.User)
+	assert.Equal(t, tq.AuthenPort("tty0"), got.Port)
+	assert.Equal(t, tq.AuthenRemAddr("192.0.2.44"), got.RemAddr)
+	assert.Equal(t, tq.Args{"service=shell", "cmd=username", "cmd-arg=admin", "cmd-arg=hunter2"}, got.Args)
+}
+
+func TestParseRulesInvalid(t *testing.T) {
+	for _, raw := range []string{
+		`not json`,
+		`[{"attribute": "user", "action": "encrypt"}]`,
+		`[{"action": "drop"}]`,
+		`[{"attribute": "(", "action": "drop"}]`,
+		`[{"attribute": "cmd-arg", "value": "[", "action": "drop"}]`,
+		`[{"attribute": "task_id", "system_event": "(", "action": "drop"}]`,
+	} {
+		_, err := ParseRules(raw)
+		assert.Error(t, err, raw)
+	}
+}
+
+func TestTransformSystemEvent(t *testing.T) {
+	rules, err := ParseRules(`[
+		{"attribute": "task_id", "system_event": "reload|config-save", "action": "drop"},
+		{"attribute": "user", "action": "drop"}
+	]`)
+	assert.NoError(t, err)
+	tr, err := New(nopLogger{}, rules, nil)
+	assert.NoError(t, err)
+
+	save := &tq.AcctRequest{User: "admin", Args: tq.Args{"task_id=7", "service=system", "event=sys_acct", "reason=write memory"}}
+	tr.Transform(save)
+	assert.Equal(t, tq.AuthenUser(""), save.User)
+	assert.Equal(t, tq.Args{"service=system", "event=sys_acct", "reason=write memory"}, save.Args)
+
+	// a rule with a system_event predicate never applies to other records
+	shell := &tq.AcctRequest{User: "admin", Args: tq.Args{"task_id=8", "service=shell", "cmd=reload"}}
+	tr.Transform(shell)
+	assert.Equal(t, tq.AuthenUser(""), shell.User)
+	assert.Equal(t, tq.Args{"task_id=8", "service=shell", "cmd=reload"}, shell.Args)
+}
+
+// customerRecord is a shell accounting record whose cmd-args carry a customer identifier
+func customerRecord(flag tq.AcctRequestFlag) *tq.AcctRequest {
+	return &tq.AcctRequest{
+		Flags:   flag,
+		User:    "mr_uses_group",
+		Port:    "tty0",
+		RemAddr: "192.0.2.44",
+		Args:    tq.Args{"task_id=41", "service=shell", "cmd=show", "cmd-arg=customer", "cmd-arg=acme-corp-4471", "noname"},
+	}
+}
+
+func TestTransformAllowlist(t *testing.T) {
+	rules, err := ParseRules(`[
+		{"attribute": "task_id|service|cmd", "action": "passthrough"},
+		{"attribute": "user", "action": "hmac"}
+	]`)
+	assert.NoError(t, err)
+	tr, err := New(nopLogger{}, rules, nil, ParseOptions(map[string]string{
+		"attribute_default":  "drop",
+		"attribute_hmac_key": "analytics-key",
+	})...)
+	assert.NoError(t, err)
+
+	record := customerRecord(tq.AcctFlagStart)
+	tr.Transform(record)
+	// cmd is allowed but cmd-arg is not, and neither is an arg without a name
+	assert.Equal(t, tq.Args{"task_id=41", "service=shell", "cmd=show"}, record.Args)
+	assert.Equal(t, tq.AuthenUser("hmac-sha256:602a549a8fb2a1347f39355903c0f2d9128d168cad0a3ec9a0f00d8edbb46e2d"), record.User)
+	assert.Equal(t, tq.AuthenPort(""), record.Port)
+	assert.Equal(t, tq.AuthenRemAddr(""), record.RemAddr)
+}
+
+func TestTransformDenylist(t *testing.T) {
+	rules, err := ParseRules(`[{"attribute": "cmd-arg", "action": "hmac"}, {"attribute": "rem-addr", "action": "drop"}]`)
+	assert.NoError(t, err)
+	tr, err := New(nopLogger{}, rules, nil, SetHMACKey([]byte("analytics-key")))
+	assert.NoError(t, err)
+
+	record := customerRecord(tq.AcctFlagStart)
+	tr.Transform(record)
+	// each cmd-arg is hashed on its own, cmd itself is left alone
+	assert.Equal(t, tq.Args{
+		"task_id=41",
+		"service=shell",
+		"cmd=show",
+		"cmd-arg=hmac-sha256:41a843e11b3ac30abf66a88797edd43f7819fab705f9f13c212133dedc5bccfb",
+		"cmd-arg=hmac-sha256:ed5be2d15a105ad1e84f8c779345646df28ace29942b4f903add8292a5511a2b",
+		"noname",
+	}, record.Args)
+	assert.Equal(t, tq.AuthenUser("mr_uses_group"), record.User)
+	assert.Equal(t, tq.AuthenRemAddr(""), record.RemAddr)
+}
+
+func TestTransformPerSink(t *testing.T) {
+	audit, err := New(nopLogger{}, nil, nil)
+	assert.NoError(t, err)
+	analytics, err := New(nopLogger{}, nil, nil, SetDefault(HMAC), SetHMACKey([]byte("analytics-key")))
+	assert.NoError(t, err)
+
+	full, hashed := customerRecord(tq.AcctFlagStart), customerRecord(tq.AcctFlagStart)
+	audit.Transform(full)
+	analytics.Transform(hashed)
+	assert.Equal(t, customerRecord(tq.AcctFlagStart), full)
+	assert.Contains(t, hashed.Args, tq.Arg("cmd-arg=hmac-sha256:ed5be2d15a105ad1e84f8c779345646df28ace29942b4f903add8292a5511a2b"))
+	assert.NotContains(t, hashed.Args, tq.Arg("noname"))
+}
+
+func TestTransformHMACStability(t *testing.T) {
+	newAnalytics := func(key string) *Transformer {
+		rules, err := ParseRules(`[{"attribute": "task_id|cmd-arg", "action": "hmac"}]`)
+		assert.NoError(t, err)
+		tr, err := New(nopLogger{}, rules, nil, SetHMACKey([]byte(key)))
+		assert.NoError(t, err)
+		return tr
+	}
+	taskID := func(r *tq.AcctRequest) tq.Arg { return r.Args[0] }
+
+	// the start and stop of a task correlate, across transformers and restarts with the same key
+	start, stop := customerRecord(tq.AcctFlagStart), customerRecord(tq.AcctFlagStop)
+	newAnalytics("analytics-key").Transform(start)
+	newAnalytics("analytics-key").Transform(stop)
+	assert.Equal(t, tq.Arg("task_id=hmac-sha256:c330370275754637389b7ddb2a651b5b38f5d303df25e443c7bc0731589a56d3"), taskID(start))
+	assert.Equal(t, taskID(start), taskID(stop))
+
+	// but not across keys
+	other := customerRecord(tq.AcctFlagStart)
+	newAnalytics("another-key").Transform(other)
+	assert.NotEqual(t, taskID(start), taskID(other))
+}
+
+func TestTransformInvalidOptions(t *testing.T) {
+	hmacRules, err := ParseRules(`[{"attribute": "user", "action": "hmac"}]`)
+	assert.NoError(t, err)
+	_, err = New(nopLogger{}, hmacRules, nil)
+	assert.Error(t, err, "hmac rule without a key")
+	_, err = New(nopLogger{}, nil, nil, SetDefault(HMAC))
+	assert.Error(t, err, "hmac default without a key")
+	_, err = New(nopLogger{}, nil, nil, SetDefault("encrypt"))
+	assert.Error(t, err, "unknown default")
+
+	// task_id may not be hashed in start records only
+	_, err = ParseRules(`[{"attribute": "task_id", "system_event": "start", "action": "hmac"}]`)
+	assert.Error(t, err)
+	_, err = ParseRules(`[{"attribute": "task_.*", "system_event": "start|stop", "action": "hmac"}]`)
+	assert.NoError(t, err)
+}
+
+func TestTruncator(t *testing.T) {
+	var got tq.Request
+	next := tq.HandlerFunc(func(response tq.Response, request tq.Request) { got = request })
+	truncator := NewTruncator(nopLogger{}, tq.SinkLimits{Name: "syslog", Value: 100}, next)
+
+	short, err := customerRecord(tq.AcctFlagStart).MarshalBinary()
+	assert.NoError(t, err)
+	truncator.Handle(nopResponse{}, tq.Request{Header: tq.Header{Length: uint32(len(short))}, Body: short, Context: context.Background()})
+	assert.Equal(t, short, got.Body, "a request within the limits is passed on as it is")
+
+	long := customerRecord(tq.AcctFlagStart)
+	long.Args = append(long.Args, tq.Arg("cmd-arg="+strings.Repeat("x", 200)))
+	b, err := long.MarshalBinary()
+	assert.NoError(t, err)
+	truncator.Handle(nopResponse{}, tq.Request{Header: tq.Header{Length: uint32(len(b))}, Body: b, Context: context.Background()})
+	assert.Equal(t, uint32(len(got.Body)), got.Header.Length)
+	var body tq.AcctRequest
+	assert.NoError(t, tq.Unmarshal(got.Body, &body))
+	assert.Equal(t, long.Args[:len(long.Args)-1], body.Args[:len(body.Args)-1])
+	a, _, v := body.Args[len(body.Args)-1].ASV()
+	assert.Equal(t, "cmd-arg", a)
+	assert.Len(t, v, 100)
+	assert.Contains(t, v, "...[truncated from 200 bytes sha256:")
+}
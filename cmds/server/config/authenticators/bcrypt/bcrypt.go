@@ -116,12 +116,7 @@ func (a Authenticator) Handle(response tq.Response, request tq.Request) {
 		secret, err := hex.DecodeString(a.hash)
 		if err != nil {
 			a.Errorf(request.Context, "error decoding the hex encoded password for user [%v]; %v", a.username, err)
-			response.Reply(
-				tq.NewAuthenReply(
-					tq.SetAuthenReplyStatus(tq.AuthenStatusFail),
-					tq.SetAuthenReplyServerMsg("login failure"),
-				),
-			)
+			response.Reply(tq.NewDenial(tq.Authenticate, tq.DenialBadCredential, ""))
 			return
 		}
 		expectedHash = secret
@@ -129,12 +124,7 @@ func (a Authenticator) Handle(response tq.Response, request tq.Request) {
 		secret, err := a.GetSecret(request.Context, a.username, a.group)
 		if err != nil {
 			a.Errorf(request.Context, "failure in keychain query for user [%v] using a sha512 hashed password; %v", a.username, err)
-			response.Reply(
-				tq.NewAuthenReply(
-					tq.SetAuthenReplyStatus(tq.AuthenStatusFail),
-					tq.SetAuthenReplyServerMsg("login failure"),
-				),
-			)
+			response.Reply(tq.NewDenial(tq.Authenticate, tq.DenialBadCredential, ""))
 		}
 		expectedHash = secret
 	}
@@ -151,10 +141,5 @@ func (a Authenticator) Handle(response tq.Response, request tq.Request) {
 	}
 
 	a.Errorf(request.Context, "failed to validate the user [%v] using a bcrypt password", a.username)
-	response.Reply(
-		tq.NewAuthenReply(
-			tq.SetAuthenReplyStatus(tq.AuthenStatusFail),
-			tq.SetAuthenReplyServerMsg("login failure"),
-		),
-	)
+	response.Reply(tq.NewDenial(tq.Authenticate, tq.DenialBadCredential, ""))
 }
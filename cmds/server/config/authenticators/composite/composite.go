@@ -0,0 +1,300 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+// Package composite implements an authenticator that spreads requests over several backend
+// authenticators, eg a primary and secondary LDAP, by weighted round-robin.  A backend that replies
+// with an error or does not reply in time is failed over to the next one and is skipped for a
+// cooldown.  A pass or fail is a definitive answer and is never failed over.
+package composite
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	tq "github.com/facebookincubator/tacquito"
+	"github.com/facebookincubator/tacquito/extension"
+)
+
+// loggerProvider provides the logging implementation
+type loggerProvider interface {
+	Infof(ctx context.Context, format string, args ...interface{})
+	Errorf(ctx context.Context, format string, args ...interface{})
+}
+
+// Option is the setter type for Authenticator
+type Option func(a *Authenticator)
+
+// SetBackend adds a backend named name.  Each backend is created from f with the username and
+// options of the composite authenticator.  A backend with a weight of 2 is tried first twice as
+// often as one with a weight of 1.  Weights below 1 are treated as 1.
+func SetBackend(name string, f extension.AuthenticatorFactory, weight int) Option {
+	return func(a *Authenticator) {
+		if weight < 1 {
+			weight = 1
+		}
+		a.backends = append(a.backends, &backend{name: name, factory: f, weight: weight})
+	}
+}
+
+// SetTimeout sets how long a backend may take to reply before it is failed over.  The default is
+// 5 seconds.
+func SetTimeout(v time.Duration) Option {
+	return func(a *Authenticator) {
+		a.timeout = v
+	}
+}
+
+// SetCooldown sets how long a backend that failed is skipped for.  The default is 30 seconds.
+func SetCooldown(v time.Duration) Option {
+	return func(a *Authenticator) {
+		a.cooldown = v
+	}
+}
+
+// New returns a composite authenticator factory
+func New(l loggerProvider, opts ...Option) *Authenticator {
+	a := &Authenticator{
+		loggerProvider: l,
+		timeout:        5 * time.Second,
+		cooldown:       30 * time.Second,
+		now:            time.Now,
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// Authenticator holds the backends and their health.  Health is shared by every user, so a dead
+// backend found by one user is skipped for all of them.
+type Authenticator struct {
+	loggerProvider
+	backends []*backend
+	timeout  time.Duration
+	cooldown time.Duration
+	now      func() time.Time
+
+	mu sync.Mutex
+}
+
+// backend is a single authenticator type within the composite
+type backend struct {
+	name    string
+	factory extension.AuthenticatorFactory
+	weight  int
+	// current is the smooth weighted round-robin state
+	current int
+	// downUntil is when the backend may be tried again after an error
+	downUntil time.Time
+}
+
+// New creates the composite authenticator for username.  Backends that cannot be created for the
+// user are logged and left out.
+func (a *Authenticator) New(username string, options map[string]string) (tq.Handler, error) {
+	u := &userAuthenticator{Authenticator: a, username: username, handlers: map[*backend]tq.Handler{}}
+	for _, b := range a.backends {
+		h, err := b.factory.New(username, options)
+		if err != nil {
+			a.Errorf(context.Background(), "composite backend [%v] is unavailable for user [%v]; %v", b.name, username, err)
+			continue
+		}
+		u.handlers[b] = h
+	}
+	if len(u.handlers) == 0 {
+		return nil, fmt.Errorf("no composite backends available for user [%v]", username)
+	}
+	return u, nil
+}
+
+// order returns the backends to try, in order.  The first is chosen by smooth weighted round-robin
+// among the healthy backends, followed by the other healthy backends by weight, then the backends
+// in cooldown.  Backends in cooldown are still tried last so a recovered backend is not lost
+// when every backend had failed.
+func (a *Authenticator) order(available map[*backend]tq.Handler) []*backend {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+	var healthy, down []*backend
+	for _, b := range a.backends {
+		if _, ok := available[b]; !ok {
+			continue
+		}
+		if now.Before(b.downUntil) {
+			down = append(down, b)
+			continue
+		}
+		healthy = append(healthy, b)
+	}
+	if len(healthy) == 0 {
+		return down
+	}
+	total := 0
+	var first *backend
+	for _, b := range healthy {
+		b.current += b.weight
+		total += b.weight
+		if first == nil || b.current > first.current {
+			first = b
+		}
+	}
+	first.current -= total
+	order := []*backend{first}
+	for _, b := range healthy {
+		if b != first {
+			order = append(order, b)
+		}
+	}
+	return append(order, down...)
+}
+
+// BackendHealth is the health of a composite backend, see Authenticator.Health
+type BackendHealth struct {
+	Name    string `json:"name"`
+	Weight  int    `json:"weight"`
+	Healthy bool   `json:"healthy"`
+	// DownUntil is when a backend in cooldown may be tried again
+	DownUntil *time.Time `json:"down_until,omitempty"`
+}
+
+// Health returns the health of each backend, in the order they were added
+func (a *Authenticator) Health() []BackendHealth {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+	health := make([]BackendHealth, 0, len(a.backends))
+	for _, b := range a.backends {
+		h := BackendHealth{Name: b.name, Weight: b.weight, Healthy: !now.Before(b.downUntil)}
+		if !h.Healthy {
+			downUntil := b.downUntil
+			h.DownUntil = &downUntil
+		}
+		health = append(health, h)
+	}
+	return health
+}
+
+// markDown starts the cooldown of b
+func (a *Authenticator) markDown(b *backend) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	b.downUntil = a.now().Add(a.cooldown)
+}
+
+// userAuthenticator is the composite authenticator of a single user
+type userAuthenticator struct {
+	*Authenticator
+	username string
+	handlers map[*backend]tq.Handler
+}
+
+// Handle tries each backend in turn until one gives a definitive answer
+func (u *userAuthenticator) Handle(response tq.Response, request tq.Request) {
+	for i, b := range u.order(u.handlers) {
+		if i > 0 {
+			compositeFailover.Inc()
+		}
+		ctx, cancel := context.WithTimeout(request.Context, u.timeout)
+		r, finished := u.try(ctx, u.handlers[b], request)
+		timedOut := ctx.Err() != nil
+		cancel()
+		if request.Context.Err() != nil {
+			// the request itself was canceled, which says nothing about the health of b
+			return
+		}
+		reason := "timed out"
+		if finished {
+			reason = r.backendError(timedOut)
+		}
+		if reason != "" {
+			compositeBackendError.WithLabelValues(b.name).Inc()
+			u.Errorf(request.Context, "[%v] composite backend [%v] %v for user [%v]; failing over", request.Header.SessionID, b.name, reason, u.username)
+			u.markDown(b)
+			continue
+		}
+		r.flush(response)
+		return
+	}
+	response.Reply(
+		tq.NewAuthenReply(
+			tq.SetAuthenReplyStatus(tq.AuthenStatusError),
+			tq.SetAuthenReplyServerMsg("authentication backends unavailable"),
+		),
+	)
+}
+
+// abandonAfter is how long a backend may keep running after its context is done before it is
+// abandoned.  Backends that honor their context return well within it.
+const abandonAfter = 50 * time.Millisecond
+
+// try calls h with request under ctx.  A backend that ignores ctx is abandoned abandonAfter ctx is
+// done, so a hung backend holds up the request no longer than the timeout.  finished is false for
+// an abandoned backend, whose response must not be used.
+func (u *userAuthenticator) try(ctx context.Context, h tq.Handler, request tq.Request) (*bufferedResponse, bool) {
+	r := &bufferedResponse{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.Handle(r, tq.Request{Header: request.Header, Body: request.Body, Context: ctx})
+	}()
+	select {
+	case <-done:
+		return r, true
+	case <-ctx.Done():
+	}
+	select {
+	case <-done:
+		return r, true
+	case <-time.After(abandonAfter):
+		compositeAbandoned.Inc()
+		return nil, false
+	}
+}
+
+// bufferedResponse holds the answer of a backend until it is known to be definitive
+type bufferedResponse struct {
+	reply   tq.EncoderDecoder
+	packet  *tq.Packet
+	next    tq.Handler
+	writers []io.Writer
+}
+
+func (r *bufferedResponse) Reply(v tq.EncoderDecoder) (int, error) { r.reply = v; return 0, nil }
+func (r *bufferedResponse) Write(p *tq.Packet) (int, error)        { r.packet = p; return 0, nil }
+func (r *bufferedResponse) Next(next tq.Handler)                   { r.next = next }
+func (r *bufferedResponse) RegisterWriter(w io.Writer)             { r.writers = append(r.writers, w) }
+
+// backendError returns why the answer is not definitive, or an empty string if it is
+func (r *bufferedResponse) backendError(timedOut bool) string {
+	if r.reply == nil && r.packet == nil {
+		if timedOut {
+			return "timed out"
+		}
+		return "did not reply"
+	}
+	if reply, ok := r.reply.(*tq.AuthenReply); ok && reply.Status == tq.AuthenStatusError {
+		return "replied with an error"
+	}
+	return ""
+}
+
+// flush forwards the buffered answer to response
+func (r *bufferedResponse) flush(response tq.Response) {
+	for _, w := range r.writers {
+		response.RegisterWriter(w)
+	}
+	if r.next != nil {
+		response.Next(r.next)
+	}
+	if r.reply != nil {
+		response.Reply(r.reply)
+		return
+	}
+	response.Write(r.packet)
+}
@@ -0,0 +1,175 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package composite
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	tq "github.com/facebookincubator/tacquito"
+	"github.com/facebookincubator/tacquito/internal/canceltest"
+	"github.com/stretchr/testify/assert"
+)
+
+type nopLogger struct{}
+
+func (nopLogger) Infof(ctx context.Context, format string, args ...interface{})  {}
+func (nopLogger) Errorf(ctx context.Context, format string, args ...interface{}) {}
+
+// fakeBackend replies with status, or blocks until the request context expires if status is 0
+type fakeBackend struct {
+	status tq.AuthenStatus
+	calls  int
+}
+
+func (f *fakeBackend) New(username string, options map[string]string) (tq.Handler, error) {
+	return tq.HandlerFunc(func(response tq.Response, request tq.Request) {
+		f.calls++
+		if f.status == 0 {
+			<-request.Context.Done()
+			return
+		}
+		response.Reply(tq.NewAuthenReply(tq.SetAuthenReplyStatus(f.status)))
+	}), nil
+}
+
+// replyResponse keeps the last reply
+type replyResponse struct {
+	reply tq.EncoderDecoder
+}
+
+func (r *replyResponse) Reply(v tq.EncoderDecoder) (int, error) { r.reply = v; return 0, nil }
+func (r *replyResponse) Write(p *tq.Packet) (int, error)        { return 0, nil }
+func (r *replyResponse) Next(next tq.Handler)                   {}
+func (r *replyResponse) RegisterWriter(io.Writer)               {}
+
+func authenticate(t *testing.T, h tq.Handler) tq.AuthenStatus {
+	resp := &replyResponse{}
+	h.Handle(resp, tq.Request{Header: *tq.NewHeader(tq.SetHeaderType(tq.Authenticate)), Context: context.Background()})
+	reply, ok := resp.reply.(*tq.AuthenReply)
+	assert.True(t, ok)
+	return reply.Status
+}
+
+func TestFailoverOnBackendError(t *testing.T) {
+	primary := &fakeBackend{status: tq.AuthenStatusError}
+	secondary := &fakeBackend{status: tq.AuthenStatusPass}
+	a := New(nopLogger{}, SetBackend("primary", primary, 1), SetBackend("secondary", secondary, 1))
+	h, err := a.New("mr_uses_group", nil)
+	assert.NoError(t, err)
+
+	// the primary is tried first, fails over, and is then skipped during its cooldown
+	assert.Equal(t, tq.AuthenStatusPass, authenticate(t, h))
+	assert.Equal(t, tq.AuthenStatusPass, authenticate(t, h))
+	assert.Equal(t, tq.AuthenStatusPass, authenticate(t, h))
+	assert.Equal(t, 1, primary.calls)
+	assert.Equal(t, 3, secondary.calls)
+}
+
+func TestFailoverOnTimeout(t *testing.T) {
+	primary := &fakeBackend{}
+	secondary := &fakeBackend{status: tq.AuthenStatusPass}
+	a := New(nopLogger{}, SetBackend("primary", primary, 1), SetBackend("secondary", secondary, 1), SetTimeout(10*time.Millisecond))
+	h, err := a.New("mr_uses_group", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, tq.AuthenStatusPass, authenticate(t, h))
+	assert.Equal(t, 1, primary.calls)
+	assert.Equal(t, 1, secondary.calls)
+}
+
+// hungBackend never returns, whatever its context
+type hungBackend struct{}
+
+func (hungBackend) New(username string, options map[string]string) (tq.Handler, error) {
+	return tq.HandlerFunc(func(response tq.Response, request tq.Request) {
+		select {}
+	}), nil
+}
+
+func TestHungBackendCanceled(t *testing.T) {
+	a := New(nopLogger{}, SetBackend("hung", hungBackend{}, 1))
+	h, err := a.New("mr_uses_group", nil)
+	assert.NoError(t, err)
+	canceltest.ReturnsWithin(t, abandonAfter+canceltest.Limit, func(ctx context.Context) error {
+		h.Handle(&replyResponse{}, tq.Request{Header: *tq.NewHeader(tq.SetHeaderType(tq.Authenticate)), Context: ctx})
+		return nil
+	})
+	// the request was canceled, the backend did not fail
+	assert.Equal(t, []BackendHealth{{Name: "hung", Weight: 1, Healthy: true}}, a.Health())
+}
+
+func TestHungBackendTimeout(t *testing.T) {
+	secondary := &fakeBackend{status: tq.AuthenStatusPass}
+	a := New(nopLogger{}, SetBackend("hung", hungBackend{}, 1), SetBackend("secondary", secondary, 1), SetTimeout(10*time.Millisecond))
+	h, err := a.New("mr_uses_group", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, tq.AuthenStatusPass, authenticate(t, h))
+	assert.Equal(t, 1, secondary.calls)
+}
+
+func TestNoFailoverOnFail(t *testing.T) {
+	primary := &fakeBackend{status: tq.AuthenStatusFail}
+	secondary := &fakeBackend{status: tq.AuthenStatusPass}
+	a := New(nopLogger{}, SetBackend("primary", primary, 1), SetBackend("secondary", secondary, 1))
+	h, err := a.New("mr_uses_group", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, tq.AuthenStatusFail, authenticate(t, h))
+	assert.Equal(t, 1, primary.calls)
+	assert.Equal(t, 0, secondary.calls)
+}
+
+func TestAllBackendsDown(t *testing.T) {
+	primary := &fakeBackend{status: tq.AuthenStatusError}
+	secondary := &fakeBackend{status: tq.AuthenStatusError}
+	a := New(nopLogger{}, SetBackend("primary", primary, 1), SetBackend("secondary", secondary, 1))
+	h, err := a.New("mr_uses_group", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, tq.AuthenStatusError, authenticate(t, h))
+	// backends in cooldown are still tried when there is nothing else
+	assert.Equal(t, tq.AuthenStatusError, authenticate(t, h))
+	assert.Equal(t, 2, primary.calls)
+	assert.Equal(t, 2, secondary.calls)
+}
+
+func TestCooldownExpires(t *testing.T) {
+	primary := &fakeBackend{status: tq.AuthenStatusError}
+	secondary := &fakeBackend{status: tq.AuthenStatusPass}
+	now := time.Unix(0, 0)
+	a := New(nopLogger{}, SetBackend("primary", primary, 10), SetBackend("secondary", secondary, 1), SetCooldown(time.Minute))
+	a.now = func() time.Time { return now }
+	h, err := a.New("mr_uses_group", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, tq.AuthenStatusPass, authenticate(t, h))
+	assert.Equal(t, tq.AuthenStatusPass, authenticate(t, h))
+	assert.Equal(t, 1, primary.calls)
+	downUntil := now.Add(time.Minute)
+	assert.Equal(t, []BackendHealth{
+		{Name: "primary", Weight: 10, DownUntil: &downUntil},
+		{Name: "secondary", Weight: 1, Healthy: true},
+	}, a.Health())
+
+	now = now.Add(time.Minute)
+	primary.status = tq.AuthenStatusPass
+	assert.Equal(t, tq.AuthenStatusPass, authenticate(t, h))
+	assert.Equal(t, 2, primary.calls)
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	primary := &fakeBackend{status: tq.AuthenStatusPass}
+	secondary := &fakeBackend{status: tq.AuthenStatusPass}
+	a := New(nopLogger{}, SetBackend("primary", primary, 3), SetBackend("secondary", secondary, 1))
+	h, err := a.New("mr_uses_group", nil)
+	assert.NoError(t, err)
+	for i := 0; i < 8; i++ {
+		authenticate(t, h)
+	}
+	assert.Equal(t, 6, primary.calls)
+	assert.Equal(t, 2, secondary.calls)
+}
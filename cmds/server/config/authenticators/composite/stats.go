@@ -0,0 +1,36 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package composite
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	compositeFailover = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "tacquito",
+		Name:      "composite_authenticator_failover",
+		Help:      "number of requests passed to a further backend after a backend error",
+	})
+	compositeBackendError = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tacquito",
+		Name:      "composite_authenticator_backend_error",
+		Help:      "number of backend errors and timeouts, by backend",
+	}, []string{"backend"})
+	compositeAbandoned = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "tacquito",
+		Name:      "composite_authenticator_abandoned",
+		Help:      "number of backend calls abandoned because they ignored the cancellation of their context",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(compositeFailover)
+	prometheus.MustRegister(compositeBackendError)
+	prometheus.MustRegister(compositeAbandoned)
+}
@@ -10,7 +10,9 @@ package stringy
 
 import (
 	"context"
+	"fmt"
 	"regexp"
+	"strings"
 
 	tq "github.com/facebookincubator/tacquito"
 	"github.com/facebookincubator/tacquito/cmds/server/config"
@@ -46,6 +48,12 @@ type CommandBasedAuthorizer struct {
 	ctx  context.Context
 	body tq.AuthorRequest
 	user config.User
+	// regexes are the compiled command matches of user, patterns they do not hold are compiled
+	// when evaluated
+	regexes map[string]*regexp.Regexp
+	// conditions are the compiled `when` expressions of user, which are likewise compiled when
+	// evaluated if they are missing
+	conditions *conditions
 }
 
 // Handle will respond with failures or accepts as needed
@@ -72,6 +80,15 @@ func (a CommandBasedAuthorizer) Handle(response tq.Response, request tq.Request)
 }
 
 func (a CommandBasedAuthorizer) evaluate() bool {
+	permit, _, _ := a.explain()
+	return permit
+}
+
+// explain evaluates the command against the user's commands and returns the decision along with
+// the rule that produced it.  An empty rule means no command matched and the default deny applied.
+// A command with a `when` expression only applies if the request satisfies it, and the trace holds
+// the value of every part of the expressions evaluated.  An expression that fails denies.
+func (a CommandBasedAuthorizer) explain() (bool, string, []string) {
 	cmd := a.body.Args.Command()
 	returnBool := func(c config.Action) bool {
 		switch c {
@@ -82,27 +99,63 @@ func (a CommandBasedAuthorizer) evaluate() bool {
 		}
 	}
 
+	var trace []string
 	for _, c := range a.user.Commands {
-		c.TrimSpace()
-		if c.Name == "*" {
+		// the config is shared by concurrent requests, so it is trimmed without being modified
+		name := strings.TrimSpace(c.Name)
+		var rule string
+		switch {
+		case name == "*":
 			// special condition of allow anything
-			return returnBool(c.Action)
-		}
-		if c.Name != cmd {
+			rule = "command *"
+		case name != cmd:
 			continue
-		}
-		if len(c.Match) == 0 {
+		case len(c.Match) == 0:
 			// cmd matches, but we have no conditions, so match it
-			return returnBool(c.Action)
+			rule = fmt.Sprintf("command %v", name)
+		default:
+			var matched, bad bool
+			if rule, matched, bad = a.match(name, c.Match); bad {
+				return false, rule, trace
+			}
+			if !matched {
+				continue
+			}
 		}
-		for _, regexish := range c.Match {
-			if matched, err := regexp.MatchString(regexish, a.body.Args.CommandArgs()); err != nil {
+		if when := strings.TrimSpace(c.When); when != "" {
+			ok, t, err := a.conditions.eval(a.ctx, a.body, a.user, rule, when)
+			trace = append(trace, t...)
+			rule = fmt.Sprintf("%v when %v", rule, when)
+			if err != nil {
+				a.Errorf(a.ctx, "unable to evaluate the condition of [%v]; %v", rule, err)
+				return false, rule, trace
+			}
+			if !ok {
+				continue
+			}
+		}
+		return returnBool(c.Action), rule, trace
+	}
+	return false, "", trace
+}
+
+// match returns the rule of the first pattern of the command name that the command args match.
+// bad is set if a pattern does not compile, which denies.
+func (a CommandBasedAuthorizer) match(name string, patterns []string) (rule string, matched, bad bool) {
+	for _, regexish := range patterns {
+		regexish = strings.TrimSpace(regexish)
+		rule = fmt.Sprintf("command %v match %v", name, regexish)
+		re, ok := a.regexes[regexish]
+		if !ok {
+			var err error
+			if re, err = regexp.Compile(regexish); err != nil {
 				a.Errorf(a.ctx, "bad regex detected; %v", err)
-				return false
-			} else if matched {
-				return returnBool(c.Action)
+				return rule, false, true
 			}
 		}
+		if re.MatchString(a.body.Args.CommandArgs()) {
+			return rule, true, false
+		}
 	}
-	return false
+	return "", false, false
 }
@@ -0,0 +1,227 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package stringy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	tq "github.com/facebookincubator/tacquito"
+	"github.com/facebookincubator/tacquito/cmds/server/config"
+)
+
+// Difference fields name what differs between two evaluations of a PolicyInput, see
+// ComparePolicies
+const (
+	// DiffAuthentication is a user known to one evaluator but not the other, or verified by
+	// authenticators of different types
+	DiffAuthentication = "authentication"
+	// DiffDecision is an authorization request decided with different statuses
+	DiffDecision = "decision"
+	// DiffRule is an authorization request decided by different rules
+	DiffRule = "rule"
+	// DiffArgs is an authorization request that returns different args
+	DiffArgs = "args"
+	// DiffError is an input only one evaluator could evaluate, or that both failed differently
+	DiffError = "error"
+)
+
+// Evaluation is what a server would decide for a PolicyInput
+type Evaluation struct {
+	// Known is set if the user is in the device group, so the server would authenticate it
+	Known bool
+	// Authenticator is the type of the authenticator that would verify the credentials of the user,
+	// zero for an unknown user or a user without one
+	Authenticator config.AuthenticatorType
+	// Authorization is the decision for the authorization request of the input
+	Authorization Decision
+}
+
+// Evaluator evaluates inputs without a network, eg a policy, see NewPolicyEvaluator.  Any evaluator
+// with the semantics of Authorizer.Explain can be compared with ComparePolicies.
+type Evaluator interface {
+	Evaluate(in PolicyInput) (Evaluation, error)
+}
+
+// NewPolicyEvaluator returns an Evaluator of policy.  The authorizer of each user, device group and
+// groups is built once and reused, so inputs that repeat them, as recorded traffic does, are
+// evaluated quickly.  It is not safe for concurrent use.
+func NewPolicyEvaluator(l loggerProvider, policy config.ServerConfig) *PolicyEvaluator {
+	return &PolicyEvaluator{root: New(l), policy: policy, scoped: map[string]*policyScope{}}
+}
+
+// PolicyEvaluator is an Evaluator of a policy, see NewPolicyEvaluator
+type PolicyEvaluator struct {
+	root   *Authorizer
+	policy config.ServerConfig
+	// scoped holds the authorizers of every user, device group and groups evaluated
+	scoped map[string]*policyScope
+}
+
+// policyScope is the authorizer of a user in a device group, nil for a user that is not in it
+type policyScope struct {
+	authorizer    *Authorizer
+	authenticator config.AuthenticatorType
+}
+
+// Evaluate implements Evaluator
+func (e *PolicyEvaluator) Evaluate(in PolicyInput) (Evaluation, error) {
+	key := in.User + "\x00" + in.DeviceGroup
+	if in.Groups != nil {
+		key += "\x00" + strings.Join(in.Groups, "\x00")
+	}
+	scope, ok := e.scoped[key]
+	if !ok {
+		user, found, err := policyUser(e.policy, in)
+		if err != nil {
+			return Evaluation{}, err
+		}
+		scope = &policyScope{}
+		if found {
+			handler, err := e.root.New(user)
+			if err != nil {
+				return Evaluation{}, err
+			}
+			scope.authorizer = handler.(*Authorizer)
+			if user.Authenticator != nil {
+				scope.authenticator = user.Authenticator.Type
+			}
+		}
+		e.scoped[key] = scope
+	}
+	if scope.authorizer == nil {
+		// the server never reaches the authorizer for users that are not in the device group
+		return Evaluation{Authorization: Decision{Status: tq.AuthorStatusFail, Rule: UnknownUserRule}}, nil
+	}
+	return Evaluation{
+		Known:         true,
+		Authenticator: scope.authenticator,
+		Authorization: scope.authorizer.Explain(policyContext(in), policyRequest(in)),
+	}, nil
+}
+
+// ComparisonDiff is an input two evaluators decided differently
+type ComparisonDiff struct {
+	// Index is the position of the input in the inputs compared
+	Index int
+	Input PolicyInput
+	// A and B are the evaluations of the input, and ErrA and ErrB their errors, if any
+	A, B       Evaluation
+	ErrA, ErrB error
+	// Fields name what differs, eg DiffDecision and DiffRule
+	Fields []string
+}
+
+// ComparisonReport is the result of ComparePolicies
+type ComparisonReport struct {
+	// Total is the number of inputs compared, and Same the number decided the same by both
+	Total int
+	Same  int
+	// Fields counts the differences by field
+	Fields map[string]int
+	Diffs  []ComparisonDiff
+}
+
+// String renders a summary of the report, followed by every difference
+func (r ComparisonReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%v inputs, %v same, %v different", r.Total, r.Same, len(r.Diffs))
+	fields := make([]string, 0, len(r.Fields))
+	for f := range r.Fields {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	for i, f := range fields {
+		sep := ", "
+		if i == 0 {
+			sep = " ("
+		}
+		fmt.Fprintf(&b, "%v%v %v", sep, f, r.Fields[f])
+	}
+	if len(fields) > 0 {
+		b.WriteString(")")
+	}
+	b.WriteString("\n")
+	for _, d := range r.Diffs {
+		fmt.Fprintf(&b, "DIFF %v user [%v] device group [%v] service [%v] cmd [%v]: %v\n", d.Index, d.Input.User, d.Input.DeviceGroup, d.Input.Service, strings.TrimSpace(d.Input.Cmd+" "+strings.Join(d.Input.CmdArgs, " ")), strings.Join(d.Fields, ", "))
+		fmt.Fprintf(&b, "    a: %v\n", describeEvaluation(d.A, d.ErrA))
+		fmt.Fprintf(&b, "    b: %v\n", describeEvaluation(d.B, d.ErrB))
+	}
+	return b.String()
+}
+
+// describeEvaluation renders e, or err if it is set
+func describeEvaluation(e Evaluation, err error) string {
+	if err != nil {
+		return fmt.Sprintf("error %v", err)
+	}
+	authen := "unknown user"
+	if e.Known {
+		authen = "known user"
+		if e.Authenticator != 0 {
+			authen += fmt.Sprintf(" authenticated by authenticator type %d", e.Authenticator)
+		}
+	}
+	return fmt.Sprintf("%v, %v by rule [%v] args %q", authen, e.Authorization.Status, e.Authorization.Rule, e.Authorization.Args)
+}
+
+// ComparePolicies evaluates every input with a and b, eg the policies of an old and a new server,
+// and reports the inputs they decide differently.  Inputs are usually recorded traffic, so no
+// network is involved.
+func ComparePolicies(a, b Evaluator, inputs []PolicyInput) ComparisonReport {
+	report := ComparisonReport{Total: len(inputs), Fields: map[string]int{}}
+	for i, in := range inputs {
+		d := ComparisonDiff{Index: i, Input: in}
+		d.A, d.ErrA = a.Evaluate(in)
+		d.B, d.ErrB = b.Evaluate(in)
+		d.Fields = compareEvaluations(d)
+		if len(d.Fields) == 0 {
+			report.Same++
+			continue
+		}
+		for _, f := range d.Fields {
+			report.Fields[f]++
+		}
+		report.Diffs = append(report.Diffs, d)
+	}
+	return report
+}
+
+// compareEvaluations returns the fields the evaluations of d differ in
+func compareEvaluations(d ComparisonDiff) []string {
+	if d.ErrA != nil || d.ErrB != nil {
+		if d.ErrA != nil && d.ErrB != nil && d.ErrA.Error() == d.ErrB.Error() {
+			return nil
+		}
+		return []string{DiffError}
+	}
+	var fields []string
+	if d.A.Known != d.B.Known || d.A.Authenticator != d.B.Authenticator {
+		fields = append(fields, DiffAuthentication)
+	}
+	a, b := d.A.Authorization, d.B.Authorization
+	if a.Status != b.Status {
+		fields = append(fields, DiffDecision)
+	}
+	if a.Rule != b.Rule {
+		fields = append(fields, DiffRule)
+	}
+	if !sameArgs(a.Args, b.Args) {
+		fields = append(fields, DiffArgs)
+	}
+	return fields
+}
+
+// sameArgs reports if a and b hold the same args, in any order
+func sameArgs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	return strings.Join(sortedCopy(a), "\n") == strings.Join(sortedCopy(b), "\n")
+}
@@ -0,0 +1,154 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package stringy
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/facebookincubator/tacquito/cmds/server/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// divergentPolicies returns the policy of testdata/policy and a copy of it that decides some
+// requests differently
+func divergentPolicies(t testing.TB) (config.ServerConfig, config.ServerConfig) {
+	old, err := LoadPolicy("testdata/policy/policy.yaml")
+	require.NoError(t, err)
+	updated, err := LoadPolicy("testdata/policy/policy.yaml")
+	require.NoError(t, err)
+	for i, u := range updated.Users {
+		switch u.Name {
+		case "alice":
+			// reload is no longer denied by name, only by default
+			neteng := &updated.Users[i].Groups[0]
+			neteng.Commands = []config.Command{neteng.Commands[0], neteng.Commands[1], neteng.Commands[3]}
+		case "bob":
+			// noc sessions get priv 5
+			updated.Users[i].Groups[0].Services[0].SetValues[0].Values = []string{"5"}
+		case "carol":
+			// carol loses configure terminal, so the noc group denies it
+			updated.Users[i].Commands = nil
+		case "root":
+			updated.Users[i].Authenticator = &config.Authenticator{Type: config.BCRYPT}
+		}
+	}
+	updated.Users = append(updated.Users, config.User{Name: "dave", Scopes: []string{"core"}, Groups: []config.Group{updated.Users[1].Groups[0]}})
+	return old, updated
+}
+
+func TestComparePolicies(t *testing.T) {
+	old, updated := divergentPolicies(t)
+	inputs := []PolicyInput{
+		{User: "alice", DeviceGroup: "core", Service: "shell", Cmd: "show", CmdArgs: []string{"version"}},
+		{User: "alice", DeviceGroup: "core", Service: "shell", Cmd: "reload"},
+		{User: "bob", DeviceGroup: "core", Service: "shell", Args: []string{"cmd="}},
+		{User: "bob", DeviceGroup: "core", Service: "shell", Cmd: "show", CmdArgs: []string{"interfaces"}},
+		{User: "carol", DeviceGroup: "edge", Service: "shell", Cmd: "configure", CmdArgs: []string{"terminal"}},
+		{User: "root", DeviceGroup: "core", Service: "shell", Cmd: "reload"},
+		{User: "dave", DeviceGroup: "core", Service: "shell", Cmd: "show"},
+		{User: "bob", Groups: []string{"nope"}, DeviceGroup: "core", Service: "shell", Cmd: "show"},
+	}
+	report := ComparePolicies(NewPolicyEvaluator(NewDefaultLogger(), old), NewPolicyEvaluator(NewDefaultLogger(), updated), inputs)
+
+	assert.Equal(t, 8, report.Total)
+	// alice show, bob show, and an unknown group both fail alike
+	assert.Equal(t, 3, report.Same)
+	assert.Equal(t, map[string]int{DiffAuthentication: 2, DiffDecision: 2, DiffRule: 3, DiffArgs: 1}, report.Fields)
+	fields := map[int][]string{}
+	for _, d := range report.Diffs {
+		fields[d.Index] = d.Fields
+	}
+	assert.Equal(t, map[int][]string{
+		1: {DiffRule},
+		2: {DiffArgs},
+		4: {DiffDecision, DiffRule},
+		5: {DiffAuthentication},
+		6: {DiffAuthentication, DiffDecision, DiffRule},
+	}, fields)
+
+	carol := report.Diffs[2]
+	assert.Equal(t, "command configure match ^terminal", carol.A.Authorization.Rule)
+	assert.True(t, carol.A.Authorization.Permit())
+	assert.Equal(t, "command configure", carol.B.Authorization.Rule)
+	assert.False(t, carol.B.Authorization.Permit())
+	assert.Equal(t, config.BCRYPT, report.Diffs[3].B.Authenticator)
+
+	s := report.String()
+	assert.Contains(t, s, "8 inputs, 3 same, 5 different (args 1, authentication 2, decision 2, rule 3)\n")
+	assert.Contains(t, s, "DIFF 2 user [bob] device group [core] service [shell] cmd []: args\n")
+	assert.Contains(t, s, `    b: known user, AuthorStatusPassAdd by rule [service shell] args ["priv-lvl=5"]`)
+	assert.Contains(t, s, "    a: unknown user, AuthorStatusFail by rule [unknown user] args []")
+}
+
+// errEvaluator fails every input
+type errEvaluator struct{}
+
+func (errEvaluator) Evaluate(in PolicyInput) (Evaluation, error) {
+	return Evaluation{}, errors.New("evaluator unavailable")
+}
+
+func TestComparePoliciesErrors(t *testing.T) {
+	old, _ := divergentPolicies(t)
+	report := ComparePolicies(NewPolicyEvaluator(NewDefaultLogger(), old), errEvaluator{}, []PolicyInput{
+		{User: "alice", DeviceGroup: "core", Service: "shell", Cmd: "show"},
+	})
+	require.Len(t, report.Diffs, 1)
+	assert.Equal(t, []string{DiffError}, report.Diffs[0].Fields)
+	assert.Contains(t, report.String(), "    b: error evaluator unavailable")
+}
+
+func TestPolicyEvaluatorMatchesPolicyTests(t *testing.T) {
+	// the evaluator decides as the policy test runner does, so the same policy never differs
+	policy, err := LoadPolicy("testdata/policy/policy.yaml")
+	require.NoError(t, err)
+	var inputs []PolicyInput
+	for _, file := range []string{"commands.yaml", "sessions.json"} {
+		cases, err := LoadPolicyCases("testdata/policy/" + file)
+		require.NoError(t, err)
+		report := RunPolicyTests(NewDefaultLogger(), policy, cases)
+		evaluator := NewPolicyEvaluator(NewDefaultLogger(), policy)
+		for i, c := range cases {
+			inputs = append(inputs, c.Input)
+			e, err := evaluator.Evaluate(c.Input)
+			require.NoError(t, err)
+			assert.Equal(t, report.Results[i].Decision, e.Authorization, c.Name)
+		}
+	}
+	report := ComparePolicies(NewPolicyEvaluator(NewDefaultLogger(), policy), NewPolicyEvaluator(NewDefaultLogger(), policy), inputs)
+	assert.Equal(t, report.Total, report.Same)
+	assert.Empty(t, report.Diffs)
+}
+
+// BenchmarkComparePolicies compares the divergent policies over 10000 inputs of recorded traffic,
+// where users and device groups repeat
+func BenchmarkComparePolicies(b *testing.B) {
+	old, updated := divergentPolicies(b)
+	users := []string{"alice", "bob", "carol", "root", "dave"}
+	groups := []string{"core", "edge"}
+	cmds := [][]string{{"show", "version"}, {"configure", "terminal"}, {"reload"}, {"ping", "10.0.0.1"}}
+	inputs := make([]PolicyInput, 10000)
+	for i := range inputs {
+		cmd := cmds[i%len(cmds)]
+		inputs[i] = PolicyInput{User: users[i%len(users)], DeviceGroup: groups[i%len(groups)], Service: "shell", Cmd: cmd[0], CmdArgs: cmd[1:]}
+	}
+	a, c := NewPolicyEvaluator(NewDefaultLogger(), old), NewPolicyEvaluator(NewDefaultLogger(), updated)
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		report := ComparePolicies(a, c, inputs)
+		if report.Total != len(inputs) {
+			b.Fatalf("compared %v of %v inputs", report.Total, len(inputs))
+		}
+	}
+	b.ReportMetric(float64(b.N*len(inputs))/time.Since(start).Seconds(), "inputs/s")
+}
@@ -0,0 +1,65 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package stringy
+
+import (
+	"context"
+	"strings"
+
+	tq "github.com/facebookincubator/tacquito"
+)
+
+// DefaultDenyRule is reported when no command or service matched a request
+const DefaultDenyRule = "default deny"
+
+// UnknownUserRule is reported by the policy test runner when the user is not in the device group
+const UnknownUserRule = "unknown user"
+
+// Decision is the dry-run result of an authorization request
+type Decision struct {
+	Status tq.AuthorStatus
+	// Rule names the command or services that produced the decision
+	Rule string
+	// Args are the args that would be returned to the client
+	Args []string
+	// Trace holds the value of every part of the `when` expressions evaluated, in the order
+	// evaluated, each prefixed with its rule, eg `command configure: in_group("tier3") = true`
+	Trace []string `json:",omitempty" yaml:",omitempty"`
+}
+
+// Permit returns true if the decision would authorize the request
+func (d Decision) Permit() bool {
+	return d.Status == tq.AuthorStatusPassAdd || d.Status == tq.AuthorStatusPassRepl
+}
+
+// Explain evaluates body the same way Handle does, without replying to a client.  It must be
+// called on an authorizer returned from New, which has been scoped to a user.
+func (a Authorizer) Explain(ctx context.Context, body tq.AuthorRequest) Decision {
+	if a.user.Name != string(body.User) {
+		return Decision{Status: tq.AuthorStatusFail, Rule: "user mismatch"}
+	}
+	if authorizer := NewCommandBasedAuthorizer(ctx, a.loggerProvider, body, a.user); authorizer != nil {
+		authorizer.regexes = a.regexes
+		authorizer.conditions = a.conditions
+		permit, rule, trace := authorizer.explain()
+		if rule == "" {
+			rule = DefaultDenyRule
+		}
+		if permit {
+			return Decision{Status: tq.AuthorStatusPassAdd, Rule: rule, Trace: trace}
+		}
+		return Decision{Status: tq.AuthorStatusFail, Rule: rule, Trace: trace}
+	}
+	authorizer := NewSessionBasedAuthorizer(ctx, a.loggerProvider, body, a.user)
+	authorizer.conditions = a.conditions
+	args, status, rules, trace := authorizer.explain()
+	if len(args) == 0 {
+		return Decision{Status: tq.AuthorStatusFail, Rule: DefaultDenyRule, Trace: trace}
+	}
+	return Decision{Status: status, Rule: strings.Join(rules, ", "), Args: args, Trace: trace}
+}
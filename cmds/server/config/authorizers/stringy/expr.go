@@ -0,0 +1,758 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package stringy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	tq "github.com/facebookincubator/tacquito"
+	"github.com/facebookincubator/tacquito/cmds/server/config"
+)
+
+// DefaultExpressionCostLimit is the cost an expression may spend on a request unless
+// SetExpressionCostLimit sets another, see SetExpressionCostLimit
+const DefaultExpressionCostLimit = 4096
+
+// ErrExpressionCost is returned for an expression that exceeded its cost limit on a request.  The
+// rule of the expression then denies the request.
+var ErrExpressionCost = errors.New("expression exceeded its cost limit")
+
+// SetExpressionCostLimit sets the cost each evaluation of a `when` expression may spend.  Every
+// operator, identifier and function call costs 1, and every byte a string comparison, contains,
+// has_prefix or regex match reads costs 1 more.  Expressions whose operators alone cost more are
+// rejected when the config is built; an evaluation that exceeds the limit fails with
+// ErrExpressionCost, which denies the request.
+func SetExpressionCostLimit(limit int) Option {
+	return func(a *Authorizer) {
+		a.exprCostLimit = limit
+	}
+}
+
+// ExpressionError is an expression that does not compile, with the position in Expr it fails at
+type ExpressionError struct {
+	Expr   string
+	Pos    int
+	Reason string
+}
+
+// Error implements error
+func (e *ExpressionError) Error() string {
+	return fmt.Sprintf("expression [%v] at %v: %v", e.Expr, e.Pos, e.Reason)
+}
+
+// exprType is the type of an expression value
+type exprType int
+
+const (
+	exprBool exprType = iota
+	exprInt
+	exprString
+)
+
+func (t exprType) String() string {
+	switch t {
+	case exprBool:
+		return "bool"
+	case exprInt:
+		return "int"
+	}
+	return "string"
+}
+
+// exprValue is the value of an expression, of the type of the node that produced it
+type exprValue struct {
+	t exprType
+	b bool
+	i int
+	s string
+}
+
+func (v exprValue) String() string {
+	switch v.t {
+	case exprBool:
+		return strconv.FormatBool(v.b)
+	case exprInt:
+		return strconv.Itoa(v.i)
+	}
+	return strconv.Quote(v.s)
+}
+
+// exprEnv is the request an expression is evaluated against, and what the evaluation spent
+type exprEnv struct {
+	body        tq.AuthorRequest
+	user        config.User
+	deviceGroup string
+	now         time.Time
+	cost, limit int
+	// trace holds the value of every node evaluated, in the order evaluated
+	trace []string
+}
+
+// newExprEnv returns the environment of body, sent by the device of ctx for user
+func newExprEnv(ctx context.Context, body tq.AuthorRequest, user config.User, limit int) *exprEnv {
+	group, _ := ctx.Value(tq.ContextDeviceGroup).(string)
+	return &exprEnv{body: body, user: user, deviceGroup: group, now: requestTime(tq.Request{Context: ctx}), limit: limit}
+}
+
+// spend adds n to the cost of the evaluation
+func (e *exprEnv) spend(n int) error {
+	e.cost += n
+	if e.cost > e.limit {
+		return ErrExpressionCost
+	}
+	return nil
+}
+
+// exprIdentifiers are the request fields expressions may name
+var exprIdentifiers = map[string]struct {
+	t   exprType
+	get func(e *exprEnv) exprValue
+}{
+	"user":         {exprString, func(e *exprEnv) exprValue { return exprValue{t: exprString, s: string(e.body.User)} }},
+	"service":      {exprString, func(e *exprEnv) exprValue { return exprValue{t: exprString, s: e.body.Args.Service()} }},
+	"cmd":          {exprString, func(e *exprEnv) exprValue { return exprValue{t: exprString, s: e.body.Args.Command()} }},
+	"args":         {exprString, func(e *exprEnv) exprValue { return exprValue{t: exprString, s: e.body.Args.CommandArgs()} }},
+	"port":         {exprString, func(e *exprEnv) exprValue { return exprValue{t: exprString, s: string(e.body.Port)} }},
+	"rem_addr":     {exprString, func(e *exprEnv) exprValue { return exprValue{t: exprString, s: string(e.body.RemAddr)} }},
+	"device_group": {exprString, func(e *exprEnv) exprValue { return exprValue{t: exprString, s: e.deviceGroup} }},
+	"priv_lvl":     {exprInt, func(e *exprEnv) exprValue { return exprValue{t: exprInt, i: int(e.body.PrivLvl)} }},
+	"hour":         {exprInt, func(e *exprEnv) exprValue { return exprValue{t: exprInt, i: e.now.Hour()} }},
+}
+
+// exprFunction is a function expressions may call
+type exprFunction struct {
+	args []exprType
+	t    exprType
+	// check, if set, validates the literal args of a call when it is compiled, nil for the others
+	check func(args []*exprValue) error
+	call  func(e *exprEnv, args []exprValue) (exprValue, error)
+}
+
+// exprFunctions are the functions expressions may call
+var exprFunctions = map[string]exprFunction{
+	// in_group reports if the user is a member of the named group
+	"in_group": {
+		args: []exprType{exprString},
+		t:    exprBool,
+		call: func(e *exprEnv, args []exprValue) (exprValue, error) {
+			return exprValue{t: exprBool, b: memberOf(e.user, args[0].s)}, nil
+		},
+	},
+	// within_window reports if the request was received within the hours from and to, in the
+	// time zone of the server, as a TimeoutRule does
+	"within_window": {
+		args:  []exprType{exprInt, exprInt},
+		t:     exprBool,
+		check: checkHours,
+		call: func(e *exprEnv, args []exprValue) (exprValue, error) {
+			if err := checkHours([]*exprValue{&args[0], &args[1]}); err != nil {
+				return exprValue{}, err
+			}
+			r := TimeoutRule{FromHour: args[0].i, ToHour: args[1].i}
+			return exprValue{t: exprBool, b: r.applies(e.user, e.now)}, nil
+		},
+	},
+	// contains reports if the first string holds the second
+	"contains": {
+		args: []exprType{exprString, exprString},
+		t:    exprBool,
+		call: func(e *exprEnv, args []exprValue) (exprValue, error) {
+			if err := e.spend(len(args[0].s)); err != nil {
+				return exprValue{}, err
+			}
+			return exprValue{t: exprBool, b: strings.Contains(args[0].s, args[1].s)}, nil
+		},
+	},
+	// has_prefix reports if the first string starts with the second
+	"has_prefix": {
+		args: []exprType{exprString, exprString},
+		t:    exprBool,
+		call: func(e *exprEnv, args []exprValue) (exprValue, error) {
+			if err := e.spend(len(args[1].s)); err != nil {
+				return exprValue{}, err
+			}
+			return exprValue{t: exprBool, b: strings.HasPrefix(args[0].s, args[1].s)}, nil
+		},
+	},
+}
+
+// checkHours returns an error for hours, any of which may be unknown until evaluated, outside of a
+// day
+func checkHours(hours []*exprValue) error {
+	for _, h := range hours {
+		if h != nil && (h.i < 0 || h.i > 23) {
+			return fmt.Errorf("hour %v must be within 0 and 23", h.i)
+		}
+	}
+	return nil
+}
+
+// expression is a compiled `when` condition of a rule
+type expression struct {
+	src  string
+	root exprNode
+	// nodes is the number of nodes, the least an evaluation costs
+	nodes int
+}
+
+// compileExpression parses and type checks src, which must be a bool expression, eg
+// `in_group("tier3") && within_window(22, 6)`
+func compileExpression(src string) (*expression, error) {
+	p := &exprParser{src: src}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	root, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf(p.tok.pos, "unexpected %q", p.tok.text)
+	}
+	if root.typ() != exprBool {
+		return nil, p.errorf(0, "the expression is a %v, it must be a bool", root.typ())
+	}
+	return &expression{src: src, root: root, nodes: p.nodes}, nil
+}
+
+// eval evaluates x against e, recording the value of every node in the trace of e
+func (x *expression) eval(e *exprEnv) (bool, error) {
+	v, err := x.root.eval(e)
+	return v.b, err
+}
+
+// exprNode is a node of a compiled expression
+type exprNode interface {
+	typ() exprType
+	eval(e *exprEnv) (exprValue, error)
+}
+
+// traced records the value of the node of source src, if it was evaluated without error
+func traced(e *exprEnv, src string, v exprValue, err error) (exprValue, error) {
+	if err == nil {
+		e.trace = append(e.trace, fmt.Sprintf("%v = %v", src, v))
+	}
+	return v, err
+}
+
+// literalNode is a constant, which is not traced
+type literalNode struct {
+	v exprValue
+}
+
+func (n *literalNode) typ() exprType { return n.v.t }
+
+func (n *literalNode) eval(e *exprEnv) (exprValue, error) {
+	return n.v, e.spend(1)
+}
+
+// identNode is a request field
+type identNode struct {
+	name string
+	t    exprType
+	get  func(e *exprEnv) exprValue
+}
+
+func (n *identNode) typ() exprType { return n.t }
+
+func (n *identNode) eval(e *exprEnv) (exprValue, error) {
+	if err := e.spend(1); err != nil {
+		return exprValue{}, err
+	}
+	return traced(e, n.name, n.get(e), nil)
+}
+
+// callNode is a function call
+type callNode struct {
+	src  string
+	fn   exprFunction
+	args []exprNode
+}
+
+func (n *callNode) typ() exprType { return n.fn.t }
+
+func (n *callNode) eval(e *exprEnv) (exprValue, error) {
+	if err := e.spend(1); err != nil {
+		return exprValue{}, err
+	}
+	args := make([]exprValue, len(n.args))
+	for i, arg := range n.args {
+		v, err := arg.eval(e)
+		if err != nil {
+			return exprValue{}, err
+		}
+		args[i] = v
+	}
+	v, err := n.fn.call(e, args)
+	return traced(e, n.src, v, err)
+}
+
+// unaryNode is a negation
+type unaryNode struct {
+	src string
+	x   exprNode
+}
+
+func (n *unaryNode) typ() exprType { return exprBool }
+
+func (n *unaryNode) eval(e *exprEnv) (exprValue, error) {
+	if err := e.spend(1); err != nil {
+		return exprValue{}, err
+	}
+	v, err := n.x.eval(e)
+	if err != nil {
+		return exprValue{}, err
+	}
+	return traced(e, n.src, exprValue{t: exprBool, b: !v.b}, nil)
+}
+
+// binaryNode is a logical operator or a comparison
+type binaryNode struct {
+	src  string
+	op   string
+	l, r exprNode
+}
+
+func (n *binaryNode) typ() exprType { return exprBool }
+
+func (n *binaryNode) eval(e *exprEnv) (exprValue, error) {
+	if err := e.spend(1); err != nil {
+		return exprValue{}, err
+	}
+	l, err := n.l.eval(e)
+	if err != nil {
+		return exprValue{}, err
+	}
+	// the right side of a logical operator is only evaluated, and traced, if it decides the result
+	switch {
+	case n.op == "&&" && !l.b, n.op == "||" && l.b:
+		return traced(e, n.src, l, nil)
+	}
+	r, err := n.r.eval(e)
+	if err != nil {
+		return exprValue{}, err
+	}
+	if l.t == exprString {
+		if err := e.spend(len(l.s) + len(r.s)); err != nil {
+			return exprValue{}, err
+		}
+	}
+	var b bool
+	switch n.op {
+	case "&&", "||":
+		b = r.b
+	case "==":
+		b = l == r
+	case "!=":
+		b = l != r
+	case "<":
+		b = l.i < r.i
+	case "<=":
+		b = l.i <= r.i
+	case ">":
+		b = l.i > r.i
+	case ">=":
+		b = l.i >= r.i
+	}
+	return traced(e, n.src, exprValue{t: exprBool, b: b}, nil)
+}
+
+// matchNode is a regex match, whose pattern is compiled with the expression
+type matchNode struct {
+	src    string
+	negate bool
+	l      exprNode
+	re     *regexp.Regexp
+}
+
+func (n *matchNode) typ() exprType { return exprBool }
+
+func (n *matchNode) eval(e *exprEnv) (exprValue, error) {
+	if err := e.spend(1); err != nil {
+		return exprValue{}, err
+	}
+	l, err := n.l.eval(e)
+	if err != nil {
+		return exprValue{}, err
+	}
+	if err := e.spend(len(l.s)); err != nil {
+		return exprValue{}, err
+	}
+	return traced(e, n.src, exprValue{t: exprBool, b: n.re.MatchString(l.s) != n.negate}, nil)
+}
+
+// token kinds of the expression lexer
+const (
+	tokEOF = iota
+	tokIdent
+	tokInt
+	tokString
+	tokOp
+)
+
+type exprToken struct {
+	kind int
+	text string
+	pos  int
+}
+
+// exprOps are the operators and punctuation of the language, longest first
+var exprOps = []string{"||", "&&", "==", "!=", "<=", ">=", "=~", "!~", "!", "<", ">", "(", ")", ","}
+
+// exprParser is a recursive descent parser of expressions.  From the loosest binding:
+//
+//	or      = and { "||" and }
+//	and     = unary { "&&" unary }
+//	unary   = "!" unary | compare
+//	compare = primary [ ( "==" | "!=" | "<" | "<=" | ">" | ">=" | "=~" | "!~" ) primary ]
+//	primary = int | string | "true" | "false" | ident | ident "(" [ or { "," or } ] ")" | "(" or ")"
+type exprParser struct {
+	src string
+	off int
+	tok exprToken
+	// nodes counts the nodes built
+	nodes int
+}
+
+func (p *exprParser) errorf(pos int, format string, args ...interface{}) error {
+	return &ExpressionError{Expr: p.src, Pos: pos, Reason: fmt.Sprintf(format, args...)}
+}
+
+// next reads the next token into p.tok
+func (p *exprParser) next() error {
+	for p.off < len(p.src) && (p.src[p.off] == ' ' || p.src[p.off] == '\t' || p.src[p.off] == '\n') {
+		p.off++
+	}
+	start := p.off
+	if p.off == len(p.src) {
+		p.tok = exprToken{kind: tokEOF, pos: start}
+		return nil
+	}
+	c := p.src[p.off]
+	switch {
+	case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		for p.off < len(p.src) && (p.src[p.off] == '_' || p.src[p.off] >= 'a' && p.src[p.off] <= 'z' || p.src[p.off] >= 'A' && p.src[p.off] <= 'Z' || p.src[p.off] >= '0' && p.src[p.off] <= '9') {
+			p.off++
+		}
+		p.tok = exprToken{kind: tokIdent, text: p.src[start:p.off], pos: start}
+		return nil
+	case c >= '0' && c <= '9':
+		for p.off < len(p.src) && p.src[p.off] >= '0' && p.src[p.off] <= '9' {
+			p.off++
+		}
+		p.tok = exprToken{kind: tokInt, text: p.src[start:p.off], pos: start}
+		return nil
+	case c == '"':
+		for p.off++; p.off < len(p.src) && p.src[p.off] != '"'; p.off++ {
+			if p.src[p.off] == '\\' {
+				p.off++
+			}
+		}
+		if p.off >= len(p.src) {
+			return p.errorf(start, "unterminated string")
+		}
+		p.off++
+		p.tok = exprToken{kind: tokString, text: p.src[start:p.off], pos: start}
+		return nil
+	}
+	for _, op := range exprOps {
+		if strings.HasPrefix(p.src[p.off:], op) {
+			p.off += len(op)
+			p.tok = exprToken{kind: tokOp, text: op, pos: start}
+			return nil
+		}
+	}
+	return p.errorf(start, "unexpected character %q", c)
+}
+
+// expect consumes the operator op
+func (p *exprParser) expect(op string) error {
+	if p.tok.kind != tokOp || p.tok.text != op {
+		return p.errorf(p.tok.pos, "expected %q", op)
+	}
+	return p.next()
+}
+
+// source returns the source of the node that starts at start and ends before the current token
+func (p *exprParser) source(start int) string {
+	end := p.tok.pos
+	if p.tok.kind == tokEOF {
+		end = len(p.src)
+	}
+	return strings.TrimSpace(p.src[start:end])
+}
+
+// logical parses the operands of the logical operator op, each with operand
+func (p *exprParser) logical(op string, operand func() (exprNode, error)) (exprNode, error) {
+	start := p.tok.pos
+	l, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for p.tok.kind == tokOp && p.tok.text == op {
+		pos := p.tok.pos
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		r, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		if l.typ() != exprBool || r.typ() != exprBool {
+			return nil, p.errorf(pos, "%v needs bool operands, not %v and %v", op, l.typ(), r.typ())
+		}
+		p.nodes++
+		l = &binaryNode{src: p.source(start), op: op, l: l, r: r}
+	}
+	return l, nil
+}
+
+func (p *exprParser) or() (exprNode, error) {
+	return p.logical("||", p.and)
+}
+
+func (p *exprParser) and() (exprNode, error) {
+	return p.logical("&&", p.unary)
+}
+
+func (p *exprParser) unary() (exprNode, error) {
+	if p.tok.kind != tokOp || p.tok.text != "!" {
+		return p.compare()
+	}
+	start := p.tok.pos
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	x, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	if x.typ() != exprBool {
+		return nil, p.errorf(start, "! needs a bool operand, not %v", x.typ())
+	}
+	p.nodes++
+	return &unaryNode{src: p.source(start), x: x}, nil
+}
+
+func (p *exprParser) compare() (exprNode, error) {
+	start := p.tok.pos
+	l, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokOp {
+		return l, nil
+	}
+	op, pos := p.tok.text, p.tok.pos
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=", "=~", "!~":
+	default:
+		return l, nil
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	rstart := p.tok
+	r, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	p.nodes++
+	switch op {
+	case "=~", "!~":
+		lit, ok := r.(*literalNode)
+		if l.typ() != exprString || !ok || lit.v.t != exprString {
+			return nil, p.errorf(pos, "%v needs a string and a string literal pattern", op)
+		}
+		re, err := regexp.Compile(lit.v.s)
+		if err != nil {
+			return nil, p.errorf(rstart.pos, "bad pattern; %v", err)
+		}
+		return &matchNode{src: p.source(start), negate: op == "!~", l: l, re: re}, nil
+	case "<", "<=", ">", ">=":
+		if l.typ() != exprInt || r.typ() != exprInt {
+			return nil, p.errorf(pos, "%v needs int operands, not %v and %v", op, l.typ(), r.typ())
+		}
+	default:
+		if l.typ() != r.typ() {
+			return nil, p.errorf(pos, "%v needs operands of one type, not %v and %v", op, l.typ(), r.typ())
+		}
+	}
+	return &binaryNode{src: p.source(start), op: op, l: l, r: r}, nil
+}
+
+func (p *exprParser) primary() (exprNode, error) {
+	tok := p.tok
+	switch tok.kind {
+	case tokInt:
+		i, err := strconv.Atoi(tok.text)
+		if err != nil {
+			return nil, p.errorf(tok.pos, "bad int %v", tok.text)
+		}
+		p.nodes++
+		return &literalNode{v: exprValue{t: exprInt, i: i}}, p.next()
+	case tokString:
+		s, err := strconv.Unquote(tok.text)
+		if err != nil {
+			return nil, p.errorf(tok.pos, "bad string %v", tok.text)
+		}
+		p.nodes++
+		return &literalNode{v: exprValue{t: exprString, s: s}}, p.next()
+	case tokIdent:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if tok.text == "true" || tok.text == "false" {
+			p.nodes++
+			return &literalNode{v: exprValue{t: exprBool, b: tok.text == "true"}}, nil
+		}
+		if p.tok.kind == tokOp && p.tok.text == "(" {
+			return p.call(tok)
+		}
+		ident, ok := exprIdentifiers[tok.text]
+		if !ok {
+			return nil, p.errorf(tok.pos, "unknown identifier %v", tok.text)
+		}
+		p.nodes++
+		return &identNode{name: tok.text, t: ident.t, get: ident.get}, nil
+	case tokOp:
+		if tok.text == "(" {
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			x, err := p.or()
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expect(")")
+		}
+	case tokEOF:
+		return nil, p.errorf(tok.pos, "unexpected end of expression")
+	}
+	return nil, p.errorf(tok.pos, "unexpected %q", tok.text)
+}
+
+// call parses the args of a call to the function name, whose "(" is the current token
+func (p *exprParser) call(name exprToken) (exprNode, error) {
+	fn, ok := exprFunctions[name.text]
+	if !ok {
+		return nil, p.errorf(name.pos, "unknown function %v", name.text)
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	var args []exprNode
+	for !(p.tok.kind == tokOp && p.tok.text == ")") {
+		if len(args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	if len(args) != len(fn.args) {
+		return nil, p.errorf(name.pos, "%v takes %v args, not %v", name.text, len(fn.args), len(args))
+	}
+	literals := make([]*exprValue, len(args))
+	for i, arg := range args {
+		if arg.typ() != fn.args[i] {
+			return nil, p.errorf(name.pos, "arg %v of %v must be a %v, not %v", i+1, name.text, fn.args[i], arg.typ())
+		}
+		if lit, ok := arg.(*literalNode); ok {
+			literals[i] = &lit.v
+		}
+	}
+	if fn.check != nil {
+		if err := fn.check(literals); err != nil {
+			return nil, p.errorf(name.pos, "%v; %v", name.text, err)
+		}
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	p.nodes++
+	return &callNode{src: p.source(name.pos), fn: fn, args: args}, nil
+}
+
+// conditions are the compiled `when` expressions of the commands and services of a user
+type conditions struct {
+	exprs map[string]*expression
+	limit int
+}
+
+// compileConditions compiles the `when` expressions of user, rejecting those that do not compile
+// or whose operators alone cost more than limit
+func compileConditions(user config.User, limit int) (*conditions, error) {
+	c := &conditions{exprs: make(map[string]*expression), limit: limit}
+	var whens []string
+	for _, cmd := range user.Commands {
+		whens = append(whens, cmd.When)
+	}
+	for _, s := range user.Services {
+		whens = append(whens, s.When)
+	}
+	for _, when := range whens {
+		when = strings.TrimSpace(when)
+		if _, ok := c.exprs[when]; ok || when == "" {
+			continue
+		}
+		x, err := compileExpression(when)
+		if err != nil {
+			return nil, fmt.Errorf("user [%v]: %w", user.Name, err)
+		}
+		if x.nodes > limit {
+			return nil, fmt.Errorf("user [%v]: expression [%v] costs at least %v, over the limit of %v", user.Name, when, x.nodes, limit)
+		}
+		c.exprs[when] = x
+	}
+	return c, nil
+}
+
+// eval reports if the request body of user, from the device of ctx, satisfies the `when`
+// expression src of rule, which an empty src always does.  The trace holds the value of every
+// part of the expression evaluated, prefixed with rule.  Expressions that were not compiled with
+// the config, eg those of an authorizer that was not built with New, are compiled here.
+func (c *conditions) eval(ctx context.Context, body tq.AuthorRequest, user config.User, rule, src string) (bool, []string, error) {
+	src = strings.TrimSpace(src)
+	if src == "" {
+		return true, nil, nil
+	}
+	limit := DefaultExpressionCostLimit
+	var x *expression
+	if c != nil {
+		limit, x = c.limit, c.exprs[src]
+	}
+	if x == nil {
+		var err error
+		if x, err = compileExpression(src); err != nil {
+			return false, nil, err
+		}
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	e := newExprEnv(ctx, body, user, limit)
+	ok, err := x.eval(e)
+	for i, t := range e.trace {
+		e.trace[i] = rule + ": " + t
+	}
+	if err != nil {
+		stringyExpressionError.Inc()
+	}
+	return ok && err == nil, e.trace, err
+}
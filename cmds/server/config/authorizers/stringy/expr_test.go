@@ -0,0 +1,167 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package stringy
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	tq "github.com/facebookincubator/tacquito"
+	"github.com/facebookincubator/tacquito/cmds/server/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// exprContext returns the context of a request from a device of group, received at hour
+func exprContext(group string, hour int) context.Context {
+	at := time.Date(2021, 6, 1, hour, 30, 0, 0, time.Local)
+	ctx := context.WithValue(context.Background(), tq.ContextEventTime, at.UTC().Format(time.RFC3339Nano))
+	return context.WithValue(ctx, tq.ContextDeviceGroup, group)
+}
+
+// exprCommand returns a request of user to run cmd with args
+func exprCommand(user, cmd, args string) tq.AuthorRequest {
+	return tq.AuthorRequest{User: tq.AuthenUser(user), PrivLvl: tq.PrivLvlRoot, Args: tq.Args{"service=shell", tq.Arg("cmd=" + cmd), tq.Arg("cmd-arg=" + args)}}
+}
+
+func TestExpressionCompileErrors(t *testing.T) {
+	for src, reason := range map[string]string{
+		`user == 3`:                   "needs operands of one type, not string and int",
+		`hostname == "r1"`:            "unknown identifier",
+		`args =~ "eth(0"`:             "error parsing regexp",
+		`args =~ cmd`:                 "string literal",
+		`within_window(22, 24)`:       "hour 24 must be within 0 and 23",
+		`in_group(3)`:                 "arg 1 of in_group must be a string",
+		`lookup("x")`:                 "unknown function",
+		`priv_lvl`:                    "it must be a bool",
+		`user == "alice" &&`:          "unexpected end",
+		`(user == "alice"`:            `expected ")"`,
+		`user == "alice" user`:        "unexpected",
+		`contains(args, "eth", "x")`:  "takes 2 args, not 3",
+		`!priv_lvl`:                   "needs a bool operand",
+		`has_prefix(args) || true`:    "takes 2 args, not 1",
+		`"unterminated == user`:       "unterminated string",
+		`priv_lvl > 15 && hour < "3"`: "needs int operands, not int and string",
+	} {
+		_, err := compileExpression(src)
+		var exprErr *ExpressionError
+		if assert.True(t, errors.As(err, &exprErr), src) {
+			assert.Equal(t, src, exprErr.Expr)
+			assert.Contains(t, exprErr.Reason, reason, src)
+		}
+	}
+}
+
+func TestExpressionRejectedAtBuild(t *testing.T) {
+	user := config.User{Name: "alice", Commands: []config.Command{{Name: "show", Action: config.PERMIT, When: `priv_lvl >= "15"`}}}
+	_, err := New(NewDefaultLogger()).New(user)
+	assert.Error(t, err)
+
+	// an expression whose operators alone cost more than the limit is rejected too
+	user.Commands[0].When = `user == "a" || user == "b" || user == "c"`
+	_, err = New(NewDefaultLogger(), SetExpressionCostLimit(5)).New(user)
+	assert.ErrorContains(t, err, "over the limit of 5")
+	_, err = New(NewDefaultLogger()).New(user)
+	assert.NoError(t, err)
+}
+
+func TestExpressionCostLimit(t *testing.T) {
+	user := config.User{Name: "alice", Commands: []config.Command{{Name: "configure", Action: config.PERMIT, When: `contains(args, "vlan")`}}}
+	h, err := New(NewDefaultLogger(), SetExpressionCostLimit(64)).New(user)
+	require.NoError(t, err)
+	a := h.(*Authorizer)
+
+	assert.True(t, a.Explain(context.Background(), exprCommand("alice", "configure", "vlan 10")).Permit())
+	// a long command costs a byte a read, and denies once it exceeds the limit
+	long := exprCommand("alice", "configure", strings.Repeat("x", 100)+" vlan 10")
+	d := a.Explain(context.Background(), long)
+	assert.False(t, d.Permit())
+	assert.Equal(t, `command configure when contains(args, "vlan")`, d.Rule)
+
+	_, _, err = a.conditions.eval(context.Background(), long, user, "command configure", user.Commands[0].When)
+	assert.ErrorIs(t, err, ErrExpressionCost)
+}
+
+func TestExpressionCompositePolicy(t *testing.T) {
+	// tier3 may change the uplinks, Ethernet1/48 to 52, of production devices except during the
+	// night, while anyone may change them in the lab
+	user := config.User{
+		Name:   "alice",
+		Groups: []config.Group{{Name: "tier3"}},
+		Commands: []config.Command{
+			{
+				Name:   "interface",
+				Match:  []string{`Ethernet1/(4[89]|5[0-2])`},
+				Action: config.PERMIT,
+				When:   `device_group == "lab" || (in_group("tier3") && !within_window(22, 6))`,
+			},
+			{Name: "interface", Match: []string{`Ethernet1/(4[89]|5[0-2])`}, Action: config.DENY},
+			{Name: "interface", Action: config.PERMIT, When: `priv_lvl >= 15 && args !~ "^Ethernet1/"`},
+		},
+	}
+	h, err := New(NewDefaultLogger()).New(user)
+	require.NoError(t, err)
+	a := h.(*Authorizer)
+
+	for _, tc := range []struct {
+		group string
+		hour  int
+		args  string
+		want  bool
+		rule  string
+	}{
+		{"prod", 14, "Ethernet1/50", true, `command interface match Ethernet1/(4[89]|5[0-2]) when device_group == "lab" || (in_group("tier3") && !within_window(22, 6))`},
+		{"prod", 23, "Ethernet1/50", false, "command interface match Ethernet1/(4[89]|5[0-2])"},
+		{"lab", 23, "Ethernet1/50", true, `command interface match Ethernet1/(4[89]|5[0-2]) when device_group == "lab" || (in_group("tier3") && !within_window(22, 6))`},
+		{"prod", 23, "Loopback0", true, `command interface when priv_lvl >= 15 && args !~ "^Ethernet1/"`},
+		{"prod", 23, "Ethernet1/1", false, DefaultDenyRule},
+	} {
+		d := a.Explain(exprContext(tc.group, tc.hour), exprCommand("alice", "interface", tc.args))
+		assert.Equal(t, tc.want, d.Permit(), "%v at %v: %v", tc.group, tc.hour, tc.args)
+		assert.Equal(t, tc.rule, d.Rule, "%v at %v: %v", tc.group, tc.hour, tc.args)
+	}
+
+	// the trace shows why the night denied, and that the lab check came first
+	d := a.Explain(exprContext("prod", 23), exprCommand("alice", "interface", "Ethernet1/50"))
+	rule := "command interface match Ethernet1/(4[89]|5[0-2])"
+	assert.Equal(t, []string{
+		rule + `: device_group = "prod"`,
+		rule + `: device_group == "lab" = false`,
+		rule + `: in_group("tier3") = true`,
+		rule + `: within_window(22, 6) = true`,
+		rule + `: !within_window(22, 6) = false`,
+		rule + `: in_group("tier3") && !within_window(22, 6) = false`,
+		rule + `: device_group == "lab" || (in_group("tier3") && !within_window(22, 6)) = false`,
+	}, d.Trace)
+}
+
+func TestExpressionService(t *testing.T) {
+	user := config.User{
+		Name: "alice",
+		Services: []config.Service{
+			{Name: "shell", SetValues: []config.Value{{Name: "priv-lvl", Values: []string{"15"}}}, When: `device_group == "lab"`},
+			{Name: "shell", SetValues: []config.Value{{Name: "priv-lvl", Values: []string{"1"}}}},
+		},
+	}
+	h, err := New(NewDefaultLogger()).New(user)
+	require.NoError(t, err)
+	a := h.(*Authorizer)
+	body := tq.AuthorRequest{User: "alice", Args: tq.Args{"service=shell", "cmd="}}
+
+	d := a.Explain(exprContext("lab", 12), body)
+	assert.Equal(t, []string{"priv-lvl=15", "priv-lvl=1"}, d.Args)
+	assert.Equal(t, `service shell when device_group == "lab", service shell`, d.Rule)
+	d = a.Explain(exprContext("prod", 12), body)
+	assert.Equal(t, []string{"priv-lvl=1"}, d.Args)
+	assert.Equal(t, "service shell", d.Rule)
+	assert.Equal(t, []string{`service shell: device_group = "prod"`, `service shell: device_group == "lab" = false`}, d.Trace)
+}
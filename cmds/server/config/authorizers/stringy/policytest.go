@@ -0,0 +1,294 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package stringy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	tq "github.com/facebookincubator/tacquito"
+	"github.com/facebookincubator/tacquito/cmds/server/config"
+
+	"gopkg.in/yaml.v3"
+)
+
+// PolicyFile is the name of the policy within a policy test directory.  Every other yaml or json
+// file in the directory is read as a list of PolicyCase.
+const PolicyFile = "policy.yaml"
+
+// PolicyCase is a single table driven authorization test, written as yaml or json
+type PolicyCase struct {
+	Name   string       `yaml:"name" json:"name"`
+	Input  PolicyInput  `yaml:"input" json:"input"`
+	Expect PolicyExpect `yaml:"expect" json:"expect"`
+}
+
+// PolicyInput describes the authorization request to evaluate.  DeviceGroup is the scope, eg the
+// SecretConfig name, the device is matched to.  Groups, if set, replaces the groups the user has in
+// the policy with the named groups, which allows asking "what if alice were in neteng".
+type PolicyInput struct {
+	User        string   `yaml:"user" json:"user"`
+	Groups      []string `yaml:"groups,omitempty" json:"groups,omitempty"`
+	DeviceGroup string   `yaml:"device_group" json:"device_group"`
+	Service     string   `yaml:"service" json:"service"`
+	Cmd         string   `yaml:"cmd,omitempty" json:"cmd,omitempty"`
+	CmdArgs     []string `yaml:"cmd_args,omitempty" json:"cmd_args,omitempty"`
+	// Args are additional avps sent by the client, eg "cmd=" or "shell:roles*" for session requests
+	Args    []string `yaml:"args,omitempty" json:"args,omitempty"`
+	PrivLvl int      `yaml:"priv_lvl,omitempty" json:"priv_lvl,omitempty"`
+}
+
+// PolicyExpect is the expected outcome of a PolicyCase.  Decision is permit or deny.  Rule and Args
+// are only compared when set.
+type PolicyExpect struct {
+	Decision string   `yaml:"decision" json:"decision"`
+	Rule     string   `yaml:"rule,omitempty" json:"rule,omitempty"`
+	Args     []string `yaml:"args,omitempty" json:"args,omitempty"`
+}
+
+// PolicyResult is the outcome of a single PolicyCase
+type PolicyResult struct {
+	Name     string
+	Decision Decision
+	// Diffs describe every expectation that was not met, empty if the case passed
+	Diffs []string
+}
+
+// Passed returns true if all expectations were met
+func (r PolicyResult) Passed() bool {
+	return len(r.Diffs) == 0
+}
+
+// PolicyReport holds the results of RunPolicyTests
+type PolicyReport struct {
+	Results []PolicyResult
+}
+
+// Failed returns the results that did not pass
+func (r PolicyReport) Failed() []PolicyResult {
+	var failed []PolicyResult
+	for _, result := range r.Results {
+		if !result.Passed() {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+// String renders a human readable report
+func (r PolicyReport) String() string {
+	var b strings.Builder
+	failed := r.Failed()
+	fmt.Fprintf(&b, "%v cases, %v passed, %v failed\n", len(r.Results), len(r.Results)-len(failed), len(failed))
+	for _, result := range failed {
+		fmt.Fprintf(&b, "FAIL %v\n", result.Name)
+		for _, d := range result.Diffs {
+			fmt.Fprintf(&b, "    %v\n", d)
+		}
+	}
+	return b.String()
+}
+
+// LoadPolicy reads a policy, which uses the same format as the server config
+func LoadPolicy(path string) (config.ServerConfig, error) {
+	var policy config.ServerConfig
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return policy, fmt.Errorf("unable to read policy; %w", err)
+	}
+	if err := yaml.Unmarshal(b, &policy); err != nil {
+		return policy, fmt.Errorf("unable to unmarshal policy [%v]; %w", path, err)
+	}
+	return policy, nil
+}
+
+// LoadPolicyCases reads a list of PolicyCase from a yaml or json file
+func LoadPolicyCases(path string) ([]PolicyCase, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read policy cases; %w", err)
+	}
+	var cases []PolicyCase
+	// json is a subset of yaml, so one decoder handles both
+	if err := yaml.Unmarshal(b, &cases); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal policy cases [%v]; %w", path, err)
+	}
+	return cases, nil
+}
+
+// RunPolicyTests evaluates every case against policy using the same rules as the authorizer
+func RunPolicyTests(l loggerProvider, policy config.ServerConfig, cases []PolicyCase) PolicyReport {
+	var report PolicyReport
+	for _, c := range cases {
+		report.Results = append(report.Results, runPolicyCase(l, policy, c))
+	}
+	return report
+}
+
+func runPolicyCase(l loggerProvider, policy config.ServerConfig, c PolicyCase) PolicyResult {
+	result := PolicyResult{Name: c.Name}
+	user, found, err := policyUser(policy, c.Input)
+	if err != nil {
+		result.Diffs = append(result.Diffs, err.Error())
+		return result
+	}
+	if found {
+		handler, err := New(l).New(user)
+		if err != nil {
+			result.Diffs = append(result.Diffs, err.Error())
+			return result
+		}
+		result.Decision = handler.(*Authorizer).Explain(policyContext(c.Input), policyRequest(c.Input))
+	} else {
+		// the server never reaches the authorizer for users that are not in the device group
+		result.Decision = Decision{Status: tq.AuthorStatusFail, Rule: UnknownUserRule}
+	}
+
+	decision := "deny"
+	if result.Decision.Permit() {
+		decision = "permit"
+	}
+	if c.Expect.Decision != decision {
+		result.Diffs = append(result.Diffs, fmt.Sprintf("decision: want %q, got %q (%v)", c.Expect.Decision, decision, result.Decision.Status))
+	}
+	if c.Expect.Rule != "" && c.Expect.Rule != result.Decision.Rule {
+		result.Diffs = append(result.Diffs, fmt.Sprintf("rule: want %q, got %q", c.Expect.Rule, result.Decision.Rule))
+	}
+	if c.Expect.Args != nil {
+		want, got := sortedCopy(c.Expect.Args), sortedCopy(result.Decision.Args)
+		if strings.Join(want, "\n") != strings.Join(got, "\n") {
+			result.Diffs = append(result.Diffs, fmt.Sprintf("args: want %q, got %q", want, got))
+		}
+	}
+	return result
+}
+
+// policyUser finds the user for the input in policy and scopes it to the device group
+func policyUser(policy config.ServerConfig, in PolicyInput) (config.User, bool, error) {
+	var user config.User
+	found := false
+	for _, u := range policy.Users {
+		if u.Name == in.User && (in.DeviceGroup == "" || u.HasScope(in.DeviceGroup)) {
+			user, found = u, true
+			break
+		}
+	}
+	if !found {
+		return user, false, nil
+	}
+	if in.DeviceGroup != "" {
+		user.LocalizeToScope(in.DeviceGroup)
+	}
+	// copy slices so reducing groups into the user does not modify the policy
+	user.Services = append([]config.Service(nil), user.Services...)
+	user.Commands = append([]config.Command(nil), user.Commands...)
+	if in.Groups == nil {
+		return user, true, nil
+	}
+	groups := map[string]config.Group{}
+	for _, u := range policy.Users {
+		for _, g := range u.Groups {
+			groups[g.Name] = g
+		}
+	}
+	user.Groups = nil
+	for _, name := range in.Groups {
+		g, ok := groups[name]
+		if !ok {
+			return user, false, fmt.Errorf("group [%v] is not in the policy", name)
+		}
+		user.Groups = append(user.Groups, g)
+	}
+	return user, true, nil
+}
+
+// policyRequest builds the AuthorRequest a client would send for the input
+// policyContext returns the context of in, which carries its device group for `when` expressions
+func policyContext(in PolicyInput) context.Context {
+	ctx := context.Background()
+	if in.DeviceGroup != "" {
+		ctx = context.WithValue(ctx, tq.ContextDeviceGroup, in.DeviceGroup)
+	}
+	return ctx
+}
+
+func policyRequest(in PolicyInput) tq.AuthorRequest {
+	args := tq.Args{}
+	if in.Service != "" {
+		args.Append("service=" + in.Service)
+	}
+	if in.Cmd != "" {
+		args.Append("cmd=" + in.Cmd)
+		for _, a := range in.CmdArgs {
+			args.Append("cmd-arg=" + a)
+		}
+	}
+	args.Append(in.Args...)
+	return *tq.NewAuthorRequest(
+		tq.SetAuthorRequestMethod(tq.AuthenMethodTacacsPlus),
+		tq.SetAuthorRequestPrivLvl(tq.PrivLvl(in.PrivLvl)),
+		tq.SetAuthorRequestType(tq.AuthenTypeASCII),
+		tq.SetAuthorRequestService(tq.AuthenServiceLogin),
+		tq.SetAuthorRequestUser(tq.AuthenUser(in.User)),
+		tq.SetAuthorRequestArgs(args),
+	)
+}
+
+func sortedCopy(v []string) []string {
+	c := append([]string{}, v...)
+	sort.Strings(c)
+	return c
+}
+
+// TestingT is the subset of testing.TB used by RunPolicyTestDir
+type TestingT interface {
+	Helper()
+	Errorf(format string, args ...interface{})
+}
+
+// RunPolicyTestDir loads PolicyFile and every case file from dir, runs them and reports each
+// failing case to t.  It is meant to be called from a go test.
+func RunPolicyTestDir(t TestingT, l loggerProvider, dir string) PolicyReport {
+	t.Helper()
+	policy, err := LoadPolicy(filepath.Join(dir, PolicyFile))
+	if err != nil {
+		t.Errorf("%v", err)
+		return PolicyReport{}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Errorf("unable to read policy test dir; %v", err)
+		return PolicyReport{}
+	}
+	var cases []PolicyCase
+	for _, e := range entries {
+		switch filepath.Ext(e.Name()) {
+		case ".yaml", ".yml", ".json":
+		default:
+			continue
+		}
+		if e.IsDir() || e.Name() == PolicyFile {
+			continue
+		}
+		c, err := LoadPolicyCases(filepath.Join(dir, e.Name()))
+		if err != nil {
+			t.Errorf("%v", err)
+			continue
+		}
+		cases = append(cases, c...)
+	}
+	report := RunPolicyTests(l, policy, cases)
+	for _, result := range report.Failed() {
+		t.Errorf("policy case [%v] failed:\n    %v", result.Name, strings.Join(result.Diffs, "\n    "))
+	}
+	return report
+}
@@ -0,0 +1,53 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package stringy
+
+import (
+	"regexp"
+	"sync"
+)
+
+// regexCache keeps the command regexes compiled by the last two builds, so a config reload only
+// compiles the patterns that changed.  Patterns that no build uses for two builds are dropped.
+type regexCache struct {
+	sync.Mutex
+	current, previous map[string]*regexp.Regexp
+}
+
+func newRegexCache() *regexCache {
+	return &regexCache{current: make(map[string]*regexp.Regexp), previous: make(map[string]*regexp.Regexp)}
+}
+
+// compile returns the compiled pattern, from the cache if it holds it
+func (c *regexCache) compile(pattern string) (*regexp.Regexp, error) {
+	c.Lock()
+	defer c.Unlock()
+	if re, ok := c.current[pattern]; ok {
+		stringyRegexCacheHit.Inc()
+		return re, nil
+	}
+	if re, ok := c.previous[pattern]; ok {
+		stringyRegexCacheHit.Inc()
+		c.current[pattern] = re
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	stringyRegexCompile.Inc()
+	c.current[pattern] = re
+	return re, nil
+}
+
+// rotate starts a new build, the patterns of the build that just completed are kept for it
+func (c *regexCache) rotate() {
+	c.Lock()
+	defer c.Unlock()
+	c.previous, c.current = c.current, make(map[string]*regexp.Regexp, len(c.current))
+}
@@ -0,0 +1,63 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package stringy
+
+import (
+	"context"
+	"testing"
+
+	tq "github.com/facebookincubator/tacquito"
+	"github.com/facebookincubator/tacquito/cmds/server/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// regexUser is authorized to configure the interfaces matching patterns
+func regexUser(patterns ...string) config.User {
+	return config.User{Name: "alice", Commands: []config.Command{{Name: "configure", Match: patterns, Action: config.PERMIT}}}
+}
+
+// regexesOf returns the authorizer a builds for user, holding its compiled command matches
+func regexesOf(t *testing.T, a *Authorizer, user config.User) *Authorizer {
+	h, err := a.New(user)
+	require.NoError(t, err)
+	return h.(*Authorizer)
+}
+
+func TestRegexCacheAcrossBuilds(t *testing.T) {
+	a := New(NewDefaultLogger())
+	first := regexesOf(t, a, regexUser(`^interface eth[0-9]+$`, ` ^vlan [0-9]+$ `))
+	require.Len(t, first.regexes, 2)
+	a.BuildDone()
+
+	// unchanged patterns reuse the regexes compiled by the previous build
+	second := regexesOf(t, a, regexUser(`^interface eth[0-9]+$`, `^loopback0$`))
+	assert.Same(t, first.regexes[`^interface eth[0-9]+$`], second.regexes[`^interface eth[0-9]+$`])
+	a.BuildDone()
+
+	// and are released once a build no longer uses them
+	a.BuildDone()
+	assert.Empty(t, a.cache.previous)
+	third := regexesOf(t, a, regexUser(`^interface eth[0-9]+$`))
+	assert.NotSame(t, first.regexes[`^interface eth[0-9]+$`], third.regexes[`^interface eth[0-9]+$`])
+}
+
+func TestRegexCompiledAtBuild(t *testing.T) {
+	a := regexesOf(t, New(NewDefaultLogger()), regexUser(`^interface (eth`, ` ^vlan [0-9]+$ `))
+	// the bad pattern is left out, and denies the requests that reach it as before, even those a
+	// later pattern would match
+	assert.Len(t, a.regexes, 1)
+	for _, args := range []string{"interface eth0", "vlan 10"} {
+		body := tq.AuthorRequest{User: "alice", Args: tq.Args{"service=shell", "cmd=configure", tq.Arg("cmd-arg=" + args)}}
+		assert.False(t, a.Explain(context.Background(), body).Permit(), args)
+	}
+	a = regexesOf(t, New(NewDefaultLogger()), regexUser(` ^vlan [0-9]+$ `))
+	body := tq.AuthorRequest{User: "alice", Args: tq.Args{"service=shell", "cmd=configure", "cmd-arg=vlan", "cmd-arg=10"}}
+	assert.True(t, a.Explain(context.Background(), body).Permit())
+}
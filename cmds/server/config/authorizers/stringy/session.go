@@ -10,6 +10,8 @@ package stringy
 
 import (
 	"context"
+	"fmt"
+	"strings"
 
 	tq "github.com/facebookincubator/tacquito"
 	"github.com/facebookincubator/tacquito/cmds/server/config"
@@ -44,11 +46,16 @@ type SessionBasedAuthorizer struct {
 	ctx  context.Context
 	body tq.AuthorRequest
 	user config.User
+	// timeouts, if set, adds timeout av pairs to successful authorizations
+	timeouts TimeoutPolicy
+	// conditions are the compiled `when` expressions of user
+	conditions *conditions
 }
 
 // Handle will respond with failures or accepts as needed
 func (sa SessionBasedAuthorizer) Handle(response tq.Response, request tq.Request) {
 	if args, status := sa.evaluate(); len(args) > 0 {
+		args = sa.withTimeouts(request, args)
 		sa.Debugf(request.Context, "authorized user [%v] as session based; args %v", sa.user.Name, args)
 		switch status {
 		case tq.AuthorStatusPassAdd:
@@ -75,8 +82,32 @@ func (sa SessionBasedAuthorizer) Handle(response tq.Response, request tq.Request
 	)
 }
 
+// withTimeouts merges the timeouts of the timeout policy into args.  Timeouts devices would not
+// accept are logged and left out, rather than failing the authorization.
+func (sa SessionBasedAuthorizer) withTimeouts(request tq.Request, args []string) []string {
+	if sa.timeouts == nil {
+		return args
+	}
+	t := sa.timeouts.Timeouts(request.Context, sa.user, requestTime(request))
+	if err := t.Validate(); err != nil {
+		sa.Errorf(request.Context, "ignoring the timeouts of user [%v]; %v", sa.user.Name, err)
+		stringyTimeoutInvalid.Inc()
+		return args
+	}
+	return mergeTimeouts(args, t)
+}
+
 // evaluate is the main entry point for session based auth flows
 func (sa SessionBasedAuthorizer) evaluate() ([]string, tq.AuthorStatus) {
+	args, status, _, _ := sa.explain()
+	return args, status
+}
+
+// explain evaluates the session and also returns the names of the services that contributed
+// args to the response.  A service with a `when` expression only contributes if the request
+// satisfies it, and the trace holds the value of every part of the expressions evaluated.  An
+// expression that fails leaves its service out.
+func (sa SessionBasedAuthorizer) explain() ([]string, tq.AuthorStatus, []string, []string) {
 	// overload the body.Args fields to include injected arg concepts in them.  Doing so artifically injects avps into the
 	// requested client args and allows them to behave in evaluation the same as if they came from the client.  We do this for
 	// args that will never present in a client request, but for things we'd like to filter on.  A use cases is filtering for scope
@@ -86,17 +117,33 @@ func (sa SessionBasedAuthorizer) evaluate() ([]string, tq.AuthorStatus) {
 	responseArgs := make(tq.Args, 0, len(args))
 	authorStatus := tq.AuthorStatusPassAdd
 
+	var rules, trace []string
 	for _, s := range sa.user.Services {
 		s.TrimSpace()
 		// optional == true means we hit a client delim of * or we encountered it in our own config
 		// via Optional = true.
 		matched, optional := sa.serviceMatcherModifier(args, s)
+		rule := "service " + s.Name
+		if when := strings.TrimSpace(s.When); when != "" && len(matched) > 0 {
+			ok, t, err := sa.conditions.eval(sa.ctx, sa.body, sa.user, rule, when)
+			trace = append(trace, t...)
+			rule = fmt.Sprintf("%v when %v", rule, when)
+			if err != nil {
+				sa.Errorf(sa.ctx, "unable to evaluate the condition of [%v]; %v", rule, err)
+			}
+			if !ok {
+				continue
+			}
+		}
 		if optional {
 			authorStatus = tq.AuthorStatusPassRepl
 		}
+		if len(matched) > 0 {
+			rules = append(rules, rule)
+		}
 		responseArgs.Append(matched...)
 	}
-	return responseArgs.Args(), authorStatus
+	return responseArgs.Args(), authorStatus, rules, trace
 }
 
 // serviceMatcherModifier matches incoming attribute value pairs from the client against our config
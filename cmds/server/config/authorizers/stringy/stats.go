@@ -33,6 +33,26 @@ var (
 		Name:      "stringy_handle_authorize_error",
 		Help:      "number of stringy authorize error packets",
 	})
+	stringyTimeoutInvalid = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "tacquito",
+		Name:      "stringy_timeout_invalid",
+		Help:      "number of session authorizations whose computed timeouts were left out as devices would not accept them",
+	})
+	stringyRegexCompile = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "tacquito",
+		Name:      "stringy_regex_compile",
+		Help:      "number of command regexes compiled by config builds",
+	})
+	stringyRegexCacheHit = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "tacquito",
+		Name:      "stringy_regex_cache_hit",
+		Help:      "number of command regexes a config build reused from a previous build",
+	})
+	stringyExpressionError = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "tacquito",
+		Name:      "stringy_expression_error",
+		Help:      "number of when expressions that failed to evaluate, eg by exceeding their cost limit, whose rules then deny",
+	})
 	stringyHandleUnexpectedPacket = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "tacquito",
 		Name:      "stringy_handle_unexpected_packet",
@@ -46,4 +66,8 @@ func init() {
 	prometheus.MustRegister(stringyHandleAuthorizeFail)
 	prometheus.MustRegister(stringyHandleAuthorizeError)
 	prometheus.MustRegister(stringyHandleUnexpectedPacket)
+	prometheus.MustRegister(stringyTimeoutInvalid)
+	prometheus.MustRegister(stringyRegexCompile)
+	prometheus.MustRegister(stringyRegexCacheHit)
+	prometheus.MustRegister(stringyExpressionError)
 }
@@ -11,6 +11,8 @@ package stringy
 
 import (
 	"context"
+	"regexp"
+	"strings"
 
 	tq "github.com/facebookincubator/tacquito"
 	"github.com/facebookincubator/tacquito/cmds/server/config"
@@ -24,27 +26,84 @@ type loggerProvider interface {
 }
 
 // New stringy Authorizer
-func New(l loggerProvider) *Authorizer {
-	return &Authorizer{loggerProvider: l}
+func New(l loggerProvider, opts ...Option) *Authorizer {
+	a := &Authorizer{loggerProvider: l, cache: newRegexCache(), exprCostLimit: DefaultExpressionCostLimit}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
 }
 
 // Authorizer is for authorization of commands and such
 type Authorizer struct {
 	loggerProvider
-	user config.User
+	user     config.User
+	timeouts TimeoutPolicy
+	// regexes are the compiled command matches of user, they are never modified once built so
+	// requests read them without locks
+	regexes map[string]*regexp.Regexp
+	// cache is shared by the authorizers of every build
+	cache *regexCache
+	// exprCostLimit is the cost each `when` expression may spend, and conditions the compiled
+	// expressions of user, see SetExpressionCostLimit
+	exprCostLimit int
+	conditions    *conditions
 }
 
-// New creates a new stringy authorizer which implements tq.Handler
+// New creates a new stringy authorizer which implements tq.Handler.  The command regexes and
+// `when` expressions of user are compiled here, while the config is built, rather than by each
+// request.  An expression that does not compile fails the user.
 func (a Authorizer) New(user config.User) (tq.Handler, error) {
 	// ReduceAll appends all group level services and commands to the user level
 	// user level overrides for services and commands are processed first, then the groups.
 	a.ReduceAll(&user)
+	conditions, err := compileConditions(user, a.exprCostLimit)
+	if err != nil {
+		return nil, err
+	}
 	return &Authorizer{
 		loggerProvider: a.loggerProvider,
 		user:           user,
+		timeouts:       a.timeouts,
+		regexes:        a.compile(user),
+		cache:          a.cache,
+		exprCostLimit:  a.exprCostLimit,
+		conditions:     conditions,
 	}, nil
 }
 
+// compile returns the compiled command matches of user.  Patterns that do not compile are left
+// out, and deny the requests that reach them.
+func (a Authorizer) compile(user config.User) map[string]*regexp.Regexp {
+	if a.cache == nil {
+		a.cache = newRegexCache()
+	}
+	regexes := make(map[string]*regexp.Regexp)
+	for _, c := range user.Commands {
+		for _, pattern := range c.Match {
+			pattern = strings.TrimSpace(pattern)
+			if _, ok := regexes[pattern]; ok {
+				continue
+			}
+			re, err := a.cache.compile(pattern)
+			if err != nil {
+				a.Errorf(context.Background(), "bad regex detected for command [%v] of user [%v]; %v", c.Name, user.Name, err)
+				continue
+			}
+			regexes[pattern] = re
+		}
+	}
+	return regexes
+}
+
+// BuildDone is called by the loader once a config build completes, regexes no build has used
+// since the previous one are then released
+func (a Authorizer) BuildDone() {
+	if a.cache != nil {
+		a.cache.rotate()
+	}
+}
+
 // ReduceAll will collapse all services and commands down to the user level
 func (a Authorizer) ReduceAll(u *config.User) {
 	for _, g := range u.Groups {
@@ -82,12 +141,16 @@ func (a Authorizer) Handle(response tq.Response, request tq.Request) {
 
 	if authorizer := NewCommandBasedAuthorizer(request.Context, a.loggerProvider, body, a.user); authorizer != nil {
 		a.Debugf(request.Context, "detected user [%v] using command based authorization", a.user.Name)
+		authorizer.regexes = a.regexes
+		authorizer.conditions = a.conditions
 		authorizer.Handle(response, request)
 		return
 	}
 
 	if authorizer := NewSessionBasedAuthorizer(request.Context, a.loggerProvider, body, a.user); authorizer != nil {
 		a.Debugf(request.Context, "detected user [%v] using session based authorization", a.user.Name)
+		authorizer.timeouts = a.timeouts
+		authorizer.conditions = a.conditions
 		authorizer.Handle(response, request)
 		return
 	}
@@ -463,3 +463,34 @@ func TestSpecialMatchers(t *testing.T) {
 		test.expect(t, test.name, resp, status)
 	}
 }
+
+func TestPolicyCases(t *testing.T) {
+	report := RunPolicyTestDir(t, NewDefaultLogger(), "testdata/policy")
+	assert.Len(t, report.Results, 22)
+}
+
+func TestPolicyReportDiffs(t *testing.T) {
+	policy, err := LoadPolicy("testdata/policy/policy.yaml")
+	assert.NoError(t, err)
+	report := RunPolicyTests(NewDefaultLogger(), policy, []PolicyCase{
+		{
+			Name:   "wrong decision, rule and args",
+			Input:  PolicyInput{User: "bob", DeviceGroup: "core", Service: "shell", Args: []string{"cmd="}},
+			Expect: PolicyExpect{Decision: "deny", Rule: "service foo", Args: []string{"priv-lvl=15"}},
+		},
+		{
+			Name:   "unknown group",
+			Input:  PolicyInput{User: "bob", Groups: []string{"nope"}, DeviceGroup: "core", Service: "shell", Cmd: "show"},
+			Expect: PolicyExpect{Decision: "permit"},
+		},
+	})
+	failed := report.Failed()
+	assert.Len(t, failed, 2)
+	assert.Equal(t, []string{
+		`decision: want "deny", got "permit" (AuthorStatusPassAdd)`,
+		`rule: want "service foo", got "service shell"`,
+		`args: want ["priv-lvl=15"], got ["priv-lvl=1"]`,
+	}, failed[0].Diffs)
+	assert.Equal(t, []string{"group [nope] is not in the policy"}, failed[1].Diffs)
+	assert.Contains(t, report.String(), "2 cases, 0 passed, 2 failed")
+}
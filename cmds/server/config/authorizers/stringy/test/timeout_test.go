@@ -0,0 +1,90 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	tq "github.com/facebookincubator/tacquito"
+	"github.com/facebookincubator/tacquito/cmds/server/config"
+	"github.com/facebookincubator/tacquito/cmds/server/config/authorizers/stringy"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// timeoutUser is a member of group with a shell service that sets a static idletime
+func timeoutUser(group string) config.User {
+	return config.User{
+		Name:   "cisco",
+		Groups: []config.Group{{Name: group}},
+		Services: []config.Service{
+			{
+				Name: "shell",
+				SetValues: []config.Value{
+					{Name: "priv-lvl", Values: []string{"15"}},
+					{Name: "idletime", Values: []string{"600"}},
+				},
+			},
+		},
+	}
+}
+
+// timeoutRequest is a session authorization received at the given wall time
+func timeoutRequest(at time.Time) tq.Request {
+	request := newAuthorRequest("cisco", tq.Args{"service=shell", "cmd="})
+	request.Context = context.WithValue(context.Background(), tq.ContextEventTime, at.Format(time.RFC3339Nano))
+	return request
+}
+
+func TestTimeoutPolicyByRole(t *testing.T) {
+	rules := stringy.TimeoutRules{
+		{Group: "oncall", IdleMinutes: 120},
+		// business hours only, in the time zone of the request below
+		{Group: "contractor", FromHour: 9, ToHour: 17, IdleMinutes: 15, SessionMinutes: 480},
+		{IdleMinutes: 30},
+	}
+	require.NoError(t, rules.Validate())
+	noon := time.Date(2021, 6, 1, 12, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		name  string
+		group string
+		at    time.Time
+		want  []string
+	}{
+		{name: "oncall", group: "oncall", at: noon, want: []string{"priv-lvl=15", "idletime=120"}},
+		{name: "contractor in hours", group: "contractor", at: noon, want: []string{"priv-lvl=15", "idletime=15", "timeout=480"}},
+		{name: "contractor out of hours", group: "contractor", at: noon.Add(8 * time.Hour), want: []string{"priv-lvl=15", "idletime=30"}},
+		{name: "anyone else", group: "staff", at: noon, want: []string{"priv-lvl=15", "idletime=30"}},
+	}
+	for _, test := range tests {
+		handler, err := stringy.New(newDefaultLogger(30), stringy.SetTimeoutPolicy(rules)).New(timeoutUser(test.group))
+		require.NoError(t, err)
+		response := &mockedResponse{}
+		handler.Handle(response, timeoutRequest(test.at))
+		require.NotNil(t, response.got, test.name)
+		assert.Equal(t, tq.AuthorStatusPassAdd, response.got.Status, test.name)
+		assert.Equal(t, test.want, response.got.Args.Args(), test.name)
+	}
+}
+
+func TestTimeoutPolicyInvalid(t *testing.T) {
+	// seconds are not expressible to devices, the static idletime of the config is kept
+	policy := stringy.TimeoutPolicyFunc(func(ctx context.Context, user config.User, now time.Time) stringy.Timeouts {
+		return stringy.Timeouts{Idle: 90 * time.Second}
+	})
+	handler, err := stringy.New(newDefaultLogger(30), stringy.SetTimeoutPolicy(policy)).New(timeoutUser("oncall"))
+	require.NoError(t, err)
+	response := &mockedResponse{}
+	handler.Handle(response, timeoutRequest(time.Now()))
+	require.NotNil(t, response.got)
+	assert.Equal(t, []string{"priv-lvl=15", "idletime=600"}, response.got.Args.Args())
+}
@@ -0,0 +1,201 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package stringy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	tq "github.com/facebookincubator/tacquito"
+	"github.com/facebookincubator/tacquito/cmds/server/config"
+)
+
+const (
+	// idleTimeoutAttribute is the idle timeout of a shell session, in minutes
+	idleTimeoutAttribute = "idletime"
+	// sessionTimeoutAttribute is the absolute timeout of a shell session, in minutes
+	sessionTimeoutAttribute = "timeout"
+	// maxTimeoutMinutes is the longest timeout devices accept, the exec-timeout limit of ios
+	maxTimeoutMinutes = 35791
+)
+
+// Option configures an Authorizer
+type Option func(a *Authorizer)
+
+// SetTimeoutPolicy adds the timeouts computed by p to every successful session based
+// authorization
+func SetTimeoutPolicy(p TimeoutPolicy) Option {
+	return func(a *Authorizer) {
+		a.timeouts = p
+	}
+}
+
+// TimeoutPolicy computes the timeouts of a session when it is authorized
+type TimeoutPolicy interface {
+	// Timeouts returns the timeouts of a session of user authorized at now
+	Timeouts(ctx context.Context, user config.User, now time.Time) Timeouts
+}
+
+// TimeoutPolicyFunc is an adapter to use a func as a TimeoutPolicy
+type TimeoutPolicyFunc func(ctx context.Context, user config.User, now time.Time) Timeouts
+
+// Timeouts implements TimeoutPolicy
+func (f TimeoutPolicyFunc) Timeouts(ctx context.Context, user config.User, now time.Time) Timeouts {
+	return f(ctx, user, now)
+}
+
+// Timeouts are the idle and absolute timeouts of a session.  Zero leaves a timeout to the device.
+type Timeouts struct {
+	Idle    time.Duration
+	Session time.Duration
+}
+
+// Validate checks the timeouts are whole minutes that devices accept
+func (t Timeouts) Validate() error {
+	for _, v := range []struct {
+		name string
+		d    time.Duration
+	}{{idleTimeoutAttribute, t.Idle}, {sessionTimeoutAttribute, t.Session}} {
+		switch {
+		case v.d < 0:
+			return fmt.Errorf("%v [%v] is negative", v.name, v.d)
+		case v.d%time.Minute != 0:
+			return fmt.Errorf("%v [%v] is not a whole number of minutes", v.name, v.d)
+		case v.d > maxTimeoutMinutes*time.Minute:
+			return fmt.Errorf("%v [%v] exceeds the device limit of [%v] minutes", v.name, v.d, maxTimeoutMinutes)
+		}
+	}
+	return nil
+}
+
+// args returns the timeouts as av pairs
+func (t Timeouts) args() []string {
+	var args []string
+	if t.Idle > 0 {
+		args = append(args, idleTimeoutAttribute+"="+strconv.Itoa(int(t.Idle/time.Minute)))
+	}
+	if t.Session > 0 {
+		args = append(args, sessionTimeoutAttribute+"="+strconv.Itoa(int(t.Session/time.Minute)))
+	}
+	return args
+}
+
+// mergeTimeouts replaces the timeout av pairs of args, eg static ones from the config, with those
+// of t.  args are returned unchanged if t is zero.
+func mergeTimeouts(args []string, t Timeouts) []string {
+	computed := t.args()
+	if len(computed) == 0 {
+		return args
+	}
+	merged := make([]string, 0, len(args)+len(computed))
+	for _, arg := range args {
+		a, _, _ := tq.Arg(arg).ASV()
+		if (a == idleTimeoutAttribute && t.Idle > 0) || (a == sessionTimeoutAttribute && t.Session > 0) {
+			continue
+		}
+		merged = append(merged, arg)
+	}
+	return append(merged, computed...)
+}
+
+// requestTime returns the wall time the request was received at in the time zone of the server,
+// or the current time if the server did not stamp it
+func requestTime(request tq.Request) time.Time {
+	if request.Context != nil {
+		if v, ok := request.Context.Value(tq.ContextEventTime).(string); ok {
+			if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+				return t.Local()
+			}
+		}
+	}
+	return time.Now()
+}
+
+// TimeoutRule sets the timeouts of the members of a group during a window of the day.  Hours are
+// in the time zone of the server.  From equal to To is the whole day, From after To wraps around
+// midnight.
+type TimeoutRule struct {
+	// Group is the group users must be a member of, empty matches every user
+	Group          string `json:"group"`
+	FromHour       int    `json:"from_hour"`
+	ToHour         int    `json:"to_hour"`
+	IdleMinutes    int    `json:"idle_minutes"`
+	SessionMinutes int    `json:"session_minutes"`
+}
+
+// applies reports if r applies to user at now
+func (r TimeoutRule) applies(user config.User, now time.Time) bool {
+	if r.Group != "" && !memberOf(user, r.Group) {
+		return false
+	}
+	if r.FromHour == r.ToHour {
+		return true
+	}
+	h := now.Hour()
+	if r.FromHour < r.ToHour {
+		return h >= r.FromHour && h < r.ToHour
+	}
+	return h >= r.FromHour || h < r.ToHour
+}
+
+// memberOf reports if user is a member of group
+func memberOf(user config.User, group string) bool {
+	for _, g := range user.Groups {
+		if g.Name == group {
+			return true
+		}
+	}
+	return false
+}
+
+// TimeoutRules is a TimeoutPolicy whose first rule that applies sets the timeouts
+type TimeoutRules []TimeoutRule
+
+// Timeouts implements TimeoutPolicy
+func (rules TimeoutRules) Timeouts(ctx context.Context, user config.User, now time.Time) Timeouts {
+	for _, r := range rules {
+		if r.applies(user, now) {
+			return Timeouts{Idle: time.Duration(r.IdleMinutes) * time.Minute, Session: time.Duration(r.SessionMinutes) * time.Minute}
+		}
+	}
+	return Timeouts{}
+}
+
+// Validate checks the hours and timeouts of every rule
+func (rules TimeoutRules) Validate() error {
+	for i, r := range rules {
+		if r.FromHour < 0 || r.FromHour > 23 || r.ToHour < 0 || r.ToHour > 23 {
+			return fmt.Errorf("timeout rule %v: hours must be within 0 and 23", i)
+		}
+		t := Timeouts{Idle: time.Duration(r.IdleMinutes) * time.Minute, Session: time.Duration(r.SessionMinutes) * time.Minute}
+		if err := t.Validate(); err != nil {
+			return fmt.Errorf("timeout rule %v: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// LoadTimeoutRules reads and validates the json list of timeout rules at path
+func LoadTimeoutRules(path string) (TimeoutRules, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules TimeoutRules
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return nil, err
+	}
+	if err := rules.Validate(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
@@ -0,0 +1,67 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package stringy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/facebookincubator/tacquito/cmds/server/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeoutsValidate(t *testing.T) {
+	assert.NoError(t, Timeouts{}.Validate())
+	assert.NoError(t, Timeouts{Idle: 15 * time.Minute, Session: maxTimeoutMinutes * time.Minute}.Validate())
+	assert.Error(t, Timeouts{Idle: -time.Minute}.Validate())
+	assert.Error(t, Timeouts{Session: 90 * time.Second}.Validate())
+	assert.Error(t, Timeouts{Idle: (maxTimeoutMinutes + 1) * time.Minute}.Validate())
+}
+
+func TestMergeTimeouts(t *testing.T) {
+	args := []string{"priv-lvl=15", "idletime*600", "timeout=60"}
+	assert.Equal(t, args, mergeTimeouts(args, Timeouts{}))
+	assert.Equal(t, []string{"priv-lvl=15", "timeout=60", "idletime=5"}, mergeTimeouts(args, Timeouts{Idle: 5 * time.Minute}))
+	assert.Equal(t, []string{"priv-lvl=15", "idletime=5", "timeout=480"}, mergeTimeouts(args, Timeouts{Idle: 5 * time.Minute, Session: 8 * time.Hour}))
+}
+
+// timeoutUserOf is a user that is a member of groups
+func timeoutUserOf(groups ...string) config.User {
+	u := config.User{Name: "cisco"}
+	for _, g := range groups {
+		u.Groups = append(u.Groups, config.Group{Name: g})
+	}
+	return u
+}
+
+func TestTimeoutRuleWindow(t *testing.T) {
+	at := func(hour int) time.Time { return time.Date(2021, 6, 1, hour, 30, 0, 0, time.UTC) }
+	night := TimeoutRule{FromHour: 22, ToHour: 6}
+	assert.True(t, night.applies(timeoutUserOf(), at(23)))
+	assert.True(t, night.applies(timeoutUserOf(), at(5)))
+	assert.False(t, night.applies(timeoutUserOf(), at(6)))
+	assert.True(t, TimeoutRule{}.applies(timeoutUserOf(), at(12)))
+	assert.False(t, TimeoutRule{Group: "oncall"}.applies(timeoutUserOf(), at(12)))
+	assert.True(t, TimeoutRule{Group: "oncall"}.applies(timeoutUserOf("oncall"), at(12)))
+}
+
+func TestLoadTimeoutRules(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rules.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[{"group": "oncall", "idle_minutes": 120}, {"idle_minutes": 30}]`), 0600))
+	rules, err := LoadTimeoutRules(path)
+	require.NoError(t, err)
+	assert.Equal(t, TimeoutRules{{Group: "oncall", IdleMinutes: 120}, {IdleMinutes: 30}}, rules)
+
+	require.NoError(t, os.WriteFile(path, []byte(`[{"from_hour": 24, "idle_minutes": 30}]`), 0600))
+	_, err = LoadTimeoutRules(path)
+	assert.Error(t, err)
+}
@@ -0,0 +1,34 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package config
+
+import (
+	"context"
+
+	tq "github.com/facebookincubator/tacquito"
+)
+
+// The factories here are built from the config schema itself, so they live with it rather than in
+// the extension package.  They are as stable as the extension interfaces: a method is never added
+// to, removed from or changed on them within a major version.
+
+// AuthorizerFactory builds the Handler that authorizes the commands and services of user, see
+// loader.SetAuthorizerProvider.  New is called concurrently.
+//
+// Stable.
+type AuthorizerFactory interface {
+	New(user User) (tq.Handler, error)
+}
+
+// HandlerFactory builds the Handler of the devices of a secret config, whose users are served by
+// cp, see loader.RegisterHandlerType.
+//
+// Stable.
+type HandlerFactory interface {
+	New(ctx context.Context, cp Provider, options map[string]string) tq.Handler
+}
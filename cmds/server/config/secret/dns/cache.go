@@ -0,0 +1,67 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package dns
+
+import (
+	"sync"
+	"time"
+)
+
+// lookupCachePrune is the number of cached addresses past which expired entries are dropped on
+// the next insert, so addresses that stop connecting do not hold memory
+const lookupCachePrune = 4096
+
+// lookupCache caches the hostnames of remote addresses
+type lookupCache struct {
+	sync.Mutex
+	ttl, negativeTTL time.Duration
+	entries          map[string]lookupEntry
+}
+
+// lookupEntry is the result of resolving an address
+type lookupEntry struct {
+	names   []string
+	err     error
+	expires time.Time
+}
+
+func newLookupCache(ttl, negativeTTL time.Duration) *lookupCache {
+	return &lookupCache{ttl: ttl, negativeTTL: negativeTTL, entries: make(map[string]lookupEntry)}
+}
+
+// get returns the cached result of resolving ip, ok is false if there is none by now
+func (c *lookupCache) get(ip string, now time.Time) (names []string, err error, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[ip]
+	if !ok || !now.Before(e.expires) {
+		return nil, nil, false
+	}
+	return e.names, e.err, true
+}
+
+// set caches the result of resolving ip
+func (c *lookupCache) set(ip string, names []string, err error, now time.Time) {
+	ttl := c.ttl
+	if err != nil {
+		ttl = c.negativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if len(c.entries) >= lookupCachePrune {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	c.entries[ip] = lookupEntry{names: names, err: err, expires: now.Add(ttl)}
+}
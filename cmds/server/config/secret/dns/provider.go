@@ -12,9 +12,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"path"
+	"strings"
+	"time"
 
 	tq "github.com/facebookincubator/tacquito"
-	"github.com/facebookincubator/tacquito/cmds/server/config"
+	"github.com/facebookincubator/tacquito/extension"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -27,18 +30,78 @@ type loggerProvider interface {
 	Record(ctx context.Context, r map[string]string, obscure ...string)
 }
 
+// defaults for the resolution of remote addresses
+const (
+	defaultLookupTimeout = 2 * time.Second
+	defaultCacheTTL      = 5 * time.Minute
+	// failed lookups are cached for less time so a recovered resolver is used soon, but long
+	// enough that a dead one does not cost every new connection the lookup timeout
+	defaultNegativeCacheTTL = 30 * time.Second
+)
+
+// resolver resolves the hostnames of an address, net.Resolver implements it
+type resolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
 // ProviderOption is the setter type for Provider
 type ProviderOption func(p *Provider)
 
-// SetDNSSecret will set a secret config for a given hostname
+// SetDNSSecret will set a secret config for a given hostname.  A host holding any of the glob
+// characters *, ? or [ is a pattern, eg *.edge.example.com, matched with path.Match.  Hosts are
+// matched case insensitively, with or without their trailing dot.
 func SetDNSSecret(config secretConfig, hosts ...string) ProviderOption {
 	return func(p *Provider) {
 		for _, h := range hosts {
-			p.secrets[h] = config
+			h = normalizeHost(h)
+			if !strings.ContainsAny(h, "*?[") {
+				p.secrets[h] = config
+				continue
+			}
+			if _, err := path.Match(h, ""); err != nil {
+				continue
+			}
+			p.patterns = append(p.patterns, hostPattern{pattern: h, secretConfig: config})
 		}
 	}
 }
 
+// SetFallbackPrefixes will set a secret config for remotes within prefixes whose hostname cannot
+// be resolved, so a dns outage does not lock out the devices it would have matched
+func SetFallbackPrefixes(config secretConfig, prefixes ...string) ProviderOption {
+	return func(p *Provider) {
+		for _, prefix := range prefixes {
+			_, ipnet, err := net.ParseCIDR(prefix)
+			if err != nil {
+				continue
+			}
+			p.fallback = append(p.fallback, fallbackPrefix{ipnet: ipnet, secretConfig: config})
+		}
+	}
+}
+
+// SetResolver will set the resolver of remote addresses, net.DefaultResolver by default
+func SetResolver(r resolver) ProviderOption {
+	return func(p *Provider) {
+		p.resolver = r
+	}
+}
+
+// SetLookupTimeout will set how long the resolution of a remote address may take
+func SetLookupTimeout(d time.Duration) ProviderOption {
+	return func(p *Provider) {
+		p.timeout = d
+	}
+}
+
+// SetLookupCache will set how long the hostnames of a remote address are cached, and how long a
+// failed resolution is.  A ttl of zero disables caching.
+func SetLookupCache(ttl, negativeTTL time.Duration) ProviderOption {
+	return func(p *Provider) {
+		p.cache.ttl, p.cache.negativeTTL = ttl, negativeTTL
+	}
+}
+
 // SetLoggerProvider will set a logger to use
 func SetLoggerProvider(l loggerProvider) ProviderOption {
 	return func(p *Provider) {
@@ -48,7 +111,13 @@ func SetLoggerProvider(l loggerProvider) ProviderOption {
 
 // New creates new config sources based on users, groups and services
 func New(l loggerProvider, opts ...ProviderOption) *Provider {
-	s := &Provider{loggerProvider: l, secrets: make(map[string]secretConfig)}
+	s := &Provider{
+		loggerProvider: l,
+		secrets:        make(map[string]secretConfig),
+		resolver:       net.DefaultResolver,
+		timeout:        defaultLookupTimeout,
+		cache:          newLookupCache(defaultCacheTTL, defaultNegativeCacheTTL),
+	}
 	for _, opt := range opts {
 		opt(s)
 	}
@@ -58,11 +127,18 @@ func New(l loggerProvider, opts ...ProviderOption) *Provider {
 // Provider ...
 type Provider struct {
 	loggerProvider
-	secrets map[string]secretConfig
+	secrets  map[string]secretConfig
+	patterns []hostPattern
+	fallback []fallbackPrefix
+	resolver resolver
+	timeout  time.Duration
+	// cache is shared by the scoped providers of a Provider, so a remote is resolved once
+	// however many secret configs try it
+	cache *lookupCache
 }
 
 // New returns a scoped Provider for a given set of users.
-func (p *Provider) New(ctx context.Context, provider config.SecretConfig, handler tq.Handler, secret func(context.Context, string) ([]byte, error)) tq.SecretProvider {
+func (p *Provider) New(ctx context.Context, provider extension.SecretConfig, handler tq.Handler, secret func(context.Context, string) ([]byte, error)) tq.SecretProvider {
 	var hosts []string
 	err := json.Unmarshal([]byte(provider.Options["hosts"]), &hosts)
 	if err != nil {
@@ -73,16 +149,28 @@ func (p *Provider) New(ctx context.Context, provider config.SecretConfig, handle
 		p.Errorf(ctx, "no host provided for dns based secret provider [%v]", provider.Name)
 		return nil
 	}
+	var fallback []string
+	if raw, ok := provider.Options["fallback_prefixes"]; ok {
+		if err := json.Unmarshal([]byte(raw), &fallback); err != nil {
+			p.Errorf(ctx, "unable to unmarshal key [fallback_prefixes] on dns based secret provider [%v]; %v", provider.Name, err)
+			return nil
+		}
+	}
 
 	scopedConfig := secretConfig{
 		secret:  secret,
 		Handler: handler,
 	}
 
-	return New(
+	scoped := New(
 		p.loggerProvider,
 		SetDNSSecret(scopedConfig, hosts...),
+		SetFallbackPrefixes(scopedConfig, fallback...),
+		SetResolver(p.resolver),
+		SetLookupTimeout(p.timeout),
 	)
+	scoped.cache = p.cache
+	return scoped
 }
 
 // Get returns a tq SecretProvider interface and or error
@@ -91,26 +179,95 @@ func (p *Provider) Get(ctx context.Context, remote net.Addr) ([]byte, tq.Handler
 	if !ok {
 		return nil, nil, fmt.Errorf("unable to assert [%v] is net.TCPAddr", remote)
 	}
+	names, err := p.lookup(ctx, addr.IP.String())
+	if err != nil {
+		return p.getFallback(ctx, addr, err)
+	}
+	for _, name := range names {
+		c, ok := p.match(normalizeHost(name))
+		if !ok {
+			continue
+		}
+		dnsGetMatch.Inc()
+		p.Debugf(ctx, "dns secret provider matches remote [%v] against fqdn [%v]", addr.IP.String(), name)
+		secret, err := c.secret(ctx, name)
+		// the handler itself is returned so the policies it implements, eg tq.SessionReusePolicy,
+		// are seen by the server
+		return secret, c.Handler, err
+	}
+	return nil, nil, fmt.Errorf("no matching dns secret provider found for names %v, for remote [%v]", names, addr.IP.String())
+}
+
+// lookup returns the hostnames of ip, from the cache if it holds them
+func (p *Provider) lookup(ctx context.Context, ip string) ([]string, error) {
+	if names, err, ok := p.cache.get(ip, time.Now()); ok {
+		dnsCacheHit.Inc()
+		return names, err
+	}
 	timer := prometheus.NewTimer(prometheus.ObserverFunc(func(v float64) {
 		ms := v * 1000 // make milliseconds
 		dnsDurations.Observe(ms)
 	}))
-	names, err := net.LookupAddr(addr.IP.String())
+	lctx, cancel := context.WithTimeout(ctx, p.timeout)
+	names, err := p.resolver.LookupAddr(lctx, ip)
+	cancel()
+	timer.ObserveDuration()
+	if err == nil && len(names) == 0 {
+		err = fmt.Errorf("no names found for [%v]", ip)
+	}
 	if err != nil {
-		timer.ObserveDuration()
 		dnsError.Inc()
-		return nil, nil, err
+		if ctx.Err() != nil {
+			// the caller gave up, which says nothing of the resolver
+			return nil, err
+		}
 	}
-	timer.ObserveDuration()
-	for _, name := range names {
-		if c, ok := p.secrets[name]; ok {
-			dnsGetMatch.Inc()
-			p.Debugf(ctx, "dns secret provider matches remote [%v] against fqdn [%v]", addr.IP.String(), name)
-			secret, err := c.secret(ctx, name)
-			return secret, c, err
+	p.cache.set(ip, names, err, time.Now())
+	return names, err
+}
+
+// match returns the secret config of the exact host name, or else of the first pattern it matches
+func (p *Provider) match(name string) (secretConfig, bool) {
+	if c, ok := p.secrets[name]; ok {
+		return c, true
+	}
+	for _, hp := range p.patterns {
+		if ok, _ := path.Match(hp.pattern, name); ok {
+			return hp.secretConfig, true
 		}
 	}
-	return nil, nil, fmt.Errorf("no matching dns secret provider found for names %v, for remote [%v]", names, addr.IP.String())
+	return secretConfig{}, false
+}
+
+// getFallback matches addr against the fallback prefixes once resolving it failed with err
+func (p *Provider) getFallback(ctx context.Context, addr *net.TCPAddr, err error) ([]byte, tq.Handler, error) {
+	for _, f := range p.fallback {
+		if !f.ipnet.Contains(addr.IP) {
+			continue
+		}
+		dnsFallback.Inc()
+		p.Infof(ctx, "dns secret provider could not resolve remote [%v], matches it against fallback prefix [%v]; %v", addr.IP.String(), f.ipnet, err)
+		secret, err := f.secret(ctx, addr.IP.String())
+		return secret, f.Handler, err
+	}
+	return nil, nil, err
+}
+
+// normalizeHost returns host lower cased and without its trailing dot
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// hostPattern is a glob matched against the hostnames of a remote
+type hostPattern struct {
+	pattern string
+	secretConfig
+}
+
+// fallbackPrefix is matched against a remote that cannot be resolved
+type fallbackPrefix struct {
+	ipnet *net.IPNet
+	secretConfig
 }
 
 // secretConfig holds the secret config needed for the SecretProvider
@@ -0,0 +1,216 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	tq "github.com/facebookincubator/tacquito"
+	"github.com/facebookincubator/tacquito/extension"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type nopLogger struct{}
+
+func (nopLogger) Infof(ctx context.Context, format string, args ...interface{})      {}
+func (nopLogger) Errorf(ctx context.Context, format string, args ...interface{})     {}
+func (nopLogger) Debugf(ctx context.Context, format string, args ...interface{})     {}
+func (nopLogger) Record(ctx context.Context, r map[string]string, obscure ...string) {}
+
+// stubResolver resolves the addresses it holds, counting its lookups.  Addresses it does not
+// hold fail, unless block is set, in which case the lookup waits for its context.
+type stubResolver struct {
+	sync.Mutex
+	names   map[string][]string
+	block   bool
+	lookups int
+}
+
+func (r *stubResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	r.Lock()
+	r.lookups++
+	names, ok := r.names[addr]
+	r.Unlock()
+	if ok {
+		return names, nil
+	}
+	if r.block {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+func (r *stubResolver) count() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.lookups
+}
+
+// stubSecretConfig is a secret config whose secret is its name
+func stubSecretConfig(name string, options map[string]string) (extension.SecretConfig, func(context.Context, string) ([]byte, error)) {
+	return extension.SecretConfig{Name: name, Options: options}, func(context.Context, string) ([]byte, error) {
+		return []byte(name), nil
+	}
+}
+
+// stubProviders returns the scoped providers of p for each config, in order, as the loader builds them
+func stubProviders(t *testing.T, p *Provider, configs ...map[string]string) []tq.SecretProvider {
+	var providers []tq.SecretProvider
+	for i, options := range configs {
+		sc, secret := stubSecretConfig(fmt.Sprintf("config-%d", i), options)
+		sp := p.New(context.Background(), sc, tq.HandlerFunc(func(tq.Response, tq.Request) {}), secret)
+		require.NotNil(t, sp)
+		providers = append(providers, sp)
+	}
+	return providers
+}
+
+// stubGet returns the secret of the first provider that matches ip, as the loader does
+func stubGet(providers []tq.SecretProvider, ip string) (string, error) {
+	var err error
+	for _, sp := range providers {
+		var secret []byte
+		secret, _, err = sp.Get(context.Background(), &net.TCPAddr{IP: net.ParseIP(ip), Port: 49})
+		if err == nil && secret != nil {
+			return string(secret), nil
+		}
+	}
+	return "", err
+}
+
+func TestDNSHostnameMatch(t *testing.T) {
+	r := &stubResolver{names: map[string][]string{
+		"192.0.2.1":   {"R1.Edge.Example.com."},
+		"192.0.2.2":   {"core1.example.com."},
+		"2001:db8::1": {"lab1.example.net."},
+	}}
+	providers := stubProviders(t, New(nopLogger{}, SetResolver(r)),
+		map[string]string{"hosts": `["core1.example.com."]`},
+		map[string]string{"hosts": `["*.edge.example.com"]`},
+		map[string]string{"hosts": `["lab?.example.net"]`},
+	)
+	for ip, want := range map[string]string{
+		"192.0.2.1":   "config-1",
+		"192.0.2.2":   "config-0",
+		"2001:db8::1": "config-2",
+	} {
+		secret, err := stubGet(providers, ip)
+		require.NoError(t, err, ip)
+		assert.Equal(t, want, secret, ip)
+	}
+
+	// every scoped provider shares the cache, so each remote is resolved once
+	lookups := r.count()
+	assert.Equal(t, 3, lookups)
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "2001:db8::1"} {
+		_, err := stubGet(providers, ip)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, lookups, r.count())
+}
+
+func TestDNSFallback(t *testing.T) {
+	r := &stubResolver{names: map[string][]string{"192.0.2.1": {"r1.edge.example.com."}}}
+	providers := stubProviders(t, New(nopLogger{}, SetResolver(r)),
+		map[string]string{"hosts": `["*.edge.example.com"]`, "fallback_prefixes": `["198.51.100.0/24"]`},
+		map[string]string{"hosts": `["*.core.example.com"]`},
+	)
+	// a remote that cannot be resolved is matched by ip
+	secret, err := stubGet(providers, "198.51.100.7")
+	require.NoError(t, err)
+	assert.Equal(t, "config-0", secret)
+	// and fails closed outside of the fallback prefixes
+	_, err = stubGet(providers, "203.0.113.7")
+	var dnsErr *net.DNSError
+	assert.ErrorAs(t, err, &dnsErr)
+	// a remote that resolves does not fall back, even within the prefixes
+	r.names["198.51.100.8"] = []string{"r8.lab.example.com."}
+	_, err = stubGet(providers, "198.51.100.8")
+	assert.Error(t, err)
+}
+
+func TestDNSLookupTimeout(t *testing.T) {
+	r := &stubResolver{block: true}
+	providers := stubProviders(t, New(nopLogger{}, SetResolver(r), SetLookupTimeout(10*time.Millisecond), SetLookupCache(time.Minute, time.Minute)),
+		map[string]string{"hosts": `["*.edge.example.com"]`, "fallback_prefixes": `["192.0.2.0/24"]`},
+	)
+	start := time.Now()
+	secret, err := stubGet(providers, "192.0.2.1")
+	require.NoError(t, err)
+	assert.Equal(t, "config-0", secret)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// the failure is cached, so a dead resolver is not waited on again
+	_, err = stubGet(providers, "192.0.2.1")
+	require.NoError(t, err)
+	assert.Equal(t, 1, r.count())
+}
+
+func TestLookupCache(t *testing.T) {
+	now := time.Now()
+	c := newLookupCache(time.Minute, time.Second)
+	c.set("192.0.2.1", []string{"r1.example.com."}, nil, now)
+	c.set("192.0.2.2", nil, fmt.Errorf("no such host"), now)
+
+	names, err, ok := c.get("192.0.2.1", now.Add(30*time.Second))
+	assert.True(t, ok)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"r1.example.com."}, names)
+	_, err, ok = c.get("192.0.2.2", now.Add(500*time.Millisecond))
+	assert.True(t, ok)
+	assert.Error(t, err)
+
+	// failures expire sooner
+	_, _, ok = c.get("192.0.2.2", now.Add(2*time.Second))
+	assert.False(t, ok)
+	_, _, ok = c.get("192.0.2.1", now.Add(time.Minute))
+	assert.False(t, ok)
+
+	// a ttl of zero disables caching
+	c = newLookupCache(0, 0)
+	c.set("192.0.2.1", []string{"r1.example.com."}, nil, now)
+	_, _, ok = c.get("192.0.2.1", now)
+	assert.False(t, ok)
+}
+
+// reuseHandler is a handler that implements tq.SessionReusePolicy
+type reuseHandler struct {
+	tq.HandlerFunc
+	reuse bool
+}
+
+func (h reuseHandler) ImplicitSessionReuse() (bool, bool) { return h.reuse, true }
+
+// TestGetReturnsHandlerPolicy asserts the handler given to New is returned by Get as is, so the
+// policies it implements are seen by the server
+func TestGetReturnsHandlerPolicy(t *testing.T) {
+	r := &stubResolver{names: map[string][]string{"10.1.2.3": {"switch1.example.com."}}}
+	p := New(nopLogger{}, SetResolver(r))
+	for _, reuse := range []bool{true, false} {
+		handler := reuseHandler{HandlerFunc: func(tq.Response, tq.Request) {}, reuse: reuse}
+		sc, secret := stubSecretConfig("dns", map[string]string{"hosts": `["switch1.example.com"]`})
+		sp := p.New(context.Background(), sc, handler, secret)
+		require.NotNil(t, sp)
+
+		_, h, err := sp.Get(context.Background(), &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 49})
+		require.NoError(t, err)
+		policy, ok := h.(tq.SessionReusePolicy)
+		require.True(t, ok, "handler policy is hidden by the provider")
+		v, set := policy.ImplicitSessionReuse()
+		assert.True(t, set)
+		assert.Equal(t, reuse, v)
+	}
+}
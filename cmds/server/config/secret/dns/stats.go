@@ -23,6 +23,16 @@ var (
 		Name:      "secret_provider_dns_get_error",
 		Help:      "the number of errors encountered when resolving dns",
 	})
+	dnsCacheHit = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "tacquito",
+		Name:      "secret_provider_dns_cache_hit",
+		Help:      "number of remotes whose names, or failure to resolve, were found in the cache",
+	})
+	dnsFallback = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "tacquito",
+		Name:      "secret_provider_dns_fallback",
+		Help:      "number of remotes that could not be resolved and matched a fallback prefix instead",
+	})
 	// durations
 	dnsDurations = prometheus.NewSummary(
 		prometheus.SummaryOpts{
@@ -38,6 +48,8 @@ func init() {
 	// gauges and counters
 	prometheus.MustRegister(dnsGetMatch)
 	prometheus.MustRegister(dnsError)
+	prometheus.MustRegister(dnsCacheHit)
+	prometheus.MustRegister(dnsFallback)
 	// durations
 	prometheus.MustRegister(dnsDurations)
 }
@@ -0,0 +1,117 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+// Package env provides pre-shared keys from environment variables, so they need not be stored in
+// config files.  The key for a device group is read from TACACS_SECRET_<GROUP>, where GROUP is the
+// keychain group of its SecretConfig in upper case, with anything but letters and digits replaced
+// by an underscore.
+package env
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/facebookincubator/tacquito/cmds/server/config"
+)
+
+// Prefix is the prefix of every secret environment variable
+const Prefix = "TACACS_SECRET_"
+
+// DefaultMinLength is the shortest secret accepted unless SetMinLength is used
+const DefaultMinLength = 16
+
+// Option is the setter type for Keychain
+type Option func(k *Keychain)
+
+// SetMinLength sets the shortest secret that is accepted
+func SetMinLength(v int) Option {
+	return func(k *Keychain) {
+		k.minLength = v
+	}
+}
+
+// SetEnviron sets the source of the environment, os.Environ by default
+func SetEnviron(fn func() []string) Option {
+	return func(k *Keychain) {
+		k.environ = fn
+	}
+}
+
+// Name returns the environment variable that holds the secret of group
+func Name(group string) string {
+	return Prefix + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, group)
+}
+
+// New reads every secret from the environment and validates them.  An error naming each
+// variable that is empty or too short is returned, so a misconfigured server fails at start up
+// rather than on the first connection.  The variables the config references are checked with
+// Validate once it is loaded.
+func New(opts ...Option) (*Keychain, error) {
+	k := &Keychain{minLength: DefaultMinLength, environ: os.Environ, secrets: make(map[string][]byte)}
+	for _, opt := range opts {
+		opt(k)
+	}
+	var invalid []string
+	for _, kv := range k.environ() {
+		name, value, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(name, Prefix) {
+			continue
+		}
+		if len(value) < k.minLength {
+			// never include the value, it is a secret even when it is a bad one
+			invalid = append(invalid, fmt.Sprintf("%v has [%v] characters, at least [%v] are required", name, len(value), k.minLength))
+			continue
+		}
+		k.secrets[name] = []byte(value)
+	}
+	if len(invalid) > 0 {
+		sort.Strings(invalid)
+		return nil, fmt.Errorf("invalid secrets in environment; %v", strings.Join(invalid, "; "))
+	}
+	if len(k.secrets) == 0 {
+		return nil, fmt.Errorf("no secrets found in environment, expected variables named %v<GROUP>", Prefix)
+	}
+	return k, nil
+}
+
+// Keychain provides pre-shared keys read from the environment at start up
+type Keychain struct {
+	minLength int
+	environ   func() []string
+	secrets   map[string][]byte
+}
+
+// Validate returns an error naming the variable of the group of kc if it was not set
+func (k *Keychain) Validate(kc config.Keychain) error {
+	if name := Name(kc.Group); k.secrets[name] == nil {
+		return fmt.Errorf("no secret for group [%v], set %v", kc.Group, name)
+	}
+	return nil
+}
+
+// Add returns the pre-shared tacacs key for the group of kc
+func (k *Keychain) Add(kc config.Keychain) func(context.Context, string) ([]byte, error) {
+	name := Name(kc.Group)
+	secret, ok := k.secrets[name]
+	return func(ctx context.Context, username string) ([]byte, error) {
+		if !ok {
+			return nil, fmt.Errorf("no secret for group [%v], set %v", kc.Group, name)
+		}
+		return secret, nil
+	}
+}
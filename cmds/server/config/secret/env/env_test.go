@@ -0,0 +1,77 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package env
+
+import (
+	"context"
+	"testing"
+
+	"github.com/facebookincubator/tacquito/cmds/server/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeychainPerGroup(t *testing.T) {
+	t.Setenv("TACACS_SECRET_CORE_ROUTERS", "core-secret-0123456789")
+	t.Setenv("TACACS_SECRET_EDGE", "edge-secret-0123456789")
+
+	k, err := New()
+	assert.NoError(t, err)
+	for group, want := range map[string]string{
+		"core-routers": "core-secret-0123456789",
+		"edge":         "edge-secret-0123456789",
+	} {
+		secret, err := k.Add(config.Keychain{Group: group})(context.Background(), "")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(want), secret)
+	}
+
+	_, err = k.Add(config.Keychain{Group: "lab"})(context.Background(), "")
+	assert.EqualError(t, err, "no secret for group [lab], set TACACS_SECRET_LAB")
+}
+
+func TestKeychainValidate(t *testing.T) {
+	k, err := New(SetEnviron(func() []string { return []string{"TACACS_SECRET_EDGE=edge-secret-0123456789"} }))
+	assert.NoError(t, err)
+	assert.NoError(t, k.Validate(config.Keychain{Group: "edge"}))
+	assert.EqualError(t, k.Validate(config.Keychain{Group: "lab"}), "no secret for group [lab], set TACACS_SECRET_LAB")
+}
+
+func TestKeychainInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		environ []string
+		err     string
+	}{
+		{
+			name:    "empty",
+			environ: []string{"TACACS_SECRET_EDGE=", "TACACS_SECRET_CORE=core-secret-0123456789"},
+			err:     "invalid secrets in environment; TACACS_SECRET_EDGE has [0] characters, at least [16] are required",
+		},
+		{
+			name:    "short",
+			environ: []string{"TACACS_SECRET_EDGE=fooman"},
+			err:     "invalid secrets in environment; TACACS_SECRET_EDGE has [6] characters, at least [16] are required",
+		},
+		{
+			name:    "none",
+			environ: []string{"HOME=/root"},
+			err:     "no secrets found in environment, expected variables named TACACS_SECRET_<GROUP>",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			environ := test.environ
+			_, err := New(SetEnviron(func() []string { return environ }))
+			assert.EqualError(t, err, test.err)
+		})
+	}
+
+	// the minimum is configurable
+	_, err := New(SetMinLength(6), SetEnviron(func() []string { return []string{"TACACS_SECRET_EDGE=fooman"} }))
+	assert.NoError(t, err)
+}
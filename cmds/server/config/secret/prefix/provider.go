@@ -14,7 +14,7 @@ import (
 	"net"
 
 	tq "github.com/facebookincubator/tacquito"
-	"github.com/facebookincubator/tacquito/cmds/server/config"
+	"github.com/facebookincubator/tacquito/extension"
 )
 
 // loggerProvider provides the logging implementation
@@ -68,7 +68,7 @@ type Provider struct {
 }
 
 // New returns a scoped Provider for a given set of users.
-func (p *Provider) New(ctx context.Context, provider config.SecretConfig, handler tq.Handler, secret func(context.Context, string) ([]byte, error)) tq.SecretProvider {
+func (p *Provider) New(ctx context.Context, provider extension.SecretConfig, handler tq.Handler, secret func(context.Context, string) ([]byte, error)) tq.SecretProvider {
 	var prefixes []string
 	raw := provider.Options["prefixes"]
 	if err := json.Unmarshal([]byte(raw), &prefixes); err != nil {
@@ -89,7 +89,9 @@ func (p *Provider) New(ctx context.Context, provider config.SecretConfig, handle
 	)
 }
 
-// Get returns a tq SecretProvider interface and or error
+// Get returns a tq SecretProvider interface and or error.  The loader asks its providers in config
+// order and the first that holds the device serves it, unlike tq.NewPrefixSecretProvider which
+// serves the longest prefix.
 func (p *Provider) Get(ctx context.Context, remote net.Addr) ([]byte, tq.Handler, error) {
 	addr, ok := remote.(*net.TCPAddr)
 	if !ok {
@@ -104,7 +106,9 @@ func (p *Provider) Get(ctx context.Context, remote net.Addr) ([]byte, tq.Handler
 		if ipNet.Contains(addr.IP) {
 			p.Debugf(ctx, "prefix secret provider matches remote [%v] against prefix [%v]", addr.IP.String(), cidr)
 			secret, err := c.secret(ctx, addr.IP.String())
-			return secret, c, err
+			// the handler itself is returned so the policies it implements, eg tq.SessionReusePolicy,
+			// are seen by the server
+			return secret, c.Handler, err
 		}
 	}
 	return nil, nil, fmt.Errorf("no matching prefix secret provider found")
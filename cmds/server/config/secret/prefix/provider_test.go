@@ -0,0 +1,57 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package prefix
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	tq "github.com/facebookincubator/tacquito"
+	"github.com/facebookincubator/tacquito/extension"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type nopLogger struct{}
+
+func (nopLogger) Infof(ctx context.Context, format string, args ...interface{})      {}
+func (nopLogger) Errorf(ctx context.Context, format string, args ...interface{})     {}
+func (nopLogger) Debugf(ctx context.Context, format string, args ...interface{})     {}
+func (nopLogger) Record(ctx context.Context, r map[string]string, obscure ...string) {}
+
+// reuseHandler is a handler that implements tq.SessionReusePolicy
+type reuseHandler struct {
+	tq.HandlerFunc
+	reuse bool
+}
+
+func (h reuseHandler) ImplicitSessionReuse() (bool, bool) { return h.reuse, true }
+
+// TestGetReturnsHandlerPolicy asserts the handler given to New is returned by Get as is, so the
+// policies it implements are seen by the server
+func TestGetReturnsHandlerPolicy(t *testing.T) {
+	for _, reuse := range []bool{true, false} {
+		handler := reuseHandler{HandlerFunc: func(tq.Response, tq.Request) {}, reuse: reuse}
+		sc := extension.SecretConfig{Name: "prefix", Options: map[string]string{"prefixes": `["10.0.0.0/8"]`}}
+		sp := New(nopLogger{}).New(context.Background(), sc, handler, func(context.Context, string) ([]byte, error) {
+			return []byte("fooman"), nil
+		})
+		require.NotNil(t, sp)
+
+		secret, h, err := sp.Get(context.Background(), &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 49})
+		require.NoError(t, err)
+		assert.Equal(t, []byte("fooman"), secret)
+		policy, ok := h.(tq.SessionReusePolicy)
+		require.True(t, ok, "handler policy is hidden by the provider")
+		v, set := policy.ImplicitSessionReuse()
+		assert.True(t, set)
+		assert.Equal(t, reuse, v)
+	}
+}
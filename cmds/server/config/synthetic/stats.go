@@ -0,0 +1,24 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package synthetic
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	syntheticDenied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tacquito",
+		Name:      "synthetic_denied",
+		Help:      "number of synthetic user requests denied by their constraints, by packet type",
+	}, []string{"type"})
+)
+
+func init() {
+	prometheus.MustRegister(syntheticDenied)
+}
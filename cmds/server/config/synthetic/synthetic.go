@@ -0,0 +1,184 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+// Package synthetic constrains the users that readiness probes and interop suites log in with.
+// A synthetic user may only be used from its probe source prefixes, at a privilege level no higher
+// than 1, and is only ever authorized for a no-op service.
+package synthetic
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	tq "github.com/facebookincubator/tacquito"
+)
+
+// loggerProvider provides the logging implementation for local server events
+type loggerProvider interface {
+	Errorf(ctx context.Context, format string, args ...interface{})
+}
+
+// recorder is implemented by loggers that keep audit records
+type recorder interface {
+	Record(ctx context.Context, r map[string]string, obscure ...string)
+}
+
+// Service is the only service a synthetic user is authorized for.  It sets no attributes.
+const Service = "tacquito-probe"
+
+// MaxPrivLvl is the highest privilege level a synthetic user may request
+const MaxPrivLvl = tq.PrivLvlUser
+
+// DefaultSources are the probe source prefixes of a synthetic user that has none configured
+var DefaultSources = []string{"127.0.0.0/8", "::1/128"}
+
+// New returns the Constraint for a synthetic user that may only be used from sources.  If sources
+// is empty, DefaultSources is used.
+func New(l loggerProvider, sources []string) (*Constraint, error) {
+	if len(sources) == 0 {
+		sources = DefaultSources
+	}
+	c := &Constraint{loggerProvider: l}
+	for _, s := range sources {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("bad probe source prefix [%v]; %w", s, err)
+		}
+		c.sources = append(c.sources, ipNet)
+	}
+	return c, nil
+}
+
+// Constraint wraps the handlers of a synthetic user
+type Constraint struct {
+	loggerProvider
+	sources []*net.IPNet
+}
+
+// allowed reports if the request came from a probe source prefix.  The source is the device, past any
+// proxy, and a request without one is not allowed.
+func (c *Constraint) allowed(request tq.Request) bool {
+	if request.Context == nil {
+		return false
+	}
+	v, _ := request.Context.Value(tq.ContextConnRemoteAddr).(string)
+	ip := net.ParseIP(strings.Trim(v, "[]"))
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range c.sources {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// deny returns the cause to deny a request at priv-lvl lvl with, or an empty cause if it is allowed.
+// service is false for requests outside the services a synthetic user may use.
+func (c *Constraint) deny(request tq.Request, lvl tq.PrivLvl, service bool) tq.DenialCause {
+	if !c.allowed(request) {
+		return tq.DenialSourceConstraint
+	}
+	if lvl > MaxPrivLvl || !service {
+		return tq.DenialPolicy
+	}
+	return ""
+}
+
+// record marks the audit record of the request as synthetic
+func (c *Constraint) record(request tq.Request, obscure ...string) {
+	r, ok := c.loggerProvider.(recorder)
+	if !ok {
+		return
+	}
+	fields := request.Fields(tq.ContextConnRemoteAddr, tq.ContextEventTime, tq.ContextReceiveOffset)
+	fields["synthetic"] = "true"
+	r.Record(request.Context, fields, obscure...)
+}
+
+// exemptKey marks the requests of a synthetic user, see Exempt
+type exemptKey struct{}
+
+// Exempt reports if the request of ctx is that of a synthetic user.  Probes fail on purpose, so any
+// lockout of users after repeated failures must skip the requests it is true for.
+func Exempt(ctx context.Context) bool {
+	v, _ := ctx.Value(exemptKey{}).(bool)
+	return v
+}
+
+// Authenticator wraps the authenticator of a synthetic user.  Every packet of the session is checked,
+// including the continue packets of ascii logins, and those that carry a priv-lvl are checked against
+// MaxPrivLvl.
+func (c *Constraint) Authenticator(next tq.Handler) tq.Handler {
+	return tq.HandlerFunc(func(response tq.Response, request tq.Request) {
+		c.record(request, "data", "user-msg")
+		var lvl tq.PrivLvl
+		var body tq.AuthenStart
+		if err := tq.Unmarshal(request.Body, &body); err == nil {
+			lvl = body.PrivLvl
+		}
+		if cause := c.deny(request, lvl, true); cause != "" {
+			syntheticDenied.WithLabelValues("authenticate").Inc()
+			c.Errorf(request.Context, "[%v] synthetic user denied from [%v] at priv-lvl [%v]", request.Header.SessionID, request.Context.Value(tq.ContextConnRemoteAddr), lvl)
+			response.Reply(tq.NewDenial(tq.Authenticate, cause, ""))
+			return
+		}
+		request.Context = context.WithValue(request.Context, exemptKey{}, true)
+		next.Handle(&constrainedResponse{Response: response, c: c}, request)
+	})
+}
+
+// constrainedResponse checks the packets that continue the session of a synthetic user
+type constrainedResponse struct {
+	tq.Response
+	c *Constraint
+}
+
+// Next wraps next so the packet it handles is checked too
+func (r *constrainedResponse) Next(next tq.Handler) {
+	r.Response.Next(r.c.Authenticator(next))
+}
+
+// Authorizer returns the authorizer of a synthetic user.  It replaces any configured authorizer and
+// only passes requests for Service, without adding any attributes.
+func (c *Constraint) Authorizer() tq.Handler {
+	return tq.HandlerFunc(func(response tq.Response, request tq.Request) {
+		c.record(request)
+		var body tq.AuthorRequest
+		if err := tq.Unmarshal(request.Body, &body); err != nil {
+			response.Reply(
+				tq.NewAuthorReply(
+					tq.SetAuthorReplyStatus(tq.AuthorStatusError),
+					tq.SetAuthorReplyServerMsg("unable to decode authorization request"),
+				),
+			)
+			return
+		}
+		if cause := c.deny(request, body.PrivLvl, body.Args.Service() == Service); cause != "" {
+			syntheticDenied.WithLabelValues("authorize").Inc()
+			response.Reply(tq.NewDenial(tq.Authorize, cause, ""))
+			return
+		}
+		response.Reply(tq.NewAuthorReply(tq.SetAuthorReplyStatus(tq.AuthorStatusPassAdd)))
+	})
+}
+
+// Accounter wraps the accounter of a synthetic user
+func (c *Constraint) Accounter(next tq.Handler) tq.Handler {
+	return tq.HandlerFunc(func(response tq.Response, request tq.Request) {
+		c.record(request)
+		if !c.allowed(request) {
+			syntheticDenied.WithLabelValues("accounting").Inc()
+			response.Reply(tq.NewDenial(tq.Accounting, tq.DenialSourceConstraint, ""))
+			return
+		}
+		next.Handle(response, request)
+	})
+}
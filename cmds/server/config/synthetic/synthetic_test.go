@@ -0,0 +1,254 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package synthetic
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	tq "github.com/facebookincubator/tacquito"
+	"github.com/facebookincubator/tacquito/cmds/server/config"
+	"github.com/facebookincubator/tacquito/cmds/server/handlers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordLogger struct {
+	records []map[string]string
+}
+
+func (*recordLogger) Errorf(ctx context.Context, format string, args ...interface{}) {}
+func (*recordLogger) Infof(ctx context.Context, format string, args ...interface{})  {}
+func (*recordLogger) Debugf(ctx context.Context, format string, args ...interface{}) {}
+func (l *recordLogger) Record(ctx context.Context, r map[string]string, obscure ...string) {
+	l.records = append(l.records, r)
+}
+
+// replyResponse keeps the last reply and next handler, rendering denials as the server does
+type replyResponse struct {
+	reply tq.EncoderDecoder
+	cause tq.DenialCause
+	next  tq.Handler
+}
+
+func (r *replyResponse) Reply(v tq.EncoderDecoder) (int, error) {
+	if d, ok := v.(*tq.Denial); ok {
+		r.cause = d.Cause
+		v = d.Reply(tq.DefaultMessageProfile)
+	}
+	r.reply = v
+	return 0, nil
+}
+func (r *replyResponse) Write(p *tq.Packet) (int, error) { return 0, nil }
+func (r *replyResponse) Next(next tq.Handler)            { r.next = next }
+func (r *replyResponse) RegisterWriter(io.Writer)        {}
+
+func request(t *testing.T, source string, ht tq.HeaderType, body tq.EncoderDecoder) tq.Request {
+	b, err := body.MarshalBinary()
+	assert.NoError(t, err)
+	return tq.Request{
+		Header:  *tq.NewHeader(tq.SetHeaderType(ht), tq.SetHeaderSeqNo(1), tq.SetHeaderSessionID(1)),
+		Body:    b,
+		Context: context.WithValue(context.Background(), tq.ContextConnRemoteAddr, source),
+	}
+}
+
+func authenStart(lvl tq.PrivLvl) *tq.AuthenStart {
+	return tq.NewAuthenStart(
+		tq.SetAuthenStartAction(tq.AuthenActionLogin),
+		tq.SetAuthenStartPrivLvl(lvl),
+		tq.SetAuthenStartType(tq.AuthenTypePAP),
+		tq.SetAuthenStartService(tq.AuthenServiceLogin),
+		tq.SetAuthenStartUser("probe"),
+		tq.SetAuthenStartData("probe"),
+	)
+}
+
+func TestAuthenticatorSources(t *testing.T) {
+	l := &recordLogger{}
+	c, err := New(l, []string{"192.0.2.0/24"})
+	assert.NoError(t, err)
+	var called int
+	h := c.Authenticator(tq.HandlerFunc(func(response tq.Response, request tq.Request) { called++ }))
+
+	tests := []struct {
+		name   string
+		source string
+		lvl    tq.PrivLvl
+		called bool
+		cause  tq.DenialCause
+	}{
+		{name: "probe prefix", source: "192.0.2.7", lvl: tq.PrivLvlUser, called: true},
+		{name: "non probe prefix", source: "198.51.100.7", lvl: tq.PrivLvlUser, cause: tq.DenialSourceConstraint},
+		{name: "loopback is not a probe prefix", source: "[::1]", lvl: tq.PrivLvlUser, cause: tq.DenialSourceConstraint},
+		{name: "priv-lvl above max", source: "192.0.2.7", lvl: tq.PrivLvlRoot, cause: tq.DenialPolicy},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			before := called
+			resp := &replyResponse{}
+			h.Handle(resp, request(t, test.source, tq.Authenticate, authenStart(test.lvl)))
+			assert.Equal(t, test.called, called > before)
+			if !test.called {
+				reply, ok := resp.reply.(*tq.AuthenReply)
+				assert.True(t, ok)
+				assert.Equal(t, tq.AuthenStatusFail, reply.Status)
+				assert.Equal(t, test.cause, resp.cause)
+			}
+		})
+	}
+	assert.Len(t, l.records, len(tests))
+	for _, r := range l.records {
+		assert.Equal(t, "true", r["synthetic"])
+	}
+}
+
+func TestDefaultSources(t *testing.T) {
+	c, err := New(&recordLogger{}, nil)
+	assert.NoError(t, err)
+	var called bool
+	h := c.Authenticator(tq.HandlerFunc(func(response tq.Response, request tq.Request) { called = true }))
+	h.Handle(&replyResponse{}, request(t, "[::1]", tq.Authenticate, authenStart(tq.PrivLvlUser)))
+	assert.True(t, called)
+
+	_, err = New(&recordLogger{}, []string{"not a prefix"})
+	assert.Error(t, err)
+}
+
+func TestAuthorizer(t *testing.T) {
+	c, err := New(&recordLogger{}, nil)
+	assert.NoError(t, err)
+	h := c.Authorizer()
+
+	tests := []struct {
+		name   string
+		source string
+		args   tq.Args
+		status tq.AuthorStatus
+	}{
+		{name: "probe service", source: "127.0.0.1", args: tq.Args{"service=" + Service}, status: tq.AuthorStatusPassAdd},
+		{name: "shell", source: "127.0.0.1", args: tq.Args{"service=shell", "cmd=show"}, status: tq.AuthorStatusFail},
+		{name: "non probe prefix", source: "198.51.100.7", args: tq.Args{"service=" + Service}, status: tq.AuthorStatusFail},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := &replyResponse{}
+			h.Handle(resp, request(t, test.source, tq.Authorize, tq.NewAuthorRequest(
+				tq.SetAuthorRequestMethod(tq.AuthenMethodTacacsPlus),
+				tq.SetAuthorRequestPrivLvl(tq.PrivLvlUser),
+				tq.SetAuthorRequestType(tq.AuthenTypeASCII),
+				tq.SetAuthorRequestService(tq.AuthenServiceLogin),
+				tq.SetAuthorRequestUser("probe"),
+				tq.SetAuthorRequestArgs(test.args),
+			)))
+			reply, ok := resp.reply.(*tq.AuthorReply)
+			assert.True(t, ok)
+			assert.Equal(t, test.status, reply.Status)
+			assert.Empty(t, reply.Args)
+		})
+	}
+}
+
+// users is the config of a single synthetic user
+type users map[string]*config.AAA
+
+func (u users) GetUser(user string) *config.AAA { return u[user] }
+
+func TestAuthenticatorASCII(t *testing.T) {
+	// an ascii login names its user and password in continue packets, the constraint still applies
+	for _, test := range []struct {
+		name   string
+		source string
+		called bool
+	}{
+		{name: "probe prefix", source: "192.0.2.7", called: true},
+		{name: "non probe prefix", source: "198.51.100.7"},
+		{name: "no source", source: ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			l := &recordLogger{}
+			c, err := New(l, []string{"192.0.2.0/24"})
+			require.NoError(t, err)
+			var called bool
+			authenticator := c.Authenticator(tq.HandlerFunc(func(response tq.Response, request tq.Request) {
+				called = true
+				assert.True(t, Exempt(request.Context))
+				response.Reply(tq.NewAuthenReply(tq.SetAuthenReplyStatus(tq.AuthenStatusPass)))
+			}))
+			start := handlers.NewAuthenticateStart(l, users{"probe": config.NewAAA(config.SetAAAAuthenticator(authenticator))})
+
+			resp := &replyResponse{}
+			login := tq.NewAuthenStart(
+				tq.SetAuthenStartAction(tq.AuthenActionLogin),
+				tq.SetAuthenStartPrivLvl(tq.PrivLvlUser),
+				tq.SetAuthenStartType(tq.AuthenTypeASCII),
+				tq.SetAuthenStartService(tq.AuthenServiceLogin),
+			)
+			start.Handle(resp, request(t, test.source, tq.Authenticate, login))
+			for _, msg := range []string{"probe", "secret"} {
+				require.NotNil(t, resp.next)
+				next := resp.next
+				resp.next = nil
+				next.Handle(resp, request(t, test.source, tq.Authenticate, tq.NewAuthenContinue(tq.SetAuthenContinueUserMessage(tq.AuthenUserMessage(msg)))))
+			}
+			assert.Equal(t, test.called, called)
+			reply, ok := resp.reply.(*tq.AuthenReply)
+			require.True(t, ok)
+			if test.called {
+				assert.Equal(t, tq.AuthenStatusPass, reply.Status)
+				return
+			}
+			assert.Equal(t, tq.AuthenStatusFail, reply.Status)
+			assert.Equal(t, tq.DenialSourceConstraint, resp.cause)
+		})
+	}
+}
+
+func TestAuthenticatorCHAP(t *testing.T) {
+	c, err := New(&recordLogger{}, []string{"192.0.2.0/24"})
+	require.NoError(t, err)
+	var called int
+	h := c.Authenticator(tq.HandlerFunc(func(response tq.Response, request tq.Request) { called++ }))
+	chap := func(lvl tq.PrivLvl) *tq.AuthenStart {
+		return tq.NewAuthenStart(
+			tq.SetAuthenStartAction(tq.AuthenActionLogin),
+			tq.SetAuthenStartPrivLvl(lvl),
+			tq.SetAuthenStartType(tq.AuthenTypeCHAP),
+			tq.SetAuthenStartService(tq.AuthenServiceLogin),
+			tq.SetAuthenStartUser("probe"),
+			tq.SetAuthenStartData("\x01challengeresponse"),
+		)
+	}
+	h.Handle(&replyResponse{}, request(t, "192.0.2.7", tq.Authenticate, chap(tq.PrivLvlUser)))
+	assert.Equal(t, 1, called)
+	resp := &replyResponse{}
+	h.Handle(resp, request(t, "198.51.100.7", tq.Authenticate, chap(tq.PrivLvlUser)))
+	assert.Equal(t, tq.DenialSourceConstraint, resp.cause)
+	resp = &replyResponse{}
+	h.Handle(resp, request(t, "192.0.2.7", tq.Authenticate, chap(tq.PrivLvlRoot)))
+	assert.Equal(t, tq.DenialPolicy, resp.cause)
+	assert.Equal(t, 1, called)
+}
+
+func TestAuthenticatorContinued(t *testing.T) {
+	// a session the wrapped authenticator continues is checked on each of its packets
+	c, err := New(&recordLogger{}, []string{"192.0.2.0/24"})
+	require.NoError(t, err)
+	var continued bool
+	h := c.Authenticator(tq.HandlerFunc(func(response tq.Response, request tq.Request) {
+		response.Next(tq.HandlerFunc(func(response tq.Response, request tq.Request) { continued = true }))
+		response.Reply(tq.NewAuthenReply(tq.SetAuthenReplyStatus(tq.AuthenStatusGetData)))
+	}))
+	resp := &replyResponse{}
+	h.Handle(resp, request(t, "192.0.2.7", tq.Authenticate, authenStart(tq.PrivLvlUser)))
+	require.NotNil(t, resp.next)
+	resp.next.Handle(resp, request(t, "198.51.100.7", tq.Authenticate, tq.NewAuthenContinue(tq.SetAuthenContinueUserMessage("data"))))
+	assert.False(t, continued)
+	assert.Equal(t, tq.DenialSourceConstraint, resp.cause)
+}
@@ -52,6 +52,10 @@ type User struct {
 	Commands      []Command      `yaml:"commands,omitempty" json:"commands,omitempty"`
 	Authenticator *Authenticator `yaml:"authenticator,omitempty" json:"authenticator,omitempty"`
 	Accounter     *Accounter     `yaml:"accounter,omitempty" json:"accounter,omitempty"`
+	// Synthetic marks a throwaway user for probes and interop tests.  It is constrained to the
+	// Sources prefixes, which default to loopback, see package synthetic.
+	Synthetic bool     `yaml:"synthetic,omitempty" json:"synthetic,omitempty"`
+	Sources   []string `yaml:"sources,omitempty" json:"sources,omitempty"`
 }
 
 // HasScope returns bool if scope is found to be bound to this user
@@ -137,6 +141,9 @@ type Service struct {
 	Match     []Value `yaml:"match,omitempty" json:"match,omitempty"`
 	SetValues []Value `yaml:"set_values,omitempty" json:"set_values,omitempty"`
 	Optional  bool    `yaml:"is_optional" json:"is_optional"`
+	// When, if set, is an expression the request must also satisfy for the service to apply, see
+	// the stringy authorizer
+	When string `yaml:"when,omitempty" json:"when,omitempty"`
 }
 
 // TrimSpace removes all leading and trailing white space removed, as defined by Unicode.
@@ -192,6 +199,9 @@ type Command struct {
 	Name   string   `yaml:"name" json:"name"`
 	Match  []string `yaml:"match,omitempty" json:"match,omitempty"`
 	Action Action   `yaml:"action" json:"action"`
+	// When, if set, is an expression the request must also satisfy for the command to apply, see
+	// the stringy authorizer
+	When string `yaml:"when,omitempty" json:"when,omitempty"`
 }
 
 // TrimSpace removes all leading and trailing white space removed, as defined by Unicode.
@@ -245,6 +255,15 @@ type SecretConfig struct {
 	Handler Handler           `yaml:"handler" json:"handler"`
 	Type    ProviderType      `yaml:"type" json:"type"`
 	Options map[string]string `yaml:"options,omitempty" json:"options,omitempty"`
+	// Cutover lists the other secrets of the devices while they are moved to a new secret
+	Cutover []CutoverSecret `yaml:"cutover,omitempty" json:"cutover,omitempty"`
+}
+
+// CutoverSecret is a secret a SecretConfig serves alongside its Secret during a cutover.  Role is
+// the part it plays, next or retiring, see tq.SecretRole.
+type CutoverSecret struct {
+	Role   string   `yaml:"role" json:"role"`
+	Secret Keychain `yaml:"secret" json:"secret"`
 }
 
 // Handler instructs the server what handler to use for the given SecretConfig
@@ -8,11 +8,13 @@
 package exporter
 
 import (
+	"encoding/json"
 	"flag"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
 
+	tq "github.com/facebookincubator/tacquito"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
@@ -25,8 +27,72 @@ var (
 func StartPromHTTP() error {
 	if *exportPromHTTP {
 		http.Handle("/metrics", promhttp.Handler())
+		http.HandleFunc("/outcomes", outcomes)
 		log.Printf("starting prometheus http exporter, listening [%v]/metrics", *promExportAddress)
 		return http.ListenAndServe(*promExportAddress, nil)
 	}
 	return nil
 }
+
+// outcomes reports the reply success ratio of each packet type as json.  Types without a final
+// reply yet are omitted.
+func outcomes(w http.ResponseWriter, r *http.Request) {
+	ratios := make(map[string]float64)
+	for _, t := range []tq.HeaderType{tq.Authenticate, tq.Authorize, tq.Accounting} {
+		if v, ok := tq.ReplySuccessRatio(t); ok {
+			ratios[t.String()] = v
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ratios); err != nil {
+		log.Printf("unable to write outcomes; %v", err)
+	}
+}
+
+// shutdownReporter reports the progress of a server shutdown
+type shutdownReporter interface {
+	ShutdownProgress() tq.ShutdownProgress
+}
+
+// HandleShutdown reports the shutdown progress of s as json on /shutdown, for debugging a drain
+// that is stuck.  It may be called after StartPromHTTP.
+func HandleShutdown(s shutdownReporter) {
+	if !*exportPromHTTP {
+		return
+	}
+	http.HandleFunc("/shutdown", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(s.ShutdownProgress()); err != nil {
+			log.Printf("unable to write shutdown progress; %v", err)
+		}
+	})
+}
+
+// featureReporter reports the protocol features devices use
+type featureReporter interface {
+	Report() tq.FeatureReport
+}
+
+// HandleFeatures reports the feature usage of f as json on /features, for cleanup campaigns.  The
+// query parameter group limits the report to one device group.  It may be called after
+// StartPromHTTP.
+func HandleFeatures(f featureReporter) {
+	if !*exportPromHTTP {
+		return
+	}
+	http.HandleFunc("/features", featuresHandler(f))
+}
+
+// featuresHandler serves the report of f
+func featuresHandler(f featureReporter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := f.Report()
+		if group := r.URL.Query().Get("group"); group != "" {
+			report.Groups = map[string]tq.GroupFeatures{group: report.Groups[group]}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			log.Printf("unable to write feature usage; %v", err)
+		}
+	}
+}
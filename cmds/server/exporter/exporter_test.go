@@ -0,0 +1,42 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package exporter
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	tq "github.com/facebookincubator/tacquito"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFeaturesHandler(t *testing.T) {
+	tracker := tq.NewFeatureTracker(10)
+	tracker.Record("core", "192.0.2.1", tq.FeatureAuthenPAP, statusTime)
+	tracker.Record("legacy", "192.0.2.2", tq.FeatureUnencrypted, statusTime.Add(time.Minute))
+	h := featuresHandler(tracker)
+
+	r := httptest.NewRequest("GET", "/features", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var report tq.FeatureReport
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(t, tracker.Report(), report)
+
+	r = httptest.NewRequest("GET", "/features?group=legacy", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	report = tq.FeatureReport{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	require.Len(t, report.Groups, 1)
+	assert.Equal(t, tq.FeatureUsage{FirstSeen: statusTime.Add(time.Minute), LastSeen: statusTime.Add(time.Minute)}, report.Groups["legacy"].Devices["192.0.2.2"][tq.FeatureUnencrypted])
+}
@@ -0,0 +1,168 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package exporter
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	tq "github.com/facebookincubator/tacquito"
+	"github.com/facebookincubator/tacquito/cmds/server/config"
+	"github.com/facebookincubator/tacquito/cmds/server/config/authenticators/composite"
+	"github.com/facebookincubator/tacquito/cmds/server/loader"
+	"github.com/facebookincubator/tacquito/extension"
+)
+
+// serverStatus reports the live state of a server, see tq.Server.Status
+type serverStatus interface {
+	Status() tq.ServerStatus
+}
+
+// configStatus reports the config a loader applied, see loader.Loader.Status
+type configStatus interface {
+	Status() loader.Status
+}
+
+// backendHealth reports the health of composite backends, see composite.Authenticator.Health
+type backendHealth interface {
+	Health() []composite.BackendHealth
+}
+
+// BackendsOf returns the authenticators that report the health of their backends, such as a
+// composite.Authenticator, by type, for StatusSources.Backends
+func BackendsOf(authenticators map[config.AuthenticatorType]extension.AuthenticatorFactory) map[string]backendHealth {
+	backends := map[string]backendHealth{}
+	for t, a := range authenticators {
+		if b, ok := a.(backendHealth); ok {
+			backends[loader.AuthenticatorTypeName(t)] = b
+		}
+	}
+	return backends
+}
+
+// StatusSources are what the status page reports on.  Any of them may be left unset.
+type StatusSources struct {
+	Server serverStatus
+	Config configStatus
+	// Backends are the composite authenticators by name, see BackendsOf
+	Backends map[string]backendHealth
+}
+
+// Status is the status page.  Scripts read it as json, so fields are only ever added and never
+// renamed, and unset sources are null rather than left out.
+//
+// Redaction review: the page is served without authentication, so nothing in it may be secret.
+// Every field is a count, a time, a state or a name from config, never a value:
+//   - Server holds connection and session counts, maintenance and shutdown state, and close
+//     reasons.  It holds no addresses or usernames.
+//   - Config names each device group with its provider and handler type, and counts its prefixes
+//     and users.  Keychain references, options and the users themselves are left out.
+//   - Backends names each composite backend with its weight and health.
+//
+// A field added to any of these types must keep to the same rule.  TestStatusRedaction in the
+// loader checks it against a config full of secrets.
+type Status struct {
+	Generated time.Time                            `json:"generated"`
+	Server    *tq.ServerStatus                     `json:"server"`
+	Config    *loader.Status                       `json:"config"`
+	Backends  map[string][]composite.BackendHealth `json:"backends"`
+}
+
+// NewStatus builds the status page from src at now
+func NewStatus(src StatusSources, now time.Time) Status {
+	s := Status{Generated: now, Backends: map[string][]composite.BackendHealth{}}
+	if src.Server != nil {
+		v := src.Server.Status()
+		s.Server = &v
+	}
+	if src.Config != nil {
+		v := src.Config.Status()
+		s.Config = &v
+	}
+	for name, b := range src.Backends {
+		s.Backends[name] = b.Health()
+	}
+	return s
+}
+
+// HandleStatus serves the status page of src on /status.  Browsers, which accept text/html, are
+// served a page and everything else is served json.  It may be called after StartPromHTTP.
+func HandleStatus(src StatusSources) {
+	if !*exportPromHTTP {
+		return
+	}
+	http.Handle("/status", statusHandler(src))
+}
+
+// statusHandler serves the status page of src
+func statusHandler(src StatusSources) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := NewStatus(src, time.Now())
+		if strings.Contains(r.Header.Get("Accept"), "text/html") {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			if err := statusPage.Execute(w, s); err != nil {
+				log.Printf("unable to write status page; %v", err)
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(s); err != nil {
+			log.Printf("unable to write status; %v", err)
+		}
+	})
+}
+
+// statusPage renders a Status for browsers
+var statusPage = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head><title>tacquito status</title></head>
+<body>
+<h1>tacquito status</h1>
+<p>generated {{.Generated.Format "2006-01-02T15:04:05Z07:00"}}</p>
+{{with .Server}}
+<h2>server</h2>
+<table>
+<tr><td>uptime</td><td>{{.Uptime}}s</td></tr>
+<tr><td>connections</td><td>{{.Connections}}</td></tr>
+<tr><td>sessions</td><td>{{.Sessions}}</td></tr>
+<tr><td>maintenance</td><td>{{.Maintenance}} {{.MaintenanceDetail}}</td></tr>
+<tr><td>shutdown</td><td>{{.Shutdown}}</td></tr>
+</table>
+<h3>closed connections, last {{.RecentWindow}}s</h3>
+<table>
+{{range $reason, $n := .RecentCloses}}<tr><td>{{$reason}}</td><td>{{$n}}</td></tr>
+{{else}}<tr><td>none</td></tr>
+{{end}}</table>
+{{end}}
+{{with .Config}}
+<h2>config</h2>
+<table>
+<tr><td>applied</td><td>{{.Applied.Format "2006-01-02T15:04:05Z07:00"}} ({{.Applies}} times)</td></tr>
+<tr><td>last reload</td><td>{{with .LastReload}}{{.Format "2006-01-02T15:04:05Z07:00"}}{{else}}never{{end}} {{.LastReloadError}}</td></tr>
+<tr><td>prefix filters</td><td>{{.PrefixAllow}} allow, {{.PrefixDeny}} deny</td></tr>
+</table>
+<h3>device groups</h3>
+<table>
+<tr><th>name</th><th>type</th><th>handler</th><th>prefixes</th><th>users</th></tr>
+{{range .Groups}}<tr><td>{{.Name}}</td><td>{{.Type}}</td><td>{{.Handler}}</td><td>{{.Prefixes}}</td><td>{{.Users}}</td></tr>
+{{end}}</table>
+{{end}}
+{{if .Backends}}
+<h2>backends</h2>
+<table>
+<tr><th>authenticator</th><th>backend</th><th>weight</th><th>healthy</th></tr>
+{{range $name, $backends := .Backends}}{{range $backends}}<tr><td>{{$name}}</td><td>{{.Name}}</td><td>{{.Weight}}</td><td>{{if .Healthy}}yes{{else}}no, until {{.DownUntil.Format "2006-01-02T15:04:05Z07:00"}}{{end}}</td></tr>
+{{end}}{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
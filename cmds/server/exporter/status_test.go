@@ -0,0 +1,141 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package exporter
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	tq "github.com/facebookincubator/tacquito"
+	"github.com/facebookincubator/tacquito/cmds/server/config"
+	"github.com/facebookincubator/tacquito/cmds/server/config/authenticators/composite"
+	"github.com/facebookincubator/tacquito/cmds/server/loader"
+	"github.com/facebookincubator/tacquito/extension"
+	"github.com/stretchr/testify/assert"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden files in testdata")
+
+var (
+	statusTime   = time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	statusReload = statusTime.Add(-time.Minute)
+	statusDown   = statusTime.Add(30 * time.Second)
+)
+
+type fakeServer struct{}
+
+func (fakeServer) Status() tq.ServerStatus {
+	return tq.ServerStatus{
+		Uptime:                3600,
+		Connections:           12,
+		Sessions:              3,
+		Maintenance:           true,
+		MaintenanceDetail:     "retry in 5m",
+		Shutdown:              tq.ShutdownServing,
+		MaxConnectionLifetime: 900,
+		SecretGracePeriod:     60,
+		RecentWindow:          900,
+		RecentCloses:          map[string]int64{"bad-secret": 4, "idle-timeout": 7},
+	}
+}
+
+type fakeConfig struct{}
+
+func (fakeConfig) Status() loader.Status {
+	return loader.Status{
+		Applied:         statusTime.Add(-time.Hour),
+		Applies:         2,
+		LastReload:      &statusReload,
+		LastReloadError: "yaml: line 3: bad indentation",
+		PrefixAllow:     1,
+		PrefixDeny:      2,
+		Groups: []loader.GroupStatus{
+			{Name: "core", Type: "prefix", Handler: "start", Prefixes: 2, Users: 40},
+			{Name: "edge", Type: "dns", Handler: "span", Prefixes: 1, Users: 3},
+		},
+	}
+}
+
+type fakeBackends struct{}
+
+func (fakeBackends) Health() []composite.BackendHealth {
+	return []composite.BackendHealth{
+		{Name: "ldap-primary", Weight: 2, Healthy: true},
+		{Name: "ldap-secondary", Weight: 1, DownUntil: &statusDown},
+	}
+}
+
+// TestStatusSnapshot pins the json of a fully populated status page, which scripts depend on.  Run
+// with -update to accept a deliberate change.
+func TestStatusSnapshot(t *testing.T) {
+	s := NewStatus(StatusSources{
+		Server:   fakeServer{},
+		Config:   fakeConfig{},
+		Backends: map[string]backendHealth{"ldap": fakeBackends{}},
+	}, statusTime)
+	got, err := json.MarshalIndent(s, "", "  ")
+	assert.NoError(t, err)
+
+	golden := filepath.Join("testdata", "status.golden.json")
+	if *updateGolden {
+		assert.NoError(t, os.MkdirAll("testdata", 0755))
+		assert.NoError(t, os.WriteFile(golden, got, 0644))
+	}
+	want, err := os.ReadFile(golden)
+	assert.NoError(t, err)
+	assert.Equal(t, string(want), string(got))
+}
+
+func TestBackendsOf(t *testing.T) {
+	c := composite.New(nil, composite.SetBackend("ldap-primary", nil, 1))
+	backends := BackendsOf(map[config.AuthenticatorType]extension.AuthenticatorFactory{
+		config.BCRYPT: plainFactory{},
+		config.SHA512: c,
+	})
+	// only the authenticators with backends are reported
+	assert.Equal(t, map[string]backendHealth{"sha512": c}, backends)
+}
+
+// plainFactory is an authenticator without backends
+type plainFactory struct{}
+
+func (plainFactory) New(username string, options map[string]string) (tq.Handler, error) {
+	return nil, nil
+}
+
+func TestStatusUnsetSources(t *testing.T) {
+	got, err := json.Marshal(NewStatus(StatusSources{}, statusTime))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"generated":"2026-01-02T03:04:05Z","server":null,"config":null,"backends":{}}`, string(got))
+}
+
+func TestStatusHandler(t *testing.T) {
+	h := statusHandler(StatusSources{Server: fakeServer{}, Config: fakeConfig{}, Backends: map[string]backendHealth{"ldap": fakeBackends{}}})
+
+	r := httptest.NewRequest("GET", "/status", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var s Status
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &s))
+	assert.Equal(t, int64(12), s.Server.Connections)
+
+	r = httptest.NewRequest("GET", "/status", nil)
+	r.Header.Set("Accept", "text/html,application/xhtml+xml")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	for _, want := range []string{"retry in 5m", "idle-timeout", "core", "yaml: line 3: bad indentation", "ldap-secondary"} {
+		assert.Contains(t, w.Body.String(), want)
+	}
+}
@@ -13,15 +13,31 @@ import (
 	tq "github.com/facebookincubator/tacquito"
 )
 
+// AccountingOption is the setter type for AccountingRequest
+type AccountingOption func(a *AccountingRequest)
+
+// SetAccountingSystemEventUser sets the user whose accounter receives system events, such as
+// reloads and configuration saves.  Devices often send these without a user.
+func SetAccountingSystemEventUser(v string) AccountingOption {
+	return func(a *AccountingRequest) {
+		a.systemEventUser = v
+	}
+}
+
 // NewAccountingRequest ...
-func NewAccountingRequest(l loggerProvider, c configProvider) *AccountingRequest {
-	return &AccountingRequest{loggerProvider: l, configProvider: c}
+func NewAccountingRequest(l loggerProvider, c configProvider, opts ...AccountingOption) *AccountingRequest {
+	a := &AccountingRequest{loggerProvider: l, configProvider: c}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
 }
 
 // AccountingRequest is the main entry point for incoming AcctRequest packets
 type AccountingRequest struct {
 	loggerProvider
 	configProvider
+	systemEventUser string
 }
 
 // Handle ...
@@ -41,6 +57,24 @@ func (a *AccountingRequest) Handle(response tq.Response, request tq.Request) {
 
 	// TODO implement a fallback for cases where a username may not be present.
 	c := a.GetUser(string(body.User))
+	if kind, ok := body.Args.SystemEvent(); ok {
+		accountingHandleSystemEvent.WithLabelValues(string(kind)).Inc()
+		if a.systemEventUser != "" {
+			c = a.GetUser(a.systemEventUser)
+		}
+		if c == nil {
+			// not a malformed record, there is just nowhere to send it
+			a.Errorf(request.Context, "[%v] no accounter for system event [%v]; set the system_event_user handler option", request.Header.SessionID, kind)
+			accountingHandleSystemEventUnrouted.Inc()
+			response.Reply(
+				tq.NewAcctReply(
+					tq.SetAcctReplyStatus(tq.AcctReplyStatusError),
+					tq.SetAcctReplyServerMsg("no accounter for system events"),
+				),
+			)
+			return
+		}
+	}
 	if c == nil {
 		a.Debugf(request.Context, "[%v] user [%v] does not have an accounter associated", request.Header.SessionID, body.User)
 		accountingHandleAccounterNil.Inc()
@@ -22,6 +22,31 @@ func NewAuthenticateStart(l loggerProvider, c configProvider) *AuthenticateStart
 type AuthenticateStart struct {
 	loggerProvider
 	configProvider
+	// services route requests by authen_service ahead of the authen_type routes
+	services map[tq.AuthenService]tq.Handler
+	// allowed, if set, are the only authen_services served
+	allowed map[tq.AuthenService]bool
+	// methods, if set, are the only authen actions and types served, and methodDenial how others
+	// are answered
+	methods      tq.AuthenMethods
+	methodDenial tq.AuthenMethodDenial
+}
+
+// HandleService routes requests for svc to h, eg enable requests to an enable authenticator,
+// ahead of the routes by action and authen_type
+func (a *AuthenticateStart) HandleService(svc tq.AuthenService, h tq.Handler) {
+	if a.services == nil {
+		a.services = make(map[tq.AuthenService]tq.Handler)
+	}
+	a.services[svc] = h
+}
+
+// AllowServices denies requests for any authen_service but those given, before they are routed
+func (a *AuthenticateStart) AllowServices(services ...tq.AuthenService) {
+	a.allowed = make(map[tq.AuthenService]bool, len(services))
+	for _, svc := range services {
+		a.allowed[svc] = true
+	}
 }
 
 // authenActionStart is a function map that determines which authenticate handler to call given
@@ -37,6 +62,33 @@ type authenActionStart struct {
 func (a *AuthenticateStart) Handle(response tq.Response, request tq.Request) {
 	var body tq.AuthenStart
 	if err := tq.Unmarshal(request.Body, &body); err != nil {
+		if atype, ok := authenStartType(request.Body); ok && !atype.IsKnown() {
+			// vendor authen_types decode, so a body that does not decode with an authen_type
+			// outside of the rfc is most likely one that decrypted with the wrong secret.
+			a.Debugf(request.Context, "[%v] invalid authen_type [%v], possible bad secret", request.Header.SessionID, atype)
+			authenStartHandleInvalidType.Inc()
+			authenStartHandleError.Inc()
+			response.Reply(
+				tq.NewAuthenReply(
+					tq.SetAuthenReplyStatus(tq.AuthenStatusError),
+					tq.SetAuthenReplyServerMsg(fmt.Sprintf("invalid authen_type [%v], possible bad secret", atype)),
+				),
+			)
+			return
+		}
+		if svc, ok := authenStartService(request.Body); ok && !svc.IsKnown() {
+			// an authen_service outside of the rfc fails validation, it is failed cleanly so the
+			// client may retry with another
+			a.Debugf(request.Context, "[%v] unsupported authen_service [%v]", request.Header.SessionID, svc)
+			authenStartHandleService.WithLabelValues(svc.Name()).Inc()
+			response.Reply(
+				tq.NewAuthenReply(
+					tq.SetAuthenReplyStatus(tq.AuthenStatusFail),
+					tq.SetAuthenReplyServerMsg(fmt.Sprintf("unsupported authen_service [%v]", svc)),
+				),
+			)
+			return
+		}
 		authenStartHandleUnexpectedPacket.Inc()
 		authenStartHandleError.Inc()
 		response.Reply(
@@ -47,9 +99,26 @@ func (a *AuthenticateStart) Handle(response tq.Response, request tq.Request) {
 		)
 		return
 	}
+	authenStartHandleService.WithLabelValues(body.Service.Name()).Inc()
+	if a.allowed != nil && !a.allowed[body.Service] {
+		a.Debugf(request.Context, "[%v] authen_service [%v] is not allowed", request.Header.SessionID, body.Service)
+		authenStartServiceDenied.WithLabelValues(body.Service.Name()).Inc()
+		response.Reply(tq.NewDenial(tq.Authenticate, tq.DenialService, body.Service.Name()))
+		return
+	}
+	if a.methods != nil && !a.methods.Allows(body.Action, body.Type) {
+		a.Debugf(request.Context, "[%v] authen action [%v] with authen_type [%v] is not allowed", request.Header.SessionID, body.Action, body.Type)
+		authenStartMethodDenied.WithLabelValues(body.Action.Name(), body.Type.Name()).Inc()
+		a.denyMethod(response, body.Action)
+		return
+	}
+	if h := a.services[body.Service]; h != nil {
+		h.Handle(response, request)
+		return
+	}
 	authenRouter := map[authenActionStart]tq.Handler{
-		// 5.4.2.6.  Enable Requests
-		{action: tq.AuthenActionLogin, service: tq.AuthenServiceEnable, minorVersion: tq.MinorVersionOne}: NewAuthenticateASCII(a.loggerProvider, a.configProvider, string(body.User)),
+		// 5.4.2.6.  Enable Requests, whose authen_type is not used, so they are routed by service
+		{action: tq.AuthenActionLogin, service: tq.AuthenServiceEnable}: NewAuthenticateASCII(a.loggerProvider, a.configProvider, string(body.User)),
 		// 5.4.2.1.  ASCII Login Requests
 		{action: tq.AuthenActionLogin, atype: tq.AuthenTypeASCII, minorVersion: tq.MinorVersionDefault}: NewAuthenticateASCII(a.loggerProvider, a.configProvider, string(body.User)),
 		// 5.4.2.2.  PAP Login Requests
@@ -58,14 +127,34 @@ func (a *AuthenticateStart) Handle(response tq.Response, request tq.Request) {
 		{action: tq.AuthenActionLogin, atype: tq.AuthenTypeMSCHAP, minorVersion: tq.MinorVersionOne}:   nil, //AuthenMSCHAPStart not implemented
 		{action: tq.AuthenActionLogin, atype: tq.AuthenTypeMSCHAPV2, minorVersion: tq.MinorVersionOne}: nil, //AuthenMSCHAPV2Start not implemented
 	}
+	if h := authenRouter[authenActionStart{action: body.Action, service: body.Service}]; h != nil {
+		h.Handle(response, request)
+		return
+	}
 	key := authenActionStart{action: body.Action, atype: body.Type, minorVersion: request.Header.Version.MinorVersion}
 	if h := authenRouter[key]; h != nil {
 		h.Handle(response, request)
 		return
 	}
+	if !supportsAuthenType(authenRouter, body.Type) {
+		// an authen_type we have no handler for, either from the rfc or a vendor extension. this
+		// is a clean failure and not an error, the client may try another method.
+		if !body.Type.IsKnown() {
+			authenStartHandleUnknownType.Inc()
+		}
+		a.Debugf(request.Context, "[%v] unsupported authen_type [%v]", request.Header.SessionID, body.Type)
+		authenStartHandleUnsupportedType.Inc()
+		response.Reply(
+			tq.NewAuthenReply(
+				tq.SetAuthenReplyStatus(tq.AuthenStatusFail),
+				tq.SetAuthenReplyServerMsg(fmt.Sprintf("unsupported authen_type [%v]", body.Type)),
+			),
+		)
+		return
+	}
 	// we don't know what this packet is, so we log everything in it. this could log passwords but w/o knowing what this
 	// packet was, we can't effectively omit fields, so we guess.  user-msg may contain a password.
-	a.Record(request.Context, request.Fields(tq.ContextConnRemoteAddr), "user-msg")
+	a.Record(request.Context, request.Fields(recordKeys...), "user-msg")
 	authenStartHandleUnexpectedPacket.Inc()
 	authenStartHandleError.Inc()
 	response.Reply(
@@ -75,3 +164,51 @@ func (a *AuthenticateStart) Handle(response tq.Response, request tq.Request) {
 		),
 	)
 }
+
+// authenStartType reads the authen_type byte from an AuthenStart body without validating it.
+// ok is false if the body is too small to be an AuthenStart.
+func authenStartType(b []byte) (tq.AuthenType, bool) {
+	if len(b) < tq.AuthenStartLen {
+		return 0, false
+	}
+	return tq.AuthenType(b[2]), true
+}
+
+// denyMethod answers a start with a method that is not allowed, with a fail or with a restart
+// listing the authen_types allowed for action
+func (a *AuthenticateStart) denyMethod(response tq.Response, action tq.AuthenAction) {
+	if a.methodDenial != tq.AuthenMethodDenialRestart {
+		response.Reply(tq.NewDenial(tq.Authenticate, tq.DenialMethod, action.Name()))
+		return
+	}
+	types := a.methods.Types(action)
+	data := make([]byte, 0, len(types))
+	for _, atype := range types {
+		data = append(data, byte(atype))
+	}
+	response.Reply(
+		tq.NewAuthenReply(
+			tq.SetAuthenReplyStatus(tq.AuthenStatusRestart),
+			tq.SetAuthenReplyData(tq.AuthenData(data)),
+		),
+	)
+}
+
+// authenStartService reads the authen_service byte from an AuthenStart body without validating it.
+// ok is false if the body is too small to be an AuthenStart.
+func authenStartService(b []byte) (tq.AuthenService, bool) {
+	if len(b) < tq.AuthenStartLen {
+		return 0, false
+	}
+	return tq.AuthenService(b[3]), true
+}
+
+// supportsAuthenType reports if any route in router has a handler for atype
+func supportsAuthenType(router map[authenActionStart]tq.Handler, atype tq.AuthenType) bool {
+	for k, h := range router {
+		if k.atype == atype && h != nil {
+			return true
+		}
+	}
+	return false
+}
@@ -8,8 +8,6 @@
 package handlers
 
 import (
-	"fmt"
-
 	tq "github.com/facebookincubator/tacquito"
 )
 
@@ -30,14 +28,14 @@ type AuthenticateASCII struct {
 // Handle is the main entry for ascii flows.
 func (a *AuthenticateASCII) Handle(response tq.Response, request tq.Request) {
 	if reply := a.authenticateContinueStop(request); reply != nil {
-		a.Record(request.Context, request.Fields(tq.ContextConnRemoteAddr))
+		a.Record(request.Context, request.Fields(recordKeys...))
 		response.Reply(reply)
 		return
 	}
 	if a.username == "" {
 		// client didn't send us a username to start with
 		authenASCIIHandleNeedUsername.Inc()
-		a.Record(request.Context, request.Fields(tq.ContextConnRemoteAddr))
+		a.Record(request.Context, request.Fields(recordKeys...))
 		response.Next(NewResponseLogger(request.Context, a.loggerProvider, tq.HandlerFunc(a.getUsername)))
 		response.Reply(
 			tq.NewAuthenReply(
@@ -55,7 +53,7 @@ func (a *AuthenticateASCII) Handle(response tq.Response, request tq.Request) {
 func (a *AuthenticateASCII) getUsername(response tq.Response, request tq.Request) {
 	// user-msg may contain a password but if we land here, it technically should be a username
 	// this should be safe to log without obscure
-	defer a.Record(request.Context, request.Fields(tq.ContextConnRemoteAddr))
+	defer a.Record(request.Context, request.Fields(recordKeys...))
 	if reply := a.authenticateContinueStop(request); reply != nil {
 		response.Reply(reply)
 		return
@@ -100,7 +98,7 @@ func (a *AuthenticateASCII) getUsername(response tq.Response, request tq.Request
 // getPassword collects a password
 func (a *AuthenticateASCII) getPassword(response tq.Response, request tq.Request) {
 	// user-msg will contain a password here, obscure it
-	defer a.Record(request.Context, request.Fields(tq.ContextConnRemoteAddr), "user-msg")
+	defer a.Record(request.Context, request.Fields(recordKeys...), "user-msg")
 	if reply := a.authenticateContinueStop(request); reply != nil {
 		response.Reply(reply)
 		return
@@ -136,12 +134,7 @@ func (a *AuthenticateASCII) getPassword(response tq.Response, request tq.Request
 	if c == nil {
 		a.Debugf(request.Context, "[%v] user [%v] does not have an authenticator associated", request.Header.SessionID, a.username)
 		authenASCIIGetPasswordAuthenFail.Inc()
-		response.Reply(
-			tq.NewAuthenReply(
-				tq.SetAuthenReplyStatus(tq.AuthenStatusFail),
-				tq.SetAuthenReplyServerMsg(fmt.Sprintf("authentication denied [%s]", a.username)),
-			),
-		)
+		response.Reply(tq.NewDenial(tq.Authenticate, tq.DenialBadCredential, ""))
 		return
 	}
 	c.Authenticate.Handle(response, request)
@@ -8,8 +8,6 @@
 package handlers
 
 import (
-	"fmt"
-
 	tq "github.com/facebookincubator/tacquito"
 )
 
@@ -29,7 +27,7 @@ type AuthenticatePAP struct {
 func (a *AuthenticatePAP) Handle(response tq.Response, request tq.Request) {
 	// all control flows use the same message type, we can defer a single log
 	// call as a result. data may contain a password
-	a.Record(request.Context, request.Fields(tq.ContextConnRemoteAddr), "data")
+	a.Record(request.Context, request.Fields(recordKeys...), "data")
 
 	authenStartHandlePAP.Inc()
 	var body tq.AuthenStart
@@ -75,12 +73,7 @@ func (a *AuthenticatePAP) Handle(response tq.Response, request tq.Request) {
 		a.Debugf(request.Context, "[%v] user [%v] does not have an authenticator associated", request.Header.SessionID, body.User)
 		authenPAPHandleAuthenFail.Inc()
 		authenPAPHandleAuthenticatorNil.Inc()
-		response.Reply(
-			tq.NewAuthenReply(
-				tq.SetAuthenReplyStatus(tq.AuthenStatusFail),
-				tq.SetAuthenReplyServerMsg(fmt.Sprintf("authentication denied [%s]", string(body.User))),
-			),
-		)
+		response.Reply(tq.NewDenial(tq.Authenticate, tq.DenialBadCredential, ""))
 		return
 	}
 	c.Authenticate.Handle(response, request)
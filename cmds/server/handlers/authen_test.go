@@ -0,0 +1,176 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package handlers
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	tq "github.com/facebookincubator/tacquito"
+	"github.com/facebookincubator/tacquito/cmds/server/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type nopLogger struct{}
+
+func (nopLogger) Infof(ctx context.Context, format string, args ...interface{})      {}
+func (nopLogger) Errorf(ctx context.Context, format string, args ...interface{})     {}
+func (nopLogger) Debugf(ctx context.Context, format string, args ...interface{})     {}
+func (nopLogger) Record(ctx context.Context, r map[string]string, obscure ...string) {}
+
+// replyResponse keeps the last reply and next handler
+type replyResponse struct {
+	reply tq.EncoderDecoder
+	next  tq.Handler
+}
+
+func (r *replyResponse) Reply(v tq.EncoderDecoder) (int, error) {
+	if d, ok := v.(*tq.Denial); ok {
+		v = d.Reply(tq.DefaultMessageProfile)
+	}
+	r.reply = v
+	return 0, nil
+}
+func (r *replyResponse) Write(p *tq.Packet) (int, error) { return 0, nil }
+func (r *replyResponse) Next(next tq.Handler)            { r.next = next }
+func (r *replyResponse) RegisterWriter(io.Writer)        {}
+
+// status returns the status of the last reply, an authentication reply
+func (r *replyResponse) status(t *testing.T) tq.AuthenStatus {
+	reply, ok := r.reply.(*tq.AuthenReply)
+	require.True(t, ok, r.reply)
+	return reply.Status
+}
+
+// authenRequest returns the authenticate request with body and minor version
+func authenRequest(t *testing.T, minor uint8, body tq.EncoderDecoder) tq.Request {
+	b, err := body.MarshalBinary()
+	require.NoError(t, err)
+	return tq.Request{
+		Header: *tq.NewHeader(
+			tq.SetHeaderVersion(tq.Version{MajorVersion: tq.MajorVersion, MinorVersion: minor}),
+			tq.SetHeaderType(tq.Authenticate),
+			tq.SetHeaderSeqNo(1),
+			tq.SetHeaderSessionID(12345),
+		),
+		Body:    b,
+		Context: context.Background(),
+	}
+}
+
+// enableStart is the start of an enable request of alice with authen_type atype
+func enableStart(atype tq.AuthenType) *tq.AuthenStart {
+	return tq.NewAuthenStart(
+		tq.SetAuthenStartAction(tq.AuthenActionLogin),
+		tq.SetAuthenStartPrivLvl(tq.PrivLvlRoot),
+		tq.SetAuthenStartType(atype),
+		tq.SetAuthenStartService(tq.AuthenServiceEnable),
+		tq.SetAuthenStartUser("alice"),
+	)
+}
+
+// passAuthenticator passes every authentication and counts them
+type passAuthenticator struct{ called int }
+
+func (a *passAuthenticator) Handle(response tq.Response, request tq.Request) {
+	a.called++
+	response.Reply(tq.NewAuthenReply(tq.SetAuthenReplyStatus(tq.AuthenStatusPass)))
+}
+
+func TestAuthenticateStartEnable(t *testing.T) {
+	// the authen_type of an enable request is not used, whatever it is and whatever the minor
+	// version, enable prompts for the password of the user as an ascii login does
+	for _, test := range []struct {
+		name  string
+		minor uint8
+		atype tq.AuthenType
+	}{
+		{name: "ascii", minor: tq.MinorVersionDefault, atype: tq.AuthenTypeASCII},
+		{name: "pap", minor: tq.MinorVersionOne, atype: tq.AuthenTypePAP},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			authenticator := &passAuthenticator{}
+			start := NewAuthenticateStart(nopLogger{}, config.Provider{"alice": config.NewAAA(config.SetAAAAuthenticator(authenticator))})
+			resp := &replyResponse{}
+			start.Handle(resp, authenRequest(t, test.minor, enableStart(test.atype)))
+			assert.Equal(t, tq.AuthenStatusGetPass, resp.status(t))
+			require.NotNil(t, resp.next)
+			resp.next.Handle(resp, authenRequest(t, test.minor, tq.NewAuthenContinue(tq.SetAuthenContinueUserMessage("enable-secret"))))
+			assert.Equal(t, tq.AuthenStatusPass, resp.status(t))
+			assert.Equal(t, 1, authenticator.called)
+		})
+	}
+}
+
+func TestStartServiceRoutes(t *testing.T) {
+	// an enable authenticator registered with HandleService serves the enable requests of every
+	// device group, other services keep their routes
+	enable := &passAuthenticator{}
+	s := NewStart(nopLogger{})
+	s.HandleService(tq.AuthenServiceEnable, enable)
+	h := s.New(context.Background(), config.Provider{}, nil)
+
+	resp := &replyResponse{}
+	h.Handle(resp, authenRequest(t, tq.MinorVersionOne, enableStart(tq.AuthenTypePAP)))
+	assert.Equal(t, tq.AuthenStatusPass, resp.status(t))
+	assert.Equal(t, 1, enable.called)
+
+	login := tq.NewAuthenStart(
+		tq.SetAuthenStartAction(tq.AuthenActionLogin),
+		tq.SetAuthenStartType(tq.AuthenTypeASCII),
+		tq.SetAuthenStartService(tq.AuthenServiceLogin),
+	)
+	resp = &replyResponse{}
+	h.Handle(resp, authenRequest(t, tq.MinorVersionDefault, login))
+	assert.Equal(t, tq.AuthenStatusGetUser, resp.status(t))
+	assert.Equal(t, 1, enable.called)
+}
+
+func TestStartAllowedServicesMalformed(t *testing.T) {
+	// allowed_services that does not parse allows no services rather than every one
+	enable := &passAuthenticator{}
+	s := NewStart(nopLogger{})
+	s.HandleService(tq.AuthenServiceEnable, enable)
+	h := s.New(context.Background(), config.Provider{}, map[string]string{"allowed_services": "login, enable"})
+
+	services, restricted := h.(*ResponseLogger).AllowedServices()
+	assert.True(t, restricted)
+	assert.Empty(t, services)
+	resp := &replyResponse{}
+	h.Handle(resp, authenRequest(t, tq.MinorVersionOne, enableStart(tq.AuthenTypePAP)))
+	assert.Equal(t, tq.AuthenStatusFail, resp.status(t))
+	assert.Equal(t, 0, enable.called)
+}
+
+func TestStartImplicitSessionReuse(t *testing.T) {
+	tests := []struct {
+		name    string
+		options map[string]string
+		reuse   bool
+		set     bool
+	}{
+		// without the option the server default applies
+		{name: "unset", options: map[string]string{}},
+		{name: "true", options: map[string]string{"implicit_session_reuse": "true"}, reuse: true, set: true},
+		{name: "True", options: map[string]string{"implicit_session_reuse": "True"}, reuse: true, set: true},
+		{name: "1", options: map[string]string{"implicit_session_reuse": "1"}, reuse: true, set: true},
+		{name: "false", options: map[string]string{"implicit_session_reuse": "false"}, set: true},
+		{name: "bad", options: map[string]string{"implicit_session_reuse": "yes please"}},
+	}
+	for _, test := range tests {
+		h := NewStart(nopLogger{}).New(context.Background(), config.Provider{}, test.options)
+		policy, ok := h.(tq.SessionReusePolicy)
+		require.True(t, ok, test.name)
+		reuse, set := policy.ImplicitSessionReuse()
+		assert.Equal(t, test.reuse, reuse, test.name)
+		assert.Equal(t, test.set, set, test.name)
+	}
+}
@@ -8,8 +8,6 @@
 package handlers
 
 import (
-	"fmt"
-
 	tq "github.com/facebookincubator/tacquito"
 )
 
@@ -43,14 +41,7 @@ func (a *AuthorizeRequest) Handle(response tq.Response, request tq.Request) {
 	if c == nil {
 		a.Debugf(request.Context, "[%v] user [%v] does not have an authorizer associated", request.Header.SessionID, body.User)
 		authorizerHandleAuthorizerNil.Inc()
-		response.Reply(
-			tq.NewAuthorReply(
-				tq.SetAuthorReplyStatus(tq.AuthorStatusFail),
-				tq.SetAuthorReplyServerMsg(
-					fmt.Sprintf("authorization denied for user [%s]", string(body.User)),
-				),
-			),
-		)
+		response.Reply(tq.NewDenial(tq.Authorize, tq.DenialPolicy, ""))
 		return
 	}
 	c.Authorizer.Handle(response, request)
@@ -7,7 +7,14 @@
 
 package handlers
 
-import "context"
+import (
+	"context"
+
+	tq "github.com/facebookincubator/tacquito"
+)
+
+// recordKeys are the request context values included in every record
+var recordKeys = []tq.ContextKey{tq.ContextConnRemoteAddr, tq.ContextEventTime, tq.ContextReceiveOffset}
 
 // loggerProvider provides the logging implementation
 type loggerProvider interface {
@@ -9,6 +9,8 @@ package handlers
 
 import (
 	"context"
+	"strconv"
+	"time"
 
 	tq "github.com/facebookincubator/tacquito"
 )
@@ -28,19 +30,121 @@ type ResponseLogger struct {
 
 // Write response fields to logger
 func (l *ResponseLogger) Write(p []byte) (int, error) {
+	return l.write(l.ctx, p)
+}
+
+// write records the response p to the request with ctx, along with the time the server took to
+// reply to it
+func (l *ResponseLogger) write(ctx context.Context, p []byte) (int, error) {
+	if ctx == nil {
+		ctx = l.ctx
+	}
 	packet := tq.NewPacket()
 	err := packet.UnmarshalBinary(p)
 	if err != nil {
 		return 0, err
 	}
-	// TODO make context available here for FieldsWithContext(tq.ContextConnRemoteAddr)
-	request := tq.Request{Header: *packet.Header, Body: packet.Body[:]}
-	l.Record(l.ctx, request.Fields())
+	request := tq.Request{Header: *packet.Header, Body: packet.Body[:], Context: ctx}
+	fields := request.Fields(recordKeys...)
+	if latency, ok := tq.Latency(ctx); ok {
+		fields["latency-us"] = strconv.FormatInt(latency.Microseconds(), 10)
+	}
+	l.Record(ctx, fields)
 	return 0, nil
 }
 
 // Handle implements a middleware logger for next
 func (l *ResponseLogger) Handle(response tq.Response, request tq.Request) {
-	response.RegisterWriter(l)
+	response.RegisterWriter(requestWriter{ResponseLogger: l, ctx: request.Context})
 	l.next.Handle(response, request)
 }
+
+// requestWriter records the responses to a single request
+type requestWriter struct {
+	*ResponseLogger
+	ctx context.Context
+}
+
+// Write response fields to logger
+func (w requestWriter) Write(p []byte) (int, error) {
+	return w.write(w.ctx, p)
+}
+
+// ImplicitSessionReuse implements tq.SessionReusePolicy on behalf of next
+func (l *ResponseLogger) ImplicitSessionReuse() (bool, bool) {
+	if p, ok := l.next.(tq.SessionReusePolicy); ok {
+		return p.ImplicitSessionReuse()
+	}
+	return false, false
+}
+
+// LifetimeExpiry implements tq.ConnectionLifetimePolicy on behalf of next
+func (l *ResponseLogger) LifetimeExpiry() tq.LifetimeExpiry {
+	if p, ok := l.next.(tq.ConnectionLifetimePolicy); ok {
+		return p.LifetimeExpiry()
+	}
+	return tq.LifetimeDrain
+}
+
+// MessageProfile implements tq.MessageProfilePolicy on behalf of next
+func (l *ResponseLogger) MessageProfile() tq.MessageProfile {
+	if p, ok := l.next.(tq.MessageProfilePolicy); ok {
+		return p.MessageProfile()
+	}
+	return tq.DefaultMessageProfile
+}
+
+// StringNormalization implements tq.StringNormalizationPolicy on behalf of next
+func (l *ResponseLogger) StringNormalization() tq.StringNormalization {
+	if p, ok := l.next.(tq.StringNormalizationPolicy); ok {
+		return p.StringNormalization()
+	}
+	return tq.DefaultStringNormalization
+}
+
+// LengthDelta implements tq.LengthQuirkPolicy on behalf of next
+func (l *ResponseLogger) LengthDelta() (int, time.Duration) {
+	if p, ok := l.next.(tq.LengthQuirkPolicy); ok {
+		return p.LengthDelta()
+	}
+	return 0, 0
+}
+
+// MaxInteractiveSessions implements tq.InteractiveSessionPolicy on behalf of next
+func (l *ResponseLogger) MaxInteractiveSessions() (int, bool) {
+	if p, ok := l.next.(tq.InteractiveSessionPolicy); ok {
+		return p.MaxInteractiveSessions()
+	}
+	return 0, false
+}
+
+// DeviceGroup implements tq.DeviceGroupPolicy on behalf of next
+func (l *ResponseLogger) DeviceGroup() string {
+	if p, ok := l.next.(tq.DeviceGroupPolicy); ok {
+		return p.DeviceGroup()
+	}
+	return ""
+}
+
+// authenRestrictions is implemented by handlers that restrict how their devices authenticate, see
+// Start.AllowedServices and Start.AuthenMethods
+type authenRestrictions interface {
+	AllowedServices() ([]tq.AuthenService, bool)
+	AuthenMethods() (tq.AuthenMethods, tq.AuthenMethodDenial)
+}
+
+// AllowedServices reports the authen_services next allows, on behalf of next
+func (l *ResponseLogger) AllowedServices() ([]tq.AuthenService, bool) {
+	if p, ok := l.next.(authenRestrictions); ok {
+		return p.AllowedServices()
+	}
+	return nil, false
+}
+
+// AuthenMethods reports the authen methods next allows, on behalf of next
+func (l *ResponseLogger) AuthenMethods() (tq.AuthenMethods, tq.AuthenMethodDenial) {
+	if p, ok := l.next.(authenRestrictions); ok {
+		return p.AuthenMethods()
+	}
+	return nil, tq.AuthenMethodDenialFail
+}
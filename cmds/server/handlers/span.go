@@ -129,8 +129,9 @@ func (w writer) Write(p []byte) (int, error) {
 	return n, err
 }
 
-func (s *Span) dialHost() (net.Conn, error) {
-	c, err := net.Dial("tcp6", s.destination)
+func (s *Span) dialHost(ctx context.Context) (net.Conn, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp6", s.destination)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't dial the connection to %v due to error %v", s.destination, err)
 	}
@@ -146,7 +147,7 @@ func (s *Span) Handle(response tq.Response, request tq.Request) {
 		spanDurations.Observe(ms)
 	}))
 	start := time.Now()
-	conn, err := s.dialHost()
+	conn, err := s.dialHost(request.Context)
 	callNextHandler := func() {
 		nextHandler := NewStart(s.loggerProvider).New(request.Context, s.configProvider.(config.Provider), nil)
 		nextHandler.Handle(response, request)
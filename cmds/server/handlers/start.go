@@ -9,6 +9,11 @@ package handlers
 
 import (
 	"context"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"time"
+
 	tq "github.com/facebookincubator/tacquito"
 	"github.com/facebookincubator/tacquito/cmds/server/config"
 )
@@ -23,11 +28,262 @@ type Start struct {
 	loggerProvider
 	configProvider
 	options map[string]string
+
+	lengthDelta       int
+	lengthDeltaBudget time.Duration
+	messageProfile    tq.MessageProfile
+	lifetimeExpiry    tq.LifetimeExpiry
+	// maxInteractive is the interactive session quota of each device, if maxInteractiveSet
+	maxInteractive    int
+	maxInteractiveSet bool
+	// implicitReuse is the session reuse policy of the device group, if implicitReuseSet
+	implicitReuse    bool
+	implicitReuseSet bool
+	// services are the authen_service routes of every handler built by New, see HandleService
+	services map[tq.AuthenService]tq.Handler
+	// allowedServices, if set, are the only authen_services of the device group
+	allowedServices map[tq.AuthenService]bool
+	// authenMethods, if set, are the only authen actions and types of the device group, and
+	// authenMethodDenial how others are answered
+	authenMethods      tq.AuthenMethods
+	authenMethodDenial tq.AuthenMethodDenial
+	// normalization is how the user, port and rem_addr fields of the device group are canonicalized
+	normalization tq.StringNormalization
+}
+
+// HandleService routes authenticate requests for svc to h, eg enable requests to an enable
+// authenticator, for every device group.  It must be called before the handler is registered with
+// the loader.
+func (s *Start) HandleService(svc tq.AuthenService, h tq.Handler) {
+	if s.services == nil {
+		s.services = make(map[tq.AuthenService]tq.Handler)
+	}
+	s.services[svc] = h
 }
 
+// defaultLengthDeltaBudget is how long to wait for the rest of a conformant body before
+// length_delta is applied
+const defaultLengthDeltaBudget = 250 * time.Millisecond
+
 // New creates a new start handler.
 func (s *Start) New(ctx context.Context, c config.Provider, options map[string]string) tq.Handler {
-	return NewResponseLogger(ctx, s.loggerProvider, &Start{loggerProvider: s.loggerProvider, configProvider: c})
+	start := &Start{loggerProvider: s.loggerProvider, configProvider: c, options: options, lengthDeltaBudget: defaultLengthDeltaBudget, messageProfile: tq.DefaultMessageProfile, services: s.services}
+	if v, ok := options["length_delta"]; ok {
+		delta, err := strconv.Atoi(v)
+		switch {
+		case err != nil:
+			s.Errorf(ctx, "ignoring length_delta [%v]; %v", v, err)
+		case delta < -tq.MaxHeaderLength || delta > tq.MaxHeaderLength:
+			s.Errorf(ctx, "ignoring length_delta [%v]; must be within [%v] bytes", v, tq.MaxHeaderLength)
+		default:
+			start.lengthDelta = delta
+		}
+	}
+	if v, ok := options["length_delta_budget"]; ok {
+		budget, err := time.ParseDuration(v)
+		if err != nil || budget <= 0 {
+			s.Errorf(ctx, "ignoring length_delta_budget [%v]; must be a positive duration", v)
+		} else {
+			start.lengthDeltaBudget = budget
+		}
+	}
+	if v, ok := options["connection_lifetime_expiry"]; ok {
+		expiry, err := tq.ParseLifetimeExpiry(v)
+		if err != nil {
+			s.Errorf(ctx, "ignoring connection_lifetime_expiry; %v", err)
+		} else {
+			start.lifetimeExpiry = expiry
+		}
+	}
+	if v, ok := options["max_interactive_sessions"]; ok {
+		max, err := strconv.Atoi(v)
+		if err != nil || max < 0 {
+			s.Errorf(ctx, "ignoring max_interactive_sessions [%v]; must be zero or a positive number", v)
+		} else {
+			start.maxInteractive, start.maxInteractiveSet = max, true
+		}
+	}
+	if v, ok := options["implicit_session_reuse"]; ok {
+		reuse, err := strconv.ParseBool(v)
+		if err != nil {
+			s.Errorf(ctx, "ignoring implicit_session_reuse [%v]; %v", v, err)
+		} else {
+			start.implicitReuse, start.implicitReuseSet = reuse, true
+		}
+	}
+	if v, ok := options["allowed_services"]; ok {
+		start.allowedServices = s.newAllowedServices(ctx, v)
+	}
+	if v, ok := options["allowed_authen_methods"]; ok {
+		methods, err := tq.ParseAuthenMethods(v)
+		if err != nil {
+			// the loader refuses such a group, a handler built without it fails closed
+			s.Errorf(ctx, "allowing no authen methods; %v", err)
+			methods = tq.AuthenMethods{}
+		}
+		start.authenMethods = methods
+	}
+	start.authenMethodDenial = tq.AuthenMethodDenialFail
+	if v, ok := options["authen_method_denial"]; ok {
+		denial, err := tq.ParseAuthenMethodDenial(v)
+		if err != nil {
+			s.Errorf(ctx, "ignoring authen_method_denial; %v", err)
+		} else {
+			start.authenMethodDenial = denial
+		}
+	}
+	start.messageProfile = s.newMessageProfile(ctx, options)
+	start.normalization = s.newStringNormalization(ctx, options)
+	return NewResponseLogger(ctx, s.loggerProvider, start)
+}
+
+// newAllowedServices parses the option allowed_services, a json list of authen_service names, eg
+// ["login", "enable"].  Unknown names are logged and ignored, so a list of only unknown names
+// allows no services, and a list that does not parse allows none either.
+func (s *Start) newAllowedServices(ctx context.Context, v string) map[tq.AuthenService]bool {
+	var names []string
+	if err := json.Unmarshal([]byte(v), &names); err != nil {
+		// the loader refuses such a group, a handler built without it fails closed
+		s.Errorf(ctx, "allowing no authen_services; %v", err)
+		return map[tq.AuthenService]bool{}
+	}
+	allowed := make(map[tq.AuthenService]bool, len(names))
+	for _, name := range names {
+		svc, ok := tq.AuthenServiceByName(name)
+		if !ok {
+			s.Errorf(ctx, "ignoring allowed_services entry [%v]; not an authen_service", name)
+			continue
+		}
+		allowed[svc] = true
+	}
+	return allowed
+}
+
+// newMessageProfile builds the message profile from the options message_profile, one of ios, nxos
+// or junos, and the overrides message_max_length, message_single_line and denial_messages, a json
+// object of denial cause to message.  Bad values are logged and ignored.
+func (s *Start) newMessageProfile(ctx context.Context, options map[string]string) tq.MessageProfile {
+	p := tq.DefaultMessageProfile
+	if v, ok := options["message_profile"]; ok {
+		if named, ok := tq.MessageProfileByName(v); ok {
+			p = named
+		} else {
+			s.Errorf(ctx, "ignoring message_profile [%v]; must be one of ios, nxos, junos or default", v)
+		}
+	}
+	if v, ok := options["message_max_length"]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			s.Errorf(ctx, "ignoring message_max_length [%v]; must be zero or a positive number", v)
+		} else {
+			p.MaxLength = n
+		}
+	}
+	if v, ok := options["message_single_line"]; ok {
+		single, err := strconv.ParseBool(v)
+		if err != nil {
+			s.Errorf(ctx, "ignoring message_single_line [%v]; %v", v, err)
+		} else {
+			p.SingleLine = single
+		}
+	}
+	if v, ok := options["denial_messages"]; ok {
+		var messages map[tq.DenialCause]string
+		if err := json.Unmarshal([]byte(v), &messages); err != nil {
+			s.Errorf(ctx, "ignoring denial_messages; %v", err)
+		} else {
+			p.Messages = messages
+		}
+	}
+	return p
+}
+
+// newStringNormalization builds the string normalization from the options trim_space, which also
+// strips trailing white space from the user, port and rem_addr fields, and invalid_utf8, one of
+// pass, replace, reject or latin1.  Bad values are logged and ignored.
+func (s *Start) newStringNormalization(ctx context.Context, options map[string]string) tq.StringNormalization {
+	n := tq.DefaultStringNormalization
+	if v, ok := options["trim_space"]; ok {
+		trim, err := strconv.ParseBool(v)
+		if err != nil {
+			s.Errorf(ctx, "ignoring trim_space [%v]; %v", v, err)
+		} else {
+			n.TrimSpace = trim
+		}
+	}
+	if v, ok := options["invalid_utf8"]; ok {
+		policy, err := tq.ParseInvalidUTF8Policy(v)
+		if err != nil {
+			s.Errorf(ctx, "ignoring invalid_utf8; %v", err)
+		} else {
+			n.InvalidUTF8 = policy
+		}
+	}
+	return n
+}
+
+// LengthDelta implements tq.LengthQuirkPolicy.  The option length_delta sets the signed number of
+// bytes to add to the declared length of packets from the devices this handler serves, and
+// length_delta_budget how long to wait for a conformant body before applying it.
+func (s *Start) LengthDelta() (int, time.Duration) {
+	return s.lengthDelta, s.lengthDeltaBudget
+}
+
+// MessageProfile implements tq.MessageProfilePolicy for the devices this handler serves
+func (s *Start) MessageProfile() tq.MessageProfile {
+	return s.messageProfile
+}
+
+// StringNormalization implements tq.StringNormalizationPolicy for the devices this handler serves
+func (s *Start) StringNormalization() tq.StringNormalization {
+	return s.normalization
+}
+
+// ImplicitSessionReuse implements tq.SessionReusePolicy.  The option implicit_session_reuse allows
+// or denies implicit reuse; the server default applies without it.
+func (s *Start) ImplicitSessionReuse() (bool, bool) {
+	return s.implicitReuse, s.implicitReuseSet
+}
+
+// LifetimeExpiry implements tq.ConnectionLifetimePolicy.  The option connection_lifetime_expiry
+// is drain, the default, or reject.
+func (s *Start) LifetimeExpiry() tq.LifetimeExpiry {
+	return s.lifetimeExpiry
+}
+
+// MaxInteractiveSessions implements tq.InteractiveSessionPolicy.  The option
+// max_interactive_sessions sets the quota of each device, zero is unlimited; the server default
+// applies without it.
+func (s *Start) MaxInteractiveSessions() (int, bool) {
+	return s.maxInteractive, s.maxInteractiveSet
+}
+
+// AllowedServices returns the only authen_services the device group is served, in ascending order.
+// restricted is false if the option allowed_services is unset and every service is served.
+func (s *Start) AllowedServices() (services []tq.AuthenService, restricted bool) {
+	if s.allowedServices == nil {
+		return nil, false
+	}
+	services = []tq.AuthenService{}
+	for svc, ok := range s.allowedServices {
+		if ok {
+			services = append(services, svc)
+		}
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i] < services[j] })
+	return services, true
+}
+
+// AuthenMethods returns the only authen methods the device group is served, nil if the option
+// allowed_authen_methods is unset, and how others are answered
+func (s *Start) AuthenMethods() (tq.AuthenMethods, tq.AuthenMethodDenial) {
+	return s.authenMethods, s.authenMethodDenial
+}
+
+// DeviceGroup implements tq.DeviceGroupPolicy.  The option device_group names the group, the
+// loader sets it to the name of the secret config unless it is set explicitly.
+func (s *Start) DeviceGroup() string {
+	return s.options["device_group"]
 }
 
 // Handle implements the tq handler interface
@@ -35,14 +291,22 @@ func (s *Start) Handle(response tq.Response, request tq.Request) {
 	switch request.Header.Type {
 	case tq.Authenticate:
 		startAuthenticate.Inc()
-		NewAuthenticateStart(s.loggerProvider, s.configProvider).Handle(response, request)
+		a := NewAuthenticateStart(s.loggerProvider, s.configProvider)
+		a.services, a.allowed = s.services, s.allowedServices
+		a.methods, a.methodDenial = s.authenMethods, s.authenMethodDenial
+		a.Handle(response, request)
 	case tq.Authorize:
 		startAuthorize.Inc()
-		s.Record(request.Context, request.Fields(tq.ContextConnRemoteAddr))
+		s.Record(request.Context, request.Fields(recordKeys...))
 		NewAuthorizeRequest(s.loggerProvider, s.configProvider).Handle(response, request)
 	case tq.Accounting:
 		startAccounting.Inc()
-		s.Record(request.Context, request.Fields(tq.ContextConnRemoteAddr))
-		NewAccountingRequest(s.loggerProvider, s.configProvider).Handle(response, request)
+		s.Record(request.Context, request.Fields(recordKeys...))
+		NewAccountingRequest(s.loggerProvider, s.configProvider, SetAccountingSystemEventUser(s.options["system_event_user"])).Handle(response, request)
+	default:
+		// the server only reads packets of known types, so this is a handler wired up elsewhere.
+		// there is no reply for a type we do not know.
+		startUnknownType.Inc()
+		s.Errorf(request.Context, "[%v] unknown header type [%v]", request.Header.SessionID, request.Header.Type)
 	}
 }
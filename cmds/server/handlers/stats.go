@@ -27,6 +27,11 @@ var (
 		Name:      "start_handle_accounting",
 		Help:      "number of accounting handlers called",
 	})
+	startUnknownType = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "tacquito",
+		Name:      "start_handle_unknown_type",
+		Help:      "number of packets with a header type outside of the rfc",
+	})
 	authenStartHandleUnexpectedPacket = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "tacquito",
 		Name:      "authenstart_unexpected_packet",
@@ -37,6 +42,36 @@ var (
 		Name:      "authenstart_handle_error",
 		Help:      "number of authenstart errors",
 	})
+	authenStartHandleUnsupportedType = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "tacquito",
+		Name:      "authenstart_handle_unsupported_type",
+		Help:      "number of authenstart packets with a valid but unsupported authen_type",
+	})
+	authenStartHandleInvalidType = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "tacquito",
+		Name:      "authenstart_handle_invalid_type",
+		Help:      "number of undecodable authenstart packets with an out of range authen_type",
+	})
+	authenStartHandleUnknownType = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "tacquito",
+		Name:      "authenstart_handle_unknown_type",
+		Help:      "number of authenstart packets with an authen_type outside of the rfc, eg a vendor extension",
+	})
+	authenStartHandleService = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tacquito",
+		Name:      "authenstart_handle_service",
+		Help:      "number of authenstart packets by authen_service, unknown for values outside of the rfc",
+	}, []string{"service"})
+	authenStartServiceDenied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tacquito",
+		Name:      "authenstart_service_denied",
+		Help:      "number of authenstart packets denied because the device may not use their authen_service",
+	}, []string{"service"})
+	authenStartMethodDenied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tacquito",
+		Name:      "authenstart_method_denied",
+		Help:      "number of authenstart packets denied because the device may not use their authen action and authen_type",
+	}, []string{"action", "type"})
 	authenStartHandlePAP = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "tacquito",
 		Name:      "authenstart_handle_pap",
@@ -162,6 +197,16 @@ var (
 		Name:      "accountingrequest_handle_accounter_nil",
 		Help:      "number of accounting handlers with nil authorizers for expected user",
 	})
+	accountingHandleSystemEvent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tacquito",
+		Name:      "accountingrequest_handle_system_event",
+		Help:      "number of system event accounting records, by kind",
+	}, []string{"kind"})
+	accountingHandleSystemEventUnrouted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "tacquito",
+		Name:      "accountingrequest_handle_system_event_unrouted",
+		Help:      "number of system event accounting records without an accounter",
+	})
 	accountingHandleError = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "tacquito",
 		Name:      "accountingrequest_handle_accounter_error",
@@ -203,8 +248,15 @@ func init() {
 	prometheus.MustRegister(startAuthenticate)
 	prometheus.MustRegister(startAuthorize)
 	prometheus.MustRegister(startAccounting)
+	prometheus.MustRegister(authenStartHandleService)
+	prometheus.MustRegister(authenStartServiceDenied)
+	prometheus.MustRegister(authenStartMethodDenied)
+	prometheus.MustRegister(startUnknownType)
 	prometheus.MustRegister(authenStartHandleUnexpectedPacket)
 	prometheus.MustRegister(authenStartHandleError)
+	prometheus.MustRegister(authenStartHandleUnsupportedType)
+	prometheus.MustRegister(authenStartHandleInvalidType)
+	prometheus.MustRegister(authenStartHandleUnknownType)
 	prometheus.MustRegister(authenStartHandlePAP)
 	prometheus.MustRegister(authenASCIIContinueStop)
 	prometheus.MustRegister(authenASCIIHandleUnexpectedPacket)
@@ -231,6 +283,8 @@ func init() {
 	prometheus.MustRegister(accountingHandleUnexpectedPacket)
 	prometheus.MustRegister(accountingHandleAccounterNil)
 	prometheus.MustRegister(accountingHandleError)
+	prometheus.MustRegister(accountingHandleSystemEvent)
+	prometheus.MustRegister(accountingHandleSystemEventUnrouted)
 	prometheus.MustRegister(spanHandle)
 	prometheus.MustRegister(spanHandleError)
 	prometheus.MustRegister(spanHandleWriteSuccess)
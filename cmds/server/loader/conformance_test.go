@@ -0,0 +1,38 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package loader
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/facebookincubator/tacquito/cmds/server/config"
+	"github.com/facebookincubator/tacquito/cmds/server/config/authorizers/stringy"
+	"github.com/facebookincubator/tacquito/cmds/server/config/secret/prefix"
+	"github.com/facebookincubator/tacquito/extension/extensiontest"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestLoaderConformance runs the secret provider suite of the extension contract on a loader
+func TestLoaderConformance(t *testing.T) {
+	source := make(reloadSource)
+	l, err := NewLoader(context.Background(), source,
+		SetLoggerProvider(reloadLogger{}),
+		SetKeychainProvider(cutoverKeychain{}),
+		SetConfigProvider(config.New()),
+		SetAuthorizerProvider(stringy.New(reloadLogger{})),
+		RegisterSecretProviderType(config.PREFIX, prefix.New(reloadLogger{})),
+		RegisterHandlerType(config.START, reloadHandlerFactory{}),
+	)
+	require.NoError(t, err)
+	source <- effectiveConfig("")
+	l.BlockUntilLoaded()
+	extensiontest.RunSecretProviderConformanceTests(t, l, &net.TCPAddr{IP: net.ParseIP("192.0.2.200"), Port: 49152}, &net.TCPAddr{IP: net.ParseIP("203.0.113.1"), Port: 49152})
+}
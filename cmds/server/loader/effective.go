@@ -0,0 +1,345 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package loader
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	tq "github.com/facebookincubator/tacquito"
+	"github.com/facebookincubator/tacquito/cmds/server/config"
+)
+
+// builtGroup is a device group, a config.SecretConfig, as a build turned it into a provider
+type builtGroup struct {
+	config   config.SecretConfig
+	provider tq.SecretProvider
+	handler  tq.Handler
+	secret   func(context.Context, string) ([]byte, error)
+	// cutover are the other secrets the group serves, see config.CutoverSecret
+	cutover []cutoverSecret
+	// users are the users scoped to the group and ruleSetHash identifies their policy
+	users       []EffectiveUser
+	ruleSetHash string
+}
+
+// Effective is the policy a device, or a device group, is served with right now, see
+// Loader.Effective.  It is served as json, so fields are only ever added and never renamed.  It
+// never holds secret material: the secret is reported by fingerprint and handler options by name.
+type Effective struct {
+	// Generation counts the configs the loader applied, and Applied is when the one reported was,
+	// so a stale config is visible
+	Generation int64     `json:"generation"`
+	Applied    time.Time `json:"applied"`
+	// Query is the address or group name that was asked about
+	Query string `json:"query"`
+	// PrefixFilter is set if a server wide prefix filter refuses the address, deny or allow
+	PrefixFilter string `json:"prefix_filter,omitempty"`
+	// Group is the device group, and Type its secret provider type
+	Group string `json:"group"`
+	Type  string `json:"type"`
+	// MatchedPrefix is the most specific prefix of the group that holds the address
+	MatchedPrefix string `json:"matched_prefix,omitempty"`
+	// SecretFingerprint is the first 16 hex characters of the hmac-sha256 of the secret, keyed with
+	// the key of SetFingerprintKey, and SecretError why the secret could not be read
+	SecretFingerprint string              `json:"secret_fingerprint,omitempty"`
+	SecretError       string              `json:"secret_error,omitempty"`
+	Handler           EffectiveHandler    `json:"handler"`
+	Strictness        EffectiveStrictness `json:"strictness"`
+	// RuleSetHash changes with any change to the users, groups, services or commands of the group
+	RuleSetHash string          `json:"rule_set_hash"`
+	Users       []EffectiveUser `json:"users"`
+}
+
+// EffectiveHandler is the handler of a device group, with the policies the server reads from it
+// for every connection
+type EffectiveHandler struct {
+	Type string `json:"type"`
+	// Options are the names of the handler options that are set
+	Options     []string `json:"options"`
+	DeviceGroup string   `json:"device_group"`
+	// ImplicitSessionReuse is unset if the handler leaves it to the server default
+	ImplicitSessionReuse *bool `json:"implicit_session_reuse,omitempty"`
+	// LengthDelta and LengthDeltaBudget are the length quirk of the devices, zero if they have none
+	LengthDelta       int    `json:"length_delta,omitempty"`
+	LengthDeltaBudget string `json:"length_delta_budget,omitempty"`
+	LifetimeExpiry    string `json:"lifetime_expiry,omitempty"`
+	// MaxInteractiveSessions is unset if the handler leaves it to the server default
+	MaxInteractiveSessions *int `json:"max_interactive_sessions,omitempty"`
+	// MessageMaxLength and MessageSingleLine are the message profile denials are rendered with
+	MessageMaxLength  int  `json:"message_max_length,omitempty"`
+	MessageSingleLine bool `json:"message_single_line,omitempty"`
+}
+
+// ServerStrictness are the server wide checks every request is held to, see SetServerStrictness
+type ServerStrictness struct {
+	Conformance       bool `json:"conformance"`
+	BodyLengthCheck   bool `json:"body_length_check"`
+	ReplyCheck        bool `json:"reply_check"`
+	RejectUnencrypted bool `json:"reject_unencrypted"`
+}
+
+// EffectiveStrictness are the checks the requests of a device group are held to, those of its
+// handler and those of the server
+type EffectiveStrictness struct {
+	ServerStrictness
+	// AllowedServices are the only authen_services served, every one if unset
+	AllowedServices []string `json:"allowed_services,omitempty"`
+	// AllowedAuthenMethods are the only authen_types served by authen action, every one if unset,
+	// and AuthenMethodDenial how others are answered
+	AllowedAuthenMethods map[string][]string `json:"allowed_authen_methods,omitempty"`
+	AuthenMethodDenial   string              `json:"authen_method_denial,omitempty"`
+	// TrimSpace and InvalidUTF8 are the string normalization of the user, port and rem_addr fields
+	TrimSpace   bool   `json:"trim_space"`
+	InvalidUTF8 string `json:"invalid_utf8"`
+}
+
+// authenRestrictionPolicy is implemented by handlers that restrict how their devices authenticate,
+// see handlers.Start
+type authenRestrictionPolicy interface {
+	AllowedServices() ([]tq.AuthenService, bool)
+	AuthenMethods() (tq.AuthenMethods, tq.AuthenMethodDenial)
+}
+
+// EffectiveUser is a user of a device group.  Authenticators and Accounters are the chain each
+// request goes through, outermost first.
+type EffectiveUser struct {
+	Name           string   `json:"name"`
+	Authenticators []string `json:"authenticators"`
+	Accounters     []string `json:"accounters"`
+}
+
+// Effective returns the policy of the device at the address query, or of the device group named
+// query, from the config serving requests right now.  An address is matched by asking each
+// provider in turn, exactly as a connection from it would be.
+func (l Loader) Effective(ctx context.Context, query string) (Effective, error) {
+	current, _ := l.current.Load().(*snapshot)
+	if current == nil {
+		return Effective{}, fmt.Errorf("no config was loaded")
+	}
+	e := Effective{Generation: current.generation, Applied: current.applied, Query: query}
+	ip := net.ParseIP(query)
+	if ip == nil {
+		for _, g := range current.groups {
+			if g.config.Name == query {
+				secret, err := g.secret(ctx, "")
+				e.describe(l, g, g.handler, secret, err)
+				return e, nil
+			}
+		}
+		return Effective{}, fmt.Errorf("no device group [%v]", query)
+	}
+
+	remote := &net.TCPAddr{IP: ip}
+	if current.prefixDeny.deny(remote) {
+		e.PrefixFilter = "deny"
+	} else if !current.prefixAllow.allow(remote) {
+		e.PrefixFilter = "allow"
+	}
+	for _, g := range current.groups {
+		secret, handler, err := g.provider.Get(ctx, remote)
+		if err != nil || secret == nil || handler == nil {
+			continue
+		}
+		e.describe(l, g, handler, secret, nil)
+		e.MatchedPrefix = matchedPrefix(g.config, ip)
+		return e, nil
+	}
+	return Effective{}, fmt.Errorf("remote [%v] has no secret providers", query)
+}
+
+// describe sets the policy of group g of l, served by handler with secret, on e.  The secret is
+// fingerprinted with an hmac keyed with the fingerprint key of l, so a weak secret cannot be
+// guessed from it offline.
+func (e *Effective) describe(l Loader, g *builtGroup, handler tq.Handler, secret []byte, err error) {
+	e.Group, e.Type = g.config.Name, providerTypeName(g.config.Type)
+	e.RuleSetHash, e.Users = g.ruleSetHash, g.users
+	if err != nil {
+		e.SecretError = err.Error()
+	} else if secret != nil {
+		mac := hmac.New(sha256.New, l.fingerprintKey)
+		mac.Write(secret)
+		e.SecretFingerprint = hex.EncodeToString(mac.Sum(nil)[:8])
+	}
+	e.Handler = effectiveHandler(g.config, handler)
+	e.Strictness = effectiveStrictness(handler)
+	e.Strictness.ServerStrictness = l.strictness
+}
+
+// effectiveStrictness reads the checks of h, as the server does for each connection
+func effectiveStrictness(h tq.Handler) EffectiveStrictness {
+	e := EffectiveStrictness{InvalidUTF8: tq.DefaultStringNormalization.InvalidUTF8.String()}
+	if p, ok := h.(tq.StringNormalizationPolicy); ok {
+		n := p.StringNormalization()
+		e.TrimSpace, e.InvalidUTF8 = n.TrimSpace, n.InvalidUTF8.String()
+	}
+	p, ok := h.(authenRestrictionPolicy)
+	if !ok {
+		return e
+	}
+	if services, restricted := p.AllowedServices(); restricted {
+		e.AllowedServices = []string{}
+		for _, svc := range services {
+			e.AllowedServices = append(e.AllowedServices, svc.Name())
+		}
+	}
+	if methods, denial := p.AuthenMethods(); methods != nil {
+		e.AllowedAuthenMethods = make(map[string][]string, len(methods))
+		for action := range methods {
+			types := []string{}
+			for _, atype := range methods.Types(action) {
+				types = append(types, atype.Name())
+			}
+			e.AllowedAuthenMethods[action.Name()] = types
+		}
+		e.AuthenMethodDenial = string(denial)
+	}
+	return e
+}
+
+// effectiveHandler reads the policies of h, as the server does for each connection
+func effectiveHandler(sc config.SecretConfig, h tq.Handler) EffectiveHandler {
+	e := EffectiveHandler{Type: handlerTypeName(sc.Handler.Type), Options: []string{}, DeviceGroup: tq.DefaultDeviceGroup}
+	for k := range handlerOptions(sc) {
+		e.Options = append(e.Options, k)
+	}
+	sort.Strings(e.Options)
+	if p, ok := h.(tq.DeviceGroupPolicy); ok && p.DeviceGroup() != "" {
+		e.DeviceGroup = p.DeviceGroup()
+	}
+	if p, ok := h.(tq.SessionReusePolicy); ok {
+		if v, ok := p.ImplicitSessionReuse(); ok {
+			e.ImplicitSessionReuse = &v
+		}
+	}
+	if p, ok := h.(tq.LengthQuirkPolicy); ok {
+		if delta, budget := p.LengthDelta(); delta != 0 {
+			e.LengthDelta, e.LengthDeltaBudget = delta, budget.String()
+		}
+	}
+	if p, ok := h.(tq.ConnectionLifetimePolicy); ok {
+		e.LifetimeExpiry = p.LifetimeExpiry().String()
+	}
+	if p, ok := h.(tq.InteractiveSessionPolicy); ok {
+		if max, ok := p.MaxInteractiveSessions(); ok {
+			e.MaxInteractiveSessions = &max
+		}
+	}
+	if p, ok := h.(tq.MessageProfilePolicy); ok {
+		profile := p.MessageProfile()
+		e.MessageMaxLength, e.MessageSingleLine = profile.MaxLength, profile.SingleLine
+	}
+	return e
+}
+
+// matchedPrefix returns the most specific prefix of sc that holds ip, empty if sc does not match
+// by prefix
+func matchedPrefix(sc config.SecretConfig, ip net.IP) string {
+	var matched *net.IPNet
+	for _, key := range []string{"prefixes", "fallback_prefixes"} {
+		var prefixes []string
+		if err := json.Unmarshal([]byte(sc.Options[key]), &prefixes); err != nil {
+			continue
+		}
+		for _, prefix := range prefixes {
+			_, ipNet, err := net.ParseCIDR(prefix)
+			if err != nil || !ipNet.Contains(ip) {
+				continue
+			}
+			if matched == nil {
+				matched = ipNet
+				continue
+			}
+			if ones, _ := ipNet.Mask.Size(); ones > maskOnes(matched) {
+				matched = ipNet
+			}
+		}
+	}
+	if matched == nil {
+		return ""
+	}
+	return matched.String()
+}
+
+func maskOnes(n *net.IPNet) int {
+	ones, _ := n.Mask.Size()
+	return ones
+}
+
+// effectiveUsers returns the users of a scope by name, a later duplicate replacing an earlier one
+// as it does in the build
+func effectiveUsers(users []config.User) []EffectiveUser {
+	byName := map[string]EffectiveUser{}
+	for _, u := range users {
+		e := EffectiveUser{Name: u.Name, Authenticators: []string{}, Accounters: []string{}}
+		if u.Synthetic {
+			e.Authenticators = append(e.Authenticators, "synthetic")
+			e.Accounters = append(e.Accounters, "synthetic")
+		}
+		if u.Authenticator != nil {
+			e.Authenticators = append(e.Authenticators, AuthenticatorTypeName(u.Authenticator.Type))
+		}
+		if u.Accounter != nil {
+			_, rules := u.Accounter.Options["attribute_rules"]
+			_, defaults := u.Accounter.Options["attribute_default"]
+			if rules || defaults {
+				e.Accounters = append(e.Accounters, "transform")
+			}
+			e.Accounters = append(e.Accounters, accounterTypeName(u.Accounter.Type))
+		}
+		byName[u.Name] = e
+	}
+	effective := make([]EffectiveUser, 0, len(byName))
+	for _, e := range byName {
+		effective = append(effective, e)
+	}
+	sort.Slice(effective, func(i, j int) bool { return effective[i].Name < effective[j].Name })
+	return effective
+}
+
+// ruleSetHash returns the first 16 hex characters of the sha256 of users, as localized to their
+// scope, which holds their groups, services and commands
+func ruleSetHash(users []config.User) string {
+	b, err := json.Marshal(users)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:8])
+}
+
+// AuthenticatorTypeName names t as in Effective and the status page
+func AuthenticatorTypeName(t config.AuthenticatorType) string {
+	switch t {
+	case config.BCRYPT:
+		return "bcrypt"
+	case config.SHA512:
+		return "sha512"
+	}
+	return fmt.Sprintf("unknown(%d)", int(t))
+}
+
+// accounterTypeName names t for Effective
+func accounterTypeName(t config.AccounterType) string {
+	switch t {
+	case config.STDERR:
+		return "stderr"
+	case config.SYSLOG:
+		return "syslog"
+	case config.FILE:
+		return "file"
+	}
+	return fmt.Sprintf("unknown(%d)", int(t))
+}
@@ -0,0 +1,202 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package loader
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	tq "github.com/facebookincubator/tacquito"
+	"github.com/facebookincubator/tacquito/cmds/server/config"
+	"github.com/facebookincubator/tacquito/cmds/server/config/authorizers/stringy"
+	"github.com/facebookincubator/tacquito/cmds/server/config/secret/prefix"
+	"github.com/facebookincubator/tacquito/cmds/server/handlers"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// effectiveConfig has two device groups, core with nested prefixes and edge, and a user of each
+func effectiveConfig(profile string) config.ServerConfig {
+	return config.ServerConfig{
+		Secrets: []config.SecretConfig{
+			{
+				Name:    "core",
+				Type:    config.PREFIX,
+				Secret:  config.Keychain{Group: "tacquito", Key: "core"},
+				Handler: config.Handler{Type: config.START, Options: map[string]string{"message_profile": profile}},
+				Options: map[string]string{"prefixes": `["192.0.2.0/24", "192.0.2.128/25"]`},
+			},
+			{
+				Name:    "edge",
+				Type:    config.PREFIX,
+				Handler: config.Handler{Type: config.START},
+				Options: map[string]string{"prefixes": `["198.51.100.0/24"]`},
+			},
+		},
+		Users: []config.User{
+			{
+				Name:          "alice",
+				Scopes:        []string{"core"},
+				Authenticator: &config.Authenticator{Type: config.BCRYPT, Options: map[string]string{"hash": "not-a-hash"}},
+				Accounter:     &config.Accounter{Type: config.STDERR},
+			},
+			{Name: "bob", Scopes: []string{"edge"}},
+		},
+		PrefixDeny: []string{"192.0.2.7/32"},
+	}
+}
+
+// TestEffective checks the effective policy of a device and a device group, and that it follows a
+// reload as soon as it is applied
+func TestEffective(t *testing.T) {
+	ctx := context.Background()
+	source := make(reloadSource)
+	l, err := NewLoader(ctx, source,
+		SetLoggerProvider(reloadLogger{}),
+		SetKeychainProvider(reloadKeychain{}),
+		SetConfigProvider(config.New()),
+		SetAuthorizerProvider(stringy.New(reloadLogger{})),
+		RegisterSecretProviderType(config.PREFIX, prefix.New(reloadLogger{})),
+		RegisterHandlerType(config.START, reloadHandlerFactory{}),
+		SetFingerprintKey([]byte("key")),
+		SetServerStrictness(ServerStrictness{Conformance: true, ReplyCheck: true}),
+	)
+	require.NoError(t, err)
+	_, err = l.Effective(ctx, "core")
+	assert.Error(t, err)
+	source <- effectiveConfig("")
+	l.BlockUntilLoaded()
+
+	e, err := l.Effective(ctx, "192.0.2.200")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), e.Generation)
+	assert.False(t, e.Applied.IsZero())
+	assert.Equal(t, "core", e.Group)
+	assert.Equal(t, "prefix", e.Type)
+	assert.Equal(t, "192.0.2.128/25", e.MatchedPrefix)
+	assert.Empty(t, e.PrefixFilter)
+	// hmac-sha256 of fooman, the secret of reloadKeychain, not its plain sha256 b0ac5746dd54e0ed
+	mac := hmac.New(sha256.New, []byte("key"))
+	mac.Write([]byte("fooman"))
+	assert.Equal(t, hex.EncodeToString(mac.Sum(nil)[:8]), e.SecretFingerprint)
+	assert.NotEqual(t, "b0ac5746dd54e0ed", e.SecretFingerprint)
+	assert.Equal(t, ServerStrictness{Conformance: true, ReplyCheck: true}, e.Strictness.ServerStrictness)
+	assert.Equal(t, tq.DefaultStringNormalization.InvalidUTF8.String(), e.Strictness.InvalidUTF8)
+	assert.Equal(t, EffectiveHandler{Type: "start", Options: []string{"device_group", "message_profile"}, DeviceGroup: "default"}, e.Handler)
+	assert.Equal(t, []EffectiveUser{{Name: "alice", Authenticators: []string{"bcrypt"}, Accounters: []string{"stderr"}}}, e.Users)
+	b, err := json.Marshal(e)
+	require.NoError(t, err)
+	assert.NotContains(t, string(b), "fooman")
+	assert.NotContains(t, string(b), "not-a-hash")
+
+	denied, err := l.Effective(ctx, "192.0.2.7")
+	require.NoError(t, err)
+	assert.Equal(t, "deny", denied.PrefixFilter)
+	assert.Equal(t, "192.0.2.0/24", denied.MatchedPrefix)
+
+	byName, err := l.Effective(ctx, "core")
+	require.NoError(t, err)
+	assert.Equal(t, e.SecretFingerprint, byName.SecretFingerprint)
+	assert.Equal(t, e.RuleSetHash, byName.RuleSetHash)
+	assert.Empty(t, byName.MatchedPrefix)
+
+	edge, err := l.Effective(ctx, "198.51.100.1")
+	require.NoError(t, err)
+	assert.Equal(t, "edge", edge.Group)
+	assert.NotEqual(t, e.RuleSetHash, edge.RuleSetHash)
+	_, err = l.Effective(ctx, "203.0.113.1")
+	assert.Error(t, err)
+	_, err = l.Effective(ctx, "nope")
+	assert.Error(t, err)
+
+	// the dump follows a reload as soon as it is applied
+	next := effectiveConfig("ios")
+	next.Users[0].Commands = []config.Command{{Name: "show", Match: []string{"version"}, Action: config.PERMIT}}
+	source <- next
+	require.Eventually(t, func() bool {
+		return l.current.Load().(*snapshot).generation == 2
+	}, 5*time.Second, time.Millisecond)
+	reloaded, err := l.Effective(ctx, "192.0.2.200")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), reloaded.Generation)
+	assert.False(t, reloaded.Applied.Before(e.Applied))
+	assert.NotEqual(t, e.RuleSetHash, reloaded.RuleSetHash)
+	assert.Equal(t, e.SecretFingerprint, reloaded.SecretFingerprint)
+}
+
+// cutoverKeychain returns the key of each keychain entry as its secret
+type cutoverKeychain struct{}
+
+func (cutoverKeychain) Add(k config.Keychain) func(context.Context, string) ([]byte, error) {
+	return func(context.Context, string) ([]byte, error) { return []byte(k.Key), nil }
+}
+
+// TestCutoverSecrets checks that the cutover secrets of the group of a device are served by role
+func TestCutoverSecrets(t *testing.T) {
+	ctx := context.Background()
+	source := make(reloadSource)
+	l, err := NewLoader(ctx, source,
+		SetLoggerProvider(reloadLogger{}),
+		SetKeychainProvider(cutoverKeychain{}),
+		SetConfigProvider(config.New()),
+		SetAuthorizerProvider(stringy.New(reloadLogger{})),
+		RegisterSecretProviderType(config.PREFIX, prefix.New(reloadLogger{})),
+		RegisterHandlerType(config.START, reloadHandlerFactory{}),
+	)
+	require.NoError(t, err)
+	c := effectiveConfig("")
+	c.Secrets[0].Cutover = []config.CutoverSecret{
+		{Role: "next", Secret: config.Keychain{Group: "tacquito", Key: "core-next"}},
+		{Role: "old", Secret: config.Keychain{Group: "tacquito", Key: "core-old"}},
+	}
+	source <- c
+	l.BlockUntilLoaded()
+
+	// the secret with an unknown role is not served
+	secrets, err := l.CutoverSecrets(ctx, &net.TCPAddr{IP: net.ParseIP("192.0.2.200"), Port: 49152})
+	require.NoError(t, err)
+	assert.Equal(t, []tq.RoleSecret{{Role: tq.SecretRoleNext, Secret: []byte("core-next")}}, secrets)
+	secrets, err = l.CutoverSecrets(ctx, &net.TCPAddr{IP: net.ParseIP("198.51.100.1")})
+	require.NoError(t, err)
+	assert.Empty(t, secrets)
+	secrets, err = l.CutoverSecrets(ctx, &net.TCPAddr{IP: net.ParseIP("203.0.113.1")})
+	require.NoError(t, err)
+	assert.Empty(t, secrets)
+
+	r := Preflight(c)
+	require.Len(t, r.Warnings, 1)
+	assert.Contains(t, r.Warnings[0], "[core]")
+}
+
+// TestEffectiveStrictness checks that the checks of a start handler are read through its response
+// logger
+func TestEffectiveStrictness(t *testing.T) {
+	h := handlers.NewStart(reloadLogger{}).New(context.Background(), nil, map[string]string{
+		"allowed_services":       `["login", "enable"]`,
+		"allowed_authen_methods": `{"login": ["pap"]}`,
+		"authen_method_denial":   "restart",
+		"invalid_utf8":           "replace",
+	})
+	e := effectiveStrictness(h)
+	assert.Equal(t, []string{"login", "enable"}, e.AllowedServices)
+	assert.Equal(t, map[string][]string{"login": {"pap"}}, e.AllowedAuthenMethods)
+	assert.Equal(t, "restart", e.AuthenMethodDenial)
+	assert.Equal(t, "replace", e.InvalidUTF8)
+
+	// an unrestricted handler reports no restrictions
+	e = effectiveStrictness(handlers.NewStart(reloadLogger{}).New(context.Background(), nil, nil))
+	assert.Nil(t, e.AllowedServices)
+	assert.Nil(t, e.AllowedAuthenMethods)
+}
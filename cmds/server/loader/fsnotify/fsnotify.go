@@ -15,6 +15,7 @@ import (
 	"fmt"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/facebookincubator/tacquito/cmds/server/config"
@@ -40,6 +41,15 @@ type Watcher struct {
 	ctx      context.Context
 	watchman *fsnotify.Watcher
 	config   chan config.ServerConfig
+
+	// reloading serializes reloads from the watch and from Reload
+	reloading sync.Mutex
+
+	// mu protects path, lastReload and lastReloadErr
+	mu            sync.Mutex
+	path          string
+	lastReload    time.Time
+	lastReloadErr error
 }
 
 // New ...
@@ -49,7 +59,7 @@ func New(ctx context.Context, l loader, logger loggerProvider) *Watcher {
 
 // Load ...
 func (w *Watcher) Load(path string) error {
-	if err := w.loader.Load(path); err != nil {
+	if err := w.reload(path); err != nil {
 		return fmt.Errorf("loader failed: %v", err)
 	}
 
@@ -96,7 +106,7 @@ func (w *Watcher) watch(path string) {
 			if pending > 0 {
 				pending = 0
 				w.Infof(w.ctx, "reloading config [%v]", path)
-				if err := w.loader.Load(path); err != nil {
+				if err := w.reload(path); err != nil {
 					w.Errorf(w.ctx, "bad config for path [%v]: %v", path, err)
 				}
 			}
@@ -104,6 +114,39 @@ func (w *Watcher) watch(path string) {
 	}
 }
 
+// Reload loads the config again without waiting for the file to change, eg when asked from the
+// admin api.  A failed reload leaves the previous config in place.
+func (w *Watcher) Reload() error {
+	w.mu.Lock()
+	path := w.path
+	w.mu.Unlock()
+	if path == "" {
+		return fmt.Errorf("no config was loaded yet")
+	}
+	return w.reload(path)
+}
+
+// reload loads path, recording when and how it went for LastReload
+func (w *Watcher) reload(path string) error {
+	w.reloading.Lock()
+	defer w.reloading.Unlock()
+	err := w.loader.Load(path)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.path = path
+	w.lastReload = time.Now()
+	w.lastReloadErr = err
+	return err
+}
+
+// LastReload returns when the config was last loaded, and the error if that load failed.  A
+// failed reload leaves the previous config in place.
+func (w *Watcher) LastReload() (time.Time, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.lastReload, w.lastReloadErr
+}
+
 // Config ...
 func (w *Watcher) Config() chan config.ServerConfig {
 	return w.loader.Config()
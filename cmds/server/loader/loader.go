@@ -10,12 +10,19 @@ package loader
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/subtle"
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	tq "github.com/facebookincubator/tacquito"
 	"github.com/facebookincubator/tacquito/cmds/server/config"
+	"github.com/facebookincubator/tacquito/cmds/server/config/accounters/transform"
+	"github.com/facebookincubator/tacquito/cmds/server/config/synthetic"
+	"github.com/facebookincubator/tacquito/extension"
 )
 
 // loggerProvider provides the logging implementation
@@ -35,29 +42,10 @@ type providerFactory interface {
 	New(users map[string]*config.AAA) config.Provider
 }
 
-// secretProviderFactory provides a new tq.SecretProvider
-type secretProviderFactory interface {
-	New(ctx context.Context, sc config.SecretConfig, h tq.Handler, secret func(context.Context, string) ([]byte, error)) tq.SecretProvider
-}
-
-// handlerFactory provides new handler types
-type handlerFactory interface {
-	New(ctx context.Context, cp config.Provider, options map[string]string) tq.Handler
-}
-
-// authenticatorFactory provides new authenticator types
-type authenticatorFactory interface {
-	New(username string, options map[string]string) (tq.Handler, error)
-}
-
-// accounterFactory provides new accounter types
-type accounterFactory interface {
-	New(options map[string]string) tq.Handler
-}
-
-// authorizerFactory provides new authorizer types
-type authorizerFactory interface {
-	New(user config.User) (tq.Handler, error)
+// buildObserver is implemented by factories that keep state across builds, eg caches, and are
+// told each time a build completes
+type buildObserver interface {
+	BuildDone()
 }
 
 // localloader represents a config loader
@@ -82,12 +70,18 @@ func SetLoggerProvider(log loggerProvider) Option {
 }
 
 // RegisterHandlerType ...
-func RegisterHandlerType(t config.HandlerType, h handlerFactory) Option {
+func RegisterHandlerType(t config.HandlerType, h config.HandlerFactory) Option {
 	return func(l *Loader) {
 		l.handlerTypes[t] = h
 	}
 }
 
+// keychainValidator may be implemented by a keychainProvider that knows up front if it holds the
+// secret of a keychain, such as env.Keychain
+type keychainValidator interface {
+	Validate(k config.Keychain) error
+}
+
 // SetKeychainProvider ..
 func SetKeychainProvider(k keychainProvider) Option {
 	return func(l *Loader) {
@@ -103,33 +97,50 @@ func SetConfigProvider(c providerFactory) Option {
 }
 
 // SetAuthorizerProvider ...
-func SetAuthorizerProvider(a authorizerFactory) Option {
+func SetAuthorizerProvider(a config.AuthorizerFactory) Option {
 	return func(l *Loader) {
 		l.authorizerProvider = a
 	}
 }
 
 // RegisterSecretProviderType ...
-func RegisterSecretProviderType(t config.ProviderType, sp secretProviderFactory) Option {
+func RegisterSecretProviderType(t config.ProviderType, sp extension.SecretProviderFactory) Option {
 	return func(l *Loader) {
 		l.providerTypes[t] = sp
 	}
 }
 
 // RegisterAuthenticator ...
-func RegisterAuthenticator(t config.AuthenticatorType, a authenticatorFactory) Option {
+func RegisterAuthenticator(t config.AuthenticatorType, a extension.AuthenticatorFactory) Option {
 	return func(l *Loader) {
 		l.authenticatorTypes[t] = a
 	}
 }
 
 // RegisterAccounter ...
-func RegisterAccounter(t config.AccounterType, a accounterFactory) Option {
+func RegisterAccounter(t config.AccounterType, a extension.AccounterFactory) Option {
 	return func(l *Loader) {
 		l.accounterTypes[t] = a
 	}
 }
 
+// SetFingerprintKey sets the key of the hmac that fingerprints secrets in Effective.  Servers that
+// share the key report the same fingerprint for the same secret.  Without it a random key is used,
+// so fingerprints only compare within one process.
+func SetFingerprintKey(key []byte) Option {
+	return func(l *Loader) {
+		l.fingerprintKey = append([]byte(nil), key...)
+	}
+}
+
+// SetServerStrictness sets the server wide checks Effective reports, as the server was configured
+// with them
+func SetServerStrictness(v ServerStrictness) Option {
+	return func(l *Loader) {
+		l.strictness = v
+	}
+}
+
 // NewLocalConfig will create a new Loader that will take loader provided config and turn it into
 // actionable server config types
 func NewLocalConfig(ctx context.Context, path string, ll localloader, opts ...Option) (*Loader, error) {
@@ -144,12 +155,14 @@ func NewLoader(ctx context.Context, l unmarshaled, opts ...Option) (*Loader, err
 	wl := &Loader{
 		ctx:                ctx,
 		unmarshaled:        l,
-		providerTypes:      make(map[config.ProviderType]secretProviderFactory),
-		authenticatorTypes: make(map[config.AuthenticatorType]authenticatorFactory),
-		accounterTypes:     make(map[config.AccounterType]accounterFactory),
-		handlerTypes:       make(map[config.HandlerType]handlerFactory),
-		query:              make(chan queryGet),
+		providerTypes:      make(map[config.ProviderType]extension.SecretProviderFactory),
+		authenticatorTypes: make(map[config.AuthenticatorType]extension.AuthenticatorFactory),
+		accounterTypes:     make(map[config.AccounterType]extension.AccounterFactory),
+		handlerTypes:       make(map[config.HandlerType]config.HandlerFactory),
+		current:            &atomic.Value{},
 		warm:               make(chan struct{}),
+		status:             &loaderStatus{},
+		rotations:          make(chan string, rotationBuffer),
 	}
 	for _, opt := range opts {
 		opt(wl)
@@ -166,6 +179,12 @@ func NewLoader(ctx context.Context, l unmarshaled, opts ...Option) (*Loader, err
 	if wl.authorizerProvider == nil {
 		return nil, fmt.Errorf("please provide an authorizer provider")
 	}
+	if len(wl.fingerprintKey) == 0 {
+		wl.fingerprintKey = make([]byte, 32)
+		if _, err := rand.Read(wl.fingerprintKey); err != nil {
+			return nil, fmt.Errorf("unable to generate a fingerprint key; %w", err)
+		}
+	}
 	go wl.updates()
 	return wl, nil
 }
@@ -177,13 +196,24 @@ type Loader struct {
 	ctx                context.Context
 	keychainProvider   keychainProvider
 	configProvider     providerFactory
-	authorizerProvider authorizerFactory
-	providerTypes      map[config.ProviderType]secretProviderFactory
-	authenticatorTypes map[config.AuthenticatorType]authenticatorFactory
-	accounterTypes     map[config.AccounterType]accounterFactory
-	handlerTypes       map[config.HandlerType]handlerFactory
-	query              chan queryGet
+	authorizerProvider config.AuthorizerFactory
+	providerTypes      map[config.ProviderType]extension.SecretProviderFactory
+	authenticatorTypes map[config.AuthenticatorType]extension.AuthenticatorFactory
+	accounterTypes     map[config.AccounterType]extension.AccounterFactory
+	handlerTypes       map[config.HandlerType]config.HandlerFactory
 	warm               chan struct{}
+	status             *loaderStatus
+	// fingerprintKey keys the secret fingerprints of Effective, see SetFingerprintKey
+	fingerprintKey []byte
+	// strictness are the server wide checks Effective reports, see SetServerStrictness
+	strictness ServerStrictness
+
+	// rotations reports the device groups whose secret a reload changed, see SecretRotations
+	rotations chan string
+
+	// current holds the *snapshot of the last build.  Builds replace it whole and never modify it,
+	// so Get reads it without locks and is never held up by a build.
+	current *atomic.Value
 }
 
 // BlockUntilLoaded will block until we are warmed up with parsed config
@@ -194,12 +224,41 @@ func (l Loader) BlockUntilLoaded() {
 // Get implements tq.SecretProvider.  The underlying user types and associated configs
 // are protected by this method.
 func (l Loader) Get(ctx context.Context, remote net.Addr) ([]byte, tq.Handler, error) {
-	q := queryGet{ctx: ctx, remote: remote, cb: make(chan secretProvider)}
-	l.query <- q
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
 	secretProviderGet.Inc()
-	sp := <-q.cb
-	secretProviderGet.Dec()
-	return sp.secret, sp.handler, sp.err
+	defer secretProviderGet.Dec()
+	current, _ := l.current.Load().(*snapshot)
+	if current == nil {
+		current = &snapshot{prefixDeny: newPrefixFilter(nil), prefixAllow: newPrefixFilter(nil)}
+	}
+	// prefixFilter will log to prom counters and also act as a quick fail for prefixes that do not pass
+	// muster.  this pevents unnecessary load on scanning SecretProviders
+	if current.prefixDeny.deny(remote) {
+		l.Infof(l.ctx, "remote address connection not allowed by prefixDeny filter [%v]", remote.String())
+	}
+	if !current.prefixAllow.allow(remote) {
+		l.Infof(l.ctx, "remote address connection not allowed by prefixAllow filter [%v]", remote.String())
+	}
+	defer buildGet.Inc()
+	return l.get(ctx, current.providers, remote)
+}
+
+// Warm implements tq.SecretWarmer.  Each device is looked up as a connection from it would be,
+// so secret providers that fetch or resolve lazily, eg by dns, have done so before it connects.
+func (l Loader) Warm(ctx context.Context, devices []net.Addr) (int, error) {
+	var warmed int
+	for _, device := range devices {
+		secret, _, err := l.Get(ctx, device)
+		if ctx.Err() != nil {
+			return warmed, ctx.Err()
+		}
+		if err == nil && secret != nil {
+			warmed++
+		}
+	}
+	return warmed, nil
 }
 
 // get is a protected method that searches for a matching provider.  we first check the
@@ -218,40 +277,177 @@ func (l Loader) get(ctx context.Context, providers []tq.SecretProvider, remote n
 	return nil, nil, fmt.Errorf("remote [%v] has no secret providers", remote)
 }
 
-// updates is the protected update/query loop for Loader
+// CutoverSecrets implements tq.SecretCutoverProvider.  The device at remote is matched to its
+// group as by Get, and the cutover secrets of the group are read from the keychain.
+func (l Loader) CutoverSecrets(ctx context.Context, remote net.Addr) ([]tq.RoleSecret, error) {
+	current, _ := l.current.Load().(*snapshot)
+	if current == nil || !current.cutover() {
+		return nil, nil
+	}
+	for _, g := range current.groups {
+		secret, handler, err := g.provider.Get(ctx, remote)
+		if err != nil || secret == nil || handler == nil {
+			continue
+		}
+		host := remote.String()
+		if addr, ok := remote.(*net.TCPAddr); ok {
+			host = addr.IP.String()
+		}
+		secrets := make([]tq.RoleSecret, 0, len(g.cutover))
+		for _, c := range g.cutover {
+			v, err := c.secret(ctx, host)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read the %v secret of secret config [%v]; %w", c.role, g.config.Name, err)
+			}
+			secrets = append(secrets, tq.RoleSecret{Role: c.role, Secret: v})
+		}
+		return secrets, nil
+	}
+	return nil, nil
+}
+
+// validateKeychains returns an error if the keychain provider cannot tell it holds the secret of
+// provider, or of one of its cutover secrets
+func (l Loader) validateKeychains(provider config.SecretConfig) error {
+	v, ok := l.keychainProvider.(keychainValidator)
+	if !ok {
+		return nil
+	}
+	if err := v.Validate(provider.Secret); err != nil {
+		return err
+	}
+	for _, c := range provider.Cutover {
+		if err := v.Validate(c.Secret); err != nil {
+			return fmt.Errorf("cutover secret; %w", err)
+		}
+	}
+	return nil
+}
+
+// cutoverSecret is a secret a group serves alongside its own during a cutover
+type cutoverSecret struct {
+	role   tq.SecretRole
+	secret func(context.Context, string) ([]byte, error)
+}
+
+// cutoverSecrets returns the cutover secrets of provider.  Secrets with an unknown role are
+// logged and not served.
+func (l *Loader) cutoverSecrets(provider config.SecretConfig) []cutoverSecret {
+	var secrets []cutoverSecret
+	for _, c := range provider.Cutover {
+		role, err := tq.ParseSecretRole(c.Role)
+		if err != nil {
+			l.Errorf(l.ctx, "cutover secret of secret config [%v] will not be served; %v", provider.Name, err)
+			continue
+		}
+		secrets = append(secrets, cutoverSecret{role: role, secret: l.keychainProvider.Add(c.Secret)})
+	}
+	return secrets
+}
+
+// snapshot is the result of a build, which Get serves from
+type snapshot struct {
+	providers   []tq.SecretProvider
+	prefixDeny  *prefixFilter
+	prefixAllow *prefixFilter
+	// groups are the device groups providers were built from, in the same order, see Effective
+	groups []*builtGroup
+	// generation counts the configs applied, and applied is when this one was
+	generation int64
+	applied    time.Time
+}
+
+// cutover reports if any group of s serves cutover secrets
+func (s *snapshot) cutover() bool {
+	for _, g := range s.groups {
+		if len(g.cutover) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// updates builds each config in turn and swaps it in once it is complete.  Builds can take a
+// while for large configs, eg compiling thousands of command regexes, and requests meanwhile are
+// served from the previous build.
 func (l *Loader) updates() {
 	var warm sync.Once
-	// providers lives here so as to remain protected from data race conditions on update/get
-	providers := []tq.SecretProvider{}
-	// prefix filters are here for the same reason, race condition protection
-	prefixDeny, prefixAllow := newPrefixFilter(nil), newPrefixFilter(nil)
-	for {
+	var generation int64
+	for c := range l.Config() {
+		generation++
+		next := &snapshot{groups: l.build(c), generation: generation}
+		for _, g := range next.groups {
+			next.providers = append(next.providers, g.provider)
+		}
+		l.Infof(l.ctx, "updated all providers from config source")
+		next.prefixDeny, next.prefixAllow = l.createPrefixFilters(c)
+		l.Infof(l.ctx, "updated all prefix filters, where available, from config source")
+		next.applied = time.Now()
+		previous, _ := l.current.Load().(*snapshot)
+		l.current.Store(next)
+		l.rotated(previous, next)
+		if o, ok := l.authorizerProvider.(buildObserver); ok {
+			o.BuildDone()
+		}
+		l.setStatus(c, time.Now())
+		buildUpdate.Inc()
+		// notify that we are warmed, but one time only
+		warm.Do(func() { close(l.warm) })
+	}
+}
+
+// rotationBuffer is how many secret rotations wait for the server to read them
+const rotationBuffer = 64
+
+// SecretRotations implements tq.SecretRotationNotifier.  A reload that changes the secret of a
+// secret config reports its device group, so the server retires the connections on the old secret.
+func (l Loader) SecretRotations() <-chan string {
+	return l.rotations
+}
+
+// rotated reports the device groups of next whose secret differs from the one they had in previous.
+// Groups are matched by the name of their secret config.
+func (l *Loader) rotated(previous, next *snapshot) {
+	if previous == nil {
+		return
+	}
+	old := make(map[string]*builtGroup, len(previous.groups))
+	for _, g := range previous.groups {
+		old[g.config.Name] = g
+	}
+	for _, g := range next.groups {
+		p, ok := old[g.config.Name]
+		if !ok || !secretRotated(l.ctx, p, g) {
+			continue
+		}
+		group := handlerOptions(g.config)["device_group"]
+		l.Infof(l.ctx, "secret of secret config [%v] was rotated, retiring the connections of device group [%v]", g.config.Name, group)
 		select {
-		case c := <-l.Config():
-			providers = l.build(c)
-			l.Infof(l.ctx, "updated all providers from config source")
-			prefixDeny, prefixAllow = l.createPrefixFilters(c)
-			l.Infof(l.ctx, "updated all prefix filters, where available, from config source")
-			buildUpdate.Inc()
-			// notify that we are warmed, but one time only
-			warm.Do(func() { close(l.warm) })
-		case q := <-l.query:
-			// prefixFilter will log to prom counters and also act as a quick fail for prefixes that do not pass
-			// muster.  this pevents unnecessary load on scanning SecretProviders
-			if prefixDeny.deny(q.remote) {
-				l.Infof(l.ctx, "remote address connection not allowed by prefixDeny filter [%v]", q.remote.String())
-			}
-			if !prefixAllow.allow(q.remote) {
-				l.Infof(l.ctx, "remote address connection not allowed by prefixAllow filter [%v]", q.remote.String())
-			}
-			secret, handler, err := l.get(q.ctx, providers, q.remote)
-			q.cb <- secretProvider{secret: secret, handler: handler, err: err}
-			close(q.cb)
-			buildGet.Inc()
+		case l.rotations <- group:
+			secretRotations.Inc()
+		default:
+			l.Errorf(l.ctx, "secret rotation of device group [%v] dropped, the server is not reading rotations", group)
 		}
 	}
 }
 
+// secretRotated reports if the secret of next differs from that of previous, by keychain reference
+// or, where both can be read, by value
+func secretRotated(ctx context.Context, previous, next *builtGroup) bool {
+	if previous.config.Secret != next.config.Secret {
+		return true
+	}
+	a, err := previous.secret(ctx, "")
+	if err != nil {
+		return false
+	}
+	b, err := next.secret(ctx, "")
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(a, b) != 1
+}
+
 // createPrefixFilters inits new filters based on config
 func (l *Loader) createPrefixFilters(c config.ServerConfig) (*prefixFilter, *prefixFilter) {
 	prefixDeny := newPrefixFilter(strToIPNet(c.PrefixDeny))
@@ -273,30 +469,39 @@ func strToIPNet(prefixes []string) []*net.IPNet {
 	return allowed
 }
 
-type secretProvider struct {
-	secret  []byte
-	handler tq.Handler
-	err     error
-}
-
-type queryGet struct {
-	ctx    context.Context
-	remote net.Addr
-	cb     chan secretProvider
-}
-
 // build is admittedly complex.  This is a design tradeoff for allowing a lot of dependency injection options that
 // also span an undefined number of config format representations.  Build glues all of these injected types together
 // into an internal representation that the server can use.  Build is best effort under all circumstances.  Injected
 // dependencies that are misconfigured or incomplete, or config itself that is the same, can result in a server running
 // without any config.  In that case, all client calls to the service will fail closed.
-func (l Loader) build(c config.ServerConfig) []tq.SecretProvider {
-	providers := make([]tq.SecretProvider, 0, len(c.Secrets))
+func (l Loader) build(c config.ServerConfig) []*builtGroup {
+	groups := make([]*builtGroup, 0, len(c.Secrets))
+	report := Preflight(c)
+	if len(report.SyntheticUsers) > 0 {
+		l.Infof(l.ctx, "synthetic users %v", report.SyntheticUsers)
+	}
+	for _, w := range report.Warnings {
+		l.Errorf(l.ctx, "preflight: %v", w)
+	}
 	for _, provider := range c.Secrets {
 		// TODO add stringer to provider.Type
 		l.Infof(l.ctx, "processing secret config [%v:%v]", provider.Name, provider.Type)
+		if _, err := authenMethods(provider); err != nil {
+			// the group fails closed rather than serve methods it was meant to refuse
+			l.Errorf(l.ctx, "invalid secret config [%v]; skipping scope; %v", provider.Name, err)
+			secretConfigInvalid.Inc()
+			continue
+		}
+		if err := l.validateKeychains(provider); err != nil {
+			// the group fails closed rather than be served with no secret
+			l.Errorf(l.ctx, "invalid secret config [%v]; skipping scope; %v", provider.Name, err)
+			secretConfigInvalid.Inc()
+			continue
+		}
 		// extract scoped user map
 		users := map[string]*config.AAA{}
+		group := &builtGroup{config: provider}
+		var scoped []config.User
 		for _, u := range c.Users {
 			// does this user belong to this scope?
 			if !u.HasScope(provider.Name) {
@@ -325,7 +530,7 @@ func (l Loader) build(c config.ServerConfig) []tq.SecretProvider {
 				opts = append(opts, config.SetAAAAuthorizer(a))
 			} else {
 				userAuthorizerUnassigned.Inc()
-				l.Infof(l.ctx, "no authorizer available in scope [%v] for user [%v]", provider.Name, u.Name)
+				l.Infof(l.ctx, "no authorizer available in scope [%v] for user [%v]; %v", provider.Name, u.Name, err)
 			}
 
 			if u.Authenticator != nil {
@@ -347,14 +552,33 @@ func (l Loader) build(c config.ServerConfig) []tq.SecretProvider {
 			if u.Accounter != nil {
 				acf := l.accounterTypes[u.Accounter.Type]
 				if acf != nil {
-					opts = append(opts, config.SetAAAAccounter(acf.New(u.Accounter.Options)))
+					a, err := l.newAccounter(acf, u.Accounter.Options)
+					if err != nil {
+						userAccounterBadConfigRef.Inc()
+						l.Errorf(l.ctx, "accounter error in scope [%v], user [%v] will not be added; %v", provider.Name, u.Name, err)
+						continue
+					}
+					opts = append(opts, config.SetAAAAccounter(a))
 				} else {
 					userAccounterUnassigned.Inc()
 					l.Errorf(l.ctx, "no accounter assigned to accounter type [%v] in scope [%v] on user [%v]", u.Accounter.Type, provider.Name, u.Name)
 				}
 			}
+			aaa := config.NewAAA(opts...)
+			if u.Synthetic {
+				constraint, err := synthetic.New(l.loggerProvider, u.Sources)
+				if err != nil {
+					userSyntheticBadConfig.Inc()
+					l.Errorf(l.ctx, "synthetic user error in scope [%v], user [%v] will not be added; %v", provider.Name, u.Name, err)
+					continue
+				}
+				aaa.Authenticate = constraint.Authenticator(aaa.Authenticate)
+				aaa.Authorizer = constraint.Authorizer()
+				aaa.Accounting = constraint.Accounter(aaa.Accounting)
+			}
 			l.Debugf(l.ctx, "loaded user [%v] into scope [%v]", u.Name, provider.Name)
-			users[u.Name] = config.NewAAA(opts...)
+			users[u.Name] = aaa
+			scoped = append(scoped, u)
 			userTotal.Inc()
 		}
 		if len(users) == 0 {
@@ -369,7 +593,7 @@ func (l Loader) build(c config.ServerConfig) []tq.SecretProvider {
 			continue
 		}
 		userConfig := l.configProvider.New(users)
-		handler := handlerType.New(l.ctx, userConfig, provider.Handler.Options)
+		handler := handlerType.New(l.ctx, userConfig, handlerOptions(provider))
 		providerType := l.providerTypes[provider.Type]
 		if providerType == nil {
 			l.Errorf(l.ctx, "no provider assigned to provider type [%v] in scope [%v]; [%v] users not added", provider.Type, provider.Name, len(users))
@@ -377,15 +601,56 @@ func (l Loader) build(c config.ServerConfig) []tq.SecretProvider {
 			continue
 		}
 		secretFunc := l.keychainProvider.Add(provider.Secret)
-		p := providerType.New(l.ctx, provider, handler, secretFunc)
+		p := providerType.New(l.ctx, extension.SecretConfig{Name: provider.Name, Options: provider.Options}, handler, secretFunc)
 		if p == nil {
 			l.Errorf(l.ctx, "provider factory is nil in scope [%v]; no users will be added", provider.Name)
 			providerFactoryMissing.Inc()
 			continue
 		}
-		providers = append(providers, p)
+		group.provider, group.handler, group.secret = p, handler, secretFunc
+		group.cutover = l.cutoverSecrets(provider)
+		group.users, group.ruleSetHash = effectiveUsers(scoped), ruleSetHash(scoped)
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// handlerOptions returns the handler options of provider, with device_group defaulting to the name
+// of provider so feature usage is reported by secret config
+func handlerOptions(provider config.SecretConfig) map[string]string {
+	if _, ok := provider.Handler.Options["device_group"]; ok {
+		return provider.Handler.Options
+	}
+	options := make(map[string]string, len(provider.Handler.Options)+1)
+	for k, v := range provider.Handler.Options {
+		options[k] = v
+	}
+	options["device_group"] = provider.Name
+	return options
+}
+
+// newAccounter creates an accounter from acf.  An accounter that declares tq.SinkLimits is wrapped
+// so every request is cut to them.  If options hold attribute_rules or attribute_default, the
+// accounter is wrapped so the rules are applied to every request before it is accounted.
+func (l Loader) newAccounter(acf extension.AccounterFactory, options map[string]string) (tq.Handler, error) {
+	a := acf.New(options)
+	if ls, ok := a.(tq.LimitedSink); ok {
+		// after the rules, which may shorten values themselves
+		a = transform.NewTruncator(l.loggerProvider, ls.SinkLimits(), a)
+	}
+	raw, hasRules := options["attribute_rules"]
+	_, hasDefault := options["attribute_default"]
+	if !hasRules && !hasDefault {
+		return a, nil
+	}
+	var rules []transform.Rule
+	if hasRules {
+		var err error
+		if rules, err = transform.ParseRules(raw); err != nil {
+			return nil, err
+		}
 	}
-	return providers
+	return transform.New(l.loggerProvider, rules, a, transform.ParseOptions(options)...)
 }
 
 // reduceAuthenticatorAccounterFromGroups applies authenticators and accounters from groups down to the user level.
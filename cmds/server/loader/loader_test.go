@@ -0,0 +1,38 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package loader
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/facebookincubator/tacquito/cmds/server/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetCanceled(t *testing.T) {
+	// Get never waits on a build, see TestReloadUnderLoad, but still honors a canceled context
+	l := Loader{current: &atomic.Value{}}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err := l.Get(ctx, &net.TCPAddr{IP: net.ParseIP("192.0.2.1")})
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestHandlerOptionsDeviceGroup(t *testing.T) {
+	sc := config.SecretConfig{Name: "core", Handler: config.Handler{Options: map[string]string{"message_profile": "ios"}}}
+	assert.Equal(t, map[string]string{"message_profile": "ios", "device_group": "core"}, handlerOptions(sc))
+	// the config is not modified
+	assert.NotContains(t, sc.Handler.Options, "device_group")
+
+	sc.Handler.Options["device_group"] = "edge"
+	assert.Equal(t, "edge", handlerOptions(sc)["device_group"])
+	assert.Equal(t, "core", handlerOptions(config.SecretConfig{Name: "core"})["device_group"])
+}
@@ -0,0 +1,105 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package loader
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	tq "github.com/facebookincubator/tacquito"
+	"github.com/facebookincubator/tacquito/cmds/server/config"
+	"github.com/facebookincubator/tacquito/cmds/server/config/synthetic"
+)
+
+// PreflightReport describes the parts of a config that deserve attention before it is served
+type PreflightReport struct {
+	// SyntheticUsers are the names of users marked synthetic
+	SyntheticUsers []string
+	// Warnings are problems that do not prevent the config from loading
+	Warnings []string
+	// Errors are problems that keep a secret config from loading, its devices fail closed
+	Errors []string
+}
+
+// Preflight inspects c without building it
+func Preflight(c config.ServerConfig) PreflightReport {
+	var r PreflightReport
+	for _, u := range c.Users {
+		if !u.Synthetic {
+			continue
+		}
+		r.SyntheticUsers = append(r.SyntheticUsers, u.Name)
+		if len(u.Sources) == 0 {
+			r.Warnings = append(r.Warnings, fmt.Sprintf("synthetic user [%v] has no sources; it is limited to %v", u.Name, synthetic.DefaultSources))
+		}
+	}
+	for _, sc := range c.Secrets {
+		methods, err := authenMethods(sc)
+		switch {
+		case err != nil:
+			r.Errors = append(r.Errors, fmt.Sprintf("secret config [%v] will not load; %v", sc.Name, err))
+		case methods != nil && methods.Empty():
+			r.Warnings = append(r.Warnings, fmt.Sprintf("secret config [%v] allows no authen methods; every authentication of its devices fails", sc.Name))
+		}
+		for _, cutover := range sc.Cutover {
+			if _, err := tq.ParseSecretRole(cutover.Role); err != nil {
+				r.Warnings = append(r.Warnings, fmt.Sprintf("secret config [%v] has a cutover secret that will not be served; %v", sc.Name, err))
+			}
+		}
+	}
+	return r
+}
+
+// authenMethods returns the allowed_authen_methods of sc, nil if it sets none, or an error if they
+// or allowed_services do not parse, or they conflict with another handler option that needs ascii
+// logins
+func authenMethods(sc config.SecretConfig) (tq.AuthenMethods, error) {
+	options := sc.Handler.Options
+	if v, ok := options["allowed_services"]; ok {
+		var services []string
+		if err := json.Unmarshal([]byte(v), &services); err != nil {
+			return nil, fmt.Errorf("allowed_services must be a json list of authen_service names; %w", err)
+		}
+	}
+	if v, ok := options["authen_method_denial"]; ok {
+		if _, err := tq.ParseAuthenMethodDenial(v); err != nil {
+			return nil, err
+		}
+	}
+	v, ok := options["allowed_authen_methods"]
+	if !ok {
+		return nil, nil
+	}
+	methods, err := tq.ParseAuthenMethods(v)
+	if err != nil {
+		return nil, fmt.Errorf("allowed_authen_methods; %w", err)
+	}
+	if methods.Allows(tq.AuthenActionLogin, tq.AuthenTypeASCII) {
+		return methods, nil
+	}
+	if needs := asciiRequirements(options); len(needs) > 0 {
+		return nil, fmt.Errorf("allowed_authen_methods allows no ascii login, which %v needs", strings.Join(needs, " and "))
+	}
+	return methods, nil
+}
+
+// asciiRequirements returns the handler options that only work over ascii logins.  Enable requests
+// prompt for their password, so a group that allows the enable service needs ascii logins.
+func asciiRequirements(options map[string]string) []string {
+	var needs []string
+	var services []string
+	if err := json.Unmarshal([]byte(options["allowed_services"]), &services); err == nil {
+		for _, name := range services {
+			if svc, ok := tq.AuthenServiceByName(name); ok && svc == tq.AuthenServiceEnable {
+				needs = append(needs, "allowed_services [enable]")
+			}
+		}
+	}
+	return needs
+}
@@ -0,0 +1,52 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package loader
+
+import (
+	"testing"
+
+	"github.com/facebookincubator/tacquito/cmds/server/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreflightSynthetic(t *testing.T) {
+	r := Preflight(config.ServerConfig{Users: []config.User{
+		{Name: "mr_uses_group"},
+		{Name: "probe", Synthetic: true, Sources: []string{"192.0.2.0/24"}},
+		{Name: "testuser", Synthetic: true},
+	}})
+	assert.Equal(t, []string{"probe", "testuser"}, r.SyntheticUsers)
+	assert.Len(t, r.Warnings, 1)
+	assert.Contains(t, r.Warnings[0], "testuser")
+}
+
+func TestPreflightAuthenMethods(t *testing.T) {
+	secret := func(name string, options map[string]string) config.SecretConfig {
+		return config.SecretConfig{Name: name, Handler: config.Handler{Options: options}}
+	}
+	r := Preflight(config.ServerConfig{Secrets: []config.SecretConfig{
+		secret("lab", nil),
+		secret("hardened", map[string]string{"allowed_authen_methods": `{"login": ["pap"]}`, "allowed_services": `["login"]`}),
+		secret("nothing", map[string]string{"allowed_authen_methods": `{"login": []}`}),
+		secret("typo", map[string]string{"allowed_authen_methods": `{"login": ["paps"]}`}),
+		secret("denial", map[string]string{"authen_method_denial": "drop"}),
+		// enable requests prompt for their password over ascii
+		secret("conflict", map[string]string{"allowed_authen_methods": `{"login": ["pap"]}`, "allowed_services": `["login", "enable"]`}),
+		secret("enable", map[string]string{"allowed_authen_methods": `{"login": ["ascii", "pap"]}`, "allowed_services": `["enable"]`}),
+		secret("malformed", map[string]string{"allowed_services": `login, enable`}),
+	}})
+	require.Len(t, r.Warnings, 1)
+	assert.Contains(t, r.Warnings[0], "[nothing] allows no authen methods")
+	require.Len(t, r.Errors, 4)
+	assert.Contains(t, r.Errors[0], "[typo]")
+	assert.Contains(t, r.Errors[1], "[denial]")
+	assert.Contains(t, r.Errors[2], "[conflict]")
+	assert.Contains(t, r.Errors[2], "allowed_services [enable]")
+	assert.Contains(t, r.Errors[3], "[malformed]")
+}
@@ -0,0 +1,244 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package loader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	tq "github.com/facebookincubator/tacquito"
+	"github.com/facebookincubator/tacquito/cmds/server/config"
+	"github.com/facebookincubator/tacquito/cmds/server/config/authorizers/stringy"
+	"github.com/facebookincubator/tacquito/cmds/server/config/secret/prefix"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// reloadRules is the number of command rules of the user of each reloaded config
+const reloadRules = 5000
+
+type reloadLogger struct{}
+
+func (reloadLogger) Infof(ctx context.Context, format string, args ...interface{})      {}
+func (reloadLogger) Errorf(ctx context.Context, format string, args ...interface{})     {}
+func (reloadLogger) Debugf(ctx context.Context, format string, args ...interface{})     {}
+func (reloadLogger) Record(ctx context.Context, r map[string]string, obscure ...string) {}
+
+// reloadSource is a config source reloaded by the test
+type reloadSource chan config.ServerConfig
+
+func (r reloadSource) Config() chan config.ServerConfig { return r }
+
+type reloadKeychain struct{}
+
+func (reloadKeychain) Add(config.Keychain) func(context.Context, string) ([]byte, error) {
+	return func(context.Context, string) ([]byte, error) { return []byte("fooman"), nil }
+}
+
+// reloadHandler exposes the users of its scope to the test
+type reloadHandler struct {
+	tq.Handler
+	users config.Provider
+}
+
+type reloadHandlerFactory struct{}
+
+func (reloadHandlerFactory) New(ctx context.Context, cp config.Provider, options map[string]string) tq.Handler {
+	return reloadHandler{Handler: tq.HandlerFunc(func(tq.Response, tq.Request) {}), users: cp}
+}
+
+type reloadResponse struct {
+	got *tq.AuthorReply
+}
+
+func (r *reloadResponse) Reply(v tq.EncoderDecoder) (int, error) {
+	r.got, _ = v.(*tq.AuthorReply)
+	return 0, nil
+}
+func (r *reloadResponse) Write(p *tq.Packet) (int, error) { return 0, nil }
+func (r *reloadResponse) Next(next tq.Handler)            {}
+func (r *reloadResponse) RegisterWriter(mw io.Writer)     {}
+
+// reloadConfig is a config whose user is authorized for commands by reloadRules regexes, which
+// generation makes distinct from those of other generations so every reload compiles them
+func reloadConfig(generation int) config.ServerConfig {
+	commands := make([]config.Command, 0, reloadRules)
+	for i := 0; i < reloadRules; i++ {
+		commands = append(commands, config.Command{
+			Name:   fmt.Sprintf("cmd%d", i),
+			Match:  []string{fmt.Sprintf(`^(interface|vlan) g%d-%d/[0-9]+(\.[0-9]+)?$`, generation, i)},
+			Action: config.PERMIT,
+		})
+	}
+	commands = append(commands, config.Command{Name: "show", Match: []string{`^version$`}, Action: config.PERMIT})
+	return config.ServerConfig{
+		Secrets: []config.SecretConfig{{
+			Name:    "core",
+			Type:    config.PREFIX,
+			Handler: config.Handler{Type: config.START},
+			Options: map[string]string{"prefixes": `["192.0.2.0/24"]`},
+		}},
+		Users: []config.User{{Name: "alice", Scopes: []string{"core"}, Commands: commands}},
+	}
+}
+
+// reloadAuthorize authorizes a command of alice from remote, as the server would, and returns how
+// long it took
+func reloadAuthorize(t *testing.T, l *Loader, remote net.Addr, request tq.Request) time.Duration {
+	start := time.Now()
+	_, h, err := l.Get(context.Background(), remote)
+	require.NoError(t, err)
+	user := h.(reloadHandler).users.GetUser("alice")
+	require.NotNil(t, user)
+	var response reloadResponse
+	user.Authorizer.Handle(&response, request)
+	elapsed := time.Since(start)
+	require.NotNil(t, response.got)
+	require.Equal(t, tq.AuthorStatusPassAdd, response.got.Status)
+	return elapsed
+}
+
+// p99 returns the 99th percentile of durations
+func p99(durations []time.Duration) time.Duration {
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	return durations[len(durations)*99/100]
+}
+
+// TestReloadUnderLoad checks that reloading a config with thousands of regexes does not hold up
+// authorizations, which are served from the previous config until the new one is built
+func TestReloadUnderLoad(t *testing.T) {
+	if testing.Short() {
+		t.Skip("compiles tens of thousands of regexes")
+	}
+	source := make(reloadSource)
+	l, err := NewLoader(context.Background(), source,
+		SetLoggerProvider(reloadLogger{}),
+		SetKeychainProvider(reloadKeychain{}),
+		SetConfigProvider(config.New()),
+		SetAuthorizerProvider(stringy.New(reloadLogger{})),
+		RegisterSecretProviderType(config.PREFIX, prefix.New(reloadLogger{})),
+		RegisterHandlerType(config.START, reloadHandlerFactory{}),
+	)
+	require.NoError(t, err)
+	source <- reloadConfig(0)
+	l.BlockUntilLoaded()
+
+	body, err := tq.NewAuthorRequest(
+		tq.SetAuthorRequestMethod(tq.AuthenMethodTacacsPlus),
+		tq.SetAuthorRequestPrivLvl(tq.PrivLvlRoot),
+		tq.SetAuthorRequestType(tq.AuthenTypeASCII),
+		tq.SetAuthorRequestService(tq.AuthenServiceLogin),
+		tq.SetAuthorRequestUser("alice"),
+		tq.SetAuthorRequestArgs(tq.Args{"service=shell", "cmd=show", "cmd-arg=version"}),
+	).MarshalBinary()
+	require.NoError(t, err)
+	request := tq.Request{Header: *tq.NewHeader(tq.SetHeaderType(tq.Authorize)), Body: body, Context: context.Background()}
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 49}
+
+	var steady []time.Duration
+	for i := 0; i < 2000; i++ {
+		steady = append(steady, reloadAuthorize(t, l, remote, request))
+	}
+
+	const reloads = 3
+	done := make(chan struct{})
+	start := time.Now()
+	go func() {
+		defer close(done)
+		for generation := 1; generation <= reloads; generation++ {
+			previous := l.current.Load()
+			source <- reloadConfig(generation)
+			for l.current.Load() == previous {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+	var reloading []time.Duration
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+			reloading = append(reloading, reloadAuthorize(t, l, remote, request))
+		}
+	}
+	build := time.Since(start) / reloads
+	require.GreaterOrEqual(t, len(reloading), 100, "too few authorizations ran during the reloads to measure them")
+
+	base, during := p99(steady), p99(reloading)
+	t.Logf("p99 authorization latency: steady [%v], during %v reloads of %v rules, each built in [%v], [%v] over %v authorizations", base, reloads, reloadRules, build, during, len(reloading))
+	// a build that held up authorizations would take them to about the build time.  Allow for
+	// the garbage collector and, on a busy or single processor, for authorizations waiting on the
+	// scheduler while a build runs.
+	limit := 3*base + 2*time.Millisecond
+	if build/10 > limit {
+		limit = build / 10
+	}
+	assert.LessOrEqual(t, during, limit, "p99 authorization latency degraded during reloads")
+}
+
+// rotationKeychain serves the key of each keychain as its secret
+type rotationKeychain struct{}
+
+func (rotationKeychain) Add(k config.Keychain) func(context.Context, string) ([]byte, error) {
+	return func(context.Context, string) ([]byte, error) { return []byte(k.Key), nil }
+}
+
+// TestSecretRotations checks that a reload reports the device groups whose secret changed
+func TestSecretRotations(t *testing.T) {
+	source := make(reloadSource)
+	l, err := NewLoader(context.Background(), source,
+		SetLoggerProvider(reloadLogger{}),
+		SetKeychainProvider(rotationKeychain{}),
+		SetConfigProvider(config.New()),
+		SetAuthorizerProvider(stringy.New(reloadLogger{})),
+		RegisterSecretProviderType(config.PREFIX, prefix.New(reloadLogger{})),
+		RegisterHandlerType(config.START, reloadHandlerFactory{}),
+	)
+	require.NoError(t, err)
+	var _ tq.SecretRotationNotifier = l
+	load := func(core, edge string) {
+		previous := l.current.Load()
+		source <- config.ServerConfig{
+			Secrets: []config.SecretConfig{
+				{Name: "core", Type: config.PREFIX, Secret: config.Keychain{Key: core}, Handler: config.Handler{Type: config.START}, Options: map[string]string{"prefixes": `["192.0.2.0/24"]`}},
+				{Name: "edge", Type: config.PREFIX, Secret: config.Keychain{Key: edge}, Handler: config.Handler{Type: config.START, Options: map[string]string{"device_group": "edges"}}, Options: map[string]string{"prefixes": `["198.51.100.0/24"]`}},
+			},
+			Users: []config.User{{Name: "alice", Scopes: []string{"core", "edge"}}},
+		}
+		for l.current.Load() == previous {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	rotations := func() []string {
+		var groups []string
+		for {
+			select {
+			case g := <-l.SecretRotations():
+				groups = append(groups, g)
+			default:
+				return groups
+			}
+		}
+	}
+
+	load("a", "b")
+	assert.Empty(t, rotations(), "the first config rotates nothing")
+	load("a", "b")
+	assert.Empty(t, rotations(), "unchanged secrets")
+	load("a", "c")
+	assert.Equal(t, []string{"edges"}, rotations())
+	load("d", "e")
+	assert.Equal(t, []string{"core", "edges"}, rotations())
+}
@@ -62,6 +62,11 @@ var (
 		Name:      "loader_build_user_accounter_bad_configref_error",
 		Help:      "number of user with bad config ref accounters",
 	})
+	userSyntheticBadConfig = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "tacquito",
+		Name:      "loader_build_user_synthetic_bad_config",
+		Help:      "number of synthetic users with bad probe source prefixes",
+	})
 	userTotal = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "tacquito",
 		Name:      "loader_build_user_total",
@@ -77,6 +82,11 @@ var (
 		Name:      "loader_build_secret_provider_missing",
 		Help:      "number of missing secret providers",
 	})
+	secretConfigInvalid = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "tacquito",
+		Name:      "loader_build_secret_config_invalid",
+		Help:      "number of secret configs skipped for settings that conflict or do not parse",
+	})
 	providerFactoryMissing = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "tacquito",
 		Name:      "loader_build_user_provider_factory_missing",
@@ -112,6 +122,11 @@ var (
 		Name:      "prefixFilter_allowed",
 		Help:      "when prefixFilter allows a remote net.Addr, this is incremented",
 	})
+	secretRotations = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "tacquito",
+		Name:      "loader_secret_rotations",
+		Help:      "number of device groups whose secret was changed by a reload, and whose connections are retired",
+	})
 	prefixFilterDenied = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "tacquito",
 		Name:      "prefixFilter_denied",
@@ -130,6 +145,7 @@ func init() {
 	prometheus.MustRegister(userAuthenticatorBadConfigRef)
 	prometheus.MustRegister(userAccounterUnassigned)
 	prometheus.MustRegister(userAccounterBadConfigRef)
+	prometheus.MustRegister(userSyntheticBadConfig)
 	prometheus.MustRegister(userTotal)
 	prometheus.MustRegister(userScopeUnassigned)
 	prometheus.MustRegister(secretProviderMissing)
@@ -141,4 +157,6 @@ func init() {
 	prometheus.MustRegister(userOverrideAccounter)
 	prometheus.MustRegister(prefixFilterAllowed)
 	prometheus.MustRegister(prefixFilterDenied)
+	prometheus.MustRegister(secretConfigInvalid)
+	prometheus.MustRegister(secretRotations)
 }
@@ -0,0 +1,135 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package loader
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/facebookincubator/tacquito/cmds/server/config"
+)
+
+// reloadReporter may be implemented by the config source of a Loader to report its last reload,
+// see fsnotify.Watcher
+type reloadReporter interface {
+	LastReload() (time.Time, error)
+}
+
+// Status is a snapshot of the config a Loader applied, see Loader.Status.  It is served as json by
+// the admin status page, so fields are only ever added and never renamed.  It must never hold
+// secret material, so groups report counts and never keychain references, options or users.
+type Status struct {
+	// Applied is when config was last applied, zero until the first config is loaded
+	Applied time.Time `json:"applied"`
+	// Applies is the number of times config was applied
+	Applies int64 `json:"applies"`
+	// LastReload is when the config source last reloaded, and LastReloadError why it failed.  They
+	// are unset if the source does not reload.
+	LastReload      *time.Time `json:"last_reload,omitempty"`
+	LastReloadError string     `json:"last_reload_error,omitempty"`
+	// PrefixAllow and PrefixDeny are the number of server wide prefix filters
+	PrefixAllow int           `json:"prefix_allow"`
+	PrefixDeny  int           `json:"prefix_deny"`
+	Groups      []GroupStatus `json:"groups"`
+}
+
+// GroupStatus summarizes a device group, a config.SecretConfig
+type GroupStatus struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Handler string `json:"handler"`
+	// Prefixes is the number of prefixes or hosts the group matches devices by
+	Prefixes int `json:"prefixes"`
+	// Users is the number of users scoped to the group
+	Users int `json:"users"`
+	// MissingSecret is set if the keychain provider does not hold a secret of the group, which is
+	// then not served
+	MissingSecret bool `json:"missing_secret,omitempty"`
+}
+
+// loaderStatus is the Status shared by the copies of a Loader
+type loaderStatus struct {
+	mu     sync.Mutex
+	status Status
+}
+
+// Status returns a snapshot of the config l last applied.  It is safe to call while l runs.
+func (l Loader) Status() Status {
+	l.status.mu.Lock()
+	s := l.status.status
+	l.status.mu.Unlock()
+	s.Groups = append([]GroupStatus{}, s.Groups...)
+	if r, ok := l.unmarshaled.(reloadReporter); ok {
+		t, err := r.LastReload()
+		s.LastReload = &t
+		if err != nil {
+			s.LastReloadError = err.Error()
+		}
+	}
+	return s
+}
+
+// setStatus records c as applied at now
+func (l Loader) setStatus(c config.ServerConfig, now time.Time) {
+	groups := make([]GroupStatus, 0, len(c.Secrets))
+	for _, sc := range c.Secrets {
+		g := GroupStatus{
+			Name:     sc.Name,
+			Type:     providerTypeName(sc.Type),
+			Handler:  handlerTypeName(sc.Handler.Type),
+			Prefixes: optionLength(sc.Options, "prefixes") + optionLength(sc.Options, "hosts") + optionLength(sc.Options, "fallback_prefixes"),
+			// the keychain itself is never reported, it names the secret
+			MissingSecret: l.validateKeychains(sc) != nil,
+		}
+		for _, u := range c.Users {
+			if u.HasScope(sc.Name) {
+				g.Users++
+			}
+		}
+		groups = append(groups, g)
+	}
+	l.status.mu.Lock()
+	defer l.status.mu.Unlock()
+	l.status.status.Applied = now
+	l.status.status.Applies++
+	l.status.status.PrefixAllow = len(c.PrefixAllow)
+	l.status.status.PrefixDeny = len(c.PrefixDeny)
+	l.status.status.Groups = groups
+}
+
+// optionLength returns the length of the json list in options[key], zero if it is not one
+func optionLength(options map[string]string, key string) int {
+	var v []interface{}
+	if err := json.Unmarshal([]byte(options[key]), &v); err != nil {
+		return 0
+	}
+	return len(v)
+}
+
+// providerTypeName names t for Status
+func providerTypeName(t config.ProviderType) string {
+	switch t {
+	case config.PREFIX:
+		return "prefix"
+	case config.DNS:
+		return "dns"
+	}
+	return "unknown"
+}
+
+// handlerTypeName names t for Status
+func handlerTypeName(t config.HandlerType) string {
+	switch t {
+	case config.START:
+		return "start"
+	case config.SPAN:
+		return "span"
+	}
+	return "unknown"
+}
@@ -0,0 +1,111 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package loader
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/facebookincubator/tacquito/cmds/server/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// reloadingSource is a config source that reports a failed reload
+type reloadingSource struct {
+	at  time.Time
+	err error
+}
+
+func (r reloadingSource) Config() chan config.ServerConfig { return nil }
+func (r reloadingSource) LastReload() (time.Time, error)   { return r.at, r.err }
+
+// TestStatusRedaction checks that the status of a config full of secrets reports counts, types and
+// names only, see exporter.Status
+func TestStatusRedaction(t *testing.T) {
+	reloaded := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	l := Loader{
+		unmarshaled: reloadingSource{at: reloaded, err: fmt.Errorf("yaml: line 3: bad indentation")},
+		status:      &loaderStatus{},
+	}
+	c := config.ServerConfig{
+		Secrets: []config.SecretConfig{
+			{
+				Name:    "core",
+				Secret:  config.Keychain{Group: "keychain-group-secret", Key: "keychain-key-secret"},
+				Handler: config.Handler{Type: config.START, Options: map[string]string{"token": "handler-option-secret"}},
+				Type:    config.PREFIX,
+				Options: map[string]string{"prefixes": `["192.0.2.0/24", "2001:db8::/32"]`},
+			},
+			{
+				Name:    "edge",
+				Secret:  config.Keychain{Group: "keychain-group-secret", Key: "keychain-key-secret"},
+				Handler: config.Handler{Type: config.SPAN},
+				Type:    config.DNS,
+				Options: map[string]string{"hosts": `["edge1.example.net"]`},
+			},
+		},
+		Users: []config.User{
+			{
+				Name:          "user-name-secret",
+				Scopes:        []string{"core", "edge"},
+				Authenticator: &config.Authenticator{Type: config.BCRYPT, Options: map[string]string{"hash": "bcrypt-hash-secret"}},
+			},
+			{Name: "other-user-secret", Scopes: []string{"core"}},
+		},
+		PrefixDeny: []string{"198.51.100.0/24"},
+	}
+	l.setStatus(c, reloaded.Add(time.Second))
+
+	s := l.Status()
+	assert.Equal(t, []GroupStatus{
+		{Name: "core", Type: "prefix", Handler: "start", Prefixes: 2, Users: 2},
+		{Name: "edge", Type: "dns", Handler: "span", Prefixes: 1, Users: 1},
+	}, s.Groups)
+	assert.Equal(t, int64(1), s.Applies)
+	assert.Equal(t, 1, s.PrefixDeny)
+	assert.Equal(t, reloaded, *s.LastReload)
+	assert.Equal(t, "yaml: line 3: bad indentation", s.LastReloadError)
+
+	b, err := json.Marshal(s)
+	assert.NoError(t, err)
+	for _, secret := range []string{"keychain", "option-secret", "user-name", "other-user", "hash", "192.0.2.0", "edge1"} {
+		assert.NotContains(t, string(b), secret)
+	}
+}
+
+// validatingKeychain holds the secrets of its groups only
+type validatingKeychain map[string]bool
+
+func (k validatingKeychain) Add(kc config.Keychain) func(context.Context, string) ([]byte, error) {
+	return func(context.Context, string) ([]byte, error) { return []byte("fooman"), nil }
+}
+
+func (k validatingKeychain) Validate(kc config.Keychain) error {
+	if !k[kc.Group] {
+		return fmt.Errorf("no secret for group [%v]", kc.Group)
+	}
+	return nil
+}
+
+func TestStatusMissingSecret(t *testing.T) {
+	l := Loader{status: &loaderStatus{}, keychainProvider: validatingKeychain{"core": true}}
+	l.setStatus(config.ServerConfig{Secrets: []config.SecretConfig{
+		{Name: "core", Secret: config.Keychain{Group: "core"}},
+		{Name: "edge", Secret: config.Keychain{Group: "edge"}},
+		// a missing cutover secret counts as much as its own
+		{Name: "lab", Secret: config.Keychain{Group: "core"}, Cutover: []config.CutoverSecret{{Role: "next", Secret: config.Keychain{Group: "lab"}}}},
+	}}, time.Now())
+	missing := map[string]bool{}
+	for _, g := range l.Status().Groups {
+		missing[g.Name] = g.MissingSecret
+	}
+	assert.Equal(t, map[string]bool{"core": false, "edge": true, "lab": true}, missing)
+}
@@ -12,6 +12,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sync/atomic"
 )
 
 // newDefaultLogger provides a basic logger if one is not provided
@@ -19,8 +20,9 @@ import (
 func newDefaultLogger(level int) *defaultLogger {
 	base := log.New(os.Stderr, "", 0)
 	meta := log.Ldate | log.Ltime | log.Llongfile
+	l := int32(level)
 	return &defaultLogger{
-		level:       level,
+		level:       &l,
 		ErrorLogger: log.New(base.Writer(), "ERROR: ", meta),
 		InfoLogger:  log.New(base.Writer(), "INFO: ", meta),
 		DebugLogger: log.New(base.Writer(), "DEBUG: ", meta),
@@ -30,8 +32,8 @@ func newDefaultLogger(level int) *defaultLogger {
 
 // defaultLogger ...
 type defaultLogger struct {
-	// log level to use
-	level int
+	// log level to use, which the admin api may change while the server runs
+	level *int32
 	// ErrorLogger is Level Error Logger
 	ErrorLogger *log.Logger
 	// InfoLogger is Level Info Logger
@@ -42,6 +44,22 @@ type defaultLogger struct {
 	FatalLogger *log.Logger
 }
 
+// Level returns the log level
+func (d defaultLogger) Level() int {
+	return int(atomic.LoadInt32(d.level))
+}
+
+// SetLevel sets the log level to 10 error, 20 info or 30 debug
+func (d defaultLogger) SetLevel(level int) error {
+	switch level {
+	case 10, 20, 30:
+	default:
+		return fmt.Errorf("unknown log level [%v]; expected 10 error, 20 info or 30 debug", level)
+	}
+	atomic.StoreInt32(d.level, int32(level))
+	return nil
+}
+
 // Record provides a log hook for record based log formats.  errors will be caught and logged to errorf
 func (d defaultLogger) Record(ctx context.Context, r map[string]string, obscure ...string) {
 	// hide fields as needed
@@ -56,21 +74,21 @@ func (d defaultLogger) Record(ctx context.Context, r map[string]string, obscure
 
 // Errorf ...
 func (d defaultLogger) Errorf(ctx context.Context, format string, args ...interface{}) {
-	if d.level >= 10 {
+	if d.Level() >= 10 {
 		d.ErrorLogger.Output(2, fmt.Sprintf(format, args...))
 	}
 }
 
 // Infof ...
 func (d defaultLogger) Infof(ctx context.Context, format string, args ...interface{}) {
-	if d.level >= 20 {
+	if d.Level() >= 20 {
 		d.InfoLogger.Output(2, fmt.Sprintf(format, args...))
 	}
 }
 
 // Debugf ...
 func (d defaultLogger) Debugf(ctx context.Context, format string, args ...interface{}) {
-	if d.level >= 30 {
+	if d.Level() >= 30 {
 		d.DebugLogger.Output(2, fmt.Sprintf(format, args...))
 	}
 }
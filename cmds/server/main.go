@@ -9,25 +9,39 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 
 	"flag"
+	"fmt"
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	tq "github.com/facebookincubator/tacquito"
+	"github.com/facebookincubator/tacquito/cmds/server/admin"
 	"github.com/facebookincubator/tacquito/cmds/server/config"
+	"github.com/facebookincubator/tacquito/cmds/server/config/accounters/batch"
 	"github.com/facebookincubator/tacquito/cmds/server/config/accounters/local"
 	"github.com/facebookincubator/tacquito/cmds/server/config/authenticators/bcrypt"
 	"github.com/facebookincubator/tacquito/cmds/server/config/authorizers/stringy"
+	"github.com/facebookincubator/tacquito/cmds/server/config/synthetic"
 
 	"github.com/facebookincubator/tacquito/cmds/server/config/secret"
+	"github.com/facebookincubator/tacquito/cmds/server/config/secret/dns"
+	"github.com/facebookincubator/tacquito/cmds/server/config/secret/env"
 	"github.com/facebookincubator/tacquito/cmds/server/config/secret/prefix"
 	"github.com/facebookincubator/tacquito/cmds/server/exporter"
 	"github.com/facebookincubator/tacquito/cmds/server/handlers"
 	"github.com/facebookincubator/tacquito/cmds/server/loader"
 	"github.com/facebookincubator/tacquito/cmds/server/loader/fsnotify"
 	"github.com/facebookincubator/tacquito/cmds/server/loader/yaml"
+	"github.com/facebookincubator/tacquito/extension"
+	// reports the metrics of the base package with the default prometheus registry
+	_ "github.com/facebookincubator/tacquito/prommetrics"
 )
 
 var (
@@ -36,6 +50,50 @@ var (
 	proxy             = flag.Bool("proxy", false, "proxy enables proxy header processing")
 	configPath        = flag.String("config", "tacquito.yaml", "the string path representing the storage location of the server config")
 	accountingLogPath = flag.String("acct-log-path", "/tmp/tacquito_accounting.log", "the string path representing the storage location of the server accounting logs")
+	conformance       = flag.Bool("conformance", false, "conformance logs protocol violations by clients and the server, for diagnostics")
+	bodyLengthCheck   = flag.Bool("body-length-check", false, "reject requests whose decoded body length disagrees with the header length")
+	replyCheck        = flag.Bool("reply-check", false, "reject replies from handlers whose body does not decode as the reply of their packet type, instead of sending them")
+	bodyOwnership     = flag.Bool("body-ownership-check", false, "log handlers that modify the body of their request, for debugging")
+	padCache          = flag.Int("pad-cache", 0, "pads to cache per connection, for devices that reuse session ids; 0 disables the cache")
+	timeoutJitter     = flag.Float64("timeout-jitter", 0, "lengthen connection and handler timeouts by a random fraction of up to this value, eg 0.2, so reconnected devices do not all time out together")
+	traceSources      = flag.String("trace-sources", "", "comma separated device addresses whose sessions are traced to stderr, with passwords redacted")
+	tlsCert           = flag.String("tls-cert", "", "serve over tls with the pem encoded certificate at this path, requires -tls-key")
+	tlsKey            = flag.String("tls-key", "", "the pem encoded private key of -tls-cert")
+	tlsMinVersion     = flag.String("tls-min-version", "1.2", "the lowest tls version clients may negotiate; 1.2 or 1.3")
+	tlsCipherSuites   = flag.String("tls-cipher-suites", "", "comma separated tls 1.2 cipher suites clients may negotiate, eg TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256; defaults to the ECDHE AEAD suites")
+	secretsFromEnv    = flag.Bool("secrets-from-env", false, "read pre-shared keys from TACACS_SECRET_<GROUP> environment variables instead of the config")
+	shutdownBudget    = flag.Duration("shutdown-budget", 25*time.Second, "how long the server may take to drain connections and flush accounting once signalled, keep it below the grace period of the deployment")
+	shutdownSpoolDir  = flag.String("shutdown-spool-dir", "", "directory that accounting records which could not be flushed on shutdown are spooled to, requires -acct-batch-size")
+	acctBatchSize     = flag.Int("acct-batch-size", 0, "write the records of -acct-log-path in batches of this many, records held are flushed on shutdown; 0 writes each record as it arrives")
+	acctBatchInterval = flag.Duration("acct-batch-interval", 5*time.Second, "the longest a record of -acct-batch-size is held before it is written")
+	acctArgSpillDir   = flag.String("acct-arg-spill-dir", "", "directory that cmd-arg values over -acct-arg-spill-threshold are held in while their records are batched, requires -acct-batch-size; the values of written records are kept in the directory -acct-log-path.args by hash")
+	acctArgSpillSize  = flag.Int("acct-arg-spill-threshold", 64<<10, "bytes of cmd-arg values above which they are spilled to -acct-arg-spill-dir")
+	acctArgSpillKeep  = flag.Duration("acct-arg-spill-retention", 24*time.Hour, "how long the spill files of a previous run, eg of records it spooled on shutdown, are kept in -acct-arg-spill-dir")
+	secretGrace       = flag.Duration("secret-grace-period", 0, "how long open connections may keep using a secret removed from the config, so in flight sessions complete; 0 keeps it until they close")
+	dnsLookupTimeout  = flag.Duration("dns-lookup-timeout", 2*time.Second, "how long resolving the hostname of a device for a dns secret config may take")
+	dnsCacheTTL       = flag.Duration("dns-cache-ttl", 5*time.Minute, "how long the hostnames of a device are cached for dns secret configs; 0 disables caching")
+	dnsNegativeTTL    = flag.Duration("dns-negative-cache-ttl", 30*time.Second, "how long a device whose hostname could not be resolved is cached, it is matched against fallback_prefixes meanwhile")
+	warmDevices       = flag.String("warm-devices-file", "", "file of device addresses, one per line, whose secrets are fetched before the first connection is served")
+	warmBudget        = flag.Duration("warm-budget", 30*time.Second, "how long warming -warm-devices-file may delay serving; 0 is unbounded")
+	featureStateFile  = flag.String("feature-state-file", "", "track the protocol features each device group uses, persisted to this json file and served on /features")
+	featureDevices    = flag.Int("feature-devices", 0, "how many devices feature usage is also tracked for individually, besides their group")
+	featureInterval   = flag.Duration("feature-persist-interval", time.Minute, "how often feature usage is saved to -feature-state-file")
+	timeoutRules      = flag.String("timeout-rules", "", "json file of rules that add idletime and timeout av pairs, in minutes, to session authorizations by group and hour of day")
+	singleConnectIdle = flag.Duration("single-connect-idle-timeout", 15*time.Minute, "how long a connection that negotiated single-connect may sit with no session in flight before it is closed")
+	maxLifetime       = flag.Duration("max-connection-lifetime", 0, "how long a connection may serve new sessions before it is closed once its sessions complete, so devices reconnect and rebalance; unlike the idle timeout it applies to busy connections; 0 is unlimited")
+	maxInteractive    = flag.Int("max-interactive-sessions", 0, "how many interactive logins each device may have awaiting another round at once, beyond which its new logins fail; 0 is unlimited, the handler option max_interactive_sessions overrides it per device group")
+	metricsIdentity   = flag.String("metrics-identity", "", "report usernames in metric labels as passthrough, hmac or bucket; denials are not counted by user if empty")
+	traceIdentity     = flag.String("trace-identity", "", "report usernames in traces as passthrough, hmac or bucket; traces keep raw usernames if empty")
+	identityKeyFile   = flag.String("identity-key-file", "", "file holding the key of the hmac identity mode; pseudonyms are stable for as long as the key is unchanged")
+	fingerprintKey    = flag.String("fingerprint-key-file", "", "file holding the hmac key of the secret fingerprints the admin api reports in effective policies; a random key, so fingerprints only compare within one process, if empty")
+	identityTopK      = flag.Int("identity-top-k", 20, "how many of the most frequent users the bucket identity mode reports exactly, others are reported as other")
+	diagnosticUser    = flag.String("diagnostic-user", "", "synthetic user that POSTs to /v1/diagnostics of the admin api log in with to time each stage of authentication, authorization and accounting; its password and the secret of loopback devices are read from TACACS_DIAGNOSTIC_PASSWORD and TACACS_DIAGNOSTIC_SECRET")
+	diagnosticEvery   = flag.Duration("diagnostic-interval", time.Minute, "how long after a diagnostic run starts the next one may")
+	diagnosticTimeout = flag.Duration("diagnostic-timeout", 10*time.Second, "how long a diagnostic run may take")
+	adminAddress      = flag.String("admin-address", "", "serve the admin api, which queries and controls the server, on this address:port; disabled if empty")
+	adminTokenFile    = flag.String("admin-token-file", "", "file holding the bearer token admin api requests must carry, required by -admin-address")
+	adminTLSCert      = flag.String("admin-tls-cert", "", "serve the admin api over tls with the pem encoded certificate at this path, requires -admin-tls-key; without it the admin api is only served on a loopback -admin-address")
+	adminTLSKey       = flag.String("admin-tls-key", "", "the pem encoded private key of -admin-tls-cert")
 	level             = flag.Int("level", 30, "log levels; 10 = error, 20 = info, 30 = debug")
 )
 
@@ -43,7 +101,7 @@ func main() {
 	flag.Parse()
 	logger := newDefaultLogger(*level)
 
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
 	ctx, cancel := context.WithCancel(ctx)
@@ -62,25 +120,96 @@ func main() {
 		logger.Fatalf(ctx, "error building accounting logger; %v", err)
 		return
 	}
+	var accounter interface {
+		New(options map[string]string) tq.Handler
+	} = accountingLogger
+	var batched *batch.Accounter
+	if *acctBatchSize > 0 {
+		batched, err = newBatchAccounter(ctx, logger)
+		if err != nil {
+			logger.Fatalf(ctx, "error building the batching accounting logger; %v", err)
+			return
+		}
+		accounter = batched
+	} else if *shutdownSpoolDir != "" || *acctArgSpillDir != "" {
+		logger.Fatalf(ctx, "-shutdown-spool-dir and -acct-arg-spill-dir hold the records of -acct-batch-size, which is unset")
+		return
+	}
+
+	var keychain interface {
+		Add(k config.Keychain) func(context.Context, string) ([]byte, error)
+	} = secret.New()
+	if *secretsFromEnv {
+		keychain, err = env.New()
+		if err != nil {
+			logger.Fatalf(ctx, "error reading secrets; %v", err)
+			return
+		}
+	}
+
+	var authorizerOpts []stringy.Option
+	if *timeoutRules != "" {
+		rules, err := stringy.LoadTimeoutRules(*timeoutRules)
+		if err != nil {
+			logger.Fatalf(ctx, "error loading -timeout-rules; %v", err)
+			return
+		}
+		authorizerOpts = append(authorizerOpts, stringy.SetTimeoutPolicy(rules))
+	}
+
+	loaderOpts := []loader.Option{
+		loader.SetServerStrictness(loader.ServerStrictness{
+			Conformance:     *conformance,
+			BodyLengthCheck: *bodyLengthCheck,
+			ReplyCheck:      *replyCheck,
+		}),
+	}
+	if *fingerprintKey != "" {
+		key, err := os.ReadFile(*fingerprintKey)
+		if err != nil {
+			logger.Fatalf(ctx, "error reading fingerprint key; %v", err)
+			return
+		}
+		loaderOpts = append(loaderOpts, loader.SetFingerprintKey([]byte(strings.TrimSpace(string(key)))))
+	}
 
 	shhh := &shh{}
-	sp, err := loader.NewLocalConfig(
-		ctx,
-		*configPath,
-		fsnotify.New(ctx, yaml.New(), logger),
+	// the authenticators by type, those with backends report their health on the status page
+	authenticators := map[config.AuthenticatorType]extension.AuthenticatorFactory{
+		config.BCRYPT: bcrypt.New(logger, shhh),
+	}
+	for t, a := range authenticators {
+		loaderOpts = append(loaderOpts, loader.RegisterAuthenticator(t, a))
+	}
+	watcher := fsnotify.New(ctx, yaml.New(), logger)
+	loaderOpts = append(loaderOpts,
 		loader.SetLoggerProvider(logger),
-		loader.SetKeychainProvider(secret.New()),
+		loader.SetKeychainProvider(keychain),
 		loader.SetConfigProvider(config.New()),
-		loader.SetAuthorizerProvider(stringy.New(logger)),
+		loader.SetAuthorizerProvider(stringy.New(logger, authorizerOpts...)),
 		loader.RegisterSecretProviderType(config.PREFIX, prefix.New(logger)),
+		loader.RegisterSecretProviderType(config.DNS, dns.New(logger, dns.SetLookupTimeout(*dnsLookupTimeout), dns.SetLookupCache(*dnsCacheTTL, *dnsNegativeTTL))),
 		loader.RegisterHandlerType(config.START, handlers.NewStart(logger)),
-		loader.RegisterAuthenticator(config.BCRYPT, bcrypt.New(logger, shhh)),
-		loader.RegisterAccounter(config.FILE, accountingLogger),
+		loader.RegisterAccounter(config.FILE, accounter),
 	)
+	sp, err := loader.NewLocalConfig(ctx, *configPath, watcher, loaderOpts...)
 	if err != nil {
 		logger.Fatalf(ctx, "error fetching config; %v", err)
 		return
 	}
+	// a secret config whose secret is missing, eg an unset environment variable, fails start up
+	// rather than every connection of its devices
+	sp.BlockUntilLoaded()
+	var missingSecrets []string
+	for _, g := range sp.Status().Groups {
+		if g.MissingSecret {
+			missingSecrets = append(missingSecrets, g.Name)
+		}
+	}
+	if len(missingSecrets) > 0 {
+		logger.Fatalf(ctx, "secret configs %v reference secrets the keychain does not hold", missingSecrets)
+		return
+	}
 
 	// setup our listener
 	listener, err := net.Listen(*network, *address)
@@ -96,9 +225,246 @@ func main() {
 	}
 	logger.Infof(ctx, "serve on %v", tcpListener.Addr().String())
 
-	s := tq.NewServer(logger, sp, tq.SetUseProxy(*proxy))
-	if err := s.Serve(ctx, tcpListener); err != nil {
+	var serveListener tq.DeadlineListener = tcpListener
+	if *tlsCert != "" {
+		if *proxy {
+			logger.Fatalf(ctx, "the proxy header is not supported over tls")
+			return
+		}
+		serveListener, err = newTLSListener(tcpListener)
+		if err != nil {
+			logger.Fatalf(ctx, "error configuring tls: %v", err)
+			return
+		}
+	}
+
+	// the tracer wraps every handler, so it is only installed when there is something to trace
+	var tracer *tq.Tracer
+	for _, source := range strings.Split(*traceSources, ",") {
+		if source = strings.TrimSpace(source); source != "" {
+			if tracer == nil {
+				tracer = tq.NewTracer(os.Stderr)
+			}
+			tracer.Add(tq.TraceFilter{Source: source})
+		}
+	}
+
+	var identityKey []byte
+	if *identityKeyFile != "" {
+		identityKey, err = os.ReadFile(*identityKeyFile)
+		if err != nil {
+			logger.Fatalf(ctx, "error reading identity key; %v", err)
+			return
+		}
+		identityKey = []byte(strings.TrimSpace(string(identityKey)))
+	}
+	if *traceIdentity != "" {
+		if tracer == nil {
+			logger.Fatalf(ctx, "-trace-identity reports the usernames of -trace-sources, which is unset")
+			return
+		}
+		o, err := tq.NewIdentityObfuscator(*traceIdentity, identityKey, *identityTopK)
+		if err != nil {
+			logger.Fatalf(ctx, "error configuring -trace-identity; %v", err)
+			return
+		}
+		tracer.SetIdentity(o)
+	}
+
+	opts := []tq.Option{
+		tq.SetUseProxy(*proxy),
+		tq.SetConformanceCheck(*conformance),
+		tq.SetBodyLengthCheck(*bodyLengthCheck),
+		tq.SetReplyCheck(*replyCheck),
+		tq.SetBodyOwnershipCheck(*bodyOwnership),
+		tq.SetPadCache(*padCache),
+		tq.SetTimeoutJitter(*timeoutJitter),
+		tq.SetShutdownBudget(*shutdownBudget),
+		tq.SetSecretGracePeriod(*secretGrace),
+		tq.SetSingleConnectIdleTimeout(*singleConnectIdle),
+		tq.SetMaxConnectionLifetime(*maxLifetime),
+		tq.SetMaxInteractiveSessions(*maxInteractive),
+	}
+	if tracer != nil {
+		opts = append(opts, tq.SetTracer(tracer))
+	}
+	if *metricsIdentity != "" {
+		o, err := tq.NewIdentityObfuscator(*metricsIdentity, identityKey, *identityTopK)
+		if err != nil {
+			logger.Fatalf(ctx, "error configuring -metrics-identity; %v", err)
+			return
+		}
+		opts = append(opts, tq.SetMetricsIdentity(o))
+	}
+	if *warmDevices != "" {
+		devices, err := readWarmDevices(*warmDevices)
+		if err != nil {
+			logger.Fatalf(ctx, "error reading -warm-devices-file; %v", err)
+			return
+		}
+		opts = append(opts, tq.SetSecretWarmup(devices, *warmBudget))
+	}
+	if *featureStateFile != "" {
+		features := tq.NewFeatureTracker(*featureDevices)
+		if err := features.Load(*featureStateFile); err != nil {
+			logger.Fatalf(ctx, "error loading -feature-state-file; %v", err)
+			return
+		}
+		persisted := make(chan struct{})
+		go func() {
+			features.Persist(ctx, *featureStateFile, *featureInterval, logger)
+			close(persisted)
+		}()
+		// the last save runs once ctx is done
+		defer func() {
+			cancel()
+			<-persisted
+		}()
+		opts = append(opts, tq.SetFeatureTracker(features))
+		exporter.HandleFeatures(features)
+	}
+	if batched != nil {
+		opts = append(opts, tq.SetShutdownSink("accounting", batched))
+	}
+	if *shutdownSpoolDir != "" {
+		opts = append(opts, tq.SetShutdownSpool(tq.NewFileSpool(*shutdownSpoolDir)))
+	}
+	s := tq.NewServer(logger, sp, opts...)
+	exporter.HandleShutdown(s)
+	exporter.HandleStatus(exporter.StatusSources{Server: s, Config: sp, Backends: exporter.BackendsOf(authenticators)})
+	// draining cancels the context the server serves with, as a signal does
+	controls := admin.Controls{Server: s, Drain: cancel, Logger: logger, Config: watcher, Effective: sp}
+	if *diagnosticUser != "" {
+		if *tlsCert != "" {
+			logger.Fatalf(ctx, "diagnostics are not supported over tls")
+			return
+		}
+		if *adminAddress == "" {
+			logger.Fatalf(ctx, "diagnostics are run on the admin api, -diagnostic-user needs -admin-address")
+			return
+		}
+		dopts := []tq.DiagnosticOption{
+			tq.SetDiagnosticInterval(*diagnosticEvery),
+			tq.SetDiagnosticTimeout(*diagnosticTimeout),
+			tq.SetDiagnosticCommand(synthetic.Service, "show"),
+		}
+		if *proxy {
+			dopts = append(dopts, tq.SetDiagnosticProxy(net.IPv6loopback.String()))
+		}
+		controls.Diagnostics = tq.NewDiagnostics(
+			*network,
+			diagnosticAddress(tcpListener.Addr().(*net.TCPAddr)),
+			[]byte(os.Getenv("TACACS_DIAGNOSTIC_SECRET")),
+			*diagnosticUser,
+			os.Getenv("TACACS_DIAGNOSTIC_PASSWORD"),
+			dopts...,
+		)
+	}
+	if *adminAddress != "" {
+		token, err := readAdminToken(*adminTokenFile)
+		if err != nil {
+			logger.Fatalf(ctx, "error configuring the admin api; %v", err)
+			return
+		}
+		adminTLS, err := newAdminTLSConfig()
+		if err != nil {
+			logger.Fatalf(ctx, "error configuring tls of the admin api; %v", err)
+			return
+		}
+		h := admin.NewHandler(controls, admin.TokenAuth(token))
+		go func() {
+			if err := admin.ListenAndServe(ctx, *adminAddress, h, adminTLS); err != nil {
+				logger.Errorf(ctx, "failed to start the admin api: %v", err)
+			}
+		}()
+	}
+	if err := s.Serve(ctx, serveListener); err != nil {
 		logger.Errorf(ctx, "error listening: %v", err)
 		return
 	}
 }
+
+// diagnosticAddress returns the loopback address of the listener on addr, which diagnostic runs
+// connect to as a probe source of the synthetic user
+func diagnosticAddress(addr *net.TCPAddr) string {
+	ip := addr.IP
+	if ip.IsUnspecified() {
+		ip = net.IPv6loopback
+		if ip4 := addr.IP.To4(); ip4 != nil || *network == "tcp4" {
+			ip = net.IPv4(127, 0, 0, 1)
+		}
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(addr.Port))
+}
+
+// readWarmDevices reads the device addresses of path, one per line.  blank lines and lines
+// starting with # are skipped.
+func readWarmDevices(path string) ([]net.Addr, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var devices []net.Addr
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ip := net.ParseIP(line)
+		if ip == nil {
+			return nil, fmt.Errorf("line %v: [%v] is not an ip address", i+1, line)
+		}
+		devices = append(devices, &net.TCPAddr{IP: ip})
+	}
+	return devices, nil
+}
+
+// readAdminToken reads the bearer token of the admin api from path
+func readAdminToken(path string) ([]byte, error) {
+	if path == "" {
+		return nil, fmt.Errorf("-admin-token-file is required")
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	token := []byte(strings.TrimSpace(string(b)))
+	if len(token) == 0 {
+		return nil, fmt.Errorf("the token of [%v] is empty", path)
+	}
+	return token, nil
+}
+
+// newAdminTLSConfig returns the tls config of the admin api from its tls flags, nil if they are
+// unset
+func newAdminTLSConfig() (*tls.Config, error) {
+	if *adminTLSCert == "" && *adminTLSKey == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(*adminTLSCert, *adminTLSKey)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+// newTLSListener wraps listener using the tls flags
+func newTLSListener(listener *net.TCPListener) (*tq.TLSListener, error) {
+	cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+	if err != nil {
+		return nil, err
+	}
+	minVersion, err := tq.ParseTLSVersion(*tlsMinVersion)
+	if err != nil {
+		return nil, err
+	}
+	opts := []tq.TLSOption{tq.SetTLSCertificates(cert), tq.SetTLSMinVersion(minVersion)}
+	if *tlsCipherSuites != "" {
+		suites, err := tq.ParseCipherSuites(*tlsCipherSuites)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, tq.SetTLSCipherSuites(suites...))
+	}
+	return tq.NewTLSListener(listener, opts...)
+}
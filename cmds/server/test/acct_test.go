@@ -16,6 +16,7 @@ import (
 	tq "github.com/facebookincubator/tacquito"
 
 	"github.com/davecgh/go-spew/spew"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -120,3 +121,66 @@ func TestAccountingPacketNoAuthen(t *testing.T) {
 		t.Fatalf("unexpected error %v", err)
 	}
 }
+
+// gatherCounter returns the value of a registered counter without labels
+func gatherCounter(t *testing.T, name string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	assert.NoError(t, err)
+	for _, f := range families {
+		if f.GetName() == name {
+			return f.GetMetric()[0].GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+func TestAccountingSystemEvent(t *testing.T) {
+	logger := NewDefaultLogger(30) // no logs
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sp, err := MockSecretProvider(ctx, logger, "testdata/test_config.yaml")
+	assert.NoError(t, err)
+
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	assert.NoError(t, err)
+	go tq.NewServer(logger, sp).Serve(ctx, listener.(*net.TCPListener))
+
+	var f tq.AcctRequestFlag
+	f.Set(tq.AcctFlagStop)
+	// reload and config save records from two vendors, none of which carry a user
+	fixtures := []tq.Args{
+		{"task_id=42", "timezone=UTC", "service=system", "event=sys_acct", "reason=reload"},
+		{"task_id=43", "timezone=UTC", "service=system", "event=sys_acct", "reason=write memory"},
+		{"service=system", "event=reboot"},
+		{"service=system", "event=commit"},
+	}
+	accounterNil := gatherCounter(t, "tacquito_accountingrequest_handle_accounter_nil")
+	for i, args := range fixtures {
+		c, err := tq.NewClient(tq.SetClientDialer("tcp6", listener.Addr().String(), []byte("fooman")))
+		assert.NoError(t, err)
+		resp, err := c.Send(tq.NewPacket(
+			tq.SetPacketHeader(tq.NewHeader(
+				tq.SetHeaderVersion(tq.Version{MajorVersion: tq.MajorVersion, MinorVersion: tq.MinorVersionDefault}),
+				tq.SetHeaderType(tq.Accounting),
+				tq.SetHeaderSessionID(tq.SessionID(100+i)),
+			)),
+			tq.SetPacketBodyUnsafe(tq.NewAcctRequest(
+				tq.SetAcctRequestFlag(f),
+				tq.SetAcctRequestMethod(tq.AuthenMethodNotSet),
+				tq.SetAcctRequestPrivLvl(tq.PrivLvlUser),
+				tq.SetAcctRequestType(tq.AuthenTypeNotSet),
+				tq.SetAcctRequestService(tq.AuthenServiceNone),
+				tq.SetAcctRequestArgs(args),
+			)),
+		))
+		assert.NoError(t, err, args)
+		if assert.NotNil(t, resp, args) {
+			var body tq.AcctReply
+			assert.NoError(t, tq.Unmarshal(resp.Body, &body))
+			assert.Equal(t, tq.AcctReplyStatusSuccess, body.Status, args)
+		}
+		c.Close()
+	}
+	// routed to the system_event_user accounter, so none count as a missing accounter
+	assert.Equal(t, accounterNil, gatherCounter(t, "tacquito_accountingrequest_handle_accounter_nil"))
+}
@@ -162,6 +162,131 @@ func PapLoginFlow() Test {
 	}
 }
 
+// UnsupportedAuthenTypeFlow sends a valid, but unimplemented, authen_type and expects a clean fail
+func UnsupportedAuthenTypeFlow() Test {
+	return Test{
+		Name:   "unsupported authen_type",
+		Secret: []byte("fooman"),
+		Seq: []Sequence{
+			{
+				Packet: tq.NewPacket(
+					tq.SetPacketHeader(
+						tq.NewHeader(
+							tq.SetHeaderVersion(tq.Version{MajorVersion: tq.MajorVersion, MinorVersion: tq.MinorVersionOne}),
+							tq.SetHeaderType(tq.Authenticate),
+							tq.SetHeaderRandomSessionID(),
+						),
+					),
+					tq.SetPacketBodyUnsafe(
+						tq.NewAuthenStart(
+							tq.SetAuthenStartType(tq.AuthenTypeCHAP),
+							tq.SetAuthenStartAction(tq.AuthenActionLogin),
+							tq.SetAuthenStartPrivLvl(tq.PrivLvlUser),
+							tq.SetAuthenStartPort("tty0"),
+							tq.SetAuthenStartUser("mr_uses_group"),
+						),
+					),
+				),
+				ValidateBody: func(response []byte) error {
+					var body tq.AuthenReply
+					if err := tq.Unmarshal(response, &body); err != nil {
+						return err
+					}
+					if body.Status != tq.AuthenStatusFail {
+						spew.Dump(body)
+						return fmt.Errorf("failed to match AuthenStatusFail")
+					}
+					return nil
+				},
+			},
+		},
+	}
+}
+
+// VendorAuthenType is an authen_type outside of the rfc, as sent by vendor extensions
+const VendorAuthenType tq.AuthenType = 0x2a
+
+// VendorAuthenTypeFlow sends a vendor authen_type and expects a clean fail naming it
+func VendorAuthenTypeFlow() Test {
+	return Test{
+		Name:   "vendor authen_type",
+		Secret: []byte("fooman"),
+		Seq: []Sequence{
+			{
+				Packet: tq.NewPacket(
+					tq.SetPacketHeader(
+						tq.NewHeader(
+							tq.SetHeaderVersion(tq.Version{MajorVersion: tq.MajorVersion, MinorVersion: tq.MinorVersionOne}),
+							tq.SetHeaderType(tq.Authenticate),
+							tq.SetHeaderRandomSessionID(),
+						),
+					),
+					tq.SetPacketBodyUnsafe(
+						tq.NewAuthenStart(
+							tq.SetAuthenStartType(VendorAuthenType),
+							tq.SetAuthenStartAction(tq.AuthenActionLogin),
+							tq.SetAuthenStartPrivLvl(tq.PrivLvlUser),
+							tq.SetAuthenStartPort("tty0"),
+							tq.SetAuthenStartUser("mr_uses_group"),
+						),
+					),
+				),
+				ValidateBody: func(response []byte) error {
+					var body tq.AuthenReply
+					if err := tq.Unmarshal(response, &body); err != nil {
+						return err
+					}
+					if body.Status != tq.AuthenStatusFail || body.ServerMsg != "unsupported authen_type [UNKNOWN(0x2a)]" {
+						spew.Dump(body)
+						return fmt.Errorf("failed to match AuthenStatusFail for the vendor authen_type")
+					}
+					return nil
+				},
+			},
+		},
+	}
+}
+
+// InvalidAuthenTypeFlow sends an undecodable body with an authen_type outside of the rfc range, as
+// a body decrypted with the wrong secret would look, and expects an error
+func InvalidAuthenTypeFlow() Test {
+	// action, priv_lvl, authen_type, authen_service, user_len, port_len, rem_addr_len, data_len
+	body := []byte{
+		uint8(tq.AuthenActionLogin), uint8(tq.PrivLvlUser), 0x42, uint8(tq.AuthenServiceLogin),
+		0x00, 0x04, 0x03, 0x10,
+	}
+	body = append(body, []byte("tty0foo")...)
+	return Test{
+		Name:   "invalid authen_type",
+		Secret: []byte("fooman"),
+		Seq: []Sequence{
+			{
+				Packet: tq.NewPacket(
+					tq.SetPacketHeader(
+						tq.NewHeader(
+							tq.SetHeaderVersion(tq.Version{MajorVersion: tq.MajorVersion, MinorVersion: tq.MinorVersionOne}),
+							tq.SetHeaderType(tq.Authenticate),
+							tq.SetHeaderRandomSessionID(),
+						),
+					),
+					tq.SetPacketBody(body),
+				),
+				ValidateBody: func(response []byte) error {
+					var body tq.AuthenReply
+					if err := tq.Unmarshal(response, &body); err != nil {
+						return err
+					}
+					if body.Status != tq.AuthenStatusError {
+						spew.Dump(body)
+						return fmt.Errorf("failed to match AuthenStatusError")
+					}
+					return nil
+				},
+			},
+		},
+	}
+}
+
 // ASCIILoginEnable ..
 func ASCIILoginEnable() Test {
 	startPacket := BuildASCIIStartPacket()
@@ -430,7 +555,7 @@ func GetASCIILoginAbortTests() []Test {
 						tq.NewHeader(
 							tq.SetHeaderVersion(tq.Version{MajorVersion: tq.MajorVersion, MinorVersion: tq.MinorVersionDefault}),
 							tq.SetHeaderType(tq.Authenticate),
-							tq.SetHeaderSeqNo(7),
+							tq.SetHeaderSeqNo(5),
 							tq.SetHeaderSessionID(startPacket.Header.SessionID),
 						),
 					),
@@ -36,10 +36,12 @@ func TestAuthenticate(t *testing.T) {
 		}
 	}()
 
+	// the ascii login and pap flows run as golden conversations, see TestGoldenConversations
 	tests := []Test{
-		ASCIILoginFullFlow(),
 		ASCIILoginEnable(),
-		PapLoginFlow(),
+		UnsupportedAuthenTypeFlow(),
+		VendorAuthenTypeFlow(),
+		InvalidAuthenTypeFlow(),
 	}
 
 	tests = append(tests, GetASCIIEnableAbortTests()...)
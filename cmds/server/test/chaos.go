@@ -0,0 +1,109 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package test
+
+import (
+	"math/rand"
+	"time"
+
+	tq "github.com/facebookincubator/tacquito"
+	"github.com/facebookincubator/tacquito/cmds/server/config"
+)
+
+// Chaos describes the faults to inject into a backend handler.  Latency is added before every
+// request and ErrorRate, from 0 to 1, is the chance a request is answered with an error instead
+// of reaching the backend.
+type Chaos struct {
+	Latency   time.Duration
+	ErrorRate float64
+}
+
+// Wrap returns a handler that injects c into next.  Injected latency honors the request context,
+// so a handler timeout set on the server fires while the backend is still "slow".
+func (c Chaos) Wrap(next tq.Handler) tq.Handler {
+	return tq.HandlerFunc(func(response tq.Response, request tq.Request) {
+		if c.Latency > 0 {
+			select {
+			case <-time.After(c.Latency):
+			case <-request.Context.Done():
+				chaosReply(response, request.Header.Type, "chaos: "+request.Context.Err().Error())
+				return
+			}
+		}
+		if c.ErrorRate > 0 && rand.Float64() < c.ErrorRate {
+			chaosReply(response, request.Header.Type, "chaos: injected error")
+			return
+		}
+		next.Handle(response, request)
+	})
+}
+
+// chaosReply replies with the error status for the packet type
+func chaosReply(response tq.Response, t tq.HeaderType, msg string) {
+	switch t {
+	case tq.Authenticate:
+		response.Reply(tq.NewAuthenReply(tq.SetAuthenReplyStatus(tq.AuthenStatusError), tq.SetAuthenReplyServerMsg(msg)))
+	case tq.Authorize:
+		response.Reply(tq.NewAuthorReply(tq.SetAuthorReplyStatus(tq.AuthorStatusError), tq.SetAuthorReplyServerMsg(msg)))
+	case tq.Accounting:
+		response.Reply(tq.NewAcctReply(tq.SetAcctReplyStatus(tq.AcctReplyStatusError), tq.SetAcctReplyServerMsg(msg)))
+	}
+}
+
+type authenticatorFactory interface {
+	New(username string, options map[string]string) (tq.Handler, error)
+}
+
+// ChaosAuthenticator wraps every authenticator built by the factory with Chaos
+type ChaosAuthenticator struct {
+	Chaos
+	Factory authenticatorFactory
+}
+
+// New implements the loader authenticator factory
+func (c ChaosAuthenticator) New(username string, options map[string]string) (tq.Handler, error) {
+	h, err := c.Factory.New(username, options)
+	if err != nil {
+		return nil, err
+	}
+	return c.Wrap(h), nil
+}
+
+type authorizerFactory interface {
+	New(user config.User) (tq.Handler, error)
+}
+
+// ChaosAuthorizer wraps every authorizer built by the factory with Chaos
+type ChaosAuthorizer struct {
+	Chaos
+	Factory authorizerFactory
+}
+
+// New implements the loader authorizer factory
+func (c ChaosAuthorizer) New(user config.User) (tq.Handler, error) {
+	h, err := c.Factory.New(user)
+	if err != nil {
+		return nil, err
+	}
+	return c.Wrap(h), nil
+}
+
+type accounterFactory interface {
+	New(options map[string]string) tq.Handler
+}
+
+// ChaosAccounter wraps every accounter built by the factory with Chaos
+type ChaosAccounter struct {
+	Chaos
+	Factory accounterFactory
+}
+
+// New implements the loader accounter factory
+func (c ChaosAccounter) New(options map[string]string) tq.Handler {
+	return c.Wrap(c.Factory.New(options))
+}
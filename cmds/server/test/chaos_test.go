@@ -0,0 +1,94 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	tq "github.com/facebookincubator/tacquito"
+	"github.com/facebookincubator/tacquito/cmds/server/config"
+	"github.com/facebookincubator/tacquito/cmds/server/config/authenticators/bcrypt"
+	"github.com/facebookincubator/tacquito/cmds/server/config/authorizers/stringy"
+	"github.com/facebookincubator/tacquito/cmds/server/loader"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startChaosServer starts a server whose backends are wrapped with the provided loader options
+func startChaosServer(ctx context.Context, t *testing.T, serverOpts []tq.Option, opts ...loader.Option) string {
+	logger := NewDefaultLogger(30) // no logs
+	sp, err := MockSecretProvider(ctx, logger, "testdata/test_config.yaml", opts...)
+	assert.NoError(t, err)
+
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	assert.NoError(t, err)
+	tcpListener := listener.(*net.TCPListener)
+
+	s := tq.NewServer(logger, sp, serverOpts...)
+	go func() {
+		if err := s.Serve(ctx, tcpListener); err != nil {
+			assert.NoError(t, err)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestChaosAuthenticatorTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logger := NewDefaultLogger(30)
+	addr := startChaosServer(
+		ctx, t,
+		[]tq.Option{tq.SetHandlerTimeout(100 * time.Millisecond)},
+		loader.RegisterAuthenticator(config.BCRYPT, ChaosAuthenticator{
+			Chaos:   Chaos{Latency: 5 * time.Second},
+			Factory: bcrypt.New(logger, &shh{}),
+		}),
+	)
+
+	c, err := tq.NewClient(tq.SetClientDialer("tcp6", addr, []byte("fooman")))
+	assert.NoError(t, err)
+	defer c.Close()
+
+	start := time.Now()
+	resp, err := c.Send(PapLoginFlow().Seq[0].Packet)
+	assert.NoError(t, err)
+	assert.Less(t, time.Since(start), time.Second, "handler timeout did not fire")
+
+	var body tq.AuthenReply
+	assert.NoError(t, tq.Unmarshal(resp.Body, &body))
+	assert.Equal(t, tq.AuthenStatusError, body.Status)
+}
+
+func TestChaosAuthorizerErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logger := NewDefaultLogger(30)
+	addr := startChaosServer(
+		ctx, t,
+		nil,
+		loader.SetAuthorizerProvider(ChaosAuthorizer{
+			Chaos:   Chaos{ErrorRate: 1},
+			Factory: stringy.New(logger),
+		}),
+	)
+
+	c, err := tq.NewClient(tq.SetClientDialer("tcp6", addr, []byte("fooman")))
+	assert.NoError(t, err)
+	defer c.Close()
+
+	resp, err := c.Send(basicAuthorPacket("mr_uses_group", tq.Args{"service=shell", "cmd=configure", "cmd-arg=terminal", "cmd-arg=<cr>"}))
+	assert.NoError(t, err)
+
+	var body tq.AuthorReply
+	assert.NoError(t, tq.Unmarshal(resp.Body, &body))
+	assert.Equal(t, tq.AuthorStatusError, body.Status)
+}
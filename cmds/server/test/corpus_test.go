@@ -0,0 +1,128 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/facebookincubator/tacquito/tacquitotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// corpusDir holds the promoted decode corpus, see tacquitotest.PromoteCorpus
+var corpusDir = filepath.Join("testdata", "corpus")
+
+// corpusSeeds are inputs as a fuzzer would report them, incidental bytes and all.  Promoting them
+// with -update minimizes each and writes it to corpusDir, where TestDecodeCorpus keeps it failing.
+// New findings are added here the same way.
+var corpusSeeds = []struct {
+	name   string
+	target string
+	input  []byte
+}{
+	{
+		// a header announcing a body past MaxBodyLength
+		name:   "oversized body",
+		target: "packet",
+		input: []byte{
+			0xc1, 0x01, 0x01, 0x00, 0x12, 0x34, 0x56, 0x78, 0x00, 0x10, 0x00, 0x00,
+			'l', 'o', 'g', 'i', 'n', 0xde, 0xad, 0xbe, 0xef, 0x00,
+		},
+	},
+	{
+		// a user length past the end of the body
+		name:   "authen start user overrun",
+		target: "authen-start",
+		input: []byte{
+			0x01, 0x01, 0x02, 0x01, 0xc8, 0x03, 0x00, 0x00,
+			't', 't', 'y', 0x7f, 0x7f,
+		},
+	},
+	{
+		// an arg count with fewer arg lengths than it counts
+		name:   "author request arg count overrun",
+		target: "author-request",
+		input: []byte{
+			0x06, 0x01, 0x02, 0x01, 0x05, 0x00, 0x00, 0x03, 0x0b,
+			'a', 'd', 'm', 'i', 'n', 's', 'e', 'r', 'v', 'i', 'c', 'e', '=', 's', 'h', 'e', 'l', 'l',
+		},
+	},
+}
+
+func TestCorpusSeeds(t *testing.T) {
+	corpus := tacquitotest.ReadCorpus(t, corpusDir)
+	for _, seed := range corpusSeeds {
+		t.Run(seed.name, func(t *testing.T) {
+			c := tacquitotest.PromoteCorpus(t, seed.target, seed.input)
+			assert.Less(t, len(c.Input), len(seed.input), "nothing was minimized away")
+			if *updateGolden {
+				tacquitotest.WriteCorpus(t, corpusDir, c)
+				return
+			}
+			// promotion is deterministic, so the seed is in the corpus as it was promoted
+			assert.Contains(t, corpus, filepath.Base(tacquitotest.WriteCorpus(t, t.TempDir(), c)), "run with -update to promote it")
+		})
+	}
+}
+
+// TestDecodeCorpus runs every promoted input against its decoder, independent of any fuzz engine
+func TestDecodeCorpus(t *testing.T) {
+	corpus := tacquitotest.ReadCorpus(t, corpusDir)
+	require.NotEmpty(t, corpus)
+	for name, c := range corpus {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			failure, ok := tacquitotest.Decode(c.Target, c.Input)
+			require.True(t, ok, "[%v] now decodes %x", c.Target, c.Input)
+			assert.Equal(t, c.Failure, failure)
+		})
+	}
+}
+
+func TestWriteCorpusCollisions(t *testing.T) {
+	dir := t.TempDir()
+	c := tacquitotest.PromoteCorpus(t, corpusSeeds[0].target, corpusSeeds[0].input)
+	path := tacquitotest.WriteCorpus(t, dir, c)
+	// the same case again is the same file
+	assert.Equal(t, path, tacquitotest.WriteCorpus(t, dir, c))
+
+	// another case under the name takes a longer one, and leaves the first as it was
+	first, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, []byte("taken"), 0644))
+	other := tacquitotest.WriteCorpus(t, dir, c)
+	assert.NotEqual(t, path, other)
+	taken, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "taken", string(taken))
+	written, err := os.ReadFile(other)
+	require.NoError(t, err)
+	assert.Equal(t, first, written)
+}
+
+func TestMinimize(t *testing.T) {
+	// fails while the input holds a 0x2a after a 0x07, wherever they are
+	fails := func(data []byte) bool {
+		for i, b := range data {
+			if b == 0x07 {
+				for _, c := range data[i+1:] {
+					if c == 0x2a {
+						return true
+					}
+				}
+			}
+		}
+		return false
+	}
+	got := tacquitotest.Minimize(t, []byte{0x01, 0x07, 0x02, 0x03, 0x04, 0x2a, 0x05}, fails)
+	assert.Equal(t, []byte{0x07, 0x2a}, got)
+}
@@ -0,0 +1,74 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package test
+
+import (
+	"context"
+	"flag"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	tq "github.com/facebookincubator/tacquito"
+	"github.com/facebookincubator/tacquito/tacquitotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden files in testdata")
+
+// TestGoldenConversations runs flows against a server with deterministic session ids and clock,
+// and compares everything on the wire with testdata/<name>.golden.  Each flow gets its own server,
+// so the clock reads of one do not interleave with those of another.
+func TestGoldenConversations(t *testing.T) {
+	tests := []struct {
+		name string
+		test Test
+	}{
+		{name: "ascii-login-full-flow", test: ASCIILoginFullFlow()},
+		{name: "pap-login-flow", test: PapLoginFlow()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sources := tacquitotest.NewSources(t, 0x5eed, time.Millisecond)
+			recorder := tacquitotest.NewRecorder(t)
+			logger := NewDefaultLogger(30) // no logs
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			sp, err := MockSecretProvider(ctx, logger, "testdata/test_config.yaml")
+			require.NoError(t, err)
+			listener, err := net.Listen("tcp6", "[::1]:0")
+			require.NoError(t, err)
+			s := tq.NewServer(logger, sp, sources.ServerOption(), tq.SetPacketSink(recorder))
+			go s.Serve(ctx, listener.(*net.TCPListener))
+
+			c, err := tq.NewClient(tq.SetClientDialer("tcp6", listener.Addr().String(), tt.test.Secret), sources.ClientOption())
+			require.NoError(t, err)
+			defer c.Close()
+			id := c.NewSessionID()
+			for _, seq := range tt.test.Seq {
+				seq.Packet.Header.SessionID = id
+				resp, err := c.Send(seq.Packet)
+				require.NoError(t, err)
+				assert.NoError(t, seq.ValidateBody(resp.Body))
+			}
+
+			got := recorder.Conversation(tt.name, id, 2*len(tt.test.Seq), 5*time.Second)
+			path := filepath.Join("testdata", tt.name+".golden")
+			if *updateGolden {
+				require.NoError(t, os.WriteFile(path, []byte(got), 0644))
+			}
+			want, err := os.ReadFile(path)
+			require.NoError(t, err)
+			assert.Equal(t, string(want), got)
+		})
+	}
+}
@@ -0,0 +1,93 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package test
+
+import (
+	"context"
+	"testing"
+
+	tq "github.com/facebookincubator/tacquito"
+	"github.com/facebookincubator/tacquito/cmds/server/config"
+	"github.com/facebookincubator/tacquito/cmds/server/handlers"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// methodReply sends a login start with atype to h and returns the reply
+func methodReply(t *testing.T, h tq.Handler, atype tq.AuthenType) tq.AuthenReply {
+	body, err := tq.NewAuthenStart(
+		tq.SetAuthenStartAction(tq.AuthenActionLogin),
+		tq.SetAuthenStartPrivLvl(tq.PrivLvlUser),
+		tq.SetAuthenStartType(atype),
+		tq.SetAuthenStartService(tq.AuthenServiceLogin),
+		tq.SetAuthenStartPort("tty0"),
+	).MarshalBinary()
+	require.NoError(t, err)
+	r := &serviceResponse{}
+	h.Handle(r, tq.Request{
+		Header:  *tq.NewHeader(tq.SetHeaderType(tq.Authenticate), tq.SetHeaderSeqNo(1), tq.SetHeaderSessionID(1)),
+		Body:    body,
+		Context: context.Background(),
+	})
+	return r.reply
+}
+
+// gatherMethodDenied returns tacquito_authenstart_method_denied for action and atype
+func gatherMethodDenied(t *testing.T, action, atype string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	for _, f := range families {
+		if f.GetName() != "tacquito_authenstart_method_denied" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["action"] == action && labels["type"] == atype {
+				return m.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func TestAuthenMethodsFail(t *testing.T) {
+	start := handlers.NewStart(NewDefaultLogger(30))
+	hardened := start.New(context.Background(), config.Provider{}, map[string]string{"allowed_authen_methods": `{"login": ["pap"]}`})
+
+	denied := gatherMethodDenied(t, "login", "ascii")
+	reply := methodReply(t, hardened, tq.AuthenTypeASCII)
+	assert.Equal(t, tq.AuthenStatusFail, reply.Status)
+	assert.Equal(t, tq.AuthenServerMsg("this authentication method is not permitted on this device; login"), reply.ServerMsg)
+	assert.Equal(t, denied+1, gatherMethodDenied(t, "login", "ascii"))
+
+	// lab groups without the option allow everything
+	lab := start.New(context.Background(), config.Provider{}, map[string]string{})
+	assert.Equal(t, tq.AuthenStatusGetUser, methodReply(t, lab, tq.AuthenTypeASCII).Status)
+	assert.Equal(t, denied+1, gatherMethodDenied(t, "login", "ascii"))
+}
+
+func TestAuthenMethodsRestart(t *testing.T) {
+	start := handlers.NewStart(NewDefaultLogger(30))
+	hardened := start.New(context.Background(), config.Provider{}, map[string]string{
+		"allowed_authen_methods": `{"login": ["pap", "chap"]}`,
+		"authen_method_denial":   "restart",
+	})
+	reply := methodReply(t, hardened, tq.AuthenTypeASCII)
+	assert.Equal(t, tq.AuthenStatusRestart, reply.Status)
+	// the data lists the allowed authen_types, one byte each
+	assert.Equal(t, tq.AuthenData([]byte{byte(tq.AuthenTypePAP), byte(tq.AuthenTypeCHAP)}), reply.Data)
+
+	// an unparsable matrix fails closed
+	broken := start.New(context.Background(), config.Provider{}, map[string]string{"allowed_authen_methods": `{"login": ["telnet"]}`})
+	assert.Equal(t, tq.AuthenStatusFail, methodReply(t, broken, tq.AuthenTypeASCII).Status)
+}
@@ -39,16 +39,14 @@ type Sequence struct {
 	Validate       func(p *tq.Packet) error
 }
 
-// MockSecretProvider creates a mock secret provider
-func MockSecretProvider(ctx context.Context, logger loggerProvider, configPath string) (tq.SecretProvider, error) {
+// MockSecretProvider creates a mock secret provider.  opts are applied after the defaults and may
+// replace any of the registered providers.
+func MockSecretProvider(ctx context.Context, logger loggerProvider, configPath string, opts ...loader.Option) (tq.SecretProvider, error) {
 	accountingLogger, err := local.New(logger, local.SetLogSinkDefault("/tmp/tacquito_accounting.log", "tacquito"))
 	if err != nil {
 		return nil, fmt.Errorf("error building accounting logger; %v", err)
 	}
-	sp, err := loader.NewLocalConfig(
-		ctx,
-		configPath,
-		yaml.New(),
+	defaults := []loader.Option{
 		loader.SetLoggerProvider(logger),
 		loader.SetKeychainProvider(secret.New()),
 		loader.SetConfigProvider(config.New()),
@@ -57,7 +55,8 @@ func MockSecretProvider(ctx context.Context, logger loggerProvider, configPath s
 		loader.RegisterAuthenticator(config.BCRYPT, bcrypt.New(logger, &shh{})),
 		loader.RegisterAccounter(config.FILE, accountingLogger),
 		loader.RegisterHandlerType(config.START, handlers.NewStart(logger)),
-	)
+	}
+	sp, err := loader.NewLocalConfig(ctx, configPath, yaml.New(), append(defaults, opts...)...)
 	if err != nil {
 		return nil, err
 	}
@@ -42,8 +42,9 @@ func BenchmarkPacketExchangeAsciiLoginUsingSharedClient(b *testing.B) {
 	assert.NoError(b, err)
 	defer c.Close()
 
-	test := ASCIILoginFullFlow()
 	for n := 0; n < b.N; n++ {
+		// each flow needs a new session id, a completed session id may not be reused on a connection
+		test := ASCIILoginFullFlow()
 		for _, s := range test.Seq {
 			c.Send(s.Packet)
 		}
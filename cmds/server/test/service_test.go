@@ -0,0 +1,137 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package test
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	tq "github.com/facebookincubator/tacquito"
+	"github.com/facebookincubator/tacquito/cmds/server/config"
+	"github.com/facebookincubator/tacquito/cmds/server/handlers"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serviceResponse keeps the authenticate reply of a request
+type serviceResponse struct {
+	reply tq.AuthenReply
+}
+
+func (r *serviceResponse) Reply(v tq.EncoderDecoder) (int, error) {
+	b, err := v.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	return 0, tq.Unmarshal(b, &r.reply)
+}
+func (r *serviceResponse) Write(p *tq.Packet) (int, error) { return 0, nil }
+func (r *serviceResponse) Next(next tq.Handler)            {}
+func (r *serviceResponse) RegisterWriter(io.Writer)        {}
+
+// serviceStart returns the body of an ascii login for svc
+func serviceStart(t *testing.T, svc tq.AuthenService) []byte {
+	b, err := tq.NewAuthenStart(
+		tq.SetAuthenStartAction(tq.AuthenActionLogin),
+		tq.SetAuthenStartPrivLvl(tq.PrivLvlRoot),
+		tq.SetAuthenStartType(tq.AuthenTypeASCII),
+		tq.SetAuthenStartService(tq.AuthenServiceLogin),
+		tq.SetAuthenStartPort("tty0"),
+	).MarshalBinary()
+	require.NoError(t, err)
+	// the service is set on the wire so values outside of the rfc can be sent
+	b[3] = uint8(svc)
+	return b
+}
+
+// serviceReply sends an ascii login for svc to h and returns the reply
+func serviceReply(t *testing.T, h tq.Handler, svc tq.AuthenService) tq.AuthenReply {
+	r := &serviceResponse{}
+	h.Handle(r, tq.Request{
+		Header:  *tq.NewHeader(tq.SetHeaderType(tq.Authenticate), tq.SetHeaderSeqNo(1), tq.SetHeaderSessionID(1)),
+		Body:    serviceStart(t, svc),
+		Context: context.Background(),
+	})
+	return r.reply
+}
+
+// gatherServiceCounter returns the value of the counter name for service
+func gatherServiceCounter(t *testing.T, name, service string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "service" && l.GetValue() == service {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestAuthenServiceRouting(t *testing.T) {
+	ctx := context.Background()
+	start := handlers.NewStart(NewDefaultLogger(30))
+	start.HandleService(tq.AuthenServiceEnable, tq.HandlerFunc(func(response tq.Response, request tq.Request) {
+		response.Reply(tq.NewAuthenReply(tq.SetAuthenReplyStatus(tq.AuthenStatusPass), tq.SetAuthenReplyServerMsg("enable authenticator")))
+	}))
+	h := start.New(ctx, config.Provider{}, map[string]string{})
+
+	enabled := gatherServiceCounter(t, "tacquito_authenstart_handle_service", "enable")
+	reply := serviceReply(t, h, tq.AuthenServiceEnable)
+	assert.Equal(t, tq.AuthenStatusPass, reply.Status)
+	assert.Equal(t, tq.AuthenServerMsg("enable authenticator"), reply.ServerMsg)
+	assert.Equal(t, enabled+1, gatherServiceCounter(t, "tacquito_authenstart_handle_service", "enable"))
+
+	// services without a route keep the routes by authen_type
+	assert.Equal(t, tq.AuthenStatusGetUser, serviceReply(t, h, tq.AuthenServiceLogin).Status)
+	assert.Equal(t, tq.AuthenStatusGetUser, serviceReply(t, h, tq.AuthenServicePPP).Status)
+}
+
+func TestAuthenServiceAllowed(t *testing.T) {
+	ctx := context.Background()
+	start := handlers.NewStart(NewDefaultLogger(30))
+	h := start.New(ctx, config.Provider{}, map[string]string{"allowed_services": `["login", "ENABLE", "bogus"]`})
+
+	assert.Equal(t, tq.AuthenStatusGetUser, serviceReply(t, h, tq.AuthenServiceLogin).Status)
+	assert.Equal(t, tq.AuthenStatusGetUser, serviceReply(t, h, tq.AuthenServiceEnable).Status)
+
+	denied := gatherServiceCounter(t, "tacquito_authenstart_service_denied", "ppp")
+	reply := serviceReply(t, h, tq.AuthenServicePPP)
+	assert.Equal(t, tq.AuthenStatusFail, reply.Status)
+	assert.Equal(t, tq.AuthenServerMsg("this service is not permitted on this device; ppp"), reply.ServerMsg)
+	assert.Equal(t, denied+1, gatherServiceCounter(t, "tacquito_authenstart_service_denied", "ppp"))
+
+	// the routes of other device groups are not affected
+	other := start.New(ctx, config.Provider{}, map[string]string{})
+	assert.Equal(t, tq.AuthenStatusGetUser, serviceReply(t, other, tq.AuthenServicePPP).Status)
+}
+
+func TestAuthenServiceUnknown(t *testing.T) {
+	h := handlers.NewStart(NewDefaultLogger(30)).New(context.Background(), config.Provider{}, map[string]string{})
+	unknown := gatherServiceCounter(t, "tacquito_authenstart_handle_service", "unknown")
+	reply := serviceReply(t, h, tq.AuthenService(0x2a))
+	assert.Equal(t, tq.AuthenStatusFail, reply.Status)
+	assert.Equal(t, tq.AuthenServerMsg("unsupported authen_service [UNKNOWN(0x2a)]"), reply.ServerMsg)
+	assert.Equal(t, unknown+1, gatherServiceCounter(t, "tacquito_authenstart_handle_service", "unknown"))
+
+	svc, ok := tq.AuthenServiceByName("FwProxy")
+	assert.True(t, ok)
+	assert.Equal(t, tq.AuthenServiceFwProxy, svc)
+	_, ok = tq.AuthenServiceByName("telnet")
+	assert.False(t, ok)
+	assert.Equal(t, "unknown", tq.AuthenService(0x2a).Name())
+}
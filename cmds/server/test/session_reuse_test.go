@@ -0,0 +1,103 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	tq "github.com/facebookincubator/tacquito"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startReuseServer starts a server for session reuse tests and returns its address
+func startReuseServer(ctx context.Context, t *testing.T, opts ...tq.Option) string {
+	logger := NewDefaultLogger(30) // no logs
+	sp, err := MockSecretProvider(ctx, logger, "testdata/test_config.yaml")
+	assert.NoError(t, err)
+
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	assert.NoError(t, err)
+	tcpListener := listener.(*net.TCPListener)
+
+	s := tq.NewServer(logger, sp, opts...)
+	go func() {
+		if err := s.Serve(ctx, tcpListener); err != nil {
+			assert.NoError(t, err)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// runFlow sends every packet in test on c and returns the first error encountered
+func runFlow(c *tq.Client, test Test) error {
+	for _, s := range test.Seq {
+		resp, err := c.Send(s.Packet)
+		if err != nil {
+			return err
+		}
+		if err := s.ValidateBody(resp.Body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestSessionImplicitReuse(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	addr := startReuseServer(ctx, t)
+
+	c, err := tq.NewClient(tq.SetClientDialer("tcp6", addr, []byte("fooman")))
+	assert.NoError(t, err)
+	defer c.Close()
+
+	// back to back sessions on one connection, without single-connect
+	for _, test := range []Test{PapLoginFlow(), ASCIILoginFullFlow(), PapLoginFlow()} {
+		assert.NoError(t, runFlow(c, test), "test name [%v]", test.Name)
+	}
+}
+
+func TestSessionIDReuse(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	addr := startReuseServer(ctx, t)
+
+	c, err := tq.NewClient(tq.SetClientDialer("tcp6", addr, []byte("fooman")))
+	assert.NoError(t, err)
+	defer c.Close()
+
+	first := PapLoginFlow()
+	assert.NoError(t, runFlow(c, first))
+
+	// a new seq 1 packet with the sessionID that just completed is rejected and the connection closed
+	replay := PapLoginFlow()
+	replay.Seq[0].Packet.Header.SessionID = first.Seq[0].Packet.Header.SessionID
+	assert.Error(t, runFlow(c, replay))
+}
+
+func TestSessionReuseIdleTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	addr := startReuseServer(ctx, t, tq.SetIdleTimeout(250*time.Millisecond))
+
+	c, err := tq.NewClient(tq.SetClientDialer("tcp6", addr, []byte("fooman")))
+	assert.NoError(t, err)
+	defer c.Close()
+
+	// reuse within the idle timeout is fine
+	assert.NoError(t, runFlow(c, PapLoginFlow()))
+	assert.NoError(t, runFlow(c, PapLoginFlow()))
+
+	// a connection awaiting a new session is still subject to the idle timeout
+	time.Sleep(500 * time.Millisecond)
+	assert.Error(t, runFlow(c, PapLoginFlow()))
+}
@@ -0,0 +1,104 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// coalescedHandler replies pass, records the sessions it saw and applies a length delta if set
+type coalescedHandler struct {
+	delta int
+	seen  chan SessionID
+}
+
+func (h coalescedHandler) Handle(response Response, request Request) {
+	h.seen <- request.Header.SessionID
+	response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusPass)))
+}
+
+func (h coalescedHandler) LengthDelta() (int, time.Duration) {
+	return h.delta, 50 * time.Millisecond
+}
+
+// rawTestPacket returns the crypted wire format of an authen start for session id
+func rawTestPacket(t *testing.T, secret []byte, id SessionID, flags HeaderFlag) []byte {
+	p := proxyTestPacket()
+	p.Header.SessionID = id
+	p.Header.Flags = flags
+	p.Header.Length = uint32(len(p.Body))
+	assert.NoError(t, crypt(secret, p))
+	b, err := p.MarshalBinary()
+	assert.NoError(t, err)
+	return b
+}
+
+func TestCoalescedPackets(t *testing.T) {
+	const proxyHeader = "PROXY TCP4 192.0.2.10 192.0.2.1 5000 49\r\n\x00"
+	secret := []byte("fooman")
+	for _, proxy := range []string{"none", "once", "every"} {
+		for _, delta := range []int{0, 4, -4} {
+			for _, conformance := range []bool{false, true} {
+				for _, flags := range []HeaderFlag{0, SingleConnect} {
+					name := fmt.Sprintf("proxy %v delta %v conformance %v flags %v", proxy, delta, conformance, flags)
+					t.Run(name, func(t *testing.T) {
+						listener, err := net.Listen("tcp", "127.0.0.1:0")
+						assert.NoError(t, err)
+						defer listener.Close()
+
+						h := coalescedHandler{delta: delta, seen: make(chan SessionID, 3)}
+						// back to back sessions without single-connect are only accepted by a tolerant server
+						s := NewServer(nopLogger{}, nil, SetConformanceCheck(conformance), SetImplicitSessionReuse(true))
+						go func() {
+							conn, err := listener.Accept()
+							if err != nil {
+								return
+							}
+							s.handle(context.Background(), newCrypter(roleServer, secret, conn, proxy != "none"), h)
+						}()
+
+						conn, err := net.Dial("tcp", listener.Addr().String())
+						assert.NoError(t, err)
+						defer conn.Close()
+
+						// three complete packets in a single write
+						var b []byte
+						for i := 1; i <= 3; i++ {
+							if proxy == "every" || (proxy == "once" && i == 1) {
+								b = append(b, proxyHeader...)
+							}
+							b = append(b, rawTestPacket(t, secret, SessionID(i), flags)...)
+						}
+						_, err = conn.Write(b)
+						assert.NoError(t, err)
+
+						c := newCrypter(roleClient, secret, conn, false)
+						assert.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+						for i := 1; i <= 3; i++ {
+							resp, err := c.read()
+							if !assert.NoError(t, err, "reply %v", i) {
+								return
+							}
+							assert.Equal(t, SessionID(i), resp.Header.SessionID)
+							var body AuthenReply
+							assert.NoError(t, Unmarshal(resp.Body, &body))
+							assert.Equal(t, AuthenStatusPass, body.Status)
+							assert.Equal(t, SessionID(i), <-h.seen)
+						}
+					})
+				}
+			}
+		}
+	}
+}
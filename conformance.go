@@ -0,0 +1,217 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+// Violation is a single breach of the tacacs+ protocol rules seen within a session
+type Violation struct {
+	// Side is the sender of the offending packet
+	Side      Direction
+	SessionID SessionID
+	SeqNo     SequenceNumber
+	// Rule is the short name of the rule that was broken; length, seq, direction, flags, type, version
+	// or ownership
+	Rule   string
+	Detail string
+}
+
+// String ...
+func (v Violation) String() string {
+	return fmt.Sprintf("%v violated %v in sessionID [%v] seq [%v]; %v", v.Side, v.Rule, v.SessionID, v.SeqNo, v.Detail)
+}
+
+// conformance holds the state of a single session as seen by the checker
+type conformance struct {
+	// started is set once the first packet of the session was seen
+	started bool
+	last    SequenceNumber
+	version uint8
+	t       HeaderType
+	flags   HeaderFlag
+}
+
+// knownFlags are the only header flag bits defined by the rfc
+const knownFlags = UnencryptedFlag | SingleConnect
+
+// observe checks the next raw, clear text, packet of a session sent by d.  It reports if the
+// session is over and any violations found.
+func (c *conformance) observe(d Direction, raw []byte) (bool, []Violation) {
+	if len(raw) < MaxHeaderLength {
+		return true, []Violation{{Side: d, Rule: "length", Detail: fmt.Sprintf("packet of [%v] bytes is shorter than a header", len(raw))}}
+	}
+	// flags are read from the raw bytes, Header.UnmarshalBinary alters them on some packets
+	version, t, seq, flags := raw[0], HeaderType(raw[1]), SequenceNumber(raw[2]), HeaderFlag(raw[3])
+	id := SessionID(binary.BigEndian.Uint32(raw[4:]))
+	length := binary.BigEndian.Uint32(raw[8:])
+	body := raw[MaxHeaderLength:]
+
+	var violations []Violation
+	report := func(rule, format string, args ...interface{}) {
+		violations = append(violations, Violation{Side: d, SessionID: id, SeqNo: seq, Rule: rule, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	if int(length) != len(body) {
+		report("length", "header declares [%v] bytes but the body has [%v]", length, len(body))
+	}
+	if length == 0 {
+		report("length", "body is empty")
+	}
+	switch {
+	case seq%2 == 1 && d != DirectionClient:
+		report("direction", "odd sequence numbers are only sent by the client")
+	case seq%2 == 0 && d != DirectionServer:
+		report("direction", "even sequence numbers are only sent by the server")
+	}
+	if !c.started {
+		if seq != 1 {
+			report("seq", "session started at [%v], expected 1", seq)
+		}
+		c.started, c.version, c.t, c.flags = true, version, t, flags
+	} else {
+		if seq != c.last+1 {
+			report("seq", "expected [%v] after [%v]", c.last+1, c.last)
+		}
+		if version != c.version {
+			report("version", "version [%#x] differs from [%#x] used by the session", version, c.version)
+		}
+		if t != c.t {
+			report("type", "packet type [%v] differs from [%v] used by the session", t, c.t)
+		}
+		if flags&UnencryptedFlag != c.flags&UnencryptedFlag {
+			report("flags", "unencrypted flag changed within the session")
+		}
+		if seq == 2 && flags&SingleConnect != 0 && c.flags&SingleConnect == 0 {
+			report("flags", "single-connect was set in reply to a client that did not request it")
+		}
+	}
+	if version>>4 != MajorVersion {
+		report("version", "unknown major version [%#x]", version>>4)
+	}
+	if flags&^knownFlags != 0 {
+		report("flags", "unknown flag bits [%#x] are set", uint8(flags&^knownFlags))
+	}
+	c.last = seq
+
+	if d != DirectionServer {
+		return false, violations
+	}
+	if t == Authenticate && len(body) > 0 {
+		switch AuthenStatus(body[0]) {
+		case AuthenStatusRestart:
+			// the client starts over with a new start packet in the same session
+			c.started = false
+			return false, violations
+		case AuthenStatusGetData, AuthenStatusGetUser, AuthenStatusGetPass:
+			return false, violations
+		}
+	}
+	return true, violations
+}
+
+// CheckSession replays a recorded session through the conformance rules and returns any
+// violations found, in the order they occurred
+func CheckSession(f SessionFixture) []Violation {
+	var c conformance
+	var violations []Violation
+	for _, p := range f.Packets {
+		done, v := c.observe(p.Direction, p.Raw)
+		violations = append(violations, v...)
+		if done {
+			c = conformance{}
+		}
+	}
+	return violations
+}
+
+// NewConformanceChecker wraps next and checks every packet exchanged through it against the
+// rules of the rfc.  Violations are logged with the side at fault, which helps decide whether a
+// device or the server is misbehaving.  It is a diagnostic and does not alter the exchange.
+func NewConformanceChecker(l loggerProvider, next Handler) *ConformanceChecker {
+	return &ConformanceChecker{loggerProvider: l, next: next, sessions: make(map[SessionID]*conformance)}
+}
+
+// ConformanceChecker is a middleware handler that checks live sessions for protocol violations
+type ConformanceChecker struct {
+	loggerProvider
+	mu       sync.Mutex
+	next     Handler
+	sessions map[SessionID]*conformance
+}
+
+// Handle checks the request and registers a writer to check the reply, then calls next
+func (c *ConformanceChecker) Handle(response Response, request Request) {
+	c.handle(c.next, response, request)
+}
+
+func (c *ConformanceChecker) handle(next Handler, response Response, request Request) {
+	h := request.Header
+	if raw, err := NewPacket(SetPacketHeader(&h), SetPacketBody(request.Body)).MarshalBinary(); err == nil {
+		c.observe(request, DirectionClient, raw)
+	}
+	response.RegisterWriter(conformanceWriter{checker: c, request: request})
+	original := request.Snapshot()
+	next.Handle(&conformanceResponse{Response: response, checker: c}, request)
+	if !bytes.Equal(original.Body, request.Body) {
+		v := Violation{Side: DirectionServer, SessionID: h.SessionID, SeqNo: h.SeqNo, Rule: "ownership", Detail: "a handler modified the request body"}
+		conformanceViolation.WithLabelValues(string(v.Side), v.Rule).Inc()
+		c.Errorf(request.Context, "conformance: %v", v)
+	}
+}
+
+func (c *ConformanceChecker) observe(request Request, d Direction, raw []byte) {
+	c.mu.Lock()
+	s, ok := c.sessions[request.Header.SessionID]
+	if !ok {
+		s = &conformance{}
+		c.sessions[request.Header.SessionID] = s
+	}
+	done, violations := s.observe(d, raw)
+	if done {
+		delete(c.sessions, request.Header.SessionID)
+	}
+	c.mu.Unlock()
+	for _, v := range violations {
+		conformanceViolation.WithLabelValues(string(v.Side), v.Rule).Inc()
+		c.Errorf(request.Context, "conformance: %v", v)
+	}
+}
+
+// conformanceWriter receives the marshalled replies of a response
+type conformanceWriter struct {
+	checker *ConformanceChecker
+	request Request
+}
+
+// Write checks p as a server packet
+func (w conformanceWriter) Write(p []byte) (int, error) {
+	w.checker.observe(w.request, DirectionServer, p)
+	return len(p), nil
+}
+
+// conformanceResponse ensures that multi packet exchanges continue to be checked
+type conformanceResponse struct {
+	Response
+	checker *ConformanceChecker
+}
+
+// Next wraps next so subsequent packets in this session are checked
+func (r *conformanceResponse) Next(next Handler) {
+	if next == nil {
+		r.Response.Next(nil)
+		return
+	}
+	r.Response.Next(HandlerFunc(func(response Response, request Request) {
+		r.checker.handle(next, response, request)
+	}))
+}
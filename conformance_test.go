@@ -0,0 +1,161 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckSessionConformant(t *testing.T) {
+	for _, f := range []SessionFixture{asciiLoginFixture(t), authorBurstFixture(t)} {
+		assert.Empty(t, CheckSession(f), f.Name)
+	}
+}
+
+// rules returns the side and rule of each violation
+func rules(violations []Violation) []string {
+	var r []string
+	for _, v := range violations {
+		r = append(r, fmt.Sprintf("%v:%v", v.Side, v.Rule))
+	}
+	return r
+}
+
+func TestCheckSessionNonConformant(t *testing.T) {
+	f := asciiLoginFixture(t)
+
+	// the client skips a sequence number
+	skipped := f
+	skipped.Packets = append([]RecordedPacket{}, f.Packets...)
+	skipped.Packets[2].Raw = append([]byte{}, skipped.Packets[2].Raw...)
+	skipped.Packets[2].Raw[2] = 5
+
+	// the server declares a longer body than it sends
+	length := f
+	length.Packets = append([]RecordedPacket{}, f.Packets...)
+	length.Packets[1].Raw = append([]byte{}, length.Packets[1].Raw...)
+	length.Packets[1].Raw[11]++
+
+	// the server sets single-connect and flips to unencrypted mid session
+	flags := f
+	flags.Packets = append([]RecordedPacket{}, f.Packets...)
+	flags.Packets[1].Raw = append([]byte{}, flags.Packets[1].Raw...)
+	flags.Packets[1].Raw[3] = byte(SingleConnect | UnencryptedFlag)
+
+	// the server answers an authorize request with an accounting reply
+	mixed := authorBurstFixture(t)
+	mixed.Packets = mixed.Packets[:2]
+	mixed.Packets[1].Raw = append([]byte{}, mixed.Packets[1].Raw...)
+	mixed.Packets[1].Raw[1] = byte(Accounting)
+
+	// the client sends the reply sequence number
+	direction := authorBurstFixture(t)
+	direction.Packets = direction.Packets[:1]
+	direction.Packets[0].Raw = append([]byte{}, direction.Packets[0].Raw...)
+	direction.Packets[0].Raw[2] = 2
+
+	tests := []struct {
+		name    string
+		fixture SessionFixture
+		want    []string
+	}{
+		// seq 5 is odd so it is on the right side, the next server reply follows on from it
+		{name: "seq", fixture: skipped, want: []string{"client:seq", "server:seq"}},
+		{name: "length", fixture: length, want: []string{"server:length"}},
+		{name: "flags", fixture: flags, want: []string{"server:flags", "server:flags"}},
+		{name: "type", fixture: mixed, want: []string{"server:type"}},
+		{name: "direction", fixture: direction, want: []string{"client:direction", "client:seq"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			violations := CheckSession(test.fixture)
+			assert.Equal(t, test.want, rules(violations))
+			for _, v := range violations {
+				assert.Equal(t, SessionID(12345), v.SessionID)
+			}
+		})
+	}
+}
+
+// errorLogger records error logs
+type errorLogger struct {
+	nopLogger
+	mu   sync.Mutex
+	logs []string
+}
+
+func (l *errorLogger) Errorf(ctx context.Context, format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logs = append(l.logs, fmt.Sprintf(format, args...))
+}
+
+func TestConformanceChecker(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet func(p *Packet)
+		want   []string
+	}{
+		{
+			name:   "conformant",
+			packet: func(p *Packet) {},
+		},
+		{
+			name:   "client sets unknown flags",
+			packet: func(p *Packet) { p.Header.Flags = 0x10 },
+			// Reply echoes the flags of the request, so the server repeats the violation
+			want: []string{"client violated flags", "server violated flags"},
+		},
+		{
+			name:   "client starts a session mid exchange",
+			packet: func(p *Packet) { p.Header.SeqNo = 3 },
+			want:   []string{"client violated seq"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			logger := &errorLogger{}
+			s := NewServer(nopLogger{}, nil)
+			client, server := net.Pipe()
+			defer client.Close()
+			done := make(chan struct{})
+			go func() {
+				sc := newCrypter(roleServer, []byte("fooman"), server, false)
+				// the checker is tested on its own, without the sequence checks of the crypter
+				sc.sequences = nil
+				s.handle(context.Background(), sc, NewConformanceChecker(logger, HandlerFunc(func(response Response, request Request) {
+					response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusPass)))
+				})))
+				close(done)
+			}()
+			c := newCrypter(roleClient, []byte("fooman"), client, false)
+			p := proxyTestPacket()
+			test.packet(p)
+			_, err := c.write(p)
+			assert.NoError(t, err)
+			_, err = c.read()
+			assert.NoError(t, err)
+			client.Close()
+			<-done
+
+			var got []string
+			for _, l := range logger.logs {
+				assert.True(t, strings.HasPrefix(l, "conformance: "), l)
+				got = append(got, strings.Join(strings.Fields(l)[1:4], " "))
+			}
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
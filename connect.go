@@ -0,0 +1,150 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// defaultConnectBudget is how long the ConnectFuncs of a connection may take, see
+// SetOnConnectPolicy
+const defaultConnectBudget = 100 * time.Millisecond
+
+// connectRejectedMessage is the server_msg of the reply to a connection rejected with a reply
+const connectRejectedMessage = "connection rejected"
+
+// ConnDecision is what a ConnectFunc decides to do with a connection
+type ConnDecision int
+
+const (
+	// ConnAccept serves the connection, or leaves it to the next ConnectFunc
+	ConnAccept ConnDecision = iota
+	// ConnReject closes the connection before its first packet is read
+	ConnReject
+	// ConnRejectWithReply reads the first packet of the connection, replies to it with an error
+	// status so the device logs why, then closes the connection
+	ConnRejectWithReply
+)
+
+// String returns the name of the decision
+func (d ConnDecision) String() string {
+	switch d {
+	case ConnAccept:
+		return "accept"
+	case ConnReject:
+		return "reject"
+	case ConnRejectWithReply:
+		return "reject-with-reply"
+	}
+	return fmt.Sprintf("unknown(%d)", int(d))
+}
+
+// ConnInfo is what is known of a connection before its first packet is read
+type ConnInfo struct {
+	// Remote is the device, from the proxy header of a proxied connection
+	Remote net.Addr
+	// DeviceGroup is the device group of the handler of the device, see DeviceGroupPolicy
+	DeviceGroup string
+	// Transport describes the connection.  Its fields that describe a packet, and the tls
+	// version, cipher suite and peer of a connection without virtual hosts, are not set yet.
+	Transport Transport
+}
+
+// ConnectFunc decides if a connection is served, see SetOnConnect
+type ConnectFunc func(ctx context.Context, info ConnInfo) (ConnDecision, error)
+
+// SetOnConnect adds fn to the funcs that decide if a connection is served, eg by consulting a
+// threat feed or a maintenance calendar.  They are called in the order they were added, once the
+// proxy header, tls handshake and secret of a connection are done and before its first packet is
+// read.  The first decision other than ConnAccept is final.  name labels the decisions of fn in
+// tacquito_serve_connect_decisions.  See SetOnConnectPolicy for how long they may take.
+func SetOnConnect(name string, fn ConnectFunc) Option {
+	return func(s *Server) {
+		s.onConnect = append(s.onConnect, namedConnectFunc{name: name, fn: fn})
+	}
+}
+
+// SetOnConnectPolicy sets the budget the ConnectFuncs of a connection share, and the decision
+// taken for one that returns an error or does not return within it.  A ConnectFunc that runs past
+// the budget is not waited for, its context is done and its decision is ignored.  A failure
+// decision of ConnAccept, the default, fails open: an error leaves the connection to the next
+// ConnectFunc and a timeout serves it.  The default budget is 100ms.
+func SetOnConnectPolicy(budget time.Duration, failure ConnDecision) Option {
+	return func(s *Server) {
+		s.connectBudget = budget
+		s.connectFailure = failure
+	}
+}
+
+// namedConnectFunc is a ConnectFunc and the name of its metrics
+type namedConnectFunc struct {
+	name string
+	fn   ConnectFunc
+}
+
+// admit runs the ConnectFuncs of the server for the connection of info
+func (s *Server) admit(ctx context.Context, info ConnInfo) ConnDecision {
+	if len(s.onConnect) == 0 {
+		return ConnAccept
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.connectBudget)
+	defer cancel()
+	for _, c := range s.onConnect {
+		decision, err := s.callConnect(ctx, c, info)
+		if err != nil {
+			cause := "error"
+			if ctx.Err() != nil {
+				cause = "timeout"
+			}
+			connectFailures.WithLabelValues(c.name, cause).Inc()
+			s.Errorf(ctx, "connect func [%v] failed for device [%v], applying [%v]; %v", c.name, info.Remote, s.connectFailure, err)
+			decision = s.connectFailure
+			if cause == "timeout" {
+				// the budget is spent, the funcs after it would time out too
+				connectDecisions.WithLabelValues(c.name, decision.String()).Inc()
+				return decision
+			}
+		}
+		connectDecisions.WithLabelValues(c.name, decision.String()).Inc()
+		if decision != ConnAccept {
+			s.Infof(ctx, "connection from device [%v] decided [%v] by connect func [%v]", info.Remote, decision, c.name)
+			return decision
+		}
+	}
+	return ConnAccept
+}
+
+// callConnect calls c, returning once it does or once ctx is done.  A panic in c is an error.
+func (s *Server) callConnect(ctx context.Context, c namedConnectFunc, info ConnInfo) (ConnDecision, error) {
+	type result struct {
+		decision ConnDecision
+		err      error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- result{err: fmt.Errorf("panic; %v", r)}
+			}
+		}()
+		decision, err := c.fn(ctx, info)
+		done <- result{decision: decision, err: err}
+	}()
+	select {
+	case r := <-done:
+		if r.err == nil && (r.decision < ConnAccept || r.decision > ConnRejectWithReply) {
+			r.err = fmt.Errorf("unknown decision [%v]", r.decision)
+		}
+		return r.decision, r.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
@@ -0,0 +1,222 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// connectTestServer is a server with connect funcs, counting the requests it handles and
+// reporting the reason it closed each connection
+type connectTestServer struct {
+	addr    string
+	handled int32
+	closed  chan CloseReason
+}
+
+func startConnectServer(t *testing.T, opts ...Option) *connectTestServer {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	require.NoError(t, err)
+	cs := &connectTestServer{addr: listener.Addr().String(), closed: make(chan CloseReason, 10)}
+	sp := secretProviderFunc(func(ctx context.Context, remote net.Addr) ([]byte, Handler, error) {
+		return []byte("fooman"), HandlerFunc(func(response Response, request Request) {
+			atomic.AddInt32(&cs.handled, 1)
+			response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusPass)))
+		}), nil
+	})
+	opts = append(opts, SetOnClose(func(ctx context.Context, remote net.Addr, reason CloseReason) {
+		cs.closed <- reason
+	}))
+	go NewServer(nopLogger{}, sp, opts...).Serve(ctx, listener.(*net.TCPListener))
+	return cs
+}
+
+// login sends a login and returns its reply and the client of the connection, or the error reading it
+func (cs *connectTestServer) login(t *testing.T) (*AuthenReply, *crypter, error) {
+	conn, err := net.Dial("tcp6", cs.addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	c := newCrypter(roleClient, []byte("fooman"), conn, false)
+	if _, err := c.write(proxyTestPacket()); err != nil {
+		return nil, c, err
+	}
+	resp, err := c.read()
+	if err != nil {
+		return nil, c, err
+	}
+	var body AuthenReply
+	require.NoError(t, Unmarshal(resp.Body, &body))
+	return &body, c, nil
+}
+
+// reason returns the reason the server closed a connection for
+func (cs *connectTestServer) reason(t *testing.T) CloseReason {
+	select {
+	case reason := <-cs.closed:
+		return reason
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection was not closed")
+	}
+	return ""
+}
+
+// recordConnect returns a ConnectFunc that records its calls and returns decision and err
+func recordConnect(calls *[]string, mu *sync.Mutex, name string, decision ConnDecision, err error) ConnectFunc {
+	return func(ctx context.Context, info ConnInfo) (ConnDecision, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		*calls = append(*calls, name)
+		return decision, err
+	}
+}
+
+func TestOnConnectOrder(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	var info ConnInfo
+	cs := startConnectServer(t,
+		SetOnConnect("first", func(ctx context.Context, i ConnInfo) (ConnDecision, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			calls, info = append(calls, "first"), i
+			return ConnAccept, nil
+		}),
+		SetOnConnect("second", recordConnect(&calls, &mu, "second", ConnAccept, nil)),
+	)
+	reply, c, err := cs.login(t)
+	require.NoError(t, err)
+	assert.Equal(t, AuthenStatusPass, reply.Status)
+	c.Close()
+	assert.Equal(t, CloseClientEOF, cs.reason(t))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"first", "second"}, calls)
+	assert.Equal(t, "::1", info.Transport.Source)
+	assert.Equal(t, cs.addr, info.Transport.Listener)
+	assert.NotNil(t, info.Remote)
+}
+
+func TestOnConnectReject(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	before := metricValue(connectDecisions.WithLabelValues("feed", "reject"))
+	cs := startConnectServer(t,
+		SetOnConnect("feed", recordConnect(&calls, &mu, "feed", ConnReject, nil)),
+		SetOnConnect("calendar", recordConnect(&calls, &mu, "calendar", ConnAccept, nil)),
+	)
+	_, _, err := cs.login(t)
+	assert.Error(t, err, "the connection is closed without a reply")
+	assert.Equal(t, CloseRejected, cs.reason(t))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&cs.handled))
+	assert.Equal(t, before+1, metricValue(connectDecisions.WithLabelValues("feed", "reject")))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"feed"}, calls, "the first rejection is final")
+}
+
+func TestOnConnectRejectWithReply(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	cs := startConnectServer(t, SetOnConnect("calendar", recordConnect(&calls, &mu, "calendar", ConnRejectWithReply, nil)))
+
+	// the first request is answered with an error, then the connection is closed
+	reply, c, err := cs.login(t)
+	require.NoError(t, err)
+	assert.Equal(t, AuthenStatusError, reply.Status)
+	assert.Equal(t, AuthenServerMsg(connectRejectedMessage), reply.ServerMsg)
+	assert.Equal(t, CloseRejected, cs.reason(t))
+	_, err = c.read()
+	assert.True(t, errors.Is(err, io.EOF), err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&cs.handled), "the handler never sees the request")
+}
+
+func TestOnConnectFailurePolicy(t *testing.T) {
+	block := func(ctx context.Context, info ConnInfo) (ConnDecision, error) {
+		<-ctx.Done()
+		// a late decision is ignored
+		return ConnReject, nil
+	}
+	fail := func(ctx context.Context, info ConnInfo) (ConnDecision, error) {
+		return ConnReject, errors.New("feed unavailable")
+	}
+	tests := []struct {
+		name    string
+		fn      ConnectFunc
+		failure ConnDecision
+		cause   string
+		// served is set if the connection is served, otherwise it is closed for reason
+		served bool
+		reason CloseReason
+	}{
+		{name: "timeout fails open", fn: block, failure: ConnAccept, cause: "timeout", served: true},
+		{name: "timeout fails closed", fn: block, failure: ConnReject, cause: "timeout", reason: CloseRejected},
+		{name: "error fails open", fn: fail, failure: ConnAccept, cause: "error", served: true},
+		{name: "error fails closed", fn: fail, failure: ConnReject, cause: "error", reason: CloseRejected},
+		{name: "error fails closed with a reply", fn: fail, failure: ConnRejectWithReply, cause: "error", reason: CloseRejected},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var calls []string
+			before := metricValue(connectFailures.WithLabelValues("feed", test.cause))
+			cs := startConnectServer(t,
+				SetOnConnectPolicy(20*time.Millisecond, test.failure),
+				SetOnConnect("feed", test.fn),
+				SetOnConnect("calendar", recordConnect(&calls, &mu, "calendar", ConnAccept, nil)),
+			)
+			reply, c, err := cs.login(t)
+			switch {
+			case test.served:
+				require.NoError(t, err)
+				assert.Equal(t, AuthenStatusPass, reply.Status)
+				c.Close()
+				assert.Equal(t, CloseClientEOF, cs.reason(t))
+			case test.failure == ConnRejectWithReply:
+				require.NoError(t, err)
+				assert.Equal(t, AuthenStatusError, reply.Status)
+				assert.Equal(t, test.reason, cs.reason(t))
+			default:
+				assert.Error(t, err)
+				assert.Equal(t, test.reason, cs.reason(t))
+			}
+			assert.Equal(t, before+1, metricValue(connectFailures.WithLabelValues("feed", test.cause)))
+
+			mu.Lock()
+			defer mu.Unlock()
+			if test.served && test.cause == "error" {
+				assert.Equal(t, []string{"calendar"}, calls, "an error that fails open leaves the connection to the next func")
+			} else {
+				assert.Empty(t, calls, "a rejection is final, and a timeout spends the budget of the funcs after it")
+			}
+		})
+	}
+}
+
+func TestOnConnectPolicyValidate(t *testing.T) {
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	require.NoError(t, err)
+	err = NewServer(nopLogger{}, sourceSecretProvider{}, SetOnConnectPolicy(0, ConnAccept)).Serve(context.Background(), listener.(*net.TCPListener))
+	var oe *OptionError
+	require.True(t, errors.As(err, &oe), err)
+	assert.Equal(t, "SetOnConnectPolicy", oe.Option)
+}
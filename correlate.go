@@ -0,0 +1,457 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+const (
+	// CorrelationAuthorizedExecuted is the event of an accounting record for a command that was
+	// authorized with a pass
+	CorrelationAuthorizedExecuted = "authorized-then-executed"
+	// CorrelationUnauthorizedExecuted is the event of an accounting record for a command without a
+	// prior authorization pass, eg the device fell back to local authorization
+	CorrelationUnauthorizedExecuted = "executed-without-authorization"
+)
+
+const (
+	// DecisionIDAttribute is the optional attribute an authorization pass carries its decision id
+	// in, see SetCorrelatorDecisionIDs
+	DecisionIDAttribute = "decision-id"
+	// CorrelationJoinDecisionID is the join of a record matched on the decision id echoed by the
+	// device, its confidence is always CorrelationConfidenceExact
+	CorrelationJoinDecisionID = "decision-id"
+	// CorrelationJoinHeuristic is the join of a record matched on the device, user, port, rem-addr
+	// and command
+	CorrelationJoinHeuristic = "heuristic"
+	// CorrelationConfidenceExact is the confidence of a record matched on its decision id
+	CorrelationConfidenceExact = "exact"
+	// CorrelationConfidenceHigh is the confidence of a heuristic match that was the only candidate
+	// and arrived within the proximity of its authorization
+	CorrelationConfidenceHigh = "high"
+	// CorrelationConfidenceLow is the confidence of any other heuristic match, eg the oldest of
+	// several identical commands
+	CorrelationConfidenceLow = "low"
+)
+
+// CorrelatorOption is used to set optional behaviors on a Correlator
+type CorrelatorOption func(c *Correlator)
+
+// SetCorrelatorTTL sets how long an authorization pass waits for its accounting record.  The
+// default is 5 minutes.
+func SetCorrelatorTTL(v time.Duration) CorrelatorOption {
+	return func(c *Correlator) {
+		c.ttl = v
+	}
+}
+
+// SetCorrelatorMaxPending sets how many authorization passes may wait for their accounting records.
+// Passes that arrive while it is full are not correlated.  The default is 4096.
+func SetCorrelatorMaxPending(v int) CorrelatorOption {
+	return func(c *Correlator) {
+		c.maxPending = v
+	}
+}
+
+// SetCorrelatorDecisionIDs adds a short opaque decision id to the authorization passes of devices
+// in groups, see DeviceGroupPolicy, as the optional attribute decision-id.  Devices that echo
+// unknown optional attributes in the accounting records of the same task let those records be
+// matched exactly.  Only enable it for groups known to echo them, and to accept them, as some
+// devices fail an authorization with an attribute they do not know.
+func SetCorrelatorDecisionIDs(groups ...string) CorrelatorOption {
+	return func(c *Correlator) {
+		for _, g := range groups {
+			c.decisionGroups[g] = true
+		}
+	}
+}
+
+// SetCorrelatorProximity sets how soon after its authorization the accounting record of a heuristic
+// match must arrive to be of high confidence.  The default is 30 seconds.
+func SetCorrelatorProximity(v time.Duration) CorrelatorOption {
+	return func(c *Correlator) {
+		c.proximity = v
+	}
+}
+
+// NewCorrelator returns a Correlator that records its combined audit events with l
+func NewCorrelator(l loggerProvider, opts ...CorrelatorOption) *Correlator {
+	c := &Correlator{
+		loggerProvider: l,
+		ttl:            5 * time.Minute,
+		maxPending:     4096,
+		proximity:      30 * time.Second,
+		now:            time.Now,
+		newID:          newDecisionID,
+		pending:        make(map[correlationKey][]correlationEntry),
+		decisions:      make(map[string]correlationKey),
+		decisionGroups: make(map[string]bool),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Correlator links the authorization pass of a command to the accounting record the device sends
+// once it ran the command.  Devices send both over separate tacacs sessions, so they are matched
+// on the device session instead: the device address, user, port and rem-addr, along with the
+// command and its args.  Where devices echo the decision id of SetCorrelatorDecisionIDs, records
+// are matched on it instead.  Each accounting record for a command produces a single combined
+// audit event with Record.
+type Correlator struct {
+	loggerProvider
+	ttl            time.Duration
+	maxPending     int
+	proximity      time.Duration
+	decisionGroups map[string]bool
+	now            func() time.Time
+	newID          func() string
+
+	mu      sync.Mutex
+	pending map[correlationKey][]correlationEntry
+	// decisions holds the key of every pending entry with a decision id
+	decisions map[string]correlationKey
+	size      int
+}
+
+// correlationKey identifies a command within a device session
+type correlationKey struct {
+	device  string
+	user    string
+	port    string
+	remAddr string
+	cmd     string
+	cmdArgs string
+}
+
+// correlationEntry is an authorization pass waiting for its accounting record
+type correlationEntry struct {
+	sessionID  SessionID
+	status     string
+	eventTime  string
+	decisionID string
+	authorized time.Time
+	expires    time.Time
+	// candidates is how many entries were pending for the key when this one was taken
+	candidates int
+}
+
+// newDecisionID returns a random decision id of 16 hex characters
+func newDecisionID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// decisionID returns the decision id echoed in args, if any
+func decisionID(args Args) string {
+	for _, arg := range args {
+		if a, _, v := arg.ASV(); a == DecisionIDAttribute {
+			return v
+		}
+	}
+	return ""
+}
+
+// deviceGroupOf returns the ContextDeviceGroup of request, if it has one
+func deviceGroupOf(request Request) string {
+	if request.Context == nil {
+		return ""
+	}
+	v, _ := request.Context.Value(ContextDeviceGroup).(string)
+	return v
+}
+
+// newCorrelationKey returns the key of a command sent by the device of request
+func newCorrelationKey(request Request, user, port, remAddr string, args Args) correlationKey {
+	k := correlationKey{user: user, port: port, remAddr: remAddr, cmd: args.Command(), cmdArgs: args.CommandArgs()}
+	if request.Context != nil {
+		k.device, _ = request.Context.Value(ContextConnRemoteAddr).(string)
+	}
+	return k
+}
+
+// eventTime returns the ContextEventTime of request, if it has one
+func eventTime(request Request) string {
+	if request.Context == nil {
+		return ""
+	}
+	v, _ := request.Context.Value(ContextEventTime).(string)
+	return v
+}
+
+// Authorizer wraps an authorization handler and remembers the commands it passes
+func (c *Correlator) Authorizer(next Handler) Handler {
+	return HandlerFunc(func(response Response, request Request) {
+		var body AuthorRequest
+		if err := Unmarshal(request.Body, &body); err != nil || body.Args.Command() == "" {
+			next.Handle(response, request)
+			return
+		}
+		key := newCorrelationKey(request, string(body.User), string(body.Port), string(body.RemAddr), body.Args)
+		r := &correlateResponse{Response: response}
+		if c.decisionGroups[deviceGroupOf(request)] {
+			r.decisionID = c.newID()
+		}
+		next.Handle(r, request)
+		if r.status != AuthorStatusPassAdd.String() && r.status != AuthorStatusPassRepl.String() {
+			return
+		}
+		entry := correlationEntry{sessionID: request.Header.SessionID, status: r.status, eventTime: eventTime(request)}
+		if r.sent {
+			entry.decisionID = r.decisionID
+		}
+		c.put(key, entry)
+	})
+}
+
+// Accounter wraps an accounting handler and records a combined audit event for every record of a
+// command.  A stop record consumes the authorization it is matched with, a start or watchdog
+// record leaves it for the stop record that follows.
+func (c *Correlator) Accounter(next Handler) Handler {
+	return HandlerFunc(func(response Response, request Request) {
+		var body AcctRequest
+		if err := Unmarshal(request.Body, &body); err == nil && body.Args.Command() != "" {
+			key := newCorrelationKey(request, string(body.User), string(body.Port), string(body.RemAddr), body.Args)
+			consume := body.Flags&AcctFlagStop != 0
+			join := CorrelationJoinDecisionID
+			entry, ok := c.takeDecision(decisionID(body.Args), consume)
+			if !ok {
+				// the device did not echo the decision id, or it expired
+				join = CorrelationJoinHeuristic
+				entry, ok = c.take(key, consume)
+			}
+			c.record(request, key, body.Flags, entry, join, ok)
+		}
+		next.Handle(response, request)
+	})
+}
+
+// put remembers entry for key, dropping expired entries to make room
+func (c *Correlator) put(key correlationKey, entry correlationEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	entry.authorized = now
+	entry.expires = now.Add(c.ttl)
+	if c.size >= c.maxPending {
+		c.expire(now)
+	}
+	if c.size >= c.maxPending {
+		correlationDropped.Inc()
+		return
+	}
+	c.pending[key] = append(c.pending[key], entry)
+	if entry.decisionID != "" {
+		c.decisions[entry.decisionID] = key
+	}
+	c.size++
+}
+
+// take returns the oldest unexpired entry for key, removing it if consume is set
+func (c *Correlator) take(key correlationKey, consume bool) (correlationEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries := c.unexpired(key)
+	if len(entries) == 0 {
+		return correlationEntry{}, false
+	}
+	entry := entries[0]
+	entry.candidates = len(entries)
+	if consume {
+		c.remove(key, 0)
+	}
+	return entry, true
+}
+
+// takeDecision returns the unexpired entry with decision id, removing it if consume is set
+func (c *Correlator) takeDecision(id string, consume bool) (correlationEntry, bool) {
+	if id == "" {
+		return correlationEntry{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key, ok := c.decisions[id]
+	if !ok {
+		return correlationEntry{}, false
+	}
+	for i, e := range c.unexpired(key) {
+		if e.decisionID != id {
+			continue
+		}
+		e.candidates = 1
+		if consume {
+			c.remove(key, i)
+		}
+		return e, true
+	}
+	return correlationEntry{}, false
+}
+
+// unexpired drops the expired entries of key and returns the rest, the caller must hold mu
+func (c *Correlator) unexpired(key correlationKey) []correlationEntry {
+	now := c.now()
+	entries := c.pending[key]
+	for len(entries) > 0 && !now.Before(entries[0].expires) {
+		delete(c.decisions, entries[0].decisionID)
+		entries = entries[1:]
+		c.size--
+		correlationExpired.Inc()
+	}
+	if len(entries) == 0 {
+		delete(c.pending, key)
+		return nil
+	}
+	c.pending[key] = entries
+	return entries
+}
+
+// remove removes the i-th entry of key, the caller must hold mu
+func (c *Correlator) remove(key correlationKey, i int) {
+	entries := c.pending[key]
+	delete(c.decisions, entries[i].decisionID)
+	entries = append(entries[:i:i], entries[i+1:]...)
+	c.size--
+	if len(entries) == 0 {
+		delete(c.pending, key)
+		return
+	}
+	c.pending[key] = entries
+}
+
+// expire removes every entry that expired by now, the caller must hold mu
+func (c *Correlator) expire(now time.Time) {
+	for key, entries := range c.pending {
+		kept := entries[:0]
+		for _, e := range entries {
+			if now.Before(e.expires) {
+				kept = append(kept, e)
+				continue
+			}
+			delete(c.decisions, e.decisionID)
+			c.size--
+			correlationExpired.Inc()
+		}
+		if len(kept) == 0 {
+			delete(c.pending, key)
+			continue
+		}
+		c.pending[key] = kept
+	}
+}
+
+// record writes the combined audit event of an accounting record for key, matched with entry by join
+func (c *Correlator) record(request Request, key correlationKey, flags AcctRequestFlag, entry correlationEntry, join string, authorized bool) {
+	r := map[string]string{
+		"event":           CorrelationUnauthorizedExecuted,
+		"device":          key.device,
+		"user":            key.user,
+		"port":            key.port,
+		"rem-addr":        key.remAddr,
+		"cmd":             key.cmd,
+		"cmd-args":        key.cmdArgs,
+		"acct-session-id": request.Header.SessionID.String(),
+		"acct-flags":      flags.String(),
+	}
+	if t := eventTime(request); t != "" {
+		r["acct-event-time"] = t
+	}
+	if !authorized {
+		correlationUnmatched.Inc()
+		c.Record(request.Context, r)
+		return
+	}
+	correlationMatched.Inc()
+	r["event"] = CorrelationAuthorizedExecuted
+	r["author-session-id"] = entry.sessionID.String()
+	r["author-status"] = entry.status
+	if entry.eventTime != "" {
+		r["author-event-time"] = entry.eventTime
+	}
+	if entry.decisionID != "" {
+		r[DecisionIDAttribute] = entry.decisionID
+	}
+	r["join"] = join
+	r["confidence"] = c.confidence(join, entry)
+	c.Record(request.Context, r)
+}
+
+// confidence returns how likely entry is the authorization of the record it was matched with
+func (c *Correlator) confidence(join string, entry correlationEntry) string {
+	if join == CorrelationJoinDecisionID {
+		return CorrelationConfidenceExact
+	}
+	if entry.candidates == 1 && c.now().Sub(entry.authorized) <= c.proximity {
+		return CorrelationConfidenceHigh
+	}
+	return CorrelationConfidenceLow
+}
+
+// Shutdown returns a snapshot of the unexpired authorization passes still waiting for their
+// accounting records, which the server spools when the Correlator is added with SetShutdownSink
+func (c *Correlator) Shutdown(ctx context.Context) (int, []map[string]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	var snapshot []map[string]string
+	for key, entries := range c.pending {
+		for _, e := range entries {
+			if !now.Before(e.expires) {
+				continue
+			}
+			snapshot = append(snapshot, map[string]string{
+				"device":            key.device,
+				"user":              key.user,
+				"port":              key.port,
+				"rem-addr":          key.remAddr,
+				"cmd":               key.cmd,
+				"cmd-args":          key.cmdArgs,
+				"author-session-id": e.sessionID.String(),
+				"author-status":     e.status,
+				"author-event-time": e.eventTime,
+				DecisionIDAttribute: e.decisionID,
+			})
+		}
+	}
+	return 0, snapshot, nil
+}
+
+// correlateResponse records the status of an authorization reply on its way to the client, adding
+// decisionID to a pass if it is set
+type correlateResponse struct {
+	Response
+	status     string
+	decisionID string
+	// sent is set once decisionID was added to a reply
+	sent bool
+}
+
+// Reply records the status of v and sends it
+func (r *correlateResponse) Reply(v EncoderDecoder) (int, error) {
+	r.status = teeStatus(Authorize, v)
+	if reply, ok := v.(*AuthorReply); ok && r.decisionID != "" && (reply.Status == AuthorStatusPassAdd || reply.Status == AuthorStatusPassRepl) {
+		// a copy, the handler may reuse its reply
+		withID := *reply
+		withID.Args = append(append(Args(nil), reply.Args...), Arg(DecisionIDAttribute+"*"+r.decisionID))
+		r.sent = true
+		return r.Response.Reply(&withID)
+	}
+	return r.Response.Reply(v)
+}
+
+// Write records the status of p and sends it
+func (r *correlateResponse) Write(p *Packet) (int, error) {
+	_, r.status = replyOutcome(p)
+	return r.Response.Write(p)
+}
@@ -0,0 +1,277 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// correlateRequest returns a request from device 192.0.2.1 for session id with body v
+func correlateRequest(t *testing.T, ht HeaderType, id SessionID, v EncoderDecoder) Request {
+	body, err := v.MarshalBinary()
+	require.NoError(t, err)
+	ctx := context.WithValue(context.Background(), ContextConnRemoteAddr, "192.0.2.1")
+	return Request{Header: Header{Type: ht, SessionID: id, SeqNo: 1}, Body: body, Context: ctx}
+}
+
+// correlateCommand returns the args of a show version command
+func correlateCommand() Args {
+	return Args{"service=shell", "cmd=show", "cmd-arg=version"}
+}
+
+func correlateAcct(t *testing.T, id SessionID, flags AcctRequestFlag) Request {
+	return correlateRequest(t, Accounting, id, NewAcctRequest(
+		SetAcctRequestFlag(flags),
+		SetAcctRequestUser("alice"),
+		SetAcctRequestPort("tty1"),
+		SetAcctRequestRemAddr("198.51.100.7"),
+		SetAcctRequestArgs(correlateCommand()),
+	))
+}
+
+func TestCorrelateAuthorizedThenExecuted(t *testing.T) {
+	logger := &recordLogger{}
+	c := NewCorrelator(logger)
+	matched := metricValue(correlationMatched)
+
+	author := c.Authorizer(HandlerFunc(func(response Response, request Request) {
+		response.Reply(NewAuthorReply(SetAuthorReplyStatus(AuthorStatusPassAdd)))
+	}))
+	author.Handle(&teeResponse{header: Header{Type: Authorize}}, correlateRequest(t, Authorize, 1, NewAuthorRequest(
+		SetAuthorRequestUser("alice"),
+		SetAuthorRequestPort("tty1"),
+		SetAuthorRequestRemAddr("198.51.100.7"),
+		SetAuthorRequestArgs(correlateCommand()),
+	)))
+
+	var accounted bool
+	acct := c.Accounter(HandlerFunc(func(response Response, request Request) { accounted = true }))
+	acct.Handle(&teeResponse{}, correlateAcct(t, 2, AcctFlagStop))
+	assert.True(t, accounted)
+
+	require.Len(t, logger.records, 1)
+	r := logger.records[0]
+	assert.Equal(t, CorrelationAuthorizedExecuted, r["event"])
+	assert.Equal(t, "192.0.2.1", r["device"])
+	assert.Equal(t, "alice", r["user"])
+	assert.Equal(t, "show", r["cmd"])
+	assert.Equal(t, "version", r["cmd-args"])
+	assert.Equal(t, SessionID(1).String(), r["author-session-id"])
+	assert.Equal(t, SessionID(2).String(), r["acct-session-id"])
+	assert.Equal(t, AuthorStatusPassAdd.String(), r["author-status"])
+	assert.Equal(t, matched+1, metricValue(correlationMatched))
+
+	// the snapshot of a correlator holds the passes awaiting accounting
+	author.Handle(&teeResponse{header: Header{Type: Authorize}}, correlateRequest(t, Authorize, 4, NewAuthorRequest(
+		SetAuthorRequestUser("alice"),
+		SetAuthorRequestArgs(correlateCommand()),
+	)))
+	_, snapshot, err := c.Shutdown(context.Background())
+	assert.NoError(t, err)
+	require.Len(t, snapshot, 1)
+	assert.Equal(t, SessionID(4).String(), snapshot[0]["author-session-id"])
+
+	// the stop record consumed the authorization
+	acct.Handle(&teeResponse{}, correlateAcct(t, 3, AcctFlagStop))
+	require.Len(t, logger.records, 2)
+	assert.Equal(t, CorrelationUnauthorizedExecuted, logger.records[1]["event"])
+}
+
+func TestCorrelateWithoutAuthorization(t *testing.T) {
+	logger := &recordLogger{}
+	c := NewCorrelator(logger)
+	unmatched := metricValue(correlationUnmatched)
+
+	// a failed authorization is never correlated
+	author := c.Authorizer(HandlerFunc(func(response Response, request Request) {
+		response.Reply(NewDenial(Authorize, DenialPolicy, ""))
+	}))
+	author.Handle(&teeResponse{header: Header{Type: Authorize}}, correlateRequest(t, Authorize, 1, NewAuthorRequest(
+		SetAuthorRequestUser("alice"),
+		SetAuthorRequestPort("tty1"),
+		SetAuthorRequestRemAddr("198.51.100.7"),
+		SetAuthorRequestArgs(correlateCommand()),
+	)))
+
+	c.Accounter(HandlerFunc(func(response Response, request Request) {})).Handle(&teeResponse{}, correlateAcct(t, 2, AcctFlagStop))
+	require.Len(t, logger.records, 1)
+	assert.Equal(t, CorrelationUnauthorizedExecuted, logger.records[0]["event"])
+	assert.Empty(t, logger.records[0]["author-session-id"])
+	assert.Equal(t, unmatched+1, metricValue(correlationUnmatched))
+}
+
+func TestCorrelateExpiry(t *testing.T) {
+	logger := &recordLogger{}
+	now := time.Unix(0, 0)
+	c := NewCorrelator(logger, SetCorrelatorTTL(time.Minute), SetCorrelatorMaxPending(1))
+	c.now = func() time.Time { return now }
+	key := correlationKey{user: "alice", cmd: "show"}
+
+	c.put(key, correlationEntry{sessionID: 1})
+	dropped := metricValue(correlationDropped)
+	c.put(correlationKey{user: "bob"}, correlationEntry{sessionID: 2})
+	assert.Equal(t, dropped+1, metricValue(correlationDropped))
+
+	// a start record leaves the authorization for its stop record
+	_, ok := c.take(key, false)
+	assert.True(t, ok)
+	now = now.Add(time.Minute)
+	_, ok = c.take(key, true)
+	assert.False(t, ok)
+	assert.Equal(t, 0, c.size)
+}
+
+// correlateFixture is the captured args of an authorization and of the accounting record the
+// device sent for the same task, with {decision-id} in place of an echoed decision id
+type correlateFixture struct {
+	Platform      string   `json:"platform"`
+	Echo          bool     `json:"echo"`
+	Authorization []string `json:"authorization"`
+	Accounting    []string `json:"accounting"`
+}
+
+// correlateReplies keeps the replies it is sent
+type correlateReplies struct {
+	teeResponse
+	replies []EncoderDecoder
+}
+
+func (r *correlateReplies) Reply(v EncoderDecoder) (int, error) {
+	r.replies = append(r.replies, v)
+	return r.teeResponse.Reply(v)
+}
+
+// correlateGroupRequest returns a request of correlateRequest from a device of group
+func correlateGroupRequest(t *testing.T, ht HeaderType, id SessionID, group string, v EncoderDecoder) Request {
+	r := correlateRequest(t, ht, id, v)
+	r.Context = context.WithValue(r.Context, ContextDeviceGroup, group)
+	return r
+}
+
+func TestCorrelateDecisionID(t *testing.T) {
+	b, err := os.ReadFile("testdata/correlate/decision-echo.json")
+	require.NoError(t, err)
+	var fixtures []correlateFixture
+	require.NoError(t, json.Unmarshal(b, &fixtures))
+	require.NotEmpty(t, fixtures)
+
+	for _, f := range fixtures {
+		t.Run(f.Platform, func(t *testing.T) {
+			logger := &recordLogger{}
+			c := NewCorrelator(logger, SetCorrelatorDecisionIDs("core"))
+			author := c.Authorizer(HandlerFunc(func(response Response, request Request) {
+				response.Reply(NewAuthorReply(SetAuthorReplyStatus(AuthorStatusPassAdd), SetAuthorReplyArgs("priv-lvl=15")))
+			}))
+			var args Args
+			args.Append(f.Authorization...)
+			r := &correlateReplies{teeResponse: teeResponse{header: Header{Type: Authorize}}}
+			author.Handle(r, correlateGroupRequest(t, Authorize, 1, "core", NewAuthorRequest(SetAuthorRequestUser("alice"), SetAuthorRequestArgs(args))))
+
+			// the pass carries the decision id as an optional attribute, after the args of the handler
+			require.Len(t, r.replies, 1)
+			reply := r.replies[0].(*AuthorReply)
+			require.Len(t, reply.Args, 2)
+			assert.Equal(t, Arg("priv-lvl=15"), reply.Args[0])
+			a, sep, id := reply.Args[1].ASV()
+			assert.Equal(t, DecisionIDAttribute, a)
+			assert.Equal(t, "*", sep)
+			assert.Len(t, id, 16)
+
+			var acctArgs Args
+			for _, arg := range f.Accounting {
+				acctArgs.Append(strings.ReplaceAll(arg, "{decision-id}", id))
+			}
+			c.Accounter(HandlerFunc(func(response Response, request Request) {})).Handle(&teeResponse{}, correlateGroupRequest(t, Accounting, 2, "core", NewAcctRequest(
+				SetAcctRequestFlag(AcctFlagStop),
+				SetAcctRequestUser("alice"),
+				SetAcctRequestArgs(acctArgs),
+			)))
+			require.Len(t, logger.records, 1)
+			record := logger.records[0]
+			assert.Equal(t, CorrelationAuthorizedExecuted, record["event"])
+			assert.Equal(t, SessionID(1).String(), record["author-session-id"])
+			assert.Equal(t, id, record[DecisionIDAttribute])
+			if f.Echo {
+				assert.Equal(t, CorrelationJoinDecisionID, record["join"])
+				assert.Equal(t, CorrelationConfidenceExact, record["confidence"])
+			} else {
+				assert.Equal(t, CorrelationJoinHeuristic, record["join"])
+				assert.Equal(t, CorrelationConfidenceHigh, record["confidence"])
+			}
+			assert.Equal(t, 0, c.size)
+			assert.Empty(t, c.decisions)
+		})
+	}
+}
+
+func TestCorrelateDecisionIDGroups(t *testing.T) {
+	c := NewCorrelator(&recordLogger{}, SetCorrelatorDecisionIDs("core"))
+	author := c.Authorizer(HandlerFunc(func(response Response, request Request) {
+		response.Reply(NewAuthorReply(SetAuthorReplyStatus(AuthorStatusPassAdd)))
+	}))
+	// devices of other groups may not accept an unknown attribute, nor may failed authorizations
+	// carry one
+	r := &correlateReplies{teeResponse: teeResponse{header: Header{Type: Authorize}}}
+	author.Handle(r, correlateGroupRequest(t, Authorize, 1, "legacy", NewAuthorRequest(SetAuthorRequestUser("alice"), SetAuthorRequestArgs(correlateCommand()))))
+	require.Len(t, r.replies, 1)
+	assert.Empty(t, r.replies[0].(*AuthorReply).Args)
+
+	deny := c.Authorizer(HandlerFunc(func(response Response, request Request) {
+		response.Reply(NewAuthorReply(SetAuthorReplyStatus(AuthorStatusFail)))
+	}))
+	r = &correlateReplies{teeResponse: teeResponse{header: Header{Type: Authorize}}}
+	deny.Handle(r, correlateGroupRequest(t, Authorize, 2, "core", NewAuthorRequest(SetAuthorRequestUser("alice"), SetAuthorRequestArgs(correlateCommand()))))
+	require.Len(t, r.replies, 1)
+	assert.Empty(t, r.replies[0].(*AuthorReply).Args)
+	assert.Empty(t, c.decisions)
+}
+
+func TestCorrelateHeuristicConfidence(t *testing.T) {
+	logger := &recordLogger{}
+	now := time.Unix(0, 0)
+	c := NewCorrelator(logger, SetCorrelatorProximity(10*time.Second))
+	c.now = func() time.Time { return now }
+	author := c.Authorizer(HandlerFunc(func(response Response, request Request) {
+		response.Reply(NewAuthorReply(SetAuthorReplyStatus(AuthorStatusPassAdd)))
+	}))
+	authorize := func(id SessionID) {
+		author.Handle(&teeResponse{header: Header{Type: Authorize}}, correlateRequest(t, Authorize, id, NewAuthorRequest(
+			SetAuthorRequestUser("alice"),
+			SetAuthorRequestPort("tty1"),
+			SetAuthorRequestRemAddr("198.51.100.7"),
+			SetAuthorRequestArgs(correlateCommand()),
+		)))
+	}
+	acct := c.Accounter(HandlerFunc(func(response Response, request Request) {}))
+
+	// the same command twice, the first stop record cannot tell which it ran
+	authorize(1)
+	authorize(2)
+	acct.Handle(&teeResponse{}, correlateAcct(t, 3, AcctFlagStop))
+	// the only candidate left, soon after its authorization
+	acct.Handle(&teeResponse{}, correlateAcct(t, 4, AcctFlagStop))
+	// the only candidate, long after its authorization
+	authorize(5)
+	now = now.Add(time.Minute)
+	acct.Handle(&teeResponse{}, correlateAcct(t, 6, AcctFlagStop))
+
+	require.Len(t, logger.records, 3)
+	for i, want := range []string{CorrelationConfidenceLow, CorrelationConfidenceHigh, CorrelationConfidenceLow} {
+		assert.Equal(t, CorrelationJoinHeuristic, logger.records[i]["join"])
+		assert.Equal(t, want, logger.records[i]["confidence"], "record %v", i)
+	}
+	assert.Equal(t, SessionID(1).String(), logger.records[0]["author-session-id"])
+}
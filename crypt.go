@@ -9,12 +9,15 @@ package tacquito
 
 import (
 	"bufio"
-	"crypto/md5"
+	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/facebookincubator/tacquito/proxy"
 )
@@ -43,51 +46,107 @@ import (
    WARNING: Per the RFC, this is not 'real' encryption. This algorithm does not meet modern standards, but like The Mandalorian says, "This Is The Way".
 */
 func crypt(secret []byte, p *Packet) error {
+	return obfuscate(secret, p, nil, nil)
+}
+
+// Obfuscate obfuscates or deobfuscates the body of p in place with secret, as the crypt of the RFC
+// is its own inverse.  Packets with the UnencryptedFlag and empty bodies are left as they are.  It
+// is meant for tooling that handles packets outside of a server, eg decrypting a packet capture
+// offline; p.Header must be set, as the pad is derived from it, and its Length must be that of
+// the body, so a truncated or mis-parsed packet is an error rather than a body left as it was.
+func Obfuscate(secret []byte, p *Packet) error {
+	if p == nil || p.Header == nil {
+		return fmt.Errorf("cannot obfuscate a packet without a header")
+	}
+	if int(p.Header.Length) != len(p.Body) {
+		return fmt.Errorf("cannot obfuscate a body of [%v] bytes with a header length of [%v]", len(p.Body), p.Header.Length)
+	}
+	return crypt(secret, p)
+}
+
+// obfuscate is crypt, recording the pad iterations in the tally t, with the pads cached in pads
+func obfuscate(secret []byte, p *Packet, t *requestTally, pads *padCache) error {
 	if p.Header.Flags.Has(UnencryptedFlag) {
 		return nil
 	}
-
-	sessionID, err := p.Header.SessionID.MarshalBinary()
-	if err != nil {
-		return err
+	if p.Header.Length == 0 || len(p.Body) == 0 {
+		// there is nothing to obfuscate, so no pad is computed or counted
+		return nil
+	}
+	// the pad covers the body actually held, which a header with a bad length must not overrun
+	if t != nil && t.padHook != nil {
+		if err := hookedPad(secret, p, t); err != nil {
+			return err
+		}
+		t.pad(padIterations(len(p.Body)))
+	} else {
+		iterations, err := pads.xorPad(p.Body, secret, p.Header.SessionID, p.Header.Version, p.Header.SeqNo)
+		if err != nil {
+			return err
+		}
+		t.pad(iterations)
 	}
+	cryptThroughput.add(len(p.Body))
+	return nil
+}
 
-	version, err := p.Header.Version.MarshalBinary()
-	if err != nil {
+// hookedPad is obfuscate with a pad that is held as a whole and passed through the pad hook of t
+// first, so tests can break it
+func hookedPad(secret []byte, p *Packet, t *requestTally) error {
+	pad := make([]byte, len(p.Body))
+	if err := PadInto(pad, secret, p.Header.SessionID, p.Header.Version, p.Header.SeqNo); err != nil {
 		return err
 	}
+	pad = t.padHook(pad)
+	if len(pad) != len(p.Body) {
+		violated(context.Background(), t.logger(), invariantPadLength, "a pad of [%v] bytes for a body of [%v] bytes", len(pad), len(p.Body))
+		return fmt.Errorf("pad of [%v] bytes does not cover a body of [%v] bytes", len(pad), len(p.Body))
+	}
+	for i, b := range p.Body {
+		p.Body[i] = b ^ pad[i]
+	}
+	return nil
+}
 
-	lastHash := make([]byte, 0, 16)
-	pad := make([]byte, 0, p.Header.Length)
-	hash := md5.New()
-	for len(pad) < int(p.Header.Length) {
-		hash.Reset()
-		hash.Write(sessionID)
-		hash.Write(secret)
-		hash.Write(version)
-		hash.Write([]byte{byte(p.Header.SeqNo)})
-		hash.Write(lastHash)
-
-		lastHash = hash.Sum(nil)
+// crypterRole is the end of a connection a crypter serves, which decides the bodies it may read
+type crypterRole uint8
 
-		pad = append(pad, lastHash[:]...)
+const (
+	// roleServer reads requests and writes replies
+	roleServer crypterRole = iota
+	// roleClient reads replies and writes requests
+	roleClient
+)
 
-		// truncate to length of body
-		if len(pad) > int(p.Header.Length) {
-			pad = pad[:int(p.Header.Length)]
-		}
+// inbound returns the direction of the packets a crypter of role r reads
+func (r crypterRole) inbound() Direction {
+	if r == roleClient {
+		return DirectionServer
 	}
+	return DirectionClient
+}
 
-	// perform xor ops
-	for i, b := range p.Body {
-		p.Body[i] = b ^ pad[i]
+// probes returns the bodies a packet of type t read by role r may hold, and those of the
+// opposite direction, which it never should
+func (r crypterRole) probes(t HeaderType) (expected, unexpected []EncoderDecoder) {
+	var requests, replies []EncoderDecoder
+	switch t {
+	case Authenticate:
+		requests, replies = []EncoderDecoder{&AuthenStart{}, &AuthenContinue{}}, []EncoderDecoder{&AuthenReply{}}
+	case Authorize:
+		requests, replies = []EncoderDecoder{&AuthorRequest{}}, []EncoderDecoder{&AuthorReply{}}
+	case Accounting:
+		requests, replies = []EncoderDecoder{&AcctRequest{}}, []EncoderDecoder{&AcctReply{}}
 	}
-	return nil
+	if r == roleClient {
+		return replies, requests
+	}
+	return requests, replies
 }
 
-// newCrypter makes a new crypter
-func newCrypter(secret []byte, c net.Conn, proxy bool) *crypter {
-	return &crypter{secret: secret, Conn: c, Reader: bufio.NewReaderSize(c, 107), proxy: proxy}
+// newCrypter makes a new crypter for the role end of c
+func newCrypter(role crypterRole, secret []byte, c net.Conn, proxy bool) *crypter {
+	return &crypter{role: role, secret: secret, Conn: c, Reader: bufio.NewReaderSize(c, 107), proxy: proxy, sequences: &sequences{}, deadlines: &deadlines{}}
 }
 
 // crypter wraps the net.Conn and performs reads and writes and crypt ops
@@ -99,217 +158,599 @@ type crypter struct {
 	net.Conn
 	*bufio.Reader
 
+	// role is the end of the connection this crypter serves
+	role crypterRole
 	// secret is the tacacs psk used in crypt ops
 	secret []byte
 	// proxy if set, will strip the ha-proxy style ascii header
 	proxy bool
+	// proxyRead is set when the proxy header of the next packet was already consumed
+	// by readProxySource
+	proxyRead bool
+	// proxySeen is set once the first proxy header on the connection was read
+	proxySeen bool
+	// emptyBody is the policy for zero length bodies by packet type.  missing types are rejected
+	emptyBody map[HeaderType]EmptyBodyPolicy
+	// lengthQuirk is set for devices that declare the wrong body length
+	lengthQuirk *lengthQuirk
+	// bodyLengthCheck rejects requests whose decoded body is shorter or longer than Header.Length
+	bodyLengthCheck bool
+	// replyCheck rejects replies that do not decode as the reply of their packet type before they
+	// are written
+	replyCheck bool
+	// source is the client address from the proxy header, if any
+	source net.Addr
+	// sink receives every packet read or written, see SetPacketSink
+	sink PacketSink
+	// clock stamps the packets given to sink, time.Now if nil
+	clock func() time.Time
+	// tally, if set, records the metrics of the request being served, see requestTally
+	tally *requestTally
+	// cutover, if set, holds the other secrets of the device group and the secret of each
+	// session, see SecretCutoverProvider
+	cutover *secretCutover
+	// provider, if set, is the SecretProvider of the connection in place of that of the server, see
+	// TLSVirtualHost
+	provider SecretProvider
+	// badSecretDetector, if set, replaces detectBadSecret, see SetBadSecretDetector
+	badSecretDetector BadSecretDetector
+	// rejectUnencrypted fails the read of requests sent with UnencryptedFlag, see
+	// SetRejectUnencrypted
+	rejectUnencrypted bool
+	// pads, if set, caches the pads of the connection, see SetPadCache
+	pads *padCache
+	// transport, if set, reads and writes packets in place of the obfuscation of the crypter, see
+	// SetPacketTransport
+	transport PacketTransport
+	// sequences, if set, tracks the sequence numbers of the sessions read by a server, see
+	// ErrSequence
+	sequences *sequences
+	// rearm, if set, re-applies the read deadline after read skips a header only packet
+	rearm func() error
+	// deadlines, if set, records the deadlines set through the crypter for interruptible
+	deadlines *deadlines
+	// skipped is the last header only packet read skipped
+	skipped ErrEmptyBody
+}
+
+// readProxySource consumes the proxy header that precedes the next packet and returns the
+// client address it carries.  This allows the server to select a secret for the real source
+// of the connection before any packet is decrypted.
+func (c *crypter) readProxySource() (net.Addr, error) {
+	p, err := c.readProxyHeader()
+	if err != nil {
+		return nil, err
+	}
+	c.proxyRead = true
+	source, err := proxySource(p)
+	if err != nil {
+		return nil, err
+	}
+	c.source = source
+	return source, nil
+}
+
+// proxySource returns the address of the client of the proxy header p
+func proxySource(p *proxy.Header) (*net.TCPAddr, error) {
+	// the proxy header names the client as its local address
+	return net.ResolveTCPAddr(p.LocalAddr().Network(), p.LocalAddr().String())
+}
+
+// device returns the address of the device on the other end, looking past any proxy
+func (c *crypter) device() string {
+	if c.source != nil {
+		return stripPort(c.source.String())
+	}
+	return stripPort(c.RemoteAddr().String())
+}
+
+// readRaw reads the next raw packet, applying the length quirk if one is set
+func (c *crypter) readRaw() ([]byte, error) {
+	if c.lengthQuirk != nil {
+		return c.lengthQuirk.read(c)
+	}
+	return readRawPacket(c.Reader)
+}
+
+// readProxyHeader reads and parses a ha-proxy style ascii header
+func (c *crypter) readProxyHeader() (*proxy.Header, error) {
+	line, err := c.ReadBytes('\000') // octal null byte
+	if err != nil {
+		if err == io.EOF {
+			return nil, err
+		}
+		crypterReadError.Inc()
+		crypterProxyHeaderError.WithLabelValues("read").Inc()
+		return nil, fmt.Errorf("unable to read header proxy line; %w", err)
+	}
+	p := proxy.NewHeader(c.LocalAddr(), c.RemoteAddr())
+	if _, err := p.Write(line); err != nil {
+		crypterReadError.Inc()
+		crypterProxyHeaderError.WithLabelValues("parse").Inc()
+		return nil, fmt.Errorf("unable to extract proxy header; %w", err)
+	}
+	crypterProxyHeaderParsed.Inc()
+	c.proxySeen = true
+	return p, nil
 }
 
-// read will read a packet from the underlying net.Conn and decyrpt it
+// proxySignature starts every ha-proxy style ascii header
+var proxySignature = []byte("PROXY ")
+
+// nextIsProxyHeader reports if the next bytes on c are a proxy header rather than a packet.  A
+// tacacs header never starts with the proxy signature, and is always longer than it.
+func (c *crypter) nextIsProxyHeader() bool {
+	b, err := c.Peek(len(proxySignature))
+	return err == nil && bytes.Equal(b, proxySignature)
+}
+
+// maxEmptySkipped is how many header only packets in a row read skips under EmptyBodyIgnore
+// before it fails with ErrEmptyBody, so a device that streams them cannot hold the read forever
+const maxEmptySkipped = 16
+
+// errEmptySkipped is returned by readPacket for a header only packet it skipped
+var errEmptySkipped = errors.New("header only packet skipped")
+
+// read will read a packet from the underlying net.Conn and decyrpt it.  Header only packets ignored
+// by their EmptyBodyPolicy are skipped, re-arming the read deadline before each next read.
 func (c *crypter) read() (*Packet, error) {
-	// strip proxy header and record metrics
-	if c.proxy {
-		line, err := c.ReadBytes('\000') // octal null byte
-		if err != nil {
-			if err == io.EOF {
+	for skipped := 1; ; skipped++ {
+		p, err := c.readPacket()
+		if err != errEmptySkipped {
+			return p, err
+		}
+		if skipped == maxEmptySkipped {
+			return nil, fmt.Errorf("skipped [%v] header only packets in a row; %w", skipped, &ErrEmptyBody{Type: c.skipped.Type, SessionID: c.skipped.SessionID})
+		}
+		if c.rearm != nil {
+			if err := c.rearm(); err != nil {
 				return nil, err
 			}
-			crypterReadError.Inc()
-			return nil, fmt.Errorf("unable to read header proxy line; %w", err)
 		}
-		p := proxy.NewHeader(c.LocalAddr(), c.RemoteAddr())
-		if _, err := p.Write(line); err != nil {
-			crypterReadError.Inc()
-			return nil, fmt.Errorf("unable to extract proxy header; %w", err)
+	}
+}
+
+// readPacket reads the next packet, returning errEmptySkipped if it is a header only packet that
+// is ignored
+func (c *crypter) readPacket() (*Packet, error) {
+	// strip proxy header and record metrics, unless readProxySource already did.  the header is
+	// sent once ahead of the first packet, but some proxies repeat it ahead of every packet, so
+	// later packets are only stripped of one that is actually there.  this keeps packets that
+	// arrive back to back in the buffer intact.
+	if c.proxy && !c.proxyRead && (!c.proxySeen || c.nextIsProxyHeader()) {
+		p, err := c.readProxyHeader()
+		if err != nil {
+			return nil, err
+		}
+		if c.source == nil {
+			// the source the first header names identifies the device in later errors, eg bad
+			// secrets, so they can be told apart from those of the proxy
+			if source, err := proxySource(p); err == nil {
+				c.source = source
+			}
 		}
-		// TODO add metrics for reporting in next diff
+	}
+	c.proxyRead = false
+	if c.transport != nil {
+		return c.readTransport()
 	}
 
-	// allocate a tacacs header
-	h := make([]byte, MaxHeaderLength)
-	if _, err := io.ReadFull(c.Reader, h); err != nil {
-		if err != io.EOF {
+	raw, err := c.readRaw()
+	if err != nil {
+		if err != io.EOF && !errors.Is(err, errMaxBodyLength) {
 			crypterReadError.Inc()
 		}
 		return nil, err
 	}
 
-	// read the length field from the bytes of the header to know how many more bytes we need to get
-	s := int(binary.BigEndian.Uint32(h[8:]))
-	if s > int(MaxBodyLength) {
-		return nil, fmt.Errorf("max header length exceeded in crypt read, aborting")
-	}
-	b := make([]byte, s)
-	if _, err := io.ReadFull(c.Reader, b); err != nil {
-		crypterReadError.Inc()
-		return nil, err
+	// header only packets are handled before any crypt or bad secret detection, there is nothing to
+	// decrypt and every body type would fail to unmarshal
+	if len(raw) == MaxHeaderLength {
+		t := HeaderType(raw[1])
+		crypterEmptyBody.WithLabelValues(t.String()).Inc()
+		id := SessionID(binary.BigEndian.Uint32(raw[4:]))
+		if c.emptyBody[t] == EmptyBodyIgnore {
+			c.skipped = ErrEmptyBody{Type: t, SessionID: id}
+			return nil, errEmptySkipped
+		}
+		return nil, &ErrEmptyBody{Type: t, SessionID: id}
 	}
 
+	// the body is decrypted in place, so the wire bytes are captured first
+	var wire []byte
+	if c.sink != nil {
+		wire = append(wire, raw...)
+	}
 	var p Packet
-	err := Unmarshal(append(h, b...), &p)
-	if err != nil {
+	if err := Unmarshal(raw, &p); err != nil {
 		crypterUnmarshalError.Inc()
 		return nil, err
 	}
+	if c.rejectUnencrypted && c.role == roleServer && p.Header.Flags.Has(UnencryptedFlag) {
+		return nil, c.rejectUnobfuscated(&p, wire)
+	}
 	// run crypt first before we look for bad secrets
-	if err := crypt(c.secret, &p); err != nil {
+	if err := c.decrypt(&p); err != nil {
 		crypterCryptError.Inc()
 		return nil, err
 	}
-	// if err is != nil, we hit a bug
-	// if reply is != nil, we found a bad secret.
-	// if both are non nil, we only inspect the error as that
-	// is a higher error condition in the server than a bad secret is
-	if reply, err := c.detectBadSecret(&p); err != nil {
+	switch result, reply, err := c.detect(&p); result {
+	case secretError:
+		// we hit a bug, a higher error condition in the server than a bad secret is
 		return nil, err
-	} else if reply != nil {
-		if _, err := c.write(reply); err != nil {
-			return nil, fmt.Errorf("bad secret, crypt write fail for session [%v]: %v", p.Header.SessionID, err)
+	case secretWrongDirection:
+		crypterWrongDirection.WithLabelValues(p.Header.Type.String()).Inc()
+		// the body is not one this end decodes, so only the wire bytes are captured
+		c.capture(c.role.inbound(), wire, nil)
+		return nil, err
+	case secretBad:
+		crypterBadSecret.Inc()
+		// the body could not be decrypted, so only the wire bytes are captured
+		c.capture(c.role.inbound(), wire, nil)
+		// only a server answers a bad secret, a client has nobody to tell
+		if reply != nil {
+			r := &response{crypter: c, header: *p.Header}
+			if _, err := r.write(reply, originServer); err != nil {
+				return nil, fmt.Errorf("bad secret, crypt write fail for session [%v]: %v", p.Header.SessionID, err)
+			}
 		}
-		return nil, fmt.Errorf("bad secret detected for sessionID [%v]", p.Header.SessionID)
+		return nil, NewBadSecretErr(fmt.Sprintf("bad secret detected for sessionID [%v] from [%v]", p.Header.SessionID, c.device()))
 	}
 
-	crypterRead.Inc()
-	return &p, nil
+	return c.received(&p, wire)
 }
 
-// write takes a packet, marshals and crypts it
-func (c *crypter) write(p *Packet) (int, error) {
-	if p == nil {
-		return 0, fmt.Errorf("handler error, packet cannot be nil")
+// received records the packet p read as wire, and checks its body length
+func (c *crypter) received(p *Packet, wire []byte) (*Packet, error) {
+	c.tally.read()
+	c.capture(c.role.inbound(), wire, p)
+	if err := c.checkSequence(p); err != nil {
+		return nil, err
 	}
-	if p.Body == nil {
-		return 0, fmt.Errorf("handler error, packet.Body cannot be nil")
+	if c.bodyLengthCheck {
+		if err := checkBodyLength(p); err != nil {
+			crypterBodyLengthMismatch.WithLabelValues(p.Header.Type.String()).Inc()
+			return nil, err
+		}
 	}
-	p.Header.Length = uint32(len(p.Body))
-	if err := crypt(c.secret, p); err != nil {
-		crypterCryptError.Inc()
-		return 0, err
+	return p, nil
+}
+
+// checkBodyLength returns ErrBodyLength if the body of the request p does not encode back to
+// Header.Length bytes.  Each body type ignores bytes after its last field, so corruption or a
+// secret that happens to decrypt into valid fields can leave bytes the fields do not account for.
+// Bodies that do not unmarshal are left to the handler.
+func checkBodyLength(p *Packet) error {
+	body, err := decodeBody(DirectionClient, p)
+	if err != nil || body == nil {
+		return nil
 	}
-	b, err := p.MarshalBinary()
+	b, err := body.MarshalBinary()
 	if err != nil {
-		crypterMarshalError.Inc()
-		return 0, err
+		return nil
+	}
+	if uint32(len(b)) == p.Header.Length {
+		return nil
+	}
+	return &ErrBodyLength{Type: p.Header.Type, SessionID: p.Header.SessionID, Declared: p.Header.Length, Decoded: len(b)}
+}
+
+// checkReply returns ErrInvalidReply if the body of the reply p does not decode as the reply of
+// its packet type, eg a body shorter than the fixed fields of an AuthenReply.  Such replies are
+// handler bugs that devices would otherwise fail to parse.
+func checkReply(p *Packet) error {
+	if _, err := decodeBody(DirectionServer, p); err != nil {
+		return &ErrInvalidReply{Type: p.Header.Type, SessionID: p.Header.SessionID, Err: err}
+	}
+	return nil
+}
+
+// readContext is read, returning ctx.Err() once ctx is done
+func (c *crypter) readContext(ctx context.Context) (*Packet, error) {
+	var p *Packet
+	err := c.interruptible(ctx, func() error {
+		var err error
+		p, err = c.read()
+		return err
+	})
+	return p, err
+}
+
+// writeContext is write, returning ctx.Err() once ctx is done
+func (c *crypter) writeContext(ctx context.Context, p *Packet) (int, error) {
+	var n int
+	err := c.interruptible(ctx, func() error {
+		var err error
+		n, err = c.write(p)
+		return err
+	})
+	return n, err
+}
+
+// interruptible calls fn, which reads or writes c, and unblocks it once ctx is done by moving the
+// deadline of c into the past.  The deadlines set through c are restored before it returns, so a
+// deadline set on the connection itself, rather than through c, is lost once ctx interrupts fn.
+func (c *crypter) interruptible(ctx context.Context, fn func() error) error {
+	if ctx.Done() == nil {
+		return fn()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	stop := make(chan struct{})
+	interrupted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Conn.SetDeadline(time.Unix(1, 0))
+			interrupted <- true
+		case <-stop:
+			interrupted <- false
+		}
+	}()
+	err := fn()
+	close(stop)
+	if <-interrupted {
+		if d := c.deadlines; d != nil {
+			d.Lock()
+			c.Conn.SetReadDeadline(d.read)
+			c.Conn.SetWriteDeadline(d.write)
+			d.Unlock()
+		}
+		return ctx.Err()
+	}
+	return err
+}
+
+// deadlines are the read and write deadlines last set through a crypter
+type deadlines struct {
+	sync.Mutex
+	read, write time.Time
+}
+
+// SetDeadline implements net.Conn, recording the deadline for interruptible
+func (c *crypter) SetDeadline(t time.Time) error {
+	if d := c.deadlines; d != nil {
+		d.Lock()
+		defer d.Unlock()
+		d.read, d.write = t, t
+	}
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline implements net.Conn, recording the deadline for interruptible
+func (c *crypter) SetReadDeadline(t time.Time) error {
+	if d := c.deadlines; d != nil {
+		d.Lock()
+		defer d.Unlock()
+		d.read = t
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline implements net.Conn, recording the deadline for interruptible
+func (c *crypter) SetWriteDeadline(t time.Time) error {
+	if d := c.deadlines; d != nil {
+		d.Lock()
+		defer d.Unlock()
+		d.write = t
 	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// writeReply writes the reply p and counts its outcome.  origin tells replies decided by a
+// handler apart from those the server synthesized
+func (c *crypter) writeReply(p *Packet, origin string) (int, error) {
+	t, status := replyOutcome(p)
+	n, err := c.write(p)
+	if err == nil {
+		c.tally.outcome(t, status, origin)
+	}
+	return n, err
+}
 
+// write takes a packet, marshals and crypts it
+func (c *crypter) write(p *Packet) (int, error) {
+	if c.transport != nil {
+		return c.writeTransport(p)
+	}
+	decoded := c.decoded(p)
+	b, err := c.marshal(p)
+	if err != nil {
+		return 0, err
+	}
 	n, err := c.Write(b)
 	if err != nil {
 		crypterWriteError.Inc()
 		return 0, err
 	}
-	crypterWrite.Inc()
+	c.tally.write()
+	c.capture(DirectionServer, b, decoded)
+	c.sequences.replied(p)
 	return n, nil
 }
 
+// decoded returns a copy of p to capture, if there is a sink, so the sink does not share the
+// body of the caller
+func (c *crypter) decoded(p *Packet) *Packet {
+	if c.sink == nil || p == nil || p.Header == nil {
+		return nil
+	}
+	h := *p.Header
+	return &Packet{Header: &h, Body: append([]byte(nil), p.Body...)}
+}
+
+// marshal returns p in wire format, crypted.  p is not changed: the header length is set on a copy
+// of its header, and the body is crypted in the marshaled buffer, so a packet can be written again
+// or logged after it was written.
+func (c *crypter) marshal(p *Packet) ([]byte, error) {
+	if err := c.writable(p); err != nil {
+		return nil, err
+	}
+	h := *p.Header
+	h.Length = uint32(len(p.Body))
+	b, err := (&Packet{Header: &h, Body: p.Body}).MarshalBinary()
+	if err != nil {
+		crypterMarshalError.Inc()
+		return nil, err
+	}
+	if err := obfuscate(c.secretOf(h.SessionID), &Packet{Header: &h, Body: b[MaxHeaderLength:]}, c.tally, c.pads); err != nil {
+		crypterCryptError.Inc()
+		return nil, err
+	}
+	return b, nil
+}
+
+// writable returns an error if p may not be written
+func (c *crypter) writable(p *Packet) error {
+	if p == nil {
+		return fmt.Errorf("handler error, packet cannot be nil")
+	}
+	if p.Body == nil {
+		return fmt.Errorf("handler error, packet.Body cannot be nil")
+	}
+	if len(p.Body) == 0 {
+		// every packet type has a minimum body length, none may be sent empty
+		return &ErrEmptyBody{Type: p.Header.Type, SessionID: p.Header.SessionID}
+	}
+	if c.replyCheck && c.role == roleServer {
+		if err := checkReply(p); err != nil {
+			crypterInvalidReply.WithLabelValues(p.Header.Type.String()).Inc()
+			return err
+		}
+	}
+	return nil
+}
+
+// decrypt deobfuscates p, read from the connection, with the secret of its session
+func (c *crypter) decrypt(p *Packet) error {
+	if c.cutover == nil || p.Header.Flags.Has(UnencryptedFlag) {
+		return obfuscate(c.secret, p, c.tally, c.pads)
+	}
+	return c.cutover.decrypt(c, p)
+}
+
+// secretOf returns the secret the packets of session are obfuscated with
+func (c *crypter) secretOf(session SessionID) []byte {
+	if c.cutover == nil {
+		return c.secret
+	}
+	return c.cutover.secret(session)
+}
+
+// decodes reports if the body of p decodes cleanly as a body of its type that c reads.  Unlike
+// detectBadSecret it has no side effects, so secrets can be tried with it.
+func (c crypter) decodes(p *Packet) bool {
+	expected, _ := c.role.probes(p.Header.Type)
+	for _, body := range expected {
+		if err := Unmarshal(p.Body, body); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// secretResult is the outcome of detectBadSecret
+type secretResult uint8
+
+const (
+	// secretGood is a packet that decoded as at least one body of its type
+	secretGood secretResult = iota
+	// secretBad is a packet that decoded as no body of its type, most likely sent with another secret
+	secretBad
+	// secretError is a bad secret that could not be answered
+	secretError
+	// secretWrongDirection is a packet that decoded only as a body of the opposite direction, eg a
+	// reply sent to a server
+	secretWrongDirection
+)
+
+// String ...
+func (r secretResult) String() string {
+	switch r {
+	case secretGood:
+		return "good"
+	case secretBad:
+		return "bad-secret"
+	case secretError:
+		return "error"
+	case secretWrongDirection:
+		return "wrong-direction"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(r))
+}
+
 // detectBadSecret is "a way" to detect a potential bad secret.  tacacs doesn't give
 // us enough information to know what body to expect from a given header, so we
-// have to go to great lengths to guess
-func (c crypter) detectBadSecret(p *Packet) (*Packet, error) {
+// have to go to great lengths to guess.  Only the bodies of the direction the role
+// of c reads are probed.  A packet that decodes as none of them, but cleanly as a
+// body of the opposite direction, is a confused peer rather than a bad secret.  For
+// secretBad the reply to send the client is returned, if the role of c answers, for
+// secretError and secretWrongDirection the error.
+func (c crypter) detectBadSecret(p *Packet) (secretResult, *Packet, error) {
 	if p.Header.Flags.Has(UnencryptedFlag) {
-		return nil, nil
+		return secretGood, nil, nil
+	}
+	expected, unexpected := c.role.probes(p.Header.Type)
+	if len(expected) == 0 {
+		return secretGood, nil, nil
 	}
 	var badSecret *BadSecretErr
-	switch p.Header.Type {
-	case Authenticate:
-		errCnt := 0
-		var as AuthenStart
-		if err := Unmarshal(p.Body, &as); errors.As(err, &badSecret) {
-			errCnt++
-		}
-		var ac AuthenContinue
-		if err := Unmarshal(p.Body, &ac); errors.As(err, &badSecret) {
-			errCnt++
+	errCnt := 0
+	for _, body := range expected {
+		err := Unmarshal(p.Body, body)
+		if err == nil {
+			return secretGood, nil, nil
 		}
-		var ar AuthenReply
-		if err := Unmarshal(p.Body, &ar); errors.As(err, &badSecret) {
+		if errors.As(err, &badSecret) {
 			errCnt++
 		}
-		if errCnt == 3 {
-			crypterBadSecret.Inc()
-			// all packet types failed, most likley a bad secret
-			return c.badSecretReply(p.Header)
-		}
-	case Authorize:
-		errCnt := 0
-		var ar AuthorRequest
-		if err := Unmarshal(p.Body, &ar); errors.As(err, &badSecret) {
-			errCnt++
-		}
-		var arr AuthorReply
-		if err := Unmarshal(p.Body, &arr); errors.As(err, &badSecret) {
-			errCnt++
-		}
-		if errCnt == 2 {
-			crypterBadSecret.Inc()
-			// all packet types failed, most likley a bad secret
-			return c.badSecretReply(p.Header)
-		}
-	case Accounting:
-		errCnt := 0
-		var ar AcctRequest
-		if err := Unmarshal(p.Body, &ar); errors.As(err, &badSecret) {
-			errCnt++
-		}
-		var arr AcctReply
-		if err := Unmarshal(p.Body, &arr); errors.As(err, &badSecret) {
-			errCnt++
-		}
-		if errCnt == 2 {
-			crypterBadSecret.Inc()
-			// all packet types failed, most likley a bad secret
-			return c.badSecretReply(p.Header)
+	}
+	for _, body := range unexpected {
+		if err := Unmarshal(p.Body, body); err == nil {
+			return secretWrongDirection, nil, &ErrWrongDirection{Type: p.Header.Type, SessionID: p.Header.SessionID, Direction: c.role.inbound()}
 		}
 	}
-	return nil, nil
+	if errCnt < len(expected) {
+		// a body of the expected direction that is malformed is left to the handler
+		return secretGood, nil, nil
+	}
+	// all packet types failed, most likley a bad secret
+	if c.role == roleClient {
+		return secretBad, nil, nil
+	}
+	return c.badSecret(p.Header)
+}
+
+// badSecret classifies a bad secret for a packet with header h by whether it can be answered
+func (c crypter) badSecret(h *Header) (secretResult, *Packet, error) {
+	reply, err := c.badSecretReply(*h)
+	if err != nil {
+		return secretError, nil, err
+	}
+	return secretBad, reply, nil
 }
 
-func (c crypter) badSecretReply(h *Header) (*Packet, error) {
-	var b []byte
-	var err error
+// badSecretReply returns the reply to a packet with header h that was sent with a bad secret.  h
+// is copied, so the reply keeps the flags, and so the obfuscation, of the request, and the
+// response that writes it enforces that.
+func (c crypter) badSecretReply(h Header) (*Packet, error) {
 	switch h.Type {
-	case Authenticate:
-		b, err = NewAuthenReply(
-			SetAuthenReplyStatus(AuthenStatusError),
-			SetAuthenReplyServerMsg("bad secret"),
-		).MarshalBinary()
-		if err != nil {
-			crypterMarshalError.Inc()
-			return nil, err
-		}
-	case Authorize:
-		b, err = NewAuthorReply(
-			SetAuthorReplyStatus(AuthorStatusError),
-			SetAuthorReplyServerMsg("bad secret"),
-		).MarshalBinary()
-		if err != nil {
-			crypterMarshalError.Inc()
-			return nil, err
-		}
-	case Accounting:
-		b, err = NewAcctReply(
-			SetAcctReplyStatus(AcctReplyStatusError),
-			SetAcctReplyServerMsg("bad secret"),
-		).MarshalBinary()
-		if err != nil {
-			crypterMarshalError.Inc()
-			return nil, err
-		}
+	case Authenticate, Authorize, Accounting:
 	default:
 		return nil, fmt.Errorf("unknown header type [%v]", h.Type)
 	}
+	b, err := errorReply(h.Type, "bad secret").MarshalBinary()
+	if err != nil {
+		crypterMarshalError.Inc()
+		return nil, err
+	}
 	// reset some flags and state for this error reply.
 	// under error conditions it can be common in the rfc to reset the sequence to 1
 	// if the error is particularly egregious.  a bad secret seems like it fits and
 	// the rfc is unclear for this particular condition on what to do
 	h.SeqNo = SequenceNumber(1)
-	p := NewPacket(
-		SetPacketHeader(h),
-		SetPacketBody(b),
-	)
-	if err != nil {
-		return nil, err
-	}
-	return p, nil
+	return NewPacket(SetPacketHeader(&h), SetPacketBody(b)), nil
 }
 
 // BadSecretErr ...
@@ -326,3 +767,73 @@ func NewBadSecretErr(msg string) *BadSecretErr {
 func (b BadSecretErr) Error() string {
 	return b.msg
 }
+
+// EmptyBodyPolicy controls how a packet with a zero length body is handled
+type EmptyBodyPolicy uint8
+
+const (
+	// EmptyBodyReject returns ErrEmptyBody, closing the connection
+	EmptyBodyReject EmptyBodyPolicy = iota
+	// EmptyBodyIgnore discards the packet and waits for the next one.  Some devices send header only
+	// accounting packets as watchdog keepalives.  More than maxEmptySkipped in a row fail with
+	// ErrEmptyBody.
+	EmptyBodyIgnore
+)
+
+// ErrEmptyBody is returned when a packet has a header length of zero
+type ErrEmptyBody struct {
+	Type      HeaderType
+	SessionID SessionID
+}
+
+// Error ...
+func (e ErrEmptyBody) Error() string {
+	return fmt.Sprintf("empty body for packet type [%v] in sessionID [%v]", e.Type, e.SessionID)
+}
+
+// ErrWrongDirection is returned when a packet decodes only as a body of the opposite direction,
+// eg a client that sends replies to the server
+type ErrWrongDirection struct {
+	Type      HeaderType
+	SessionID SessionID
+	// Direction is the direction the packet was read in
+	Direction Direction
+}
+
+// Error ...
+func (e ErrWrongDirection) Error() string {
+	return fmt.Sprintf("packet of type [%v] in sessionID [%v] sent by the %v holds a body of the opposite direction", e.Type, e.SessionID, e.Direction)
+}
+
+// ErrInvalidReply is returned when a reply is written whose body does not decode as the reply of
+// its packet type, see SetReplyCheck
+type ErrInvalidReply struct {
+	Type      HeaderType
+	SessionID SessionID
+	Err       error
+}
+
+// Error ...
+func (e ErrInvalidReply) Error() string {
+	return fmt.Sprintf("handler error, reply of packet type [%v] in sessionID [%v] is invalid; %v", e.Type, e.SessionID, e.Err)
+}
+
+// Unwrap returns the decode error
+func (e ErrInvalidReply) Unwrap() error {
+	return e.Err
+}
+
+// ErrBodyLength is returned when the fields of a decoded body add up to a different length than
+// the header declares, see SetBodyLengthCheck
+type ErrBodyLength struct {
+	Type      HeaderType
+	SessionID SessionID
+	// Declared is Header.Length and Decoded is the length of the body its fields account for
+	Declared uint32
+	Decoded  int
+}
+
+// Error ...
+func (e ErrBodyLength) Error() string {
+	return fmt.Sprintf("body of packet type [%v] in sessionID [%v] decodes to [%v] bytes, but the header declares [%v]", e.Type, e.SessionID, e.Decoded, e.Declared)
+}
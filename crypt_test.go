@@ -8,10 +8,15 @@
 package tacquito
 
 import (
+	"context"
+	"errors"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // returns an encrypted TACACs+ packet's byte values, contains the 12 byte header
@@ -148,3 +153,467 @@ func TestPacketEncryptDecryptUnencryptFlagSet(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, b, packet.Body)
 }
+
+func TestCrypterEmptyBody(t *testing.T) {
+	tests := []struct {
+		name   string
+		t      HeaderType
+		policy EmptyBodyPolicy
+	}{
+		{name: "authenticate reject", t: Authenticate, policy: EmptyBodyReject},
+		{name: "authenticate ignore", t: Authenticate, policy: EmptyBodyIgnore},
+		{name: "authorize reject", t: Authorize, policy: EmptyBodyReject},
+		{name: "authorize ignore", t: Authorize, policy: EmptyBodyIgnore},
+		{name: "accounting reject", t: Accounting, policy: EmptyBodyReject},
+		{name: "accounting ignore", t: Accounting, policy: EmptyBodyIgnore},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			c := newCrypter(roleServer, []byte("fooman"), server, false)
+			c.emptyBody = map[HeaderType]EmptyBodyPolicy{test.t: test.policy}
+			before := metricValue(crypterEmptyBody.WithLabelValues(test.t.String()))
+
+			// a header only packet followed by a real one
+			go func() {
+				client.Write([]byte{0xc1, byte(test.t), 0x01, 0x00, 0x00, 0x00, 0x30, 0x39, 0x00, 0x00, 0x00, 0x00})
+				client.Write(getEncryptedBytes())
+			}()
+
+			p, err := c.read()
+			assert.Equal(t, before+1, metricValue(crypterEmptyBody.WithLabelValues(test.t.String())))
+			if test.policy == EmptyBodyIgnore {
+				assert.NoError(t, err)
+				assert.Equal(t, getDecryptedBytes(), p.Body)
+				return
+			}
+			var eb *ErrEmptyBody
+			assert.True(t, errors.As(err, &eb))
+			assert.Equal(t, test.t, eb.Type)
+			assert.Equal(t, SessionID(12345), eb.SessionID)
+		})
+	}
+}
+
+func TestCrypterEmptyBodyStream(t *testing.T) {
+	// a device that streams header only packets is failed once maxEmptySkipped were skipped in a
+	// row, the deadline re-armed before each next read
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	c := newCrypter(roleServer, []byte("fooman"), server, false)
+	c.emptyBody = map[HeaderType]EmptyBodyPolicy{Accounting: EmptyBodyIgnore}
+	var rearmed int
+	c.rearm = func() error {
+		rearmed++
+		return nil
+	}
+	go func() {
+		for {
+			if _, err := client.Write([]byte{0xc1, byte(Accounting), 0x01, 0x00, 0x00, 0x00, 0x30, 0x39, 0x00, 0x00, 0x00, 0x00}); err != nil {
+				return
+			}
+		}
+	}()
+	_, err := c.read()
+	var eb *ErrEmptyBody
+	if assert.True(t, errors.As(err, &eb), err) {
+		assert.Equal(t, Accounting, eb.Type)
+		assert.Equal(t, SessionID(12345), eb.SessionID)
+	}
+	assert.Equal(t, maxEmptySkipped-1, rearmed)
+}
+
+func TestCrypterBodyLength(t *testing.T) {
+	// padded has four bytes after its last field, its field lengths sum to less than Header.Length.
+	// write encrypts a packet in place, so each test gets its own.
+	padded := func() *Packet {
+		p := proxyTestPacket()
+		p.Body = append(p.Body, 0x00, 0x00, 0x00, 0x00)
+		return p
+	}
+	length := uint32(len(padded().Body))
+	tests := []struct {
+		name   string
+		check  bool
+		packet *Packet
+		err    bool
+	}{
+		{name: "conformant body with the check", check: true, packet: proxyTestPacket()},
+		{name: "padded body without the check", check: false, packet: padded()},
+		{name: "padded body with the check", check: true, packet: padded(), err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			c := newCrypter(roleServer, []byte("fooman"), server, false)
+			c.bodyLengthCheck = test.check
+			before := metricValue(crypterBodyLengthMismatch.WithLabelValues(Authenticate.String()))
+			want := uint32(len(test.packet.Body))
+			go newCrypter(roleClient, []byte("fooman"), client, false).write(test.packet)
+
+			p, err := c.read()
+			if !test.err {
+				assert.NoError(t, err)
+				assert.Equal(t, want, p.Header.Length)
+				assert.Equal(t, before, metricValue(crypterBodyLengthMismatch.WithLabelValues(Authenticate.String())))
+				return
+			}
+			var bl *ErrBodyLength
+			if !assert.True(t, errors.As(err, &bl)) {
+				return
+			}
+			assert.Equal(t, length, bl.Declared)
+			assert.Equal(t, int(length)-4, bl.Decoded)
+			assert.Equal(t, SessionID(12345), bl.SessionID)
+			assert.Equal(t, before+1, metricValue(crypterBodyLengthMismatch.WithLabelValues(Authenticate.String())))
+		})
+	}
+}
+
+func TestCrypterWriteEmptyBody(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	c := newCrypter(roleServer, []byte("fooman"), server, false)
+	_, err := c.write(NewPacket(
+		SetPacketHeader(NewHeader(SetHeaderType(Accounting), SetHeaderSeqNo(2), SetHeaderSessionID(12345))),
+		SetPacketBody([]byte{}),
+	))
+	var eb *ErrEmptyBody
+	assert.True(t, errors.As(err, &eb))
+	assert.Equal(t, Accounting, eb.Type)
+}
+
+func TestCrypterWriteReplyCheck(t *testing.T) {
+	authorReply, err := NewAuthorReply(SetAuthorReplyStatus(AuthorStatusPassAdd), SetAuthorReplyArgs("priv-lvl=15")).MarshalBinary()
+	assert.NoError(t, err)
+	tests := []struct {
+		name    string
+		t       HeaderType
+		body    []byte
+		invalid bool
+	}{
+		{name: "authen reply without its fixed fields", t: Authenticate, body: []byte{byte(AuthenStatusPass), 0x00, 0x00}, invalid: true},
+		{name: "authen reply with a server msg it does not hold", t: Authenticate, body: []byte{byte(AuthenStatusPass), 0x00, 0x00, 0x05, 0x00, 0x00}, invalid: true},
+		{name: "author reply with an arg it does not hold", t: Authorize, body: authorReply[:len(authorReply)-1], invalid: true},
+		{name: "acct reply with an unknown status", t: Accounting, body: []byte{0x00, 0x00, 0x00, 0x00, 0x09}, invalid: true},
+		{name: "author reply", t: Authorize, body: authorReply},
+		{name: "authen reply", t: Authenticate, body: []byte{byte(AuthenStatusPass), 0x00, 0x00, 0x00, 0x00, 0x00}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packet := func() *Packet {
+				return NewPacket(
+					SetPacketHeader(NewHeader(SetHeaderVersion(benchVersion), SetHeaderType(test.t), SetHeaderSeqNo(2), SetHeaderSessionID(12345))),
+					SetPacketBody(append([]byte(nil), test.body...)),
+				)
+			}
+			// the check is off by default
+			c := &crypter{Conn: &writeCountingConn{}, secret: []byte("fooman")}
+			_, err := c.write(packet())
+			assert.NoError(t, err)
+
+			c.replyCheck = true
+			before := metricValue(crypterInvalidReply.WithLabelValues(test.t.String()))
+			_, err = c.write(packet())
+			if !test.invalid {
+				assert.NoError(t, err)
+				return
+			}
+			var ir *ErrInvalidReply
+			assert.True(t, errors.As(err, &ir), "%v", err)
+			assert.Equal(t, test.t, ir.Type)
+			assert.Equal(t, before+1, metricValue(crypterInvalidReply.WithLabelValues(test.t.String())))
+
+			// clients write requests, which the check does not apply to
+			c.role = roleClient
+			_, err = c.write(packet())
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestHandlerInvalidReply(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	s := NewServer(nopLogger{}, nil, SetReplyCheck(true))
+	sc := newCrypter(roleServer, []byte("fooman"), server, false)
+	// as Serve sets it on the crypter of each connection
+	sc.replyCheck = s.replyCheck
+	errs := make(chan error, 2)
+	go s.handle(context.Background(), sc, HandlerFunc(func(response Response, request Request) {
+		header := request.Header
+		header.SeqNo++
+		for _, body := range [][]byte{{}, {byte(AuthenStatusPass), 0x00, 0x00}} {
+			_, err := response.Write(NewPacket(SetPacketHeader(&header), SetPacketBody(body)))
+			errs <- err
+		}
+		response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusFail)))
+	}))
+
+	c := newCrypter(roleClient, []byte("fooman"), client, false)
+	_, err := c.write(featureTestStart(12345, 0, MinorVersionDefault, AuthenTypePAP))
+	require.NoError(t, err)
+	// neither invalid reply reaches the device, the reply the handler sends next does
+	assert.Equal(t, AuthenStatusFail, lifetimeReply(t, c).Status)
+
+	var eb *ErrEmptyBody
+	assert.True(t, errors.As(<-errs, &eb))
+	var ir *ErrInvalidReply
+	assert.True(t, errors.As(<-errs, &ir))
+	assert.Equal(t, Authenticate, ir.Type)
+	assert.Equal(t, SessionID(12345), ir.SessionID)
+}
+
+func TestDetectBadSecret(t *testing.T) {
+	decrypted := func(secret string, flags HeaderFlag) *Packet {
+		var header Header
+		assert.NoError(t, Unmarshal(getEncryptedBytes()[:12], &header))
+		header.Flags = flags
+		packet := &Packet{Header: &header, Body: getEncryptedBytes()[12:]}
+		assert.NoError(t, crypt([]byte(secret), packet))
+		return packet
+	}
+	tests := []struct {
+		name   string
+		packet *Packet
+		result secretResult
+	}{
+		{name: "good", packet: decrypted("fooman", 0), result: secretGood},
+		{name: "bad secret", packet: decrypted("not-fooman", 0), result: secretBad},
+		// bodies sent in the clear are never checked
+		{name: "unencrypted", packet: decrypted("not-fooman", UnencryptedFlag), result: secretGood},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			seqNo := test.packet.Header.SeqNo
+			result, reply, err := crypter{}.detectBadSecret(test.packet)
+			assert.Equal(t, test.result, result)
+			// the reply is built from a copy of the header of the request
+			assert.Equal(t, seqNo, test.packet.Header.SeqNo)
+			assert.NoError(t, err)
+			if test.result != secretBad {
+				assert.Nil(t, reply)
+				return
+			}
+			var body AuthenReply
+			assert.NoError(t, Unmarshal(reply.Body, &body))
+			assert.Equal(t, AuthenStatusError, body.Status)
+			assert.Equal(t, SequenceNumber(1), reply.Header.SeqNo)
+		})
+	}
+}
+
+func TestBadSecretError(t *testing.T) {
+	// a bad secret that cannot be answered, as there is no reply for the packet type
+	result, reply, err := crypter{}.badSecret(&Header{Type: HeaderType(0x7)})
+	assert.Equal(t, secretError, result)
+	assert.Nil(t, reply)
+	assert.Error(t, err)
+	assert.Equal(t, "error", result.String())
+}
+
+// wrongDirectionTestReply is an authentication reply, which only a server sends
+func wrongDirectionTestReply() *Packet {
+	return NewPacket(
+		SetPacketHeader(NewHeader(SetHeaderType(Authenticate), SetHeaderSeqNo(2), SetHeaderSessionID(12345),
+			SetHeaderVersion(Version{MajorVersion: MajorVersion, MinorVersion: MinorVersionOne}))),
+		SetPacketBodyUnsafe(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusPass), SetAuthenReplyServerMsg("hello"))),
+	)
+}
+
+func TestCrypterWrongDirection(t *testing.T) {
+	tests := []struct {
+		name   string
+		role   crypterRole
+		packet *Packet
+	}{
+		{name: "server reads a reply", role: roleServer, packet: wrongDirectionTestReply()},
+		{name: "client reads a request", role: roleClient, packet: proxyTestPacket()},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			c := newCrypter(test.role, []byte("fooman"), server, false)
+			wrong := metricValue(crypterWrongDirection.WithLabelValues(Authenticate.String()))
+			bad := metricValue(crypterBadSecret)
+			// the writer shares the secret, so the body decrypts cleanly
+			go newCrypter(roleServer, []byte("fooman"), client, false).write(test.packet)
+
+			_, err := c.read()
+			var wd *ErrWrongDirection
+			if !assert.True(t, errors.As(err, &wd), "%v", err) {
+				return
+			}
+			assert.Equal(t, Authenticate, wd.Type)
+			assert.Equal(t, SessionID(12345), wd.SessionID)
+			assert.Equal(t, test.role.inbound(), wd.Direction)
+			var bs *BadSecretErr
+			assert.False(t, errors.As(err, &bs))
+			assert.Equal(t, wrong+1, metricValue(crypterWrongDirection.WithLabelValues(Authenticate.String())))
+			assert.Equal(t, bad, metricValue(crypterBadSecret))
+		})
+	}
+}
+
+func TestCrypterClientBadSecret(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// a client does not answer a bad secret, or this read would block on the pipe
+	c := newCrypter(roleClient, []byte("fooman"), client, false)
+	go newCrypter(roleServer, []byte("not-fooman"), server, false).write(wrongDirectionTestReply())
+	_, err := c.read()
+	var bs *BadSecretErr
+	assert.True(t, errors.As(err, &bs), "%v", err)
+}
+
+func TestCryptZeroLength(t *testing.T) {
+	// an empty body does not reach the pad, which would reject the zero version
+	for _, body := range [][]byte{nil, {}} {
+		count, _ := padIterationsObserved(t)
+		p := &Packet{Header: &Header{SessionID: 7}, Body: body}
+		require.NoError(t, crypt([]byte("fooman"), p))
+		assert.Empty(t, p.Body)
+		gotCount, _ := padIterationsObserved(t)
+		assert.Equal(t, count, gotCount)
+	}
+}
+
+func TestReplyObfuscation(t *testing.T) {
+	body, err := NewAuthenReply(SetAuthenReplyStatus(AuthenStatusPass)).MarshalBinary()
+	require.NoError(t, err)
+	tests := []struct {
+		name string
+		// request is the flags of the request and handler those of the packet the handler writes
+		request, handler HeaderFlag
+	}{
+		{name: "unencrypted request", request: UnencryptedFlag, handler: UnencryptedFlag},
+		{name: "unencrypted request, handler cleared the flag", request: UnencryptedFlag, handler: SingleConnect},
+		{name: "obfuscated request", request: 0, handler: 0},
+		{name: "obfuscated request, handler set the flag", request: SingleConnect, handler: UnencryptedFlag | SingleConnect},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := &writeCountingConn{}
+			r := newBatchResponse(conn)
+			r.header.Flags = test.request
+			p := NewPacket(
+				SetPacketHeader(NewHeader(SetHeaderVersion(r.header.Version), SetHeaderType(Authenticate), SetHeaderSeqNo(2), SetHeaderSessionID(12345), SetHeaderFlag(test.handler))),
+				SetPacketBody(append([]byte(nil), body...)),
+			)
+			_, err := r.Write(p)
+			require.NoError(t, err)
+			// the packet of the handler keeps its flags
+			assert.Equal(t, test.handler, p.Header.Flags)
+
+			// the request decides the obfuscation, the handler the other flags.  The wire bytes are
+			// checked, as unmarshaling a header sets SingleConnect on the first reply.
+			require.Len(t, conn.writes, 1)
+			sent := conn.writes[0]
+			assert.Equal(t, test.request&UnencryptedFlag|test.handler&^UnencryptedFlag, HeaderFlag(sent[3]))
+			if test.request.Has(UnencryptedFlag) {
+				assert.Equal(t, body, sent[MaxHeaderLength:])
+			} else {
+				assert.NotEqual(t, body, sent[MaxHeaderLength:])
+			}
+
+			// replies built by the response copy the flags of the request
+			conn.writes = nil
+			_, err = r.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusPass)))
+			require.NoError(t, err)
+			require.Len(t, conn.writes, 1)
+			assert.Equal(t, test.request, HeaderFlag(conn.writes[0][3]))
+		})
+	}
+}
+
+func TestCrypterWriteLeavesPacket(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	// a second write of a packet crypted in place fails the bad secret check, whose reply nobody reads
+	require.NoError(t, client.SetDeadline(time.Now().Add(5*time.Second)))
+	require.NoError(t, server.SetDeadline(time.Now().Add(5*time.Second)))
+
+	p := proxyTestPacket()
+	// a length the write corrects, on the copy it sends
+	p.Header.Length = 0
+	clear, err := p.MarshalBinary()
+	require.NoError(t, err)
+	writes := make(chan error, 1)
+	go func() {
+		c := newCrypter(roleClient, []byte("fooman"), client, false)
+		// eg a retry after a transient error, each write must send the same bytes
+		for i := 0; i < 2; i++ {
+			if _, err := c.write(p); err != nil {
+				writes <- err
+				return
+			}
+		}
+		writes <- nil
+	}()
+
+	c := newCrypter(roleServer, []byte("fooman"), server, false)
+	// the same request is read twice, without the sequence checks of a session
+	c.sequences = nil
+	first, err := c.read()
+	require.NoError(t, err)
+	second, err := c.read()
+	require.NoError(t, err)
+	require.NoError(t, <-writes)
+	assert.Equal(t, proxyTestPacket().Body, first.Body)
+	assert.Equal(t, first, second)
+
+	after, err := p.MarshalBinary()
+	require.NoError(t, err)
+	assert.Equal(t, clear, after, "the packet of the caller is unchanged")
+}
+
+func TestObfuscate(t *testing.T) {
+	encrypted := getEncryptedBytes()
+	var header Header
+	require.NoError(t, Unmarshal(encrypted[:12], &header))
+	packet := &Packet{Header: &header, Body: encrypted[12:]}
+
+	// the same call decrypts and encrypts
+	require.NoError(t, Obfuscate([]byte("fooman"), packet))
+	assert.Equal(t, getDecryptedBytes(), packet.Body)
+	require.NoError(t, Obfuscate([]byte("fooman"), packet))
+	assert.Equal(t, getEncryptedBytes()[12:], packet.Body)
+
+	header.Flags.Set(UnencryptedFlag)
+	require.NoError(t, Obfuscate([]byte("fooman"), packet))
+	assert.Equal(t, getEncryptedBytes()[12:], packet.Body)
+
+	assert.Error(t, Obfuscate([]byte("fooman"), &Packet{Body: []byte{0x01}}))
+	assert.Error(t, Obfuscate([]byte("fooman"), nil))
+
+	// a header length that disagrees with the body is an error, and the body is left as it was
+	for _, length := range []uint32{0, header.Length - 1, header.Length + 1} {
+		h := header
+		h.Flags = 0
+		h.Length = length
+		body := getEncryptedBytes()[12:]
+		assert.Error(t, Obfuscate([]byte("fooman"), &Packet{Header: &h, Body: body}), length)
+		assert.Equal(t, getEncryptedBytes()[12:], body, length)
+	}
+	h := header
+	h.Length = 4
+	assert.Error(t, Obfuscate([]byte("fooman"), &Packet{Header: &h}))
+	// a body that is really empty has nothing to obfuscate
+	h.Length = 0
+	assert.NoError(t, Obfuscate([]byte("fooman"), &Packet{Header: &h}))
+}
@@ -18,6 +18,22 @@ const ContextReqID ContextKey = "reqID"
 // ContextSessionID is used to store the context for a session in Request as a wrapped context
 const ContextSessionID ContextKey = "session-id"
 
-// ContextConnRemoteAddr is used to store the net.conn remoteAddr within a session.  This value would be present
-// in any sub contexts that share the underlying net.conn
+// ContextConnRemoteAddr is used to store the address of the device within a session, without its port.  For
+// proxied connections it is the source of the proxy header, not the address of the proxy.  This value would be
+// present in any sub contexts that share the underlying net.conn
 const ContextConnRemoteAddr ContextKey = "conn-remote-addr"
+
+// ContextDeviceGroup is the group of the device that sent a packet, see DeviceGroupPolicy
+const ContextDeviceGroup ContextKey = "device-group"
+
+// ContextEventTime is the wall time a packet was received at, from the clock set with SetClock, in
+// RFC3339 format with nanoseconds
+const ContextEventTime ContextKey = "event-time"
+
+// ContextReceiveOffset is the time a packet was received at in microseconds since the server
+// started, on the monotonic clock.  The wall clock has stepped between two packets if the
+// difference of their ContextEventTime does not match the difference of their offsets.
+const ContextReceiveOffset ContextKey = "receive-offset-us"
+
+// contextReceived is the time.Time a packet was received at, with its monotonic reading, see Latency
+const contextReceived ContextKey = "received"
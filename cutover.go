@@ -0,0 +1,134 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// SecretRole is the part a secret plays while the devices of a group are moved to a new secret
+type SecretRole string
+
+const (
+	// SecretRoleCurrent is the secret SecretProvider.Get returns for the device
+	SecretRoleCurrent SecretRole = "current"
+	// SecretRoleNext is the secret devices are being moved to
+	SecretRoleNext SecretRole = "next"
+	// SecretRoleRetiring is the secret devices are being moved from
+	SecretRoleRetiring SecretRole = "retiring"
+)
+
+// ParseSecretRole returns the SecretRole named v, current, next or retiring
+func ParseSecretRole(v string) (SecretRole, error) {
+	switch r := SecretRole(v); r {
+	case SecretRoleCurrent, SecretRoleNext, SecretRoleRetiring:
+		return r, nil
+	}
+	return "", fmt.Errorf("unknown secret role [%v], expected current, next or retiring", v)
+}
+
+// RoleSecret is a secret of a device group and the part it plays in a cutover
+type RoleSecret struct {
+	Role   SecretRole
+	Secret []byte
+}
+
+// SecretCutoverProvider may be implemented by a SecretProvider to serve a device group with more
+// than one secret while its devices are moved to a new one.  CutoverSecrets returns the secrets of
+// the device at remote other than the one Get returns, which has SecretRoleCurrent.  The server
+// reads the first packet of each session with the secret from Get, then with these in order, and
+// answers every packet of the session with the secret that read it.  Devices on the old and new
+// secret may so share a group, and a connection, while they are moved.
+// tacquito_secret_role_sessions counts the sessions of each group by the role of their secret, so
+// it shows when no device uses the retiring secret anymore.  tacquito_secret_index_sessions counts
+// them by the index of their secret in the order tried, 0 for the current secret, which tells
+// apart secrets that share a role, and tacquito_crypter_secret_fallback counts the sessions of
+// every group read with any secret but the current one.
+type SecretCutoverProvider interface {
+	CutoverSecrets(ctx context.Context, remote net.Addr) ([]RoleSecret, error)
+}
+
+// secretCutover holds the secrets of a connection during a cutover, and the secret each of its
+// sessions is served with
+type secretCutover struct {
+	group string
+	// secrets are tried in order, the first is the one from SecretProvider.Get
+	secrets []RoleSecret
+	// affinity is the index in secrets of the secret of each session
+	affinity map[SessionID]int
+}
+
+// newSecretCutover returns the cutover of c, whose secret from Get is current, or nil if the
+// SecretProvider has no other secret for the device at remote
+func (s *Server) newSecretCutover(ctx context.Context, c *crypter, remote net.Addr, group string) *secretCutover {
+	p, ok := s.providerOf(c).(SecretCutoverProvider)
+	if !ok {
+		return nil
+	}
+	others, err := p.CutoverSecrets(ctx, remote)
+	if err != nil {
+		s.Errorf(ctx, "unable to get the cutover secrets of [%v], serving the current secret only; %v", remote, err)
+		return nil
+	}
+	cutover := &secretCutover{group: group, secrets: []RoleSecret{{Role: SecretRoleCurrent, Secret: c.secret}}, affinity: make(map[SessionID]int)}
+	for _, other := range others {
+		if len(other.Secret) == 0 || bytes.Equal(other.Secret, c.secret) {
+			continue
+		}
+		cutover.secrets = append(cutover.secrets, other)
+	}
+	if len(cutover.secrets) == 1 {
+		return nil
+	}
+	return cutover
+}
+
+// decrypt deobfuscates p with the secret of its session.  The first packet of a session is tried
+// with each secret in turn, and the session keeps the first that decodes it.  A packet no secret
+// decodes is left deobfuscated with the current secret, for bad secret detection to answer.
+func (sc *secretCutover) decrypt(c *crypter, p *Packet) error {
+	if i, ok := sc.affinity[p.Header.SessionID]; ok {
+		return obfuscate(sc.secrets[i].Secret, p, c.tally, c.pads)
+	}
+	obfuscated := append([]byte(nil), p.Body...)
+	for i, secret := range sc.secrets {
+		copy(p.Body, obfuscated)
+		// a secret is tried once for a session, so its pad is not cached
+		if err := obfuscate(secret.Secret, p, c.tally, nil); err != nil {
+			return err
+		}
+		if c.decodes(p) {
+			sc.affinity[p.Header.SessionID] = i
+			secretRoleSessions.WithLabelValues(sc.group, string(secret.Role)).Inc()
+			secretIndexSessions.WithLabelValues(sc.group, strconv.Itoa(i)).Inc()
+			if i > 0 {
+				crypterSecretFallback.Inc()
+			}
+			return nil
+		}
+	}
+	copy(p.Body, obfuscated)
+	return obfuscate(sc.secrets[0].Secret, p, c.tally, nil)
+}
+
+// secret returns the secret session is served with
+func (sc *secretCutover) secret(session SessionID) []byte {
+	return sc.secrets[sc.affinity[session]].Secret
+}
+
+// forget drops the secret of a session that completed
+func (sc *secretCutover) forget(session SessionID) {
+	if sc == nil {
+		return
+	}
+	delete(sc.affinity, session)
+}
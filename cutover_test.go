@@ -0,0 +1,163 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// cutoverProvider serves every device with the old secret as current and the new one as next
+type cutoverProvider struct {
+	handler Handler
+}
+
+func (p cutoverProvider) Get(ctx context.Context, remote net.Addr) ([]byte, Handler, error) {
+	return []byte("old-secret"), p.handler, nil
+}
+
+func (p cutoverProvider) CutoverSecrets(ctx context.Context, remote net.Addr) ([]RoleSecret, error) {
+	return []RoleSecret{
+		{Role: SecretRoleCurrent, Secret: []byte("old-secret")},
+		{Role: SecretRoleNext, Secret: []byte("new-secret")},
+	}, nil
+}
+
+// cutoverGroup names the device group of the handler of a cutoverProvider
+type cutoverGroup struct {
+	HandlerFunc
+}
+
+func (cutoverGroup) DeviceGroup() string {
+	return "cutover-test"
+}
+
+func TestParseSecretRole(t *testing.T) {
+	for _, role := range []SecretRole{SecretRoleCurrent, SecretRoleNext, SecretRoleRetiring} {
+		parsed, err := ParseSecretRole(string(role))
+		require.NoError(t, err)
+		assert.Equal(t, role, parsed)
+	}
+	_, err := ParseSecretRole("old")
+	assert.Error(t, err)
+}
+
+func TestSecretCutover(t *testing.T) {
+	roleSessions := func(role SecretRole) float64 {
+		return metricValue(secretRoleSessions.WithLabelValues("cutover-test", string(role)))
+	}
+	indexSessions := func(index string) float64 {
+		return metricValue(secretIndexSessions.WithLabelValues("cutover-test", index))
+	}
+	current, next := roleSessions(SecretRoleCurrent), roleSessions(SecretRoleNext)
+	first, second := indexSessions("0"), indexSessions("1")
+	fallback := metricValue(crypterSecretFallback)
+
+	// every session takes a continue, so the secret of the session must hold past its start
+	handler := cutoverGroup{HandlerFunc(func(response Response, request Request) {
+		response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusGetPass)))
+		response.Next(HandlerFunc(func(response Response, request Request) {
+			response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusPass)))
+		}))
+	})}
+	server := NewServer(nopLogger{}, cutoverProvider{handler: handler})
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Serve(ctx, listener.(*net.TCPListener))
+
+	// two devices of the group, one already moved to the new secret, log in at the same time
+	const sessions = 5
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*sessions)
+	for _, secret := range []string{"old-secret", "new-secret"} {
+		c, err := NewClient(SetClientDialer("tcp6", listener.Addr().String(), []byte(secret)))
+		require.NoError(t, err)
+		defer c.Close()
+		wg.Add(1)
+		go func(c *Client, secret string) {
+			defer wg.Done()
+			for i := 0; i < sessions; i++ {
+				id := c.NewSessionID()
+				start := featureTestStart(id, SingleConnect, MinorVersionOne, AuthenTypePAP)
+				resp, err := c.Send(start)
+				if err != nil {
+					errs <- fmt.Errorf("[%v] start; %w", secret, err)
+					return
+				}
+				var reply AuthenReply
+				if err := Unmarshal(resp.Body, &reply); err != nil || reply.Status != AuthenStatusGetPass {
+					errs <- fmt.Errorf("[%v] start replied [%v]; %v", secret, reply.Status, err)
+					return
+				}
+				resp, err = c.Send(NewPacket(
+					SetPacketHeader(NewHeader(SetHeaderVersion(start.Header.Version), SetHeaderType(Authenticate), SetHeaderSeqNo(3), SetHeaderFlag(SingleConnect), SetHeaderSessionID(id))),
+					SetPacketBodyUnsafe(NewAuthenContinue(SetAuthenContinueUserMessage("password"))),
+				))
+				if err != nil {
+					errs <- fmt.Errorf("[%v] continue; %w", secret, err)
+					return
+				}
+				if err := Unmarshal(resp.Body, &reply); err != nil || reply.Status != AuthenStatusPass {
+					errs <- fmt.Errorf("[%v] continue replied [%v]; %v", secret, reply.Status, err)
+					return
+				}
+			}
+		}(c, secret)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+	// each device was answered with its own secret, and its sessions are counted by role
+	assert.Equal(t, current+sessions, roleSessions(SecretRoleCurrent))
+	assert.Equal(t, next+sessions, roleSessions(SecretRoleNext))
+	// and by the index of the secret, the current secret first
+	assert.Equal(t, first+sessions, indexSessions("0"))
+	assert.Equal(t, second+sessions, indexSessions("1"))
+	// only the sessions of the device on the new secret fell back from the current one
+	assert.Equal(t, fallback+sessions, metricValue(crypterSecretFallback))
+}
+
+func TestSecretCutoverBadSecret(t *testing.T) {
+	c := newCrypter(roleServer, []byte("old-secret"), nil, false)
+	c.cutover = &secretCutover{group: "cutover-test", affinity: make(map[SessionID]int), secrets: []RoleSecret{
+		{Role: SecretRoleCurrent, Secret: []byte("old-secret")},
+		{Role: SecretRoleNext, Secret: []byte("new-secret")},
+	}}
+	p := featureTestStart(1, 0, MinorVersionOne, AuthenTypePAP)
+	require.NoError(t, crypt([]byte("other-secret"), p))
+	fallback := metricValue(crypterSecretFallback)
+	// no secret reads it, so it is left to bad secret detection with the current secret
+	require.NoError(t, c.decrypt(p))
+	assert.Equal(t, fallback, metricValue(crypterSecretFallback))
+	assert.False(t, c.decodes(p))
+	assert.Empty(t, c.cutover.affinity)
+	assert.Equal(t, []byte("old-secret"), c.secretOf(1))
+}
+
+func TestSecretCutoverForget(t *testing.T) {
+	cutover := &secretCutover{group: "cutover-test", affinity: map[SessionID]int{1: 1, 2: 1}}
+	sp := newSessionProvider(false)
+	sp.cutover = cutover
+	sp.set(Header{SessionID: 2, SeqNo: 1, Type: Authenticate}, nil)
+	// a refused session never started, a known one is kept until it is deleted
+	sp.refuse(1)
+	sp.refuse(2)
+	assert.Equal(t, map[SessionID]int{2: 1}, cutover.affinity)
+	sp.complete(2)
+	assert.Empty(t, cutover.affinity)
+}
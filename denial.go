@@ -0,0 +1,181 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// DenialCause is why a request was denied.  Handlers reply with a Denial naming the cause and
+// the server renders the message a device is shown using the MessageProfile of that device.
+type DenialCause string
+
+const (
+	// DenialBadCredential is a wrong username or password
+	DenialBadCredential DenialCause = "bad-credential"
+	// DenialLockout is a user locked out after too many failures
+	DenialLockout DenialCause = "lockout"
+	// DenialTimeWindow is a request outside the hours a user may log in
+	DenialTimeWindow DenialCause = "time-window"
+	// DenialSourceConstraint is a request from a source the user may not log in from
+	DenialSourceConstraint DenialCause = "source-constraint"
+	// DenialRevoked is a user whose access was revoked
+	DenialRevoked DenialCause = "revoked"
+	// DenialPolicy is a request denied by an authorization rule
+	DenialPolicy DenialCause = "policy"
+	// DenialMaintenance is a request refused during maintenance
+	DenialMaintenance DenialCause = "maintenance"
+	// DenialService is a request for an authen_service the device may not use
+	DenialService DenialCause = "service"
+	// DenialMethod is a start with an authen action and authen_type the device may not use
+	DenialMethod DenialCause = "method"
+)
+
+// denialCatalog holds the default message of every cause
+var denialCatalog = map[DenialCause]string{
+	DenialBadCredential:    "login failure",
+	DenialLockout:          "account locked, try again later",
+	DenialTimeWindow:       "access is not permitted at this time",
+	DenialSourceConstraint: "access is not permitted from this source",
+	DenialRevoked:          "access has been revoked",
+	DenialPolicy:           "denied by policy",
+	DenialMaintenance:      "service is under maintenance, try again later",
+	DenialService:          "this service is not permitted on this device",
+	DenialMethod:           "this authentication method is not permitted on this device",
+}
+
+// denialUnknown is the message of a cause missing from the catalog
+const denialUnknown = "access denied"
+
+// MessageProfile describes how a family of devices displays server messages
+type MessageProfile struct {
+	// MaxLength is the longest message in bytes a device shows in full.  Zero is unlimited.
+	MaxLength int
+	// SingleLine is set for devices that show nothing past the first line
+	SingleLine bool
+	// Messages override the catalog message of a cause
+	Messages map[DenialCause]string
+}
+
+var (
+	// ProfileIOS truncates messages at around 130 characters
+	ProfileIOS = MessageProfile{MaxLength: 128}
+	// ProfileNXOS shows a single line
+	ProfileNXOS = MessageProfile{MaxLength: 240, SingleLine: true}
+	// ProfileJunOS shows a single line
+	ProfileJunOS = MessageProfile{MaxLength: 255, SingleLine: true}
+	// DefaultMessageProfile fits every shipped profile.  It is used for devices without one.
+	DefaultMessageProfile = MessageProfile{MaxLength: 128, SingleLine: true}
+)
+
+// MessageProfileByName returns the shipped profile named ios, nxos, junos or default
+func MessageProfileByName(name string) (MessageProfile, bool) {
+	switch strings.ToLower(name) {
+	case "ios":
+		return ProfileIOS, true
+	case "nxos", "nx-os":
+		return ProfileNXOS, true
+	case "junos":
+		return ProfileJunOS, true
+	case "default":
+		return DefaultMessageProfile, true
+	}
+	return MessageProfile{}, false
+}
+
+// MessageProfilePolicy may be implemented by the Handler returned from a SecretProvider to set the
+// MessageProfile of the device group that provider matches.  DefaultMessageProfile is used
+// otherwise.
+type MessageProfilePolicy interface {
+	MessageProfile() MessageProfile
+}
+
+// Render returns the message for cause, followed by detail if set, shortened to fit p
+func (p MessageProfile) Render(cause DenialCause, detail string) string {
+	msg, ok := p.Messages[cause]
+	if !ok {
+		if msg, ok = denialCatalog[cause]; !ok {
+			msg = denialUnknown
+		}
+	}
+	if detail != "" {
+		msg += "; " + detail
+	}
+	if p.SingleLine {
+		if i := strings.IndexAny(msg, "\r\n"); i >= 0 {
+			msg = msg[:i]
+		}
+	}
+	if p.MaxLength > 0 && len(msg) > p.MaxLength {
+		msg = truncate(msg, p.MaxLength)
+	}
+	return msg
+}
+
+// truncate shortens msg to at most n bytes without splitting a rune, marking the cut with ...
+func truncate(msg string, n int) string {
+	const ellipsis = "..."
+	cut := n
+	if n > len(ellipsis) {
+		cut -= len(ellipsis)
+	}
+	for cut > 0 && !utf8.RuneStart(msg[cut]) {
+		cut--
+	}
+	if n > len(ellipsis) {
+		return msg[:cut] + ellipsis
+	}
+	return msg[:cut]
+}
+
+// NewDenial returns a Denial of a packet of type t for cause.  detail is optional and is shown
+// after the catalog message where the device has room for it.
+func NewDenial(t HeaderType, cause DenialCause, detail string) *Denial {
+	return &Denial{Type: t, Cause: cause, Detail: detail}
+}
+
+// Denial is a reply body that denies a request for a cause.  The server replies with the fail
+// reply of its packet type, or error for accounting which has no fail status, carrying a message
+// rendered by the MessageProfile of the device.
+type Denial struct {
+	Type   HeaderType
+	Cause  DenialCause
+	Detail string
+}
+
+// Reply returns the reply body d is sent as to a device with profile p
+func (d *Denial) Reply(p MessageProfile) EncoderDecoder {
+	msg := p.Render(d.Cause, d.Detail)
+	switch d.Type {
+	case Authorize:
+		return NewAuthorReply(SetAuthorReplyStatus(AuthorStatusFail), SetAuthorReplyServerMsg(msg))
+	case Accounting:
+		return NewAcctReply(SetAcctReplyStatus(AcctReplyStatusError), SetAcctReplyServerMsg(msg))
+	}
+	return NewAuthenReply(SetAuthenReplyStatus(AuthenStatusFail), SetAuthenReplyServerMsg(msg))
+}
+
+// MarshalBinary marshals the reply for DefaultMessageProfile.  Responses from the server render
+// d for the profile of the device instead.
+func (d *Denial) MarshalBinary() ([]byte, error) {
+	return d.Reply(DefaultMessageProfile).MarshalBinary()
+}
+
+// UnmarshalBinary is not supported, a Denial is only ever sent
+func (d *Denial) UnmarshalBinary(data []byte) error {
+	return fmt.Errorf("a denial cannot be unmarshaled, unmarshal the reply of its packet type")
+}
+
+// Fields returns the fields of the reply with the cause of the denial
+func (d *Denial) Fields() map[string]string {
+	fields := d.Reply(DefaultMessageProfile).Fields()
+	fields["denial-cause"] = string(d.Cause)
+	return fields
+}
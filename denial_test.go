@@ -0,0 +1,132 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDenialCatalogFitsProfiles(t *testing.T) {
+	for _, name := range []string{"ios", "nxos", "junos", "default"} {
+		p, ok := MessageProfileByName(name)
+		assert.True(t, ok, name)
+		for cause, msg := range denialCatalog {
+			assert.Equal(t, msg, p.Render(cause, ""), "%v does not fit %v", cause, name)
+			assert.LessOrEqual(t, len(msg), p.MaxLength, "%v does not fit %v", cause, name)
+			assert.NotContains(t, msg, "\n", cause)
+		}
+	}
+}
+
+func TestMessageProfileRender(t *testing.T) {
+	long := strings.Repeat("é", 100)
+	tests := []struct {
+		name    string
+		profile MessageProfile
+		cause   DenialCause
+		detail  string
+		want    string
+	}{
+		{name: "catalog", profile: ProfileIOS, cause: DenialPolicy, want: "denied by policy"},
+		{name: "detail", profile: ProfileIOS, cause: DenialPolicy, detail: "cmd reload", want: "denied by policy; cmd reload"},
+		{name: "unknown cause", profile: ProfileIOS, cause: "bogus", want: "access denied"},
+		{name: "single line", profile: ProfileJunOS, cause: DenialMaintenance, detail: "back at 10:00\\ncall noc", want: "service is under maintenance, try again later; back at 10:00\\ncall noc"},
+		{name: "newline cut", profile: ProfileJunOS, cause: DenialMaintenance, detail: "back at 10:00\ncall noc", want: "service is under maintenance, try again later; back at 10:00"},
+		{name: "newline kept", profile: ProfileIOS, cause: DenialMaintenance, detail: "back at 10:00\ncall noc", want: "service is under maintenance, try again later; back at 10:00\ncall noc"},
+		{name: "override", profile: MessageProfile{Messages: map[DenialCause]string{DenialLockout: "locked, call the noc"}}, cause: DenialLockout, want: "locked, call the noc"},
+		{name: "truncated", profile: MessageProfile{MaxLength: 20}, cause: DenialSourceConstraint, want: "access is not per..."},
+		{name: "truncated rune safe", profile: MessageProfile{MaxLength: 22}, cause: DenialPolicy, detail: long, want: "denied by policy; ..."},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := test.profile.Render(test.cause, test.detail)
+			assert.Equal(t, test.want, got)
+			assert.True(t, utf8.ValidString(got))
+		})
+	}
+}
+
+func TestDenialReply(t *testing.T) {
+	var authen AuthenReply
+	b, err := NewDenial(Authenticate, DenialBadCredential, "").MarshalBinary()
+	assert.NoError(t, err)
+	assert.NoError(t, Unmarshal(b, &authen))
+	assert.Equal(t, AuthenStatusFail, authen.Status)
+	assert.Equal(t, AuthenServerMsg("login failure"), authen.ServerMsg)
+
+	var author AuthorReply
+	b, err = NewDenial(Authorize, DenialPolicy, "").MarshalBinary()
+	assert.NoError(t, err)
+	assert.NoError(t, Unmarshal(b, &author))
+	assert.Equal(t, AuthorStatusFail, author.Status)
+
+	// accounting has no fail status
+	var acct AcctReply
+	b, err = NewDenial(Accounting, DenialSourceConstraint, "").MarshalBinary()
+	assert.NoError(t, err)
+	assert.NoError(t, Unmarshal(b, &acct))
+	assert.Equal(t, AcctReplyStatusError, acct.Status)
+
+	assert.Equal(t, "policy", NewDenial(Authorize, DenialPolicy, "").Fields()["denial-cause"])
+}
+
+// profileHandler denies every request and sets a message profile
+type profileHandler struct {
+	profile MessageProfile
+}
+
+func (h profileHandler) Handle(response Response, request Request) {
+	response.Reply(NewDenial(request.Header.Type, DenialMaintenance, "back at 10:00\ncall noc"))
+}
+
+func (h profileHandler) MessageProfile() MessageProfile {
+	return h.profile
+}
+
+func TestServerRendersDenialForProfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler Handler
+		want    string
+	}{
+		{
+			name:    "default profile",
+			handler: HandlerFunc(profileHandler{}.Handle),
+			want:    "service is under maintenance, try again later; back at 10:00",
+		},
+		{
+			name:    "device profile",
+			handler: profileHandler{profile: MessageProfile{MaxLength: 32}},
+			want:    "service is under maintenance,...",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewServer(nopLogger{}, nil)
+			client, server := net.Pipe()
+			defer client.Close()
+			go s.handle(context.Background(), newCrypter(roleServer, []byte("fooman"), server, false), test.handler)
+
+			c := newCrypter(roleClient, []byte("fooman"), client, false)
+			_, err := c.write(outcomeTestRequest(Authenticate))
+			assert.NoError(t, err)
+			resp, err := c.read()
+			assert.NoError(t, err)
+			var body AuthenReply
+			assert.NoError(t, Unmarshal(resp.Body, &body))
+			assert.Equal(t, AuthenStatusFail, body.Status)
+			assert.Equal(t, AuthenServerMsg(test.want), body.ServerMsg)
+		})
+	}
+}
@@ -0,0 +1,38 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestDependencies checks that the package, which programs that only embed the codec and client
+// import, depends on the standard library and its own stdlib only packages.  Metrics, eg
+// prommetrics, live in packages of their own.
+func TestDependencies(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs go list")
+	}
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go is not on the path")
+	}
+	out, err := exec.Command(gobin, "list", "-deps",
+		"-f", "{{if not .Standard}}{{.ImportPath}}{{end}}", ".").CombinedOutput()
+	require.NoError(t, err, string(out))
+	assert.ElementsMatch(t, []string{
+		"github.com/facebookincubator/tacquito",
+		"github.com/facebookincubator/tacquito/internal/testhooks",
+		"github.com/facebookincubator/tacquito/proxy",
+	}, strings.Fields(string(out)))
+}
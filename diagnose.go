@@ -0,0 +1,429 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/facebookincubator/tacquito/proxy"
+)
+
+// DiagnosticStage is a stage of the exercise Diagnostics runs against a server
+type DiagnosticStage string
+
+const (
+	// DiagnosticStageConnect dials the server
+	DiagnosticStageConnect DiagnosticStage = "connect"
+	// DiagnosticStageProxy sends the proxy header, it only runs with SetDiagnosticProxy
+	DiagnosticStageProxy DiagnosticStage = "proxy"
+	// DiagnosticStageAuthenticate logs in with PAP
+	DiagnosticStageAuthenticate DiagnosticStage = "authenticate"
+	// DiagnosticStageAuthorizeExec authorizes the service, as a device does for an exec session
+	DiagnosticStageAuthorizeExec DiagnosticStage = "authorize-exec"
+	// DiagnosticStageAuthorizeCommand authorizes a command of the service
+	DiagnosticStageAuthorizeCommand DiagnosticStage = "authorize-command"
+	// DiagnosticStageAccountingStart sends the START record of the command
+	DiagnosticStageAccountingStart DiagnosticStage = "accounting-start"
+	// DiagnosticStageAccountingStop sends the STOP record of the command
+	DiagnosticStageAccountingStop DiagnosticStage = "accounting-stop"
+)
+
+// diagnosticBaselines are the packet types whose live session durations each stage is compared with
+var diagnosticBaselines = map[DiagnosticStage]HeaderType{
+	DiagnosticStageAuthenticate:     Authenticate,
+	DiagnosticStageAuthorizeExec:    Authorize,
+	DiagnosticStageAuthorizeCommand: Authorize,
+	DiagnosticStageAccountingStart:  Accounting,
+	DiagnosticStageAccountingStop:   Accounting,
+}
+
+// DiagnosticOption is a setter type for Diagnostics
+type DiagnosticOption func(d *Diagnostics)
+
+// SetDiagnosticInterval sets how long after the start of a run the next one may start.  The
+// default is a minute.
+func SetDiagnosticInterval(v time.Duration) DiagnosticOption {
+	return func(d *Diagnostics) {
+		d.interval = v
+	}
+}
+
+// SetDiagnosticTimeout sets how long a whole run may take, stages that do not complete in time
+// fail.  The default is 10 seconds.
+func SetDiagnosticTimeout(v time.Duration) DiagnosticOption {
+	return func(d *Diagnostics) {
+		d.timeout = v
+	}
+}
+
+// SetDiagnosticProxy sends a proxy header naming source as the device before the first packet,
+// for servers with SetUseProxy.  source must be a probe source of the synthetic user.
+func SetDiagnosticProxy(source string) DiagnosticOption {
+	return func(d *Diagnostics) {
+		d.proxy = source
+	}
+}
+
+// SetDiagnosticCommand sets the service and command that are authorized and accounted.  The
+// default is the shell service and the show command; a synthetic user is only authorized for the
+// probe service.
+func SetDiagnosticCommand(service, cmd string) DiagnosticOption {
+	return func(d *Diagnostics) {
+		d.service, d.cmd = service, cmd
+	}
+}
+
+// SetDiagnosticClock sets the wall clock runs are stamped and rate limited with.  The default is
+// time.Now.
+func SetDiagnosticClock(fn func() time.Time) DiagnosticOption {
+	return func(d *Diagnostics) {
+		d.clock = fn
+	}
+}
+
+// NewDiagnostics returns Diagnostics that exercise the server on address with user and password,
+// using secret.  user should be a synthetic user, so the exercise can neither change anything nor
+// be used from anywhere but a probe source.
+func NewDiagnostics(network, address string, secret []byte, user, password string, opts ...DiagnosticOption) *Diagnostics {
+	d := &Diagnostics{
+		network:  network,
+		address:  address,
+		secret:   secret,
+		user:     user,
+		password: password,
+		service:  "shell",
+		cmd:      "show",
+		interval: time.Minute,
+		timeout:  10 * time.Second,
+		clock:    time.Now,
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// Diagnostics runs a full synthetic exercise against a live server, for when it is reported as
+// slow: it connects, authenticates, authorizes an exec session and a command, and accounts for
+// the command, timing each stage.  Stages are timed from the client, so they include the calls
+// the handlers of the server make to their backends.  Each stage is compared with the rolling p50
+// and p99 of the sessions of its packet type the server completed in the last ten minutes, so a
+// stage that deviates stands out.  Those are only known for a server in the same process.
+//
+// Runs are safe to repeat in production, they are limited to one at a time and one per interval.
+type Diagnostics struct {
+	network  string
+	address  string
+	secret   []byte
+	user     string
+	password string
+	proxy    string
+	service  string
+	cmd      string
+	interval time.Duration
+	timeout  time.Duration
+	clock    func() time.Time
+
+	mu      sync.Mutex
+	running bool
+	last    time.Time
+}
+
+// DiagnosticLimitError is returned by Run while another run is in progress, or too soon after the
+// last one started
+type DiagnosticLimitError struct {
+	// RetryAfter is how long until a run may start, zero while another is in progress
+	RetryAfter time.Duration
+}
+
+func (e *DiagnosticLimitError) Error() string {
+	if e.RetryAfter == 0 {
+		return "a diagnostic run is in progress"
+	}
+	return fmt.Sprintf("diagnostics are rate limited, retry after %v", e.RetryAfter)
+}
+
+// DiagnosticReport is the outcome of a run.  Scripts read it as json, so fields are only ever
+// added and never renamed.
+type DiagnosticReport struct {
+	Started      time.Time               `json:"started"`
+	Milliseconds float64                 `json:"milliseconds"`
+	Stages       []DiagnosticStageReport `json:"stages"`
+	// Failed is the stage the run stopped at, empty if every stage passed
+	Failed DiagnosticStage `json:"failed,omitempty"`
+}
+
+// DiagnosticStageReport is the timing of a stage
+type DiagnosticStageReport struct {
+	Stage        DiagnosticStage `json:"stage"`
+	Milliseconds float64         `json:"milliseconds"`
+	Passed       bool            `json:"passed"`
+	// Result is the status the server replied with, or why the stage failed
+	Result string `json:"result"`
+	// Baseline is null for stages without live durations to compare with
+	Baseline *DiagnosticBaseline `json:"baseline"`
+}
+
+// DiagnosticBaseline compares a stage with the live durations of sessions of its packet type
+type DiagnosticBaseline struct {
+	Type string  `json:"type"`
+	P50  float64 `json:"p50_milliseconds"`
+	P99  float64 `json:"p99_milliseconds"`
+	// Deviation is slow if the stage took longer than P99, elevated if longer than P50, else
+	// normal
+	Deviation string `json:"deviation"`
+}
+
+// deviation returns the Deviation of a stage that took ms
+func (b DiagnosticBaseline) deviation(ms float64) string {
+	switch {
+	case ms > b.P99:
+		return "slow"
+	case ms > b.P50:
+		return "elevated"
+	}
+	return "normal"
+}
+
+// Run runs the exercise, stopping at the first stage that fails.  A failed stage is not an error,
+// it is in the report; the error is a *DiagnosticLimitError if the run may not start yet.
+func (d *Diagnostics) Run(ctx context.Context) (DiagnosticReport, error) {
+	now, err := d.acquire()
+	if err != nil {
+		return DiagnosticReport{}, err
+	}
+	defer d.release()
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	// baselines are read first, the sessions of the run are observed like any other
+	baselines := make(map[HeaderType]DiagnosticBaseline)
+	for _, t := range diagnosticBaselines {
+		if p50, p99, ok := sessionQuantiles(t); ok {
+			baselines[t] = DiagnosticBaseline{Type: t.String(), P50: p50, P99: p99}
+		}
+	}
+
+	run := &diagnosticRun{d: d}
+	defer run.close()
+	stages := []struct {
+		stage DiagnosticStage
+		fn    func(ctx context.Context) (string, error)
+	}{
+		{DiagnosticStageConnect, run.connect},
+		{DiagnosticStageProxy, run.sendProxyHeader},
+		{DiagnosticStageAuthenticate, run.authenticate},
+		{DiagnosticStageAuthorizeExec, run.authorizeExec},
+		{DiagnosticStageAuthorizeCommand, run.authorizeCommand},
+		{DiagnosticStageAccountingStart, run.accountingStart},
+		{DiagnosticStageAccountingStop, run.accountingStop},
+	}
+	report := DiagnosticReport{Started: now, Stages: []DiagnosticStageReport{}}
+	started := time.Now()
+	for _, s := range stages {
+		if s.stage == DiagnosticStageProxy && d.proxy == "" {
+			continue
+		}
+		stageStarted := time.Now()
+		result, err := s.fn(ctx)
+		sr := DiagnosticStageReport{Stage: s.stage, Milliseconds: milliseconds(time.Since(stageStarted)), Passed: err == nil, Result: result}
+		if err != nil {
+			sr.Result = err.Error()
+		}
+		if t, ok := diagnosticBaselines[s.stage]; ok {
+			if b, ok := baselines[t]; ok {
+				b.Deviation = b.deviation(sr.Milliseconds)
+				sr.Baseline = &b
+			}
+		}
+		report.Stages = append(report.Stages, sr)
+		if err != nil {
+			report.Failed = s.stage
+			break
+		}
+	}
+	report.Milliseconds = milliseconds(time.Since(started))
+	return report, nil
+}
+
+// acquire claims the run and returns when it starts, or returns why it may not start
+func (d *Diagnostics) acquire() (time.Time, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.running {
+		return time.Time{}, &DiagnosticLimitError{}
+	}
+	now := d.clock()
+	if !d.last.IsZero() {
+		if wait := d.last.Add(d.interval).Sub(now); wait > 0 {
+			return time.Time{}, &DiagnosticLimitError{RetryAfter: wait}
+		}
+	}
+	d.running, d.last = true, now
+	return now, nil
+}
+
+// release ends the claim of acquire
+func (d *Diagnostics) release() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.running = false
+}
+
+// milliseconds returns d in fractional milliseconds
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// diagnosticRun is the state of a run, each stage builds on the ones before it
+type diagnosticRun struct {
+	d      *Diagnostics
+	conn   net.Conn
+	client *Client
+	task   *Task
+}
+
+// close closes the connection of the run, if any
+func (r *diagnosticRun) close() {
+	if r.conn != nil {
+		r.conn.Close()
+	}
+}
+
+func (r *diagnosticRun) connect(ctx context.Context) (string, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, r.d.network, r.d.address)
+	if err != nil {
+		return "", err
+	}
+	r.conn = conn
+	// the remaining stages share the deadline of the run
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	r.client = &Client{crypter: newCrypter(roleClient, r.d.secret, conn, false)}
+	return conn.LocalAddr().String(), nil
+}
+
+func (r *diagnosticRun) sendProxyHeader(ctx context.Context) (string, error) {
+	source := net.ParseIP(r.d.proxy)
+	if source == nil {
+		return "", fmt.Errorf("bad proxy source [%v]", r.d.proxy)
+	}
+	local, _ := r.conn.LocalAddr().(*net.TCPAddr)
+	if local == nil {
+		return "", fmt.Errorf("proxy headers need a tcp connection")
+	}
+	b := make([]byte, proxy.MaxProxyHeader)
+	n, err := proxy.NewHeader(&net.TCPAddr{IP: source, Port: local.Port}, r.conn.RemoteAddr()).Read(b)
+	if err != nil {
+		return "", err
+	}
+	if _, err := r.conn.Write(b[:n]); err != nil {
+		return "", err
+	}
+	return source.String(), nil
+}
+
+// send sends body as the first packet of a new session of type t and returns the reply
+func (r *diagnosticRun) send(ctx context.Context, t HeaderType, minor uint8, body EncoderDecoder) (*Packet, error) {
+	b, err := body.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	p := NewPacket(
+		SetPacketHeader(NewHeader(
+			SetHeaderVersion(Version{MajorVersion: MajorVersion, MinorVersion: minor}),
+			SetHeaderType(t),
+			SetHeaderSeqNo(1),
+			SetHeaderFlag(SingleConnect),
+			SetHeaderSessionID(r.client.NewSessionID()),
+		)),
+		SetPacketBody(b),
+	)
+	return r.client.SendContext(ctx, p)
+}
+
+func (r *diagnosticRun) authenticate(ctx context.Context) (string, error) {
+	resp, err := r.send(ctx, Authenticate, MinorVersionOne, NewAuthenStart(
+		SetAuthenStartAction(AuthenActionLogin),
+		SetAuthenStartPrivLvl(PrivLvlUser),
+		SetAuthenStartType(AuthenTypePAP),
+		SetAuthenStartService(AuthenServiceLogin),
+		SetAuthenStartUser(AuthenUser(r.d.user)),
+		SetAuthenStartPort(diagnosticPort),
+		SetAuthenStartData(AuthenData(r.d.password)),
+	))
+	if err != nil {
+		return "", err
+	}
+	var reply AuthenReply
+	if err := Unmarshal(resp.Body, &reply); err != nil {
+		return "", err
+	}
+	if reply.Status != AuthenStatusPass {
+		return "", fmt.Errorf("authentication status [%v]", reply.Status)
+	}
+	return reply.Status.String(), nil
+}
+
+func (r *diagnosticRun) authorizeExec(ctx context.Context) (string, error) {
+	return r.authorize(ctx, Args{Arg("service=" + r.d.service)})
+}
+
+func (r *diagnosticRun) authorizeCommand(ctx context.Context) (string, error) {
+	return r.authorize(ctx, Args{Arg("service=" + r.d.service), Arg("cmd=" + r.d.cmd)})
+}
+
+// authorize authorizes args for the user of the run
+func (r *diagnosticRun) authorize(ctx context.Context, args Args) (string, error) {
+	resp, err := r.send(ctx, Authorize, MinorVersionDefault, NewAuthorRequest(
+		SetAuthorRequestMethod(AuthenMethodTacacsPlus),
+		SetAuthorRequestPrivLvl(PrivLvlUser),
+		SetAuthorRequestType(AuthenTypePAP),
+		SetAuthorRequestService(AuthenServiceLogin),
+		SetAuthorRequestUser(AuthenUser(r.d.user)),
+		SetAuthorRequestPort(diagnosticPort),
+		SetAuthorRequestArgs(args),
+	))
+	if err != nil {
+		return "", err
+	}
+	var reply AuthorReply
+	if err := Unmarshal(resp.Body, &reply); err != nil {
+		return "", err
+	}
+	if reply.Status != AuthorStatusPassAdd && reply.Status != AuthorStatusPassRepl {
+		return "", fmt.Errorf("authorization status [%v]", reply.Status)
+	}
+	return reply.Status.String(), nil
+}
+
+func (r *diagnosticRun) accountingStart(ctx context.Context) (string, error) {
+	// records are sent once, a refused record fails the stage rather than delaying the run
+	t, err := r.client.StartTask(ctx, r.d.user, string(diagnosticPort), Args{Arg("service=" + r.d.service), Arg("cmd=" + r.d.cmd)}, SetTaskRetries(0, 0))
+	if err != nil {
+		return "", err
+	}
+	r.task = t
+	return t.ID(), nil
+}
+
+func (r *diagnosticRun) accountingStop(ctx context.Context) (string, error) {
+	if err := r.task.Stop(ctx, nil); err != nil {
+		return "", err
+	}
+	return r.task.ID(), nil
+}
+
+// diagnosticPort is the port diagnostic requests are made on
+const diagnosticPort AuthenPort = "diagnostic"
@@ -0,0 +1,251 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// diagnosticTestHandler passes the password probe and every request, except the authorization of
+// the reload command.  Authentications wait for block, if set.
+func diagnosticTestHandler(block chan struct{}) Handler {
+	return HandlerFunc(func(response Response, request Request) {
+		switch request.Header.Type {
+		case Authenticate:
+			if block != nil {
+				<-block
+			}
+			var body AuthenStart
+			if err := Unmarshal(request.Body, &body); err != nil || string(body.Data) != "probe" {
+				response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusFail)))
+				return
+			}
+			response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusPass)))
+		case Authorize:
+			var body AuthorRequest
+			if err := Unmarshal(request.Body, &body); err != nil || body.Args.Command() == "reload" {
+				response.Reply(NewAuthorReply(SetAuthorReplyStatus(AuthorStatusFail)))
+				return
+			}
+			response.Reply(NewAuthorReply(SetAuthorReplyStatus(AuthorStatusPassAdd)))
+		case Accounting:
+			response.Reply(NewAcctReply(SetAcctReplyStatus(AcctReplyStatusSuccess)))
+		}
+	})
+}
+
+// startDiagnosticTestServer serves h to the device source, or to any device if source is empty,
+// and returns its address
+func startDiagnosticTestServer(t *testing.T, h Handler, source string, opts ...Option) string {
+	s := NewServer(nopLogger{}, secretProviderFunc(func(ctx context.Context, remote net.Addr) ([]byte, Handler, error) {
+		if source != "" && remote.(*net.TCPAddr).IP.String() != source {
+			return nil, nil, errors.New("unknown device")
+		}
+		return []byte("fooman"), h, nil
+	}), opts...)
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go s.Serve(ctx, listener.(*net.TCPListener))
+	return listener.Addr().String()
+}
+
+// diagnosticStages returns the stages of report and whether each passed
+func diagnosticStages(report DiagnosticReport) map[DiagnosticStage]bool {
+	stages := make(map[DiagnosticStage]bool)
+	for _, s := range report.Stages {
+		stages[s.Stage] = s.Passed
+	}
+	return stages
+}
+
+func TestDiagnosticsReport(t *testing.T) {
+	addr := startDiagnosticTestServer(t, diagnosticTestHandler(nil), "")
+	now := time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)
+	d := NewDiagnostics("tcp6", addr, []byte("fooman"), "synthetic", "probe", SetDiagnosticClock(func() time.Time { return now }))
+
+	report, err := d.Run(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, now, report.Started)
+	assert.Empty(t, report.Failed)
+	var stages []DiagnosticStage
+	for _, s := range report.Stages {
+		stages = append(stages, s.Stage)
+		assert.True(t, s.Passed, "%v: %v", s.Stage, s.Result)
+		assert.NotEmpty(t, s.Result, s.Stage)
+		assert.LessOrEqual(t, s.Milliseconds, report.Milliseconds, s.Stage)
+	}
+	// the proxy stage only runs for a proxy
+	assert.Equal(t, []DiagnosticStage{
+		DiagnosticStageConnect,
+		DiagnosticStageAuthenticate,
+		DiagnosticStageAuthorizeExec,
+		DiagnosticStageAuthorizeCommand,
+		DiagnosticStageAccountingStart,
+		DiagnosticStageAccountingStop,
+	}, stages)
+
+	// the sessions of the first run are now in the live durations the second is compared with
+	now = now.Add(time.Minute)
+	report, err = d.Run(context.Background())
+	require.NoError(t, err)
+	for _, s := range report.Stages {
+		if s.Stage == DiagnosticStageConnect {
+			assert.Nil(t, s.Baseline, "connect has no live durations")
+			continue
+		}
+		if assert.NotNil(t, s.Baseline, s.Stage) {
+			assert.Equal(t, diagnosticBaselines[s.Stage].String(), s.Baseline.Type)
+			assert.LessOrEqual(t, s.Baseline.P50, s.Baseline.P99)
+			assert.Contains(t, []string{"normal", "elevated", "slow"}, s.Baseline.Deviation)
+		}
+	}
+}
+
+func TestDiagnosticsFailedStage(t *testing.T) {
+	addr := startDiagnosticTestServer(t, diagnosticTestHandler(nil), "")
+	tests := []struct {
+		name   string
+		d      *Diagnostics
+		failed DiagnosticStage
+	}{
+		{
+			name:   "wrong password",
+			d:      NewDiagnostics("tcp6", addr, []byte("fooman"), "synthetic", "wrong"),
+			failed: DiagnosticStageAuthenticate,
+		},
+		{
+			name:   "command denied",
+			d:      NewDiagnostics("tcp6", addr, []byte("fooman"), "synthetic", "probe", SetDiagnosticCommand("shell", "reload")),
+			failed: DiagnosticStageAuthorizeCommand,
+		},
+		{
+			name:   "no server",
+			d:      NewDiagnostics("tcp6", "[::1]:1", []byte("fooman"), "synthetic", "probe"),
+			failed: DiagnosticStageConnect,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			report, err := test.d.Run(context.Background())
+			require.NoError(t, err, "a failed stage is in the report")
+			assert.Equal(t, test.failed, report.Failed)
+			last := report.Stages[len(report.Stages)-1]
+			assert.Equal(t, test.failed, last.Stage, "no stage runs after the failed one")
+			assert.False(t, last.Passed)
+			assert.NotEmpty(t, last.Result)
+		})
+	}
+}
+
+func TestDiagnosticsProxy(t *testing.T) {
+	// the server only knows the device named by the proxy header, not the proxy itself
+	addr := startDiagnosticTestServer(t, diagnosticTestHandler(nil), "192.0.2.10", SetUseProxy(true))
+	report, err := NewDiagnostics("tcp6", addr, []byte("fooman"), "synthetic", "probe", SetDiagnosticProxy("192.0.2.10")).Run(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, report.Failed, report.Stages)
+	stages := diagnosticStages(report)
+	assert.True(t, stages[DiagnosticStageProxy])
+}
+
+func TestDiagnosticsTimeout(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	addr := startDiagnosticTestServer(t, diagnosticTestHandler(block), "")
+	d := NewDiagnostics("tcp6", addr, []byte("fooman"), "synthetic", "probe", SetDiagnosticTimeout(100*time.Millisecond))
+	started := time.Now()
+	report, err := d.Run(context.Background())
+	require.NoError(t, err)
+	assert.Less(t, time.Since(started), 5*time.Second)
+	assert.Equal(t, DiagnosticStageAuthenticate, report.Failed)
+}
+
+func TestDiagnosticsRateLimit(t *testing.T) {
+	block := make(chan struct{})
+	addr := startDiagnosticTestServer(t, diagnosticTestHandler(block), "")
+	now := time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)
+	d := NewDiagnostics("tcp6", addr, []byte("fooman"), "synthetic", "probe",
+		SetDiagnosticInterval(time.Minute),
+		SetDiagnosticClock(func() time.Time { return now }),
+	)
+
+	done := make(chan DiagnosticReport)
+	go func() {
+		report, err := d.Run(context.Background())
+		assert.NoError(t, err)
+		done <- report
+	}()
+	// the first run is held at authentication, another may not start meanwhile
+	require.Eventually(t, func() bool {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return d.running
+	}, 5*time.Second, 10*time.Millisecond)
+	_, err := d.Run(context.Background())
+	var le *DiagnosticLimitError
+	require.True(t, errors.As(err, &le), err)
+	assert.Zero(t, le.RetryAfter)
+
+	// even once the interval passed
+	now = now.Add(2 * time.Minute)
+	_, err = d.Run(context.Background())
+	require.True(t, errors.As(err, &le), err)
+	assert.Zero(t, le.RetryAfter)
+
+	close(block)
+	report := <-done
+	assert.Empty(t, report.Failed)
+
+	// the interval counts from the start of the last run
+	now = now.Add(-90 * time.Second)
+	_, err = d.Run(context.Background())
+	require.True(t, errors.As(err, &le), err)
+	assert.Equal(t, 30*time.Second, le.RetryAfter)
+
+	now = now.Add(30 * time.Second)
+	_, err = d.Run(context.Background())
+	assert.NoError(t, err)
+}
+
+func TestBucketQuantile(t *testing.T) {
+	bounds := []float64{1, 2, 4}
+	counts := []uint64{40, 50, 8, 2}
+	// the 50th observation is a fifth of the way through the 1-2 bucket
+	assert.InDelta(t, 1.2, bucketQuantile(0.5, bounds, counts), 0.0001)
+	assert.InDelta(t, 0.5, bucketQuantile(0.2, bounds, counts), 0.0001)
+	// the 99th is above the last bucket
+	assert.Equal(t, 4.0, bucketQuantile(0.99, bounds, counts))
+}
+
+func TestSessionQuantiles(t *testing.T) {
+	// the durations are kept by the package, whatever the metrics
+	d := newTypeDurations(Authorize)
+	saved := sessionTypes[Authorize]
+	sessionTypes[Authorize] = d
+	defer func() { sessionTypes[Authorize] = saved }()
+	_, _, ok := sessionQuantiles(Authorize)
+	assert.False(t, ok)
+	for i := 0; i < 100; i++ {
+		sessionTypeObserver(Authorize).Observe(3)
+	}
+	p50, p99, ok := sessionQuantiles(Authorize)
+	assert.True(t, ok)
+	// every duration is in the 2-4 bucket
+	assert.InDelta(t, 3, p50, 0.0001)
+	assert.InDelta(t, 3.98, p99, 0.0001)
+	_, _, ok = sessionQuantiles(HeaderType(9))
+	assert.False(t, ok)
+}
@@ -0,0 +1,32 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+// Package tacquito implements the TACACS+ protocol of rfc8907, for building servers and clients.
+//
+// # Cancellation
+//
+// Every call that can block on I/O or a lock for an unbounded time takes a context and returns
+// within a bounded time of it being done, usually with its error.  Calls that predate a context,
+// such as Client.Send and SetClientDialer, are kept as wrappers of their context taking variants
+// and use context.Background.  Handlers get theirs as Request.Context, and implementations of
+// the interfaces of this package, eg a ShutdownSink, Spool or backend Handler, are expected to
+// honor the context they are given in the same way.  PacketSink.Capture is the exception; it is
+// called inline on a connection and must not block at all.
+//
+// Server.Serve applies the same to the connections it serves: once its context is done, a read
+// blocked on a device is woken and the connection closed with CloseShutdown, rather than once its
+// idle timeout passes.  A context that interrupts a Client call does so through the connection
+// deadline, which is restored rather than cleared once the call returns.
+//
+// # Metrics
+//
+// The package depends on the standard library only, so its metrics are reported through the
+// Metrics interface and discard their values until SetMetrics is called.  Earlier releases
+// registered them with the default prometheus registry on their own; programs that relied on that
+// import github.com/facebookincubator/tacquito/prommetrics, which does it on import, or call
+// SetMetrics with a Metrics of their own.
+package tacquito
@@ -0,0 +1,82 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestUnknownEnums ensures values outside of the rfc are surfaced as they are, not coerced
+func TestUnknownEnums(t *testing.T) {
+	tests := []struct {
+		name  string
+		known bool
+		str   string
+		v     interface {
+			IsKnown() bool
+			String() string
+		}
+	}{
+		{name: "authen action", v: AuthenAction(0x2a), str: "UNKNOWN(0x2a)"},
+		{name: "authen type", v: AuthenType(0x2a), str: "UNKNOWN(0x2a)"},
+		{name: "authen service", v: AuthenService(0x2a), str: "UNKNOWN(0x2a)"},
+		{name: "authen status", v: AuthenStatus(0x2a), str: "UNKNOWN(0x2a)"},
+		{name: "authen method", v: AuthenMethod(0x2a), str: "UNKNOWN(0x2a)"},
+		{name: "author status", v: AuthorStatus(0x2a), str: "UNKNOWN(0x2a)"},
+		{name: "acct reply status", v: AcctReplyStatus(0x2a), str: "UNKNOWN(0x2a)"},
+		{name: "header type", v: HeaderType(0x2a), str: "UNKNOWN(0x2a)"},
+		{name: "priv lvl", v: PrivLvl(0x2a), str: "UNKNOWN(0x2a)"},
+		{name: "priv lvl in range", v: PrivLvl(7), known: true, str: "PrivLvl7"},
+		{name: "authen method krb4", v: AuthenMethodKrb4, known: true, str: "AuthenMethodKrb4"},
+		{name: "authen method rcmd", v: AuthenMethodRCMD, known: true, str: "AuthenMethodRCMD"},
+		{name: "acct flag start", v: AcctFlagStart, known: true, str: "AcctFlagStart"},
+		{name: "acct flag watchdog", v: AcctFlagWatchdog, known: true, str: "AcctFlagWatchdog"},
+		{name: "acct flag watchdog with update", v: AcctFlagWatchdogWithUpdate, known: true, str: "AcctFlagWatchdogWithUpdate"},
+		{name: "acct flag unknown bits", v: AcctFlagStop | 0x40, str: "AcctFlagStop|UNKNOWN(0x40)"},
+		{name: "authen reply flag unknown bits", v: AuthenReplyFlag(0x03), str: "AuthenReplyFlagNoEcho|UNKNOWN(0x02)"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.known, test.v.IsKnown())
+			assert.Equal(t, test.str, test.v.String())
+		})
+	}
+}
+
+// TestDeprecatedFollow ensures the deprecated follow statuses are named but never valid
+func TestDeprecatedFollow(t *testing.T) {
+	assert.Equal(t, "AuthenStatusFollow", AuthenStatusFollow.String())
+	assert.Error(t, AuthenStatusFollow.Validate(nil))
+	assert.Equal(t, "AuthorStatusFollow", AuthorStatusFollow.String())
+	assert.Error(t, AuthorStatusFollow.Validate(nil))
+	assert.Equal(t, "AcctReplyStatusFollow", AcctReplyStatusFollow.String())
+	assert.Error(t, AcctReplyStatusFollow.Validate(nil))
+}
+
+// TestVendorAuthenType ensures a vendor authen_type survives a round trip and is rendered in fields
+func TestVendorAuthenType(t *testing.T) {
+	start := NewAuthenStart(
+		SetAuthenStartType(AuthenType(0x2a)),
+		SetAuthenStartAction(AuthenActionLogin),
+		SetAuthenStartPrivLvl(PrivLvlUser),
+		SetAuthenStartService(AuthenServiceLogin),
+		SetAuthenStartPort("tty0"),
+		SetAuthenStartUser("user"),
+	)
+	b, err := start.MarshalBinary()
+	require.NoError(t, err)
+
+	var decoded AuthenStart
+	require.NoError(t, Unmarshal(b, &decoded))
+	assert.Equal(t, AuthenType(0x2a), decoded.Type)
+	assert.False(t, decoded.Type.IsKnown())
+	assert.Equal(t, "UNKNOWN(0x2a)", decoded.Fields()["type"])
+}
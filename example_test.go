@@ -0,0 +1,169 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	tq "github.com/facebookincubator/tacquito"
+)
+
+// exampleLogger writes server events to the standard logger
+type exampleLogger struct{}
+
+func (exampleLogger) Infof(ctx context.Context, format string, args ...interface{}) {
+	log.Printf(format, args...)
+}
+func (exampleLogger) Errorf(ctx context.Context, format string, args ...interface{}) {
+	log.Printf(format, args...)
+}
+func (exampleLogger) Debugf(ctx context.Context, format string, args ...interface{}) {}
+func (exampleLogger) Record(ctx context.Context, r map[string]string, obscure ...string) {
+	log.Print(r)
+}
+
+// exampleSecretProvider serves every device with the same secret and a handler that passes
+// every authentication
+type exampleSecretProvider struct{}
+
+func (exampleSecretProvider) Get(ctx context.Context, remote net.Addr) ([]byte, tq.Handler, error) {
+	return []byte("fooman"), tq.HandlerFunc(func(response tq.Response, request tq.Request) {
+		response.Reply(tq.NewAuthenReply(tq.SetAuthenReplyStatus(tq.AuthenStatusPass)))
+	}), nil
+}
+
+func ExampleNewServer() {
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := tq.NewServer(exampleLogger{}, exampleSecretProvider{},
+		tq.SetIdleTimeout(30*time.Second),
+		tq.SetHandlerTimeout(5*time.Second),
+	)
+	go s.Serve(context.Background(), listener.(*net.TCPListener))
+}
+
+func ExampleSetServerOptions() {
+	// eg decoded from a config file
+	opts := tq.ServerOptions{
+		IdleTimeout:    30 * time.Second,
+		HandlerTimeout: 5 * time.Second,
+		EmptyBody:      map[tq.HeaderType]tq.EmptyBodyPolicy{tq.Accounting: tq.EmptyBodyReject},
+	}
+	_ = tq.NewServer(exampleLogger{}, exampleSecretProvider{}, tq.SetServerOptions(opts))
+}
+
+func ExampleNewClient() {
+	c, err := tq.NewClient(tq.SetClientDialer("tcp6", "[::1]:49", []byte("fooman")))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer c.Close()
+	resp, err := c.Send(tq.NewPacket(
+		tq.SetPacketHeader(tq.NewHeader(
+			tq.SetHeaderVersion(tq.Version{MajorVersion: tq.MajorVersion, MinorVersion: tq.MinorVersionOne}),
+			tq.SetHeaderType(tq.Authenticate),
+			tq.SetHeaderSessionID(12345),
+		)),
+		tq.SetPacketBodyUnsafe(tq.NewAuthenStart(
+			tq.SetAuthenStartAction(tq.AuthenActionLogin),
+			tq.SetAuthenStartPrivLvl(tq.PrivLvlUser),
+			tq.SetAuthenStartType(tq.AuthenTypePAP),
+			tq.SetAuthenStartService(tq.AuthenServiceLogin),
+			tq.SetAuthenStartUser("cisco"),
+			tq.SetAuthenStartData("cisco"),
+		)),
+	))
+	if err != nil {
+		log.Fatal(err)
+	}
+	var reply tq.AuthenReply
+	if err := tq.Unmarshal(resp.Body, &reply); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(reply.Status)
+}
+
+func ExampleSetClientOptions() {
+	_, err := tq.NewClient(tq.SetClientOptions(tq.ClientOptions{Secret: []byte("fooman")}))
+	fmt.Println(err)
+	// Output: invalid value [ ] for SetClientOptions; network and address are required
+}
+
+func ExampleNewPacket() {
+	p := tq.NewPacket(
+		tq.SetPacketHeader(tq.NewHeader(
+			tq.SetHeaderVersion(tq.Version{MajorVersion: tq.MajorVersion, MinorVersion: tq.MinorVersionDefault}),
+			tq.SetHeaderType(tq.Accounting),
+			tq.SetHeaderSeqNo(1),
+			tq.SetHeaderSessionID(12345),
+		)),
+		tq.SetPacketBodyUnsafe(tq.NewAcctRequest(
+			tq.SetAcctRequestFlag(tq.AcctFlagStart),
+			tq.SetAcctRequestMethod(tq.AuthenMethodTacacsPlus),
+			tq.SetAcctRequestPrivLvl(tq.PrivLvlUser),
+			tq.SetAcctRequestType(tq.AuthenTypeASCII),
+			tq.SetAcctRequestService(tq.AuthenServiceLogin),
+			tq.SetAcctRequestUser("cisco"),
+			tq.SetAcctRequestArgs(tq.Args{"service=shell", "cmd=show"}),
+		)),
+	)
+	fmt.Println(p.Header.Type, p.Header.Length)
+	// Output: Accounting 37
+}
+
+func ExampleNewDecryptReader() {
+	p := tq.NewPacket(
+		tq.SetPacketHeader(tq.NewHeader(
+			tq.SetHeaderVersion(tq.Version{MajorVersion: tq.MajorVersion, MinorVersion: tq.MinorVersionDefault}),
+			tq.SetHeaderType(tq.Authorize),
+			tq.SetHeaderSeqNo(2),
+			tq.SetHeaderSessionID(12345),
+		)),
+		tq.SetPacketBodyUnsafe(tq.NewAuthorReply(tq.SetAuthorReplyStatus(tq.AuthorStatusPassAdd))),
+	)
+	var wire bytes.Buffer
+	if _, err := tq.NewEncryptWriter(&wire, []byte("fooman")).WritePacket(p); err != nil {
+		log.Fatal(err)
+	}
+	clear, err := tq.NewDecryptReader(&wire, []byte("fooman")).ReadPacket()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var reply tq.AuthorReply
+	if err := tq.Unmarshal(clear.Body, &reply); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(reply.Status)
+	// Output: AuthorStatusPassAdd
+}
+
+func ExampleNewSessionRecorder() {
+	recorder := tq.NewSessionRecorder(tq.HandlerFunc(func(response tq.Response, request tq.Request) {
+		response.Reply(tq.NewAuthenReply(tq.SetAuthenReplyStatus(tq.AuthenStatusPass)))
+	}))
+	// return recorder as the handler of a SecretProvider, then inspect a session with
+	if f, ok := recorder.Fixture(12345); ok {
+		summary, _ := tq.SummarizeSession(f)
+		fmt.Print(summary)
+	}
+}
+
+func ExampleNewConformanceChecker() {
+	_ = tq.NewConformanceChecker(exampleLogger{}, tq.HandlerFunc(func(response tq.Response, request tq.Request) {
+		response.Reply(tq.NewAuthenReply(tq.SetAuthenReplyStatus(tq.AuthenStatusPass)))
+	}))
+	// or for every connection of a server
+	_ = tq.NewServer(exampleLogger{}, exampleSecretProvider{}, tq.SetConformanceCheck(true))
+}
@@ -0,0 +1,56 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package examples
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+
+	tq "github.com/facebookincubator/tacquito"
+)
+
+// NewAccounter returns an Accounter that writes to w, eg a file opened with os.O_APPEND
+func NewAccounter(w io.Writer) *Accounter {
+	return &Accounter{enc: json.NewEncoder(w)}
+}
+
+// Accounter writes every accounting request as a line of json.  Each line holds the fields of the
+// header and body of the request and the address of the device that sent it.
+type Accounter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// Handle records an accounting request.  A device is only told of success once the record is
+// written, so it may retry a request that could not be.
+func (a *Accounter) Handle(response tq.Response, request tq.Request) {
+	var body tq.AcctRequest
+	if err := tq.Unmarshal(request.Body, &body); err != nil {
+		response.Reply(
+			tq.NewAcctReply(
+				tq.SetAcctReplyStatus(tq.AcctReplyStatusError),
+				tq.SetAcctReplyServerMsg("unable to decode accounting request"),
+			),
+		)
+		return
+	}
+	a.mu.Lock()
+	err := a.enc.Encode(request.Fields(tq.ContextConnRemoteAddr))
+	a.mu.Unlock()
+	if err != nil {
+		response.Reply(
+			tq.NewAcctReply(
+				tq.SetAcctReplyStatus(tq.AcctReplyStatusError),
+				tq.SetAcctReplyServerMsg("unable to record accounting request"),
+			),
+		)
+		return
+	}
+	response.Reply(tq.NewAcctReply(tq.SetAcctReplyStatus(tq.AcctReplyStatusSuccess)))
+}
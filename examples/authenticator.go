@@ -0,0 +1,81 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package examples
+
+import (
+	tq "github.com/facebookincubator/tacquito"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// NewAuthenticator returns an Authenticator for users, a map of username to a bcrypt hash as made
+// by bcrypt.GenerateFromPassword
+func NewAuthenticator(users map[string]string) *Authenticator {
+	a := &Authenticator{users: make(map[string][]byte, len(users))}
+	cost := 0
+	for name, hash := range users {
+		a.users[name] = []byte(hash)
+		if c, err := bcrypt.Cost([]byte(hash)); err == nil && c > cost {
+			cost = c
+		}
+	}
+	if cost == 0 {
+		cost = bcrypt.DefaultCost
+	}
+	// the cost is taken from the stored hashes, so it is always valid
+	a.unknown, _ = bcrypt.GenerateFromPassword([]byte("unknown user"), cost)
+	return a
+}
+
+// Authenticator checks PAP logins against a map of bcrypt hashes.  Replace the map with a lookup in
+// your own user store to reuse it.
+type Authenticator struct {
+	users map[string][]byte
+	// unknown is compared against for unknown users, so they take as long to deny as a wrong
+	// password and the time of a reply does not tell which usernames exist
+	unknown []byte
+}
+
+// Handle replies pass or fail to an AuthenStart of type PAP.  The password of a PAP login is the
+// data field of the start packet, so the exchange is a single request and reply.
+func (a *Authenticator) Handle(response tq.Response, request tq.Request) {
+	var body tq.AuthenStart
+	if err := tq.Unmarshal(request.Body, &body); err != nil {
+		response.Reply(
+			tq.NewAuthenReply(
+				tq.SetAuthenReplyStatus(tq.AuthenStatusError),
+				tq.SetAuthenReplyServerMsg("unable to decode authentication start"),
+			),
+		)
+		return
+	}
+	if body.Type != tq.AuthenTypePAP {
+		response.Reply(
+			tq.NewAuthenReply(
+				tq.SetAuthenReplyStatus(tq.AuthenStatusError),
+				tq.SetAuthenReplyServerMsg("only pap authentication is supported"),
+			),
+		)
+		return
+	}
+	hash, ok := a.users[string(body.User)]
+	if !ok {
+		hash = a.unknown
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(body.Data)) != nil || !ok {
+		// unknown users and wrong passwords get the same answer
+		response.Reply(tq.NewDenial(tq.Authenticate, tq.DenialBadCredential, ""))
+		return
+	}
+	response.Reply(
+		tq.NewAuthenReply(
+			tq.SetAuthenReplyStatus(tq.AuthenStatusPass),
+			tq.SetAuthenReplyServerMsg("login success"),
+		),
+	)
+}
@@ -0,0 +1,70 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package examples
+
+import (
+	"fmt"
+	"io"
+
+	tq "github.com/facebookincubator/tacquito"
+	"github.com/facebookincubator/tacquito/cmds/server/config"
+	"github.com/facebookincubator/tacquito/cmds/server/config/authorizers/stringy"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Policy is the rule file of an Authorizer.  Users take the same form as the users of the server
+// config, see cmds/server/tacquito.yaml, so services, commands and groups all apply.
+type Policy struct {
+	Users []config.User `yaml:"users"`
+}
+
+// NewAuthorizer reads a yaml Policy from r and builds the rules of every user in it with the
+// stringy rule engine
+func NewAuthorizer(l loggerProvider, r io.Reader) (*Authorizer, error) {
+	var p Policy
+	if err := yaml.NewDecoder(r).Decode(&p); err != nil {
+		return nil, fmt.Errorf("unable to decode policy; %w", err)
+	}
+	engine := stringy.New(l)
+	a := &Authorizer{users: make(map[string]tq.Handler, len(p.Users))}
+	for _, u := range p.Users {
+		h, err := engine.New(u)
+		if err != nil {
+			return nil, fmt.Errorf("unable to build rules for user [%v]; %w", u.Name, err)
+		}
+		a.users[u.Name] = h
+	}
+	return a, nil
+}
+
+// Authorizer passes each authorization request to the rules of its user
+type Authorizer struct {
+	users map[string]tq.Handler
+}
+
+// Handle authorizes a request with the rules of its user.  Users missing from the policy are
+// denied.
+func (a *Authorizer) Handle(response tq.Response, request tq.Request) {
+	var body tq.AuthorRequest
+	if err := tq.Unmarshal(request.Body, &body); err != nil {
+		response.Reply(
+			tq.NewAuthorReply(
+				tq.SetAuthorReplyStatus(tq.AuthorStatusError),
+				tq.SetAuthorReplyServerMsg("unable to decode authorization request"),
+			),
+		)
+		return
+	}
+	h, ok := a.users[string(body.User)]
+	if !ok {
+		response.Reply(tq.NewDenial(tq.Authorize, tq.DenialPolicy, ""))
+		return
+	}
+	h.Handle(response, request)
+}
@@ -0,0 +1,238 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package examples
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	tq "github.com/facebookincubator/tacquito"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var testSecret = []byte("fooman")
+
+const testPolicy = `
+users:
+  - name: alice
+    services:
+      - name: shell
+        set_values:
+          - name: priv-lvl
+            values: [15]
+    commands:
+      - name: show
+        action: 2
+      - name: reload
+        action: 1
+  - name: bob
+    commands:
+      - name: show
+        action: 2
+`
+
+// lockedBuffer is a bytes.Buffer safe for the server and the test to use at once
+type lockedBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (l *lockedBuffer) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.Write(p)
+}
+
+func (l *lockedBuffer) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.String()
+}
+
+// testDeployment is the assembled example server
+type testDeployment struct {
+	client *tq.Client
+	logs   *lockedBuffer
+	acct   *lockedBuffer
+}
+
+// deploy assembles the example handlers into a server on a loopback listener and connects a client
+func deploy(t *testing.T) *testDeployment {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret-password"), bcrypt.MinCost)
+	require.NoError(t, err)
+	d := &testDeployment{logs: &lockedBuffer{}, acct: &lockedBuffer{}}
+	logger := Logger{log.New(d.logs, "", 0)}
+
+	authorizer, err := NewAuthorizer(logger, strings.NewReader(testPolicy))
+	require.NoError(t, err)
+	h := Handlers{
+		Authenticator: NewAuthenticator(map[string]string{"alice": string(hash), "bob": string(hash)}),
+		Authorizer:    authorizer,
+		Accounter:     NewAccounter(d.acct),
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	// every request below is a new session on the one client connection
+	go func() {
+		done <- Serve(ctx, logger, listener.(*net.TCPListener), testSecret, h, tq.SetImplicitSessionReuse(true))
+	}()
+
+	d.client, err = tq.NewClient(tq.SetClientDialer("tcp", listener.Addr().String(), testSecret))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		d.client.Close()
+		cancel()
+		listener.Close()
+		assert.NoError(t, <-done)
+	})
+	return d
+}
+
+// send sends body as the first packet of session id and returns the reply body
+func (d *testDeployment) send(t *testing.T, id tq.SessionID, typ tq.HeaderType, body tq.EncoderDecoder) []byte {
+	resp, err := d.client.Send(tq.NewPacket(
+		tq.SetPacketHeader(tq.NewHeader(
+			tq.SetHeaderVersion(tq.Version{MajorVersion: tq.MajorVersion, MinorVersion: tq.MinorVersionOne}),
+			tq.SetHeaderType(typ),
+			tq.SetHeaderSeqNo(1),
+			tq.SetHeaderSessionID(id),
+		)),
+		tq.SetPacketBodyUnsafe(body),
+	))
+	require.NoError(t, err)
+	return resp.Body
+}
+
+func (d *testDeployment) login(t *testing.T, id tq.SessionID, typ tq.AuthenType, user, password string) tq.AuthenReply {
+	body := d.send(t, id, tq.Authenticate, tq.NewAuthenStart(
+		tq.SetAuthenStartAction(tq.AuthenActionLogin),
+		tq.SetAuthenStartPrivLvl(tq.PrivLvlUser),
+		tq.SetAuthenStartType(typ),
+		tq.SetAuthenStartService(tq.AuthenServiceLogin),
+		tq.SetAuthenStartUser(tq.AuthenUser(user)),
+		tq.SetAuthenStartData(tq.AuthenData(password)),
+	))
+	var reply tq.AuthenReply
+	require.NoError(t, tq.Unmarshal(body, &reply))
+	return reply
+}
+
+func (d *testDeployment) authorize(t *testing.T, id tq.SessionID, user string, args ...tq.Arg) tq.AuthorReply {
+	body := d.send(t, id, tq.Authorize, tq.NewAuthorRequest(
+		tq.SetAuthorRequestMethod(tq.AuthenMethodTacacsPlus),
+		tq.SetAuthorRequestPrivLvl(tq.PrivLvlUser),
+		tq.SetAuthorRequestType(tq.AuthenTypeASCII),
+		tq.SetAuthorRequestService(tq.AuthenServiceLogin),
+		tq.SetAuthorRequestUser(tq.AuthenUser(user)),
+		tq.SetAuthorRequestArgs(args),
+	))
+	var reply tq.AuthorReply
+	require.NoError(t, tq.Unmarshal(body, &reply))
+	return reply
+}
+
+func TestAuthenticator(t *testing.T) {
+	d := deploy(t)
+	assert.Equal(t, tq.AuthenStatusPass, d.login(t, 1, tq.AuthenTypePAP, "alice", "secret-password").Status)
+	assert.Equal(t, tq.AuthenStatusFail, d.login(t, 2, tq.AuthenTypePAP, "alice", "wrong-password").Status)
+	assert.Equal(t, tq.AuthenStatusFail, d.login(t, 3, tq.AuthenTypePAP, "mallory", "secret-password").Status)
+	assert.Equal(t, tq.AuthenStatusError, d.login(t, 4, tq.AuthenTypeCHAP, "alice", "secret-password").Status)
+}
+
+func TestAuthenticatorUnknownUserCost(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret-password"), bcrypt.MinCost+1)
+	require.NoError(t, err)
+	a := NewAuthenticator(map[string]string{"alice": string(hash)})
+	// unknown users are compared against a hash as costly as those of the known users
+	cost, err := bcrypt.Cost(a.unknown)
+	require.NoError(t, err)
+	assert.Equal(t, bcrypt.MinCost+1, cost)
+}
+
+func TestAuthorizer(t *testing.T) {
+	d := deploy(t)
+	reply := d.authorize(t, 1, "alice", "service=shell", "cmd=")
+	assert.Equal(t, tq.AuthorStatusPassAdd, reply.Status)
+	assert.Equal(t, tq.Args{"priv-lvl=15"}, reply.Args)
+
+	assert.Equal(t, tq.AuthorStatusPassAdd, d.authorize(t, 2, "alice", "service=shell", "cmd=show", "cmd-arg=version").Status)
+	assert.Equal(t, tq.AuthorStatusFail, d.authorize(t, 3, "alice", "service=shell", "cmd=reload").Status)
+	assert.Equal(t, tq.AuthorStatusPassAdd, d.authorize(t, 4, "bob", "service=shell", "cmd=show").Status)
+	assert.Equal(t, tq.AuthorStatusFail, d.authorize(t, 5, "mallory", "service=shell", "cmd=show").Status)
+}
+
+func TestNewAuthorizerBadPolicy(t *testing.T) {
+	_, err := NewAuthorizer(Logger{log.New(&bytes.Buffer{}, "", 0)}, strings.NewReader("users: {"))
+	assert.Error(t, err)
+}
+
+func TestAccounter(t *testing.T) {
+	d := deploy(t)
+	for i, flag := range []tq.AcctRequestFlag{tq.AcctFlagStart, tq.AcctFlagStop} {
+		body := d.send(t, tq.SessionID(i+1), tq.Accounting, tq.NewAcctRequest(
+			tq.SetAcctRequestFlag(flag),
+			tq.SetAcctRequestMethod(tq.AuthenMethodTacacsPlus),
+			tq.SetAcctRequestPrivLvl(tq.PrivLvlUser),
+			tq.SetAcctRequestType(tq.AuthenTypeASCII),
+			tq.SetAcctRequestService(tq.AuthenServiceLogin),
+			tq.SetAcctRequestUser("alice"),
+			tq.SetAcctRequestArgs(tq.Args{"service=shell", "task_id=1"}),
+		))
+		var reply tq.AcctReply
+		require.NoError(t, tq.Unmarshal(body, &reply))
+		assert.Equal(t, tq.AcctReplyStatusSuccess, reply.Status)
+	}
+
+	lines := strings.Split(strings.TrimSpace(d.acct.String()), "\n")
+	require.Len(t, lines, 2)
+	for i, flag := range []string{"AcctFlagStart", "AcctFlagStop"} {
+		var record map[string]string
+		require.NoError(t, json.Unmarshal([]byte(lines[i]), &record))
+		assert.Equal(t, "alice", record["user"])
+		assert.Equal(t, flag, record["flags"])
+		assert.NotEmpty(t, record[string(tq.ContextConnRemoteAddr)])
+	}
+}
+
+func TestLogDecisions(t *testing.T) {
+	d := deploy(t)
+	d.login(t, 1, tq.AuthenTypePAP, "alice", "secret-password")
+	d.login(t, 2, tq.AuthenTypePAP, "bob", "wrong-password")
+	d.authorize(t, 3, "alice", "service=shell", "cmd=reload")
+
+	logs := d.logs.String()
+	assert.Contains(t, logs, "[1] Authenticate decision for user [alice]: AuthenStatusPass")
+	assert.Contains(t, logs, "[2] Authenticate decision for user [bob]: AuthenStatusFail, cause [bad-credential]")
+	assert.Contains(t, logs, "[3] Authorize decision for user [alice]: AuthorStatusFail")
+}
+
+func TestHandlersUnsupported(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	logger := Logger{log.New(&lockedBuffer{}, "", 0)}
+	go Serve(context.Background(), logger, listener.(*net.TCPListener), testSecret, Handlers{})
+	defer listener.Close()
+
+	c, err := tq.NewClient(tq.SetClientDialer("tcp", listener.Addr().String(), testSecret))
+	require.NoError(t, err)
+	d := &testDeployment{client: c}
+	defer c.Close()
+	assert.Equal(t, tq.AuthorStatusFail, d.authorize(t, 1, "alice", "service=shell").Status)
+}
@@ -0,0 +1,53 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+// Package examples holds small reference implementations of each extension point of a tacquito
+// server: an authenticator, an authorizer, an accounter and a middleware, and Serve, which
+// assembles them into a running server.  Each file stands on its own and may be copied into a
+// deployment as a starting point.
+package examples
+
+import (
+	"context"
+	"log"
+)
+
+// loggerProvider provides the logging implementation, see Logger
+type loggerProvider interface {
+	Infof(ctx context.Context, format string, args ...interface{})
+	Errorf(ctx context.Context, format string, args ...interface{})
+	Debugf(ctx context.Context, format string, args ...interface{})
+	Record(ctx context.Context, r map[string]string, obscure ...string)
+}
+
+// Logger writes server events and records to a log.Logger
+type Logger struct {
+	*log.Logger
+}
+
+// Infof logs an informational event
+func (l Logger) Infof(ctx context.Context, format string, args ...interface{}) {
+	l.Printf("INFO: "+format, args...)
+}
+
+// Errorf logs an error
+func (l Logger) Errorf(ctx context.Context, format string, args ...interface{}) {
+	l.Printf("ERROR: "+format, args...)
+}
+
+// Debugf discards debug events
+func (l Logger) Debugf(ctx context.Context, format string, args ...interface{}) {}
+
+// Record logs a structured record.  Fields named in obscure are not logged.
+func (l Logger) Record(ctx context.Context, r map[string]string, obscure ...string) {
+	for _, k := range obscure {
+		if _, ok := r[k]; ok {
+			r[k] = "<obscured>"
+		}
+	}
+	l.Printf("RECORD: %v", r)
+}
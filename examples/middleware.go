@@ -0,0 +1,45 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package examples
+
+import (
+	tq "github.com/facebookincubator/tacquito"
+)
+
+// LogDecisions wraps next and logs the decision of every reply it sends.  It follows an exchange
+// through Response.Next, so every reply of a multi packet authentication is logged.  Replies sent
+// with Response.Write are raw packets and are not logged.
+func LogDecisions(l loggerProvider, next tq.Handler) tq.Handler {
+	return tq.HandlerFunc(func(response tq.Response, request tq.Request) {
+		next.Handle(&decisionResponse{Response: response, loggerProvider: l, request: request}, request)
+	})
+}
+
+// decisionResponse logs each reply before sending it on to the Response it wraps
+type decisionResponse struct {
+	tq.Response
+	loggerProvider
+	request tq.Request
+}
+
+// Reply logs the status of v, and the cause if it is a denial
+func (r *decisionResponse) Reply(v tq.EncoderDecoder) (int, error) {
+	fields := v.Fields()
+	user := r.request.Fields()["user"]
+	if cause, ok := fields["denial-cause"]; ok {
+		r.Infof(r.request.Context, "[%v] %v decision for user [%v]: %v, cause [%v]", r.request.Header.SessionID, r.request.Header.Type, user, fields["status"], cause)
+	} else {
+		r.Infof(r.request.Context, "[%v] %v decision for user [%v]: %v", r.request.Header.SessionID, r.request.Header.Type, user, fields["status"])
+	}
+	return r.Response.Reply(v)
+}
+
+// Next wraps the handler of the next packet of the exchange so its replies are logged too
+func (r *decisionResponse) Next(next tq.Handler) {
+	r.Response.Next(LogDecisions(r.loggerProvider, next))
+}
@@ -0,0 +1,60 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package examples
+
+import (
+	"context"
+	"net"
+
+	tq "github.com/facebookincubator/tacquito"
+)
+
+// Handlers route each request to the handler of its packet type
+type Handlers struct {
+	Authenticator tq.Handler
+	Authorizer    tq.Handler
+	Accounter     tq.Handler
+}
+
+// Handle routes request by its packet type.  Packet types without a handler are denied.
+func (h Handlers) Handle(response tq.Response, request tq.Request) {
+	var next tq.Handler
+	switch request.Header.Type {
+	case tq.Authenticate:
+		next = h.Authenticator
+	case tq.Authorize:
+		next = h.Authorizer
+	case tq.Accounting:
+		next = h.Accounter
+	}
+	if next == nil {
+		response.Reply(tq.NewDenial(request.Header.Type, tq.DenialPolicy, "not supported"))
+		return
+	}
+	next.Handle(response, request)
+}
+
+// sharedSecret serves every device with the same secret and handler.  A deployment with more than
+// one secret would look the device up by remote instead.
+type sharedSecret struct {
+	secret  []byte
+	handler tq.Handler
+}
+
+// Get returns the secret and handler of every device
+func (s sharedSecret) Get(ctx context.Context, remote net.Addr) ([]byte, tq.Handler, error) {
+	return s.secret, s.handler, nil
+}
+
+// Serve assembles a server from h, logging every decision it makes, and serves devices that share
+// secret on listener.  It blocks until ctx is done or listener is closed.  opts are passed on to
+// tq.NewServer.
+func Serve(ctx context.Context, l loggerProvider, listener *net.TCPListener, secret []byte, h Handlers, opts ...tq.Option) error {
+	s := tq.NewServer(l, sharedSecret{secret: secret, handler: LogDecisions(l, h)}, opts...)
+	return s.Serve(ctx, listener)
+}
@@ -0,0 +1,151 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+// Package extension is the contract for secret providers, handlers, authenticators, authorizers,
+// accounters and the services they use that are built outside of this repository.  It only holds
+// interfaces, and every one of them is stable: a method is never added to, removed from or changed
+// on an interface here within a major version.  New behavior is added as a new, optional
+// interface that implementations may assert for, the way tq.SecretWarmer extends
+// tq.SecretProvider.
+//
+// The package depends on the tacquito package and the standard library only, so the types the
+// interfaces take are defined here rather than drawn from the config schema of the server.  The
+// factories that are built from that schema itself, of the handlers and authorizers of a config,
+// are config.HandlerFactory and config.AuthorizerFactory of the server.
+//
+// Each interface has a conformance suite in the extensiontest package, which the implementations
+// in this repository run, and which implementations elsewhere should run too.  The interfaces of
+// the tacquito package that these mirror are checked against them at build time, so a refactor
+// that would break an implementation does not compile.
+package extension
+
+import (
+	"context"
+	"net"
+	"time"
+
+	tq "github.com/facebookincubator/tacquito"
+)
+
+// SecretProvider selects the secret and handler of the device at remote, see tq.SecretProvider.
+// An unknown device is an error.  Get is called concurrently, and returns promptly once ctx is
+// done.
+//
+// Stable.
+type SecretProvider interface {
+	Get(ctx context.Context, remote net.Addr) ([]byte, tq.Handler, error)
+}
+
+// Handler handles the packets of a session, see tq.Handler.  It answers every request with
+// Response.Reply or Response.Write, or hands the session on with Response.Next.  Handle is called
+// concurrently for different sessions, and returns promptly once the context of the request is
+// done.
+//
+// Stable.
+type Handler interface {
+	Handle(response tq.Response, request tq.Request)
+}
+
+// AuthenticatorFactory builds the Handler that authenticates username, from the options of its
+// authenticator in config, see loader.RegisterAuthenticator.  Options it cannot serve are an
+// error.  New is called concurrently.
+//
+// Stable.
+type AuthenticatorFactory interface {
+	New(username string, options map[string]string) (tq.Handler, error)
+}
+
+// AccounterFactory builds the Handler that accounts the requests of users whose accounter in
+// config has options, see loader.RegisterAccounter.  New is called concurrently.
+//
+// Stable.
+type AccounterFactory interface {
+	New(options map[string]string) tq.Handler
+}
+
+// SecretConfig is the part of a secret config of the server a SecretProviderFactory builds from:
+// its name, for logs, and the options of its provider type
+type SecretConfig struct {
+	Name    string
+	Options map[string]string
+}
+
+// SecretProviderFactory builds the SecretProvider of the secret config sc, which serves handler and
+// reads the secret of a device with secret, see loader.RegisterSecretProviderType.  A nil
+// SecretProvider skips the secret config.
+//
+// Stable.
+type SecretProviderFactory interface {
+	New(ctx context.Context, sc SecretConfig, handler tq.Handler, secret func(context.Context, string) ([]byte, error)) tq.SecretProvider
+}
+
+// Metrics creates the metrics of an implementation, see tq.Metrics.  Creating two metrics of one
+// name is an error of the implementation, eg a panic of a prometheus registry.  Every method is
+// called concurrently, and so are the methods of the metrics it returns.
+//
+// Stable.
+type Metrics interface {
+	Counter(opts tq.MetricOpts) tq.Counter
+	CounterVec(opts tq.MetricOpts) tq.CounterVec
+	Gauge(opts tq.MetricOpts) tq.Gauge
+	GaugeFunc(opts tq.MetricOpts, f func() float64)
+	Observer(opts tq.MetricOpts) tq.Observer
+	ObserverVec(opts tq.MetricOpts) tq.ObserverVec
+}
+
+// Logger is the logger every component logs through.  Record logs a record based entry, with the
+// values of the keys in obscure hidden, and may change r to hide them.  Every method is called
+// concurrently.
+//
+// Stable.
+type Logger interface {
+	Infof(ctx context.Context, format string, args ...interface{})
+	Errorf(ctx context.Context, format string, args ...interface{})
+	Debugf(ctx context.Context, format string, args ...interface{})
+	Record(ctx context.Context, r map[string]string, obscure ...string)
+}
+
+// Clock is the wall clock of a component, see tq.SetClock.  Now is called concurrently.
+//
+// Stable.
+type Clock interface {
+	Now() time.Time
+}
+
+// ClockFunc is a Clock of a function, eg ClockFunc(time.Now)
+type ClockFunc func() time.Time
+
+// Now implements Clock
+func (f ClockFunc) Now() time.Time {
+	return f()
+}
+
+// KV is the store of state shared by every instance of a server, see tq.Store for the semantics
+// of each method.  Every method is called concurrently, and returns an error wrapping ctx.Err()
+// once ctx is done.
+//
+// Stable.
+type KV interface {
+	Get(ctx context.Context, key string) (value []byte, ok bool, err error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Incr(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error)
+	CompareAndSwap(ctx context.Context, key string, old, new []byte, ttl time.Duration) (bool, error)
+}
+
+// the interfaces the server uses must keep the methods of the contract, and must not
+// require more
+var (
+	_ SecretProvider    = tq.SecretProvider(nil)
+	_ tq.SecretProvider = SecretProvider(nil)
+	_ Handler           = tq.Handler(nil)
+	_ tq.Handler        = Handler(nil)
+	_ KV                = tq.Store(nil)
+	_ tq.Store          = KV(nil)
+	_ Metrics           = tq.Metrics(nil)
+	_ tq.Metrics        = Metrics(nil)
+	_ Clock             = ClockFunc(time.Now)
+)
@@ -0,0 +1,407 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+// Package extensiontest holds the conformance suites of the interfaces of the extension package.
+// Every implementation, in this repository or not, runs the suite of each interface it implements
+// from its own tests, eg
+//
+//	func TestConformance(t *testing.T) {
+//		extensiontest.RunKVConformanceTests(t, func(t *testing.T) extension.KV { return newStore(t) })
+//	}
+//
+// The suites check the semantics the server relies on that the compiler cannot: errors,
+// context cancellation and concurrency safety.  Run them with -race.
+package extensiontest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	tq "github.com/facebookincubator/tacquito"
+	"github.com/facebookincubator/tacquito/cmds/server/config"
+	"github.com/facebookincubator/tacquito/extension"
+)
+
+// PromptTimeout is how long a call may take once its context is done
+var PromptTimeout = time.Second
+
+// concurrency is how many goroutines the concurrency checks call from
+const concurrency = 16
+
+// prompt fails t if fn does not return within PromptTimeout
+func prompt(t *testing.T, name string, fn func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+	select {
+	case <-done:
+	case <-time.After(PromptTimeout):
+		t.Fatalf("%v did not return within %v of its context being done", name, PromptTimeout)
+	}
+}
+
+// parallel calls fn from concurrency goroutines, with the index of each, and returns once all did
+func parallel(fn func(i int)) {
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// canceled returns a context that is already done
+func canceled() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}
+
+// RunSecretProviderConformanceTests checks p against the extension.SecretProvider contract.  p
+// must have a secret for the device at known, and none for the device at unknown.
+func RunSecretProviderConformanceTests(t *testing.T, p extension.SecretProvider, known, unknown net.Addr) {
+	t.Run("known device", func(t *testing.T) {
+		secret, handler, err := p.Get(context.Background(), known)
+		if err != nil || len(secret) == 0 || handler == nil {
+			t.Fatalf("Get(%v) returned secret of %v bytes, handler %v, error %v; want a secret and handler", known, len(secret), handler, err)
+		}
+		again, _, err := p.Get(context.Background(), known)
+		if err != nil || string(again) != string(secret) {
+			t.Errorf("Get(%v) returned another secret the second time, error %v", known, err)
+		}
+	})
+	t.Run("unknown device", func(t *testing.T) {
+		if _, _, err := p.Get(context.Background(), unknown); err == nil {
+			t.Errorf("Get(%v) returned no error for an unknown device", unknown)
+		}
+	})
+	t.Run("canceled context", func(t *testing.T) {
+		prompt(t, "Get", func() { p.Get(canceled(), known) })
+	})
+	t.Run("concurrent", func(t *testing.T) {
+		errs := make(chan error, concurrency)
+		parallel(func(int) {
+			if _, _, err := p.Get(context.Background(), known); err != nil {
+				errs <- err
+			}
+		})
+		close(errs)
+		for err := range errs {
+			t.Errorf("concurrent Get(%v): %v", known, err)
+		}
+	})
+}
+
+// recordingResponse is a tq.Response that keeps what a handler answered with
+type recordingResponse struct {
+	mu      sync.Mutex
+	replies []tq.EncoderDecoder
+	writes  []*tq.Packet
+	nexts   int
+}
+
+func (r *recordingResponse) Reply(v tq.EncoderDecoder) (int, error) {
+	b, err := v.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.replies = append(r.replies, v)
+	return len(b), nil
+}
+
+func (r *recordingResponse) Write(p *tq.Packet) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writes = append(r.writes, p)
+	return len(p.Body), nil
+}
+
+func (r *recordingResponse) Next(next tq.Handler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nexts++
+}
+
+func (r *recordingResponse) RegisterWriter(io.Writer) {}
+
+// answered reports if the handler replied, wrote or handed the session on
+func (r *recordingResponse) answered() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.replies)+len(r.writes)+r.nexts > 0
+}
+
+// RunHandlerConformanceTests checks h against the extension.Handler contract.  request returns a
+// new request that h serves, eg the start of a session.
+func RunHandlerConformanceTests(t *testing.T, h extension.Handler, request func() tq.Request) {
+	t.Run("answers", func(t *testing.T) {
+		r := &recordingResponse{}
+		prompt(t, "Handle", func() { h.Handle(r, request()) })
+		if !r.answered() {
+			t.Errorf("Handle neither replied nor handed the session on")
+		}
+	})
+	t.Run("canceled context", func(t *testing.T) {
+		req := request()
+		req.Context = canceled()
+		prompt(t, "Handle", func() { h.Handle(&recordingResponse{}, req) })
+	})
+	t.Run("concurrent", func(t *testing.T) {
+		unanswered := make(chan int, concurrency)
+		parallel(func(i int) {
+			r := &recordingResponse{}
+			h.Handle(r, request())
+			if !r.answered() {
+				unanswered <- i
+			}
+		})
+		close(unanswered)
+		for i := range unanswered {
+			t.Errorf("concurrent Handle %v neither replied nor handed the session on", i)
+		}
+	})
+}
+
+// RunAuthenticatorConformanceTests checks a against the extension.AuthenticatorFactory contract.
+// The handler a builds for username with options must serve request, see
+// RunHandlerConformanceTests.
+func RunAuthenticatorConformanceTests(t *testing.T, a extension.AuthenticatorFactory, username string, options map[string]string, request func() tq.Request) {
+	build := func() (tq.Handler, error) { return a.New(username, options) }
+	runFactoryConformanceTests(t, "New", build, request)
+}
+
+// RunAuthorizerConformanceTests checks a against the config.AuthorizerFactory contract.  The
+// handler a builds for user must serve request, see RunHandlerConformanceTests.
+func RunAuthorizerConformanceTests(t *testing.T, a config.AuthorizerFactory, user config.User, request func() tq.Request) {
+	build := func() (tq.Handler, error) { return a.New(user) }
+	runFactoryConformanceTests(t, "New", build, request)
+}
+
+// RunAccounterConformanceTests checks a against the extension.AccounterFactory contract.  The
+// handler a builds with options must serve request, see RunHandlerConformanceTests.
+func RunAccounterConformanceTests(t *testing.T, a extension.AccounterFactory, options map[string]string, request func() tq.Request) {
+	build := func() (tq.Handler, error) {
+		if h := a.New(options); h != nil {
+			return h, nil
+		}
+		return nil, fmt.Errorf("no handler")
+	}
+	runFactoryConformanceTests(t, "New", build, request)
+}
+
+// runFactoryConformanceTests checks that build returns a handler, also when called concurrently,
+// and runs the handler conformance tests on it
+func runFactoryConformanceTests(t *testing.T, name string, build func() (tq.Handler, error), request func() tq.Request) {
+	h, err := build()
+	if err != nil || h == nil {
+		t.Fatalf("%v returned handler %v, error %v; want a handler", name, h, err)
+	}
+	t.Run("concurrent "+name, func(t *testing.T) {
+		errs := make(chan error, concurrency)
+		parallel(func(int) {
+			if h, err := build(); err != nil || h == nil {
+				errs <- fmt.Errorf("handler %v, error %v", h, err)
+			}
+		})
+		close(errs)
+		for err := range errs {
+			t.Errorf("concurrent %v: %v", name, err)
+		}
+	})
+	t.Run("handler", func(t *testing.T) {
+		RunHandlerConformanceTests(t, h, request)
+	})
+}
+
+// RunMetricsConformanceTests checks m against the extension.Metrics contract.  The suite creates
+// metrics of its own, named extensiontest_conformance_*, so m must not hold metrics of those names.
+func RunMetricsConformanceTests(t *testing.T, m extension.Metrics) {
+	opts := func(name string, labels ...string) tq.MetricOpts {
+		return tq.MetricOpts{Name: "extensiontest_conformance_" + name, Help: "created by the extensiontest metrics conformance suite", Labels: labels}
+	}
+	counter := m.Counter(opts("counter"))
+	counterVec := m.CounterVec(opts("counter_vec", "result"))
+	gauge := m.Gauge(opts("gauge"))
+	histogram := m.Observer(tq.MetricOpts{Name: "extensiontest_conformance_histogram", Help: "created by the extensiontest metrics conformance suite", Buckets: []float64{0.1, 1, 10}})
+	summary := m.Observer(tq.MetricOpts{Name: "extensiontest_conformance_summary", Help: "created by the extensiontest metrics conformance suite", Objectives: map[float64]float64{0.5: 0.05}})
+	observerVec := m.ObserverVec(tq.MetricOpts{Name: "extensiontest_conformance_observer_vec", Help: "created by the extensiontest metrics conformance suite", Labels: []string{"type"}, Buckets: []float64{0.1, 1, 10}})
+	m.GaugeFunc(opts("gauge_func"), func() float64 { return 1 })
+	for name, metric := range map[string]interface{}{
+		"Counter":          counter,
+		"CounterVec":       counterVec,
+		"Gauge":            gauge,
+		"Observer":         histogram,
+		"Observer summary": summary,
+		"ObserverVec":      observerVec,
+	} {
+		if metric == nil {
+			t.Fatalf("%v returned nil", name)
+		}
+	}
+	t.Run("concurrent", func(t *testing.T) {
+		parallel(func(i int) {
+			counter.Inc()
+			counter.Add(2)
+			counterVec.WithLabelValues(fmt.Sprintf("result-%v", i%2)).Inc()
+			gauge.Inc()
+			gauge.Dec()
+			histogram.Observe(float64(i))
+			summary.Observe(float64(i))
+			observerVec.WithLabelValues("authenticate").Observe(float64(i))
+		})
+	})
+}
+
+// RunLoggerConformanceTests checks l against the extension.Logger contract
+func RunLoggerConformanceTests(t *testing.T, l extension.Logger) {
+	log := func(ctx context.Context, i int) {
+		l.Infof(ctx, "extensiontest info %v", i)
+		l.Errorf(ctx, "extensiontest error %v", i)
+		l.Debugf(ctx, "extensiontest debug %v", i)
+		l.Errorf(ctx, "extensiontest without args")
+		l.Record(ctx, map[string]string{"user": "extensiontest", "password": "secret"}, "password", "missing")
+		l.Record(ctx, nil, "password")
+	}
+	t.Run("canceled context", func(t *testing.T) {
+		prompt(t, "logging", func() { log(canceled(), 0) })
+	})
+	t.Run("concurrent", func(t *testing.T) {
+		parallel(func(i int) { log(context.Background(), i) })
+	})
+}
+
+// RunClockConformanceTests checks c against the extension.Clock contract
+func RunClockConformanceTests(t *testing.T, c extension.Clock) {
+	if c.Now().IsZero() {
+		t.Errorf("Now returned the zero time")
+	}
+	t.Run("concurrent", func(t *testing.T) {
+		zero := make(chan int, concurrency)
+		parallel(func(i int) {
+			if c.Now().IsZero() {
+				zero <- i
+			}
+		})
+		close(zero)
+		for i := range zero {
+			t.Errorf("concurrent Now %v returned the zero time", i)
+		}
+	})
+}
+
+// RunKVConformanceTests checks the KVs newKV returns against the extension.KV contract.  Each test
+// gets a new, empty KV.
+func RunKVConformanceTests(t *testing.T, newKV func(t *testing.T) extension.KV) {
+	ctx := context.Background()
+	t.Run("get and set", func(t *testing.T) {
+		kv := newKV(t)
+		if _, ok, err := kv.Get(ctx, "missing"); ok || err != nil {
+			t.Errorf("Get of a key that is not set returned ok %v, error %v", ok, err)
+		}
+		value := []byte("value")
+		if err := kv.Set(ctx, "key", value, 0); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		// the KV keeps its own copy
+		value[0] = 'V'
+		got, ok, err := kv.Get(ctx, "key")
+		if !ok || err != nil || string(got) != "value" {
+			t.Errorf("Get returned %q, ok %v, error %v; want %q", got, ok, err, "value")
+		}
+	})
+	t.Run("ttl", func(t *testing.T) {
+		kv := newKV(t)
+		if err := kv.Set(ctx, "key", []byte("value"), 20*time.Millisecond); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		time.Sleep(60 * time.Millisecond)
+		if _, ok, err := kv.Get(ctx, "key"); ok || err != nil {
+			t.Errorf("Get of an expired key returned ok %v, error %v", ok, err)
+		}
+	})
+	t.Run("incr", func(t *testing.T) {
+		kv := newKV(t)
+		// a key that is not set starts at zero
+		if got, err := kv.Incr(ctx, "count", 2, 0); err != nil || got != 2 {
+			t.Errorf("Incr returned %v, error %v; want 2", got, err)
+		}
+		if got, err := kv.Incr(ctx, "count", 3, 0); err != nil || got != 5 {
+			t.Errorf("Incr returned %v, error %v; want 5", got, err)
+		}
+		if err := kv.Set(ctx, "text", []byte("text"), 0); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		if _, err := kv.Incr(ctx, "text", 1, 0); err == nil {
+			t.Errorf("Incr of a value that is not an integer returned no error")
+		}
+	})
+	t.Run("compare and swap", func(t *testing.T) {
+		kv := newKV(t)
+		if swapped, err := kv.CompareAndSwap(ctx, "key", nil, []byte("first"), 0); !swapped || err != nil {
+			t.Fatalf("CompareAndSwap of a key that is not set returned %v, error %v", swapped, err)
+		}
+		if swapped, err := kv.CompareAndSwap(ctx, "key", nil, []byte("second"), 0); swapped || err != nil {
+			t.Errorf("CompareAndSwap from not set of a key that is set returned %v, error %v", swapped, err)
+		}
+		if swapped, err := kv.CompareAndSwap(ctx, "key", []byte("other"), []byte("second"), 0); swapped || err != nil {
+			t.Errorf("CompareAndSwap from another value returned %v, error %v", swapped, err)
+		}
+		if swapped, err := kv.CompareAndSwap(ctx, "key", []byte("first"), []byte("second"), 0); !swapped || err != nil {
+			t.Errorf("CompareAndSwap from the value returned %v, error %v", swapped, err)
+		}
+		if got, _, _ := kv.Get(ctx, "key"); string(got) != "second" {
+			t.Errorf("Get after CompareAndSwap returned %q, want %q", got, "second")
+		}
+	})
+	t.Run("canceled context", func(t *testing.T) {
+		kv := newKV(t)
+		ctx := canceled()
+		check := func(name string, err error) {
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("%v with a canceled context returned %v, want an error wrapping context.Canceled", name, err)
+			}
+		}
+		prompt(t, "KV", func() {
+			_, _, err := kv.Get(ctx, "key")
+			check("Get", err)
+			check("Set", kv.Set(ctx, "key", []byte("value"), 0))
+			_, err = kv.Incr(ctx, "key", 1, 0)
+			check("Incr", err)
+			_, err = kv.CompareAndSwap(ctx, "key", nil, []byte("value"), 0)
+			check("CompareAndSwap", err)
+		})
+	})
+	t.Run("concurrent", func(t *testing.T) {
+		kv := newKV(t)
+		const increments = 50
+		parallel(func(int) {
+			for i := 0; i < increments; i++ {
+				if _, err := kv.Incr(ctx, "count", 1, 0); err != nil {
+					t.Errorf("concurrent Incr: %v", err)
+					return
+				}
+			}
+		})
+		if got, err := kv.Incr(ctx, "count", 0, 0); err != nil || got != concurrency*increments {
+			t.Errorf("Incr after concurrent increments returned %v, error %v; want %v", got, err, concurrency*increments)
+		}
+	})
+}
@@ -0,0 +1,152 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package extensiontest_test
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	tq "github.com/facebookincubator/tacquito"
+	"github.com/facebookincubator/tacquito/cmds/server/config"
+	"github.com/facebookincubator/tacquito/cmds/server/config/accounters/local"
+	"github.com/facebookincubator/tacquito/cmds/server/config/authenticators/bcrypt"
+	"github.com/facebookincubator/tacquito/cmds/server/config/authenticators/composite"
+	"github.com/facebookincubator/tacquito/cmds/server/config/authorizers/stringy"
+	"github.com/facebookincubator/tacquito/cmds/server/config/secret/prefix"
+	"github.com/facebookincubator/tacquito/cmds/server/handlers"
+	"github.com/facebookincubator/tacquito/cmds/server/test"
+	"github.com/facebookincubator/tacquito/extension"
+	"github.com/facebookincubator/tacquito/extension/extensiontest"
+	"github.com/facebookincubator/tacquito/prommetrics"
+	"github.com/facebookincubator/tacquito/tacquitotest"
+
+	"github.com/prometheus/client_golang/prometheus"
+	hasher "golang.org/x/crypto/bcrypt"
+)
+
+// the in-tree implementations run the suites as any other implementation would
+
+// logger logs nothing
+var logger = test.NewDefaultLogger(0)
+
+// request returns a new request of type t with body
+func request(t *testing.T, ht tq.HeaderType, body tq.EncoderDecoder) func() tq.Request {
+	b, err := body.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func() tq.Request {
+		return tq.Request{
+			Header:  *tq.NewHeader(tq.SetHeaderVersion(tq.Version{MajorVersion: tq.MajorVersion, MinorVersion: tq.MinorVersionOne}), tq.SetHeaderType(ht), tq.SetHeaderSeqNo(1), tq.SetHeaderSessionID(1)),
+			Body:    b,
+			Context: context.Background(),
+		}
+	}
+}
+
+// papStart returns a pap login of user with password
+func papStart(t *testing.T, user, password string) func() tq.Request {
+	return request(t, tq.Authenticate, tq.NewAuthenStart(
+		tq.SetAuthenStartAction(tq.AuthenActionLogin),
+		tq.SetAuthenStartPrivLvl(tq.PrivLvlUser),
+		tq.SetAuthenStartType(tq.AuthenTypePAP),
+		tq.SetAuthenStartService(tq.AuthenServiceLogin),
+		tq.SetAuthenStartUser(tq.AuthenUser(user)),
+		tq.SetAuthenStartPort("tty0"),
+		tq.SetAuthenStartData(tq.AuthenData(password)),
+	))
+}
+
+// bcryptOptions returns the options of a bcrypt authenticator for password
+func bcryptOptions(t *testing.T, password string) map[string]string {
+	hash, err := hasher.GenerateFromPassword([]byte(password), hasher.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]string{"hash": hex.EncodeToString(hash)}
+}
+
+func TestPrefixSecretProvider(t *testing.T) {
+	handler := tq.HandlerFunc(func(response tq.Response, request tq.Request) {})
+	secret := func(ctx context.Context, key string) ([]byte, error) { return []byte("fooman"), nil }
+	sc := extension.SecretConfig{Name: "conformance", Options: map[string]string{"prefixes": `["192.0.2.0/24"]`}}
+	p := prefix.New(logger).New(context.Background(), sc, handler, secret)
+	extensiontest.RunSecretProviderConformanceTests(t, p, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 49}, &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 49})
+}
+
+func TestStartHandler(t *testing.T) {
+	h := handlers.NewStart(logger).New(context.Background(), config.Provider{}, map[string]string{})
+	extensiontest.RunHandlerConformanceTests(t, h, papStart(t, "conformance", "password"))
+}
+
+func TestBcryptAuthenticator(t *testing.T) {
+	a := bcrypt.New(logger, nil)
+	extensiontest.RunAuthenticatorConformanceTests(t, a, "conformance", bcryptOptions(t, "password"), papStart(t, "conformance", "password"))
+}
+
+func TestCompositeAuthenticator(t *testing.T) {
+	a := composite.New(logger, composite.SetBackend("primary", bcrypt.New(logger, nil), 1))
+	extensiontest.RunAuthenticatorConformanceTests(t, a, "conformance", bcryptOptions(t, "password"), papStart(t, "conformance", "password"))
+}
+
+func TestStringyAuthorizer(t *testing.T) {
+	user := config.User{Name: "conformance", Services: []config.Service{{Name: "shell", SetValues: []config.Value{{Name: "priv-lvl", Values: []string{"15"}}}}}}
+	body := tq.NewAuthorRequest(
+		tq.SetAuthorRequestMethod(tq.AuthenMethodTacacsPlus),
+		tq.SetAuthorRequestPrivLvl(tq.PrivLvlUser),
+		tq.SetAuthorRequestType(tq.AuthenTypeASCII),
+		tq.SetAuthorRequestService(tq.AuthenServiceLogin),
+		tq.SetAuthorRequestUser("conformance"),
+		tq.SetAuthorRequestPort("tty0"),
+		tq.SetAuthorRequestArgs(tq.Args{"service=shell", "cmd="}),
+	)
+	extensiontest.RunAuthorizerConformanceTests(t, stringy.New(logger), user, request(t, tq.Authorize, body))
+}
+
+// discard is an accounting log that keeps nothing
+type discard struct{}
+
+func (discard) Printf(format string, args ...interface{}) {}
+
+func TestLocalAccounter(t *testing.T) {
+	a, err := local.New(logger, local.SetLogSink(discard{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := tq.NewAcctRequest(
+		tq.SetAcctRequestFlag(tq.AcctFlagStart),
+		tq.SetAcctRequestMethod(tq.AuthenMethodTacacsPlus),
+		tq.SetAcctRequestPrivLvl(tq.PrivLvlUser),
+		tq.SetAcctRequestType(tq.AuthenTypeASCII),
+		tq.SetAcctRequestService(tq.AuthenServiceLogin),
+		tq.SetAcctRequestUser("conformance"),
+		tq.SetAcctRequestPort("tty0"),
+		tq.SetAcctRequestArgs(tq.Args{"task_id=1", "service=shell"}),
+	)
+	extensiontest.RunAccounterConformanceTests(t, a, map[string]string{}, request(t, tq.Accounting, body))
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	extensiontest.RunMetricsConformanceTests(t, prommetrics.New(prometheus.NewRegistry()))
+}
+
+func TestLogger(t *testing.T) {
+	extensiontest.RunLoggerConformanceTests(t, logger)
+}
+
+func TestClocks(t *testing.T) {
+	extensiontest.RunClockConformanceTests(t, extension.ClockFunc(time.Now))
+	extensiontest.RunClockConformanceTests(t, tacquitotest.NewSources(t, 1, time.Millisecond))
+}
+
+func TestMemoryStore(t *testing.T) {
+	extensiontest.RunKVConformanceTests(t, func(t *testing.T) extension.KV { return tq.NewMemoryStore() })
+}
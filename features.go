@@ -0,0 +1,364 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Feature is a protocol feature whose use by devices is tracked by a FeatureTracker, to find the
+// devices a cleanup campaign still has to touch
+type Feature string
+
+const (
+	// FeatureUnencrypted is a packet with the unencrypted flag set
+	FeatureUnencrypted Feature = "flag-unencrypted"
+	// FeatureSingleConnect is a packet with the single-connect flag set
+	FeatureSingleConnect Feature = "flag-single-connect"
+	// FeatureNoSingleConnect is a connection whose first packet did not negotiate single-connect
+	FeatureNoSingleConnect Feature = "no-single-connect"
+	// FeatureMinorVersionDefault is a packet with the legacy minor version 0
+	FeatureMinorVersionDefault Feature = "minor-version-default"
+	// FeatureAuthenASCII and the others below are authentication starts by authen_type
+	FeatureAuthenASCII    Feature = "authen-ascii"
+	FeatureAuthenPAP      Feature = "authen-pap"
+	FeatureAuthenCHAP     Feature = "authen-chap"
+	FeatureAuthenARAP     Feature = "authen-arap"
+	FeatureAuthenMSCHAP   Feature = "authen-mschap"
+	FeatureAuthenMSCHAPV2 Feature = "authen-mschapv2"
+	FeatureAuthenOther    Feature = "authen-other"
+	// FeatureLengthQuirk is a packet read with the length delta of a LengthQuirkPolicy
+	FeatureLengthQuirk Feature = "quirk-length-delta"
+	// FeatureImplicitReuse is a session accepted by implicit session reuse, see SessionReusePolicy
+	FeatureImplicitReuse Feature = "quirk-implicit-session-reuse"
+)
+
+// authenFeatures maps the authen_type of an authentication start to its feature
+var authenFeatures = map[AuthenType]Feature{
+	AuthenTypeASCII:    FeatureAuthenASCII,
+	AuthenTypePAP:      FeatureAuthenPAP,
+	AuthenTypeCHAP:     FeatureAuthenCHAP,
+	AuthenTypeARAP:     FeatureAuthenARAP,
+	AuthenTypeMSCHAP:   FeatureAuthenMSCHAP,
+	AuthenTypeMSCHAPV2: FeatureAuthenMSCHAPV2,
+}
+
+// DefaultDeviceGroup is the group of devices whose handler does not implement DeviceGroupPolicy
+const DefaultDeviceGroup = "default"
+
+// DeviceGroupPolicy may be implemented by the Handler returned from a SecretProvider to name the
+// group of devices it serves, which feature usage is reported by
+type DeviceGroupPolicy interface {
+	DeviceGroup() string
+}
+
+// deviceGroup returns the group of the devices h serves
+func deviceGroup(h Handler) string {
+	if p, ok := h.(DeviceGroupPolicy); ok && p.DeviceGroup() != "" {
+		return p.DeviceGroup()
+	}
+	return DefaultDeviceGroup
+}
+
+// featureShards is how many independently locked shards a FeatureTracker spreads its writes over
+const featureShards = 16
+
+// FeatureUsage is when a feature was first and last seen
+type FeatureUsage struct {
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// merge widens u to include v
+func (u FeatureUsage) merge(v FeatureUsage) FeatureUsage {
+	if u.FirstSeen.IsZero() || v.FirstSeen.Before(u.FirstSeen) {
+		u.FirstSeen = v.FirstSeen
+	}
+	if v.LastSeen.After(u.LastSeen) {
+		u.LastSeen = v.LastSeen
+	}
+	return u
+}
+
+// GroupFeatures is the feature usage of a device group, and of its devices if they are tracked
+type GroupFeatures struct {
+	Features map[Feature]FeatureUsage            `json:"features"`
+	Devices  map[string]map[Feature]FeatureUsage `json:"devices,omitempty"`
+}
+
+// FeatureReport is the feature usage of every device group.  It is also the format of the state
+// file of FeatureTracker.Persist.
+type FeatureReport struct {
+	Groups map[string]GroupFeatures `json:"groups"`
+}
+
+// featureKey identifies one usage entry, device is empty for the entry of the whole group
+type featureKey struct {
+	group, device string
+	feature       Feature
+}
+
+// featureShard holds the entries of the groups and devices that hash to it
+type featureShard struct {
+	mu      sync.Mutex
+	usage   map[featureKey]FeatureUsage
+	devices map[featureKey]struct{}
+}
+
+// NewFeatureTracker returns a FeatureTracker.  Devices are tracked individually, besides their
+// group, until maxDevices are known; 0 only tracks groups.
+func NewFeatureTracker(maxDevices int) *FeatureTracker {
+	t := &FeatureTracker{maxShardDevices: (maxDevices + featureShards - 1) / featureShards}
+	for i := range t.shards {
+		t.shards[i] = &featureShard{usage: map[featureKey]FeatureUsage{}, devices: map[featureKey]struct{}{}}
+	}
+	return t
+}
+
+// FeatureTracker records when device groups, and optionally devices, first and last used the
+// protocol features cleanup campaigns are after, see SetFeatureTracker.  Records are spread over
+// shards so connections rarely contend, and are persisted by Persist off the request path.
+type FeatureTracker struct {
+	shards [featureShards]*featureShard
+	// maxShardDevices bounds the devices of each shard, so the bound over all shards is only
+	// reached if devices hash evenly
+	maxShardDevices int
+}
+
+// shard returns the shard of group and device
+func (t *FeatureTracker) shard(group, device string) *featureShard {
+	h := fnv.New32a()
+	h.Write([]byte(group))
+	h.Write([]byte{0})
+	h.Write([]byte(device))
+	return t.shards[h.Sum32()%featureShards]
+}
+
+// Record records that device, of group, used f at now
+func (t *FeatureTracker) Record(group, device string, f Feature, now time.Time) {
+	now = now.UTC()
+	t.record(featureKey{group: group, feature: f}, FeatureUsage{FirstSeen: now, LastSeen: now})
+	if device != "" && t.maxShardDevices > 0 {
+		t.record(featureKey{group: group, device: device, feature: f}, FeatureUsage{FirstSeen: now, LastSeen: now})
+	}
+}
+
+// record merges u into the entry of k, unless k is of a device over the device bound
+func (t *FeatureTracker) record(k featureKey, u FeatureUsage) {
+	s := t.shard(k.group, k.device)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, ok := s.usage[k]; ok {
+		s.usage[k] = existing.merge(u)
+		return
+	}
+	if k.device != "" {
+		device := featureKey{group: k.group, device: k.device}
+		if _, ok := s.devices[device]; !ok {
+			if len(s.devices) >= t.maxShardDevices {
+				featureDevicesDropped.Inc()
+				return
+			}
+			s.devices[device] = struct{}{}
+		}
+	}
+	s.usage[k] = u
+}
+
+// Report returns the feature usage recorded so far
+func (t *FeatureTracker) Report() FeatureReport {
+	r := FeatureReport{Groups: map[string]GroupFeatures{}}
+	for _, s := range t.shards {
+		s.mu.Lock()
+		for k, u := range s.usage {
+			g, ok := r.Groups[k.group]
+			if !ok {
+				g = GroupFeatures{Features: map[Feature]FeatureUsage{}}
+			}
+			if k.device == "" {
+				g.Features[k.feature] = u
+			} else {
+				if g.Devices == nil {
+					g.Devices = map[string]map[Feature]FeatureUsage{}
+				}
+				if g.Devices[k.device] == nil {
+					g.Devices[k.device] = map[Feature]FeatureUsage{}
+				}
+				g.Devices[k.device][k.feature] = u
+			}
+			r.Groups[k.group] = g
+		}
+		s.mu.Unlock()
+	}
+	return r
+}
+
+// Merge adds the usage of r, eg from the state file of a previous run, to t
+func (t *FeatureTracker) Merge(r FeatureReport) {
+	for group, g := range r.Groups {
+		for f, u := range g.Features {
+			t.record(featureKey{group: group, feature: f}, u)
+		}
+		if t.maxShardDevices == 0 {
+			continue
+		}
+		for device, features := range g.Devices {
+			for f, u := range features {
+				t.record(featureKey{group: group, device: device, feature: f}, u)
+			}
+		}
+	}
+}
+
+// Load merges the state file at path into t.  A missing file is not an error, there is no state
+// before the first run.
+func (t *FeatureTracker) Load(path string) error {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var r FeatureReport
+	if err := json.Unmarshal(b, &r); err != nil {
+		return err
+	}
+	t.Merge(r)
+	return nil
+}
+
+// Save writes the report of t to the state file at path.  The file is replaced in one rename, so
+// a crash while saving keeps the previous state.
+func (t *FeatureTracker) Save(path string) error {
+	b, err := json.Marshal(t.Report())
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Persist saves t to path every interval, and once more when ctx is done, before it returns.  An
+// interval of zero only saves when ctx is done.  Errors are logged to l and saving carries on.
+func (t *FeatureTracker) Persist(ctx context.Context, path string, interval time.Duration, l loggerProvider) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			t.persist(ctx, path, l)
+			return
+		case <-tick:
+			t.persist(ctx, path, l)
+		}
+	}
+}
+
+// persist saves t to path, logging an error to l
+func (t *FeatureTracker) persist(ctx context.Context, path string, l loggerProvider) {
+	if err := t.Save(path); err != nil {
+		l.Errorf(ctx, "unable to save feature usage to [%v]; %v", path, err)
+	}
+}
+
+// SetFeatureTracker records the protocol features each device group uses into t
+func SetFeatureTracker(t *FeatureTracker) Option {
+	return func(s *Server) {
+		s.features = t
+	}
+}
+
+// connFeatures records the features used on one connection, it is a no-op if nil
+type connFeatures struct {
+	tracker *FeatureTracker
+	clock   func() time.Time
+	group   string
+	device  string
+	started bool
+}
+
+// newConnFeatures returns the feature recorder of the connection of c, served by h, or nil if
+// features are not tracked
+func (s *Server) newConnFeatures(c *crypter, h Handler) *connFeatures {
+	if s.features == nil {
+		return nil
+	}
+	group := deviceGroup(h)
+	remote := c.RemoteAddr()
+	if c.source != nil {
+		remote = c.source
+	}
+	// the bare address, without the brackets of an ipv6 address with a port
+	device, _, err := net.SplitHostPort(remote.String())
+	if err != nil {
+		device = remote.String()
+	}
+	return &connFeatures{tracker: s.features, clock: s.clock, group: group, device: device}
+}
+
+// record records that the device of the connection used f
+func (c *connFeatures) record(f Feature) {
+	if c == nil {
+		return
+	}
+	c.tracker.Record(c.group, c.device, f, c.clock())
+}
+
+// packet records the features used by p, a decrypted packet read from the connection
+func (c *connFeatures) packet(p *Packet) {
+	if c == nil {
+		return
+	}
+	if !c.started {
+		c.started = true
+		if !p.Header.Flags.Has(SingleConnect) {
+			c.record(FeatureNoSingleConnect)
+		}
+	}
+	if p.Header.Flags.Has(SingleConnect) {
+		c.record(FeatureSingleConnect)
+	}
+	if p.Header.Flags.Has(UnencryptedFlag) {
+		c.record(FeatureUnencrypted)
+	}
+	if p.Header.Version.MinorVersion == MinorVersionDefault {
+		c.record(FeatureMinorVersionDefault)
+	}
+	// authen_type is the third byte of an authentication start, read in place so every packet
+	// need not be unmarshaled
+	if p.Header.Type == Authenticate && p.Header.SeqNo == 1 && len(p.Body) > 2 {
+		f, ok := authenFeatures[AuthenType(p.Body[2])]
+		if !ok {
+			f = FeatureAuthenOther
+		}
+		c.record(f)
+	}
+}
@@ -0,0 +1,218 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// featureTestHandler passes every authentication for the devices of group
+type featureTestHandler struct {
+	group string
+}
+
+func (h featureTestHandler) DeviceGroup() string {
+	return h.group
+}
+
+func (featureTestHandler) Handle(response Response, request Request) {
+	response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusPass)))
+}
+
+// featureTestStart is an authentication start of session id, using the given header flags,
+// minor version and authen_type
+func featureTestStart(id SessionID, flags HeaderFlag, minor uint8, atype AuthenType) *Packet {
+	return NewPacket(
+		SetPacketHeader(NewHeader(SetHeaderType(Authenticate), SetHeaderSeqNo(1), SetHeaderSessionID(id), SetHeaderFlag(flags),
+			SetHeaderVersion(Version{MajorVersion: MajorVersion, MinorVersion: minor}))),
+		SetPacketBodyUnsafe(NewAuthenStart(
+			SetAuthenStartAction(AuthenActionLogin),
+			SetAuthenStartPrivLvl(PrivLvlUser),
+			SetAuthenStartType(atype),
+			SetAuthenStartService(AuthenServiceLogin),
+			SetAuthenStartUser("cisco"),
+		)),
+	)
+}
+
+// featureTestClock advances a minute on every call
+type featureTestClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *featureTestClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(time.Minute)
+	return c.now
+}
+
+// featureTestExchange sends packets from device, served by h, on one connection of s
+func featureTestExchange(t *testing.T, s *Server, device string, h Handler, packets ...*Packet) {
+	client, server := net.Pipe()
+	sc := newCrypter(roleServer, []byte("fooman"), server, false)
+	sc.source = &net.TCPAddr{IP: net.ParseIP(device)}
+	done := make(chan struct{})
+	go func() {
+		s.handle(context.Background(), sc, h)
+		close(done)
+	}()
+	c := newCrypter(roleClient, []byte("fooman"), client, false)
+	for _, p := range packets {
+		_, err := c.write(p)
+		require.NoError(t, err)
+		reply, err := c.read()
+		require.NoError(t, err)
+		require.Equal(t, p.Header.SessionID, reply.Header.SessionID)
+	}
+	client.Close()
+	<-done
+}
+
+// features returns the features of usage, sorted
+func features(usage map[Feature]FeatureUsage) []Feature {
+	var fs []Feature
+	for f := range usage {
+		fs = append(fs, f)
+	}
+	sort.Slice(fs, func(i, j int) bool { return fs[i] < fs[j] })
+	return fs
+}
+
+func TestFeatureTrackerMixedFleet(t *testing.T) {
+	tracker := NewFeatureTracker(100)
+	clock := &featureTestClock{now: time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)}
+	s := NewServer(nopLogger{}, nil, SetFeatureTracker(tracker), SetClock(clock.Now), SetImplicitSessionReuse(true))
+
+	core, legacy := featureTestHandler{group: "core"}, featureTestHandler{group: "legacy"}
+	// a modern device multiplexing sessions over single-connect
+	featureTestExchange(t, s, "2001:db8::1", core,
+		featureTestStart(1, SingleConnect, MinorVersionDefault, AuthenTypeASCII),
+		featureTestStart(2, SingleConnect, MinorVersionDefault, AuthenTypeASCII),
+	)
+	// a device that never negotiates single-connect
+	featureTestExchange(t, s, "2001:db8::2", core,
+		featureTestStart(3, 0, MinorVersionOne, AuthenTypePAP),
+	)
+	// a legacy device sending cleartext and reusing its connection without single-connect
+	featureTestExchange(t, s, "2001:db8::3", legacy,
+		featureTestStart(4, UnencryptedFlag, MinorVersionOne, AuthenTypePAP),
+		featureTestStart(5, UnencryptedFlag, MinorVersionOne, AuthenTypePAP),
+	)
+	// a device whose handler names no group
+	featureTestExchange(t, s, "2001:db8::4", maintenanceHandler(),
+		featureTestStart(6, 0, MinorVersionOne, AuthenType(0x99)),
+	)
+
+	report := tracker.Report()
+	require.Len(t, report.Groups, 3)
+	assert.Equal(t, []Feature{FeatureAuthenASCII, FeatureAuthenPAP, FeatureSingleConnect, FeatureMinorVersionDefault, FeatureNoSingleConnect}, features(report.Groups["core"].Features))
+	assert.Equal(t, []Feature{FeatureAuthenPAP, FeatureUnencrypted, FeatureNoSingleConnect, FeatureImplicitReuse}, features(report.Groups["legacy"].Features))
+	assert.Equal(t, []Feature{FeatureAuthenOther, FeatureNoSingleConnect}, features(report.Groups[DefaultDeviceGroup].Features))
+
+	devices := report.Groups["core"].Devices
+	require.Len(t, devices, 2)
+	assert.Equal(t, []Feature{FeatureAuthenASCII, FeatureSingleConnect, FeatureMinorVersionDefault}, features(devices["2001:db8::1"]))
+	assert.Equal(t, []Feature{FeatureAuthenPAP, FeatureNoSingleConnect}, features(devices["2001:db8::2"]))
+	// both sessions of the first device are covered
+	ascii := devices["2001:db8::1"][FeatureAuthenASCII]
+	assert.True(t, ascii.FirstSeen.Before(ascii.LastSeen), "%+v", ascii)
+	// the group spans its devices
+	pap := report.Groups["core"].Features[FeatureAuthenPAP]
+	assert.Equal(t, devices["2001:db8::2"][FeatureAuthenPAP], pap)
+	assert.True(t, report.Groups["core"].Features[FeatureAuthenASCII].FirstSeen.Before(pap.FirstSeen))
+}
+
+// maintenanceHandler is the handler of maintenanceSecretProvider, which names no device group
+func maintenanceHandler() Handler {
+	_, h, _ := maintenanceSecretProvider{}.Get(context.Background(), nil)
+	return h
+}
+
+func TestFeatureTrackerDeviceBound(t *testing.T) {
+	now := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	tracker := NewFeatureTracker(featureShards)
+	for i := 0; i < 10*featureShards; i++ {
+		tracker.Record("core", fmt.Sprintf("192.0.2.%v", i), FeatureAuthenPAP, now)
+	}
+	report := tracker.Report()
+	assert.Contains(t, report.Groups["core"].Features, FeatureAuthenPAP)
+	assert.NotEmpty(t, report.Groups["core"].Devices)
+	assert.LessOrEqual(t, len(report.Groups["core"].Devices), featureShards)
+
+	// groups are still tracked without devices
+	tracker = NewFeatureTracker(0)
+	tracker.Record("core", "192.0.2.1", FeatureAuthenPAP, now)
+	report = tracker.Report()
+	assert.Contains(t, report.Groups["core"].Features, FeatureAuthenPAP)
+	assert.Empty(t, report.Groups["core"].Devices)
+}
+
+func TestFeatureTrackerPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "features.json")
+	first := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	tracker := NewFeatureTracker(10)
+	tracker.Record("core", "192.0.2.1", FeatureAuthenPAP, first)
+	tracker.Record("core", "192.0.2.1", FeatureAuthenPAP, first.Add(time.Hour))
+	tracker.Record("legacy", "192.0.2.2", FeatureUnencrypted, first.In(time.FixedZone("PDT", -7*3600)))
+
+	// saved once ctx is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tracker.Persist(ctx, path, 0, nopLogger{})
+
+	loaded := NewFeatureTracker(10)
+	require.NoError(t, loaded.Load(path))
+	assert.Equal(t, tracker.Report(), loaded.Report())
+
+	// usage recorded after a restart widens the loaded usage
+	loaded.Record("core", "192.0.2.1", FeatureAuthenPAP, first.Add(2*time.Hour))
+	require.NoError(t, loaded.Save(path))
+	reloaded := NewFeatureTracker(10)
+	require.NoError(t, reloaded.Load(path))
+	assert.Equal(t, FeatureUsage{FirstSeen: first, LastSeen: first.Add(2 * time.Hour)}, reloaded.Report().Groups["core"].Devices["192.0.2.1"][FeatureAuthenPAP])
+
+	// there is no state before the first run
+	assert.NoError(t, NewFeatureTracker(10).Load(filepath.Join(t.TempDir(), "missing.json")))
+}
+
+// groupContextHandler keeps the ContextDeviceGroup of the requests of the devices of group
+type groupContextHandler struct {
+	featureTestHandler
+	seen chan string
+}
+
+func (h groupContextHandler) Handle(response Response, request Request) {
+	h.seen <- deviceGroupOf(request)
+	h.featureTestHandler.Handle(response, request)
+}
+
+func TestContextDeviceGroup(t *testing.T) {
+	s := NewServer(nopLogger{}, nil)
+	for _, test := range []struct {
+		h    Handler
+		want string
+	}{
+		{h: groupContextHandler{featureTestHandler: featureTestHandler{group: "core"}, seen: make(chan string, 1)}, want: "core"},
+		{h: groupContextHandler{seen: make(chan string, 1)}, want: DefaultDeviceGroup},
+	} {
+		featureTestExchange(t, s, "2001:db8::1", test.h, featureTestStart(1, 0, MinorVersionOne, AuthenTypePAP))
+		assert.Equal(t, test.want, <-test.h.(groupContextHandler).seen)
+	}
+}
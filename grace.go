@@ -0,0 +1,78 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"time"
+)
+
+// SetSecretGracePeriod sets how long a connection may keep using a secret once it was removed or
+// rotated out of the SecretProvider.  The secret of a connection is resolved when it is accepted;
+// with a grace period set it is resolved again for every packet.  Once it no longer matches,
+// sessions in flight have the grace period to complete, new sessions on the connection are
+// refused and the connection is closed as soon as nothing is in flight, or when the grace period
+// passes.  New connections never get the removed secret.  A value of zero, the default, keeps the
+// secret of a connection until it closes.
+func SetSecretGracePeriod(v time.Duration) Option {
+	return func(s *Server) {
+		s.secretGrace = v
+	}
+}
+
+// connSecret tracks if the secret of a connection is still served by the SecretProvider
+type connSecret struct {
+	s      *Server
+	c      *crypter
+	remote net.Addr
+	// until is when the grace period of a removed secret ends, zero while the secret is current
+	until time.Time
+}
+
+// newConnSecret returns the secret tracking of c, which is served under remote
+func (s *Server) newConnSecret(c *crypter) *connSecret {
+	remote := c.RemoteAddr()
+	if c.source != nil {
+		remote = c.source
+	}
+	return &connSecret{s: s, c: c, remote: remote}
+}
+
+// check resolves the secret of the connection again, starting the grace period if it is gone
+func (g *connSecret) check(ctx context.Context) {
+	if g.s.secretGrace <= 0 || !g.until.IsZero() {
+		return
+	}
+	secret, _, err := g.s.providerOf(g.c).Get(ctx, g.remote)
+	if err == nil && bytes.Equal(secret, g.c.secret) {
+		return
+	}
+	g.until = time.Now().Add(g.s.secretGrace)
+	serveSecretGrace.Inc()
+	g.s.Infof(ctx, "secret of connection from [%v] was removed, in flight sessions have until [%v] to complete", g.remote, g.until)
+}
+
+// revoked reports if the secret of the connection was removed
+func (g *connSecret) revoked() bool {
+	return !g.until.IsZero()
+}
+
+// expired reports if the grace period of a removed secret has passed
+func (g *connSecret) expired() bool {
+	return g.revoked() && !time.Now().Before(g.until)
+}
+
+// deadline returns the read deadline d, moved up to the end of the grace period
+func (g *connSecret) deadline(d time.Time) time.Time {
+	if g.revoked() && g.until.Before(d) {
+		return g.until
+	}
+	return d
+}
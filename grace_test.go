@@ -0,0 +1,136 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rotatingSecretProvider serves a secret that may be removed
+type rotatingSecretProvider struct {
+	mu      sync.Mutex
+	secret  []byte
+	handler Handler
+}
+
+func (p *rotatingSecretProvider) Get(ctx context.Context, remote net.Addr) ([]byte, Handler, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.secret == nil {
+		return nil, nil, fmt.Errorf("no secret for [%v]", remote)
+	}
+	return p.secret, p.handler, nil
+}
+
+func (p *rotatingSecretProvider) remove() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.secret = nil
+}
+
+func TestSecretGracePeriod(t *testing.T) {
+	sp := &rotatingSecretProvider{secret: []byte("fooman"), handler: askUserHandler(AuthenStatusPass)}
+	reasons := make(chan CloseReason, 2)
+	s := NewServer(nopLogger{}, sp, SetSecretGracePeriod(time.Second), SetOnClose(func(ctx context.Context, remote net.Addr, reason CloseReason) {
+		reasons <- reason
+	}))
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Serve(ctx, listener.(*net.TCPListener))
+
+	c, err := NewClient(SetClientDialer("tcp6", listener.Addr().String(), []byte("fooman")))
+	require.NoError(t, err)
+	defer c.Close()
+	start := proxyTestPacket()
+	resp, err := c.Send(start)
+	require.NoError(t, err)
+	var reply AuthenReply
+	require.NoError(t, Unmarshal(resp.Body, &reply))
+	assert.Equal(t, AuthenStatusGetUser, reply.Status)
+
+	// the secret is rotated out while the login is in flight, which still completes
+	sp.remove()
+	cont := NewPacket(
+		SetPacketHeader(NewHeader(SetHeaderType(Authenticate), SetHeaderSeqNo(3), SetHeaderSessionID(start.Header.SessionID), SetHeaderVersion(start.Header.Version))),
+		SetPacketBodyUnsafe(NewAuthenContinue(SetAuthenContinueUserMessage("cisco"))),
+	)
+	resp, err = c.Send(cont)
+	require.NoError(t, err)
+	require.NoError(t, Unmarshal(resp.Body, &reply))
+	assert.Equal(t, AuthenStatusPass, reply.Status)
+
+	select {
+	case reason := <-reasons:
+		assert.Equal(t, CloseSecretRevoked, reason)
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection was not closed once its session completed")
+	}
+
+	// a new connection does not get the removed secret
+	next, err := NewClient(SetClientDialer("tcp6", listener.Addr().String(), []byte("fooman")))
+	require.NoError(t, err)
+	defer next.Close()
+	_, err = next.Send(proxyTestPacket())
+	assert.Error(t, err)
+	assert.Equal(t, CloseUnknownDevice, <-reasons)
+}
+
+// promptHandler asks for a username forever
+func promptHandler() HandlerFunc {
+	return func(response Response, request Request) {
+		response.Next(promptHandler())
+		response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusGetUser)))
+	}
+}
+
+func TestSecretGracePeriodExpires(t *testing.T) {
+	sp := &rotatingSecretProvider{secret: []byte("fooman"), handler: promptHandler()}
+	reasons := make(chan CloseReason, 1)
+	s := NewServer(nopLogger{}, sp, SetSecretGracePeriod(50*time.Millisecond), SetOnClose(func(ctx context.Context, remote net.Addr, reason CloseReason) {
+		reasons <- reason
+	}))
+	client, server := net.Pipe()
+	defer client.Close()
+	go s.handle(context.Background(), newCrypter(roleServer, []byte("fooman"), server, false), sp.handler)
+
+	c := newCrypter(roleClient, []byte("fooman"), client, false)
+	start := proxyTestPacket()
+	_, err := c.write(start)
+	require.NoError(t, err)
+	_, err = c.read()
+	require.NoError(t, err)
+
+	// the removed secret is noticed on the next packet, which is still served
+	sp.remove()
+	cont := NewPacket(
+		SetPacketHeader(NewHeader(SetHeaderType(Authenticate), SetHeaderSeqNo(3), SetHeaderSessionID(start.Header.SessionID), SetHeaderVersion(start.Header.Version))),
+		SetPacketBodyUnsafe(NewAuthenContinue(SetAuthenContinueUserMessage("cisco"))),
+	)
+	_, err = c.write(cont)
+	require.NoError(t, err)
+	_, err = c.read()
+	require.NoError(t, err)
+
+	// the device never finishes its login, so the connection is purged with the grace period
+	select {
+	case reason := <-reasons:
+		assert.Equal(t, CloseSecretRevoked, reason)
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection was not closed once the grace period passed")
+	}
+}
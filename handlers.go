@@ -9,7 +9,10 @@ package tacquito
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"strings"
+	"sync/atomic"
 )
 
 // response implements the Response interface.  when testing handlers, provide your own
@@ -23,13 +26,90 @@ type response struct {
 	header Header
 	// slice of writers to write back the response
 	writers []io.Writer
+	// written is set once a packet was written
+	written bool
+	// profile renders the message of a Denial
+	profile MessageProfile
+	// user is the user of the session and identity reports it in metrics, see SetMetricsIdentity
+	user     string
+	identity IdentityObfuscator
+	// tally records the metrics of the request, see requestTally
+	tally *requestTally
+	// seqNo is the sequence number of the last packet of the session, which a reply must be past
+	seqNo SequenceNumber
+	// released is set, atomically, once the server moved on from the request.  The connection then
+	// belongs to the next request, so the response may not write to it.
+	released int32
+	// peer, if set, reports if the device went away while the request was handled
+	peer *peerWatch
 }
 
 // Reply will write the provided EncoderDecoder to the underlying net.Conn.  This method handles
 // all header values based on the underlying EncoderDecoder.  If you want total control on the
 // packet that is written, use Send instead.
 func (r *response) Reply(v EncoderDecoder) (int, error) {
-	seqNo := int(r.header.SeqNo)
+	return r.reply(v, originHandler)
+}
+
+// synthesize replies on behalf of the server, eg when a handler timed out without replying
+func (r *response) synthesize(v EncoderDecoder) (int, error) {
+	return r.reply(v, originServer)
+}
+
+func (r *response) reply(v EncoderDecoder, origin string) (int, error) {
+	p, err := r.packet(r.header, v)
+	if err != nil {
+		r.Errorf(r.ctx, "unable to marshal packet; %v", err)
+		return 0, err
+	}
+	r.header = *p.Header
+	r.tee(p)
+	return r.write(p, origin)
+}
+
+// ReplyBatch replies with the authentication replies vs in a single packet, eg a banner and the
+// prompt that follows it, so a device receives them together.  A device answers every reply it
+// reads, so only the last reply is sent, carrying the server messages of the replies before it
+// ahead of its own, one per line.  Every reply but the last must continue the session, eg a
+// GETDATA banner before a GETUSER prompt.  If the replies cannot be joined into a reply that
+// marshals, eg a server message longer than the field allows, nothing is written.
+func (r *response) ReplyBatch(vs ...EncoderDecoder) (int, error) {
+	if len(vs) == 0 {
+		return 0, nil
+	}
+	msgs := make([]string, 0, len(vs))
+	for i, v := range vs {
+		reply, ok := v.(*AuthenReply)
+		if !ok {
+			err := fmt.Errorf("reply [%v] of the batch is a %T, only authentication replies are batched", i, v)
+			r.Errorf(r.ctx, "%v", err)
+			return 0, err
+		}
+		switch reply.Status {
+		case AuthenStatusGetData, AuthenStatusGetUser, AuthenStatusGetPass:
+		default:
+			if i < len(vs)-1 {
+				err := fmt.Errorf("reply [%v] of the batch ends the session, only the last reply may", i)
+				r.Errorf(r.ctx, "%v", err)
+				return 0, err
+			}
+		}
+		if reply.ServerMsg != "" {
+			msgs = append(msgs, string(reply.ServerMsg))
+		}
+	}
+	last := *vs[len(vs)-1].(*AuthenReply)
+	last.ServerMsg = AuthenServerMsg(strings.Join(msgs, "\n"))
+	return r.reply(&last, originHandler)
+}
+
+// packet builds the packet of the reply v to the packet with header h
+func (r *response) packet(h Header, v EncoderDecoder) (*Packet, error) {
+	if d, ok := v.(*Denial); ok {
+		countDenial(r.tally, r.identity, d, r.user)
+		v = d.Reply(r.profile)
+	}
+	seqNo := int(h.SeqNo)
 	// some special conditions for different body types
 	switch t := v.(type) {
 	case *AuthenReply:
@@ -41,38 +121,111 @@ func (r *response) Reply(v EncoderDecoder) (int, error) {
 	default:
 		seqNo++
 	}
+	// the flags, and so the obfuscation, of the request are kept, see obfuscation
 	header := NewHeader(
-		SetHeaderVersion(r.header.Version),
-		SetHeaderType(r.header.Type),
+		SetHeaderVersion(h.Version),
+		SetHeaderType(h.Type),
 		SetHeaderSeqNo(seqNo),
-		SetHeaderFlag(r.header.Flags),
-		SetHeaderSessionID(r.header.SessionID),
+		SetHeaderFlag(h.Flags),
+		SetHeaderSessionID(h.SessionID),
 	)
 	b, err := v.MarshalBinary()
 	if err != nil {
-		r.Errorf(r.ctx, "unable to marshal packet; %v", err)
-		return 0, err
+		return nil, err
 	}
-	r.header = *header
-	p := NewPacket(
+	return NewPacket(
 		SetPacketHeader(header),
 		SetPacketBody(b),
-	)
-	if pbytes, err := p.MarshalBinary(); err == nil {
-		for _, mw := range r.writers {
-			_, err := mw.Write(pbytes)
-			if err != nil {
-				r.Errorf(r.ctx, "unable to write to response writer; %v", err)
-			}
+	), nil
+}
+
+// tee writes the clear text packet p to the registered writers
+func (r *response) tee(p *Packet) {
+	pbytes, err := p.MarshalBinary()
+	if err != nil {
+		return
+	}
+	for _, mw := range r.writers {
+		if _, err := mw.Write(pbytes); err != nil {
+			r.Errorf(r.ctx, "unable to write to response writer; %v", err)
 		}
 	}
-	return r.Write(p)
 }
 
 // Write will write the packet to the underlying net.Conn.  If you are expecting another packet
 // to return from the client after writing a response, call Next(handler) to provide a next Handler.
 func (r *response) Write(p *Packet) (int, error) {
-	return r.crypter.write(p)
+	return r.write(p, originHandler)
+}
+
+func (r *response) write(p *Packet, origin string) (int, error) {
+	if err := r.writable(p); err != nil {
+		return 0, err
+	}
+	r.written = true
+	// the request is answered, so what was observed reading and deciding it is committed before
+	// the device can see the reply.  the reply itself is committed before the next read.
+	r.tally.commit()
+	n, err := r.crypter.writeReply(r.obfuscation(p), origin)
+	r.peer.wrote(err)
+	if err == nil && p != nil && p.Header != nil {
+		r.seqNo = p.Header.SeqNo
+	}
+	return n, err
+}
+
+// writable checks the invariants of writing the packet p through r.  A response the server
+// released is refused.  A sequence number that does not advance the session is counted, but the
+// packet is still written, as the device is the better judge of it.  A reply to a device that went
+// away, eg from a handler that replies after its context was cancelled, is counted and dropped
+// with ErrPeerDisconnected.
+func (r *response) writable(p *Packet) error {
+	if r.peer.disconnected() {
+		handlerPeerDisconnected.WithLabelValues("reply_dropped").Inc()
+		return ErrPeerDisconnected
+	}
+	if atomic.LoadInt32(&r.released) != 0 {
+		violated(r.ctx, r.loggerProvider, invariantReplyAfterRelease, "[%v] a reply was written after the server released the response", r.header.SessionID)
+		return fmt.Errorf("[%v] the response was released, the session has moved on", r.header.SessionID)
+	}
+	if p != nil && p.Header != nil && p.Header.SeqNo <= r.seqNo && !restarts(p) {
+		violated(r.ctx, r.loggerProvider, invariantStaleSeqNo, "[%v] a reply with seq [%v] after seq [%v]", p.Header.SessionID, p.Header.SeqNo, r.seqNo)
+	}
+	return nil
+}
+
+// restarts reports if p is the clear text authentication reply that restarts its session, the one
+// reply that takes the session back to seq 1
+func restarts(p *Packet) bool {
+	return p.Header.Type == Authenticate && p.Header.SeqNo == 1 && len(p.Body) > 0 && AuthenStatus(p.Body[0]) == AuthenStatusRestart
+}
+
+// obfuscation returns p with the obfuscation of the request it answers.  A reply to a request
+// sent with UnencryptedFlag is sent with it too, and a reply to an obfuscated request is
+// obfuscated, whatever flags the handler set.  p is copied rather than modified if its flag has to
+// change.
+func (r *response) obfuscation(p *Packet) *Packet {
+	if p == nil || p.Header == nil {
+		return p
+	}
+	want := r.header.Flags & UnencryptedFlag
+	if p.Header.Flags&UnencryptedFlag == want {
+		return p
+	}
+	h := *p.Header
+	h.Flags = h.Flags&^UnencryptedFlag | want
+	return &Packet{Header: &h, Body: p.Body}
+}
+
+// errorReply returns an error reply body for packet type t
+func errorReply(t HeaderType, msg string) EncoderDecoder {
+	switch t {
+	case Authorize:
+		return NewAuthorReply(SetAuthorReplyStatus(AuthorStatusError), SetAuthorReplyServerMsg(msg))
+	case Accounting:
+		return NewAcctReply(SetAcctReplyStatus(AcctReplyStatusError), SetAcctReplyServerMsg(msg))
+	}
+	return NewAuthenReply(SetAuthenReplyStatus(AuthenStatusError), SetAuthenReplyServerMsg(msg))
 }
 
 // Next sets the incoming handler to next. This is only used for exchange sequences within the authenticate
@@ -94,6 +247,13 @@ type Response interface {
 	RegisterWriter(io.Writer)
 }
 
+// BatchReplier is implemented by the Response the server passes to handlers.  ReplyBatch sends
+// several authentication replies as one, see response.ReplyBatch.  Middleware that wraps a Response
+// may not implement it, so handlers should fall back to Reply when it is missing.
+type BatchReplier interface {
+	ReplyBatch(vs ...EncoderDecoder) (int, error)
+}
+
 // Request provides access to the config for this net.Conn and also the packet itself
 type Request struct {
 	Header  Header
@@ -101,6 +261,13 @@ type Request struct {
 	Context context.Context
 }
 
+// Snapshot returns a copy of r with a Body of its own, which later changes to the Body of r do not
+// affect
+func (r Request) Snapshot() Request {
+	r.Body = append([]byte(nil), r.Body...)
+	return r
+}
+
 // Fields will extract all fields from any packet type and attempt to include any optional
 // ContextKey values
 func (r Request) Fields(keys ...ContextKey) map[string]string {
@@ -170,6 +337,12 @@ func (r Request) Fields(keys ...ContextKey) map[string]string {
 }
 
 // Handler form the basis for the state machine during client server exchanges.
+//
+// The Body of a Request is shared with the middleware that observe it, eg audit records, a Tee or
+// a Tracer, and is owned by the server.  Handlers must not modify it; a handler that needs to
+// normalize a request should decode it, or work on a Snapshot.  Middleware that observe a request
+// after calling the next handler must take a Snapshot before calling it.  The ConformanceChecker
+// reports handlers that modify a request as an ownership violation.
 type Handler interface {
 	Handle(response Response, request Request)
 }
@@ -121,7 +121,7 @@ func (h *Header) Validate() error {
 	}
 	// manually validate Length since it's not a Field interface
 	if h.Length > MaxBodyLength {
-		return fmt.Errorf("length field is too large, max size is 2^(16)")
+		return &LengthError{Field: "body", Length: int64(h.Length), Max: int64(MaxBodyLength)}
 	}
 	return nil
 }
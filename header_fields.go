@@ -111,10 +111,18 @@ const (
 	Accounting HeaderType = 0x03
 )
 
-// Validate characterics of type based on rfc and usage.
-func (t HeaderType) Validate(condition interface{}) error {
+// IsKnown reports if t is one of the values defined by the rfc
+func (t HeaderType) IsKnown() bool {
 	switch t {
 	case Authenticate, Authorize, Accounting:
+		return true
+	}
+	return false
+}
+
+// Validate characterics of type based on rfc and usage.
+func (t HeaderType) Validate(condition interface{}) error {
+	if t.IsKnown() {
 		return nil
 	}
 	return fmt.Errorf("unknown HeaderType value [%v]", t)
@@ -135,7 +143,7 @@ func (t HeaderType) String() string {
 	case Accounting:
 		return "Accounting"
 	}
-	return fmt.Sprintf("unknown HeaderType[%d]", uint8(t))
+	return unknownValue(uint8(t))
 }
 
 // SequenceNumber is the sequence number of the current packet.  The first packet
@@ -240,5 +248,13 @@ func (b HeaderFlag) String() string {
 	if b.Has(SingleConnect) {
 		flags = append(flags, "SingleConnect")
 	}
+	if !b.IsKnown() {
+		flags = append(flags, unknownValue(uint8(b&^(UnencryptedFlag|SingleConnect))))
+	}
 	return strings.Join(flags, "|")
 }
+
+// IsKnown reports if b has no bits set other than those defined by the rfc
+func (b HeaderFlag) IsKnown() bool {
+	return b&^(UnencryptedFlag|SingleConnect) == 0
+}
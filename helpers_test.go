@@ -0,0 +1,151 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type nopLogger struct{}
+
+func (nopLogger) Infof(ctx context.Context, format string, args ...interface{})      {}
+func (nopLogger) Errorf(ctx context.Context, format string, args ...interface{})     {}
+func (nopLogger) Debugf(ctx context.Context, format string, args ...interface{})     {}
+func (nopLogger) Record(ctx context.Context, r map[string]string, obscure ...string) {}
+
+// recordLogger keeps audit records
+type recordLogger struct {
+	nopLogger
+	mu      sync.Mutex
+	records []map[string]string
+}
+
+func (l *recordLogger) Record(ctx context.Context, r map[string]string, obscure ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records = append(l.records, r)
+}
+
+// sourceSecretProvider only knows a single source address
+type sourceSecretProvider struct {
+	source string
+	secret []byte
+}
+
+func (p sourceSecretProvider) Get(ctx context.Context, remote net.Addr) ([]byte, Handler, error) {
+	addr, ok := remote.(*net.TCPAddr)
+	if !ok || addr.IP.String() != p.source {
+		return nil, nil, fmt.Errorf("no secret for [%v]", remote)
+	}
+	return p.secret, HandlerFunc(func(response Response, request Request) {
+		// the reply names the device the request came from
+		device, _ := request.Context.Value(ContextConnRemoteAddr).(string)
+		response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusPass), SetAuthenReplyServerMsg(device)))
+	}), nil
+}
+
+// proxyTestPacket returns a PAP login
+func proxyTestPacket() *Packet {
+	return NewPacket(
+		SetPacketHeader(NewHeader(SetHeaderType(Authenticate), SetHeaderSessionID(12345),
+			SetHeaderVersion(Version{MajorVersion: MajorVersion, MinorVersion: MinorVersionOne}))),
+		SetPacketBodyUnsafe(NewAuthenStart(
+			SetAuthenStartAction(AuthenActionLogin),
+			SetAuthenStartPrivLvl(PrivLvlUser),
+			SetAuthenStartType(AuthenTypePAP),
+			SetAuthenStartService(AuthenServiceLogin),
+			SetAuthenStartUser("cisco"),
+			SetAuthenStartPort("tty0"),
+			SetAuthenStartRemAddr("foo"),
+			SetAuthenStartData("cisco"),
+		)),
+	)
+}
+
+// outcomeTestRequest returns a request of type t, an AuthenStart for any type but Authorize and
+// Accounting
+func outcomeTestRequest(t HeaderType) *Packet {
+	h := NewHeader(SetHeaderType(t), SetHeaderSeqNo(1), SetHeaderSessionID(12345),
+		SetHeaderVersion(Version{MajorVersion: MajorVersion, MinorVersion: MinorVersionDefault}))
+	switch t {
+	case Authorize:
+		return NewPacket(SetPacketHeader(h), SetPacketBodyUnsafe(NewAuthorRequest(
+			SetAuthorRequestMethod(AuthenMethodTacacsPlus),
+			SetAuthorRequestPrivLvl(PrivLvlRoot),
+			SetAuthorRequestType(AuthenTypeASCII),
+			SetAuthorRequestService(AuthenServiceLogin),
+			SetAuthorRequestUser("cisco"),
+			SetAuthorRequestArgs(Args{"service=shell", "cmd=reload"}),
+		)))
+	case Accounting:
+		return NewPacket(SetPacketHeader(h), SetPacketBodyUnsafe(NewAcctRequest(
+			SetAcctRequestFlag(AcctFlagStart),
+			SetAcctRequestMethod(AuthenMethodTacacsPlus),
+			SetAcctRequestPrivLvl(PrivLvlRoot),
+			SetAcctRequestType(AuthenTypeASCII),
+			SetAcctRequestService(AuthenServiceLogin),
+			SetAcctRequestUser("cisco"),
+			SetAcctRequestArgs(Args{"service=shell", "cmd=show"}),
+		)))
+	}
+	return proxyTestPacket()
+}
+
+// lengthQuirkTestCrypter returns a server crypter that corrects a length quirk of delta
+func lengthQuirkTestCrypter(conn net.Conn, delta int) *crypter {
+	c := newCrypter(roleServer, []byte("fooman"), conn, false)
+	c.lengthQuirk = &lengthQuirk{delta: delta, budget: 50 * time.Millisecond}
+	return c
+}
+
+// authenStatusHandler replies with status
+func authenStatusHandler(status AuthenStatus) HandlerFunc {
+	return func(response Response, request Request) {
+		response.Reply(NewAuthenReply(SetAuthenReplyStatus(status)))
+	}
+}
+
+// askUserHandler asks for a username, then replies with status
+func askUserHandler(status AuthenStatus) HandlerFunc {
+	return func(response Response, request Request) {
+		response.Next(authenStatusHandler(status))
+		response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusGetUser)))
+	}
+}
+
+// teeExchange sends packets to a server using h and returns the status of each reply
+func teeExchange(t *testing.T, h Handler, packets ...*Packet) []AuthenStatus {
+	s := NewServer(nopLogger{}, nil)
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.handle(context.Background(), newCrypter(roleServer, []byte("fooman"), server, false), h)
+		close(done)
+	}()
+	c := newCrypter(roleClient, []byte("fooman"), client, false)
+	var statuses []AuthenStatus
+	for _, p := range packets {
+		_, err := c.write(p)
+		assert.NoError(t, err)
+		resp, err := c.read()
+		assert.NoError(t, err)
+		var body AuthenReply
+		assert.NoError(t, Unmarshal(resp.Body, &body))
+		statuses = append(statuses, body.Status)
+	}
+	client.Close()
+	<-done
+	return statuses
+}
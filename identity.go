@@ -0,0 +1,226 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+)
+
+// IdentityObfuscator maps a username to the identity reported in its place wherever a raw username
+// would become a metric label or an event field.  Audit records always keep the raw username.
+type IdentityObfuscator interface {
+	Obfuscate(user string) string
+}
+
+// IdentityOther is the identity of the users a BucketIdentity does not report exactly
+const IdentityOther = "other"
+
+// IdentityUnknown is reported for requests whose user is not known, eg an ascii login denied
+// before the device sent the username
+const IdentityUnknown = "unknown"
+
+// NewIdentityObfuscator returns the IdentityObfuscator of mode, one of passthrough, hmac or bucket.
+// key is the key of hmac and k the number of users bucket reports exactly.
+func NewIdentityObfuscator(mode string, key []byte, k int) (IdentityObfuscator, error) {
+	switch mode {
+	case "passthrough":
+		return PassthroughIdentity{}, nil
+	case "hmac":
+		if len(key) == 0 {
+			return nil, fmt.Errorf("identity mode hmac requires a key")
+		}
+		return NewHMACIdentity(key), nil
+	case "bucket":
+		if k <= 0 {
+			return nil, fmt.Errorf("identity mode bucket requires a positive k, got [%v]", k)
+		}
+		return NewBucketIdentity(k), nil
+	}
+	return nil, fmt.Errorf("unknown identity mode [%v], expected passthrough, hmac or bucket", mode)
+}
+
+// PassthroughIdentity reports every username as is.  It is meant for labs, where neither
+// cardinality nor privacy is a concern.
+type PassthroughIdentity struct{}
+
+// Obfuscate returns user
+func (PassthroughIdentity) Obfuscate(user string) string {
+	return user
+}
+
+// NewHMACIdentity returns an HMACIdentity that derives its pseudonyms from key
+func NewHMACIdentity(key []byte) *HMACIdentity {
+	return &HMACIdentity{key: append([]byte(nil), key...)}
+}
+
+// HMACIdentity reports a stable pseudonym for every username, derived from a key with hmac-sha256.
+// The pseudonym of a user stays the same across restarts for as long as the key is unchanged, so
+// operators holding the key can tell who a pseudonym is while dashboards never hold the username.
+type HMACIdentity struct {
+	key []byte
+}
+
+// Obfuscate returns the pseudonym of user
+func (h *HMACIdentity) Obfuscate(user string) string {
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write([]byte(user))
+	return "u-" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// bucketCapacity is how many users a BucketIdentity counts for every user it reports exactly
+const bucketCapacity = 4
+
+// bucketMinCount is the guaranteed count a user needs before a BucketIdentity reports it exactly,
+// so neither the first users after a start nor a spray of usernames are ever reported as is
+const bucketMinCount = 16
+
+// bucketLabels is how many distinct users a BucketIdentity reports exactly over its lifetime, for
+// every user it reports at a time
+const bucketLabels = 2
+
+// NewBucketIdentity returns a BucketIdentity that reports the k most frequent users exactly
+func NewBucketIdentity(k int) *BucketIdentity {
+	return &BucketIdentity{
+		k:        k,
+		capacity: k * bucketCapacity,
+		index:    make(map[string]*bucketCounter),
+		labels:   make(map[string]struct{}, k*bucketLabels),
+	}
+}
+
+// BucketIdentity reports the k users it has seen most often as is, and every other user as
+// IdentityOther.  Frequencies are estimated with the space-saving algorithm over a fixed number of
+// counters, so memory does not grow with the number of users.  Every call to Obfuscate counts an
+// occurrence of the user.
+//
+// A user is only reported as is once it has proven frequent: its guaranteed count must reach
+// bucketMinCount and exceed the count any user the counters may have missed could have.  Until
+// then, eg while warming up or under a spray of usernames, every user is IdentityOther.  At most
+// k*bucketLabels distinct users are ever reported as is, which caps the cardinality of a label
+// even as the most frequent users change.
+type BucketIdentity struct {
+	mu       sync.Mutex
+	k        int
+	capacity int
+	counters []*bucketCounter
+	index    map[string]*bucketCounter
+	// total is the number of occurrences counted
+	total uint64
+	// labels are the users reported as is so far
+	labels map[string]struct{}
+}
+
+// bucketCounter is the estimated count of a user.  over is how much the count may overestimate
+// it, which is the count of the user it replaced.
+type bucketCounter struct {
+	user  string
+	count uint64
+	over  uint64
+}
+
+// Obfuscate counts an occurrence of user and returns user if it is among the k most frequent
+// users and has proven frequent, IdentityOther otherwise
+func (b *BucketIdentity) Obfuscate(user string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.observe(user)
+	// rank on the guaranteed count, so users that only replaced a busy counter are not reported
+	guaranteed := c.count - c.over
+	if guaranteed < bucketMinCount || guaranteed <= b.total/uint64(b.capacity) {
+		return IdentityOther
+	}
+	var above int
+	for _, o := range b.counters {
+		if o.count-o.over > guaranteed {
+			above++
+		}
+	}
+	if above >= b.k {
+		return IdentityOther
+	}
+	if _, ok := b.labels[user]; !ok {
+		if len(b.labels) >= b.k*bucketLabels {
+			return IdentityOther
+		}
+		b.labels[user] = struct{}{}
+	}
+	return user
+}
+
+// observe counts an occurrence of user, replacing the user with the smallest count once every
+// counter is taken.  The caller must hold mu.
+func (b *BucketIdentity) observe(user string) *bucketCounter {
+	b.total++
+	if c, ok := b.index[user]; ok {
+		c.count++
+		return c
+	}
+	if len(b.counters) < b.capacity {
+		c := &bucketCounter{user: user, count: 1}
+		b.counters = append(b.counters, c)
+		b.index[user] = c
+		return c
+	}
+	min := b.counters[0]
+	for _, c := range b.counters[1:] {
+		if c.count < min.count {
+			min = c
+		}
+	}
+	delete(b.index, min.user)
+	min.user, min.over = user, min.count
+	min.count++
+	b.index[user] = min
+	return min
+}
+
+// SetMetricsIdentity sets the IdentityObfuscator of the user label of the
+// tacquito_denials_by_user metric.  Denials are not counted by user unless it is set.
+func SetMetricsIdentity(v IdentityObfuscator) Option {
+	return func(s *Server) {
+		s.metricsIdentity = v
+	}
+}
+
+// requestUser returns the user of the first packet of a session, if it carries one
+func requestUser(request Request) string {
+	switch request.Header.Type {
+	case Authenticate:
+		var body AuthenStart
+		if err := Unmarshal(request.Body, &body); err == nil {
+			return string(body.User)
+		}
+	case Authorize:
+		var body AuthorRequest
+		if err := Unmarshal(request.Body, &body); err == nil {
+			return string(body.User)
+		}
+	case Accounting:
+		var body AcctRequest
+		if err := Unmarshal(request.Body, &body); err == nil {
+			return string(body.User)
+		}
+	}
+	return ""
+}
+
+// countDenial counts the denial d of user in tacquito_denials_by_user, through the tally t
+func countDenial(t *requestTally, o IdentityObfuscator, d *Denial, user string) {
+	if o == nil {
+		return
+	}
+	identity := IdentityUnknown
+	if user != "" {
+		identity = o.Obfuscate(user)
+	}
+	t.denial(d.Type.String(), string(d.Cause), identity)
+}
@@ -0,0 +1,134 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHMACIdentityStable(t *testing.T) {
+	// a restart builds a new identity from the same key
+	before, after := NewHMACIdentity([]byte("pseudonym-key")), NewHMACIdentity([]byte("pseudonym-key"))
+	assert.Equal(t, before.Obfuscate("alice"), after.Obfuscate("alice"))
+	assert.NotEqual(t, before.Obfuscate("alice"), before.Obfuscate("bob"))
+	assert.NotContains(t, before.Obfuscate("alice"), "alice")
+
+	// pseudonyms change with the key
+	assert.NotEqual(t, before.Obfuscate("alice"), NewHMACIdentity([]byte("rotated-key")).Obfuscate("alice"))
+}
+
+func TestBucketIdentity(t *testing.T) {
+	b := NewBucketIdentity(2)
+	for i := 0; i < 500; i++ {
+		b.Obfuscate("alice")
+		b.Obfuscate("bob")
+	}
+	// a long tail of users seen once each never displaces the heavy hitters
+	for i := 0; i < 1000; i++ {
+		assert.Equal(t, IdentityOther, b.Obfuscate(fmt.Sprintf("user%d", i)))
+	}
+	assert.Equal(t, "alice", b.Obfuscate("alice"))
+	assert.Equal(t, "bob", b.Obfuscate("bob"))
+	assert.Len(t, b.counters, 2*bucketCapacity)
+	assert.Len(t, b.index, 2*bucketCapacity)
+}
+
+func TestBucketIdentityWarmUp(t *testing.T) {
+	// the first users after a start are not reported as is until they prove frequent
+	b := NewBucketIdentity(2)
+	for i := 0; i < bucketMinCount-1; i++ {
+		assert.Equal(t, IdentityOther, b.Obfuscate("alice"))
+	}
+	assert.Equal(t, "alice", b.Obfuscate("alice"))
+}
+
+func TestBucketIdentitySpray(t *testing.T) {
+	// a spray of usernames, each tried a few times, never reports one as is
+	b := NewBucketIdentity(2)
+	for i := 0; i < 2000; i++ {
+		user := fmt.Sprintf("spray%d", i)
+		for j := 0; j < 3; j++ {
+			assert.Equal(t, IdentityOther, b.Obfuscate(user))
+		}
+	}
+	assert.Empty(t, b.labels)
+}
+
+func TestBucketIdentityLabelCap(t *testing.T) {
+	// the most frequent users change over time, but the distinct users reported as is are capped
+	b := NewBucketIdentity(1)
+	reported := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		user := fmt.Sprintf("user%d", i)
+		for j := 0; j < 1000*(i+1); j++ {
+			reported[b.Obfuscate(user)] = true
+		}
+	}
+	delete(reported, IdentityOther)
+	assert.Len(t, reported, bucketLabels)
+	assert.Equal(t, IdentityOther, b.Obfuscate("user9"))
+}
+
+func TestNewIdentityObfuscator(t *testing.T) {
+	tests := []struct {
+		mode      string
+		key       []byte
+		k         int
+		expectErr bool
+	}{
+		{mode: "passthrough"},
+		{mode: "hmac", key: []byte("key")},
+		{mode: "hmac", expectErr: true},
+		{mode: "bucket", k: 10},
+		{mode: "bucket", expectErr: true},
+		{mode: "audit", expectErr: true},
+	}
+	for _, test := range tests {
+		_, err := NewIdentityObfuscator(test.mode, test.key, test.k)
+		assert.Equal(t, test.expectErr, err != nil, test.mode)
+	}
+}
+
+func TestDenialsByUser(t *testing.T) {
+	identity := NewHMACIdentity([]byte("pseudonym-key"))
+	s := NewServer(nopLogger{}, nil, SetMetricsIdentity(identity))
+	client, server := net.Pipe()
+	defer client.Close()
+	go s.handle(context.Background(), newCrypter(roleServer, []byte("fooman"), server, false), HandlerFunc(func(response Response, request Request) {
+		response.Reply(NewDenial(Authenticate, DenialBadCredential, ""))
+	}))
+	counter := denialsByUser.WithLabelValues(Authenticate.String(), string(DenialBadCredential), identity.Obfuscate("cisco"))
+	before := metricValue(counter)
+
+	c := newCrypter(roleClient, []byte("fooman"), client, false)
+	_, err := c.write(proxyTestPacket())
+	require.NoError(t, err)
+	_, err = c.read()
+	require.NoError(t, err)
+	assert.Equal(t, before+1, metricValue(counter))
+}
+
+func TestTracerIdentity(t *testing.T) {
+	sink := &lockedBuffer{}
+	tracer := NewTracer(sink, TraceFilter{Username: "cisco"})
+	tracer.SetIdentity(NewHMACIdentity([]byte("pseudonym-key")))
+	teeExchange(t, tracer.Wrap(authenStatusHandler(AuthenStatusPass)), proxyTestPacket())
+
+	lines := sink.lines()
+	require.NotEmpty(t, lines)
+	assert.Contains(t, lines[0], fmt.Sprintf("user=%q", NewHMACIdentity([]byte("pseudonym-key")).Obfuscate("cisco")))
+	for _, l := range lines {
+		assert.NotContains(t, l, "cisco")
+	}
+}
@@ -0,0 +1,182 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// interactiveQuotaMessage is the server_msg of authentication starts refused by the interactive
+// session quota
+const interactiveQuotaMessage = "too many interactive logins in progress from this device"
+
+// InteractiveSessionPolicy may be implemented by the Handler returned from a SecretProvider to set
+// how many interactive authentication sessions each of its devices may have open at once,
+// overriding SetMaxInteractiveSessions.  ok false uses the server default, and a max of zero is
+// unlimited.
+type InteractiveSessionPolicy interface {
+	MaxInteractiveSessions() (max int, ok bool)
+}
+
+// SetMaxInteractiveSessions caps the interactive authentication sessions, those that take more
+// than one round such as an ascii login awaiting its password, that each device may have open at
+// once over all of its connections, and over every instance sharing the Store set with SetStore.
+// A console server stuck on many lines otherwise parks a session on every one of them.  While a
+// device is at the cap, its new authentication starts are failed with an error and counted in
+// tacquito_serve_interactive_rejected; its open sessions are unaffected.  The cap is soft, devices
+// may briefly exceed it by the starts that were already being handled.  A value of zero, the
+// default, is unlimited.
+func SetMaxInteractiveSessions(v int) Option {
+	return func(s *Server) {
+		s.maxInteractive = v
+	}
+}
+
+// interactiveStoreTTL bounds how long the count of a device is kept in the Store after it last
+// changed, so the sessions counted by an instance that died without releasing them are dropped
+const interactiveStoreTTL = time.Hour
+
+// interactiveStoreAttempts bounds the compare and swaps of a change to the count of a device, which
+// only repeat while other sessions of the device change it at once
+const interactiveStoreAttempts = 8
+
+// interactiveStoreTimeout bounds a release of a session, which is not tied to a request
+const interactiveStoreTimeout = 5 * time.Second
+
+// SetInteractiveStoreFailure sets what the interactive session quota does when its Store fails,
+// see SetStore.  The default is StoreFailOpen, a store outage does not block logins.
+func SetInteractiveStoreFailure(f StoreFailure) Option {
+	return func(s *Server) {
+		s.interactiveFailure = f
+	}
+}
+
+// interactiveKey is the Store key of the interactive session count of device
+func interactiveKey(device string) string {
+	return "interactive/" + device
+}
+
+// interactiveOpen returns the number of open interactive sessions of device over every instance
+// sharing store
+func interactiveOpen(ctx context.Context, store Store, device string) (int, error) {
+	v, ok, err := store.Get(ctx, interactiveKey(device))
+	if err != nil || !ok {
+		return 0, err
+	}
+	n, err := strconv.Atoi(string(v))
+	if err != nil {
+		return 0, fmt.Errorf("interactive session count of [%v] is not an integer; %w", device, err)
+	}
+	if n < 0 {
+		// counts are never released below zero, but a store may be shared with instances that did
+		return 0, nil
+	}
+	return n, nil
+}
+
+// interactiveAdd adds delta to the interactive session count of device in store, and keeps it for
+// another interactiveStoreTTL.  Store.Incr does not extend the ttl of a key, so a count held for
+// longer than the ttl would expire under its sessions, and the releases of those sessions would
+// drive the next count below zero; the count is compare and swapped instead, and never goes below
+// zero.
+func interactiveAdd(ctx context.Context, store Store, device string, delta int) error {
+	key := interactiveKey(device)
+	for i := 0; i < interactiveStoreAttempts; i++ {
+		old, ok, err := store.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		var n int
+		if ok {
+			if n, err = strconv.Atoi(string(old)); err != nil {
+				return fmt.Errorf("interactive session count of [%v] is not an integer; %w", device, err)
+			}
+		} else {
+			old = nil
+		}
+		if n += delta; n < 0 {
+			// the sessions released were dropped with a count that expired
+			n = 0
+		}
+		swapped, err := store.CompareAndSwap(ctx, key, old, []byte(strconv.Itoa(n)), interactiveStoreTTL)
+		if err != nil || swapped {
+			return err
+		}
+	}
+	return fmt.Errorf("interactive session count of [%v] changed on each of [%v] attempts", device, interactiveStoreAttempts)
+}
+
+// connInteractive applies the interactive session quota to one connection, it is a no-op if nil
+type connInteractive struct {
+	loggerProvider
+	store   Store
+	failure StoreFailure
+	ctx     context.Context
+	device  string
+	max     int
+}
+
+// newConnInteractive returns the interactive session quota of the connection of c, served by h,
+// or nil if it is unlimited
+func (s *Server) newConnInteractive(ctx context.Context, c *crypter, h Handler) *connInteractive {
+	max := s.maxInteractive
+	if p, ok := h.(InteractiveSessionPolicy); ok {
+		if v, ok := p.MaxInteractiveSessions(); ok {
+			max = v
+		}
+	}
+	if max <= 0 {
+		return nil
+	}
+	return &connInteractive{loggerProvider: s.loggerProvider, store: s.store, failure: s.interactiveFailure, ctx: ctx, device: c.device(), max: max}
+}
+
+// full reports if the device is at its quota, so the authentication start h must be refused
+func (q *connInteractive) full(h Header) bool {
+	if q == nil || h.Type != Authenticate || h.SeqNo != 1 {
+		return false
+	}
+	n, err := interactiveOpen(q.ctx, q.store, q.device)
+	if err != nil {
+		return !q.failure.allow(q.ctx, q.loggerProvider, "interactive", err)
+	}
+	return n >= q.max
+}
+
+// hold counts the session of h, an authentication start that awaits another round, against the
+// quota until sp deletes it on any path: completion, an error, or the connection closing
+func (q *connInteractive) hold(sp *sessions, h Header) {
+	if q == nil || h.Type != Authenticate || h.SeqNo != 1 {
+		return
+	}
+	sp.hold(h.SessionID, q.acquire)
+}
+
+// acquire counts an interactive session of the device, until the returned func is called.  A
+// session the store failed to count is not released either.
+func (q *connInteractive) acquire() func() {
+	if err := interactiveAdd(q.ctx, q.store, q.device, 1); err != nil {
+		q.failure.allow(q.ctx, q.loggerProvider, "interactive", err)
+		return func() {}
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			// the connection may be closing, so the release gets a context of its own
+			ctx, cancel := context.WithTimeout(context.Background(), interactiveStoreTimeout)
+			defer cancel()
+			if err := interactiveAdd(ctx, q.store, q.device, -1); err != nil {
+				q.failure.allow(ctx, q.loggerProvider, "interactive", err)
+			}
+		})
+	}
+}
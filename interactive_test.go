@@ -0,0 +1,316 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// interactiveTestHandler prompts for a password, then passes "pass", fails "fail" or an abort, and
+// outlives the handler timeout for "slow"
+func interactiveTestHandler() Handler {
+	return HandlerFunc(func(response Response, request Request) {
+		response.Next(HandlerFunc(func(response Response, request Request) {
+			var body AuthenContinue
+			if err := Unmarshal(request.Body, &body); err != nil {
+				response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusError)))
+				return
+			}
+			switch {
+			case body.Flags&AuthenContinueFlagAbort != 0, body.UserMessage == "fail":
+				response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusFail)))
+			case body.UserMessage == "slow":
+				<-request.Context.Done()
+			default:
+				response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusPass)))
+			}
+		}))
+		response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusGetPass), SetAuthenReplyServerMsg("password:")))
+	})
+}
+
+// interactiveTestPolicy sets the interactive session quota of its connections
+type interactiveTestPolicy struct {
+	Handler
+	max int
+}
+
+func (p interactiveTestPolicy) MaxInteractiveSessions() (int, bool) {
+	return p.max, true
+}
+
+// interactiveTestConn is the client end of a connection served by s
+type interactiveTestConn struct {
+	*crypter
+	client net.Conn
+	// done is closed once the server closed the connection
+	done chan struct{}
+}
+
+// interactiveTestDial opens a connection from device, served by h
+func interactiveTestDial(t *testing.T, s *Server, device string, h Handler) *interactiveTestConn {
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	sc := newCrypter(roleServer, []byte("fooman"), server, false)
+	sc.source = &net.TCPAddr{IP: net.ParseIP(device), Port: 49}
+	done := make(chan struct{})
+	go func() {
+		s.handle(context.Background(), sc, h)
+		close(done)
+	}()
+	return &interactiveTestConn{crypter: newCrypter(roleClient, []byte("fooman"), client, false), client: client, done: done}
+}
+
+// start starts the ascii login of session id and returns the reply
+func (c *interactiveTestConn) start(t *testing.T, id SessionID) AuthenReply {
+	_, err := c.write(featureTestStart(id, 0, MinorVersionDefault, AuthenTypeASCII))
+	require.NoError(t, err)
+	return lifetimeReply(t, c.crypter)
+}
+
+// cont sends the continue of session id with seq and returns the reply
+func (c *interactiveTestConn) cont(t *testing.T, id SessionID, seq int, opts ...AuthenContinueOption) AuthenReply {
+	_, err := c.write(NewPacket(
+		SetPacketHeader(NewHeader(SetHeaderType(Authenticate), SetHeaderSeqNo(seq), SetHeaderSessionID(id),
+			SetHeaderVersion(Version{MajorVersion: MajorVersion, MinorVersion: MinorVersionDefault}))),
+		SetPacketBodyUnsafe(NewAuthenContinue(opts...)),
+	))
+	require.NoError(t, err)
+	return lifetimeReply(t, c.crypter)
+}
+
+// closed waits for the server to close c
+func (c *interactiveTestConn) closed(t *testing.T) {
+	select {
+	case <-c.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not closed")
+	}
+}
+
+// interactiveTestOpen waits for device to have n interactive sessions open on s.  The server
+// counts a session after the reply to its start is written, so a client may see the reply first.
+func interactiveTestOpen(t *testing.T, s *Server, device string, n int) {
+	require.Eventually(t, func() bool { return interactiveTestCount(t, s, device) == n }, 5*time.Second, time.Millisecond, "expected [%v] open interactive sessions", n)
+}
+
+// interactiveTestCount returns the open interactive sessions of device in the store of s
+func interactiveTestCount(t *testing.T, s *Server, device string) int {
+	n, err := interactiveOpen(context.Background(), s.store, device)
+	require.NoError(t, err)
+	return n
+}
+
+func TestInteractiveSessionQuota(t *testing.T) {
+	const device = "192.0.2.1"
+	tests := []struct {
+		name string
+		opts []Option
+		// end ends the open session 1 of c
+		end func(t *testing.T, c *interactiveTestConn)
+	}{
+		{
+			name: "pass",
+			end: func(t *testing.T, c *interactiveTestConn) {
+				assert.Equal(t, AuthenStatusPass, c.cont(t, 1, 3, SetAuthenContinueUserMessage("pass")).Status)
+			},
+		},
+		{
+			name: "fail",
+			end: func(t *testing.T, c *interactiveTestConn) {
+				assert.Equal(t, AuthenStatusFail, c.cont(t, 1, 3, SetAuthenContinueUserMessage("fail")).Status)
+			},
+		},
+		{
+			name: "abort",
+			end: func(t *testing.T, c *interactiveTestConn) {
+				assert.Equal(t, AuthenStatusFail, c.cont(t, 1, 3, SetAuthenContinueFlag(AuthenContinueFlagAbort)).Status)
+			},
+		},
+		{
+			name: "handler timeout",
+			opts: []Option{SetHandlerTimeout(50 * time.Millisecond)},
+			end: func(t *testing.T, c *interactiveTestConn) {
+				assert.Equal(t, AuthenStatusError, c.cont(t, 1, 3, SetAuthenContinueUserMessage("slow")).Status)
+			},
+		},
+		{
+			name: "idle timeout",
+			opts: []Option{SetIdleTimeout(100 * time.Millisecond)},
+			end: func(t *testing.T, c *interactiveTestConn) {
+				c.closed(t)
+			},
+		},
+		{
+			name: "connection drop",
+			end: func(t *testing.T, c *interactiveTestConn) {
+				c.client.Close()
+				c.closed(t)
+			},
+		},
+		{
+			name: "sequence error",
+			end: func(t *testing.T, c *interactiveTestConn) {
+				// a client never sends an even sequence number
+				_, err := c.write(NewPacket(
+					SetPacketHeader(NewHeader(SetHeaderType(Authenticate), SetHeaderSeqNo(2), SetHeaderSessionID(1),
+						SetHeaderVersion(Version{MajorVersion: MajorVersion, MinorVersion: MinorVersionDefault}))),
+					SetPacketBodyUnsafe(NewAuthenContinue(SetAuthenContinueUserMessage("pass"))),
+				))
+				require.NoError(t, err)
+				c.closed(t)
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewServer(nopLogger{}, nil, append([]Option{SetIdleTimeout(5 * time.Second), SetMaxInteractiveSessions(1)}, test.opts...)...)
+			h := interactiveTestHandler()
+
+			first := interactiveTestDial(t, s, device, h)
+			require.Equal(t, AuthenStatusGetPass, first.start(t, 1).Status)
+			interactiveTestOpen(t, s, device, 1)
+
+			// the device is at its quota, on any of its connections
+			rejected := metricValue(serveInteractiveRejected)
+			second := interactiveTestDial(t, s, device, h)
+			reply := second.start(t, 2)
+			assert.Equal(t, AuthenStatusError, reply.Status)
+			assert.Equal(t, AuthenServerMsg(interactiveQuotaMessage), reply.ServerMsg)
+			assert.Equal(t, rejected+1, metricValue(serveInteractiveRejected))
+			// other devices are not
+			assert.Equal(t, AuthenStatusGetPass, interactiveTestDial(t, s, "192.0.2.2", h).start(t, 3).Status)
+
+			test.end(t, first)
+			interactiveTestOpen(t, s, device, 0)
+			assert.Equal(t, AuthenStatusGetPass, interactiveTestDial(t, s, device, h).start(t, 4).Status)
+		})
+	}
+}
+
+func TestInteractiveSessionPolicy(t *testing.T) {
+	const device = "192.0.2.1"
+	// the policy of the device group overrides the server default, both ways
+	s := NewServer(nopLogger{}, nil, SetIdleTimeout(5*time.Second), SetMaxInteractiveSessions(1))
+	unlimited := interactiveTestPolicy{Handler: interactiveTestHandler(), max: 0}
+	for id := SessionID(1); id <= 3; id++ {
+		assert.Equal(t, AuthenStatusGetPass, interactiveTestDial(t, s, device, unlimited).start(t, id).Status)
+	}
+	// unlimited devices are not counted
+	assert.Equal(t, 0, interactiveTestCount(t, s, device))
+
+	s = NewServer(nopLogger{}, nil, SetIdleTimeout(5*time.Second))
+	two := interactiveTestPolicy{Handler: interactiveTestHandler(), max: 2}
+	for id := SessionID(1); id <= 2; id++ {
+		assert.Equal(t, AuthenStatusGetPass, interactiveTestDial(t, s, device, two).start(t, id).Status)
+	}
+	interactiveTestOpen(t, s, device, 2)
+	assert.Equal(t, AuthenStatusError, interactiveTestDial(t, s, device, two).start(t, 3).Status)
+
+	// sessions that complete in one round are never counted
+	c := interactiveTestDial(t, s, "192.0.2.2", interactiveTestPolicy{Handler: HandlerFunc(func(response Response, request Request) {
+		response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusPass)))
+	}), max: 1})
+	assert.Equal(t, AuthenStatusPass, c.start(t, 1).Status)
+	assert.Equal(t, 0, interactiveTestCount(t, s, "192.0.2.2"))
+}
+
+func TestInteractiveSessionQuotaSharedStore(t *testing.T) {
+	const device = "192.0.2.1"
+	// two instances sharing a store share the quota of a device
+	store := NewMemoryStore()
+	a := NewServer(nopLogger{}, nil, SetIdleTimeout(5*time.Second), SetMaxInteractiveSessions(1), SetStore(store))
+	b := NewServer(nopLogger{}, nil, SetIdleTimeout(5*time.Second), SetMaxInteractiveSessions(1), SetStore(store))
+	h := interactiveTestHandler()
+	first := interactiveTestDial(t, a, device, h)
+	require.Equal(t, AuthenStatusGetPass, first.start(t, 1).Status)
+	interactiveTestOpen(t, b, device, 1)
+	assert.Equal(t, AuthenStatusError, interactiveTestDial(t, b, device, h).start(t, 2).Status)
+
+	assert.Equal(t, AuthenStatusPass, first.cont(t, 1, 3, SetAuthenContinueUserMessage("pass")).Status)
+	interactiveTestOpen(t, b, device, 0)
+	assert.Equal(t, AuthenStatusGetPass, interactiveTestDial(t, b, device, h).start(t, 3).Status)
+}
+
+func TestInteractiveStoreFailure(t *testing.T) {
+	for _, test := range []struct {
+		failure StoreFailure
+		status  AuthenStatus
+	}{
+		{failure: StoreFailOpen, status: AuthenStatusGetPass},
+		{failure: StoreFailClosed, status: AuthenStatusError},
+	} {
+		t.Run(test.failure.String(), func(t *testing.T) {
+			store := &faultyStore{Store: NewMemoryStore(), down: true}
+			s := NewServer(nopLogger{}, nil, SetIdleTimeout(5*time.Second), SetMaxInteractiveSessions(1), SetStore(store), SetInteractiveStoreFailure(test.failure))
+			failures := metricValue(storeFailures.WithLabelValues("interactive", test.failure.String()))
+			assert.Equal(t, test.status, interactiveTestDial(t, s, "192.0.2.1", interactiveTestHandler()).start(t, 1).Status)
+			assert.Less(t, failures, metricValue(storeFailures.WithLabelValues("interactive", test.failure.String())))
+		})
+	}
+}
+
+func TestInteractiveSessionQuotaTTL(t *testing.T) {
+	const device = "192.0.2.1"
+	clock := &storeTestClock{now: time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)}
+	store := NewMemoryStore()
+	store.now = clock.Now
+	s := NewServer(nopLogger{}, nil, SetIdleTimeout(5*time.Second), SetMaxInteractiveSessions(2), SetStore(store))
+	h := interactiveTestHandler()
+
+	first := interactiveTestDial(t, s, device, h)
+	require.Equal(t, AuthenStatusGetPass, first.start(t, 1).Status)
+	interactiveTestOpen(t, s, device, 1)
+	clock.now = clock.now.Add(50 * time.Minute)
+	second := interactiveTestDial(t, s, device, h)
+	require.Equal(t, AuthenStatusGetPass, second.start(t, 2).Status)
+	interactiveTestOpen(t, s, device, 2)
+
+	// the count outlives the ttl of its first session, as every change keeps it for another ttl
+	clock.now = clock.now.Add(20 * time.Minute)
+	assert.Equal(t, 2, interactiveTestCount(t, s, device))
+	assert.Equal(t, AuthenStatusError, interactiveTestDial(t, s, device, h).start(t, 3).Status)
+	assert.Equal(t, AuthenStatusPass, first.cont(t, 1, 3, SetAuthenContinueUserMessage("pass")).Status)
+	interactiveTestOpen(t, s, device, 1)
+
+	// a session held past the ttl of an unchanged count is dropped with it, and its release does
+	// not let an extra session past the quota
+	clock.now = clock.now.Add(2 * interactiveStoreTTL)
+	interactiveTestOpen(t, s, device, 0)
+	assert.Equal(t, AuthenStatusPass, second.cont(t, 2, 3, SetAuthenContinueUserMessage("pass")).Status)
+	interactiveTestOpen(t, s, device, 0)
+	for id := SessionID(4); id <= 5; id++ {
+		require.Equal(t, AuthenStatusGetPass, interactiveTestDial(t, s, device, h).start(t, id).Status)
+	}
+	interactiveTestOpen(t, s, device, 2)
+	assert.Equal(t, AuthenStatusError, interactiveTestDial(t, s, device, h).start(t, 6).Status)
+}
+
+func TestInteractiveAddContended(t *testing.T) {
+	// a count that changes on every attempt is an error, rather than a lost change
+	store := &contendedStore{Store: NewMemoryStore()}
+	assert.Error(t, interactiveAdd(context.Background(), store, "192.0.2.1", 1))
+	assert.Equal(t, interactiveStoreAttempts, store.swaps)
+}
+
+// contendedStore is a Store whose compare and swaps always find the value changed
+type contendedStore struct {
+	Store
+	swaps int
+}
+
+func (c *contendedStore) CompareAndSwap(ctx context.Context, key string, old, new []byte, ttl time.Duration) (bool, error) {
+	c.swaps++
+	return false, nil
+}
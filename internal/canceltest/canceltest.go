@@ -0,0 +1,49 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+// Package canceltest checks that blocking calls keep to the cancellation rule of the tacquito
+// package: a call that can block on I/O or a lock for an unbounded time takes a context and
+// returns within a bounded time of it being done.
+package canceltest
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Block is how long a call is left blocking before its context is canceled
+const Block = 20 * time.Millisecond
+
+// Limit is how soon after cancellation a call must return, by default
+const Limit = 100 * time.Millisecond
+
+// ReturnsWithin calls fn with a context that is canceled once fn has blocked for Block, and fails
+// t unless fn returns within limit of the cancellation.  A fn that returns before it is canceled
+// did not block, so the check proves nothing and t fails too.  It returns the error of fn, or nil
+// if fn did not return.
+func ReturnsWithin(t testing.TB, limit time.Duration, fn func(ctx context.Context) error) error {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- fn(ctx) }()
+	select {
+	case err := <-done:
+		t.Errorf("returned before it was canceled, it must block for the check to be meaningful; %v", err)
+		return err
+	case <-time.After(Block):
+	}
+	cancel()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(limit):
+		t.Errorf("did not return within %v of its context being canceled", limit)
+		return nil
+	}
+}
@@ -0,0 +1,33 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+// Package testhooks holds the sources of nondeterminism that tests may replace in servers and
+// clients.  It is internal so that only the tacquitotest harness can set them, a production
+// binary has no way to construct Hooks.  The options that apply them are unexported in the
+// tacquito package, which hands them over through ServerOption and ClientOption.
+package testhooks
+
+import "time"
+
+// Hooks replace the session ids, wall clock and read deadlines of a server or client.  Nil fields
+// keep the defaults.
+type Hooks struct {
+	// SessionID returns the id of each session a client starts
+	SessionID func() uint32
+	// Now returns the wall time
+	Now func() time.Time
+	// Deadline returns the read deadline of a connection that may idle for d
+	Deadline func(d time.Duration) time.Time
+}
+
+// ServerOption returns the tq.Option that applies h to a server, and ClientOption the
+// tq.ClientOption that applies h to a client.  The tacquito package sets them as it is
+// initialized, this package cannot import it.
+var (
+	ServerOption func(h *Hooks) interface{}
+	ClientOption func(h *Hooks) interface{}
+)
@@ -0,0 +1,114 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// invariant names a state the server can never be in unless tacquito itself has a bug.  Devices
+// cannot cause these, so a violation is a bug report rather than a protocol error.
+type invariant string
+
+const (
+	// invariantStaleSeqNo is a reply whose sequence number is not past the last packet of its session
+	invariantStaleSeqNo invariant = "stale-seq-no"
+	// invariantReplyAfterRelease is a reply written through a Response after the server released it,
+	// eg by a handler that kept the Response of a session the server already moved on from
+	invariantReplyAfterRelease invariant = "reply-after-release"
+	// invariantPadLength is a pad that does not cover the body it obfuscates
+	invariantPadLength invariant = "pad-length"
+	// invariantArgsMutated is a request whose body, and so its args, changed after the server
+	// committed it, eg by a handler that kept the request and modified it later
+	invariantArgsMutated invariant = "args-mutated"
+	// invariantInFlightClose is a connection the server closed on its own accord, which it only does
+	// once no session is in flight, with sessions in flight
+	invariantInFlightClose invariant = "in-flight-close"
+)
+
+// invariantLogInterval is how often a violation of an invariant is logged, every violation is
+// counted
+const invariantLogInterval = time.Hour
+
+// invariantSampling is how many requests a check that costs a pass over the body covers one of
+const invariantSampling = 16
+
+// invariantLog rate limits the logs of invariant violations, per invariant
+type invariantLog struct {
+	mu   sync.Mutex
+	last map[invariant]time.Time
+	now  func() time.Time
+}
+
+// invariants limits the logs of every invariant violation of the process
+var invariants = &invariantLog{last: make(map[invariant]time.Time), now: time.Now}
+
+// due reports if a violation of i should be logged now, and if so starts its interval again
+func (l *invariantLog) due(i invariant) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if last, ok := l.last[i]; ok && now.Sub(last) < invariantLogInterval {
+		return false
+	}
+	l.last[i] = now
+	return true
+}
+
+// violated counts a violation of i and logs it to l, at most once per invariantLogInterval.  l may
+// be nil where there is no logger, the violation is then only counted.
+func violated(ctx context.Context, l loggerProvider, i invariant, format string, args ...interface{}) {
+	invariantViolation.WithLabelValues(string(i)).Inc()
+	if l == nil || !invariants.due(i) {
+		return
+	}
+	l.Errorf(ctx, "invariant [%v] violated, this is a bug in tacquito; %v; further violations are only counted for %v",
+		i, fmt.Sprintf(format, args...), invariantLogInterval)
+}
+
+// bodySum is the checksum of a body that must not change, see invariantArgsMutated
+func bodySum(body []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(body)
+	return h.Sum64()
+}
+
+// committedArgs checks that the requests a connection committed are not modified after, see
+// invariantArgsMutated.  One in invariantSampling requests is checksummed as it is committed, and
+// checked when the next request is committed or the connection closes, as whatever kept it has
+// had the time between to modify it.  It belongs to the goroutine serving its connection.
+type committedArgs struct {
+	committed uint32
+	header    Header
+	body      []byte
+	sum       uint64
+}
+
+// commit checks the request committed before, then samples request
+func (a *committedArgs) commit(ctx context.Context, l loggerProvider, request Request) {
+	a.check(ctx, l)
+	if a.committed++; a.committed%invariantSampling == 1 {
+		a.header, a.body, a.sum = request.Header, request.Body, bodySum(request.Body)
+	}
+}
+
+// check checks the sampled request, if any, is as it was committed
+func (a *committedArgs) check(ctx context.Context, l loggerProvider) {
+	if a.body == nil {
+		return
+	}
+	if bodySum(a.body) != a.sum {
+		violated(ctx, l, invariantArgsMutated, "[%v] the body of %v seq [%v] changed after it was committed",
+			a.header.SessionID, a.header.Type, a.header.SeqNo)
+	}
+	a.body = nil
+}
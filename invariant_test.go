@@ -0,0 +1,200 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// invariantCount returns the violations of i counted so far
+func invariantCount(i invariant) float64 {
+	return metricValue(invariantViolation.WithLabelValues(string(i)))
+}
+
+// resetInvariantLog gives the invariant log a clock moved by the test, and restores it once the
+// test is done
+func resetInvariantLog(t *testing.T) *storeTestClock {
+	clock := &storeTestClock{now: time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)}
+	saved := invariants
+	invariants = &invariantLog{last: make(map[invariant]time.Time), now: clock.Now}
+	t.Cleanup(func() { invariants = saved })
+	return clock
+}
+
+func TestInvariantLog(t *testing.T) {
+	clock := resetInvariantLog(t)
+	logger := &errorLogger{}
+	ctx := context.Background()
+	before := invariantCount(invariantStaleSeqNo)
+
+	violated(ctx, logger, invariantStaleSeqNo, "first")
+	violated(ctx, logger, invariantStaleSeqNo, "second")
+	// every invariant has an interval of its own
+	violated(ctx, logger, invariantPadLength, "pad")
+	clock.now = clock.now.Add(invariantLogInterval - time.Second)
+	violated(ctx, logger, invariantStaleSeqNo, "third")
+	clock.now = clock.now.Add(time.Second)
+	violated(ctx, logger, invariantStaleSeqNo, "fourth")
+	// a violation without a logger is counted all the same
+	violated(ctx, nil, invariantStaleSeqNo, "fifth")
+
+	assert.Equal(t, before+5, invariantCount(invariantStaleSeqNo))
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	require.Len(t, logger.logs, 3)
+	assert.Contains(t, logger.logs[0], "[stale-seq-no]")
+	assert.Contains(t, logger.logs[0], "first")
+	assert.Contains(t, logger.logs[1], "[pad-length]")
+	assert.Contains(t, logger.logs[2], "fourth")
+}
+
+func TestInvariantStaleSeqNo(t *testing.T) {
+	resetInvariantLog(t)
+	before := invariantCount(invariantStaleSeqNo)
+	conn := &writeCountingConn{}
+	r := newBatchResponse(conn)
+	r.seqNo = 1
+	reply := func(seqNo int, status AuthenStatus) *Packet {
+		return NewPacket(
+			SetPacketHeader(NewHeader(SetHeaderVersion(r.header.Version), SetHeaderType(Authenticate), SetHeaderSeqNo(seqNo), SetHeaderSessionID(12345))),
+			SetPacketBodyUnsafe(NewAuthenReply(SetAuthenReplyStatus(status))),
+		)
+	}
+
+	_, err := r.Write(reply(2, AuthenStatusGetPass))
+	require.NoError(t, err)
+	assert.Equal(t, before, invariantCount(invariantStaleSeqNo))
+	// the same seq twice is stale, and still written
+	_, err = r.Write(reply(2, AuthenStatusFail))
+	require.NoError(t, err)
+	assert.Equal(t, before+1, invariantCount(invariantStaleSeqNo))
+	assert.Len(t, conn.writes, 2)
+	// a restart takes the session back to seq 1
+	_, err = r.Write(reply(1, AuthenStatusRestart))
+	require.NoError(t, err)
+	assert.Equal(t, before+1, invariantCount(invariantStaleSeqNo))
+}
+
+func TestInvariantReplyAfterRelease(t *testing.T) {
+	resetInvariantLog(t)
+	before := invariantCount(invariantReplyAfterRelease)
+	client, server := net.Pipe()
+	defer client.Close()
+	logger := &errorLogger{}
+	s := NewServer(logger, nil)
+	kept := make(chan Response, 1)
+	go s.handle(context.Background(), newCrypter(roleServer, []byte("fooman"), server, false), HandlerFunc(func(response Response, request Request) {
+		if request.Header.SessionID == 1 {
+			// a handler that keeps the response of its session past its return
+			kept <- response
+		}
+		response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusFail)))
+	}))
+
+	c := newCrypter(roleClient, []byte("fooman"), client, false)
+	for _, id := range []SessionID{1, 2} {
+		_, err := c.write(featureTestStart(id, SingleConnect, MinorVersionDefault, AuthenTypePAP))
+		require.NoError(t, err)
+		assert.Equal(t, AuthenStatusFail, lifetimeReply(t, c).Status)
+	}
+	// the server moved on to session 2 since, so the kept response may not write
+	_, err := (<-kept).Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusPass)))
+	assert.Error(t, err)
+	assert.Equal(t, before+1, invariantCount(invariantReplyAfterRelease))
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	require.Len(t, logger.logs, 1)
+	assert.Contains(t, logger.logs[0], "[reply-after-release]")
+}
+
+func TestInvariantPadLength(t *testing.T) {
+	resetInvariantLog(t)
+	before := invariantCount(invariantPadLength)
+	client, server := net.Pipe()
+	defer client.Close()
+	logger := &errorLogger{}
+	// the pad hook breaks the pads of this server only
+	s := NewServer(logger, nil)
+	s.padHook = func(pad []byte) []byte { return pad[:len(pad)-1] }
+	done := make(chan struct{})
+	go func() {
+		s.handle(context.Background(), newCrypter(roleServer, []byte("fooman"), server, false), HandlerFunc(func(response Response, request Request) {
+			response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusPass)))
+		}))
+		close(done)
+	}()
+
+	c := newCrypter(roleClient, []byte("fooman"), client, false)
+	_, err := c.write(featureTestStart(1, 0, MinorVersionDefault, AuthenTypePAP))
+	require.NoError(t, err)
+	<-done
+	assert.Equal(t, before+1, invariantCount(invariantPadLength))
+	// other crypters are not hooked
+	assert.NoError(t, crypt([]byte("fooman"), proxyTestPacket()))
+	assert.Equal(t, before+1, invariantCount(invariantPadLength))
+	// the violation was logged once, before the connection was closed for it
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	require.Len(t, logger.logs, 2)
+	assert.Contains(t, logger.logs[0], "[pad-length]")
+}
+
+func TestInvariantArgsMutated(t *testing.T) {
+	resetInvariantLog(t)
+	before := invariantCount(invariantArgsMutated)
+	client, server := net.Pipe()
+	defer client.Close()
+	logger := &errorLogger{}
+	s := NewServer(logger, nil)
+	// a handler that keeps every request past its return, and modifies a kept one when the next
+	// request is handled, once the server committed it
+	kept := map[SessionID]Request{}
+	go s.handle(context.Background(), newCrypter(roleServer, []byte("fooman"), server, false), HandlerFunc(func(response Response, request Request) {
+		if previous, ok := kept[request.Header.SessionID-1]; ok {
+			previous.Body[0] ^= 0xff
+		}
+		kept[request.Header.SessionID] = request
+		response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusFail)))
+	}))
+
+	c := newCrypter(roleClient, []byte("fooman"), client, false)
+	for id := SessionID(1); id <= 3; id++ {
+		_, err := c.write(featureTestStart(id, SingleConnect, MinorVersionDefault, AuthenTypePAP))
+		require.NoError(t, err)
+		assert.Equal(t, AuthenStatusFail, lifetimeReply(t, c).Status)
+	}
+	// only the first request is sampled, so only its modification is seen
+	assert.Equal(t, before+1, invariantCount(invariantArgsMutated))
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	require.Len(t, logger.logs, 1)
+	assert.Contains(t, logger.logs[0], "[args-mutated]")
+}
+
+func TestInvariantInFlightClose(t *testing.T) {
+	resetInvariantLog(t)
+	before := invariantCount(invariantInFlightClose)
+	logger := &errorLogger{}
+	ctx := context.Background()
+	checkDrained(ctx, logger, CloseLifetime, 0)
+	checkDrained(ctx, logger, CloseClientEOF, 3)
+	assert.Equal(t, before, invariantCount(invariantInFlightClose))
+	checkDrained(ctx, logger, CloseLifetime, 1)
+	checkDrained(ctx, logger, CloseSecretRotated, 2)
+	assert.Equal(t, before+2, invariantCount(invariantInFlightClose))
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	require.Len(t, logger.logs, 1)
+	assert.Contains(t, logger.logs[0], "with [1] sessions in flight")
+}
@@ -0,0 +1,114 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// lifetimeJitter is the largest fraction a connection lifetime is shortened by, so connections
+// accepted together after a restart do not all reconnect together either
+const lifetimeJitter = 0.1
+
+// LifetimeExpiry is what the server does with a connection that outlived SetMaxConnectionLifetime
+type LifetimeExpiry int
+
+const (
+	// LifetimeDrain closes the connection as soon as none of its sessions are in flight
+	LifetimeDrain LifetimeExpiry = iota
+	// LifetimeReject keeps the connection until the device starts a new session, replies to it
+	// with an error so the device reconnects, then closes the connection once none of its
+	// sessions are in flight
+	LifetimeReject
+)
+
+// String returns the name of the expiry
+func (e LifetimeExpiry) String() string {
+	switch e {
+	case LifetimeDrain:
+		return "drain"
+	case LifetimeReject:
+		return "reject"
+	}
+	return fmt.Sprintf("unknown(%d)", int(e))
+}
+
+// ParseLifetimeExpiry returns the LifetimeExpiry named v, drain or reject
+func ParseLifetimeExpiry(v string) (LifetimeExpiry, error) {
+	switch v {
+	case "drain":
+		return LifetimeDrain, nil
+	case "reject":
+		return LifetimeReject, nil
+	}
+	return 0, fmt.Errorf("unknown connection lifetime expiry [%v], expected drain or reject", v)
+}
+
+// ConnectionLifetimePolicy may be implemented by the Handler returned from a SecretProvider to set
+// what happens to its connections once they outlive SetMaxConnectionLifetime.  LifetimeDrain is
+// used otherwise.
+type ConnectionLifetimePolicy interface {
+	LifetimeExpiry() LifetimeExpiry
+}
+
+// SetMaxConnectionLifetime sets how long a connection may serve new sessions, so long lived
+// single-connect connections do not pin a device to one server and a load balancer can rebalance
+// them.  Each connection is given a lifetime shortened by a random fraction of up to 10%.  Once it
+// passes, sessions in flight complete, new sessions are refused and the connection is closed as
+// set by the ConnectionLifetimePolicy of its handler.  A value of zero, the default, disables it.
+func SetMaxConnectionLifetime(v time.Duration) Option {
+	return func(s *Server) {
+		s.maxLifetime = v
+	}
+}
+
+// connLifetime tracks the lifetime of a single connection
+type connLifetime struct {
+	expires time.Time
+	expiry  LifetimeExpiry
+	// rejected is set once a new session was refused for the lifetime
+	rejected bool
+}
+
+// newConnLifetime returns the lifetime of a connection accepted now, with a handler of policy h
+func (s *Server) newConnLifetime(h Handler) *connLifetime {
+	if s.maxLifetime <= 0 {
+		return &connLifetime{}
+	}
+	l := &connLifetime{
+		expires: time.Now().Add(s.maxLifetime - time.Duration(rand.Float64()*lifetimeJitter*float64(s.maxLifetime))),
+	}
+	if p, ok := h.(ConnectionLifetimePolicy); ok {
+		l.expiry = p.LifetimeExpiry()
+	}
+	return l
+}
+
+// expired reports if the connection outlived its lifetime
+func (l *connLifetime) expired() bool {
+	return !l.expires.IsZero() && !time.Now().Before(l.expires)
+}
+
+// closing reports if a connection with inFlight sessions should be closed now
+func (l *connLifetime) closing(inFlight int) bool {
+	if inFlight > 0 || !l.expired() {
+		return false
+	}
+	return l.expiry == LifetimeDrain || l.rejected
+}
+
+// deadline returns the read deadline of a connection with inFlight sessions, given idle is the
+// deadline of the idle timeout.  A draining connection wakes up when its lifetime passes.
+func (l *connLifetime) deadline(idle time.Time, inFlight int) time.Time {
+	if l.expires.IsZero() || l.expiry != LifetimeDrain || inFlight > 0 || idle.Before(l.expires) {
+		return idle
+	}
+	return l.expires
+}
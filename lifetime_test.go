@@ -0,0 +1,137 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rejectLifetime is a handler whose connections reject new sessions once they outlive their lifetime
+type rejectLifetime struct {
+	Handler
+}
+
+func (rejectLifetime) LifetimeExpiry() LifetimeExpiry {
+	return LifetimeReject
+}
+
+// lifetimeReply reads an authenticate reply from c
+func lifetimeReply(t *testing.T, c *crypter) AuthenReply {
+	p, err := c.read()
+	require.NoError(t, err)
+	var reply AuthenReply
+	require.NoError(t, Unmarshal(p.Body, &reply))
+	return reply
+}
+
+func TestConnectionLifetimeDrain(t *testing.T) {
+	lifetime := 100 * time.Millisecond
+	reasons := make(chan CloseReason, 1)
+	s := NewServer(nopLogger{}, nil, SetIdleTimeout(5*time.Second), SetMaxConnectionLifetime(lifetime), SetOnClose(func(ctx context.Context, remote net.Addr, reason CloseReason) {
+		reasons <- reason
+	}))
+	// a login that prompts for the password, so its session spans two packets
+	h := HandlerFunc(func(response Response, request Request) {
+		response.Next(HandlerFunc(func(response Response, request Request) {
+			response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusPass)))
+		}))
+		response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusGetPass), SetAuthenReplyServerMsg("password:")))
+	})
+	client, server := net.Pipe()
+	defer client.Close()
+	before := metricValue(connectionClosed.WithLabelValues(string(CloseLifetime)))
+	go s.handle(context.Background(), newCrypter(roleServer, []byte("fooman"), server, false), h)
+
+	c := newCrypter(roleClient, []byte("fooman"), client, false)
+	start := outcomeTestRequest(Authenticate)
+	_, err := c.write(start)
+	require.NoError(t, err)
+	assert.Equal(t, AuthenStatusGetPass, lifetimeReply(t, c).Status)
+
+	// the session is still in flight once the lifetime passes, so the connection stays open
+	time.Sleep(2 * lifetime)
+	cont := NewPacket(
+		SetPacketHeader(NewHeader(SetHeaderType(Authenticate), SetHeaderSeqNo(3), SetHeaderSessionID(start.Header.SessionID), SetHeaderVersion(start.Header.Version))),
+		SetPacketBodyUnsafe(NewAuthenContinue(SetAuthenContinueUserMessage("secret"))),
+	)
+	_, err = c.write(cont)
+	require.NoError(t, err)
+	assert.Equal(t, AuthenStatusPass, lifetimeReply(t, c).Status)
+
+	select {
+	case reason := <-reasons:
+		assert.Equal(t, CloseLifetime, reason)
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection was not closed once its session completed")
+	}
+	assert.Equal(t, before+1, metricValue(connectionClosed.WithLabelValues(string(CloseLifetime))))
+}
+
+func TestConnectionLifetimeDrainIdle(t *testing.T) {
+	reasons := make(chan CloseReason, 1)
+	s := NewServer(nopLogger{}, nil, SetIdleTimeout(5*time.Second), SetMaxConnectionLifetime(50*time.Millisecond), SetOnClose(func(ctx context.Context, remote net.Addr, reason CloseReason) {
+		reasons <- reason
+	}))
+	client, server := net.Pipe()
+	defer client.Close()
+	go s.handle(context.Background(), newCrypter(roleServer, []byte("fooman"), server, false), HandlerFunc(func(response Response, request Request) {}))
+
+	// an idle connection is closed when its lifetime passes, well before the idle timeout
+	select {
+	case reason := <-reasons:
+		assert.Equal(t, CloseLifetime, reason)
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle connection was not closed once its lifetime passed")
+	}
+}
+
+func TestConnectionLifetimeReject(t *testing.T) {
+	lifetime := 50 * time.Millisecond
+	reasons := make(chan CloseReason, 1)
+	s := NewServer(nopLogger{}, nil, SetIdleTimeout(5*time.Second), SetMaxConnectionLifetime(lifetime), SetOnClose(func(ctx context.Context, remote net.Addr, reason CloseReason) {
+		reasons <- reason
+	}))
+	h := rejectLifetime{HandlerFunc(func(response Response, request Request) {
+		response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusPass)))
+	})}
+	client, server := net.Pipe()
+	defer client.Close()
+	rejected := metricValue(serveLifetimeRejected)
+	go s.handle(context.Background(), newCrypter(roleServer, []byte("fooman"), server, false), h)
+
+	// the connection waits for the device, then refuses its new session so it reconnects
+	time.Sleep(2 * lifetime)
+	c := newCrypter(roleClient, []byte("fooman"), client, false)
+	_, err := c.write(outcomeTestRequest(Authenticate))
+	require.NoError(t, err)
+	assert.Equal(t, AuthenStatusError, lifetimeReply(t, c).Status)
+	assert.Equal(t, rejected+1, metricValue(serveLifetimeRejected))
+
+	select {
+	case reason := <-reasons:
+		assert.Equal(t, CloseLifetime, reason)
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection was not closed once its new session was refused")
+	}
+}
+
+func TestParseLifetimeExpiry(t *testing.T) {
+	for _, e := range []LifetimeExpiry{LifetimeDrain, LifetimeReject} {
+		v, err := ParseLifetimeExpiry(e.String())
+		assert.NoError(t, err)
+		assert.Equal(t, e, v)
+	}
+	_, err := ParseLifetimeExpiry("close")
+	assert.Error(t, err)
+}
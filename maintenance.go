@@ -0,0 +1,58 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import "sync"
+
+// maintenance is the maintenance mode of a Server
+type maintenance struct {
+	mu     sync.RWMutex
+	on     bool
+	detail string
+}
+
+// StartMaintenance puts the server in maintenance mode.  Every new authentication is failed with
+// the DenialMaintenance message of the device, followed by detail if set, eg "retry in 5m".  The
+// connection stays open, and authentications already in progress, authorization and accounting
+// are served as usual.  It may be called while the server runs, eg from an admin endpoint.
+func (s *Server) StartMaintenance(detail string) {
+	s.maintenance.mu.Lock()
+	defer s.maintenance.mu.Unlock()
+	s.maintenance.on = true
+	s.maintenance.detail = detail
+}
+
+// StopMaintenance takes the server out of maintenance mode
+func (s *Server) StopMaintenance() {
+	s.maintenance.mu.Lock()
+	defer s.maintenance.mu.Unlock()
+	s.maintenance.on = false
+	s.maintenance.detail = ""
+}
+
+// Maintenance reports if the server is in maintenance mode, and with what detail
+func (s *Server) Maintenance() (string, bool) {
+	s.maintenance.mu.RLock()
+	defer s.maintenance.mu.RUnlock()
+	return s.maintenance.detail, s.maintenance.on
+}
+
+// maintenanceWrap wraps the handler of new sessions on a connection.  While the server is in
+// maintenance mode it fails authentications instead of calling next.
+func (s *Server) maintenanceWrap(next Handler) Handler {
+	return HandlerFunc(func(response Response, request Request) {
+		detail, on := s.Maintenance()
+		if !on || request.Header.Type != Authenticate {
+			next.Handle(response, request)
+			return
+		}
+		serveMaintenanceDenied.Inc()
+		s.Infof(request.Context, "[%v] authentication failed, the server is in maintenance mode", request.Header.SessionID)
+		response.Reply(NewDenial(Authenticate, DenialMaintenance, detail))
+	})
+}
@@ -0,0 +1,77 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// maintenanceSecretProvider passes every authentication and accounting request
+type maintenanceSecretProvider struct{}
+
+func (maintenanceSecretProvider) Get(ctx context.Context, remote net.Addr) ([]byte, Handler, error) {
+	return []byte("fooman"), HandlerFunc(func(response Response, request Request) {
+		if request.Header.Type == Accounting {
+			response.Reply(NewAcctReply(SetAcctReplyStatus(AcctReplyStatusSuccess)))
+			return
+		}
+		response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusPass)))
+	}), nil
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	require.NoError(t, err)
+	s := NewServer(nopLogger{}, maintenanceSecretProvider{}, SetImplicitSessionReuse(true))
+	go s.Serve(ctx, listener.(*net.TCPListener))
+
+	// every exchange below is a new session on the one connection
+	c, err := NewClient(SetClientDialer("tcp6", listener.Addr().String(), []byte("fooman")))
+	require.NoError(t, err)
+	defer c.Close()
+	id := SessionID(1)
+	send := func(ht HeaderType) []byte {
+		p := outcomeTestRequest(ht)
+		p.Header.SessionID = id
+		id++
+		resp, err := c.Send(p)
+		require.NoError(t, err)
+		return resp.Body
+	}
+	authenticate := func() AuthenReply {
+		var reply AuthenReply
+		require.NoError(t, Unmarshal(send(Authenticate), &reply))
+		return reply
+	}
+	account := func() AcctReplyStatus {
+		var reply AcctReply
+		require.NoError(t, Unmarshal(send(Accounting), &reply))
+		return reply.Status
+	}
+
+	assert.Equal(t, AuthenStatusPass, authenticate().Status)
+
+	s.StartMaintenance("retry in 5m")
+	detail, on := s.Maintenance()
+	assert.True(t, on)
+	assert.Equal(t, "retry in 5m", detail)
+	reply := authenticate()
+	assert.Equal(t, AuthenStatusFail, reply.Status)
+	assert.Equal(t, AuthenServerMsg("service is under maintenance, try again later; retry in 5m"), reply.ServerMsg)
+	assert.Equal(t, AcctReplyStatusSuccess, account())
+
+	s.StopMaintenance()
+	assert.Equal(t, AuthenStatusPass, authenticate().Status)
+}
@@ -0,0 +1,241 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"crypto/rand"
+	"fmt"
+	"time"
+)
+
+// Counter is a metric that counts up
+type Counter interface {
+	Inc()
+	Add(float64)
+}
+
+// Gauge is a metric that counts up and down
+type Gauge interface {
+	Counter
+	Dec()
+}
+
+// Observer is a metric that observes values, a histogram or a summary
+type Observer interface {
+	Observe(float64)
+}
+
+// CounterVec is a Counter partitioned by the values of its labels
+type CounterVec interface {
+	WithLabelValues(lvs ...string) Counter
+}
+
+// ObserverVec is an Observer partitioned by the values of its labels
+type ObserverVec interface {
+	WithLabelValues(lvs ...string) Observer
+}
+
+// MetricOpts describe a metric of the package.  Name has no namespace, the Metrics adds one.
+type MetricOpts struct {
+	Name string
+	Help string
+	// Labels are the label names of a vector
+	Labels []string
+	// Buckets are the upper bounds of the buckets of a histogram
+	Buckets []float64
+	// Objectives are the quantiles and their absolute errors of a summary, it is a histogram if
+	// they are not set
+	Objectives map[float64]float64
+}
+
+// Metrics creates the metrics the package reports, see SetMetrics.  The package depends on the
+// standard library only; github.com/facebookincubator/tacquito/prommetrics implements Metrics with
+// prometheus.
+type Metrics interface {
+	Counter(opts MetricOpts) Counter
+	CounterVec(opts MetricOpts) CounterVec
+	Gauge(opts MetricOpts) Gauge
+	// GaugeFunc reports the value of f whenever the metrics are collected
+	GaugeFunc(opts MetricOpts, f func() float64)
+	Observer(opts MetricOpts) Observer
+	ObserverVec(opts MetricOpts) ObserverVec
+}
+
+// SetMetrics creates every metric of the package with m.  It must be called before any server,
+// client or crypter is created, eg at the start of main.  The metrics discard their values until it
+// is called, and importing github.com/facebookincubator/tacquito/prommetrics calls it with the
+// default prometheus registry.  A later call replaces the metrics of an earlier one.
+func SetMetrics(m Metrics) {
+	for _, b := range registered {
+		b.bind(m)
+	}
+}
+
+// binder is a metric of the package, created with the Metrics given to SetMetrics
+type binder interface {
+	bind(m Metrics)
+}
+
+// registered are the metrics of the package, see stats.go
+var registered []binder
+
+// counterMetric is a Counter of the package
+type counterMetric struct {
+	Counter
+	opts MetricOpts
+}
+
+func (c *counterMetric) bind(m Metrics) { c.Counter = m.Counter(c.opts) }
+
+// newCounter registers the counter name
+func newCounter(name, help string) *counterMetric {
+	c := &counterMetric{Counter: nopMetric{}, opts: MetricOpts{Name: name, Help: help}}
+	registered = append(registered, c)
+	return c
+}
+
+// counterVecMetric is a CounterVec of the package
+type counterVecMetric struct {
+	CounterVec
+	opts MetricOpts
+}
+
+func (c *counterVecMetric) bind(m Metrics) { c.CounterVec = m.CounterVec(c.opts) }
+
+// newCounterVec registers the counter vector name with labels
+func newCounterVec(name, help string, labels ...string) *counterVecMetric {
+	c := &counterVecMetric{CounterVec: nopCounterVec{}, opts: MetricOpts{Name: name, Help: help, Labels: labels}}
+	registered = append(registered, c)
+	return c
+}
+
+// gaugeMetric is a Gauge of the package
+type gaugeMetric struct {
+	Gauge
+	opts MetricOpts
+}
+
+func (g *gaugeMetric) bind(m Metrics) { g.Gauge = m.Gauge(g.opts) }
+
+// newGauge registers the gauge name
+func newGauge(name, help string) *gaugeMetric {
+	g := &gaugeMetric{Gauge: nopMetric{}, opts: MetricOpts{Name: name, Help: help}}
+	registered = append(registered, g)
+	return g
+}
+
+// gaugeFuncMetric is a gauge of the package whose value is read from f
+type gaugeFuncMetric struct {
+	f    func() float64
+	opts MetricOpts
+}
+
+func (g *gaugeFuncMetric) bind(m Metrics) { m.GaugeFunc(g.opts, g.f) }
+
+// newGaugeFunc registers the gauge name, whose value is read from f
+func newGaugeFunc(name, help string, f func() float64) *gaugeFuncMetric {
+	g := &gaugeFuncMetric{f: f, opts: MetricOpts{Name: name, Help: help}}
+	registered = append(registered, g)
+	return g
+}
+
+// observerMetric is an Observer of the package
+type observerMetric struct {
+	Observer
+	opts MetricOpts
+}
+
+func (o *observerMetric) bind(m Metrics) { o.Observer = m.Observer(o.opts) }
+
+// newHistogram registers the histogram name with buckets
+func newHistogram(name, help string, buckets []float64) *observerMetric {
+	o := &observerMetric{Observer: nopMetric{}, opts: MetricOpts{Name: name, Help: help, Buckets: buckets}}
+	registered = append(registered, o)
+	return o
+}
+
+// summaryObjectives are the quantiles of every summary of the package
+var summaryObjectives = map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}
+
+// newSummary registers the summary name
+func newSummary(name, help string) *observerMetric {
+	o := &observerMetric{Observer: nopMetric{}, opts: MetricOpts{Name: name, Help: help, Objectives: summaryObjectives}}
+	registered = append(registered, o)
+	return o
+}
+
+// observerVecMetric is an ObserverVec of the package
+type observerVecMetric struct {
+	ObserverVec
+	opts MetricOpts
+}
+
+func (o *observerVecMetric) bind(m Metrics) { o.ObserverVec = m.ObserverVec(o.opts) }
+
+// newHistogramVec registers the histogram vector name with buckets and labels
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *observerVecMetric {
+	o := &observerVecMetric{ObserverVec: nopObserverVec{}, opts: MetricOpts{Name: name, Help: help, Labels: labels, Buckets: buckets}}
+	registered = append(registered, o)
+	return o
+}
+
+// exponentialBuckets returns count bucket bounds, the first start and each factor times the one
+// before
+func exponentialBuckets(start, factor float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
+
+// nopMetric is every metric until SetMetrics is called, it discards its values
+type nopMetric struct{}
+
+func (nopMetric) Inc()            {}
+func (nopMetric) Dec()            {}
+func (nopMetric) Add(float64)     {}
+func (nopMetric) Observe(float64) {}
+
+// nopCounterVec is every CounterVec until SetMetrics is called
+type nopCounterVec struct{}
+
+func (nopCounterVec) WithLabelValues(...string) Counter { return nopMetric{} }
+
+// nopObserverVec is every ObserverVec until SetMetrics is called
+type nopObserverVec struct{}
+
+func (nopObserverVec) WithLabelValues(...string) Observer { return nopMetric{} }
+
+// durationTimer observes the time since it was started, in milliseconds
+type durationTimer struct {
+	start time.Time
+	o     Observer
+}
+
+// newTimer starts a durationTimer for o
+func newTimer(o Observer) *durationTimer {
+	return &durationTimer{start: time.Now(), o: o}
+}
+
+// ObserveDuration observes the time since the timer was started
+func (t *durationTimer) ObserveDuration() {
+	t.o.Observe(float64(time.Since(t.start)) / float64(time.Millisecond))
+}
+
+// newRequestID returns a random version 4 uuid that identifies the requests of a connection
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,159 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	// the tests read the metrics they move from testMetrics
+	SetMetrics(testMetrics{})
+	os.Exit(m.Run())
+}
+
+// testMetrics implements Metrics with testMetric, whose values the tests read with metricValue
+// and observations
+type testMetrics struct{}
+
+func (testMetrics) Counter(MetricOpts) Counter           { return &testMetric{} }
+func (testMetrics) CounterVec(MetricOpts) CounterVec     { return &testCounterVec{} }
+func (testMetrics) Gauge(MetricOpts) Gauge               { return &testMetric{} }
+func (testMetrics) GaugeFunc(MetricOpts, func() float64) {}
+func (testMetrics) Observer(MetricOpts) Observer         { return &testMetric{} }
+func (testMetrics) ObserverVec(MetricOpts) ObserverVec   { return &testObserverVec{} }
+
+// testMetric is a counter, gauge or observer that keeps its value, or the count and sum of what
+// it observed
+type testMetric struct {
+	mu    sync.Mutex
+	value float64
+	count uint64
+}
+
+func (m *testMetric) Inc() { m.Add(1) }
+func (m *testMetric) Dec() { m.Add(-1) }
+
+func (m *testMetric) Add(v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.value += v
+}
+
+func (m *testMetric) Observe(v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.value += v
+	m.count++
+}
+
+// testVec is a vector of testMetric by label values
+type testVec struct {
+	mu      sync.Mutex
+	metrics map[string]*testMetric
+}
+
+func (v *testVec) get(lvs []string) *testMetric {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	key := strings.Join(lvs, "\x00")
+	m, ok := v.metrics[key]
+	if !ok {
+		if v.metrics == nil {
+			v.metrics = make(map[string]*testMetric)
+		}
+		m = &testMetric{}
+		v.metrics[key] = m
+	}
+	return m
+}
+
+// testCounterVec is a CounterVec of testMetric
+type testCounterVec struct{ testVec }
+
+func (v *testCounterVec) WithLabelValues(lvs ...string) Counter { return v.get(lvs) }
+
+// testObserverVec is an ObserverVec of testMetric
+type testObserverVec struct{ testVec }
+
+func (v *testObserverVec) WithLabelValues(lvs ...string) Observer { return v.get(lvs) }
+
+// testMetricOf returns the testMetric of m, a metric of the package or one of its vectors
+func testMetricOf(m interface{}) *testMetric {
+	switch v := m.(type) {
+	case *counterMetric:
+		m = v.Counter
+	case *gaugeMetric:
+		m = v.Gauge
+	case *observerMetric:
+		m = v.Observer
+	}
+	return m.(*testMetric)
+}
+
+// metricValue returns the value of the counter or gauge m
+func metricValue(m interface{}) float64 {
+	t := testMetricOf(m)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.value
+}
+
+// observations returns the number and sum of the values the observer m observed
+func observations(m interface{}) (uint64, float64) {
+	t := testMetricOf(m)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.count, t.value
+}
+
+func TestRegisteredMetrics(t *testing.T) {
+	// every metric is registered once, under a name of its own, and is described
+	names := make(map[string]bool)
+	for _, b := range registered {
+		var opts MetricOpts
+		switch m := b.(type) {
+		case *counterMetric:
+			opts = m.opts
+		case *counterVecMetric:
+			opts = m.opts
+			assert.NotEmpty(t, opts.Labels, opts.Name)
+		case *gaugeMetric:
+			opts = m.opts
+		case *gaugeFuncMetric:
+			opts = m.opts
+		case *observerMetric:
+			opts = m.opts
+			assert.True(t, opts.Buckets != nil || opts.Objectives != nil, opts.Name)
+		case *observerVecMetric:
+			opts = m.opts
+			assert.NotEmpty(t, opts.Labels, opts.Name)
+		default:
+			t.Fatalf("unknown metric %T", b)
+		}
+		assert.False(t, names[opts.Name], "%v is registered twice", opts.Name)
+		names[opts.Name] = true
+		assert.NotEmpty(t, opts.Help, opts.Name)
+		assert.False(t, strings.HasPrefix(opts.Name, "tacquito"), opts.Name)
+	}
+	assert.True(t, names["crypter_read"])
+}
+
+func TestNopMetrics(t *testing.T) {
+	// the metrics discard their values until SetMetrics is called
+	c := &counterVecMetric{CounterVec: nopCounterVec{}}
+	c.WithLabelValues("a").Inc()
+	o := &observerVecMetric{ObserverVec: nopObserverVec{}}
+	o.WithLabelValues("a").Observe(1)
+	assert.Equal(t, []float64{1, 4, 16}, exponentialBuckets(1, 4, 3))
+}
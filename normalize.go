@@ -0,0 +1,281 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// InvalidUTF8Policy is what the server does with a user, port or rem_addr field that is not valid
+// utf-8, see StringNormalization
+type InvalidUTF8Policy uint8
+
+const (
+	// InvalidUTF8Pass leaves the field as it is, handlers see the bytes the device sent
+	InvalidUTF8Pass InvalidUTF8Policy = iota
+	// InvalidUTF8Replace replaces each run of invalid bytes with U+FFFD
+	InvalidUTF8Replace
+	// InvalidUTF8Reject answers the request with the error reply of its type
+	InvalidUTF8Reject
+	// InvalidUTF8Latin1 transcodes the field from latin-1, as sent by devices that do not speak
+	// utf-8, eg "ren\xe9" becomes "rené"
+	InvalidUTF8Latin1
+)
+
+// String returns the name of the policy
+func (p InvalidUTF8Policy) String() string {
+	switch p {
+	case InvalidUTF8Pass:
+		return "pass"
+	case InvalidUTF8Replace:
+		return "replace"
+	case InvalidUTF8Reject:
+		return "reject"
+	case InvalidUTF8Latin1:
+		return "latin1"
+	}
+	return fmt.Sprintf("unknown(%d)", int(p))
+}
+
+// ParseInvalidUTF8Policy returns the InvalidUTF8Policy named v, pass, replace, reject or latin1
+func ParseInvalidUTF8Policy(v string) (InvalidUTF8Policy, error) {
+	switch v {
+	case "pass":
+		return InvalidUTF8Pass, nil
+	case "replace":
+		return InvalidUTF8Replace, nil
+	case "reject":
+		return InvalidUTF8Reject, nil
+	case "latin1":
+		return InvalidUTF8Latin1, nil
+	}
+	return 0, fmt.Errorf("unknown invalid utf-8 policy [%v], expected pass, replace, reject or latin1", v)
+}
+
+// StringNormalization is how the user, port and rem_addr fields of the request that starts a
+// session are canonicalized before any handler decodes them, as devices pad or terminate them
+// inconsistently.  Trailing NULs are always stripped.  The raw fields of a request that was changed
+// are kept for audit, see RequestRawFields.
+type StringNormalization struct {
+	// TrimSpace also strips trailing white space
+	TrimSpace bool
+	// InvalidUTF8 is what is done with a field that is not valid utf-8
+	InvalidUTF8 InvalidUTF8Policy
+}
+
+// DefaultStringNormalization only strips trailing NULs
+var DefaultStringNormalization = StringNormalization{}
+
+// StringNormalizationPolicy may be implemented by the Handler returned from a SecretProvider to set
+// the StringNormalization of the devices it serves.  DefaultStringNormalization is used otherwise.
+type StringNormalizationPolicy interface {
+	StringNormalization() StringNormalization
+}
+
+// ContextRawFields is the RawFields of a request whose fields were normalized, see
+// RequestRawFields
+const ContextRawFields ContextKey = "raw-fields"
+
+// RawFields are the user, port and rem_addr fields of a request as the device sent them, before
+// they were normalized.  Only the fields that were changed are set.  They are bytes, base64 in
+// json, as they may not be valid utf-8.
+type RawFields struct {
+	User    []byte `json:"user,omitempty"`
+	Port    []byte `json:"port,omitempty"`
+	RemAddr []byte `json:"rem_addr,omitempty"`
+}
+
+// RequestRawFields returns the RawFields of the request with ctx, if its fields were normalized
+func RequestRawFields(ctx context.Context) (RawFields, bool) {
+	if ctx == nil {
+		return RawFields{}, false
+	}
+	f, ok := ctx.Value(ContextRawFields).(RawFields)
+	return f, ok
+}
+
+// ErrInvalidUTF8 is returned for a field that is not valid utf-8 under InvalidUTF8Reject, or that
+// no longer fits its length byte once replaced or transcoded
+type ErrInvalidUTF8 struct {
+	Field string
+	// TooLong is set if the field was made valid but is then longer than a field can be
+	TooLong bool
+}
+
+// Error ...
+func (e ErrInvalidUTF8) Error() string {
+	if e.TooLong {
+		return fmt.Sprintf("%v is too long as utf-8", e.Field)
+	}
+	return fmt.Sprintf("%v is not valid utf-8", e.Field)
+}
+
+// normalizedFields are the names of the fields StringNormalization applies to, in the order they
+// are encoded in a request
+var normalizedFields = [...]string{"user", "port", "rem_addr"}
+
+// trailingSpace is the white space TrimSpace strips, along with NULs
+const trailingSpace = "\x00 \t\r\n\v\f"
+
+// apply returns p with its fields normalized, and their raw values if any changed.  p is returned
+// as it is if nothing changed, or if it is not a request that starts a session or is malformed, in
+// which case it is left to the handler.  A field rejected under InvalidUTF8Reject, or made longer
+// than maxByteFieldLength, returns *ErrInvalidUTF8.
+func (n StringNormalization) apply(p *Packet) (*Packet, RawFields, error) {
+	lengths, start, ok := requestFields(p)
+	if !ok {
+		return p, RawFields{}, nil
+	}
+	b := p.Body
+	if !n.changes(b[start:], b[lengths:lengths+len(normalizedFields)]) {
+		// most requests are left as they are, without allocating
+		return p, RawFields{}, nil
+	}
+	var raw RawFields
+	var values [len(normalizedFields)]string
+	changed := false
+	end := start
+	for i, field := range normalizedFields {
+		l := int(b[lengths+i])
+		v := string(b[end : end+l])
+		end += l
+		normalized, err := n.field(field, v)
+		if err != nil {
+			return p, RawFields{}, err
+		}
+		values[i] = normalized
+		if normalized == v {
+			continue
+		}
+		changed = true
+		switch field {
+		case "user":
+			raw.User = []byte(v)
+		case "port":
+			raw.Port = []byte(v)
+		case "rem_addr":
+			raw.RemAddr = []byte(v)
+		}
+	}
+	if !changed {
+		return p, RawFields{}, nil
+	}
+	// a replaced or transcoded field may be longer, field checked it still fits its byte
+	body := make([]byte, 0, len(b)+len(values[0])+len(values[1])+len(values[2])-(end-start))
+	body = append(body, b[:start]...)
+	for i, v := range values {
+		body[lengths+i] = uint8(len(v))
+		body = append(body, v...)
+	}
+	body = append(body, b[end:]...)
+	h := *p.Header
+	h.Length = uint32(len(body))
+	return &Packet{Header: &h, Body: body}, raw, nil
+}
+
+// changes reports if n changes any of the fields in b, whose lengths are given in order
+func (n StringNormalization) changes(b, lengths []byte) bool {
+	for _, l := range lengths {
+		v := b[:l]
+		b = b[l:]
+		if len(v) == 0 {
+			continue
+		}
+		last := v[len(v)-1]
+		if last == 0 || n.TrimSpace && strings.IndexByte(trailingSpace, last) >= 0 {
+			return true
+		}
+		if n.InvalidUTF8 != InvalidUTF8Pass && !utf8.Valid(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// field returns the normalized value v of field
+func (n StringNormalization) field(field, v string) (string, error) {
+	trimmed := strings.TrimRight(v, "\x00")
+	if trimmed != v {
+		requestFieldNormalized.WithLabelValues(field, "nul").Inc()
+	}
+	if n.TrimSpace {
+		if t := strings.TrimRight(trimmed, trailingSpace); t != trimmed {
+			requestFieldNormalized.WithLabelValues(field, "space").Inc()
+			trimmed = t
+		}
+	}
+	if utf8.ValidString(trimmed) {
+		return trimmed, nil
+	}
+	switch n.InvalidUTF8 {
+	case InvalidUTF8Replace:
+		requestFieldNormalized.WithLabelValues(field, "replace").Inc()
+		trimmed = strings.ToValidUTF8(trimmed, string(utf8.RuneError))
+	case InvalidUTF8Reject:
+		requestFieldNormalized.WithLabelValues(field, "reject").Inc()
+		return "", &ErrInvalidUTF8{Field: field}
+	case InvalidUTF8Latin1:
+		requestFieldNormalized.WithLabelValues(field, "latin1").Inc()
+		trimmed = latin1ToUTF8(trimmed)
+	default:
+		return trimmed, nil
+	}
+	if len(trimmed) > maxByteFieldLength {
+		return "", &ErrInvalidUTF8{Field: field, TooLong: true}
+	}
+	return trimmed, nil
+}
+
+// latin1ToUTF8 returns v, whose bytes are latin-1, as utf-8
+func latin1ToUTF8(v string) string {
+	var b strings.Builder
+	b.Grow(len(v) * 2)
+	for i := 0; i < len(v); i++ {
+		b.WriteRune(rune(v[i]))
+	}
+	return b.String()
+}
+
+// requestFields returns the offset of the length of the user field of p, followed by those of port
+// and rem_addr, and the offset of the user field, followed by port and rem_addr.  ok is false for
+// packets that are not requests starting a session, or whose body is too short to hold the fields.
+func requestFields(p *Packet) (lengths, start int, ok bool) {
+	if p == nil || p.Header == nil || p.Header.SeqNo != 1 {
+		return 0, 0, false
+	}
+	b := p.Body
+	switch p.Header.Type {
+	case Authenticate:
+		// action, priv_lvl, authen_type, authen_service, then the lengths of user, port, rem_addr
+		// and data
+		lengths, start = 4, 8
+	case Authorize:
+		// authen_method, priv_lvl, authen_type, authen_service, then the lengths of user, port,
+		// rem_addr, arg_cnt and one per arg
+		if len(b) < 8 {
+			return 0, 0, false
+		}
+		lengths, start = 4, 8+int(b[7])
+	case Accounting:
+		// flags ahead of the same layout as an authorization request
+		if len(b) < 9 {
+			return 0, 0, false
+		}
+		lengths, start = 5, 9+int(b[8])
+	default:
+		return 0, 0, false
+	}
+	if len(b) < start {
+		return 0, 0, false
+	}
+	end := start + int(b[lengths]) + int(b[lengths+1]) + int(b[lengths+2])
+	return lengths, start, len(b) >= end
+}
@@ -0,0 +1,280 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// latin1User is a user name with an é in latin-1, which is not valid utf-8
+const latin1User = "ren\xe9"
+
+// normalizeTestPacket returns a request of type t from user on port, whose bytes are spliced in so
+// they need not be valid
+func normalizeTestPacket(t *testing.T, typ HeaderType, user, port string) *Packet {
+	p := outcomeTestRequest(typ)
+	var b []byte
+	switch typ {
+	case Authorize:
+		var body AuthorRequest
+		require.NoError(t, Unmarshal(p.Body, &body))
+		body.User, body.Port = "@", "#"
+		b = mustMarshal(t, &body)
+	case Accounting:
+		var body AcctRequest
+		require.NoError(t, Unmarshal(p.Body, &body))
+		body.User, body.Port = "@", "#"
+		b = mustMarshal(t, &body)
+	default:
+		var body AuthenStart
+		require.NoError(t, Unmarshal(p.Body, &body))
+		body.User, body.Port = "@", "#"
+		b = mustMarshal(t, &body)
+	}
+	lengths, _, ok := requestFields(&Packet{Header: p.Header, Body: b})
+	require.True(t, ok)
+	b[lengths], b[lengths+1] = uint8(len(user)), uint8(len(port))
+	b = bytes.Replace(b, []byte("@#"), []byte(user+port), 1)
+	h := *p.Header
+	h.Length = uint32(len(b))
+	return &Packet{Header: &h, Body: b}
+}
+
+// mustMarshal returns the bytes of v
+func mustMarshal(t *testing.T, v EncoderDecoder) []byte {
+	b, err := v.MarshalBinary()
+	require.NoError(t, err)
+	return b
+}
+
+func TestStringNormalization(t *testing.T) {
+	tests := []struct {
+		name          string
+		normalization StringNormalization
+		user, port    string
+		// wantUser and wantPort are the normalized fields, unchanged if empty
+		wantUser, wantPort string
+		err                bool
+	}{
+		{name: "nul terminated user", user: "cisco\x00", port: "tty0", wantUser: "cisco"},
+		{name: "nul padded user", user: "cisco\x00\x00\x00", port: "tty0", wantUser: "cisco"},
+		{name: "space padded port", user: "cisco", port: "tty0   "},
+		{name: "space padded port trimmed", normalization: StringNormalization{TrimSpace: true}, user: "cisco", port: "tty0 \t ", wantPort: "tty0"},
+		{name: "nul and space trimmed", normalization: StringNormalization{TrimSpace: true}, user: "cisco \x00", port: "tty0", wantUser: "cisco"},
+		{name: "latin-1 passed", user: latin1User, port: "tty0"},
+		{name: "latin-1 replaced", normalization: StringNormalization{InvalidUTF8: InvalidUTF8Replace}, user: latin1User, port: "tty0", wantUser: "ren\uFFFD"},
+		{name: "latin-1 transcoded", normalization: StringNormalization{InvalidUTF8: InvalidUTF8Latin1}, user: latin1User, port: "tty0", wantUser: "rené"},
+		{name: "utf-8 not transcoded", normalization: StringNormalization{InvalidUTF8: InvalidUTF8Latin1}, user: "rené", port: "tty0"},
+		{name: "transcoded too long", normalization: StringNormalization{InvalidUTF8: InvalidUTF8Latin1}, user: strings.Repeat("\xe9", 200), port: "tty0", err: true},
+		{name: "latin-1 rejected", normalization: StringNormalization{InvalidUTF8: InvalidUTF8Reject}, user: latin1User, port: "tty0", err: true},
+		{name: "utf-8 not rejected", normalization: StringNormalization{InvalidUTF8: InvalidUTF8Reject}, user: "rené", port: "tty0"},
+	}
+	for _, test := range tests {
+		for _, typ := range []HeaderType{Authenticate, Authorize, Accounting} {
+			t.Run(test.name+"/"+typ.String(), func(t *testing.T) {
+				p := normalizeTestPacket(t, typ, test.user, test.port)
+				original := append([]byte{}, p.Body...)
+				normalized, raw, err := test.normalization.apply(p)
+				assert.Equal(t, original, p.Body, "the packet read is not modified")
+				if test.err {
+					var invalid *ErrInvalidUTF8
+					if assert.ErrorAs(t, err, &invalid) {
+						assert.Equal(t, "user", invalid.Field)
+					}
+					return
+				}
+				require.NoError(t, err)
+				if test.wantUser == "" && test.wantPort == "" {
+					assert.Same(t, p, normalized)
+					assert.Equal(t, RawFields{}, raw)
+					return
+				}
+				want := normalizeTestPacket(t, typ, pick(test.wantUser, test.user), pick(test.wantPort, test.port))
+				assert.Equal(t, want, normalized)
+				var wantRaw RawFields
+				if test.wantUser != "" {
+					wantRaw.User = []byte(test.user)
+				}
+				if test.wantPort != "" {
+					wantRaw.Port = []byte(test.port)
+				}
+				assert.Equal(t, wantRaw, raw)
+			})
+		}
+	}
+}
+
+// pick returns v, or otherwise if v is empty
+func pick(v, otherwise string) string {
+	if v == "" {
+		return otherwise
+	}
+	return v
+}
+
+func TestStringNormalizationSkips(t *testing.T) {
+	// continuations, replies and malformed bodies are left as they are
+	p := normalizeTestPacket(t, Authenticate, "cisco\x00", "tty0")
+	p.Header.SeqNo = 3
+	normalized, _, err := DefaultStringNormalization.apply(p)
+	assert.NoError(t, err)
+	assert.Same(t, p, normalized)
+
+	p = normalizeTestPacket(t, Accounting, "cisco\x00", "tty0")
+	p.Body = p.Body[:12]
+	normalized, _, err = DefaultStringNormalization.apply(p)
+	assert.NoError(t, err)
+	assert.Same(t, p, normalized)
+}
+
+// normalizationPolicyHandler is a Handler with a StringNormalizationPolicy
+type normalizationPolicyHandler struct {
+	HandlerFunc
+	normalization StringNormalization
+}
+
+// StringNormalization implements StringNormalizationPolicy
+func (h normalizationPolicyHandler) StringNormalization() StringNormalization {
+	return h.normalization
+}
+
+// sendNormalizeTest sends p to addr and returns the reply
+func sendNormalizeTest(t *testing.T, addr string, p *Packet) *Packet {
+	conn, err := net.Dial("tcp6", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	c := newCrypter(roleClient, []byte("fooman"), conn, false)
+	_, err = c.write(p)
+	require.NoError(t, err)
+	resp, err := c.read()
+	require.NoError(t, err)
+	return resp
+}
+
+func TestStringNormalizationServed(t *testing.T) {
+	records := make(chan AcctRecord, 1)
+	handler := normalizationPolicyHandler{
+		HandlerFunc: func(response Response, request Request) {
+			var body AcctRequest
+			if assert.NoError(t, Unmarshal(request.Body, &body)) {
+				records <- NewAcctRecord(request, body)
+			}
+			response.Reply(NewAcctReply(SetAcctReplyStatus(AcctReplyStatusSuccess)))
+		},
+		normalization: StringNormalization{TrimSpace: true},
+	}
+	addr, _ := startPeerServer(t, handler, SetConformanceCheck(true))
+	nul := metricValue(requestFieldNormalized.WithLabelValues("user", "nul"))
+	space := metricValue(requestFieldNormalized.WithLabelValues("port", "space"))
+
+	resp := sendNormalizeTest(t, addr, normalizeTestPacket(t, Accounting, "cisco\x00", "tty0  "))
+	var reply AcctReply
+	require.NoError(t, Unmarshal(resp.Body, &reply))
+	assert.Equal(t, AcctReplyStatusSuccess, reply.Status)
+
+	// the canonical fields feed the handler, the raw ones the audit record
+	record := <-records
+	assert.Equal(t, AuthenUser("cisco"), record.User)
+	assert.Equal(t, AuthenPort("tty0"), record.Port)
+	require.NotNil(t, record.Raw)
+	assert.Equal(t, RawFields{User: []byte("cisco\x00"), Port: []byte("tty0  ")}, *record.Raw)
+	b, err := json.Marshal(record)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), `"raw":{"user":"Y2lzY28A","port":"dHR5MCAg"}`)
+	assert.Equal(t, nul+1, metricValue(requestFieldNormalized.WithLabelValues("user", "nul")))
+	assert.Equal(t, space+1, metricValue(requestFieldNormalized.WithLabelValues("port", "space")))
+
+	// a request left as it is has no raw fields
+	sendNormalizeTest(t, addr, normalizeTestPacket(t, Accounting, "cisco", "tty0"))
+	assert.Nil(t, (<-records).Raw)
+}
+
+func TestStringNormalizationRejected(t *testing.T) {
+	var handled int32
+	handler := normalizationPolicyHandler{
+		HandlerFunc: func(response Response, request Request) {
+			atomic.AddInt32(&handled, 1)
+			response.Reply(NewAuthorReply(SetAuthorReplyStatus(AuthorStatusPassAdd)))
+		},
+		normalization: StringNormalization{InvalidUTF8: InvalidUTF8Reject},
+	}
+	addr, _ := startPeerServer(t, handler)
+
+	resp := sendNormalizeTest(t, addr, normalizeTestPacket(t, Authorize, latin1User, "tty0"))
+	var reply AuthorReply
+	require.NoError(t, Unmarshal(resp.Body, &reply))
+	assert.Equal(t, AuthorStatusError, reply.Status)
+	assert.Equal(t, AuthorServerMsg("user is not valid utf-8"), reply.ServerMsg)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&handled))
+}
+
+func TestStringNormalizationPolicies(t *testing.T) {
+	// the user a handler decodes under each policy, from a device sending latin-1 or utf-8
+	for _, test := range []struct {
+		policy InvalidUTF8Policy
+		user   string
+		// want is the user the handler sees, the request is refused if empty
+		want AuthenUser
+	}{
+		{policy: InvalidUTF8Pass, user: latin1User, want: latin1User},
+		{policy: InvalidUTF8Pass, user: "rené", want: "rené"},
+		{policy: InvalidUTF8Replace, user: latin1User, want: "ren\uFFFD"},
+		{policy: InvalidUTF8Replace, user: "rené", want: "rené"},
+		{policy: InvalidUTF8Reject, user: latin1User},
+		{policy: InvalidUTF8Reject, user: "rené", want: "rené"},
+		{policy: InvalidUTF8Latin1, user: latin1User, want: "rené"},
+		{policy: InvalidUTF8Latin1, user: "rené", want: "rené"},
+	} {
+		t.Run(fmt.Sprintf("%v/%q", test.policy, test.user), func(t *testing.T) {
+			users := make(chan AuthenUser, 1)
+			handler := normalizationPolicyHandler{
+				HandlerFunc: func(response Response, request Request) {
+					var body AuthenStart
+					if assert.NoError(t, Unmarshal(request.Body, &body)) {
+						users <- body.User
+					}
+					response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusPass)))
+				},
+				normalization: StringNormalization{InvalidUTF8: test.policy},
+			}
+			addr, _ := startPeerServer(t, handler, SetConformanceCheck(true))
+
+			resp := sendNormalizeTest(t, addr, normalizeTestPacket(t, Authenticate, test.user, "tty0"))
+			var reply AuthenReply
+			require.NoError(t, Unmarshal(resp.Body, &reply))
+			if test.want == "" {
+				assert.Equal(t, AuthenStatusError, reply.Status)
+				assert.Empty(t, users)
+				return
+			}
+			assert.Equal(t, AuthenStatusPass, reply.Status)
+			assert.Equal(t, test.want, <-users)
+		})
+	}
+}
+
+func TestParseInvalidUTF8Policy(t *testing.T) {
+	for _, p := range []InvalidUTF8Policy{InvalidUTF8Pass, InvalidUTF8Replace, InvalidUTF8Reject, InvalidUTF8Latin1} {
+		parsed, err := ParseInvalidUTF8Policy(p.String())
+		assert.NoError(t, err)
+		assert.Equal(t, p, parsed)
+	}
+	_, err := ParseInvalidUTF8Policy("cp1252")
+	assert.Error(t, err)
+}
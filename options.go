@@ -0,0 +1,295 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// OptionError is returned when an option was given a value that cannot be used.  Option is the
+// name of the setter, eg SetIdleTimeout.
+type OptionError struct {
+	Option string
+	Value  interface{}
+	Reason string
+}
+
+// Error ...
+func (e *OptionError) Error() string {
+	return fmt.Sprintf("invalid value [%v] for %v; %v", e.Value, e.Option, e.Reason)
+}
+
+// ServerOptions holds the optional settings of a Server as plain fields, for callers that build
+// them from data rather than code.  There is a field for every Option.  Zero values leave the
+// current setting in place, so settings whose zero value is meaningful are pointers.  Apply it
+// with SetServerOptions.
+type ServerOptions struct {
+	UseProxy                 bool
+	IdleTimeout              time.Duration
+	SingleConnectIdleTimeout time.Duration
+	HandlerTimeout           time.Duration
+	TimeoutJitter            float64
+	ConformanceCheck         bool
+	Tracer                   *Tracer
+	EmptyBody                map[HeaderType]EmptyBodyPolicy
+	BodyLengthCheck          bool
+	ReplyCheck               bool
+	BodyOwnershipCheck       bool
+	OnClose                  CloseFunc
+	ImplicitSessionReuse     bool
+	BadSecretDetector        BadSecretDetector
+	PacketSink               PacketSink
+	Clock                    func() time.Time
+	// OnConnect are added in order, see SetOnConnect
+	OnConnect []NamedConnectFunc
+	// ConnectBudget and ConnectFailure are set together, see SetOnConnectPolicy
+	ConnectBudget           time.Duration
+	ConnectFailure          ConnDecision
+	FeatureTracker          *FeatureTracker
+	SecretGracePeriod       time.Duration
+	MetricsIdentity         IdentityObfuscator
+	MaxInteractiveSessions  int
+	InteractiveStoreFailure *StoreFailure
+	MaxConnectionLifetime   time.Duration
+	PacketTransport         func(conn net.Conn, secret []byte) PacketTransport
+	SecretRotationPace      int
+	ShutdownBudget          time.Duration
+	// ShutdownSinks are added in order, see SetShutdownSink
+	ShutdownSinks     []NamedShutdownSink
+	ShutdownSpool     Spool
+	Store             Store
+	RejectUnencrypted bool
+	PadCache          int
+	// WarmDevices and WarmBudget are set together, see SetSecretWarmup
+	WarmDevices []net.Addr
+	WarmBudget  time.Duration
+}
+
+// NamedConnectFunc is a ConnectFunc of ServerOptions and the name of its metrics
+type NamedConnectFunc struct {
+	Name string
+	Func ConnectFunc
+}
+
+// NamedShutdownSink is a ShutdownSink of ServerOptions and the name it is reported under
+type NamedShutdownSink struct {
+	Name string
+	Sink ShutdownSink
+}
+
+// SetServerOptions applies every set field of o using the matching Option
+func SetServerOptions(o ServerOptions) Option {
+	return func(s *Server) {
+		var opts []Option
+		if o.UseProxy {
+			opts = append(opts, SetUseProxy(o.UseProxy))
+		}
+		if o.IdleTimeout != 0 {
+			opts = append(opts, SetIdleTimeout(o.IdleTimeout))
+		}
+		if o.SingleConnectIdleTimeout != 0 {
+			opts = append(opts, SetSingleConnectIdleTimeout(o.SingleConnectIdleTimeout))
+		}
+		if o.HandlerTimeout != 0 {
+			opts = append(opts, SetHandlerTimeout(o.HandlerTimeout))
+		}
+		if o.TimeoutJitter != 0 {
+			opts = append(opts, SetTimeoutJitter(o.TimeoutJitter))
+		}
+		if o.ConformanceCheck {
+			opts = append(opts, SetConformanceCheck(o.ConformanceCheck))
+		}
+		if o.Tracer != nil {
+			opts = append(opts, SetTracer(o.Tracer))
+		}
+		for t, p := range o.EmptyBody {
+			opts = append(opts, SetEmptyBodyPolicy(t, p))
+		}
+		if o.BodyLengthCheck {
+			opts = append(opts, SetBodyLengthCheck(o.BodyLengthCheck))
+		}
+		if o.ReplyCheck {
+			opts = append(opts, SetReplyCheck(o.ReplyCheck))
+		}
+		if o.BodyOwnershipCheck {
+			opts = append(opts, SetBodyOwnershipCheck(o.BodyOwnershipCheck))
+		}
+		if o.OnClose != nil {
+			opts = append(opts, SetOnClose(o.OnClose))
+		}
+		if o.ImplicitSessionReuse {
+			opts = append(opts, SetImplicitSessionReuse(o.ImplicitSessionReuse))
+		}
+		if o.BadSecretDetector != nil {
+			opts = append(opts, SetBadSecretDetector(o.BadSecretDetector))
+		}
+		if o.PacketSink != nil {
+			opts = append(opts, SetPacketSink(o.PacketSink))
+		}
+		if o.Clock != nil {
+			opts = append(opts, SetClock(o.Clock))
+		}
+		for _, c := range o.OnConnect {
+			opts = append(opts, SetOnConnect(c.Name, c.Func))
+		}
+		if o.ConnectBudget != 0 || o.ConnectFailure != ConnAccept {
+			budget := s.connectBudget
+			if o.ConnectBudget != 0 {
+				budget = o.ConnectBudget
+			}
+			opts = append(opts, SetOnConnectPolicy(budget, o.ConnectFailure))
+		}
+		if o.FeatureTracker != nil {
+			opts = append(opts, SetFeatureTracker(o.FeatureTracker))
+		}
+		if o.SecretGracePeriod != 0 {
+			opts = append(opts, SetSecretGracePeriod(o.SecretGracePeriod))
+		}
+		if o.MetricsIdentity != nil {
+			opts = append(opts, SetMetricsIdentity(o.MetricsIdentity))
+		}
+		if o.MaxInteractiveSessions != 0 {
+			opts = append(opts, SetMaxInteractiveSessions(o.MaxInteractiveSessions))
+		}
+		if o.InteractiveStoreFailure != nil {
+			opts = append(opts, SetInteractiveStoreFailure(*o.InteractiveStoreFailure))
+		}
+		if o.MaxConnectionLifetime != 0 {
+			opts = append(opts, SetMaxConnectionLifetime(o.MaxConnectionLifetime))
+		}
+		if o.PacketTransport != nil {
+			opts = append(opts, SetPacketTransport(o.PacketTransport))
+		}
+		if o.SecretRotationPace != 0 {
+			opts = append(opts, SetSecretRotationPace(o.SecretRotationPace))
+		}
+		if o.ShutdownBudget != 0 {
+			opts = append(opts, SetShutdownBudget(o.ShutdownBudget))
+		}
+		for _, sink := range o.ShutdownSinks {
+			opts = append(opts, SetShutdownSink(sink.Name, sink.Sink))
+		}
+		if o.ShutdownSpool != nil {
+			opts = append(opts, SetShutdownSpool(o.ShutdownSpool))
+		}
+		if o.Store != nil {
+			opts = append(opts, SetStore(o.Store))
+		}
+		if o.RejectUnencrypted {
+			opts = append(opts, SetRejectUnencrypted(o.RejectUnencrypted))
+		}
+		if o.PadCache != 0 {
+			opts = append(opts, SetPadCache(o.PadCache))
+		}
+		if o.WarmDevices != nil || o.WarmBudget != 0 {
+			opts = append(opts, SetSecretWarmup(o.WarmDevices, o.WarmBudget))
+		}
+		for _, opt := range opts {
+			opt(s)
+		}
+	}
+}
+
+// validate checks the settings of s once all options are applied
+func (s *Server) validate() error {
+	if s.SecretProvider == nil {
+		return &OptionError{Option: "NewServer", Value: s.SecretProvider, Reason: "a SecretProvider is required"}
+	}
+	if s.idleTimeout <= 0 {
+		return &OptionError{Option: "SetIdleTimeout", Value: s.idleTimeout, Reason: "must be positive"}
+	}
+	if s.singleConnectIdleTimeout <= 0 {
+		return &OptionError{Option: "SetSingleConnectIdleTimeout", Value: s.singleConnectIdleTimeout, Reason: "must be positive"}
+	}
+	if s.handlerTimeout < 0 {
+		return &OptionError{Option: "SetHandlerTimeout", Value: s.handlerTimeout, Reason: "must not be negative"}
+	}
+	if s.clock == nil {
+		return &OptionError{Option: "SetClock", Value: s.clock, Reason: "a clock is required"}
+	}
+	if s.timeoutJitter < 0 || s.timeoutJitter > 1 {
+		return &OptionError{Option: "SetTimeoutJitter", Value: s.timeoutJitter, Reason: "must be between 0 and 1"}
+	}
+	if s.warmBudget < 0 {
+		return &OptionError{Option: "SetSecretWarmup", Value: s.warmBudget, Reason: "budget must not be negative"}
+	}
+	if s.secretGrace < 0 {
+		return &OptionError{Option: "SetSecretGracePeriod", Value: s.secretGrace, Reason: "must not be negative"}
+	}
+	if s.connectBudget <= 0 {
+		return &OptionError{Option: "SetOnConnectPolicy", Value: s.connectBudget, Reason: "budget must be positive"}
+	}
+	if s.connectFailure < ConnAccept || s.connectFailure > ConnRejectWithReply {
+		return &OptionError{Option: "SetOnConnectPolicy", Value: s.connectFailure, Reason: "unknown failure decision"}
+	}
+	if s.rotationPace <= 0 {
+		return &OptionError{Option: "SetSecretRotationPace", Value: s.rotationPace, Reason: "must be positive"}
+	}
+	if s.padCacheEntries < 0 {
+		return &OptionError{Option: "SetPadCache", Value: s.padCacheEntries, Reason: "must not be negative"}
+	}
+	if s.maxLifetime < 0 {
+		return &OptionError{Option: "SetMaxConnectionLifetime", Value: s.maxLifetime, Reason: "must not be negative"}
+	}
+	if s.maxInteractive < 0 {
+		return &OptionError{Option: "SetMaxInteractiveSessions", Value: s.maxInteractive, Reason: "must not be negative"}
+	}
+	if s.store == nil {
+		return &OptionError{Option: "SetStore", Value: s.store, Reason: "a Store is required"}
+	}
+	if s.interactiveFailure != StoreFailClosed && s.interactiveFailure != StoreFailOpen {
+		return &OptionError{Option: "SetInteractiveStoreFailure", Value: s.interactiveFailure, Reason: "unknown failure policy"}
+	}
+	if s.shutdownBudget < 0 {
+		return &OptionError{Option: "SetShutdownBudget", Value: s.shutdownBudget, Reason: "must not be negative"}
+	}
+	for _, sink := range s.shutdownSinks {
+		if sink.ShutdownSink == nil {
+			return &OptionError{Option: "SetShutdownSink", Value: sink.name, Reason: "a sink is required"}
+		}
+	}
+	for t, p := range s.emptyBody {
+		if p != EmptyBodyReject && p != EmptyBodyIgnore {
+			return &OptionError{Option: "SetEmptyBodyPolicy", Value: p, Reason: fmt.Sprintf("unknown policy for packet type [%v]", t)}
+		}
+	}
+	return nil
+}
+
+// ClientOptions holds the settings of a Client as plain fields, for callers that build them
+// from data rather than code.  Apply it with SetClientOptions.
+type ClientOptions struct {
+	Network string
+	Address string
+	// LocalAddress is optional, see SetClientDialerWithLocalAddr
+	LocalAddress string
+	Secret       []byte
+}
+
+// SetClientOptions dials the server described by o
+func SetClientOptions(o ClientOptions) ClientOption {
+	return func(c *Client) error {
+		if o.Network == "" || o.Address == "" {
+			return &OptionError{Option: "SetClientOptions", Value: o.Network + " " + o.Address, Reason: "network and address are required"}
+		}
+		if o.LocalAddress != "" {
+			return SetClientDialerWithLocalAddr(o.Network, o.Address, o.LocalAddress, o.Secret)(c)
+		}
+		return SetClientDialer(o.Network, o.Address, o.Secret)(c)
+	}
+}
+
+// validate checks the settings of c once all options are applied
+func (c *Client) validate() error {
+	if c.crypter == nil {
+		return &OptionError{Option: "NewClient", Value: nil, Reason: "a dialer option such as SetClientDialer is required"}
+	}
+	return nil
+}
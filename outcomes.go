@@ -0,0 +1,96 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import "sync/atomic"
+
+const (
+	// originHandler marks replies decided by a Handler
+	originHandler = "handler"
+	// originServer marks replies the server synthesized, such as bad secret or timeout errors
+	originServer = "server"
+)
+
+// replyOutcome returns the packet type and status labels of the reply p.  Unknown statuses share
+// a single label to keep the cardinality bounded.
+func replyOutcome(p *Packet) (string, string) {
+	// unknown statuses share a label so they cannot grow the cardinality of the outcome metrics
+	status := "unknown"
+	switch p.Header.Type {
+	case Authenticate:
+		if len(p.Body) > 0 && AuthenStatus(p.Body[0]).IsKnown() {
+			status = AuthenStatus(p.Body[0]).String()
+		}
+	case Authorize:
+		if len(p.Body) > 0 && AuthorStatus(p.Body[0]).IsKnown() {
+			status = AuthorStatus(p.Body[0]).String()
+		}
+	case Accounting:
+		// status follows the server_msg and data lengths
+		if len(p.Body) > 4 && AcctReplyStatus(p.Body[4]).IsKnown() {
+			status = AcctReplyStatus(p.Body[4]).String()
+		}
+	default:
+		return "unknown", "unknown"
+	}
+	return p.Header.Type.String(), status
+}
+
+// successStatus holds the statuses that count as success for each packet type
+var successStatus = map[HeaderType][]string{
+	Authenticate: {AuthenStatusPass.String()},
+	Authorize:    {AuthorStatusPassAdd.String(), AuthorStatusPassRepl.String()},
+	Accounting:   {AcctReplyStatusSuccess.String()},
+}
+
+// ReplySuccessRatio returns the share of replies of packet type t sent since start up that were a
+// success, across handler and server origins.  Intermediate authenticate replies such as GetUser
+// are not counted either way.  False is returned if no final reply was sent yet.
+func ReplySuccessRatio(t HeaderType) (float64, bool) {
+	if int(t) >= len(replyTotals.final) {
+		return 0, false
+	}
+	total := atomic.LoadUint64(&replyTotals.final[t])
+	if total == 0 {
+		return 0, false
+	}
+	return float64(atomic.LoadUint64(&replyTotals.success[t])) / float64(total), true
+}
+
+// replyTotals counts the replies of ReplySuccessRatio, whatever the Metrics
+var replyTotals replyCounts
+
+// replyCounts are the final replies of each packet type and the successes among them
+type replyCounts struct {
+	final, success [Accounting + 1]uint64
+}
+
+// add counts n replies of the packet type and status named typ and status
+func (r *replyCounts) add(typ, status string, n int) {
+	var t HeaderType
+	switch typ {
+	case Authenticate.String():
+		t = Authenticate
+	case Authorize.String():
+		t = Authorize
+	case Accounting.String():
+		t = Accounting
+	default:
+		return
+	}
+	switch status {
+	case AuthenStatusGetData.String(), AuthenStatusGetUser.String(), AuthenStatusGetPass.String(), AuthenStatusRestart.String():
+		return
+	}
+	atomic.AddUint64(&r.final[t], uint64(n))
+	for _, s := range successStatus[t] {
+		if status == s {
+			atomic.AddUint64(&r.success[t], uint64(n))
+		}
+	}
+}
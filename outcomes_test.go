@@ -0,0 +1,127 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplyOutcomes(t *testing.T) {
+	tests := []struct {
+		name    string
+		packet  *Packet
+		secret  string
+		handler HandlerFunc
+		labels  []string
+	}{
+		{
+			name:   "authenticate pass",
+			packet: outcomeTestRequest(Authenticate),
+			handler: func(response Response, request Request) {
+				response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusPass)))
+			},
+			labels: []string{"Authenticate", "AuthenStatusPass", originHandler},
+		},
+		{
+			name:   "authorize fail",
+			packet: outcomeTestRequest(Authorize),
+			handler: func(response Response, request Request) {
+				response.Reply(NewAuthorReply(SetAuthorReplyStatus(AuthorStatusFail)))
+			},
+			labels: []string{"Authorize", "AuthorStatusFail", originHandler},
+		},
+		{
+			name:   "accounting success",
+			packet: outcomeTestRequest(Accounting),
+			handler: func(response Response, request Request) {
+				response.Reply(NewAcctReply(SetAcctReplyStatus(AcctReplyStatusSuccess)))
+			},
+			labels: []string{"Accounting", "AcctReplyStatusSuccess", originHandler},
+		},
+		{
+			name:   "bad secret",
+			packet: outcomeTestRequest(Authenticate),
+			secret: "not-fooman",
+			handler: func(response Response, request Request) {
+				response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusPass)))
+			},
+			labels: []string{"Authenticate", "AuthenStatusError", originServer},
+		},
+		{
+			name:   "handler timeout",
+			packet: outcomeTestRequest(Authorize),
+			handler: func(response Response, request Request) {
+				<-request.Context.Done()
+			},
+			labels: []string{"Authorize", "AuthorStatusError", originServer},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			secret := []byte("fooman")
+			if test.secret != "" {
+				secret = []byte(test.secret)
+			}
+			s := NewServer(nopLogger{}, nil, SetHandlerTimeout(50*time.Millisecond))
+			client, server := net.Pipe()
+			defer client.Close()
+			done := make(chan struct{})
+			go func() {
+				s.handle(context.Background(), newCrypter(roleServer, []byte("fooman"), server, false), test.handler)
+				close(done)
+			}()
+			before := metricValue(replyOutcomes.WithLabelValues(test.labels...))
+
+			c := newCrypter(roleClient, secret, client, false)
+			_, err := c.write(test.packet)
+			assert.NoError(t, err)
+			// a client with a bad secret cannot decode the reply, so only wait for it
+			_, err = readRawPacket(client)
+			assert.NoError(t, err)
+			client.Close()
+			<-done
+			assert.Equal(t, before+1, metricValue(replyOutcomes.WithLabelValues(test.labels...)))
+		})
+	}
+}
+
+func TestReplySuccessRatio(t *testing.T) {
+	saved := replyTotals
+	replyTotals = replyCounts{}
+	defer func() { replyTotals = saved }()
+	_, ok := ReplySuccessRatio(Authenticate)
+	assert.False(t, ok)
+
+	var tally *requestTally
+	outcome := func(typ, status, origin string, n int) {
+		for i := 0; i < n; i++ {
+			tally.outcome(typ, status, origin)
+		}
+	}
+	outcome("Authenticate", "AuthenStatusGetUser", originHandler, 5)
+	outcome("Authenticate", "AuthenStatusPass", originHandler, 3)
+	outcome("Authenticate", "AuthenStatusFail", originHandler, 1)
+	outcome("Authenticate", "AuthenStatusError", originServer, 2)
+	// a tally commits its outcomes in a batch
+	tally = &requestTally{}
+	outcome("Authorize", "AuthorStatusPassAdd", originHandler, 1)
+	tally.commit()
+	ratio, ok := ReplySuccessRatio(Authenticate)
+	assert.True(t, ok)
+	assert.Equal(t, 0.5, ratio)
+	ratio, ok = ReplySuccessRatio(Authorize)
+	assert.True(t, ok)
+	assert.Equal(t, 1.0, ratio)
+	_, ok = ReplySuccessRatio(Accounting)
+	assert.False(t, ok)
+}
@@ -0,0 +1,111 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// normalizingHandler breaks the ownership contract of Handler, upper casing the request in place
+func normalizingHandler(response Response, request Request) {
+	copy(request.Body, bytes.ToUpper(request.Body))
+	response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusPass)))
+}
+
+func TestMutatingHandlerObservers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	original := proxyTestPacket().Body
+	logger := &errorLogger{}
+
+	secondary := make(chan []byte, 1)
+	tee := NewTee(ctx, nopLogger{}, HandlerFunc(normalizingHandler), HandlerFunc(func(response Response, request Request) {
+		secondary <- append([]byte(nil), request.Body...)
+		response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusPass)))
+	}))
+	sink := &lockedBuffer{}
+	tracer := NewTracer(sink, TraceFilter{SessionID: 12345})
+	recorder := NewSessionRecorder(tee)
+	h := NewConformanceChecker(logger, tracer.Wrap(recorder))
+
+	assert.Equal(t, []AuthenStatus{AuthenStatusPass}, teeExchange(t, h, proxyTestPacket()))
+
+	// the shadow comparator
+	select {
+	case got := <-secondary:
+		assert.Equal(t, original, got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("request was not mirrored")
+	}
+	// the session recorder
+	f, ok := recorder.Fixture(12345)
+	if assert.True(t, ok) && assert.NotEmpty(t, f.Packets) {
+		var p Packet
+		assert.NoError(t, p.UnmarshalBinary(f.Packets[0].Raw))
+		assert.Equal(t, original, p.Body)
+	}
+	// the tracer
+	assert.Contains(t, sink.lines()[0], `user="cisco"`)
+	// and the conformance checker reports the handler
+	var found bool
+	for _, l := range logger.logs {
+		found = found || strings.Contains(l, "server violated ownership")
+	}
+	assert.True(t, found, logger.logs)
+}
+
+func TestBodyOwnershipCheck(t *testing.T) {
+	for _, check := range []bool{false, true} {
+		t.Run(fmt.Sprintf("check %v", check), func(t *testing.T) {
+			before := metricValue(requestBodyModified.WithLabelValues(Authenticate.String()))
+			logger := &errorLogger{}
+			client, server := net.Pipe()
+			s := NewServer(logger, nil, SetBodyOwnershipCheck(check))
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				s.handle(context.Background(), newCrypter(roleServer, []byte("fooman"), server, false), HandlerFunc(normalizingHandler))
+			}()
+
+			c := newCrypter(roleClient, []byte("fooman"), client, false)
+			_, err := c.write(featureTestStart(12345, 0, MinorVersionDefault, AuthenTypePAP))
+			require.NoError(t, err)
+			assert.Equal(t, AuthenStatusPass, lifetimeReply(t, c).Status)
+			client.Close()
+			<-done
+
+			var found bool
+			for _, l := range logger.logs {
+				found = found || strings.Contains(l, "a handler modified the body")
+			}
+			assert.Equal(t, check, found, logger.logs)
+			want := before
+			if check {
+				want++
+			}
+			assert.Equal(t, want, metricValue(requestBodyModified.WithLabelValues(Authenticate.String())))
+		})
+	}
+}
+
+func TestRequestSnapshot(t *testing.T) {
+	request := Request{Header: *proxyTestPacket().Header, Body: proxyTestPacket().Body}
+	snapshot := request.Snapshot()
+	assert.Equal(t, request, snapshot)
+	request.Body[0] ^= 0xff
+	assert.NotEqual(t, request.Body, snapshot.Body)
+}
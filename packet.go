@@ -103,7 +103,7 @@ func (p *Packet) MarshalBinary() ([]byte, error) {
 		return nil, fmt.Errorf("body is nil, cannot MarshalBinary")
 	}
 	if p.Header.Length > MaxBodyLength {
-		return nil, fmt.Errorf("indicated size is too large to marshal; max allowed [%v] reported [%v]", MaxBodyLength, p.Header.Length)
+		return nil, &LengthError{Field: "body", Length: int64(p.Header.Length), Max: int64(MaxBodyLength)}
 	}
 	head, err := p.Header.MarshalBinary()
 	if err != nil {
@@ -120,6 +120,9 @@ func (p *Packet) UnmarshalBinary(v []byte) error {
 	if v == nil {
 		return fmt.Errorf("cannot unmarshal a nil slice")
 	}
+	if len(v) < MaxHeaderLength {
+		return fmt.Errorf("packet size [%v] is too small for a header of size [%v]", len(v), MaxHeaderLength)
+	}
 	// Unmarshal failure will lead to the connection being closed
 	var err error
 	var h Header
@@ -129,7 +132,10 @@ func (p *Packet) UnmarshalBinary(v []byte) error {
 	}
 	p.Header = &h
 	if h.Length > MaxBodyLength {
-		return fmt.Errorf("indicated size is too large to unmarshal; max allowed [%v] reported [%v]", MaxBodyLength, h.Length)
+		return &LengthError{Field: "body", Length: int64(h.Length), Max: int64(MaxBodyLength)}
+	}
+	if len(v) < MaxHeaderLength+int(h.Length) {
+		return fmt.Errorf("packet body size [%v] is smaller than the indicated size [%v]", len(v)-MaxHeaderLength, h.Length)
 	}
 	p.Body = v[MaxHeaderLength : MaxHeaderLength+int(h.Length)]
 	return nil
@@ -204,11 +210,79 @@ func (b *readBuffer) string(n int) string {
 	return string(str)
 }
 
+// maxFieldLength is the longest variable length field of a body, its length is sent as a uint16
+const maxFieldLength = 0xffff
+
+// maxByteFieldLength is the longest user, port, rem_addr, authen start data or arg, their lengths
+// are sent as a uint8
+const maxByteFieldLength = 0xff
+
+// maxArgCount is the most args a body may carry, the count is sent as a uint8
+const maxArgCount = 0xff
+
+// LengthError is returned for a field, a count or a whole body that does not fit the length the
+// protocol allows for it
+type LengthError struct {
+	// Field is the name of the field on the wire, eg server_msg, or body for the whole body
+	Field  string
+	Length int64
+	Max    int64
+}
+
+// Error implements error
+func (e *LengthError) Error() string {
+	return fmt.Sprintf("%v length [%v] exceeds the maximum of [%v]", e.Field, e.Length, e.Max)
+}
+
+// fieldLength is the name, length and longest allowed length of a variable length field of a body
+type fieldLength struct {
+	name   string
+	length int
+	max    int
+}
+
+// validateLengths checks that each variable length field fits its length on the wire and that
+// the whole body, fixed bytes included, fits in MaxBodyLength.  MarshalBinary would otherwise
+// silently truncate the lengths and send a packet that does not decode.  Lengths are summed as
+// int64 so the total cannot overflow on 32 bit platforms.
+func validateLengths(fixed int, fields ...fieldLength) error {
+	total := int64(fixed)
+	for _, f := range fields {
+		if f.length > f.max {
+			return &LengthError{Field: f.name, Length: int64(f.length), Max: int64(f.max)}
+		}
+		total += int64(f.length)
+	}
+	if total > int64(MaxBodyLength) {
+		return &LengthError{Field: "body", Length: total, Max: int64(MaxBodyLength)}
+	}
+	return nil
+}
+
+// validateArgs checks the count of args and returns their total length.  The length of each arg
+// is checked by Arg.Validate.
+func validateArgs(args Args) (int, error) {
+	if len(args) > maxArgCount {
+		return 0, fmt.Errorf("arg count [%v] exceeds the maximum of [%v]", len(args), maxArgCount)
+	}
+	var total int
+	for _, arg := range args {
+		total += arg.Len()
+	}
+	return total, nil
+}
+
 // appendUint16 will append an int to a []byte as a uint16 but shifting bits
 func appendUint16(b []byte, i int) []byte {
 	return append(b, byte(i>>8), byte(i))
 }
 
+// unknownValue renders a value outside of the known set of an enum, eg a vendor extension, so
+// the raw value stays visible in logs rather than reading as a known constant
+func unknownValue(v uint8) string {
+	return fmt.Sprintf("UNKNOWN(0x%02x)", v)
+}
+
 // isAllASCII will ensure that the given string only uses ascii characters.
 // it will return false if it has anything other than ascii, true, if it's safe ascii.
 func isAllASCII(s string) bool {
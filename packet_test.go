@@ -10,6 +10,7 @@ package tacquito
 import (
 	"encoding/binary"
 	"math/rand"
+	"strings"
 	"testing"
 
 	"github.com/davecgh/go-spew/spew"
@@ -252,6 +253,77 @@ func TestAcctReplyMarshalUnmarshal(t *testing.T) {
 	assert.Equal(t, v, decoded)
 }
 
+func TestReplyValidate(t *testing.T) {
+	long := strings.Repeat("a", maxFieldLength+1)
+	manyArgs := make([]string, maxArgCount+1)
+	for i := range manyArgs {
+		manyArgs[i] = "a=b"
+	}
+	tests := []struct {
+		name  string
+		reply interface {
+			EncoderDecoder
+			Validate() error
+		}
+		err string
+	}{
+		{
+			name:  "authen reply",
+			reply: NewAuthenReply(SetAuthenReplyStatus(AuthenStatusPass), SetAuthenReplyServerMsg("login success")),
+		},
+		{
+			name:  "authen reply long server msg",
+			reply: NewAuthenReply(SetAuthenReplyStatus(AuthenStatusPass), SetAuthenReplyServerMsg(long)),
+			err:   "server_msg length [65536] exceeds the maximum of [65535]",
+		},
+		{
+			name: "authen reply too large",
+			reply: NewAuthenReply(
+				SetAuthenReplyStatus(AuthenStatusPass),
+				SetAuthenReplyServerMsg(long[:maxFieldLength]),
+				SetAuthenReplyData(AuthenData(long[:maxFieldLength])),
+			),
+			err: "body length [131076] exceeds the maximum of [65536]",
+		},
+		{
+			name:  "author reply",
+			reply: NewAuthorReply(SetAuthorReplyStatus(AuthorStatusPassAdd), SetAuthorReplyArgs("priv-lvl=15")),
+		},
+		{
+			name:  "author reply long data",
+			reply: NewAuthorReply(SetAuthorReplyStatus(AuthorStatusPassAdd), SetAuthorReplyData(AuthorData(long))),
+			err:   "data length [65536] exceeds the maximum of [65535]",
+		},
+		{
+			name:  "author reply too many args",
+			reply: NewAuthorReply(SetAuthorReplyStatus(AuthorStatusPassAdd), SetAuthorReplyArgs(manyArgs...)),
+			err:   "arg count [256] exceeds the maximum of [255]",
+		},
+		{
+			name:  "acct reply",
+			reply: NewAcctReply(SetAcctReplyStatus(AcctReplyStatusSuccess)),
+		},
+		{
+			name:  "acct reply long server msg",
+			reply: NewAcctReply(SetAcctReplyStatus(AcctReplyStatusSuccess), SetAcctReplyServerMsg(long)),
+			err:   "server_msg length [65536] exceeds the maximum of [65535]",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.reply.Validate()
+			_, marshalErr := test.reply.MarshalBinary()
+			if test.err == "" {
+				assert.NoError(t, err)
+				assert.NoError(t, marshalErr)
+				return
+			}
+			assert.EqualError(t, err, test.err)
+			assert.EqualError(t, marshalErr, test.err)
+		})
+	}
+}
+
 func TestPacketMarshalUnmarshalTooLarge(t *testing.T) {
 	var f HeaderFlag
 	f.Set(SingleConnect)
@@ -0,0 +1,157 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+)
+
+// PacketTransport reads and writes whole packets on a connection.  Read returns a packet with a
+// clear text body, and Write is given one.  The md5 crypter of rfc8907, see NewMD5Transport,
+// serves connections unless SetPacketTransport replaces it.
+type PacketTransport interface {
+	Read() (*Packet, error)
+	Write(p *Packet) (int, error)
+}
+
+// SetPacketTransport serves every tls connection with the PacketTransport f returns for it and its
+// secret, in place of the obfuscation of rfc8907, eg NewCleartextTransport for TACACS+ over TLS,
+// where bodies are sent in clear text under the tls session, or the transport of a test harness.
+// Connections that are not tls keep the md5 crypter whatever f is, so bodies are never sent in
+// clear text over plain tcp and a bad secret is still detected there.  conn reads through the
+// buffer of the server, so bytes the server already read are not lost.  The server still strips
+// proxy headers, checks replies and body lengths and captures packets, but bad secret detection,
+// length quirks, cutover secrets and pad caches are part of the obfuscation f replaces.
+func SetPacketTransport(f func(conn net.Conn, secret []byte) PacketTransport) Option {
+	return func(s *Server) {
+		s.packetTransport = f
+	}
+}
+
+// NewMD5Transport returns the md5 crypter of rfc8907 that the server serves connections with, as
+// the PacketTransport of the server end of conn, obfuscating with secret.  It is the default of
+// SetPacketTransport, which can be given it as it is, eg to obfuscate tls connections too, or
+// wrap it.
+func NewMD5Transport(conn net.Conn, secret []byte) PacketTransport {
+	return md5Transport{c: newCrypter(roleServer, secret, conn, false)}
+}
+
+// md5Transport is the PacketTransport of a crypter, see NewMD5Transport
+type md5Transport struct {
+	c *crypter
+}
+
+// Read implements PacketTransport
+func (t md5Transport) Read() (*Packet, error) {
+	return t.c.read()
+}
+
+// Write implements PacketTransport
+func (t md5Transport) Write(p *Packet) (int, error) {
+	return t.c.write(p)
+}
+
+// NewCleartextTransport returns a PacketTransport that reads and writes packets as they are, their
+// bodies neither obfuscated nor deobfuscated whatever their flags or secret.  It is meant for
+// connections secured by other means, such as tls, and can be given to SetPacketTransport as it
+// is.
+func NewCleartextTransport(conn net.Conn, secret []byte) PacketTransport {
+	return &cleartextTransport{conn: conn}
+}
+
+// cleartextTransport is a PacketTransport without obfuscation, see NewCleartextTransport
+type cleartextTransport struct {
+	conn net.Conn
+}
+
+// Read implements PacketTransport
+func (t *cleartextTransport) Read() (*Packet, error) {
+	raw, err := readRawPacket(t.conn)
+	if err != nil {
+		return nil, err
+	}
+	var p Packet
+	if err := Unmarshal(raw, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Write implements PacketTransport.  The header length is set on a copy of the header of p.
+func (t *cleartextTransport) Write(p *Packet) (int, error) {
+	if p == nil || p.Header == nil {
+		return 0, fmt.Errorf("packet and header cannot be nil")
+	}
+	h := *p.Header
+	h.Length = uint32(len(p.Body))
+	b, err := (&Packet{Header: &h, Body: p.Body}).MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	return t.conn.Write(b)
+}
+
+// bufferedConn is a net.Conn that reads through r, the buffer of a crypter
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Read implements net.Conn
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
+
+// useTransport reads and writes the packets of c with the PacketTransport f returns, if f is set
+// and the connection of c is tls.  Other connections keep the obfuscation of c.
+func (c *crypter) useTransport(f func(conn net.Conn, secret []byte) PacketTransport) {
+	if f == nil {
+		return
+	}
+	if _, ok := c.Conn.(tlsStater); !ok {
+		return
+	}
+	c.transport = f(&bufferedConn{Conn: c.Conn, r: c.Reader}, c.secret)
+}
+
+// readTransport reads a packet with the PacketTransport of c
+func (c *crypter) readTransport() (*Packet, error) {
+	p, err := c.transport.Read()
+	if err != nil {
+		if err != io.EOF {
+			crypterReadError.Inc()
+		}
+		return nil, err
+	}
+	if p == nil || p.Header == nil {
+		crypterReadError.Inc()
+		return nil, fmt.Errorf("packet transport read a packet without a header")
+	}
+	// the wire format is up to the transport, so only the packet it read is captured
+	return c.received(p, nil)
+}
+
+// writeTransport writes p with the PacketTransport of c
+func (c *crypter) writeTransport(p *Packet) (int, error) {
+	if err := c.writable(p); err != nil {
+		return 0, err
+	}
+	decoded := c.decoded(p)
+	n, err := c.transport.Write(p)
+	if err != nil {
+		crypterWriteError.Inc()
+		return 0, err
+	}
+	c.tally.write()
+	c.capture(DirectionServer, nil, decoded)
+	c.sequences.replied(p)
+	return n, nil
+}
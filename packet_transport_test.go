@@ -0,0 +1,134 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingTransport is a cleartext transport that counts the packets it writes
+type countingTransport struct {
+	PacketTransport
+	written *int32
+}
+
+func (t countingTransport) Write(p *Packet) (int, error) {
+	atomic.AddInt32(t.written, 1)
+	return t.PacketTransport.Write(p)
+}
+
+// startTransportServer serves handler with the transports f returns, over tls if secure is set,
+// and returns its address
+func startTransportServer(t *testing.T, handler Handler, secure bool, f func(conn net.Conn, secret []byte) PacketTransport) string {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	require.NoError(t, err)
+	sp := secretProviderFunc(func(ctx context.Context, remote net.Addr) ([]byte, Handler, error) {
+		return []byte("fooman"), handler, nil
+	})
+	s := NewServer(nopLogger{}, sp, SetPacketTransport(f))
+	if !secure {
+		go s.Serve(ctx, listener.(*net.TCPListener))
+		return listener.Addr().String()
+	}
+	tlsListener, err := NewTLSListener(listener.(*net.TCPListener), SetTLSCertificates(selfSignedCertificate(t)))
+	require.NoError(t, err)
+	go s.Serve(ctx, tlsListener)
+	return listener.Addr().String()
+}
+
+// dialTLS dials the tls server at addr
+func dialTLS(t *testing.T, addr string) net.Conn {
+	conn, err := tls.Dial("tcp6", addr, &tls.Config{InsecureSkipVerify: true})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	return conn
+}
+
+// dialCleartext serves handler with a cleartext transport over tls and returns a cleartext client
+// of it
+func dialCleartext(t *testing.T, handler Handler, written *int32) PacketTransport {
+	addr := startTransportServer(t, handler, true, func(conn net.Conn, secret []byte) PacketTransport {
+		return countingTransport{PacketTransport: NewCleartextTransport(conn, secret), written: written}
+	})
+	return NewCleartextTransport(dialTLS(t, addr), nil)
+}
+
+// passHandler passes every request
+var passHandler = HandlerFunc(func(response Response, request Request) {
+	response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusPass)))
+})
+
+// assertMD5Pass sends a login obfuscated with fooman on conn and asserts it passes
+func assertMD5Pass(t *testing.T, conn net.Conn) {
+	c := newCrypter(roleClient, []byte("fooman"), conn, false)
+	_, err := c.write(proxyTestPacket())
+	require.NoError(t, err)
+	resp, err := c.read()
+	require.NoError(t, err)
+	var body AuthenReply
+	require.NoError(t, Unmarshal(resp.Body, &body))
+	assert.Equal(t, AuthenStatusPass, body.Status)
+}
+
+func TestPacketTransportPlainTCP(t *testing.T) {
+	// a cleartext transport is not used on plain tcp, where the md5 crypter still serves
+	var written int32
+	addr := startTransportServer(t, passHandler, false, func(conn net.Conn, secret []byte) PacketTransport {
+		return countingTransport{PacketTransport: NewCleartextTransport(conn, secret), written: &written}
+	})
+	conn, err := net.Dial("tcp6", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	assertMD5Pass(t, conn)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&written))
+}
+
+func TestPacketTransportMD5(t *testing.T) {
+	// the md5 crypter is a transport, so it can be wrapped and obfuscate tls connections too
+	var written int32
+	addr := startTransportServer(t, passHandler, true, func(conn net.Conn, secret []byte) PacketTransport {
+		return countingTransport{PacketTransport: NewMD5Transport(conn, secret), written: &written}
+	})
+	assertMD5Pass(t, dialTLS(t, addr))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&written))
+}
+
+func TestPacketTransportCleartext(t *testing.T) {
+	var written int32
+	client := dialCleartext(t, HandlerFunc(func(response Response, request Request) {
+		var body AuthenStart
+		// the body arrives as it was sent, though it is not flagged unencrypted
+		if assert.NoError(t, Unmarshal(request.Body, &body)) {
+			assert.Equal(t, AuthenUser("cisco"), body.User)
+		}
+		response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusPass)))
+	}), &written)
+
+	request := proxyTestPacket()
+	require.False(t, request.Header.Flags.Has(UnencryptedFlag))
+	_, err := client.Write(request)
+	require.NoError(t, err)
+	resp, err := client.Read()
+	require.NoError(t, err)
+	var body AuthenReply
+	require.NoError(t, Unmarshal(resp.Body, &body))
+	assert.Equal(t, AuthenStatusPass, body.Status)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&written))
+}
@@ -0,0 +1,108 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+)
+
+// padStackInput is the largest md5 input PadInto builds without allocating, enough for secrets of
+// up to 230 bytes
+const padStackInput = 256
+
+// PadInto fills dst with the pseudo pad for a body of len(dst) bytes, see crypt.  It does not
+// allocate unless the secret is longer than 230 bytes, so it may be used as a reference for pads
+// computed elsewhere, eg by offload hardware.
+func PadInto(dst []byte, secret []byte, sessionID SessionID, version Version, seqNo SequenceNumber) error {
+	for i := range dst {
+		dst[i] = 0
+	}
+	return xorPad(dst, secret, sessionID, version, seqNo)
+}
+
+// xorPad xors the pseudo pad for a body of len(body) bytes into body, a hash at a time as each is
+// produced, so the pad is never held as a whole.  Like PadInto it does not allocate unless the
+// secret is longer than 230 bytes.
+func xorPad(body []byte, secret []byte, sessionID SessionID, version Version, seqNo SequenceNumber) error {
+	if err := version.Validate(nil); err != nil {
+		return err
+	}
+	// the md5 input is session_id, key, version and seq_no, followed by the previous hash for
+	// every hash after the first
+	n := 4 + len(secret) + 2
+	var stack [padStackInput]byte
+	var in []byte
+	if n+md5.Size <= len(stack) {
+		in = stack[:n+md5.Size]
+	} else {
+		in = make([]byte, n+md5.Size)
+	}
+	binary.BigEndian.PutUint32(in, uint32(sessionID))
+	copy(in[4:], secret)
+	in[n-2] = version.MajorVersion<<4 | version.MinorVersion
+	in[n-1] = byte(seqNo)
+
+	sum := md5.Sum(in[:n])
+	for off := 0; off < len(body); off += md5.Size {
+		if off > 0 {
+			copy(in[n:], sum[:])
+			sum = md5.Sum(in)
+		}
+		// the last hash is truncated to the length of the body
+		block := body[off:]
+		if len(block) > md5.Size {
+			block = block[:md5.Size]
+		}
+		for i := range block {
+			block[i] ^= sum[i]
+		}
+	}
+	return nil
+}
+
+// padIterations returns the number of md5 iterations in the pad of a body of n bytes
+func padIterations(n int) int {
+	return (n + md5.Size - 1) / md5.Size
+}
+
+// PadMismatchError is returned by VerifyRoundTrip for the first byte a pad got wrong
+type PadMismatchError struct {
+	Offset int
+	Want   byte
+	Got    byte
+}
+
+// Error implements error
+func (e PadMismatchError) Error() string {
+	return fmt.Sprintf("pad mismatch at offset [%v]; want [%#02x] got [%#02x]", e.Offset, e.Want, e.Got)
+}
+
+// VerifyRoundTrip obfuscates body as the server would and deobfuscates it with pad, eg a pad
+// computed by offload hardware.  A *PadMismatchError is returned for the first byte that does not
+// round trip.  pad must be as long as body.
+func VerifyRoundTrip(body, pad []byte, secret []byte, sessionID SessionID, version Version, seqNo SequenceNumber) error {
+	if len(pad) != len(body) {
+		return fmt.Errorf("pad is [%v] bytes for a body of [%v] bytes", len(pad), len(body))
+	}
+	p := &Packet{
+		Header: &Header{Version: version, SeqNo: seqNo, SessionID: sessionID, Length: uint32(len(body))},
+		Body:   append([]byte(nil), body...),
+	}
+	if err := crypt(secret, p); err != nil {
+		return err
+	}
+	for i, b := range p.Body {
+		if got := b ^ pad[i]; got != body[i] {
+			want := b ^ body[i]
+			return &PadMismatchError{Offset: i, Want: want, Got: pad[i]}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// referencePad builds the pad straight from rfc8907 4.5
+func referencePad(length int, secret []byte, sessionID SessionID, version Version, seqNo SequenceNumber) []byte {
+	prefix := []byte{byte(sessionID >> 24), byte(sessionID >> 16), byte(sessionID >> 8), byte(sessionID)}
+	prefix = append(prefix, secret...)
+	prefix = append(prefix, version.MajorVersion<<4|version.MinorVersion, byte(seqNo))
+	pad := make([]byte, 0, length)
+	var last []byte
+	for len(pad) < length {
+		h := md5.New()
+		h.Write(prefix)
+		h.Write(last)
+		last = h.Sum(nil)
+		pad = append(pad, last...)
+	}
+	return pad[:length]
+}
+
+func padLengths() []int {
+	var lengths []int
+	for i := 0; i <= 64; i++ {
+		lengths = append(lengths, i)
+	}
+	return append(lengths, 15, 16, 17, 31, 32, 33, 1024)
+}
+
+func TestPadInto(t *testing.T) {
+	version := Version{MajorVersion: MajorVersion, MinorVersion: MinorVersionDefault}
+	secrets := [][]byte{nil, []byte("fooman"), bytes.Repeat([]byte("s"), 300)}
+	for _, secret := range secrets {
+		for _, n := range padLengths() {
+			pad := make([]byte, n)
+			err := PadInto(pad, secret, 0x9c1e5a2f, version, 3)
+			assert.NoError(t, err)
+			assert.Equal(t, referencePad(n, secret, 0x9c1e5a2f, version, 3), pad, "secret of %v bytes, length %v", len(secret), n)
+		}
+	}
+}
+
+func TestPadIntoBadVersion(t *testing.T) {
+	err := PadInto(make([]byte, 16), []byte("fooman"), 1, Version{MajorVersion: 0x9}, 1)
+	assert.Error(t, err)
+}
+
+func TestPadIntoAllocs(t *testing.T) {
+	version := Version{MajorVersion: MajorVersion, MinorVersion: MinorVersionOne}
+	pad := make([]byte, 64)
+	secret := []byte("fooman")
+	allocs := testing.AllocsPerRun(100, func() {
+		PadInto(pad, secret, 12345, version, 1)
+	})
+	assert.Equal(t, float64(0), allocs)
+}
+
+func TestPadIntoMatchesCrypt(t *testing.T) {
+	version := Version{MajorVersion: MajorVersion, MinorVersion: MinorVersionDefault}
+	secret := []byte("fooman")
+	for _, n := range padLengths() {
+		body := bytes.Repeat([]byte{0xa5}, n)
+		p := &Packet{
+			Header: &Header{Version: version, SeqNo: 5, SessionID: 42, Length: uint32(n)},
+			Body:   make([]byte, n),
+		}
+		copy(p.Body, body)
+		assert.NoError(t, crypt(secret, p))
+		pad := make([]byte, n)
+		assert.NoError(t, PadInto(pad, secret, 42, version, 5))
+		for i := range body {
+			body[i] ^= pad[i]
+		}
+		assert.Equal(t, body, p.Body, "length %v", n)
+	}
+}
+
+func TestCryptMatchesReference(t *testing.T) {
+	// the pad is xored a hash at a time, so every length around a hash boundary is checked
+	version := Version{MajorVersion: MajorVersion, MinorVersion: MinorVersionOne}
+	for _, secret := range [][]byte{[]byte("fooman"), bytes.Repeat([]byte("s"), 300)} {
+		for _, n := range append(padLengths(), 64<<10+7) {
+			body := bytes.Repeat([]byte{0x5a}, n)
+			p := &Packet{Header: &Header{Version: version, SeqNo: 2, SessionID: 7, Length: uint32(n)}, Body: make([]byte, n)}
+			copy(p.Body, body)
+			require.NoError(t, crypt(secret, p))
+			for i, b := range referencePad(n, secret, 7, version, 2) {
+				body[i] ^= b
+			}
+			assert.Equal(t, body, p.Body, "secret of %v bytes, length %v", len(secret), n)
+		}
+	}
+}
+
+func TestCryptAllocs(t *testing.T) {
+	p := &Packet{
+		Header: &Header{Version: Version{MajorVersion: MajorVersion, MinorVersion: MinorVersionOne}, SeqNo: 1, SessionID: 12345, Length: 1024},
+		Body:   make([]byte, 1024),
+	}
+	secret := []byte("fooman")
+	allocs := testing.AllocsPerRun(100, func() {
+		crypt(secret, p)
+	})
+	assert.Equal(t, float64(0), allocs)
+}
+
+// BenchmarkCrypt compares crypt, which xors each hash into the body as it is produced, with
+// building the whole pad first and xoring it after, as crypt once did
+func BenchmarkCrypt(b *testing.B) {
+	version := Version{MajorVersion: MajorVersion, MinorVersion: MinorVersionOne}
+	secret := []byte("fooman")
+	for _, size := range []struct {
+		name string
+		n    int
+	}{{"64B", 64}, {"1KB", 1 << 10}, {"64KB", 64 << 10}} {
+		p := &Packet{Header: &Header{Version: version, SeqNo: 1, SessionID: 12345, Length: uint32(size.n)}, Body: make([]byte, size.n)}
+		b.Run("pad/"+size.name, func(b *testing.B) {
+			b.SetBytes(int64(size.n))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				pad := make([]byte, len(p.Body))
+				if err := PadInto(pad, secret, p.Header.SessionID, p.Header.Version, p.Header.SeqNo); err != nil {
+					b.Fatal(err)
+				}
+				for j, v := range p.Body {
+					p.Body[j] = v ^ pad[j]
+				}
+			}
+		})
+		b.Run("stream/"+size.name, func(b *testing.B) {
+			b.SetBytes(int64(size.n))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := crypt(secret, p); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyRoundTrip(t *testing.T) {
+	version := Version{MajorVersion: MajorVersion, MinorVersion: MinorVersionDefault}
+	secret := []byte("fooman")
+	body := []byte("an authen start body that spans more than two md5 blocks")
+	pad := make([]byte, len(body))
+	assert.NoError(t, PadInto(pad, secret, 7, version, 1))
+	assert.NoError(t, VerifyRoundTrip(body, pad, secret, 7, version, 1))
+
+	// a pad for the wrong seq_no, and a pad off by a single byte in the second block
+	assert.Error(t, VerifyRoundTrip(body, pad, secret, 7, version, 3))
+	bad := append([]byte(nil), pad...)
+	bad[17] ^= 0x01
+	err := VerifyRoundTrip(body, bad, secret, 7, version, 1)
+	var mismatch *PadMismatchError
+	if assert.True(t, errors.As(err, &mismatch)) {
+		assert.Equal(t, 17, mismatch.Offset)
+		assert.Equal(t, pad[17], mismatch.Want)
+		assert.Equal(t, bad[17], mismatch.Got)
+	}
+
+	assert.Error(t, VerifyRoundTrip(body, pad[:4], secret, 7, version, 1))
+}
+
+// padIterationsObserved returns the count and sum of crypterPadIterations
+func padIterationsObserved(t *testing.T) (uint64, float64) {
+	return observations(crypterPadIterations)
+}
+
+func TestCryptPadIterations(t *testing.T) {
+	version := Version{MajorVersion: MajorVersion, MinorVersion: MinorVersionDefault}
+	tests := []struct {
+		length     int
+		iterations int
+	}{
+		{length: 1, iterations: 1},
+		{length: 16, iterations: 1},
+		{length: 17, iterations: 2},
+		{length: 100, iterations: 7},
+		{length: 4096, iterations: 256},
+	}
+	for _, test := range tests {
+		count, sum := padIterationsObserved(t)
+		p := &Packet{
+			Header: &Header{Version: version, SeqNo: 1, SessionID: 7, Length: uint32(test.length)},
+			Body:   make([]byte, test.length),
+		}
+		require.NoError(t, crypt([]byte("fooman"), p))
+		gotCount, gotSum := padIterationsObserved(t)
+		assert.Equal(t, count+1, gotCount, "length %v", test.length)
+		assert.Equal(t, float64(test.iterations), gotSum-sum, "length %v", test.length)
+	}
+
+	// bodies sent in the clear are not crypted, nor are empty bodies, see TestCryptZeroLength
+	count, _ := padIterationsObserved(t)
+	p := &Packet{Header: &Header{Version: version, Flags: UnencryptedFlag, Length: 32}, Body: make([]byte, 32)}
+	require.NoError(t, crypt([]byte("fooman"), p))
+	gotCount, _ := padIterationsObserved(t)
+	assert.Equal(t, count, gotCount)
+}
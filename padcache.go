@@ -0,0 +1,120 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"bytes"
+	"sync"
+)
+
+// SetPadCache keeps the pads of the last entries session id, version and sequence number pairs of
+// each connection, so a packet that repeats them, eg the accounting records of a device that
+// reuses a session id for every record on a single-connect connection, is crypted with a cached
+// pad rather than a new md5 chain.  Each entry holds up to MaxBodyLength bytes.  Secrets differ by
+// connection, so a cache is never shared between connections.  It is off by default, as every miss
+// allocates a pad a connection that never repeats a pair does not need.  Lookups are counted in
+// tacquito_crypter_pad_cache.
+func SetPadCache(entries int) Option {
+	return func(s *Server) {
+		s.padCacheEntries = entries
+	}
+}
+
+// padCache is a least recently used cache of the pads of one crypter.  It is safe for concurrent
+// use, as the reads and writes of a connection may run at once.
+type padCache struct {
+	mu sync.Mutex
+	// entries are ordered from the most to the least recently used
+	entries []padEntry
+	size    int
+	// hits and misses count lookups, resolved once so a lookup does not allocate
+	hits, misses interface{ Inc() }
+}
+
+// padEntry is a pad and the inputs it was computed from
+type padEntry struct {
+	secret    []byte
+	sessionID SessionID
+	version   Version
+	seqNo     SequenceNumber
+	pad       []byte
+}
+
+// newPadCache returns a cache of size pads, or nil, which caches nothing, for a size of zero
+func newPadCache(size int) *padCache {
+	if size <= 0 {
+		return nil
+	}
+	return &padCache{
+		entries: make([]padEntry, 0, size),
+		size:    size,
+		hits:    crypterPadCache.WithLabelValues("hit"),
+		misses:  crypterPadCache.WithLabelValues("miss"),
+	}
+}
+
+// xorPad is xorPad with the pad of c, if it holds one at least as long as body.  It returns the md5
+// iterations it computed, zero for a hit.
+func (c *padCache) xorPad(body []byte, secret []byte, sessionID SessionID, version Version, seqNo SequenceNumber) (int, error) {
+	if c == nil || len(body) > int(MaxBodyLength) {
+		return padIterations(len(body)), xorPad(body, secret, sessionID, version, seqNo)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i := c.find(secret, sessionID, version, seqNo)
+	if i >= 0 && len(c.entries[i].pad) >= len(body) {
+		c.hits.Inc()
+		e := c.entries[i]
+		copy(c.entries[1:i+1], c.entries[:i])
+		c.entries[0] = e
+		for j := range body {
+			body[j] ^= e.pad[j]
+		}
+		return 0, nil
+	}
+	c.misses.Inc()
+	var e padEntry
+	switch {
+	case i >= 0:
+		// a pad too short for body is replaced by a longer one
+		e = c.entries[i]
+	case len(c.entries) < c.size:
+		c.entries = append(c.entries, padEntry{})
+		i = len(c.entries) - 1
+	default:
+		// the least recently used entry is evicted, and its pad reused
+		i = len(c.entries) - 1
+		e = c.entries[i]
+	}
+	if cap(e.pad) < len(body) {
+		e.pad = make([]byte, len(body))
+	}
+	e.pad = e.pad[:len(body)]
+	if err := PadInto(e.pad, secret, sessionID, version, seqNo); err != nil {
+		// the slot is left to a later miss
+		c.entries[i] = padEntry{pad: e.pad[:0]}
+		return 0, err
+	}
+	e.secret, e.sessionID, e.version, e.seqNo = secret, sessionID, version, seqNo
+	copy(c.entries[1:i+1], c.entries[:i])
+	c.entries[0] = e
+	for j := range body {
+		body[j] ^= e.pad[j]
+	}
+	return padIterations(len(body)), nil
+}
+
+// find returns the index of the entry for the inputs, or -1
+func (c *padCache) find(secret []byte, sessionID SessionID, version Version, seqNo SequenceNumber) int {
+	for i, e := range c.entries {
+		if e.sessionID == sessionID && e.seqNo == seqNo && e.version == version && bytes.Equal(e.secret, secret) {
+			return i
+		}
+	}
+	return -1
+}
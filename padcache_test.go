@@ -0,0 +1,172 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// padCacheTestPacket returns a packet of session id and seqNo with a body of n bytes
+func padCacheTestPacket(id SessionID, seqNo SequenceNumber, n int) *Packet {
+	return &Packet{
+		Header: &Header{Version: Version{MajorVersion: MajorVersion, MinorVersion: MinorVersionDefault}, SessionID: id, SeqNo: seqNo, Length: uint32(n)},
+		Body:   bytes.Repeat([]byte{0x5a}, n),
+	}
+}
+
+func TestPadCache(t *testing.T) {
+	secret := []byte("fooman")
+	pads := newPadCache(2)
+	hits := metricValue(crypterPadCache.WithLabelValues("hit"))
+	misses := metricValue(crypterPadCache.WithLabelValues("miss"))
+	tests := []struct {
+		name string
+		id   SessionID
+		seq  SequenceNumber
+		n    int
+		hit  bool
+	}{
+		{name: "first", id: 1, seq: 1, n: 40},
+		{name: "repeated", id: 1, seq: 1, n: 40, hit: true},
+		{name: "shorter", id: 1, seq: 1, n: 10, hit: true},
+		// a longer body replaces the pad with one that covers it
+		{name: "longer", id: 1, seq: 1, n: 100},
+		{name: "longer repeated", id: 1, seq: 1, n: 100, hit: true},
+		{name: "other seq", id: 1, seq: 2, n: 40},
+		{name: "other session", id: 2, seq: 1, n: 40},
+		// session 1 seq 1 was the least recently used of three, so it was evicted
+		{name: "evicted", id: 1, seq: 1, n: 40},
+		{name: "kept", id: 2, seq: 1, n: 40, hit: true},
+	}
+	for _, test := range tests {
+		cached, uncached := padCacheTestPacket(test.id, test.seq, test.n), padCacheTestPacket(test.id, test.seq, test.n)
+		require.NoError(t, obfuscate(secret, cached, nil, pads), test.name)
+		require.NoError(t, crypt(secret, uncached), test.name)
+		assert.Equal(t, uncached.Body, cached.Body, test.name)
+		if test.hit {
+			hits++
+		} else {
+			misses++
+		}
+		assert.Equal(t, hits, metricValue(crypterPadCache.WithLabelValues("hit")), test.name)
+		assert.Equal(t, misses, metricValue(crypterPadCache.WithLabelValues("miss")), test.name)
+		assert.LessOrEqual(t, len(pads.entries), 2, test.name)
+	}
+
+	// a pad is only reused for the secret it was computed with
+	other, uncached := padCacheTestPacket(2, 1, 40), padCacheTestPacket(2, 1, 40)
+	require.NoError(t, obfuscate([]byte("not-fooman"), other, nil, pads))
+	require.NoError(t, crypt([]byte("not-fooman"), uncached))
+	assert.Equal(t, uncached.Body, other.Body)
+}
+
+func TestPadCacheError(t *testing.T) {
+	pads := newPadCache(2)
+	p := padCacheTestPacket(1, 1, 40)
+	p.Header.Version = Version{MajorVersion: 0x1}
+	assert.Error(t, obfuscate([]byte("fooman"), p, nil, pads))
+	assert.Error(t, obfuscate([]byte("fooman"), p, nil, pads), "a pad that failed is not cached")
+	assert.Nil(t, newPadCache(0))
+}
+
+func TestPadCacheCrypter(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	c := newCrypter(roleServer, []byte("fooman"), server, false)
+	c.pads = newPadCache(4)
+	hits := metricValue(crypterPadCache.WithLabelValues("hit"))
+	reply := func() *Packet {
+		return NewPacket(
+			SetPacketHeader(NewHeader(SetHeaderType(Authenticate), SetHeaderSeqNo(2), SetHeaderSessionID(12345),
+				SetHeaderVersion(Version{MajorVersion: MajorVersion, MinorVersion: MinorVersionOne}))),
+			SetPacketBodyUnsafe(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusPass))),
+		)
+	}
+
+	// a device that reuses the session id of every session starts it over at 1 once it is
+	// answered, so the sequence checks pass and each session repeats the pads of the first
+	errs := make(chan error, 1)
+	go func() {
+		w := newCrypter(roleClient, []byte("fooman"), client, false)
+		for i := 0; i < 3; i++ {
+			if _, err := w.write(proxyTestPacket()); err != nil {
+				errs <- err
+				return
+			}
+			if _, err := w.read(); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	}()
+	for i := 0; i < 3; i++ {
+		p, err := c.read()
+		require.NoError(t, err)
+		assert.Equal(t, proxyTestPacket().Body, p.Body)
+		_, err = c.write(reply())
+		require.NoError(t, err)
+	}
+	require.NoError(t, <-errs)
+	// the request and reply pads of the second and third sessions are hits
+	assert.Equal(t, hits+4, metricValue(crypterPadCache.WithLabelValues("hit")))
+}
+
+func TestPadCacheValidate(t *testing.T) {
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	require.NoError(t, err)
+	err = NewServer(nopLogger{}, sourceSecretProvider{}, SetPadCache(-1)).Serve(context.Background(), listener.(*net.TCPListener))
+	var oe *OptionError
+	require.True(t, errors.As(err, &oe), err)
+	assert.Equal(t, "SetPadCache", oe.Option)
+}
+
+// BenchmarkPadCache crypts the 50 packets of a session, a request and reply for each of 25
+// accounting records.  A device that reuses the session id of every record repeats the same two
+// pads, which the cache computes once, while the packets of distinct sessions always miss.
+func BenchmarkPadCache(b *testing.B) {
+	secret := []byte("fooman")
+	reused := func(i int) (SessionID, SequenceNumber) { return 1, SequenceNumber(i%2 + 1) }
+	distinct := func(i int) (SessionID, SequenceNumber) { return SessionID(i/2 + 1), SequenceNumber(i%2 + 1) }
+	for _, n := range []int{64, 1024} {
+		for _, bench := range []struct {
+			name    string
+			packets func(i int) (SessionID, SequenceNumber)
+			cache   int
+		}{
+			{name: "reused/uncached", packets: reused},
+			{name: "reused/cached", packets: reused, cache: 8},
+			{name: "distinct/uncached", packets: distinct},
+			{name: "distinct/cached", packets: distinct, cache: 8},
+		} {
+			b.Run(fmt.Sprintf("%v/%vB", bench.name, n), func(b *testing.B) {
+				p := padCacheTestPacket(1, 1, n)
+				b.SetBytes(int64(50 * n))
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					pads := newPadCache(bench.cache)
+					for j := 0; j < 50; j++ {
+						p.Header.SessionID, p.Header.SeqNo = bench.packets(j)
+						if err := obfuscate(secret, p, nil, pads); err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,105 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ErrPeerDisconnected is why the context of a request was cancelled if the device reset its
+// connection while the request was handled, or a reply to it failed to write, eg a user that closed their ssh session during a slow
+// authorization, see RequestCause.  Replies to such a request are dropped and return it.
+var ErrPeerDisconnected = errors.New("peer disconnected")
+
+// contextPeer is the peerWatch of a request
+const contextPeer ContextKey = "peer"
+
+// RequestCause returns why the context of a request is done: ErrPeerDisconnected if the device went
+// away while the request was handled, or ctx.Err() otherwise, eg context.DeadlineExceeded for the
+// handler timeout.  It is nil while the context is live.  Backends can tell a client that went away
+// from one they were too slow for, which ctx.Err() reports alike as context.Canceled.
+func RequestCause(ctx context.Context) error {
+	err := ctx.Err()
+	if errors.Is(err, context.Canceled) {
+		if w, ok := ctx.Value(contextPeer).(*peerWatch); ok && w.disconnected() {
+			return ErrPeerDisconnected
+		}
+	}
+	return err
+}
+
+// peerWatch cancels the context of a request if the device resets the connection while the
+// request is handled.  The server does not read the connection while a handler runs, so the watch
+// peeks it; anything the device sends meanwhile stays buffered for the next read.  An EOF is not
+// taken for a device that went away, as a device that half-closed the connection still reads the
+// reply; the reply fails to write if it did go away.
+type peerWatch struct {
+	c      *crypter
+	cancel context.CancelFunc
+	// gone is set, atomically, once the device reset the connection or a reply failed to write
+	gone int32
+	done chan struct{}
+}
+
+// newPeerWatch returns a watch of c that cancels a request with cancel
+func newPeerWatch(c *crypter, cancel context.CancelFunc) *peerWatch {
+	return &peerWatch{c: c, cancel: cancel, done: make(chan struct{})}
+}
+
+// start watches the connection until stop is called
+func (w *peerWatch) start() {
+	if w.c.Buffered() > 0 {
+		// the device already sent more, so it is still there
+		close(w.done)
+		return
+	}
+	go func() {
+		defer close(w.done)
+		if _, err := w.c.Peek(1); err != nil && errors.Is(err, syscall.ECONNRESET) {
+			w.disconnect("cancelled")
+		}
+	}()
+}
+
+// disconnect marks the device gone and cancels the request, counted as event
+func (w *peerWatch) disconnect(event string) {
+	if atomic.CompareAndSwapInt32(&w.gone, 0, 1) {
+		handlerPeerDisconnected.WithLabelValues(event).Inc()
+		w.cancel()
+	}
+}
+
+// wrote marks the device gone if err, from writing a reply, is an error of the connection
+func (w *peerWatch) wrote(err error) {
+	var opErr *net.OpError
+	if w != nil && errors.As(err, &opErr) && !opErr.Timeout() {
+		w.disconnect("write_failed")
+	}
+}
+
+// stop ends the watch, waking the peek if it is still waiting, so the connection can be read again.
+// The server sets the read deadline again before the next read.
+func (w *peerWatch) stop() {
+	select {
+	case <-w.done:
+		return
+	default:
+	}
+	w.c.SetReadDeadline(time.Now())
+	<-w.done
+}
+
+// disconnected reports if the device went away while the request was handled
+func (w *peerWatch) disconnected() bool {
+	return w != nil && atomic.LoadInt32(&w.gone) != 0
+}
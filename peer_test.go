@@ -0,0 +1,195 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// peerTestResult is what a handler of startPeerServer observed once its context was done
+type peerTestResult struct {
+	cause error
+	// after is how long after the start of the handler its context was done
+	after time.Duration
+	// reply is the error of the reply written once the context was done
+	reply error
+}
+
+// startPeerServer serves handler, with the handler timeout given in opts, and returns the address
+// of the server and the reasons it closes connections for
+func startPeerServer(t *testing.T, handler Handler, opts ...Option) (string, chan CloseReason) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	require.NoError(t, err)
+	closed := make(chan CloseReason, 10)
+	sp := secretProviderFunc(func(ctx context.Context, remote net.Addr) ([]byte, Handler, error) {
+		return []byte("fooman"), handler, nil
+	})
+	opts = append(opts, SetOnClose(func(ctx context.Context, remote net.Addr, reason CloseReason) {
+		closed <- reason
+	}))
+	go NewServer(nopLogger{}, sp, opts...).Serve(ctx, listener.(*net.TCPListener))
+	return listener.Addr().String(), closed
+}
+
+// blockingPeerHandler waits for the context of each request to be done, replies, and sends what it
+// observed to results
+func blockingPeerHandler(results chan peerTestResult) Handler {
+	return HandlerFunc(func(response Response, request Request) {
+		start := time.Now()
+		<-request.Context.Done()
+		r := peerTestResult{cause: RequestCause(request.Context), after: time.Since(start)}
+		_, r.reply = response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusFail)))
+		results <- r
+	})
+}
+
+func TestPeerDisconnectCancelsHandler(t *testing.T) {
+	results := make(chan peerTestResult, 1)
+	addr, closed := startPeerServer(t, blockingPeerHandler(results), SetHandlerTimeout(time.Minute))
+	cancelled := metricValue(handlerPeerDisconnected.WithLabelValues("cancelled"))
+	dropped := metricValue(handlerPeerDisconnected.WithLabelValues("reply_dropped"))
+
+	conn, err := net.Dial("tcp6", addr)
+	require.NoError(t, err)
+	c := newCrypter(roleClient, []byte("fooman"), conn, false)
+	_, err = c.write(proxyTestPacket())
+	require.NoError(t, err)
+	// the user closes their session while the handler is busy, and the device resets the connection
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, conn.(*net.TCPConn).SetLinger(0))
+	require.NoError(t, conn.Close())
+
+	select {
+	case r := <-results:
+		assert.ErrorIs(t, r.cause, ErrPeerDisconnected)
+		assert.Less(t, r.after, 5*time.Second)
+		assert.ErrorIs(t, r.reply, ErrPeerDisconnected)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handler was not cancelled when the device disconnected")
+	}
+	select {
+	case reason := <-closed:
+		assert.Equal(t, CloseClientEOF, reason)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection was not closed")
+	}
+	assert.Equal(t, cancelled+1, metricValue(handlerPeerDisconnected.WithLabelValues("cancelled")))
+	assert.Equal(t, dropped+1, metricValue(handlerPeerDisconnected.WithLabelValues("reply_dropped")))
+}
+
+func TestPeerHalfClose(t *testing.T) {
+	// a device that half-closes the connection once it sent its request still reads the reply
+	results := make(chan error, 1)
+	handler := HandlerFunc(func(response Response, request Request) {
+		time.Sleep(100 * time.Millisecond)
+		_, err := response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusPass)))
+		assert.NoError(t, RequestCause(request.Context))
+		results <- err
+	})
+	addr, closed := startPeerServer(t, handler)
+	cancelled := metricValue(handlerPeerDisconnected.WithLabelValues("cancelled"))
+
+	conn, err := net.Dial("tcp6", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	c := newCrypter(roleClient, []byte("fooman"), conn, false)
+	_, err = c.write(proxyTestPacket())
+	require.NoError(t, err)
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+
+	resp, err := c.read()
+	require.NoError(t, err)
+	var body AuthenReply
+	require.NoError(t, Unmarshal(resp.Body, &body))
+	assert.Equal(t, AuthenStatusPass, body.Status)
+	assert.NoError(t, <-results)
+	select {
+	case reason := <-closed:
+		assert.Equal(t, CloseClientEOF, reason)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection was not closed")
+	}
+	assert.Equal(t, cancelled, metricValue(handlerPeerDisconnected.WithLabelValues("cancelled")))
+}
+
+func TestPeerTimeoutCause(t *testing.T) {
+	// a device that waits is not taken for one that went away
+	results := make(chan peerTestResult, 1)
+	addr, _ := startPeerServer(t, blockingPeerHandler(results), SetHandlerTimeout(50*time.Millisecond))
+	cancelled := metricValue(handlerPeerDisconnected.WithLabelValues("cancelled"))
+
+	conn, err := net.Dial("tcp6", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	c := newCrypter(roleClient, []byte("fooman"), conn, false)
+	_, err = c.write(proxyTestPacket())
+	require.NoError(t, err)
+	resp, err := c.read()
+	require.NoError(t, err)
+	var body AuthenReply
+	require.NoError(t, Unmarshal(resp.Body, &body))
+	assert.Equal(t, AuthenStatusFail, body.Status)
+
+	r := <-results
+	assert.ErrorIs(t, r.cause, context.DeadlineExceeded)
+	assert.NoError(t, r.reply)
+	assert.Equal(t, cancelled, metricValue(handlerPeerDisconnected.WithLabelValues("cancelled")))
+}
+
+func TestPeerWatchKeepsPipelinedPacket(t *testing.T) {
+	// a packet the device sends while a handler runs is read intact once the handler returns
+	handler := HandlerFunc(func(response Response, request Request) {
+		if request.Header.SessionID == 1 {
+			time.Sleep(100 * time.Millisecond)
+		}
+		assert.NoError(t, request.Context.Err())
+		response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusPass)))
+	})
+	addr, _ := startPeerServer(t, handler)
+
+	conn, err := net.Dial("tcp6", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	c := newCrypter(roleClient, []byte("fooman"), conn, false)
+	for _, id := range []SessionID{1, 2} {
+		p := proxyTestPacket()
+		p.Header.SessionID = id
+		p.Header.Flags.Set(SingleConnect)
+		_, err = c.write(p)
+		require.NoError(t, err)
+		time.Sleep(20 * time.Millisecond)
+	}
+	for _, id := range []SessionID{1, 2} {
+		resp, err := c.read()
+		require.NoError(t, err)
+		assert.Equal(t, id, resp.Header.SessionID)
+		var body AuthenReply
+		require.NoError(t, Unmarshal(resp.Body, &body))
+		assert.Equal(t, AuthenStatusPass, body.Status)
+	}
+}
+
+func TestRequestCause(t *testing.T) {
+	assert.NoError(t, RequestCause(context.Background()))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// a request cancelled by the server, not by its device
+	assert.ErrorIs(t, RequestCause(context.WithValue(ctx, contextPeer, &peerWatch{})), context.Canceled)
+	assert.ErrorIs(t, RequestCause(context.WithValue(ctx, contextPeer, &peerWatch{gone: 1})), ErrPeerDisconnected)
+}
@@ -0,0 +1,99 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import "strings"
+
+// PortKind is how a user connected to a device, as classified from the port field of an
+// AuthenStart, AuthorRequest or AcctRequest
+type PortKind string
+
+const (
+	// PortTTY is an async or serial line, eg tty2 or tty1/0/3
+	PortTTY PortKind = "tty"
+	// PortVTY is a virtual terminal line, eg ssh or telnet on vty0 or pts/1
+	PortVTY PortKind = "vty"
+	// PortConsole is the console line, eg con0 or console
+	PortConsole PortKind = "console"
+	// PortAux is the auxiliary line, eg aux0
+	PortAux PortKind = "aux"
+	// PortUnknown is a port in a format that is not recognized, eg a vendor specific one
+	PortUnknown PortKind = "unknown"
+)
+
+// portPrefixes maps the lowercase port name prefixes devices send to their kind.  Longer prefixes
+// are listed before the shorter prefixes they start with.
+var portPrefixes = []struct {
+	prefix string
+	kind   PortKind
+}{
+	{"console", PortConsole},
+	{"con", PortConsole},
+	{"cty", PortConsole},
+	{"vty", PortVTY},
+	{"pts", PortVTY},
+	{"tty", PortTTY},
+	{"aux", PortAux},
+}
+
+// Port is a parsed AuthenPort, see AuthenPort.Parse
+type Port struct {
+	Kind PortKind
+	// Line is the line number of the port, eg 0/0/1 for tty0/0/1, and may be empty
+	Line string
+	// Raw is the port as the device sent it
+	Raw string
+}
+
+// Parse classifies t.  Ports are matched case insensitively with an optional "line " prefix and
+// a line number of digits and slashes, eg "vty0", "Line VTY 4", "console" or "pts/1".  Any other
+// port, eg "ttyp0" or "Gi0/1", is of PortUnknown with only Raw set.
+func (t AuthenPort) Parse() Port {
+	p := Port{Kind: PortUnknown, Raw: string(t)}
+	s := strings.ToLower(strings.TrimSpace(string(t)))
+	s = strings.TrimSpace(strings.TrimPrefix(s, "line "))
+	for _, pp := range portPrefixes {
+		if !strings.HasPrefix(s, pp.prefix) {
+			continue
+		}
+		line := strings.TrimPrefix(strings.TrimSpace(strings.TrimPrefix(s, pp.prefix)), "/")
+		if !isPortLine(line) {
+			return p
+		}
+		p.Kind, p.Line = pp.kind, line
+		return p
+	}
+	return p
+}
+
+// isPortLine reports if s is empty or a line number such as 2 or 1/0/3
+func isPortLine(s string) bool {
+	if s == "" {
+		return true
+	}
+	for _, part := range strings.Split(s, "/") {
+		if part == "" {
+			return false
+		}
+		for _, r := range part {
+			if r < '0' || r > '9' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// portFields adds the kind and line of port to fields, see Fields of AuthenStart, AuthorRequest
+// and AcctRequest
+func portFields(fields map[string]string, port AuthenPort) map[string]string {
+	p := port.Parse()
+	fields["port-kind"] = string(p.Kind)
+	fields["port-line"] = p.Line
+	return fields
+}
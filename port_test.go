@@ -0,0 +1,55 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthenPortParse(t *testing.T) {
+	tests := []struct {
+		port AuthenPort
+		want Port
+	}{
+		{port: "tty0", want: Port{Kind: PortTTY, Line: "0", Raw: "tty0"}},
+		{port: "tty1/0/3", want: Port{Kind: PortTTY, Line: "1/0/3", Raw: "tty1/0/3"}},
+		{port: "TTY 12", want: Port{Kind: PortTTY, Line: "12", Raw: "TTY 12"}},
+		{port: "vty1", want: Port{Kind: PortVTY, Line: "1", Raw: "vty1"}},
+		{port: "line vty 4", want: Port{Kind: PortVTY, Line: "4", Raw: "line vty 4"}},
+		{port: "pts/2", want: Port{Kind: PortVTY, Line: "2", Raw: "pts/2"}},
+		{port: "console", want: Port{Kind: PortConsole, Raw: "console"}},
+		{port: "con0", want: Port{Kind: PortConsole, Line: "0", Raw: "con0"}},
+		{port: "Console0", want: Port{Kind: PortConsole, Line: "0", Raw: "Console0"}},
+		{port: "cty", want: Port{Kind: PortConsole, Raw: "cty"}},
+		{port: "aux0", want: Port{Kind: PortAux, Line: "0", Raw: "aux0"}},
+		{port: "ttyp0", want: Port{Kind: PortUnknown, Raw: "ttyp0"}},
+		{port: "Gi0/1", want: Port{Kind: PortUnknown, Raw: "Gi0/1"}},
+		{port: "vty0//1", want: Port{Kind: PortUnknown, Raw: "vty0//1"}},
+		{port: "", want: Port{Kind: PortUnknown}},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.want, test.port.Parse(), "port [%v]", test.port)
+	}
+}
+
+func TestPortFields(t *testing.T) {
+	fields := NewAcctRequest(SetAcctRequestPort("tty2")).Fields()
+	assert.Equal(t, "tty2", fields["port"])
+	assert.Equal(t, "tty", fields["port-kind"])
+	assert.Equal(t, "2", fields["port-line"])
+
+	fields = NewAuthorRequest(SetAuthorRequestPort("vendor:slot-3")).Fields()
+	assert.Equal(t, "vendor:slot-3", fields["port"])
+	assert.Equal(t, "unknown", fields["port-kind"])
+	assert.Equal(t, "", fields["port-line"])
+
+	fields = NewAuthenStart(SetAuthenStartPort("console")).Fields()
+	assert.Equal(t, "console", fields["port-kind"])
+}
@@ -0,0 +1,108 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+// Package prommetrics reports the metrics of tacquito with prometheus.  The base package depends
+// on the standard library only and discards its metrics until tq.SetMetrics is called.  Importing
+// this package calls
+//
+//	tq.SetMetrics(prommetrics.New(prometheus.DefaultRegisterer))
+//
+// so programs that served the metrics of tacquito from the default registry before it moved them
+// behind tq.Metrics only need to import it, eg
+//
+//	import _ "github.com/facebookincubator/tacquito/prommetrics"
+//
+// Programs that serve another registry call tq.SetMetrics(prommetrics.New(reg)) before they create
+// a server; the metrics then move in reg, and those of the default registry stop moving.
+package prommetrics
+
+import (
+	tq "github.com/facebookincubator/tacquito"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Namespace prefixes the name of every metric
+const Namespace = "tacquito"
+
+func init() {
+	tq.SetMetrics(New(prometheus.DefaultRegisterer))
+}
+
+// New returns the tq.Metrics that registers every metric with reg
+func New(reg prometheus.Registerer) tq.Metrics {
+	return metrics{reg: reg}
+}
+
+// metrics implements tq.Metrics
+type metrics struct {
+	reg prometheus.Registerer
+}
+
+func (m metrics) Counter(opts tq.MetricOpts) tq.Counter {
+	c := prometheus.NewCounter(prometheus.CounterOpts{Namespace: Namespace, Name: opts.Name, Help: opts.Help})
+	m.reg.MustRegister(c)
+	return c
+}
+
+func (m metrics) CounterVec(opts tq.MetricOpts) tq.CounterVec {
+	v := prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: Namespace, Name: opts.Name, Help: opts.Help}, opts.Labels)
+	m.reg.MustRegister(v)
+	return counterVec{v}
+}
+
+func (m metrics) Gauge(opts tq.MetricOpts) tq.Gauge {
+	g := prometheus.NewGauge(prometheus.GaugeOpts{Namespace: Namespace, Name: opts.Name, Help: opts.Help})
+	m.reg.MustRegister(g)
+	return g
+}
+
+func (m metrics) GaugeFunc(opts tq.MetricOpts, f func() float64) {
+	m.reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{Namespace: Namespace, Name: opts.Name, Help: opts.Help}, f))
+}
+
+// Observer returns a summary if opts has objectives, a histogram otherwise
+func (m metrics) Observer(opts tq.MetricOpts) tq.Observer {
+	if opts.Objectives != nil {
+		s := prometheus.NewSummary(prometheus.SummaryOpts{Namespace: Namespace, Name: opts.Name, Help: opts.Help, Objectives: opts.Objectives})
+		m.reg.MustRegister(s)
+		return s
+	}
+	h := prometheus.NewHistogram(prometheus.HistogramOpts{Namespace: Namespace, Name: opts.Name, Help: opts.Help, Buckets: opts.Buckets})
+	m.reg.MustRegister(h)
+	return h
+}
+
+// ObserverVec returns a summary vector if opts has objectives, a histogram vector otherwise
+func (m metrics) ObserverVec(opts tq.MetricOpts) tq.ObserverVec {
+	if opts.Objectives != nil {
+		s := prometheus.NewSummaryVec(prometheus.SummaryOpts{Namespace: Namespace, Name: opts.Name, Help: opts.Help, Objectives: opts.Objectives}, opts.Labels)
+		m.reg.MustRegister(s)
+		return observerVec{s}
+	}
+	h := prometheus.NewHistogramVec(prometheus.HistogramOpts{Namespace: Namespace, Name: opts.Name, Help: opts.Help, Buckets: opts.Buckets}, opts.Labels)
+	m.reg.MustRegister(h)
+	return observerVec{h}
+}
+
+// counterVec is a tq.CounterVec
+type counterVec struct {
+	v *prometheus.CounterVec
+}
+
+func (c counterVec) WithLabelValues(lvs ...string) tq.Counter {
+	return c.v.WithLabelValues(lvs...)
+}
+
+// observerVec is a tq.ObserverVec
+type observerVec struct {
+	v prometheus.ObserverVec
+}
+
+func (o observerVec) WithLabelValues(lvs ...string) tq.Observer {
+	return o.v.WithLabelValues(lvs...)
+}
@@ -0,0 +1,83 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package prommetrics
+
+import (
+	"testing"
+
+	tq "github.com/facebookincubator/tacquito"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := New(reg)
+
+	c := m.CounterVec(tq.MetricOpts{Name: "counted", Help: "counted", Labels: []string{"type"}})
+	c.WithLabelValues("a").Add(2)
+	assert.Equal(t, float64(2), testutil.ToFloat64(c.WithLabelValues("a").(prometheus.Counter)))
+
+	g := m.Gauge(tq.MetricOpts{Name: "gauged", Help: "gauged"})
+	g.Inc()
+	g.Dec()
+	g.Add(3)
+	m.GaugeFunc(tq.MetricOpts{Name: "read", Help: "read"}, func() float64 { return 7 })
+
+	h := m.ObserverVec(tq.MetricOpts{Name: "histogram", Help: "histogram", Labels: []string{"type"}, Buckets: []float64{1, 2}})
+	h.WithLabelValues("a").Observe(1.5)
+	s := m.Observer(tq.MetricOpts{Name: "summary", Help: "summary", Objectives: map[float64]float64{0.5: 0.05}})
+	s.Observe(1)
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	got := make(map[string]*dto.MetricFamily)
+	for _, f := range families {
+		got[f.GetName()] = f
+	}
+	require.Contains(t, got, "tacquito_gauged")
+	assert.Equal(t, float64(3), got["tacquito_gauged"].GetMetric()[0].GetGauge().GetValue())
+	require.Contains(t, got, "tacquito_read")
+	assert.Equal(t, float64(7), got["tacquito_read"].GetMetric()[0].GetGauge().GetValue())
+	require.Contains(t, got, "tacquito_histogram")
+	assert.Equal(t, dto.MetricType_HISTOGRAM, got["tacquito_histogram"].GetType())
+	require.Contains(t, got, "tacquito_summary")
+	assert.Equal(t, dto.MetricType_SUMMARY, got["tacquito_summary"].GetType())
+}
+
+func TestDefaultRegisterer(t *testing.T) {
+	// importing the package registers every metric of the base package with the default registry
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	names := make(map[string]bool)
+	for _, f := range families {
+		names[f.GetName()] = true
+	}
+	for _, name := range []string{"tacquito_crypter_read", "tacquito_serve_accepted", "tacquito_sessions_duration_milliseconds"} {
+		assert.True(t, names[name], name)
+	}
+}
+
+func TestSetMetrics(t *testing.T) {
+	// every metric of the base package is registered, under the tacquito namespace
+	reg := prometheus.NewRegistry()
+	tq.SetMetrics(New(reg))
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	names := make(map[string]bool)
+	for _, f := range families {
+		names[f.GetName()] = true
+	}
+	for _, name := range []string{"tacquito_crypter_read", "tacquito_serve_accepted", "tacquito_crypter_packets_per_second", "tacquito_sessions_duration_milliseconds"} {
+		assert.True(t, names[name], name)
+	}
+}
@@ -0,0 +1,135 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// LengthQuirkPolicy may be implemented by the Handler returned from a SecretProvider to accept
+// packets from devices whose header length field disagrees with the real body length by a fixed
+// delta.  Since it hangs off the handler of a SecretProvider, it only applies to the device group
+// that provider matches; there is intentionally no server wide option for it.
+type LengthQuirkPolicy interface {
+	// LengthDelta returns the signed delta that is added to the declared length to get the real
+	// body length, eg -4 for a device that counts 4 header bytes in the length field, and how long
+	// to wait for the rest of a conformant body before the delta is applied.  A delta of 0 disables
+	// the quirk.
+	LengthDelta() (int, time.Duration)
+}
+
+// lengthQuirk reads packets whose declared length may be off by delta
+type lengthQuirk struct {
+	delta  int
+	budget time.Duration
+	// applied is called every time a packet was read using the delta
+	applied func(declared, actual int)
+}
+
+// read reads a raw packet from c.  The shorter of the declared and adjusted lengths is always
+// read.  The remaining bytes are only read if they are already buffered or arrive within the
+// budget, and do not look like the start of the next header.  A conformant device always sends
+// them, while a buggy one waits for our reply.
+func (q *lengthQuirk) read(c *crypter) ([]byte, error) {
+	h := make([]byte, MaxHeaderLength)
+	if _, err := io.ReadFull(c.Reader, h); err != nil {
+		return nil, err
+	}
+	// bounds check before converting, a length over 2^31 would be negative as an int on 32 bit
+	// platforms
+	length32 := binary.BigEndian.Uint32(h[8:])
+	if length32 > MaxBodyLength {
+		return nil, bodyLengthError(length32)
+	}
+	declared := int(length32)
+	short, long := declared, declared+q.delta
+	if short > long {
+		short, long = long, short
+	}
+	if short < 0 || long > int(MaxBodyLength) {
+		// the delta cannot apply to this packet
+		short, long = declared, declared
+	}
+	raw := make([]byte, MaxHeaderLength+long)
+	copy(raw, h)
+	if _, err := io.ReadFull(c.Reader, raw[MaxHeaderLength:MaxHeaderLength+short]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	length := short
+	if long > short && q.more(c, long-short) {
+		if _, err := io.ReadFull(c.Reader, raw[MaxHeaderLength+short:]); err != nil {
+			return nil, err
+		}
+		length = long
+	}
+	if length != declared {
+		crypterLengthQuirk.Inc()
+		binary.BigEndian.PutUint32(raw[8:], uint32(length))
+		if q.applied != nil {
+			q.applied(declared, length)
+		}
+	}
+	return raw[:MaxHeaderLength+length], nil
+}
+
+// more reports if the next n bytes on c are the remainder of the current body.  The budget only
+// starts once the buffered bytes are exhausted, as the next packet may already be buffered behind
+// this one; its header decides without waiting.
+func (q *lengthQuirk) more(c *crypter, n int) bool {
+	if buffered := c.Buffered(); buffered > 0 && buffered < n {
+		if b, err := c.Peek(buffered); err == nil && looksLikeNext(c, b) {
+			return false
+		}
+	}
+	if c.Buffered() < n {
+		// the read deadline is reset by the server before every packet
+		c.SetReadDeadline(time.Now().Add(q.budget))
+		defer c.SetReadDeadline(time.Time{})
+	}
+	b, err := c.Peek(n)
+	if err != nil {
+		return false
+	}
+	return !looksLikeNext(c, b)
+}
+
+// looksLikeNext reports if b could be the start of the next packet on c, including a proxy header
+// repeated ahead of it
+func looksLikeNext(c *crypter, b []byte) bool {
+	if c.proxy {
+		n := len(b)
+		if n > len(proxySignature) {
+			n = len(proxySignature)
+		}
+		if n > 0 && bytes.Equal(b[:n], proxySignature[:n]) {
+			return true
+		}
+	}
+	return looksLikeHeader(b)
+}
+
+// looksLikeHeader reports if b could be the start of a tacacs header
+func looksLikeHeader(b []byte) bool {
+	if len(b) == 0 || b[0]>>4 != MajorVersion {
+		return false
+	}
+	if len(b) == 1 {
+		return true
+	}
+	switch HeaderType(b[1]) {
+	case Authenticate, Authorize, Accounting:
+		return true
+	}
+	return false
+}
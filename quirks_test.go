@@ -0,0 +1,173 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// frames as sent by the affected firmware, encrypted with secret []byte("fooman").  The length
+// field counts 4 bytes more than the body that follows the header.
+func getLengthQuirkFrames() [][]byte {
+	// authen start, declared length 0x30 for a 0x2c byte body
+	authen := getEncryptedBytes()
+	authen[11] = 0x30
+	return [][]byte{
+		authen,
+		// acct request start, declared length 0x40 for a 0x3c byte body
+		{0xc0, 0x03, 0x01, 0x00, 0x2a, 0x0f, 0x11, 0xc3, 0x00, 0x00, 0x00, 0x40, 0x4d, 0x41, 0x96, 0x79,
+			0xb2, 0x92, 0xe6, 0xc5, 0xff, 0x64, 0xcf, 0x7b, 0xbd, 0xf5, 0xfe, 0x7a, 0x67, 0x44, 0x02, 0xc3,
+			0x8f, 0x4e, 0xa5, 0xda, 0xd2, 0x2d, 0x97, 0x56, 0xf6, 0x95, 0xf5, 0xf5, 0x58, 0x51, 0x54, 0x2d,
+			0x4b, 0xed, 0x52, 0x27, 0x6e, 0x88, 0x10, 0xa1, 0x56, 0x23, 0xcc, 0x02, 0xfa, 0x42, 0x74, 0x7a,
+			0x84, 0xc8, 0x26, 0x79, 0xfe, 0x75, 0x91, 0x4b},
+	}
+}
+
+func TestLengthQuirkFrames(t *testing.T) {
+	for _, frame := range getLengthQuirkFrames() {
+		client, server := net.Pipe()
+		c := lengthQuirkTestCrypter(server, -4)
+		var declared, actual int
+		c.lengthQuirk.applied = func(d, a int) { declared, actual = d, a }
+		before := metricValue(crypterLengthQuirk)
+
+		// the device writes its frame and waits for a reply
+		go client.Write(frame)
+		p, err := c.read()
+		assert.NoError(t, err)
+		assert.Equal(t, before+1, metricValue(crypterLengthQuirk))
+		assert.Equal(t, len(frame)-MaxHeaderLength+4, declared)
+		assert.Equal(t, len(frame)-MaxHeaderLength, actual)
+		assert.Equal(t, uint32(actual), p.Header.Length)
+		switch p.Header.Type {
+		case Authenticate:
+			assert.Equal(t, getDecryptedBytes(), p.Body)
+		case Accounting:
+			var body AcctRequest
+			assert.NoError(t, Unmarshal(p.Body, &body))
+			assert.Equal(t, "netops", body.User.String())
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestLengthQuirkBackToBack(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	c := lengthQuirkTestCrypter(server, -4)
+	before := metricValue(crypterLengthQuirk)
+
+	// the bytes after a short body are the next header, not the rest of the body
+	frames := getLengthQuirkFrames()
+	go client.Write(append(append([]byte{}, frames[0]...), frames[1]...))
+	for _, want := range []HeaderType{Authenticate, Accounting} {
+		p, err := c.read()
+		assert.NoError(t, err)
+		assert.Equal(t, want, p.Header.Type)
+	}
+	assert.Equal(t, before+2, metricValue(crypterLengthQuirk))
+}
+
+func TestLengthQuirkConformant(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	c := lengthQuirkTestCrypter(server, -4)
+	before := metricValue(crypterLengthQuirk)
+
+	// the rest of a conformant body arrives within the budget
+	go func() {
+		frame := getEncryptedBytes()
+		client.Write(frame[:len(frame)-4])
+		time.Sleep(10 * time.Millisecond)
+		client.Write(frame[len(frame)-4:])
+	}()
+	p, err := c.read()
+	assert.NoError(t, err)
+	assert.Equal(t, getDecryptedBytes(), p.Body)
+	assert.Equal(t, before, metricValue(crypterLengthQuirk))
+}
+
+func TestLengthQuirkDisabled(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	c := newCrypter(roleServer, []byte("fooman"), server, false)
+
+	// without the quirk the read waits for bytes that never come
+	go func() {
+		client.Write(getLengthQuirkFrames()[0])
+		client.Close()
+	}()
+	_, err := c.read()
+	assert.Error(t, err)
+}
+
+// lengthQuirkHandler replies pass and applies a length delta
+type lengthQuirkHandler struct {
+	delta int
+}
+
+func (h lengthQuirkHandler) Handle(response Response, request Request) {
+	response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusPass)))
+}
+
+func (h lengthQuirkHandler) LengthDelta() (int, time.Duration) {
+	return h.delta, 50 * time.Millisecond
+}
+
+// infoLogger records info logs
+type infoLogger struct {
+	nopLogger
+	mu   sync.Mutex
+	logs []string
+}
+
+func (l *infoLogger) Infof(ctx context.Context, format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logs = append(l.logs, fmt.Sprintf(format, args...))
+}
+
+func TestLengthQuirkLogOncePerDevice(t *testing.T) {
+	logger := &infoLogger{}
+	s := NewServer(logger, nil)
+	for i := 0; i < 2; i++ {
+		client, server := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			s.handle(context.Background(), newCrypter(roleServer, []byte("fooman"), server, false), lengthQuirkHandler{delta: -4})
+			close(done)
+		}()
+		_, err := client.Write(getLengthQuirkFrames()[0])
+		assert.NoError(t, err)
+		resp, err := newCrypter(roleClient, []byte("fooman"), client, false).read()
+		assert.NoError(t, err)
+		var body AuthenReply
+		assert.NoError(t, Unmarshal(resp.Body, &body))
+		assert.Equal(t, AuthenStatusPass, body.Status)
+		client.Close()
+		<-done
+	}
+	var quirkLogs int
+	for _, l := range logger.logs {
+		if strings.Contains(l, "length delta") {
+			quirkLogs++
+		}
+	}
+	assert.Equal(t, 1, quirkLogs)
+}
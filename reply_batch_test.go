@@ -0,0 +1,123 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeCountingConn keeps every write made to it
+type writeCountingConn struct {
+	net.Conn
+	writes [][]byte
+}
+
+func (c *writeCountingConn) Write(b []byte) (int, error) {
+	c.writes = append(c.writes, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func newBatchResponse(conn net.Conn) *response {
+	return &response{
+		loggerProvider: nopLogger{},
+		ctx:            context.Background(),
+		crypter:        &crypter{Conn: conn, secret: []byte("fooman")},
+		header:         *NewHeader(SetHeaderVersion(Version{MajorVersion: MajorVersion, MinorVersion: MinorVersionDefault}), SetHeaderType(Authenticate), SetHeaderSeqNo(1), SetHeaderSessionID(12345)),
+		profile:        DefaultMessageProfile,
+	}
+}
+
+func TestReplyBatch(t *testing.T) {
+	conn := &writeCountingConn{}
+	r := newBatchResponse(conn)
+	var teed bytes.Buffer
+	r.RegisterWriter(&teed)
+
+	var replier BatchReplier = r
+	_, err := replier.ReplyBatch(
+		NewAuthenReply(SetAuthenReplyStatus(AuthenStatusGetData), SetAuthenReplyServerMsg("authorized use only")),
+		NewAuthenReply(SetAuthenReplyStatus(AuthenStatusGetUser), SetAuthenReplyServerMsg("username:")),
+	)
+	require.NoError(t, err)
+	require.Len(t, conn.writes, 1)
+
+	// the device gets a single reply, the prompt, with the banner ahead of its message
+	reader := NewDecryptReader(bytes.NewReader(conn.writes[0]), []byte("fooman"))
+	p, err := reader.ReadPacket()
+	require.NoError(t, err)
+	assert.Equal(t, SequenceNumber(2), p.Header.SeqNo)
+	var reply AuthenReply
+	require.NoError(t, Unmarshal(p.Body, &reply))
+	assert.Equal(t, AuthenStatusGetUser, reply.Status)
+	assert.Equal(t, AuthenServerMsg("authorized use only\nusername:"), reply.ServerMsg)
+	_, err = reader.ReadPacket()
+	assert.Error(t, err)
+	assert.Equal(t, SequenceNumber(2), r.header.SeqNo)
+	assert.True(t, r.written)
+	assert.NotZero(t, teed.Len())
+}
+
+func TestReplyBatchMarshalError(t *testing.T) {
+	conn := &writeCountingConn{}
+	r := newBatchResponse(conn)
+
+	// each message fits the field, joined they do not
+	_, err := r.ReplyBatch(
+		NewAuthenReply(SetAuthenReplyStatus(AuthenStatusGetData), SetAuthenReplyServerMsg(strings.Repeat("a", maxFieldLength/2+1))),
+		NewAuthenReply(SetAuthenReplyStatus(AuthenStatusGetUser), SetAuthenReplyServerMsg(strings.Repeat("a", maxFieldLength/2))),
+	)
+	assert.Error(t, err)
+	// nothing reached the wire and the response may still reply
+	assert.Empty(t, conn.writes)
+	assert.False(t, r.written)
+	assert.Equal(t, SequenceNumber(1), r.header.SeqNo)
+
+	_, err = r.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusGetUser), SetAuthenReplyServerMsg("username:")))
+	assert.NoError(t, err)
+	assert.Len(t, conn.writes, 1)
+}
+
+func TestReplyBatchRefused(t *testing.T) {
+	tests := []struct {
+		name string
+		vs   []EncoderDecoder
+	}{
+		{
+			// the device could not answer the prompt of a session the first reply ended
+			name: "ends the session",
+			vs: []EncoderDecoder{
+				NewAuthenReply(SetAuthenReplyStatus(AuthenStatusFail), SetAuthenReplyServerMsg("denied")),
+				NewAuthenReply(SetAuthenReplyStatus(AuthenStatusGetUser), SetAuthenReplyServerMsg("username:")),
+			},
+		},
+		{
+			name: "not authentication",
+			vs: []EncoderDecoder{
+				NewAuthenReply(SetAuthenReplyStatus(AuthenStatusGetData), SetAuthenReplyServerMsg("authorized use only")),
+				NewAuthorReply(SetAuthorReplyStatus(AuthorStatusPassAdd)),
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := &writeCountingConn{}
+			r := newBatchResponse(conn)
+			_, err := r.ReplyBatch(test.vs...)
+			assert.Error(t, err)
+			assert.Empty(t, conn.writes)
+			assert.False(t, r.written)
+		})
+	}
+}
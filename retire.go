@@ -0,0 +1,202 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// SecretRotationNotifier may be implemented by a SecretProvider to report that the secret of a
+// device group was rotated.  Every group received is retired as by Server.RetireGroup.  The
+// channel is read while the server serves.
+type SecretRotationNotifier interface {
+	SecretRotations() <-chan string
+}
+
+// SetSecretRotationPace sets how many connections per second are retired after a secret rotation,
+// see RetireGroup, so a fleet wide rotation does not reconnect every device at once.  The default
+// is 10.
+func SetSecretRotationPace(perSecond int) Option {
+	return func(s *Server) {
+		s.rotationPace = perSecond
+	}
+}
+
+// RetireGroup retires the open connections of devices in group, see DeviceGroupPolicy, after the
+// secret of the group was rotated.  Connections are retired at the pace set with
+// SetSecretRotationPace.  A retired connection completes its sessions in flight, refuses new
+// sessions so the device reconnects and gets the new secret, and is closed once nothing is in
+// flight.  Connections accepted after the call are not retired.  The connections left on the old
+// secret are reported in tacquito_serve_connections_retiring.
+func (s *Server) RetireGroup(group string) {
+	s.retirement.queue(group, s.rotationPace)
+}
+
+// watchRotations retires the groups reported by a SecretRotationNotifier until ctx is done
+func (s *Server) watchRotations(ctx context.Context) {
+	n, ok := s.SecretProvider.(SecretRotationNotifier)
+	if !ok {
+		return
+	}
+	rotations := n.SecretRotations()
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case group, ok := <-rotations:
+				if !ok {
+					return
+				}
+				s.Infof(ctx, "secret of device group [%v] was rotated, retiring its connections", group)
+				s.RetireGroup(group)
+			}
+		}
+	}()
+}
+
+// retirement holds the open connections by device group, and the connections waiting to be retired
+type retirement struct {
+	mu      sync.Mutex
+	conns   map[*connRetire]struct{}
+	pending []*connRetire
+	// pacing is set while a goroutine retires the pending connections
+	pacing bool
+	// stopped is set once the server was stopped, see stop
+	stopped bool
+}
+
+// register adds the connection c of a device in group
+func (r *retirement) register(c net.Conn, group string) *connRetire {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conns == nil {
+		r.conns = make(map[*connRetire]struct{})
+	}
+	cr := &connRetire{conn: c, group: group, stopped: r.stopped}
+	r.conns[cr] = struct{}{}
+	return cr
+}
+
+// unregister removes a closed connection
+func (r *retirement) unregister(cr *connRetire) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conns, cr)
+	if cr.queued {
+		serveRetiring.Dec()
+	}
+}
+
+// queue marks the connections of group for retirement, retiring them perSecond
+func (r *retirement) queue(group string, perSecond int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for cr := range r.conns {
+		if cr.group != group || cr.queued {
+			continue
+		}
+		cr.queued = true
+		serveRetiring.Inc()
+		r.pending = append(r.pending, cr)
+	}
+	if r.pacing || len(r.pending) == 0 {
+		return
+	}
+	r.pacing = true
+	go r.pace(time.Second / time.Duration(perSecond))
+}
+
+// stop wakes every connection, and every connection registered after, so a read blocked on the
+// device returns at once and the connection sees the server was stopped
+func (r *retirement) stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stopped = true
+	for cr := range r.conns {
+		cr.stop()
+	}
+}
+
+// pace retires a pending connection every interval, until none are pending
+func (r *retirement) pace(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		r.mu.Lock()
+		if len(r.pending) == 0 {
+			r.pacing = false
+			r.mu.Unlock()
+			return
+		}
+		cr := r.pending[0]
+		r.pending[0] = nil
+		r.pending = r.pending[1:]
+		r.mu.Unlock()
+		cr.retire()
+		<-ticker.C
+	}
+}
+
+// connRetire is the retirement state of one connection
+type connRetire struct {
+	conn  net.Conn
+	group string
+	// queued is set once the connection is pending retirement, guarded by the retirement lock
+	queued bool
+
+	mu sync.Mutex
+	// retired is set once the connection may not start new sessions
+	retired bool
+	// idle is set while the connection waits for a packet with no sessions in flight
+	idle bool
+	// stopped is set once the server was stopped, every read of the connection is woken at once
+	stopped bool
+}
+
+// arm sets the read deadline of the connection before a read, with inFlight sessions.  It reports
+// if the connection was retired, the read deadline and the retirement are set under one lock so a
+// retirement either is seen here or wakes the read.
+func (cr *connRetire) arm(deadline time.Time, inFlight int) (retired bool, err error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.idle = inFlight == 0
+	if cr.stopped {
+		deadline = time.Now()
+	}
+	return cr.retired, cr.conn.SetReadDeadline(deadline)
+}
+
+// retire stops the connection from starting new sessions, waking it if it is idle so it closes.
+// A connection with sessions in flight is not interrupted, it closes once they complete.
+func (cr *connRetire) retire() {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.retired = true
+	if cr.idle {
+		cr.conn.SetReadDeadline(time.Now())
+	}
+}
+
+// stop wakes the connection whether or not it is idle, the server was stopped
+func (cr *connRetire) stop() {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.stopped = true
+	cr.conn.SetReadDeadline(time.Now())
+}
+
+// isRetired reports if the connection was retired
+func (cr *connRetire) isRetired() bool {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return cr.retired
+}
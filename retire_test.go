@@ -0,0 +1,178 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// retireTestHandler asks for a username then passes, for the devices of group
+type retireTestHandler struct {
+	HandlerFunc
+	group string
+}
+
+func (h retireTestHandler) DeviceGroup() string {
+	return h.group
+}
+
+// rotationProvider serves one secret and reports rotations of device groups
+type rotationProvider struct {
+	handler   Handler
+	rotations chan string
+}
+
+func (p rotationProvider) Get(ctx context.Context, remote net.Addr) ([]byte, Handler, error) {
+	return []byte("fooman"), p.handler, nil
+}
+
+func (p rotationProvider) SecretRotations() <-chan string {
+	return p.rotations
+}
+
+// retireTestStart starts login id on a single-connect connection
+func retireTestStart(id SessionID) *Packet {
+	return featureTestStart(id, SingleConnect, MinorVersionDefault, AuthenTypeASCII)
+}
+
+// retireTestContinue continues login id
+func retireTestContinue(id SessionID) *Packet {
+	return NewPacket(
+		SetPacketHeader(NewHeader(SetHeaderType(Authenticate), SetHeaderSeqNo(3), SetHeaderSessionID(id), SetHeaderFlag(SingleConnect),
+			SetHeaderVersion(Version{MajorVersion: MajorVersion, MinorVersion: MinorVersionDefault}))),
+		SetPacketBodyUnsafe(NewAuthenContinue(SetAuthenContinueUserMessage("cisco"))),
+	)
+}
+
+// retireTestStatus sends p on c and returns the status of the reply
+func retireTestStatus(t *testing.T, c *Client, p *Packet) AuthenStatus {
+	resp, err := c.Send(p)
+	require.NoError(t, err)
+	var reply AuthenReply
+	require.NoError(t, Unmarshal(resp.Body, &reply))
+	return reply.Status
+}
+
+// retireTestServer serves rotationProvider with the given pace, and returns its address and the
+// close reasons and times of its connections
+func retireTestServer(t *testing.T, ctx context.Context, p rotationProvider, pace int) (*Server, string, chan retireTestClose) {
+	closes := make(chan retireTestClose, 200)
+	s := NewServer(nopLogger{}, p, SetSecretRotationPace(pace), SetOnClose(func(ctx context.Context, remote net.Addr, reason CloseReason) {
+		closes <- retireTestClose{reason: reason, at: time.Now()}
+	}))
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	require.NoError(t, err)
+	go s.Serve(ctx, listener.(*net.TCPListener))
+	return s, listener.Addr().String(), closes
+}
+
+type retireTestClose struct {
+	reason CloseReason
+	at     time.Time
+}
+
+func TestRetireGroupPaced(t *testing.T) {
+	const conns, pace = 100, 200
+	p := rotationProvider{handler: retireTestHandler{HandlerFunc: askUserHandler(AuthenStatusPass), group: "edge"}, rotations: make(chan string)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, addr, closes := retireTestServer(t, ctx, p, pace)
+
+	// half of the connections have a login in flight, the others are idle
+	clients := make([]*Client, conns)
+	for i := range clients {
+		c, err := NewClient(SetClientDialer("tcp6", addr, []byte("fooman")))
+		require.NoError(t, err)
+		defer c.Close()
+		clients[i] = c
+		require.Equal(t, AuthenStatusGetUser, retireTestStatus(t, c, retireTestStart(1)))
+		if i%2 == 1 {
+			require.Equal(t, AuthenStatusPass, retireTestStatus(t, c, retireTestContinue(1)))
+		}
+	}
+	require.Eventually(t, func() bool {
+		s.retirement.mu.Lock()
+		defer s.retirement.mu.Unlock()
+		return len(s.retirement.conns) == conns
+	}, 2*time.Second, time.Millisecond)
+
+	rotated := time.Now()
+	p.rotations <- "edge"
+	// every login in flight completes
+	for i := 0; i < conns; i += 2 {
+		assert.Equal(t, AuthenStatusPass, retireTestStatus(t, clients[i], retireTestContinue(1)), "connection %v", i)
+	}
+
+	var at []time.Time
+	for len(at) < conns {
+		select {
+		case c := <-closes:
+			require.Equal(t, CloseSecretRotated, c.reason)
+			at = append(at, c.at)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v of %v connections were retired", len(at), conns)
+		}
+	}
+	sort.Slice(at, func(i, j int) bool { return at[i].Before(at[j]) })
+	// the connections are retired at the pace, not all at once
+	interval := time.Second / pace
+	for i, a := range at {
+		assert.GreaterOrEqual(t, a.Sub(rotated), time.Duration(i)*interval*8/10, "connection %v retired ahead of the pace", i)
+	}
+	require.Eventually(t, func() bool { return metricValue(serveRetiring) == 0 }, time.Second, time.Millisecond)
+}
+
+func TestRetireGroupRefusesNewSessions(t *testing.T) {
+	p := rotationProvider{handler: retireTestHandler{HandlerFunc: askUserHandler(AuthenStatusPass), group: "edge"}, rotations: make(chan string)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, addr, closes := retireTestServer(t, ctx, p, 1)
+	c, err := NewClient(SetClientDialer("tcp6", addr, []byte("fooman")))
+	require.NoError(t, err)
+	defer c.Close()
+	require.Equal(t, AuthenStatusGetUser, retireTestStatus(t, c, retireTestStart(1)))
+
+	// groups other than the rotated one are left alone
+	s.RetireGroup("core")
+	s.RetireGroup("edge")
+	assert.Equal(t, float64(1), metricValue(serveRetiring))
+	require.Eventually(t, func() bool {
+		s.retirement.mu.Lock()
+		defer s.retirement.mu.Unlock()
+		for cr := range s.retirement.conns {
+			if !cr.isRetired() {
+				return false
+			}
+		}
+		return true
+	}, time.Second, time.Millisecond)
+
+	// the retired connection refuses a new session, and completes the one in flight
+	assert.Equal(t, AuthenStatusError, retireTestStatus(t, c, retireTestStart(2)))
+	assert.Equal(t, AuthenStatusPass, retireTestStatus(t, c, retireTestContinue(1)))
+	select {
+	case closed := <-closes:
+		assert.Equal(t, CloseSecretRotated, closed.reason)
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection was not closed once its session completed")
+	}
+
+	// connections accepted after the rotation get the new secret and are not retired
+	other, err := NewClient(SetClientDialer("tcp6", addr, []byte("fooman")))
+	require.NoError(t, err)
+	defer other.Close()
+	require.Equal(t, AuthenStatusGetUser, retireTestStatus(t, other, retireTestStart(1)))
+	assert.Equal(t, float64(0), metricValue(serveRetiring))
+}
@@ -0,0 +1,132 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// PrefixSecret is the secret and handler of the devices of a prefix, see NewPrefixSecretProvider
+type PrefixSecret struct {
+	// Prefix is an ipv4 or ipv6 cidr, eg 192.0.2.0/24 or 2001:db8::/32
+	Prefix  string
+	Secret  []byte
+	Handler Handler
+}
+
+// UnknownDeviceError is returned by a PrefixSecretProvider for a device no prefix holds
+type UnknownDeviceError struct {
+	Remote net.Addr
+}
+
+// Error implements error
+func (e *UnknownDeviceError) Error() string {
+	return fmt.Sprintf("no prefix holds device [%v]", e.Remote)
+}
+
+// NewPrefixSecretProvider returns a SecretProvider that serves each device with the secret of the
+// longest prefix that holds it, so one server can front several network domains that each have
+// their own secret, and a /24 can be carved out of a /16 with a secret of its own.  A prefix may
+// only be given once.  Devices no prefix holds are a *UnknownDeviceError, which the server closes
+// and counts in tacquito_serve_unknown_device.
+//
+// This differs from the PREFIX secret provider of the config loader, which serves a device with
+// the first provider in config order that holds it whatever the length of its prefix.  A config
+// moved onto this provider must not rely on its order.
+func NewPrefixSecretProvider(entries ...PrefixSecret) (*PrefixSecretProvider, error) {
+	p := &PrefixSecretProvider{}
+	for _, e := range entries {
+		_, ipNet, err := net.ParseCIDR(e.Prefix)
+		if err != nil {
+			return nil, fmt.Errorf("prefix [%v] is not a cidr; %w", e.Prefix, err)
+		}
+		if len(e.Secret) == 0 || e.Handler == nil {
+			return nil, fmt.Errorf("prefix [%v] needs a secret and a handler", e.Prefix)
+		}
+		table := &p.v6
+		if len(ipNet.Mask) == net.IPv4len {
+			table = &p.v4
+			ipNet.IP = ipNet.IP.To4()
+		}
+		if err := table.add(ipNet, e); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// PrefixSecretProvider is a SecretProvider of prefixes, see NewPrefixSecretProvider
+type PrefixSecretProvider struct {
+	v4, v6 prefixTable
+}
+
+// Get implements SecretProvider
+func (p *PrefixSecretProvider) Get(ctx context.Context, remote net.Addr) ([]byte, Handler, error) {
+	var ip net.IP
+	switch addr := remote.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.IPAddr:
+		ip = addr.IP
+	}
+	table := &p.v6
+	// an ipv4 device may be seen as an ipv4 mapped ipv6 address by a dual stack listener
+	if v4 := ip.To4(); v4 != nil {
+		ip, table = v4, &p.v4
+	}
+	if ip != nil {
+		if e, ok := table.lookup(ip); ok {
+			return e.Secret, e.Handler, nil
+		}
+	}
+	return nil, nil, &UnknownDeviceError{Remote: remote}
+}
+
+// prefixTable holds the prefixes of one address family by length, longest first
+type prefixTable struct {
+	lengths []prefixLength
+}
+
+// prefixLength holds the prefixes of one length, by their masked address
+type prefixLength struct {
+	ones     int
+	mask     net.IPMask
+	prefixes map[string]PrefixSecret
+}
+
+// add adds e for ipNet, whose ip is of the family of t
+func (t *prefixTable) add(ipNet *net.IPNet, e PrefixSecret) error {
+	ones, _ := ipNet.Mask.Size()
+	i := sort.Search(len(t.lengths), func(i int) bool { return t.lengths[i].ones <= ones })
+	if i == len(t.lengths) || t.lengths[i].ones != ones {
+		t.lengths = append(t.lengths, prefixLength{})
+		copy(t.lengths[i+1:], t.lengths[i:])
+		t.lengths[i] = prefixLength{ones: ones, mask: ipNet.Mask, prefixes: map[string]PrefixSecret{}}
+	}
+	key := string(ipNet.IP.Mask(ipNet.Mask))
+	if _, ok := t.lengths[i].prefixes[key]; ok {
+		return fmt.Errorf("prefix [%v] is given more than once", ipNet)
+	}
+	t.lengths[i].prefixes[key] = e
+	return nil
+}
+
+// lookup returns the entry of the longest prefix that holds ip
+func (t *prefixTable) lookup(ip net.IP) (PrefixSecret, bool) {
+	for _, l := range t.lengths {
+		if e, ok := l.prefixes[string(ip.Mask(l.mask))]; ok {
+			return e, true
+		}
+	}
+	return PrefixSecret{}, false
+}
@@ -0,0 +1,121 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefixSecretProvider(t *testing.T) {
+	handler := HandlerFunc(func(response Response, request Request) {})
+	p, err := NewPrefixSecretProvider(
+		PrefixSecret{Prefix: "10.1.0.0/16", Secret: []byte("domain"), Handler: handler},
+		PrefixSecret{Prefix: "10.1.2.0/24", Secret: []byte("lab"), Handler: handler},
+		PrefixSecret{Prefix: "10.1.2.3/32", Secret: []byte("bastion"), Handler: handler},
+		PrefixSecret{Prefix: "0.0.0.0/0", Secret: []byte("fallback"), Handler: handler},
+		PrefixSecret{Prefix: "2001:db8::/32", Secret: []byte("v6-domain"), Handler: handler},
+		PrefixSecret{Prefix: "2001:db8:1::/48", Secret: []byte("v6-lab"), Handler: handler},
+		PrefixSecret{Prefix: "2001:db8:1::1/128", Secret: []byte("v6-bastion"), Handler: handler},
+	)
+	require.NoError(t, err)
+	tests := []struct {
+		name   string
+		remote net.Addr
+		secret string
+	}{
+		{name: "/16", remote: &net.TCPAddr{IP: net.ParseIP("10.1.9.9"), Port: 4000}, secret: "domain"},
+		// the /24 overlaps the /16, and being longer it wins whatever the order they were given in
+		{name: "/24 within the /16", remote: &net.TCPAddr{IP: net.ParseIP("10.1.2.4")}, secret: "lab"},
+		{name: "exact /32", remote: &net.TCPAddr{IP: net.ParseIP("10.1.2.3")}, secret: "bastion"},
+		{name: "default route", remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}, secret: "fallback"},
+		{name: "ipv4 mapped ipv6", remote: &net.TCPAddr{IP: net.ParseIP("::ffff:10.1.2.3")}, secret: "bastion"},
+		{name: "ipv6 /32", remote: &net.TCPAddr{IP: net.ParseIP("2001:db8:2::1")}, secret: "v6-domain"},
+		{name: "ipv6 /48 within the /32", remote: &net.TCPAddr{IP: net.ParseIP("2001:db8:1::2")}, secret: "v6-lab"},
+		{name: "ipv6 exact /128", remote: &net.TCPAddr{IP: net.ParseIP("2001:db8:1::1")}, secret: "v6-bastion"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			secret, h, err := p.Get(context.Background(), test.remote)
+			require.NoError(t, err)
+			assert.Equal(t, test.secret, string(secret))
+			assert.NotNil(t, h)
+		})
+	}
+}
+
+func TestPrefixSecretProviderUnknownDevice(t *testing.T) {
+	handler := HandlerFunc(func(response Response, request Request) {})
+	p, err := NewPrefixSecretProvider(
+		PrefixSecret{Prefix: "10.1.0.0/16", Secret: []byte("domain"), Handler: handler},
+		PrefixSecret{Prefix: "2001:db8::/32", Secret: []byte("v6-domain"), Handler: handler},
+	)
+	require.NoError(t, err)
+	for _, remote := range []net.Addr{
+		&net.TCPAddr{IP: net.ParseIP("10.2.0.1")},
+		// an ipv6 address is never matched against ipv4 prefixes, or the reverse
+		&net.TCPAddr{IP: net.ParseIP("::a01:1")},
+		&net.TCPAddr{IP: net.ParseIP("2001:db9::1")},
+		&net.UnixAddr{Name: "/tmp/tacquito.sock"},
+	} {
+		secret, h, err := p.Get(context.Background(), remote)
+		var ud *UnknownDeviceError
+		require.True(t, errors.As(err, &ud), err)
+		assert.Equal(t, remote, ud.Remote)
+		assert.Nil(t, secret)
+		assert.Nil(t, h)
+	}
+}
+
+func TestPrefixSecretProviderInvalid(t *testing.T) {
+	handler := HandlerFunc(func(response Response, request Request) {})
+	for name, entries := range map[string][]PrefixSecret{
+		"not a cidr":      {{Prefix: "10.1.0.0", Secret: []byte("a"), Handler: handler}},
+		"duplicate":       {{Prefix: "10.1.0.0/16", Secret: []byte("a"), Handler: handler}, {Prefix: "10.1.255.0/16", Secret: []byte("b"), Handler: handler}},
+		"missing secret":  {{Prefix: "10.1.0.0/16", Handler: handler}},
+		"missing handler": {{Prefix: "10.1.0.0/16", Secret: []byte("a")}},
+	} {
+		_, err := NewPrefixSecretProvider(entries...)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestPrefixSecretProviderServe(t *testing.T) {
+	// each domain is served with its own secret, and the crypter of a connection with the secret of
+	// the prefix of its device
+	handler := HandlerFunc(func(response Response, request Request) {
+		response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusPass)))
+	})
+	p, err := NewPrefixSecretProvider(
+		PrefixSecret{Prefix: "::/0", Secret: []byte("v6-domain"), Handler: handler},
+		PrefixSecret{Prefix: "::1/128", Secret: []byte("fooman"), Handler: handler},
+	)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	require.NoError(t, err)
+	go NewServer(nopLogger{}, p).Serve(ctx, listener.(*net.TCPListener))
+
+	conn, err := net.Dial("tcp6", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	c := newCrypter(roleClient, []byte("fooman"), conn, false)
+	_, err = c.write(proxyTestPacket())
+	require.NoError(t, err)
+	resp, err := c.read()
+	require.NoError(t, err)
+	var body AuthenReply
+	require.NoError(t, Unmarshal(resp.Body, &body))
+	assert.Equal(t, AuthenStatusPass, body.Status)
+}
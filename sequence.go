@@ -0,0 +1,163 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrSequence is returned when a device sends a packet whose sequence number breaks rfc8907
+// section 4.1: the first packet of a session must be seq 1, client packets are odd, each follows
+// the reply before it, and a session ends before its sequence number wraps.  The server replies
+// with an error where the packet type and sequence number allow it, and closes the connection with
+// CloseSessionError.
+type ErrSequence struct {
+	SessionID SessionID
+	SeqNo     SequenceNumber
+	// Reason is one of even, first, order or wrap
+	Reason string
+}
+
+// Error ...
+func (e ErrSequence) Error() string {
+	return fmt.Sprintf("sessionID [%v] sent sequence number [%v]; %v", e.SessionID, e.SeqNo, sequenceReasons[e.Reason])
+}
+
+// sequenceReasons explain the reasons of ErrSequence
+var sequenceReasons = map[string]string{
+	"even":  "client packets must have odd sequence numbers",
+	"first": "the first packet of a session must be sequence number 1",
+	"order": "the sequence number does not follow the last one of the session",
+	"wrap":  "the reply would wrap the sequence number, the session must restart",
+}
+
+// isErrSequence reports if err is *ErrSequence.  Its target escapes, so it is declared here rather
+// than in readCloseReason, which the peer watch calls on the timeout of every request.
+func isErrSequence(err error) bool {
+	var sequence *ErrSequence
+	return errors.As(err, &sequence)
+}
+
+// sequences tracks the sequence number expected next from the device in each session of a
+// connection.  Reads and replies of a connection may come from different goroutines, eg a handler
+// that replies after its timeout, so it is locked.
+type sequences struct {
+	sync.Mutex
+	next map[SessionID]SequenceNumber
+}
+
+// check returns *ErrSequence if the request p does not have the sequence number expected next in
+// its session, and terminates the session.  Otherwise the next request of the session is expected
+// to follow p, until a reply is written.
+func (s *sequences) check(p *Packet) error {
+	if s == nil {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	id, seq := p.Header.SessionID, p.Header.SeqNo
+	next, known := s.next[id]
+	var reason string
+	switch {
+	case seq%2 == 0:
+		reason = "even"
+	case seq == 255:
+		reason = "wrap"
+	case !known && seq != 1:
+		reason = "first"
+	case known && seq != next:
+		reason = "order"
+	}
+	if reason != "" {
+		delete(s.next, id)
+		return &ErrSequence{SessionID: id, SeqNo: seq, Reason: reason}
+	}
+	if s.next == nil {
+		s.next = make(map[SessionID]SequenceNumber)
+	}
+	s.next[id] = seq + 2
+	return nil
+}
+
+// replied records the reply p.  The device answers a reply that continues its session with the
+// next sequence number, and starts over at 1 after one that ends or restarts it.
+func (s *sequences) replied(p *Packet) {
+	if s == nil || p == nil || p.Header == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	if _, known := s.next[p.Header.SessionID]; !known {
+		return
+	}
+	if !continues(p) {
+		delete(s.next, p.Header.SessionID)
+		return
+	}
+	s.next[p.Header.SessionID] = p.Header.SeqNo + 1
+}
+
+// forget drops the session id, which ended whether or not it was replied to, so the device may
+// start it over at 1
+func (s *sequences) forget(id SessionID) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	delete(s.next, id)
+}
+
+// continues reports if the clear text reply p awaits another request of its session
+func continues(p *Packet) bool {
+	if p.Header.Type != Authenticate || len(p.Body) == 0 {
+		return false
+	}
+	switch AuthenStatus(p.Body[0]) {
+	case AuthenStatusGetData, AuthenStatusGetUser, AuthenStatusGetPass:
+		return true
+	}
+	return false
+}
+
+// checkSequence checks the sequence number of p, a request read by a server, and answers one that
+// breaks it with an error reply if the packet type and sequence number allow one
+func (c *crypter) checkSequence(p *Packet) error {
+	if c.role != roleServer {
+		return nil
+	}
+	err := c.sequences.check(p)
+	if err == nil {
+		return nil
+	}
+	seqErr := err.(*ErrSequence)
+	crypterSeqError.WithLabelValues(seqErr.Reason).Inc()
+	switch p.Header.Type {
+	case Authenticate, Authorize, Accounting:
+	default:
+		return err
+	}
+	if seqErr.Reason == "even" || seqErr.Reason == "wrap" {
+		// there is no sequence number to reply with
+		return err
+	}
+	b, merr := errorReply(p.Header.Type, "sequence number out of order").MarshalBinary()
+	if merr != nil {
+		crypterMarshalError.Inc()
+		return err
+	}
+	h := *p.Header
+	h.SeqNo++
+	r := &response{crypter: c, header: *p.Header}
+	if _, werr := r.write(NewPacket(SetPacketHeader(&h), SetPacketBody(b)), originServer); werr != nil {
+		return fmt.Errorf("%v; unable to write the reply: %w", err, werr)
+	}
+	return err
+}
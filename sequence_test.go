@@ -0,0 +1,242 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sequenceTestPacket returns a packet of type t in session id with seq, whose body is a single
+// status byte for replies
+func sequenceTestPacket(t HeaderType, id SessionID, seq SequenceNumber, body ...byte) *Packet {
+	return NewPacket(SetPacketHeader(&Header{Type: t, SessionID: id, SeqNo: seq}), SetPacketBody(body))
+}
+
+func TestSequences(t *testing.T) {
+	getPass := []byte{byte(AuthenStatusGetPass)}
+	restart := []byte{byte(AuthenStatusRestart)}
+	pass := []byte{byte(AuthenStatusPass)}
+	tests := []struct {
+		name string
+		// packets alternate requests read and replies written, from a request
+		packets []*Packet
+		// reason is that of the error of the last request, none if empty
+		reason string
+	}{
+		{name: "start", packets: []*Packet{sequenceTestPacket(Authenticate, 1, 1)}},
+		{name: "start mid exchange", packets: []*Packet{sequenceTestPacket(Authorize, 1, 7)}, reason: "first"},
+		{name: "even", packets: []*Packet{sequenceTestPacket(Authorize, 1, 2)}, reason: "even"},
+		{
+			name: "continue",
+			packets: []*Packet{
+				sequenceTestPacket(Authenticate, 1, 1), sequenceTestPacket(Authenticate, 1, 2, getPass...),
+				sequenceTestPacket(Authenticate, 1, 3),
+			},
+		},
+		{
+			name: "continue repeated",
+			packets: []*Packet{
+				sequenceTestPacket(Authenticate, 1, 1), sequenceTestPacket(Authenticate, 1, 2, getPass...),
+				sequenceTestPacket(Authenticate, 1, 3), sequenceTestPacket(Authenticate, 1, 4, getPass...),
+				sequenceTestPacket(Authenticate, 1, 3),
+			},
+			reason: "order",
+		},
+		{
+			name: "restarted",
+			packets: []*Packet{
+				sequenceTestPacket(Authenticate, 1, 1), sequenceTestPacket(Authenticate, 1, 2, restart...),
+				sequenceTestPacket(Authenticate, 1, 1),
+			},
+		},
+		{
+			name: "reused after the session ended",
+			packets: []*Packet{
+				sequenceTestPacket(Authenticate, 1, 1), sequenceTestPacket(Authenticate, 1, 2, pass...),
+				sequenceTestPacket(Authenticate, 1, 3),
+			},
+			reason: "first",
+		},
+		{
+			name: "interleaved",
+			packets: []*Packet{
+				sequenceTestPacket(Authenticate, 1, 1), sequenceTestPacket(Authenticate, 1, 2, getPass...),
+				sequenceTestPacket(Authenticate, 2, 1), sequenceTestPacket(Authenticate, 2, 2, getPass...),
+				sequenceTestPacket(Authenticate, 1, 3),
+			},
+		},
+		{name: "wrap", packets: []*Packet{sequenceTestPacket(Authenticate, 1, 255)}, reason: "wrap"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &sequences{}
+			var err error
+			for i, p := range test.packets {
+				if i%2 == 1 {
+					s.replied(p)
+					continue
+				}
+				err = s.check(p)
+				if i < len(test.packets)-1 {
+					require.NoError(t, err)
+				}
+			}
+			if test.reason == "" {
+				assert.NoError(t, err)
+				return
+			}
+			var seqErr *ErrSequence
+			if assert.ErrorAs(t, err, &seqErr) {
+				assert.Equal(t, test.reason, seqErr.Reason)
+			}
+		})
+	}
+}
+
+func TestSequencesLongSession(t *testing.T) {
+	// a session whose next request would need seq 255 is terminated, as its reply would wrap
+	s := &sequences{}
+	getData := byte(AuthenStatusGetData)
+	for seq := SequenceNumber(1); seq < 255; seq += 2 {
+		require.NoError(t, s.check(sequenceTestPacket(Authenticate, 1, seq)), "seq %v", seq)
+		s.replied(sequenceTestPacket(Authenticate, 1, seq+1, getData))
+	}
+	var seqErr *ErrSequence
+	require.ErrorAs(t, s.check(sequenceTestPacket(Authenticate, 1, 255)), &seqErr)
+	assert.Equal(t, "wrap", seqErr.Reason)
+}
+
+func TestSequencesForgotten(t *testing.T) {
+	// a session that completes without a reply is forgotten with it, so its id may start over at 1
+	s := newSessionProvider(false)
+	defer s.close()
+	s.sequences = &sequences{}
+	for _, id := range []SessionID{1, 2} {
+		h := sessionHeader(id, 1, SingleConnect)
+		require.NoError(t, s.sequences.check(&Packet{Header: &h}))
+		_, err := s.get(h)
+		require.NoError(t, err)
+		s.set(h, nil)
+		s.complete(id)
+	}
+	assert.Empty(t, s.sequences.next)
+	h := sessionHeader(1, 1, SingleConnect)
+	assert.NoError(t, s.sequences.check(&Packet{Header: &h}))
+	_, err := s.get(h)
+	assert.NoError(t, err)
+}
+
+// sequenceTestConn is a client connection to the server of newSequenceTestConn
+type sequenceTestConn struct {
+	*crypter
+	handled int32
+	// done is closed once the server closed the connection
+	done chan struct{}
+}
+
+// newSequenceTestConn returns a client connection to a server with opts that passes every session
+// after asking for a password
+func newSequenceTestConn(t *testing.T, opts ...Option) *sequenceTestConn {
+	c := &sequenceTestConn{done: make(chan struct{})}
+	h := HandlerFunc(func(response Response, request Request) {
+		atomic.AddInt32(&c.handled, 1)
+		response.Next(HandlerFunc(func(response Response, request Request) {
+			atomic.AddInt32(&c.handled, 1)
+			response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusPass)))
+		}))
+		response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusGetPass)))
+	})
+	client, server := net.Pipe()
+	go func() {
+		NewServer(nopLogger{}, nil, opts...).handle(context.Background(), newCrypter(roleServer, []byte("fooman"), server, false), h)
+		close(c.done)
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-c.done
+	})
+	require.NoError(t, client.SetDeadline(time.Now().Add(5*time.Second)))
+	c.crypter = newCrypter(roleClient, []byte("fooman"), client, false)
+	return c
+}
+
+// send sends an authentication packet of session id with seq, a start if seq is 1, and returns
+// the reply
+func (c *sequenceTestConn) send(t *testing.T, id SessionID, seq SequenceNumber) (*Packet, AuthenReply) {
+	p := featureTestStart(id, SingleConnect, MinorVersionDefault, AuthenTypeASCII)
+	if seq != 1 {
+		p = NewPacket(
+			SetPacketHeader(NewHeader(SetHeaderType(Authenticate), SetHeaderSeqNo(int(seq)), SetHeaderSessionID(id), SetHeaderFlag(SingleConnect),
+				SetHeaderVersion(Version{MajorVersion: MajorVersion, MinorVersion: MinorVersionDefault}))),
+			SetPacketBodyUnsafe(NewAuthenContinue(SetAuthenContinueUserMessage("password"))),
+		)
+	}
+	_, err := c.write(p)
+	require.NoError(t, err)
+	resp, err := c.read()
+	require.NoError(t, err)
+	var reply AuthenReply
+	require.NoError(t, Unmarshal(resp.Body, &reply))
+	return resp, reply
+}
+
+// closed waits for the server to close c
+func (c *sequenceTestConn) closed(t *testing.T) {
+	select {
+	case <-c.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not closed")
+	}
+}
+
+func TestSequenceServed(t *testing.T) {
+	first := metricValue(crypterSeqError.WithLabelValues("first"))
+	order := metricValue(crypterSeqError.WithLabelValues("order"))
+
+	// a session that starts mid exchange is answered with an error, without its handler
+	c := newSequenceTestConn(t)
+	resp, reply := c.send(t, 1, 3)
+	assert.Equal(t, SequenceNumber(4), resp.Header.SeqNo)
+	assert.Equal(t, AuthenStatusError, reply.Status)
+	assert.Equal(t, AuthenServerMsg("sequence number out of order"), reply.ServerMsg)
+	c.closed(t)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&c.handled))
+	assert.Equal(t, first+1, metricValue(crypterSeqError.WithLabelValues("first")))
+
+	// as is one that skips a sequence number
+	c = newSequenceTestConn(t)
+	_, reply = c.send(t, 1, 1)
+	assert.Equal(t, AuthenStatusGetPass, reply.Status)
+	resp, reply = c.send(t, 1, 5)
+	assert.Equal(t, SequenceNumber(6), resp.Header.SeqNo)
+	assert.Equal(t, AuthenStatusError, reply.Status)
+	c.closed(t)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&c.handled))
+	assert.Equal(t, order+1, metricValue(crypterSeqError.WithLabelValues("order")))
+}
+
+func TestSequenceInterleaved(t *testing.T) {
+	// sessions of a single-connect connection are checked each on their own
+	c := newSequenceTestConn(t)
+	_, reply := c.send(t, 1, 1)
+	assert.Equal(t, AuthenStatusGetPass, reply.Status)
+	_, reply = c.send(t, 2, 1)
+	assert.Equal(t, AuthenStatusGetPass, reply.Status)
+	_, reply = c.send(t, 1, 3)
+	assert.Equal(t, AuthenStatusPass, reply.Status)
+	_, reply = c.send(t, 2, 3)
+	assert.Equal(t, AuthenStatusPass, reply.Status)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&c.handled))
+}
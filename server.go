@@ -10,11 +10,11 @@ package tacquito
 import (
 	"context"
 	"errors"
-	"github.com/google/uuid"
-	"github.com/prometheus/client_golang/prometheus"
-	"io"
+	"math/rand"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -30,12 +30,141 @@ func SetUseProxy(v bool) Option {
 	}
 }
 
+// SetIdleTimeout sets how long a connection may sit idle between packets before it is closed.
+// This includes the time a connection without single-connect spends awaiting a new session after
+// one completes.  The default is 15 seconds.
+func SetIdleTimeout(v time.Duration) Option {
+	return func(s *Server) {
+		s.idleTimeout = v
+	}
+}
+
+// SetSingleConnectIdleTimeout sets how long a connection that negotiated single-connect may sit
+// with no session in flight before it is closed.  Devices such as IOS-XR and Junos keep these
+// connections open to multiplex their sessions, so it is longer than the idle timeout, which still
+// applies between the packets of a session.  The default is 15 minutes.
+func SetSingleConnectIdleTimeout(v time.Duration) Option {
+	return func(s *Server) {
+		s.singleConnectIdleTimeout = v
+	}
+}
+
+// SetHandlerTimeout sets a deadline on the context of every Request.  Handlers that call slow
+// backends should observe request.Context and reply with an error when it expires.  If a handler
+// returns after the deadline without replying, the server replies with an error on its behalf.
+// A value of zero, the default, disables the deadline.
+func SetHandlerTimeout(v time.Duration) Option {
+	return func(s *Server) {
+		s.handlerTimeout = v
+	}
+}
+
+// SetTimeoutJitter lengthens the idle and handler timeouts by a random fraction of up to v, eg 0.2
+// for up to 20% longer, drawn anew each time a timeout is applied.  After a restart every device
+// reconnects at once, and without jitter their idle timeouts would then all fire together too.
+// A value of zero, the default, disables jitter.
+func SetTimeoutJitter(v float64) Option {
+	return func(s *Server) {
+		s.timeoutJitter = v
+	}
+}
+
+// SetConformanceCheck wraps the handler of every connection in a ConformanceChecker, which logs
+// protocol violations by either side.  It is a diagnostic mode and is off by default.
+func SetConformanceCheck(v bool) Option {
+	return func(s *Server) {
+		s.conformance = v
+	}
+}
+
+// SetTracer traces the sessions that match the filters of t, see Tracer
+func SetTracer(t *Tracer) Option {
+	return func(s *Server) {
+		s.tracer = t
+	}
+}
+
+// SetEmptyBodyPolicy sets how packets of type t with a zero length body are handled.  By default
+// accounting packets are ignored, as some devices send them as keepalives, and authenticate and
+// authorize packets are rejected.
+func SetEmptyBodyPolicy(t HeaderType, v EmptyBodyPolicy) Option {
+	return func(s *Server) {
+		s.emptyBody[t] = v
+	}
+}
+
+// SetBodyLengthCheck rejects requests whose decoded body fields add up to a different length than
+// Header.Length, closing the connection.  Each body type ignores bytes after its last field, so
+// this catches corruption, or a wrong secret, that per field validation lets through.  It is off
+// by default, as some devices pad their bodies.  Rejections are counted in
+// tacquito_crypter_body_length_mismatch.
+func SetBodyLengthCheck(v bool) Option {
+	return func(s *Server) {
+		s.bodyLengthCheck = v
+	}
+}
+
+// SetReplyCheck rejects replies whose body does not decode as the reply of their packet type, eg an
+// AuthenReply too short to hold its status, before they are written.  Write and Reply return
+// ErrInvalidReply to the handler, so handler bugs surface as errors rather than as replies the
+// device cannot parse.  Replies with an empty body are always rejected, with ErrEmptyBody.
+// Rejections are counted in tacquito_crypter_invalid_reply.
+func SetReplyCheck(v bool) Option {
+	return func(s *Server) {
+		s.replyCheck = v
+	}
+}
+
+// SetBodyOwnershipCheck checksums the body of every request before and after its handler runs,
+// and logs handlers that modified it, counted in tacquito_request_body_modified.  The body is
+// owned by the server, see Handler.  It is a debug mode and is off by default, as it hashes every
+// body twice.
+func SetBodyOwnershipCheck(v bool) Option {
+	return func(s *Server) {
+		s.bodyOwnershipCheck = v
+	}
+}
+
+// SetOnClose sets a func that is called with the reason for every connection the server closes,
+// including connections from unknown devices that are closed before any packet is read.
+func SetOnClose(fn CloseFunc) Option {
+	return func(s *Server) {
+		s.onClose = fn
+	}
+}
+
+// SetImplicitSessionReuse sets whether a connection without single-connect may carry a new session
+// after its first session completes, for handlers that leave it to the server, see
+// SessionReusePolicy.  Such sessions are counted in tacquito_sessions_reuse_implicit.  The default
+// is false, per rfc8907, and those connections are closed instead.
+func SetImplicitSessionReuse(v bool) Option {
+	return func(s *Server) {
+		s.implicitReuse = v
+	}
+}
+
 // NewServer returns a new server.
 // loggerProvider - the logging backend to use
 // listener - net.Listener
 // sp SecretProvider - enables server to translate net.conn.remaddr into associated config for that device
 func NewServer(l loggerProvider, sp SecretProvider, opts ...Option) *Server {
-	s := &Server{loggerProvider: l, SecretProvider: sp}
+	s := &Server{
+		loggerProvider:           l,
+		SecretProvider:           sp,
+		idleTimeout:              15 * time.Second,
+		singleConnectIdleTimeout: 15 * time.Minute,
+		rotationPace:             10,
+		connectBudget:            defaultConnectBudget,
+		clock:                    time.Now,
+		started:                  time.Now(),
+		store:                    NewMemoryStore(),
+		interactiveFailure:       StoreFailOpen,
+		emptyBody: map[HeaderType]EmptyBodyPolicy{
+			Authenticate: EmptyBodyReject,
+			Authorize:    EmptyBodyReject,
+			Accounting:   EmptyBodyIgnore,
+		},
+	}
 	for _, opt := range opts {
 		opt(s)
 	}
@@ -44,12 +173,101 @@ func NewServer(l loggerProvider, sp SecretProvider, opts ...Option) *Server {
 
 // Server  ...
 type Server struct {
+	// sessions is the number of sessions in flight over all connections.  It is first so it is
+	// 64-bit aligned for atomic access on 32-bit platforms.
+	sessions int64
+
 	loggerProvider
 	waitGroup
 	SecretProvider
 
 	// enables ha-proxy ascii proxy header support
 	proxy bool
+	// idleTimeout is the read deadline applied before every packet on a connection
+	idleTimeout time.Duration
+	// singleConnectIdleTimeout replaces idleTimeout on a single-connect connection with no session
+	// in flight
+	singleConnectIdleTimeout time.Duration
+	// handlerTimeout is the deadline applied to the context of every request
+	handlerTimeout time.Duration
+	// timeoutJitter is the largest fraction the timeouts are lengthened by
+	timeoutJitter float64
+	// emptyBody is the policy for zero length bodies by packet type
+	emptyBody map[HeaderType]EmptyBodyPolicy
+	// conformance wraps connection handlers in a ConformanceChecker
+	conformance bool
+	// bodyLengthCheck rejects requests whose decoded body length disagrees with the header
+	bodyLengthCheck bool
+	// replyCheck rejects replies that do not decode before they are written
+	replyCheck bool
+	// bodyOwnershipCheck logs handlers that modify the body of their request
+	bodyOwnershipCheck bool
+	// badSecretDetector replaces the default detection of bad secrets, see SetBadSecretDetector
+	badSecretDetector BadSecretDetector
+	// rejectUnencrypted answers requests sent with UnencryptedFlag with an error and closes their
+	// connection, see SetRejectUnencrypted
+	rejectUnencrypted bool
+	// padCacheEntries is the size of the pad cache of each connection, see SetPadCache
+	padCacheEntries int
+	// packetTransport, if set, returns the PacketTransport of each tls connection, see
+	// SetPacketTransport
+	packetTransport func(conn net.Conn, secret []byte) PacketTransport
+	// tracer traces selected sessions
+	tracer *Tracer
+	// lengthQuirkSeen holds the devices that were logged for a length quirk
+	lengthQuirkSeen sync.Map
+	// implicitReuse is the session reuse policy of handlers without a SessionReusePolicy
+	implicitReuse bool
+	// onClose is called for every closed connection
+	onClose CloseFunc
+	// clock is the wall clock requests are stamped with
+	clock func() time.Time
+	// deadline, if set, replaces time.Now().Add of the idle read deadlines, see setTestHooks
+	deadline func(d time.Duration) time.Time
+	// started is when the server was created, on the monotonic clock
+	started time.Time
+	// padHook, if set, replaces every pad of the connections of the server before it is applied.
+	// It is nil outside of tests, which use it to break invariantPadLength.
+	padHook func(pad []byte) []byte
+	// shutdownBudget is how long shutdown may take, zero is unbounded
+	shutdownBudget time.Duration
+	// shutdownSinks are flushed on shutdown, in order
+	shutdownSinks []namedSink
+	// spool keeps the records shutdownSinks could not flush
+	spool Spool
+	// shutdownState is the progress of shutdown
+	shutdownState shutdownState
+	// maintenance fails new authentications while it is on
+	maintenance maintenance
+	// maxLifetime is how long a connection may serve new sessions, zero is unlimited
+	maxLifetime time.Duration
+	// metricsIdentity reports users in metric labels, see SetMetricsIdentity
+	metricsIdentity IdentityObfuscator
+	// packetSink receives every packet read or written, see SetPacketSink
+	packetSink PacketSink
+	// secretGrace is how long a connection may keep a removed secret, see SetSecretGracePeriod
+	secretGrace time.Duration
+	// rotationPace is how many connections per second RetireGroup retires
+	rotationPace int
+	// retirement holds the connections by device group for RetireGroup
+	retirement retirement
+	// recentCloses counts close reasons for Status
+	recentCloses closeWindow
+	// warmDevices have their secrets warmed before serving, within warmBudget, see SetSecretWarmup
+	warmDevices []net.Addr
+	warmBudget  time.Duration
+	// features records the protocol features devices use, see SetFeatureTracker
+	features *FeatureTracker
+	// maxInteractive is the default quota of interactive sessions per device, zero is unlimited
+	maxInteractive int
+	// interactiveFailure is what the interactive session quota does when store fails
+	interactiveFailure StoreFailure
+	// store holds the state shared by every instance of the server, see SetStore
+	store Store
+	// onConnect decide if a connection is served, within connectBudget, see SetOnConnect
+	onConnect      []namedConnectFunc
+	connectBudget  time.Duration
+	connectFailure ConnDecision
 }
 
 // DeadlineListener is a net.Listener that supports Deadlines
@@ -58,17 +276,31 @@ type DeadlineListener interface {
 	SetDeadline(t time.Time) error
 }
 
-// Serve is a blocking method that serves clients
+// Serve is a blocking method that serves clients.  An *OptionError is returned if the server
+// was given invalid options.
 func (s *Server) Serve(ctx context.Context, listener DeadlineListener) error {
-	defer func() {
-		s.Infof(ctx, "Stopping server listener for %v...", listener.Addr().String())
-		err := listener.Close()
-		if err != nil {
-			s.Errorf(ctx, "%s", err)
+	if err := s.validate(); err != nil {
+		listener.Close()
+		return err
+	}
+	defer s.shutdown(ctx, listener)
+
+	// a blocked Accept would otherwise hold up shutdown until the listener deadline passes, and a
+	// blocked read until the idle timeout of its connection
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			listener.Close()
+			s.retirement.stop()
+		case <-stopped:
 		}
-		s.Infof(ctx, "waiting for [%v] connections to close prior to shutdown", s.active)
-		s.Wait()
 	}()
+	s.warm(ctx)
+	s.watchRotations(ctx)
+	// the connections of ctx report the listener they arrived on, see Transport
+	listenerCtx := context.WithValue(ctx, contextListener, listener.Addr().String())
 
 	for {
 		select {
@@ -100,22 +332,44 @@ func (s *Server) Serve(ctx context.Context, listener DeadlineListener) error {
 				continue
 
 			}
-			timer := prometheus.NewTimer(prometheus.ObserverFunc(func(v float64) {
-				ms := v * 1000 // make milliseconds
-				connectionDuration.Observe(ms)
-			}))
-			WithReqIDCtx := context.WithValue(ctx, ContextReqID, uuid.New().String())
+			timer := newTimer(connectionDuration)
+			WithReqIDCtx := context.WithValue(listenerCtx, ContextReqID, newRequestID())
+			if s.proxy {
+				// the source of a proxied connection is only known after reading the proxy header,
+				// which must not block the accept loop
+				s.Add(1)
+				go func() {
+					s.handleProxy(listenerCtx, WithReqIDCtx, conn)
+					s.Done()
+					timer.ObserveDuration()
+				}()
+				continue
+			}
+			if hc, ok := conn.(*tlsHostConn); ok {
+				// the virtual host, and so the secret provider, of the connection is only known
+				// after its handshake, which must not block the accept loop
+				s.Add(1)
+				go func() {
+					s.handleTLSHost(listenerCtx, WithReqIDCtx, hc)
+					s.Done()
+					timer.ObserveDuration()
+				}()
+				continue
+			}
 			secret, handler, err := s.Get(WithReqIDCtx, conn.RemoteAddr())
 			if err != nil || secret == nil || handler == nil {
-				s.Errorf(ctx, "ignoring request: %v", err)
-				conn.Close()
+				serveUnknownDevice.Inc()
+				s.Errorf(ctx, "ignoring request from unknown device [%v]: %v", conn.RemoteAddr(), err)
+				s.closeConn(ctx, conn, conn.RemoteAddr(), CloseUnknownDevice)
 				timer.ObserveDuration()
 				continue
 			}
 			serveAccepted.Inc()
 			s.Add(1)
 			go func() {
-				s.handle(ctx, newCrypter(secret, conn, s.proxy), handler)
+				c := s.newServerCrypter(conn, s.proxy)
+				c.secret = secret
+				s.handle(listenerCtx, c, handler)
 				s.Done()
 				serveAccepted.Dec()
 				timer.ObserveDuration()
@@ -124,62 +378,429 @@ func (s *Server) Serve(ctx context.Context, listener DeadlineListener) error {
 	}
 }
 
+// newServerCrypter returns the crypter of a connection accepted by s, with the checks of s.  Its
+// secret is set once the device, and so its SecretProvider, is known.
+func (s *Server) newServerCrypter(conn net.Conn, proxy bool) *crypter {
+	c := newCrypter(roleServer, nil, conn, proxy)
+	c.emptyBody = s.emptyBody
+	c.bodyLengthCheck = s.bodyLengthCheck
+	c.replyCheck = s.replyCheck
+	c.badSecretDetector = s.badSecretDetector
+	c.rejectUnencrypted = s.rejectUnencrypted
+	c.pads = newPadCache(s.padCacheEntries)
+	return c
+}
+
+// jitter returns d lengthened by a random fraction of up to timeoutJitter
+func (s *Server) jitter(d time.Duration) time.Duration {
+	if s.timeoutJitter <= 0 || d <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Float64()*s.timeoutJitter*float64(d))
+}
+
+// handleProxy selects the secret for a proxied connection using the source in its proxy header.
+// Connections from sources without a secret are closed before any packet is decrypted, so an
+// unknown device does not look like a client with a bad secret.
+func (s *Server) handleProxy(ctx, reqIDCtx context.Context, conn net.Conn) {
+	c := s.newServerCrypter(conn, true)
+	if err := c.SetReadDeadline(s.idleDeadline(s.idleTimeout)); err != nil {
+		s.Errorf(ctx, "unable to set read deadline on connection %v", conn.RemoteAddr().String())
+	}
+	source, err := c.readProxySource()
+	if err != nil {
+		reason := readCloseReason(err)
+		if reason != CloseClientEOF && reason != CloseIdleTimeout {
+			reason = CloseProxyError
+			s.Errorf(ctx, "closing connection from proxy [%v]; reason [%v]; %v", conn.RemoteAddr(), reason, err)
+		}
+		s.closeConn(ctx, conn, conn.RemoteAddr(), reason)
+		return
+	}
+	secret, handler, err := s.Get(reqIDCtx, source)
+	if err != nil || secret == nil || handler == nil {
+		serveUnknownDevice.Inc()
+		s.Errorf(ctx, "closing connection from unknown device [%v] via proxy [%v]: %v", source, conn.RemoteAddr(), err)
+		s.closeConn(ctx, conn, source, CloseUnknownDevice)
+		return
+	}
+	c.secret = secret
+	serveAccepted.Inc()
+	s.handle(ctx, c, handler)
+	serveAccepted.Dec()
+}
+
+// closeConn closes conn, reporting the reason to the logs, metrics and onClose.  remote is the
+// device, which differs from conn.RemoteAddr for proxied connections.
+func (s *Server) closeConn(ctx context.Context, conn net.Conn, remote net.Addr, reason CloseReason) {
+	conn.Close()
+	connectionClosed.WithLabelValues(string(reason)).Inc()
+	if reason != CloseClientEOF {
+		s.recentCloses.add(s.clock(), reason)
+	}
+	s.Debugf(ctx, "closed connection to %v; reason [%v]", remote, reason)
+	if s.onClose != nil {
+		s.onClose(ctx, remote, reason)
+	}
+}
+
 // handle will process connections on a net.Conn. This is meant to be executed in a goroutine
 func (s *Server) handle(ctx context.Context, c *crypter, h Handler) {
-	// defer closing the connection on return.
-	defer c.Close()
+	c.sink, c.clock = s.packetSink, s.clock
+	c.useTransport(s.packetTransport)
+	// every return sets the reason before the connection is closed
+	var reason CloseReason
+	remote := c.RemoteAddr()
+	if c.source != nil {
+		remote = c.source
+	}
+	defer func() {
+		s.closeConn(ctx, c.Conn, remote, reason)
+	}()
+	group := deviceGroup(h)
+	transport := newConnTransport(ctx, c)
+	admission := s.admit(ctx, ConnInfo{Remote: remote, DeviceGroup: group, Transport: transport.Transport})
+	if admission == ConnReject {
+		reason = CloseRejected
+		return
+	}
+	features := s.newConnFeatures(c, h)
+	retire := s.retirement.register(c.Conn, group)
+	defer s.retirement.unregister(retire)
 	// scoped to the entire undelrying net.Conn.  this is needed for single-connect
-	sessionProvider := newSessionProvider()
+	implicitReuse := s.implicitReuse
+	if p, ok := h.(SessionReusePolicy); ok {
+		if v, ok := p.ImplicitSessionReuse(); ok {
+			implicitReuse = v
+		}
+	}
+	if p, ok := h.(LengthQuirkPolicy); ok {
+		if delta, budget := p.LengthDelta(); delta != 0 {
+			device := c.device()
+			c.lengthQuirk = &lengthQuirk{delta: delta, budget: budget, applied: func(declared, actual int) {
+				features.record(FeatureLengthQuirk)
+				if _, seen := s.lengthQuirkSeen.LoadOrStore(device, struct{}{}); !seen {
+					s.Infof(ctx, "device [%v] declared a length of [%v] for a body of [%v] bytes; applying length delta [%v]", device, declared, actual, delta)
+				}
+			}}
+		}
+	}
+	profile := DefaultMessageProfile
+	if p, ok := h.(MessageProfilePolicy); ok {
+		profile = p.MessageProfile()
+	}
+	normalization := DefaultStringNormalization
+	if p, ok := h.(StringNormalizationPolicy); ok {
+		normalization = p.StringNormalization()
+	}
+	lifetime := s.newConnLifetime(h)
+	interactive := s.newConnInteractive(ctx, c, h)
+	grace := s.newConnSecret(c)
+	c.cutover = s.newSecretCutover(ctx, c, grace.remote, group)
+	// after the policy checks above, like the wrappers below
+	h = s.maintenanceWrap(h)
+	if s.conformance {
+		// after the policy checks above, the checker does not forward them
+		h = NewConformanceChecker(s.loggerProvider, h)
+	}
+	if s.tracer != nil {
+		h = s.tracer.Wrap(h)
+	}
+	// the requests of the connection are served one at a time, so they share a tally that is
+	// committed as each is answered, rather than applying every metric as it is observed
+	tally := &requestTally{log: s.loggerProvider, padHook: s.padHook}
+	c.tally = tally
+	defer tally.commit()
+	sessionProvider := newSessionProvider(implicitReuse)
+	sessionProvider.active = &s.sessions
+	sessionProvider.implicitReused = func() { features.record(FeatureImplicitReuse) }
+	sessionProvider.tally = tally
+	sessionProvider.sequences = c.sequences
+	sessionProvider.cutover = c.cutover
 	defer sessionProvider.close()
+	defer func() { checkDrained(ctx, s.loggerProvider, reason, sessionProvider.inFlight()) }()
+	var committed committedArgs
+	defer func() { committed.check(ctx, s.loggerProvider) }()
+	// users holds the user of each session on the connection, for metrics labeled by user
+	users := map[SessionID]string{}
+	// arm sets the read deadline of the next packet, reporting if the connection was retired
+	arm := func() (bool, error) {
+		idle := s.idleTimeout
+		if sessionProvider.awaiting() {
+			// a single-connect connection is kept open for the next session of the device
+			idle = s.singleConnectIdleTimeout
+		}
+		deadline := grace.deadline(lifetime.deadline(s.idleDeadline(idle), sessionProvider.inFlight()))
+		return retire.arm(deadline, sessionProvider.inFlight())
+	}
+	// the deadline is re-armed after a header only packet the device sends as a keepalive, as after
+	// any other packet, and read fails once it skipped maxEmptySkipped of them in a row.  A retired
+	// connection with nothing in flight is woken at once.
+	c.rearm = func() error {
+		retired, err := arm()
+		if retired && sessionProvider.inFlight() == 0 {
+			return c.SetReadDeadline(time.Now())
+		}
+		return err
+	}
 	for {
 		select {
 		case <-ctx.Done():
 			s.Debugf(ctx, "context cancellation received, closing connection to %v", c.RemoteAddr())
+			reason = CloseShutdown
 			return
 		default:
-			if err := c.SetReadDeadline(time.Now().Add(15 * time.Second)); err != nil {
+			if lifetime.closing(sessionProvider.inFlight()) {
+				reason = CloseLifetime
+				return
+			}
+			if grace.revoked() && sessionProvider.inFlight() == 0 {
+				reason = CloseSecretRevoked
+				return
+			}
+			retired, err := arm()
+			if err != nil {
 				s.Errorf(ctx, "unable to set read deadline on connection %v", c.RemoteAddr().String())
 			}
+			if retired && sessionProvider.inFlight() == 0 {
+				reason = CloseSecretRotated
+				return
+			}
+			// the reply to the previous request is committed before the next is awaited
+			tally.commit()
 			packet, err := c.read()
 			if err != nil {
-				if err != io.EOF {
-					s.Errorf(ctx, "closing connection, unable to read, %v", err)
+				reason = readCloseReason(err)
+				if ctx.Err() != nil {
+					// woken by the server stopping
+					s.Debugf(ctx, "context cancellation received, closing connection to %v", c.RemoteAddr())
+					reason = CloseShutdown
+					return
+				}
+				if reason == CloseIdleTimeout && lifetime.closing(sessionProvider.inFlight()) {
+					reason = CloseLifetime
+					return
+				}
+				if reason == CloseIdleTimeout && retire.isRetired() && sessionProvider.inFlight() == 0 {
+					// woken by its retirement
+					reason = CloseSecretRotated
+					return
+				}
+				if reason == CloseIdleTimeout && grace.expired() {
+					s.Errorf(ctx, "closing connection from [%v], the grace period of its removed secret passed with [%v] sessions in flight", c.RemoteAddr(), sessionProvider.inFlight())
+					reason = CloseSecretRevoked
+					return
+				}
+				if reason != CloseClientEOF {
+					s.Errorf(ctx, "closing connection, unable to read; reason [%v]; %v", reason, err)
 				}
 				return
 			}
+			features.packet(packet)
+			grace.check(ctx)
+			if grace.expired() {
+				s.Errorf(ctx, "closing connection from [%v], the grace period of its removed secret passed with [%v] sessions in flight", c.RemoteAddr(), sessionProvider.inFlight())
+				reason = CloseSecretRevoked
+				return
+			}
+			received := time.Now()
 			// sessionid will be a child to the parent context
-			remoteAddrCtx := context.WithValue(ctx, ContextConnRemoteAddr, stripPort(c.RemoteAddr().String()))
+			remoteAddrCtx := s.stamp(context.WithValue(context.WithValue(ctx, ContextConnRemoteAddr, c.device()), ContextDeviceGroup, group), received)
+			remoteAddrCtx = context.WithValue(remoteAddrCtx, ContextTransport, transport.packet(packet.Header, sessionProvider.negotiated(*packet.Header)))
+			var handlerCtx context.Context
+			var cancel context.CancelFunc
+			handlerTimeout := s.jitter(s.handlerTimeout)
+			if handlerTimeout > 0 {
+				handlerCtx, cancel = context.WithTimeout(remoteAddrCtx, handlerTimeout)
+			} else {
+				handlerCtx, cancel = context.WithCancel(remoteAddrCtx)
+			}
+			// the handler is cancelled if the device goes away before it returns
+			peer := newPeerWatch(c, cancel)
+			handlerCtx = context.WithValue(handlerCtx, contextPeer, peer)
 			// create our request
 			req := Request{
 				Header:  *packet.Header,
 				Body:    packet.Body,
-				Context: remoteAddrCtx,
+				Context: handlerCtx,
 			}
 			// create the response
-			resp := &response{ctx: req.Context, crypter: c, loggerProvider: s.loggerProvider, header: req.Header}
+			resp := &response{ctx: req.Context, crypter: c, loggerProvider: s.loggerProvider, header: req.Header, profile: profile, tally: tally, seqNo: req.Header.SeqNo, peer: peer}
+			if admission == ConnRejectWithReply {
+				// the first packet of the connection, so it starts a session
+				s.Infof(ctx, "[%v] request refused, the connection was rejected on connect", req.Header.SessionID)
+				resp.synthesize(errorReply(req.Header.Type, connectRejectedMessage))
+				cancel()
+				reason = CloseRejected
+				return
+			}
 			state, err := sessionProvider.get(req.Header)
 			if err != nil {
 				s.Errorf(ctx, "unable to obtain a session; connection will close; %v", err)
+				cancel()
+				reason = CloseSessionError
 				return
 			}
 			// default to our provided handler for new flows
+			if state == nil && grace.revoked() {
+				// the device starts a new session with a secret that was removed
+				s.Infof(ctx, "[%v] new session refused, the secret of the connection was removed", req.Header.SessionID)
+				resp.synthesize(errorReply(req.Header.Type, "secret rotated, reconnect"))
+				cancel()
+				reason = CloseSecretRevoked
+				return
+			}
+			if state == nil && retire.isRetired() {
+				// the device starts a new session on a connection retired by a secret rotation
+				serveRetiredRejected.Inc()
+				s.Infof(ctx, "[%v] new session refused, the secret of device group [%v] was rotated", req.Header.SessionID, group)
+				resp.synthesize(errorReply(req.Header.Type, "secret rotated, reconnect"))
+				cancel()
+				sessionProvider.refuse(req.Header.SessionID)
+				continue
+			}
+			if state == nil && lifetime.expired() {
+				// the device starts a new session on a connection that outlived its lifetime
+				serveLifetimeRejected.Inc()
+				lifetime.rejected = true
+				s.Infof(ctx, "[%v] new session refused, the connection outlived its lifetime", req.Header.SessionID)
+				resp.synthesize(errorReply(req.Header.Type, "connection lifetime exceeded, reconnect"))
+				cancel()
+				sessionProvider.refuse(req.Header.SessionID)
+				continue
+			}
+			if state == nil && interactive.full(req.Header) {
+				// the device already has its quota of logins parked awaiting another round
+				serveInteractiveRejected.Inc()
+				s.Infof(ctx, "[%v] new authentication refused, device [%v] is at its quota of [%v] interactive sessions", req.Header.SessionID, interactive.device, interactive.max)
+				resp.synthesize(errorReply(req.Header.Type, interactiveQuotaMessage))
+				cancel()
+				sessionProvider.refuse(req.Header.SessionID)
+				continue
+			}
 			if state == nil {
+				normalized, raw, err := normalization.apply(packet)
+				if err != nil {
+					s.Infof(ctx, "[%v] request refused; %v", req.Header.SessionID, err)
+					resp.synthesize(errorReply(req.Header.Type, err.Error()))
+					cancel()
+					sessionProvider.refuse(req.Header.SessionID)
+					continue
+				}
+				if normalized != packet {
+					// the canonical fields feed the handlers, the raw ones the audit records
+					req.Header, req.Body = *normalized.Header, normalized.Body
+					req.Context = context.WithValue(req.Context, ContextRawFields, raw)
+				}
 				state = h
 				sessionProvider.set(req.Header, nil)
+				if s.metricsIdentity != nil {
+					users[req.Header.SessionID] = requestUser(req)
+				}
+			}
+			resp.user, resp.identity = users[req.Header.SessionID], s.metricsIdentity
+			var sum uint64
+			if s.bodyOwnershipCheck {
+				sum = bodySum(req.Body)
+			}
+			peer.start()
+			handled := s.call(ctx, state, resp, req)
+			peer.stop()
+			if !handled {
+				cancel()
+				reason = CloseHandlerPanic
+				return
+			}
+			if s.bodyOwnershipCheck && bodySum(req.Body) != sum {
+				requestBodyModified.WithLabelValues(req.Header.Type.String()).Inc()
+				s.Errorf(ctx, "[%v] a handler modified the body of a %v request, which the server owns", req.Header.SessionID, req.Header.Type)
+			}
+			if errors.Is(handlerCtx.Err(), context.DeadlineExceeded) {
+				handlerTimeouts.Inc()
+				s.Errorf(ctx, "[%v] handler exceeded the timeout of %v", req.Header.SessionID, handlerTimeout)
+				if !resp.written {
+					// the client would otherwise wait for a reply that never comes
+					resp.synthesize(errorReply(req.Header.Type, "timed out"))
+					resp.next = nil
+				}
+			}
+			cancel()
+			// the connection belongs to the next request from here on
+			atomic.StoreInt32(&resp.released, 1)
+			committed.commit(ctx, s.loggerProvider, req)
+			if peer.disconnected() {
+				s.Debugf(ctx, "[%v] device [%v] disconnected while the request was handled", req.Header.SessionID, c.RemoteAddr())
+				reason = CloseClientEOF
+				return
 			}
-			handlers.Inc()
-			state.Handle(resp, req)
-			handlers.Dec()
 			if resp.next == nil {
 				s.Infof(ctx, "[%v] sessionID is complete", req.Header.SessionID)
-				sessionProvider.delete(req.Header.SessionID)
+				sessionProvider.complete(req.Header.SessionID)
+				delete(users, req.Header.SessionID)
 				continue
 			}
 			sessionProvider.update(resp.header, resp.next)
+			interactive.hold(sessionProvider, req.Header)
 		}
 	}
 }
 
+// checkDrained checks a connection the server closes for reason, with inFlight sessions.  The
+// server closes a connection for its lifetime or a rotated secret only once it is drained.
+func checkDrained(ctx context.Context, l loggerProvider, reason CloseReason, inFlight int) {
+	if inFlight == 0 || (reason != CloseLifetime && reason != CloseSecretRotated) {
+		return
+	}
+	violated(ctx, l, invariantInFlightClose, "closing a connection for [%v] with [%v] sessions in flight", reason, inFlight)
+}
+
+// call runs h, recovering from a panic so one bad request only costs its own connection.  False
+// is returned if h panicked.
+func (s *Server) call(ctx context.Context, h Handler, resp *response, req Request) (ok bool) {
+	handlers.Inc()
+	defer handlers.Dec()
+	defer func() {
+		if r := recover(); r != nil {
+			s.Errorf(ctx, "[%v] handler panic; %v", req.Header.SessionID, r)
+		}
+	}()
+	h.Handle(resp, req)
+	return true
+}
+
+// handleTLSHost selects the secret for a connection of a TLSListener with virtual hosts from the
+// SecretProvider of the host its handshake routed it to.  Connections whose handshake fails, eg
+// as no host serves them, are closed before any packet is read.
+func (s *Server) handleTLSHost(ctx, reqIDCtx context.Context, conn *tlsHostConn) {
+	provider, err := conn.handshake(ctx, s.jitter(s.idleTimeout))
+	if err != nil {
+		s.Errorf(ctx, "closing connection from [%v], tls handshake failed; %v", conn.RemoteAddr(), err)
+		s.closeConn(ctx, conn, conn.RemoteAddr(), CloseTLSHandshake)
+		return
+	}
+	c := s.newServerCrypter(conn, false)
+	c.provider = provider
+	secret, handler, err := s.providerOf(c).Get(reqIDCtx, conn.RemoteAddr())
+	if err != nil || secret == nil || handler == nil {
+		serveUnknownDevice.Inc()
+		s.Errorf(ctx, "closing connection from unknown device [%v] of tls virtual host [%v]: %v", conn.RemoteAddr(), conn.host.name, err)
+		s.closeConn(ctx, conn, conn.RemoteAddr(), CloseUnknownDevice)
+		return
+	}
+	c.secret = secret
+	serveAccepted.Inc()
+	s.handle(ctx, c, handler)
+	serveAccepted.Dec()
+}
+
+// providerOf returns the SecretProvider of the connection of c
+func (s *Server) providerOf(c *crypter) SecretProvider {
+	if c.provider != nil {
+		return c.provider
+	}
+	return s.SecretProvider
+}
+
 // stripPort removes port info from v4 or v6 ip strings
 func stripPort(ip string) string {
 	i := strings.LastIndex(ip, ":")
@@ -0,0 +1,273 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func startProxyServer(ctx context.Context, t *testing.T, sp SecretProvider) string {
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	assert.NoError(t, err)
+	s := NewServer(nopLogger{}, sp, SetUseProxy(true))
+	go s.Serve(ctx, listener.(*net.TCPListener))
+	return listener.Addr().String()
+}
+
+func TestProxyKnownSource(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	secret := []byte("fooman")
+	addr := startProxyServer(ctx, t, sourceSecretProvider{source: "192.0.2.10", secret: secret})
+
+	conn, err := net.Dial("tcp6", addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("PROXY TCP4 192.0.2.10 192.0.2.1 5000 49\r\n\x00"))
+	assert.NoError(t, err)
+
+	c := newCrypter(roleClient, secret, conn, false)
+	_, err = c.write(proxyTestPacket())
+	assert.NoError(t, err)
+	resp, err := c.read()
+	assert.NoError(t, err)
+	var body AuthenReply
+	assert.NoError(t, Unmarshal(resp.Body, &body))
+	assert.Equal(t, AuthenStatusPass, body.Status)
+	// handlers see the device, not the proxy
+	assert.Equal(t, AuthenServerMsg("192.0.2.10"), body.ServerMsg)
+}
+
+func TestProxyUnknownSource(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	secret := []byte("fooman")
+	addr := startProxyServer(ctx, t, sourceSecretProvider{source: "192.0.2.10", secret: secret})
+	unknown := metricValue(serveUnknownDevice)
+	badSecret := metricValue(crypterBadSecret)
+
+	conn, err := net.Dial("tcp6", addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("PROXY TCP4 198.51.100.7 192.0.2.1 5000 49\r\n\x00"))
+	assert.NoError(t, err)
+	c := newCrypter(roleClient, secret, conn, false)
+	c.write(proxyTestPacket())
+
+	// the server closes the connection without replying, not even with a bad secret reply
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, err := conn.Read(make([]byte, 1))
+	assert.Equal(t, 0, n)
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, unknown+1, metricValue(serveUnknownDevice))
+	assert.Equal(t, badSecret, metricValue(crypterBadSecret))
+}
+
+// readProxied writes header and p, obfuscated with secret, to a server crypter that strips proxy
+// headers, and returns the crypter and its read
+func readProxied(t *testing.T, header string, secret string, p *Packet) (*crypter, *Packet, error) {
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close(); server.Close() })
+	go func() {
+		client.Write([]byte(header))
+		newCrypter(roleClient, []byte(secret), client, false).write(p)
+		// the pipe is synchronous, replies are drained so the server does not block on them
+		io.Copy(io.Discard, client)
+	}()
+	c := newCrypter(roleServer, []byte("fooman"), server, true)
+	read, err := c.read()
+	return c, read, err
+}
+
+func TestProxyHeaderMetrics(t *testing.T) {
+	parsed := metricValue(crypterProxyHeaderParsed)
+	parseErrors := metricValue(crypterProxyHeaderError.WithLabelValues("parse"))
+
+	c, p, err := readProxied(t, "PROXY TCP4 192.0.2.10 192.0.2.1 5000 49\r\n\x00", "fooman", proxyTestPacket())
+	assert.NoError(t, err)
+	assert.NotNil(t, p)
+	assert.Equal(t, parsed+1, metricValue(crypterProxyHeaderParsed))
+	// the source of the header is recorded though no secret was selected for it
+	assert.Equal(t, "192.0.2.10", c.device())
+
+	_, _, err = readProxied(t, "PROXY TCP4 not-an-address\r\n\x00", "fooman", proxyTestPacket())
+	assert.Error(t, err)
+	assert.Equal(t, parsed+1, metricValue(crypterProxyHeaderParsed))
+	assert.Equal(t, parseErrors+1, metricValue(crypterProxyHeaderError.WithLabelValues("parse")))
+}
+
+func TestProxyBadSecretNamesSource(t *testing.T) {
+	// a bad secret is told apart from its proxy by the device that sent it
+	_, _, err := readProxied(t, "PROXY TCP4 192.0.2.10 192.0.2.1 5000 49\r\n\x00", "not-fooman", proxyTestPacket())
+	var bs *BadSecretErr
+	if assert.True(t, errors.As(err, &bs), err) {
+		assert.Contains(t, bs.Error(), "from [192.0.2.10]")
+	}
+}
+
+func TestNewServerDefaults(t *testing.T) {
+	s := NewServer(nopLogger{}, nil)
+	assert.False(t, s.proxy)
+	assert.False(t, s.conformance)
+	assert.Equal(t, 15*time.Second, s.idleTimeout)
+	assert.Equal(t, 15*time.Minute, s.singleConnectIdleTimeout)
+	assert.Equal(t, time.Duration(0), s.handlerTimeout)
+	assert.Equal(t, map[HeaderType]EmptyBodyPolicy{
+		Authenticate: EmptyBodyReject,
+		Authorize:    EmptyBodyReject,
+		Accounting:   EmptyBodyIgnore,
+	}, s.emptyBody)
+
+	// a zero ServerOptions changes nothing
+	z := NewServer(nopLogger{}, nil, SetServerOptions(ServerOptions{}))
+	assert.Equal(t, s.proxy, z.proxy)
+	assert.Equal(t, s.conformance, z.conformance)
+	assert.Equal(t, s.idleTimeout, z.idleTimeout)
+	assert.Equal(t, s.handlerTimeout, z.handlerTimeout)
+	assert.Equal(t, s.emptyBody, z.emptyBody)
+	assert.Equal(t, s.connectBudget, z.connectBudget)
+	assert.Equal(t, s.interactiveFailure, z.interactiveFailure)
+	assert.IsType(t, s.store, z.store)
+}
+
+func TestSetServerOptions(t *testing.T) {
+	failClosed := StoreFailClosed
+	tracker := NewFeatureTracker(1)
+	store := NewMemoryStore()
+	devices := []net.Addr{&net.TCPAddr{IP: net.IPv6loopback}}
+	s := NewServer(nopLogger{}, nil, SetServerOptions(ServerOptions{
+		UseProxy:                 true,
+		IdleTimeout:              time.Minute,
+		SingleConnectIdleTimeout: time.Hour,
+		HandlerTimeout:           time.Second,
+		TimeoutJitter:            0.2,
+		ConformanceCheck:         true,
+		EmptyBody:                map[HeaderType]EmptyBodyPolicy{Accounting: EmptyBodyReject},
+		BodyLengthCheck:          true,
+		ReplyCheck:               true,
+		BodyOwnershipCheck:       true,
+		ImplicitSessionReuse:     true,
+		OnConnect:                []NamedConnectFunc{{Name: "a"}, {Name: "b"}},
+		ConnectFailure:           ConnReject,
+		FeatureTracker:           tracker,
+		SecretGracePeriod:        time.Minute,
+		MaxInteractiveSessions:   2,
+		InteractiveStoreFailure:  &failClosed,
+		MaxConnectionLifetime:    time.Hour,
+		SecretRotationPace:       5,
+		ShutdownBudget:           time.Second,
+		ShutdownSinks:            []NamedShutdownSink{{Name: "a"}},
+		Store:                    store,
+		RejectUnencrypted:        true,
+		PadCache:                 4,
+		WarmDevices:              devices,
+	}))
+	assert.True(t, s.proxy)
+	assert.True(t, s.conformance)
+	assert.Equal(t, time.Minute, s.idleTimeout)
+	assert.Equal(t, time.Hour, s.singleConnectIdleTimeout)
+	assert.Equal(t, time.Second, s.handlerTimeout)
+	assert.Equal(t, 0.2, s.timeoutJitter)
+	assert.Equal(t, EmptyBodyReject, s.emptyBody[Accounting])
+	assert.Equal(t, EmptyBodyReject, s.emptyBody[Authenticate])
+	assert.True(t, s.bodyLengthCheck)
+	assert.True(t, s.replyCheck)
+	assert.True(t, s.bodyOwnershipCheck)
+	assert.True(t, s.implicitReuse)
+	if assert.Len(t, s.onConnect, 2) {
+		assert.Equal(t, "a", s.onConnect[0].name)
+		assert.Equal(t, "b", s.onConnect[1].name)
+	}
+	// the budget is kept when only the failure decision is set
+	assert.Equal(t, NewServer(nopLogger{}, nil).connectBudget, s.connectBudget)
+	assert.Equal(t, ConnReject, s.connectFailure)
+	assert.Same(t, tracker, s.features)
+	assert.Equal(t, time.Minute, s.secretGrace)
+	assert.Equal(t, 2, s.maxInteractive)
+	assert.Equal(t, StoreFailClosed, s.interactiveFailure)
+	assert.Equal(t, time.Hour, s.maxLifetime)
+	assert.Equal(t, 5, s.rotationPace)
+	assert.Equal(t, time.Second, s.shutdownBudget)
+	if assert.Len(t, s.shutdownSinks, 1) {
+		assert.Equal(t, "a", s.shutdownSinks[0].name)
+	}
+	assert.Same(t, store, s.store)
+	assert.True(t, s.rejectUnencrypted)
+	assert.Equal(t, 4, s.padCacheEntries)
+	assert.Equal(t, devices, s.warmDevices)
+}
+
+func TestTimeoutJitter(t *testing.T) {
+	s := NewServer(nopLogger{}, nil)
+	assert.Equal(t, 15*time.Second, s.jitter(15*time.Second))
+
+	s = NewServer(nopLogger{}, nil, SetTimeoutJitter(0.2))
+	assert.Equal(t, time.Duration(0), s.jitter(0), "a disabled timeout stays disabled")
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 1000; i++ {
+		d := s.jitter(15 * time.Second)
+		assert.GreaterOrEqual(t, d, 15*time.Second)
+		assert.LessOrEqual(t, d, 18*time.Second)
+		seen[d] = true
+	}
+	assert.Greater(t, len(seen), 1, "jittered timeouts should vary")
+}
+
+func TestServeInvalidOptions(t *testing.T) {
+	sp := sourceSecretProvider{source: "192.0.2.10", secret: []byte("fooman")}
+	tests := []struct {
+		name   string
+		sp     SecretProvider
+		opts   []Option
+		option string
+	}{
+		{name: "no secret provider", option: "NewServer"},
+		{name: "zero idle timeout", sp: sp, opts: []Option{SetIdleTimeout(0)}, option: "SetIdleTimeout"},
+		{name: "zero single-connect idle timeout", sp: sp, opts: []Option{SetSingleConnectIdleTimeout(0)}, option: "SetSingleConnectIdleTimeout"},
+		{name: "negative handler timeout", sp: sp, opts: []Option{SetHandlerTimeout(-time.Second)}, option: "SetHandlerTimeout"},
+		{name: "negative timeout jitter", sp: sp, opts: []Option{SetTimeoutJitter(-0.1)}, option: "SetTimeoutJitter"},
+		{name: "timeout jitter above one", sp: sp, opts: []Option{SetTimeoutJitter(1.5)}, option: "SetTimeoutJitter"},
+		{name: "unknown empty body policy", sp: sp, opts: []Option{SetEmptyBodyPolicy(Authorize, 7)}, option: "SetEmptyBodyPolicy"},
+		{name: "negative shutdown budget", sp: sp, opts: []Option{SetShutdownBudget(-time.Second)}, option: "SetShutdownBudget"},
+		{name: "negative secret warmup budget", sp: sp, opts: []Option{SetSecretWarmup(nil, -time.Second)}, option: "SetSecretWarmup"},
+		{name: "negative connection lifetime", sp: sp, opts: []Option{SetMaxConnectionLifetime(-time.Second)}, option: "SetMaxConnectionLifetime"},
+		{name: "negative interactive sessions", sp: sp, opts: []Option{SetMaxInteractiveSessions(-1)}, option: "SetMaxInteractiveSessions"},
+		{name: "nil store", sp: sp, opts: []Option{SetStore(nil)}, option: "SetStore"},
+		{name: "unknown interactive store failure", sp: sp, opts: []Option{SetInteractiveStoreFailure(StoreFailure(7))}, option: "SetInteractiveStoreFailure"},
+		{name: "negative secret grace period", sp: sp, opts: []Option{SetSecretGracePeriod(-time.Second)}, option: "SetSecretGracePeriod"},
+		{name: "nil shutdown sink", sp: sp, opts: []Option{SetShutdownSink("acct", nil)}, option: "SetShutdownSink"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp6", "[::1]:0")
+			assert.NoError(t, err)
+			err = NewServer(nopLogger{}, test.sp, test.opts...).Serve(context.Background(), listener.(*net.TCPListener))
+			var oe *OptionError
+			assert.True(t, errors.As(err, &oe), err)
+			assert.Equal(t, test.option, oe.Option)
+		})
+	}
+}
+
+func TestNewClientInvalidOptions(t *testing.T) {
+	var oe *OptionError
+	_, err := NewClient()
+	assert.True(t, errors.As(err, &oe))
+	assert.Equal(t, "NewClient", oe.Option)
+
+	_, err = NewClient(SetClientOptions(ClientOptions{Secret: []byte("fooman")}))
+	assert.True(t, errors.As(err, &oe))
+	assert.Equal(t, "SetClientOptions", oe.Option)
+}
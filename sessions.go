@@ -10,20 +10,33 @@ package tacquito
 import (
 	"fmt"
 	"sync"
-
-	"github.com/prometheus/client_golang/prometheus"
+	"sync/atomic"
 )
 
+// SessionReusePolicy may be implemented by the Handler returned from a SecretProvider to control
+// session reuse on its connections.  Some clients start a new session on the same connection after
+// the previous session completes, without ever negotiating single-connect.  ImplicitSessionReuse
+// returning reuse true accepts them as new sessions, which is out of spec but tolerated for those
+// clients.  ok false, and handlers that do not implement this interface, use the server default,
+// which is strict per rfc8907 unless SetImplicitSessionReuse is set.
+type SessionReusePolicy interface {
+	ImplicitSessionReuse() (reuse bool, ok bool)
+}
+
 // newSessionProvider creates a session manager for an underlying net.Conn
-func newSessionProvider() *sessions {
-	return &sessions{known: make(map[SessionID]*sessionContext)}
+func newSessionProvider(implicitReuse bool) *sessions {
+	return &sessions{known: make(map[SessionID]*sessionContext), implicitReuse: implicitReuse}
 }
 
 // sessionContext is a thread safe cache that tracks session ids from clients
 type sessionContext struct {
 	header Header
 	Handler
-	timer *prometheus.Timer
+	timer *durationTimer
+	// typed times the session for the durations of its packet type, see sessionQuantiles
+	typed *durationTimer
+	// release, if set, releases the slot of the session in the interactive session quota
+	release func()
 }
 
 // sessions manages client session ids. we use sessions to know how to
@@ -34,28 +47,95 @@ type sessionContext struct {
 type sessions struct {
 	sync.RWMutex
 	known map[SessionID]*sessionContext
+
+	// implicitReuse allows new sessions after a completed session without single-connect
+	implicitReuse bool
+	// singleConnect is true if the first session on the connection negotiated single-connect
+	singleConnect bool
+	// started is true once the first session on the connection has been seen
+	started bool
+	// completed is the number of sessions that completed on the connection
+	completed int
+	// lastCompleted is the sessionID of the most recently completed session
+	lastCompleted SessionID
+	// active, if set, counts the known sessions of every connection of a server
+	active *int64
+	// implicitReused, if set, is called for every session accepted by implicit reuse
+	implicitReused func()
+	// tally, if set, records the metrics of the request being served, see requestTally
+	tally *requestTally
+	// sequences, if set, are the sequence numbers the crypter of the connection expects, which
+	// forget the sessions deleted here
+	sequences *sequences
+	// cutover, if set, holds the secret of each session of the connection, which forgets the
+	// sessions deleted here
+	cutover *secretCutover
 }
 
-// get a session
+// get a session.  Sequence numbers are not checked here, the crypter checked them as it read the
+// request, see sequences.
 func (s *sessions) get(h Header) (Handler, error) {
-	if err := ClientSequenceNumber(h.SeqNo).Validate(nil); err != nil {
-		s.delete(h.SessionID)
-		return nil, fmt.Errorf("sessionID [%v] sequence number is corrupted; %v", h.SessionID, err)
-	}
 	s.Lock()
 	defer s.Unlock()
 	sc, ok := s.known[h.SessionID]
 	if !ok {
-		sessionsGetMiss.Inc()
-		return nil, nil
-	}
-	if err := LastSequence(sc.header.SeqNo).Validate(h.SeqNo); err != nil {
-		return nil, fmt.Errorf("sessionID [%v] sequence number is mismatched; %v", h.SessionID, err)
+		s.tally.sessionMiss()
+		return nil, s.begin(h)
 	}
-	sessionsGetHit.Inc()
+	s.tally.sessionHit()
 	return sc.Handler, nil
 }
 
+// negotiated reports if the connection negotiated single-connect, as it does with h if h starts
+// its first session
+func (s *sessions) negotiated(h Header) bool {
+	s.RLock()
+	defer s.RUnlock()
+	if !s.started {
+		return h.Flags.Has(SingleConnect)
+	}
+	return s.singleConnect
+}
+
+// awaiting reports if the connection negotiated single-connect and has no session in flight
+func (s *sessions) awaiting() bool {
+	s.RLock()
+	defer s.RUnlock()
+	return s.started && s.singleConnect && len(s.known) == 0
+}
+
+// begin decides if a new session may start on this connection.  Once a session completes, the
+// connection awaits a new session.  A new sessionID is accepted if single-connect was negotiated
+// or implicit reuse is allowed.  A seq 1 packet that reuses the sessionID of the session that just
+// completed is treated as a replay and rejected.  begin must be called with the lock held.
+func (s *sessions) begin(h Header) error {
+	if !s.started {
+		s.started = true
+		s.singleConnect = h.Flags.Has(SingleConnect)
+		return nil
+	}
+	if h.SeqNo != 1 || s.completed == 0 {
+		return nil
+	}
+	if h.SessionID == s.lastCompleted {
+		sessionsReuseReplayed.Inc()
+		return fmt.Errorf("sessionID [%v] was already completed on this connection", h.SessionID)
+	}
+	if s.singleConnect {
+		sessionsReuseSingleConnect.Inc()
+		return nil
+	}
+	if !s.implicitReuse {
+		sessionsReuseImplicitDenied.Inc()
+		return fmt.Errorf("sessionID [%v] reuses a connection without single-connect", h.SessionID)
+	}
+	sessionsReuseImplicit.Inc()
+	if s.implicitReused != nil {
+		s.implicitReused()
+	}
+	return nil
+}
+
 // set a session and next handler.  for long running packet exchanges, we need
 // to know what handler state was left when we last responded so we know what to
 // processes the next client response as.  This is especially important when we
@@ -65,12 +145,19 @@ func (s *sessions) set(h Header, n Handler) {
 	s.Lock()
 	defer s.Unlock()
 	sessionsActive.Inc()
-	sessionsSet.Inc()
-	timer := prometheus.NewTimer(prometheus.ObserverFunc(func(v float64) {
-		ms := v * 1000 // make milliseconds
-		sessionDurations.Observe(ms)
-	}))
-	s.known[h.SessionID] = &sessionContext{header: h, Handler: n, timer: timer}
+	s.tally.sessionSet()
+	timer := newTimer(sessionDurations)
+	if _, ok := s.known[h.SessionID]; !ok {
+		s.count(1)
+	}
+	s.known[h.SessionID] = &sessionContext{header: h, Handler: n, timer: timer, typed: newTimer(sessionTypeObserver(h.Type))}
+}
+
+// count adds delta to active, if set
+func (s *sessions) count(delta int64) {
+	if s.active != nil {
+		atomic.AddInt64(s.active, delta)
+	}
 }
 
 // update a session id and next handler.
@@ -79,7 +166,7 @@ func (s *sessions) update(h Header, n Handler) {
 	defer s.Unlock()
 	sc, ok := s.known[h.SessionID]
 	if !ok {
-		sessionsGetMiss.Inc()
+		s.tally.sessionMiss()
 		return
 	}
 	sc.header = h
@@ -87,21 +174,97 @@ func (s *sessions) update(h Header, n Handler) {
 	s.known[h.SessionID] = sc
 }
 
+// hold sets the release func of a known session that holds none, from acquire.  acquire and the
+// release funcs may call a Store, so they are called without the lock held, and a session deleted
+// meanwhile is released at once.
+func (s *sessions) hold(session SessionID, acquire func() func()) {
+	s.RLock()
+	sc, ok := s.known[session]
+	held := ok && sc.release != nil
+	s.RUnlock()
+	if !ok || held {
+		return
+	}
+	release := acquire()
+	s.Lock()
+	if s.known[session] == sc && sc.release == nil {
+		sc.release, release = release, nil
+	}
+	s.Unlock()
+	if release != nil {
+		release()
+	}
+}
+
 // delete a session
 func (s *sessions) delete(session SessionID) {
 	s.Lock()
-	defer s.Unlock()
 	sessionsActive.Dec()
+	var release func()
 	if sc := s.known[session]; sc != nil {
 		sc.timer.ObserveDuration()
+		sc.typed.ObserveDuration()
+		s.count(-1)
+		release = sc.release
 	}
 	delete(s.known, session)
+	s.forget(session)
+	s.Unlock()
+	// a release may call a Store, which must not block the other sessions of the connection
+	if release != nil {
+		release()
+	}
+}
+
+// refuse drops what the connection holds for session, whose first request was refused so it never
+// started
+func (s *sessions) refuse(session SessionID) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.known[session]; !ok {
+		s.forget(session)
+	}
 }
 
-// close will stop all prom timers, it's the only reason we have this
+// forget drops the per session state the crypter of the connection holds for session, with the
+// lock held
+func (s *sessions) forget(session SessionID) {
+	s.sequences.forget(session)
+	s.cutover.forget(session)
+}
+
+// complete deletes a session that finished cleanly and marks the connection as awaiting
+// a new session
+func (s *sessions) complete(session SessionID) {
+	s.delete(session)
+	s.Lock()
+	defer s.Unlock()
+	s.completed++
+	s.lastCompleted = session
+}
+
+// inFlight returns the number of sessions that have not completed
+func (s *sessions) inFlight() int {
+	s.RLock()
+	defer s.RUnlock()
+	return len(s.known)
+}
+
+// close will stop all duration timers, it's the only reason we have this
 func (s *sessions) close() {
+	s.Lock()
+	var releases []func()
 	for _, r := range s.known {
 		r.timer.ObserveDuration()
+		r.typed.ObserveDuration()
+		if r.release != nil {
+			releases = append(releases, r.release)
+		}
+	}
+	s.count(-int64(len(s.known)))
+	s.Unlock()
+	for _, release := range releases {
+		release()
 	}
 }
 
@@ -109,19 +272,24 @@ func (s *sessions) close() {
 // a counter that can be used in Serve()
 type waitGroup struct {
 	sync.WaitGroup
-	active uint
+	active int64
 }
 
 // Add adds to WaitGroup and increments the count
 func (w *waitGroup) Add(delta int) {
 	waitgroupActive.Inc()
 	w.WaitGroup.Add(delta)
-	w.active++
+	atomic.AddInt64(&w.active, int64(delta))
 }
 
 // Done decrements WaitGroup and the counter
 func (w *waitGroup) Done() {
 	waitgroupActive.Dec()
 	w.WaitGroup.Done()
-	w.active--
+	atomic.AddInt64(&w.active, -1)
+}
+
+// Active returns the count, it is safe to call while connections are added and done
+func (w *waitGroup) Active() int64 {
+	return atomic.LoadInt64(&w.active)
 }
@@ -0,0 +1,235 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/facebookincubator/tacquito/internal/testhooks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sessionHeader(id SessionID, seq int, f HeaderFlag) Header {
+	return *NewHeader(SetHeaderSessionID(id), SetHeaderSeqNo(seq), SetHeaderFlag(f))
+}
+
+func TestSessionReuse(t *testing.T) {
+	var single HeaderFlag
+	single.Set(SingleConnect)
+
+	tests := []struct {
+		name          string
+		implicitReuse bool
+		first         Header
+		next          Header
+		expectErr     bool
+	}{
+		{name: "implicit reuse allowed", implicitReuse: true, first: sessionHeader(1, 1, 0), next: sessionHeader(2, 1, 0)},
+		{name: "implicit reuse denied", implicitReuse: false, first: sessionHeader(1, 1, 0), next: sessionHeader(2, 1, 0), expectErr: true},
+		{name: "single-connect reuse", implicitReuse: false, first: sessionHeader(1, 1, single), next: sessionHeader(2, 1, single)},
+		{name: "sessionID replay", implicitReuse: true, first: sessionHeader(1, 1, 0), next: sessionHeader(1, 1, 0), expectErr: true},
+		{name: "sessionID replay single-connect", implicitReuse: true, first: sessionHeader(1, 1, single), next: sessionHeader(1, 1, single), expectErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newSessionProvider(test.implicitReuse)
+			defer s.close()
+			h, err := s.get(test.first)
+			assert.NoError(t, err)
+			assert.Nil(t, h)
+			s.set(test.first, nil)
+			s.complete(test.first.SessionID)
+
+			_, err = s.get(test.next)
+			if test.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestServeImplicitSessionReuse(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      []Option
+		expectErr bool
+	}{
+		{name: "strict by default", expectErr: true},
+		{name: "tolerant", opts: []Option{SetImplicitSessionReuse(true)}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			listener, err := net.Listen("tcp6", "[::1]:0")
+			require.NoError(t, err)
+			s := NewServer(nopLogger{}, sourceSecretProvider{source: "::1", secret: []byte("fooman")}, test.opts...)
+			go s.Serve(ctx, listener.(*net.TCPListener))
+
+			c, err := NewClient(SetClientDialer("tcp6", listener.Addr().String(), []byte("fooman")))
+			require.NoError(t, err)
+			defer c.Close()
+
+			_, err = c.Send(proxyTestPacket())
+			require.NoError(t, err)
+
+			// a second session on the same connection, without single-connect
+			reused := metricValue(sessionsReuseImplicit)
+			second := proxyTestPacket()
+			second.Header.SessionID = 54321
+			_, err = c.Send(second)
+			if test.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, reused+1, metricValue(sessionsReuseImplicit))
+		})
+	}
+}
+
+func TestSingleConnectInterleaved(t *testing.T) {
+	c := newSequenceTestConn(t)
+	_, err := c.write(featureTestStart(1, SingleConnect, MinorVersionDefault, AuthenTypeASCII))
+	require.NoError(t, err)
+	// the client decodes every seq 2 reply as single-connect, so the flag is read off the wire
+	raw, err := c.readRaw()
+	require.NoError(t, err)
+	flags := HeaderFlag(raw[3])
+	assert.True(t, flags.Has(SingleConnect), "the first reply negotiates single-connect")
+
+	// the sessions of the connection are demultiplexed by session id, each with its own handler
+	_, reply := c.send(t, 2, 1)
+	assert.Equal(t, AuthenStatusGetPass, reply.Status)
+	_, reply = c.send(t, 1, 3)
+	assert.Equal(t, AuthenStatusPass, reply.Status)
+	_, reply = c.send(t, 2, 3)
+	assert.Equal(t, AuthenStatusPass, reply.Status)
+
+	// and the connection is kept open for the next
+	_, reply = c.send(t, 3, 1)
+	assert.Equal(t, AuthenStatusGetPass, reply.Status)
+	_, reply = c.send(t, 3, 3)
+	assert.Equal(t, AuthenStatusPass, reply.Status)
+}
+
+func TestSingleConnectIdleTimeout(t *testing.T) {
+	// the deadline hook records each idle timeout the server arms, and expires the single-connect
+	// timeout once expire is set, so the test never waits for either timeout
+	armed := make(chan time.Duration, 16)
+	var expire int32
+	deadline := func(d time.Duration) time.Time {
+		armed <- d
+		if d == time.Hour && atomic.LoadInt32(&expire) == 1 {
+			return time.Now()
+		}
+		return time.Now().Add(d)
+	}
+	c := newSequenceTestConn(t, SetIdleTimeout(time.Minute), SetSingleConnectIdleTimeout(time.Hour), setTestHooks(&testhooks.Hooks{Deadline: deadline}))
+	// untilSingleConnect waits for the single-connect timeout to be armed, checking that the idle
+	// timeout was armed while the session was open
+	untilSingleConnect := func() {
+		for {
+			select {
+			case d := <-armed:
+				if d == time.Hour {
+					return
+				}
+				assert.Equal(t, time.Minute, d)
+			case <-time.After(5 * time.Second):
+				t.Fatal("single-connect timeout was not armed")
+			}
+		}
+	}
+
+	_, reply := c.send(t, 1, 1)
+	assert.Equal(t, AuthenStatusGetPass, reply.Status)
+	_, reply = c.send(t, 1, 3)
+	assert.Equal(t, AuthenStatusPass, reply.Status)
+	// a quiescent single-connect connection is given its own timeout rather than the idle timeout
+	untilSingleConnect()
+
+	_, reply = c.send(t, 2, 1)
+	assert.Equal(t, AuthenStatusGetPass, reply.Status)
+	atomic.StoreInt32(&expire, 1)
+	_, reply = c.send(t, 2, 3)
+	assert.Equal(t, AuthenStatusPass, reply.Status)
+	untilSingleConnect()
+
+	// and is closed once it passes
+	c.closed(t)
+}
+
+func TestSessionReleaseUnlocked(t *testing.T) {
+	for _, end := range []struct {
+		name string
+		end  func(s *sessions)
+	}{
+		{name: "delete", end: func(s *sessions) { s.delete(1) }},
+		{name: "close", end: func(s *sessions) { s.close() }},
+	} {
+		t.Run(end.name, func(t *testing.T) {
+			s := newSessionProvider(false)
+			s.set(sessionHeader(1, 1, 0), nil)
+			unblock := make(chan struct{})
+			released := make(chan struct{})
+			// a release stuck on a slow store
+			s.hold(1, func() func() {
+				return func() {
+					<-unblock
+					close(released)
+				}
+			})
+			go end.end(s)
+
+			// the other sessions of the connection are served meanwhile
+			done := make(chan struct{})
+			go func() {
+				_, err := s.get(sessionHeader(2, 1, 0))
+				assert.NoError(t, err)
+				s.set(sessionHeader(2, 1, 0), nil)
+				s.inFlight()
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("a release blocked the sessions of the connection")
+			}
+			close(unblock)
+			<-released
+		})
+	}
+}
+
+func TestSessionCloseObservesType(t *testing.T) {
+	d := newTypeDurations(Authorize)
+	saved := sessionTypes[Authorize]
+	sessionTypes[Authorize] = d
+	defer func() { sessionTypes[Authorize] = saved }()
+
+	// sessions still open when the connection closes count toward the durations of their type
+	s := newSessionProvider(true)
+	for id := SessionID(1); id <= 2; id++ {
+		s.set(*NewHeader(SetHeaderType(Authorize), SetHeaderSessionID(id), SetHeaderSeqNo(1)), nil)
+	}
+	s.delete(1)
+	s.close()
+	var observed uint64
+	for i := range d.counts {
+		observed += atomic.LoadUint64(&d.counts[i])
+	}
+	assert.Equal(t, uint64(2), observed)
+}
@@ -0,0 +1,359 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ShutdownSink is a sink that holds records in memory, eg a batching accounter, which the server
+// flushes when it shuts down
+type ShutdownSink interface {
+	// Shutdown flushes the records held until ctx is done and stops the sink.  It returns how
+	// many records were flushed and the records that were not.
+	Shutdown(ctx context.Context) (int, []map[string]string, error)
+}
+
+// Spool keeps the records a ShutdownSink could not flush on durable storage, so they can be
+// replayed once the sink recovers
+type Spool interface {
+	// Spool stores records of sink until ctx is done and returns how many were stored
+	Spool(ctx context.Context, sink string, records []map[string]string) (int, error)
+}
+
+// ShutdownStage is a step of the shutdown of a Server
+type ShutdownStage string
+
+const (
+	// ShutdownServing is a server that is not shutting down
+	ShutdownServing ShutdownStage = "serving"
+	// ShutdownStopAccepting closes the listener so no new connections are accepted
+	ShutdownStopAccepting ShutdownStage = "stop-accepting"
+	// ShutdownDrain waits for open connections to close
+	ShutdownDrain ShutdownStage = "drain"
+	// ShutdownFlush flushes every ShutdownSink
+	ShutdownFlush ShutdownStage = "flush"
+	// ShutdownSpool writes the records that were not flushed to the Spool
+	ShutdownSpool ShutdownStage = "spool"
+	// ShutdownDone is a server that finished shutting down
+	ShutdownDone ShutdownStage = "done"
+)
+
+// shutdownShares is the share of the remaining shutdown budget each timed stage may use.  Time a
+// stage does not use is left to the stages after it.
+var shutdownShares = []struct {
+	stage ShutdownStage
+	share float64
+}{
+	{ShutdownDrain, 0.5},
+	{ShutdownFlush, 0.3},
+	{ShutdownSpool, 0.2},
+}
+
+// SinkReport is what happened to the records of a ShutdownSink during shutdown
+type SinkReport struct {
+	Flushed int    `json:"flushed"`
+	Spooled int    `json:"spooled"`
+	Lost    int    `json:"lost"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ShutdownProgress reports how far the shutdown of a Server got, see Server.ShutdownProgress
+type ShutdownProgress struct {
+	Stage ShutdownStage `json:"stage"`
+	// Started is when shutdown began and Deadline is when its budget runs out
+	Started  time.Time `json:"started,omitempty"`
+	Deadline time.Time `json:"deadline,omitempty"`
+	// StageDeadline is when the budget of the current stage runs out
+	StageDeadline time.Time `json:"stage_deadline,omitempty"`
+	// Active is the number of connections that are still open
+	Active int64                 `json:"active"`
+	Sinks  map[string]SinkReport `json:"sinks,omitempty"`
+}
+
+// SetShutdownBudget sets how long the server may take to shut down once the context of Serve is
+// done, eg the grace period of a SIGTERM.  The budget is split between draining connections,
+// flushing each ShutdownSink and spooling what could not be flushed.  A value of zero, the
+// default, waits for every stage to finish.
+func SetShutdownBudget(v time.Duration) Option {
+	return func(s *Server) {
+		s.shutdownBudget = v
+	}
+}
+
+// SetShutdownSink adds a sink named name that is flushed when the server shuts down, after its
+// connections are drained.  Sinks are flushed in the order they were added.
+func SetShutdownSink(name string, sink ShutdownSink) Option {
+	return func(s *Server) {
+		s.shutdownSinks = append(s.shutdownSinks, namedSink{name: name, ShutdownSink: sink})
+	}
+}
+
+// SetShutdownSpool sets where the records a ShutdownSink could not flush are written
+func SetShutdownSpool(v Spool) Option {
+	return func(s *Server) {
+		s.spool = v
+	}
+}
+
+// namedSink is a ShutdownSink and the name it is reported under
+type namedSink struct {
+	ShutdownSink
+	name string
+}
+
+// shutdownState guards the progress of a shutdown, which is read by admin endpoints while the
+// server is shutting down
+type shutdownState struct {
+	mu       sync.Mutex
+	progress ShutdownProgress
+}
+
+// ShutdownProgress returns how far the shutdown of the server got, for debugging a shutdown that
+// is stuck.  The stage is ShutdownServing until the context of Serve is done.
+func (s *Server) ShutdownProgress() ShutdownProgress {
+	s.shutdownState.mu.Lock()
+	defer s.shutdownState.mu.Unlock()
+	p := s.shutdownState.progress
+	if p.Stage == "" {
+		p.Stage = ShutdownServing
+	}
+	p.Active = s.Active()
+	sinks := make(map[string]SinkReport, len(p.Sinks))
+	for k, v := range p.Sinks {
+		sinks[k] = v
+	}
+	p.Sinks = sinks
+	return p
+}
+
+// setStage moves the shutdown to stage, which must finish by deadline
+func (s *Server) setStage(stage ShutdownStage, deadline time.Time) {
+	s.shutdownState.mu.Lock()
+	defer s.shutdownState.mu.Unlock()
+	s.shutdownState.progress.Stage = stage
+	s.shutdownState.progress.StageDeadline = deadline
+}
+
+// setSinkReport records the report of sink
+func (s *Server) setSinkReport(sink string, r SinkReport) {
+	s.shutdownState.mu.Lock()
+	defer s.shutdownState.mu.Unlock()
+	s.shutdownState.progress.Sinks[sink] = r
+}
+
+// shutdown stops accepting connections on listener, then runs each stage in order within the
+// shutdown budget and logs a final record of what was and was not flushed
+func (s *Server) shutdown(ctx context.Context, listener DeadlineListener) {
+	started := time.Now()
+	var deadline time.Time
+	if s.shutdownBudget > 0 {
+		deadline = started.Add(s.shutdownBudget)
+	}
+	s.shutdownState.mu.Lock()
+	s.shutdownState.progress = ShutdownProgress{Started: started, Deadline: deadline, Sinks: make(map[string]SinkReport)}
+	s.shutdownState.mu.Unlock()
+
+	s.setStage(ShutdownStopAccepting, deadline)
+	s.Infof(ctx, "Stopping server listener for %v...", listener.Addr().String())
+	if err := listener.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		s.Errorf(ctx, "%s", err)
+	}
+
+	remaining := map[string][]map[string]string{}
+	reports := map[string]SinkReport{}
+	for i, stage := range shutdownShares {
+		sctx, cancel := s.stageContext(deadline, i)
+		stageDeadline, _ := sctx.Deadline()
+		s.setStage(stage.stage, stageDeadline)
+		switch stage.stage {
+		case ShutdownDrain:
+			s.drain(ctx, sctx)
+		case ShutdownFlush:
+			for _, sink := range s.shutdownSinks {
+				r := s.flushSink(ctx, sctx, sink, remaining)
+				reports[sink.name] = r
+				s.setSinkReport(sink.name, r)
+			}
+		case ShutdownSpool:
+			for _, sink := range s.shutdownSinks {
+				r := reports[sink.name]
+				r.Spooled, r.Lost = s.spoolSink(ctx, sctx, sink.name, remaining[sink.name])
+				reports[sink.name] = r
+				s.setSinkReport(sink.name, r)
+			}
+		}
+		cancel()
+	}
+	s.setStage(ShutdownDone, time.Time{})
+
+	record := map[string]string{
+		"event":    "shutdown",
+		"duration": time.Since(started).String(),
+		"active":   strconv.FormatInt(s.Active(), 10),
+	}
+	var lost int
+	names := make([]string, 0, len(reports))
+	for name, r := range reports {
+		if r.Lost > 0 {
+			names = append(names, name)
+		}
+		record[name+"-flushed"] = strconv.Itoa(r.Flushed)
+		record[name+"-spooled"] = strconv.Itoa(r.Spooled)
+		record[name+"-lost"] = strconv.Itoa(r.Lost)
+		lost += r.Lost
+	}
+	sort.Strings(names)
+	s.Record(ctx, record)
+	if lost > 0 {
+		s.Errorf(ctx, "shutdown lost [%v] records that could neither be flushed nor spooled, sinks %v", lost, names)
+	}
+	s.Infof(ctx, "shutdown finished in [%v] with [%v] connections still open", time.Since(started), s.Active())
+}
+
+// stageContext returns the context of the stage at index i of shutdownShares.  Its deadline is
+// the share of the stage of the time left before deadline, which is zero for no budget.
+func (s *Server) stageContext(deadline time.Time, i int) (context.Context, context.CancelFunc) {
+	if deadline.IsZero() {
+		return context.WithCancel(context.Background())
+	}
+	var shares float64
+	for _, stage := range shutdownShares[i:] {
+		shares += stage.share
+	}
+	left := time.Until(deadline)
+	if left < 0 {
+		left = 0
+	}
+	return context.WithTimeout(context.Background(), time.Duration(float64(left)*shutdownShares[i].share/shares))
+}
+
+// drain waits for open connections to close until sctx is done
+func (s *Server) drain(ctx, sctx context.Context) {
+	s.Infof(ctx, "waiting for [%v] connections to close prior to shutdown", s.Active())
+	done := make(chan struct{})
+	go func() {
+		s.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-sctx.Done():
+		shutdownUndrained.Add(float64(s.Active()))
+		s.Errorf(ctx, "[%v] connections were still open when the drain budget ran out", s.Active())
+	}
+}
+
+// flushSink flushes sink until sctx is done and keeps the records it could not flush in remaining
+func (s *Server) flushSink(ctx, sctx context.Context, sink namedSink, remaining map[string][]map[string]string) SinkReport {
+	flushed, records, err := sink.Shutdown(sctx)
+	r := SinkReport{Flushed: flushed, Lost: len(records)}
+	if err != nil {
+		r.Error = err.Error()
+		s.Errorf(ctx, "sink [%v] failed to flush [%v] records on shutdown; %v", sink.name, len(records), err)
+	}
+	shutdownFlushed.WithLabelValues(sink.name).Add(float64(flushed))
+	remaining[sink.name] = records
+	return r
+}
+
+// spoolSink spools records of sink until sctx is done, and returns how many were and were not
+func (s *Server) spoolSink(ctx, sctx context.Context, sink string, records []map[string]string) (int, int) {
+	if len(records) == 0 {
+		return 0, 0
+	}
+	if s.spool == nil {
+		shutdownLost.WithLabelValues(sink).Add(float64(len(records)))
+		return 0, len(records)
+	}
+	n, err := s.spool.Spool(sctx, sink, records)
+	if err != nil {
+		s.Errorf(ctx, "unable to spool [%v] records of sink [%v]; %v", len(records)-n, sink, err)
+	}
+	shutdownSpooled.WithLabelValues(sink).Add(float64(n))
+	shutdownLost.WithLabelValues(sink).Add(float64(len(records) - n))
+	return n, len(records) - n
+}
+
+// NewFileSpool returns a Spool that appends the records of each sink to a file named after the
+// sink in dir, see ReadSpool for the format
+func NewFileSpool(dir string) *FileSpool {
+	return &FileSpool{dir: dir}
+}
+
+// FileSpool is a Spool on the local filesystem
+type FileSpool struct {
+	mu  sync.Mutex
+	dir string
+}
+
+// Path returns the file the records of sink are spooled to
+func (f *FileSpool) Path(sink string) string {
+	return filepath.Join(f.dir, filepath.Base(sink)+".spool")
+}
+
+// Spool appends records to the spool file of sink, as a segment of their own, and syncs it to
+// disk.  Records are written one at a time so those written before ctx is done are kept.
+func (f *FileSpool) Spool(ctx context.Context, sink string, records []map[string]string) (int, error) {
+	if len(records) == 0 {
+		return 0, nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := os.OpenFile(f.Path(sink), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	if _, err := file.Write(appendSpoolSegment(nil, sink)); err != nil {
+		return 0, err
+	}
+	var n int
+	var cause error
+	var b []byte
+	for _, r := range records {
+		if cause = ctx.Err(); cause != nil {
+			break
+		}
+		if b, cause = appendSpoolRecord(b[:0], r); cause != nil {
+			break
+		}
+		if _, cause = file.Write(b); cause != nil {
+			break
+		}
+		n++
+	}
+	if err := file.Sync(); err != nil {
+		return 0, fmt.Errorf("unable to sync spool [%v]; %w", f.Path(sink), err)
+	}
+	return n, cause
+}
+
+// Read reads the spool file of sink with ReadSpool, a sink that spooled nothing has no records
+func (f *FileSpool) Read(sink string, fn func(record map[string]string) error) (SpoolReadReport, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := os.Open(f.Path(sink))
+	if os.IsNotExist(err) {
+		return SpoolReadReport{}, nil
+	}
+	if err != nil {
+		return SpoolReadReport{}, err
+	}
+	defer file.Close()
+	return ReadSpool(file, func(_ string, record map[string]string) error { return fn(record) })
+}
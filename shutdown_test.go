@@ -0,0 +1,113 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slowSink flushes a record every delay until the context of Shutdown is done
+type slowSink struct {
+	delay   time.Duration
+	records []map[string]string
+}
+
+func (s *slowSink) Shutdown(ctx context.Context) (int, []map[string]string, error) {
+	for i := range s.records {
+		select {
+		case <-time.After(s.delay):
+		case <-ctx.Done():
+			return i, s.records[i:], ctx.Err()
+		}
+	}
+	return len(s.records), nil, nil
+}
+
+func TestShutdownBudget(t *testing.T) {
+	sink := &slowSink{delay: 20 * time.Millisecond}
+	for i := 0; i < 100; i++ {
+		sink.records = append(sink.records, map[string]string{"task_id": strconv.Itoa(i)})
+	}
+	spool := NewFileSpool(t.TempDir())
+	logger := &recordLogger{}
+	budget := 500 * time.Millisecond
+	s := NewServer(logger, sourceSecretProvider{source: "192.0.2.10", secret: []byte("fooman")},
+		SetShutdownBudget(budget),
+		SetShutdownSink("acct", sink),
+		SetShutdownSpool(spool),
+	)
+	assert.Equal(t, ShutdownServing, s.ShutdownProgress().Stage)
+
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		assert.NoError(t, s.Serve(ctx, listener.(*net.TCPListener)))
+		close(done)
+	}()
+
+	cancel()
+	started := time.Now()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not finish")
+	}
+	assert.Less(t, time.Since(started), budget+200*time.Millisecond)
+
+	p := s.ShutdownProgress()
+	assert.Equal(t, ShutdownDone, p.Stage)
+	r := p.Sinks["acct"]
+	assert.Greater(t, r.Flushed, 0)
+	assert.Less(t, r.Flushed, len(sink.records))
+	assert.Equal(t, len(sink.records)-r.Flushed, r.Spooled)
+	assert.Equal(t, 0, r.Lost)
+
+	// the spool holds exactly the records that were not flushed, in order
+	var spooled []map[string]string
+	report, err := spool.Read("acct", func(record map[string]string) error {
+		spooled = append(spooled, record)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, SpoolReadReport{Segments: 1, Records: r.Spooled}, report)
+	assert.Equal(t, sink.records[r.Flushed:], spooled)
+
+	require.Len(t, logger.records, 1)
+	final := logger.records[0]
+	assert.Equal(t, "shutdown", final["event"])
+	assert.Equal(t, strconv.Itoa(r.Flushed), final["acct-flushed"])
+	assert.Equal(t, strconv.Itoa(r.Spooled), final["acct-spooled"])
+	assert.Equal(t, "0", final["acct-lost"])
+}
+
+func TestShutdownWithoutSpool(t *testing.T) {
+	sink := &slowSink{delay: time.Second, records: []map[string]string{{"task_id": "1"}}}
+	logger := &recordLogger{}
+	s := NewServer(logger, sourceSecretProvider{source: "192.0.2.10", secret: []byte("fooman")},
+		SetShutdownBudget(100*time.Millisecond),
+		SetShutdownSink("acct", sink),
+	)
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.NoError(t, s.Serve(ctx, listener.(*net.TCPListener)))
+
+	assert.Equal(t, SinkReport{Lost: 1, Error: context.DeadlineExceeded.Error()}, s.ShutdownProgress().Sinks["acct"])
+	require.Len(t, logger.records, 1)
+	assert.Equal(t, "1", logger.records[0]["acct-lost"])
+}
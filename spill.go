@@ -0,0 +1,284 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ArgSpillAttribute is the attribute of the arg that replaces spilled cmd-arg args, see Args.Spill
+const ArgSpillAttribute = "cmd-arg-spill"
+
+// NewArgSpill returns an ArgSpill that keeps the cmd-arg values of Args above threshold bytes in
+// dir, which is created if needed.  Spill files already in dir were left by a previous process, eg
+// for records spooled on its shutdown.  They are kept until Collect removes them, and a replay of
+// those records may Retain them meanwhile.  Partial writes of a previous process are removed.
+func NewArgSpill(dir string, threshold int) (*ArgSpill, error) {
+	if threshold < 1 {
+		return nil, fmt.Errorf("spill threshold must be at least 1, got [%v]", threshold)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("unable to create spill directory; %w", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read spill directory; %w", err)
+	}
+	s := &ArgSpill{dir: dir, threshold: threshold, refs: make(map[string]int), orphans: make(map[string]time.Time)}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".spill-") {
+			os.Remove(filepath.Join(dir, e.Name()))
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if b, err := hex.DecodeString(e.Name()); err != nil || len(b) != sha256.Size {
+			continue
+		}
+		s.orphans[e.Name()] = info.ModTime()
+		argSpillFiles.Inc()
+	}
+	return s, nil
+}
+
+// ArgSpill keeps oversized cmd-arg values, eg config pushed through the cli, in content addressed
+// files so records only carry a reference to them.  A spilled file is retained by every record
+// that references it, and removed once each has been released, see Release.
+type ArgSpill struct {
+	dir       string
+	threshold int
+
+	mu sync.Mutex
+	// refs counts the records that reference each file, by hash
+	refs map[string]int
+	// orphans are the files left by a previous process that are not retained, by hash, with the
+	// time they were written
+	orphans map[string]time.Time
+}
+
+// ArgRef references the cmd-arg values of a request held in an ArgSpill
+type ArgRef struct {
+	// Hash is the hex sha256 of the values, joined by spaces as by Args.CommandArgs
+	Hash string
+	Size int64
+}
+
+// String returns the reference as it is carried in records, sha256:<hash>:<size>
+func (r ArgRef) String() string {
+	return fmt.Sprintf("sha256:%v:%v", r.Hash, r.Size)
+}
+
+// ParseArgRef parses a reference returned by ArgRef.String
+func ParseArgRef(s string) (ArgRef, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 || parts[0] != "sha256" {
+		return ArgRef{}, fmt.Errorf("invalid arg reference [%v]", s)
+	}
+	if b, err := hex.DecodeString(parts[1]); err != nil || len(b) != sha256.Size {
+		return ArgRef{}, fmt.Errorf("invalid arg reference hash [%v]", parts[1])
+	}
+	size, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || size < 0 {
+		return ArgRef{}, fmt.Errorf("invalid arg reference size [%v]", parts[2])
+	}
+	return ArgRef{Hash: parts[1], Size: size}, nil
+}
+
+// Ref returns the reference held by the cmd-arg-spill arg of t, ok is false if t was not spilled
+func (t Args) Ref() (ArgRef, bool) {
+	for _, arg := range t {
+		a, _, v := arg.ASV()
+		if a != ArgSpillAttribute {
+			continue
+		}
+		ref, err := ParseArgRef(v)
+		return ref, err == nil
+	}
+	return ArgRef{}, false
+}
+
+// Spill returns t with its cmd-arg args replaced by a single cmd-arg-spill arg referencing their
+// values in s, if the values are over the threshold of s, and t itself otherwise.  The values are
+// streamed to the file as they are hashed, they are never joined in memory.  The file is retained
+// once for the returned Args, which must be released with s.Release when the record holding them
+// is no longer needed.
+func (t Args) Spill(s *ArgSpill) (Args, error) {
+	if s == nil {
+		return t, nil
+	}
+	values, size := t.commandArgValues()
+	if size <= int64(s.threshold) {
+		return t, nil
+	}
+	ref, err := s.write(values, size)
+	if err != nil {
+		argSpillFailed.Inc()
+		return t, err
+	}
+	spilled := make(Args, 0, len(t)-len(values)+1)
+	for _, arg := range t {
+		if a, _, _ := arg.ASV(); a != "cmd-arg" {
+			spilled = append(spilled, arg)
+		}
+	}
+	spilled = append(spilled, Arg(ArgSpillAttribute+"="+ref.String()))
+	return spilled, nil
+}
+
+// commandArgValues returns the cmd-arg values of t and their size joined by spaces
+func (t Args) commandArgValues() ([]string, int64) {
+	var values []string
+	var size int64
+	for _, arg := range t {
+		a, _, v := arg.ASV()
+		if a != "cmd-arg" {
+			continue
+		}
+		if len(values) > 0 {
+			size++
+		}
+		values = append(values, v)
+		size += int64(len(v))
+	}
+	return values, size
+}
+
+// write streams values to a file named by their hash and retains it
+func (s *ArgSpill) write(values []string, size int64) (ArgRef, error) {
+	f, err := os.CreateTemp(s.dir, ".spill-*")
+	if err != nil {
+		return ArgRef{}, fmt.Errorf("unable to create spill file; %w", err)
+	}
+	defer os.Remove(f.Name())
+	h := sha256.New()
+	w := bufio.NewWriter(io.MultiWriter(f, h))
+	for i, v := range values {
+		if i > 0 {
+			w.WriteByte(' ')
+		}
+		w.WriteString(v)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return ArgRef{}, fmt.Errorf("unable to write spill file; %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return ArgRef{}, fmt.Errorf("unable to write spill file; %w", err)
+	}
+	ref := ArgRef{Hash: hex.EncodeToString(h.Sum(nil)), Size: size}
+
+	// the rename and the reference are made under the lock so a concurrent release of the same
+	// content cannot remove the file between them
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Rename(f.Name(), s.path(ref)); err != nil {
+		return ArgRef{}, fmt.Errorf("unable to write spill file; %w", err)
+	}
+	s.retain(ref)
+	argSpilled.Inc()
+	return ref, nil
+}
+
+// retain takes a reference to the file of ref, under the lock of s
+func (s *ArgSpill) retain(ref ArgRef) {
+	if _, ok := s.orphans[ref.Hash]; ok {
+		// already counted in argSpillFiles
+		delete(s.orphans, ref.Hash)
+		s.refs[ref.Hash]++
+		return
+	}
+	if s.refs[ref.Hash] == 0 {
+		argSpillFiles.Inc()
+	}
+	s.refs[ref.Hash]++
+}
+
+// Retain takes a reference to the file of ref, for a record that referenced it in a previous
+// process and is replayed, eg from the spool.  The record releases it with Release once it is
+// written, as if it had been spilled by this process.
+func (s *ArgSpill) Retain(ref ArgRef) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := os.Stat(s.path(ref)); err != nil {
+		return fmt.Errorf("arg reference [%v] has no spill file; %w", ref, err)
+	}
+	s.retain(ref)
+	return nil
+}
+
+// Collect removes the files left by a previous process that were not retained and were written
+// before before, and returns how many it removed.  Files spilled or retained by this process are
+// removed by Release instead.
+func (s *ArgSpill) Collect(before time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var removed int
+	for hash, written := range s.orphans {
+		if !written.Before(before) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.dir, hash)); err != nil && !os.IsNotExist(err) {
+			continue
+		}
+		delete(s.orphans, hash)
+		argSpillFiles.Dec()
+		argSpillCollected.Inc()
+		removed++
+	}
+	return removed
+}
+
+// path returns the file of ref
+func (s *ArgSpill) path(ref ArgRef) string {
+	return filepath.Join(s.dir, ref.Hash)
+}
+
+// Open returns the spilled values of ref, for sinks that need full fidelity.  It is called while
+// the record referencing ref is retained, ie before it is released.
+func (s *ArgSpill) Open(ref ArgRef) (io.ReadCloser, error) {
+	return os.Open(s.path(ref))
+}
+
+// Release drops a reference to the file of ref, taken by Args.Spill or Retain, and removes the
+// file once no records reference it.  Records that are spooled rather than written are not
+// released, so their files remain for whatever replays the spool.  Releasing a file left by a
+// previous process that was not retained does nothing, as other records may reference it, it is
+// removed by Collect.
+func (s *ArgSpill) Release(ref ArgRef) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.orphans[ref.Hash]; ok {
+		return nil
+	}
+	n, ok := s.refs[ref.Hash]
+	if !ok {
+		return fmt.Errorf("arg reference [%v] is not retained", ref)
+	}
+	if n > 1 {
+		s.refs[ref.Hash] = n - 1
+		return nil
+	}
+	delete(s.refs, ref.Hash)
+	argSpillFiles.Dec()
+	if err := os.Remove(s.path(ref)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to remove spill file; %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// spillTestArgs returns the args of a command whose cmd-arg values are n values of size bytes
+func spillTestArgs(n, size int) Args {
+	args := Args{"service=shell", "cmd=configure"}
+	for i := 0; i < n; i++ {
+		args.Append("cmd-arg=" + strings.Repeat(string(rune('a'+i%26)), size))
+	}
+	return args
+}
+
+// spillFiles returns the spill files in dir
+func spillFiles(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestArgSpillThreshold(t *testing.T) {
+	_, err := NewArgSpill(t.TempDir(), 0)
+	assert.Error(t, err)
+	dir := t.TempDir()
+	s, err := NewArgSpill(dir, 100)
+	require.NoError(t, err)
+
+	// two values of 49 bytes and their separator are exactly the threshold
+	at := spillTestArgs(2, 49)
+	kept, err := at.Spill(s)
+	require.NoError(t, err)
+	assert.Equal(t, at, kept)
+	_, ok := kept.Ref()
+	assert.False(t, ok)
+	assert.Empty(t, spillFiles(t, dir))
+
+	over := spillTestArgs(2, 50)
+	spilled, err := over.Spill(s)
+	require.NoError(t, err)
+	ref, ok := spilled.Ref()
+	require.True(t, ok)
+	sum := sha256.Sum256([]byte(over.CommandArgs()))
+	assert.Equal(t, ArgRef{Hash: hex.EncodeToString(sum[:]), Size: 101}, ref)
+	assert.Equal(t, Args{"service=shell", "cmd=configure", Arg("cmd-arg-spill=" + ref.String())}, spilled)
+	assert.Equal(t, "configure", spilled.Command())
+	assert.Equal(t, []string{ref.Hash}, spillFiles(t, dir))
+
+	// sinks that need the values read them back while the record is retained
+	f, err := s.Open(ref)
+	require.NoError(t, err)
+	b, err := io.ReadAll(f)
+	f.Close()
+	require.NoError(t, err)
+	assert.Equal(t, over.CommandArgs(), string(b))
+
+	parsed, err := ParseArgRef(ref.String())
+	require.NoError(t, err)
+	assert.Equal(t, ref, parsed)
+	for _, bad := range []string{"", "md5:00:1", "sha256:zz:1", "sha256:" + ref.Hash + ":-1"} {
+		_, err := ParseArgRef(bad)
+		assert.Error(t, err, bad)
+	}
+
+	require.NoError(t, s.Release(ref))
+	assert.Empty(t, spillFiles(t, dir))
+	assert.Error(t, s.Release(ref))
+}
+
+func TestArgSpillConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewArgSpill(dir, 10)
+	require.NoError(t, err)
+	files := metricValue(argSpillFiles)
+
+	// half the requests push the same config, the others each push their own
+	const requests = 50
+	type spillResult struct {
+		i    int
+		args Args
+		err  error
+	}
+	results := make(chan spillResult, requests)
+	for i := 0; i < requests; i++ {
+		go func(i int) {
+			args := spillTestArgs(100, 200)
+			if i%2 == 1 {
+				args.Append(fmt.Sprintf("cmd-arg=request-%d", i))
+			}
+			spilled, err := args.Spill(s)
+			results <- spillResult{i: i, args: spilled, err: err}
+		}(i)
+	}
+	refs := make([]ArgRef, requests)
+	for n := 0; n < requests; n++ {
+		r := <-results
+		require.NoError(t, r.err)
+		ref, ok := r.args.Ref()
+		require.True(t, ok)
+		refs[r.i] = ref
+	}
+	assert.Len(t, spillFiles(t, dir), 1+requests/2)
+	assert.Equal(t, files+1+requests/2, metricValue(argSpillFiles))
+
+	// the shared file is kept until every record referencing it is released
+	for i := 0; i < requests-2; i += 2 {
+		require.NoError(t, s.Release(refs[i]))
+	}
+	f, err := s.Open(refs[0])
+	require.NoError(t, err)
+	f.Close()
+	for i := 1; i < requests; i += 2 {
+		require.NoError(t, s.Release(refs[i]))
+	}
+	assert.Equal(t, []string{refs[0].Hash}, spillFiles(t, dir))
+	require.NoError(t, s.Release(refs[requests-2]))
+	assert.Empty(t, spillFiles(t, dir))
+	assert.Equal(t, files, metricValue(argSpillFiles))
+}
+
+func TestArgSpillRecovered(t *testing.T) {
+	dir := t.TempDir()
+	previous, err := NewArgSpill(dir, 10)
+	require.NoError(t, err)
+	spilled, err := spillTestArgs(2, 20).Spill(previous)
+	require.NoError(t, err)
+	replayed, _ := spilled.Ref()
+	spilled, err = spillTestArgs(3, 20).Spill(previous)
+	require.NoError(t, err)
+	stale, _ := spilled.Ref()
+	// a write the previous process did not complete
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".spill-123"), []byte("partial"), 0600))
+	files := metricValue(argSpillFiles)
+
+	// the files of a previous process are kept, and their references are not lost
+	s, err := NewArgSpill(dir, 10)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{replayed.Hash, stale.Hash}, spillFiles(t, dir))
+	assert.Equal(t, files+2, metricValue(argSpillFiles))
+	assert.NoError(t, s.Release(stale), "other records of the previous process may reference it")
+	assert.Len(t, spillFiles(t, dir), 2)
+
+	// a replayed record retains its file, which is removed once it is released
+	require.NoError(t, s.Retain(replayed))
+	assert.Error(t, s.Retain(ArgRef{Hash: strings.Repeat("0", 64)}))
+	assert.Equal(t, 1, s.Collect(time.Now().Add(time.Hour)), "the stale file is collected, the retained one is not")
+	assert.Equal(t, []string{replayed.Hash}, spillFiles(t, dir))
+	require.NoError(t, s.Release(replayed))
+	assert.Empty(t, spillFiles(t, dir))
+	assert.Equal(t, files, metricValue(argSpillFiles))
+}
+
+func TestArgSpillCollect(t *testing.T) {
+	dir := t.TempDir()
+	previous, err := NewArgSpill(dir, 10)
+	require.NoError(t, err)
+	spilled, err := spillTestArgs(2, 20).Spill(previous)
+	require.NoError(t, err)
+	ref, _ := spilled.Ref()
+	written := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, ref.Hash), written, written))
+
+	s, err := NewArgSpill(dir, 10)
+	require.NoError(t, err)
+	collected := metricValue(argSpillCollected)
+	assert.Equal(t, 0, s.Collect(written), "files are kept for their retention")
+	assert.Equal(t, []string{ref.Hash}, spillFiles(t, dir))
+	assert.Equal(t, 1, s.Collect(time.Now().Add(-time.Hour)))
+	assert.Empty(t, spillFiles(t, dir))
+	assert.Equal(t, collected+1, metricValue(argSpillCollected))
+}
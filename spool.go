@@ -0,0 +1,325 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+// Spool files outlive the binaries that write them, a rollback reads what a newer release wrote
+// and an upgrade what an older one did, so the format is versioned and self-describing.
+//
+// A spool file is a sequence of segments, one per Spool call, so binaries of any version may
+// append to it.  A segment is:
+//
+//	magic        4 bytes, 0x89 T Q S
+//	major        1 byte
+//	minor        1 byte
+//	header size  uint16
+//	header       the fields of the segment, in order:
+//	               sink  uint16 length, then the name of the sink
+//	records      until the next magic or the end of the file, each:
+//	               size  uint32
+//	               crc   uint32, crc32c of the payload
+//	               payload:
+//	                 count  uint16
+//	                 count attributes, each a uint16 length and a key, then a uint32 length and a value
+//
+// All integers are big endian.  A minor version may only add fields at the end of the header or
+// of a payload, which readers of an older minor skip, as the sizes before them tell where they
+// end.  Anything else is a new major version, which readers refuse with a *SpoolVersionError.
+//
+// Releases before the format spooled json lines, one object per record, which readers still
+// accept as version 0.  A file they wrote may go on as segments.
+const (
+	// SpoolMajorVersion is the major version of the segments this release writes and reads
+	SpoolMajorVersion uint8 = 1
+	// SpoolMinorVersion is the minor version of the segments this release writes
+	SpoolMinorVersion uint8 = 0
+	// MaxSpoolRecordSize is the size past which a record is taken to be corrupt
+	MaxSpoolRecordSize = 16 << 20
+)
+
+// spoolMagic starts every segment.  Its first byte is never the start of a json line.
+var spoolMagic = []byte{0x89, 'T', 'Q', 'S'}
+
+// spoolCRC is the crc32c table of record payloads
+var spoolCRC = crc32.MakeTable(crc32.Castagnoli)
+
+// SpoolVersionError is returned for a segment of a major version this release cannot read
+type SpoolVersionError struct {
+	Major  uint8
+	Minor  uint8
+	Offset int64
+}
+
+// Error implements error
+func (e *SpoolVersionError) Error() string {
+	return fmt.Sprintf("spool segment at offset [%v] is format version [%v.%v], this release reads major version [%v] only", e.Offset, e.Major, e.Minor, SpoolMajorVersion)
+}
+
+// SpoolReadReport counts what ReadSpool read
+type SpoolReadReport struct {
+	// Segments are the segments read, legacy json lines are not in one
+	Segments int
+	// Records are the records passed on, of any version
+	Records int
+	// Corrupt are the records skipped, for a crc that does not match their payload, a payload that
+	// does not decode, or a file that ends part way through them
+	Corrupt int
+}
+
+// appendSpoolSegment appends the start of a segment of sink to b
+func appendSpoolSegment(b []byte, sink string) []byte {
+	header := appendUint16(nil, len(sink))
+	header = append(header, sink...)
+	b = append(b, spoolMagic...)
+	b = append(b, SpoolMajorVersion, SpoolMinorVersion)
+	b = appendUint16(b, len(header))
+	return append(b, header...)
+}
+
+// appendSpoolRecord appends record to b, with its attributes in the order of their keys so the
+// same record is always the same bytes
+func appendSpoolRecord(b []byte, record map[string]string) ([]byte, error) {
+	if len(record) > 0xffff {
+		return b, &LengthError{Field: "spool record attributes", Length: int64(len(record)), Max: 0xffff}
+	}
+	keys := make([]string, 0, len(record))
+	for k := range record {
+		if len(k) > 0xffff {
+			return b, &LengthError{Field: "spool record key", Length: int64(len(k)), Max: 0xffff}
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	payload := appendUint16(nil, len(keys))
+	for _, k := range keys {
+		payload = appendUint16(payload, len(k))
+		payload = append(payload, k...)
+		payload = appendUint32(payload, uint32(len(record[k])))
+		payload = append(payload, record[k]...)
+	}
+	if len(payload) > MaxSpoolRecordSize {
+		return b, &LengthError{Field: "spool record", Length: int64(len(payload)), Max: MaxSpoolRecordSize}
+	}
+	b = appendUint32(b, uint32(len(payload)))
+	b = appendUint32(b, crc32.Checksum(payload, spoolCRC))
+	return append(b, payload...), nil
+}
+
+// appendUint32 appends i to b, big endian
+func appendUint32(b []byte, i uint32) []byte {
+	return append(b, byte(i>>24), byte(i>>16), byte(i>>8), byte(i))
+}
+
+// decodeSpoolPayload decodes the attributes of a record payload, skipping the fields of newer
+// minor versions after them
+func decodeSpoolPayload(payload []byte) (map[string]string, error) {
+	r := bytes.NewReader(payload)
+	var count uint16
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return nil, err
+	}
+	record := make(map[string]string, count)
+	for i := 0; i < int(count); i++ {
+		var klen uint16
+		if err := binary.Read(r, binary.BigEndian, &klen); err != nil {
+			return nil, err
+		}
+		k := make([]byte, klen)
+		if _, err := io.ReadFull(r, k); err != nil {
+			return nil, err
+		}
+		var vlen uint32
+		if err := binary.Read(r, binary.BigEndian, &vlen); err != nil {
+			return nil, err
+		}
+		if int64(vlen) > int64(r.Len()) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		v := make([]byte, vlen)
+		if _, err := io.ReadFull(r, v); err != nil {
+			return nil, err
+		}
+		record[string(k)] = string(v)
+	}
+	return record, nil
+}
+
+// ReadSpool reads the spooled records of r in order and passes each to fn with the sink it was
+// spooled for, which is empty for legacy json lines.  Corrupt records are skipped and counted,
+// rather than ending the replay.  A segment of another major version ends it with a
+// *SpoolVersionError, as do errors from reading r or from fn.
+func ReadSpool(r io.Reader, fn func(sink string, record map[string]string) error) (SpoolReadReport, error) {
+	sr := &spoolReader{r: bufio.NewReader(r)}
+	err := sr.read(fn)
+	spoolCorrupt.Add(float64(sr.report.Corrupt))
+	return sr.report, err
+}
+
+// spoolReader reads a spool file, see ReadSpool
+type spoolReader struct {
+	r      *bufio.Reader
+	offset int64
+	report SpoolReadReport
+	// sink is the sink of the segment being read, empty outside of one
+	sink string
+	// segment is set while reading the records of a segment
+	segment bool
+}
+
+func (s *spoolReader) read(fn func(sink string, record map[string]string) error) error {
+	for {
+		next, err := s.r.Peek(len(spoolMagic))
+		if len(next) == 0 {
+			return s.truncated(err)
+		}
+		switch {
+		case bytes.Equal(next, spoolMagic):
+			if err := s.readSegment(); err != nil {
+				return err
+			}
+			continue
+		case !s.segment:
+			if err := s.readLegacy(fn); err != nil {
+				return err
+			}
+			continue
+		}
+		record, err := s.readRecord()
+		if err != nil {
+			return err
+		}
+		if record == nil {
+			continue
+		}
+		s.report.Records++
+		if err := fn(s.sink, record); err != nil {
+			return err
+		}
+	}
+}
+
+// readSegment reads the start of a segment
+func (s *spoolReader) readSegment() error {
+	start := s.offset
+	var fixed [8]byte
+	if _, err := s.readFull(fixed[:]); err != nil {
+		// a segment cut off before its records has none to lose
+		return s.truncated(err)
+	}
+	major, minor := fixed[4], fixed[5]
+	if major != SpoolMajorVersion {
+		return &SpoolVersionError{Major: major, Minor: minor, Offset: start}
+	}
+	header := make([]byte, binary.BigEndian.Uint16(fixed[6:]))
+	if _, err := s.readFull(header); err != nil {
+		return s.truncated(err)
+	}
+	if len(header) < 2 || len(header) < 2+int(binary.BigEndian.Uint16(header)) {
+		return fmt.Errorf("spool segment at offset [%v] has a malformed header", start)
+	}
+	// fields of newer minor versions follow the sink, and are skipped with the header
+	s.sink = string(header[2 : 2+binary.BigEndian.Uint16(header)])
+	s.segment = true
+	s.report.Segments++
+	return nil
+}
+
+// readRecord reads a record of a segment, it returns a nil record for a corrupt one it skipped
+func (s *spoolReader) readRecord() (map[string]string, error) {
+	var fixed [8]byte
+	if _, err := s.readFull(fixed[:]); err != nil {
+		return nil, s.truncatedRecord(err)
+	}
+	size := binary.BigEndian.Uint32(fixed[:4])
+	if size > MaxSpoolRecordSize {
+		// the size itself is corrupt, so where the next record starts is unknown
+		s.report.Corrupt++
+		return nil, s.resync()
+	}
+	payload := make([]byte, size)
+	if _, err := s.readFull(payload); err != nil {
+		return nil, s.truncatedRecord(err)
+	}
+	if crc32.Checksum(payload, spoolCRC) != binary.BigEndian.Uint32(fixed[4:]) {
+		s.report.Corrupt++
+		return nil, nil
+	}
+	record, err := decodeSpoolPayload(payload)
+	if err != nil {
+		s.report.Corrupt++
+		return nil, nil
+	}
+	return record, nil
+}
+
+// readLegacy reads a json line spooled before the format, skipping one that does not decode
+func (s *spoolReader) readLegacy(fn func(sink string, record map[string]string) error) error {
+	line, err := s.r.ReadBytes('\n')
+	s.offset += int64(len(line))
+	if err != nil && err != io.EOF {
+		return err
+	}
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return nil
+	}
+	var record map[string]string
+	if err := json.Unmarshal(line, &record); err != nil {
+		s.report.Corrupt++
+		return nil
+	}
+	s.report.Records++
+	return fn("", record)
+}
+
+// resync skips to the next segment, or the end of the file, counting nothing it skips
+func (s *spoolReader) resync() error {
+	for {
+		next, err := s.r.Peek(len(spoolMagic))
+		if bytes.Equal(next, spoolMagic) || len(next) == 0 {
+			return s.truncated(err)
+		}
+		s.r.Discard(1)
+		s.offset++
+	}
+}
+
+// readFull reads len(b) bytes, keeping track of the offset
+func (s *spoolReader) readFull(b []byte) (int, error) {
+	n, err := io.ReadFull(s.r, b)
+	s.offset += int64(n)
+	return n, err
+}
+
+// truncated returns nil for a file that ends part way through, as it does when the writer was
+// killed, and any other error as is
+func (s *spoolReader) truncated(err error) error {
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
+
+// truncatedRecord is truncated for a record, which is corrupt if the file ends part way through it
+func (s *spoolReader) truncatedRecord(err error) error {
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		s.report.Corrupt++
+	}
+	return s.truncated(err)
+}
@@ -0,0 +1,170 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// spoolFixtures are frozen spool files of each format version, written by hand rather than by the
+// current writer so a change to the format can not change them too.  They are never regenerated;
+// a new version adds files of its own.
+var spoolFixtures = filepath.Join("testdata", "spool")
+
+// spoolTestRecords are the accounting records of the fixtures
+var spoolTestRecords = []map[string]string{
+	{"task_id": "1", "user": "alice", "cmd": "show version"},
+	{"task_id": "2", "user": "bob", "cmd": "configure terminal", "stop_time": "1609459200"},
+}
+
+// spooledRecord is a record and the sink it was read for
+type spooledRecord struct {
+	sink   string
+	record map[string]string
+}
+
+// readSpoolFixture reads the fixture name with ReadSpool
+func readSpoolFixture(t *testing.T, name string) ([]spooledRecord, SpoolReadReport, error) {
+	b, err := os.ReadFile(filepath.Join(spoolFixtures, name))
+	require.NoError(t, err)
+	var records []spooledRecord
+	report, err := ReadSpool(bytes.NewReader(b), func(sink string, record map[string]string) error {
+		records = append(records, spooledRecord{sink: sink, record: record})
+		return nil
+	})
+	return records, report, err
+}
+
+func TestSpoolVersions(t *testing.T) {
+	acct := []spooledRecord{{"acct", spoolTestRecords[0]}, {"acct", spoolTestRecords[1]}}
+	tests := []struct {
+		name    string
+		fixture string
+		records []spooledRecord
+		report  SpoolReadReport
+	}{
+		{
+			// the json lines of releases before the format, read as version 0
+			name:    "older release",
+			fixture: "v0-legacy.spool",
+			records: []spooledRecord{{"", spoolTestRecords[0]}, {"", spoolTestRecords[1]}},
+			report:  SpoolReadReport{Records: 2},
+		},
+		{
+			name:    "this release",
+			fixture: "v1.0-acct.spool",
+			records: acct,
+			report:  SpoolReadReport{Segments: 1, Records: 2},
+		},
+		{
+			name:    "correlation snapshot",
+			fixture: "v1.0-correlation.spool",
+			records: []spooledRecord{{"correlation", map[string]string{
+				"device":            "192.0.2.1",
+				"user":              "alice",
+				"port":              "tty0",
+				"rem-addr":          "",
+				"cmd":               "show",
+				"cmd-args":          "version",
+				"author-session-id": "0x0000002a",
+				"author-status":     "PassAdd",
+				"author-event-time": "2021-01-01T00:00:00Z",
+				DecisionIDAttribute: "d1",
+			}}},
+			report: SpoolReadReport{Segments: 1, Records: 1},
+		},
+		{
+			// a newer minor release added a header field and a field to every record
+			name:    "newer minor release",
+			fixture: "v1.1-acct.spool",
+			records: acct,
+			report:  SpoolReadReport{Segments: 1, Records: 2},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			records, report, err := readSpoolFixture(t, test.fixture)
+			require.NoError(t, err)
+			assert.Equal(t, test.records, records)
+			assert.Equal(t, test.report, report)
+		})
+	}
+}
+
+func TestSpoolIncompatibleMajor(t *testing.T) {
+	records, report, err := readSpoolFixture(t, "v2.0-acct.spool")
+	var ve *SpoolVersionError
+	require.True(t, errors.As(err, &ve), err)
+	assert.Equal(t, SpoolVersionError{Major: 2, Minor: 0, Offset: 74}, *ve)
+	assert.Contains(t, err.Error(), "version [2.0]")
+	// the segment before it was read
+	assert.Equal(t, []spooledRecord{{"acct", spoolTestRecords[0]}}, records)
+	assert.Equal(t, SpoolReadReport{Segments: 1, Records: 1}, report)
+}
+
+func TestSpoolCorrupt(t *testing.T) {
+	records, report, err := readSpoolFixture(t, "v1.0-corrupt.spool")
+	require.NoError(t, err, "corrupt records are skipped, not fatal")
+	assert.Equal(t, []spooledRecord{
+		{"", map[string]string{"task_id": "0"}},
+		// the first record of the segment fails its crc
+		{"acct", spoolTestRecords[1]},
+		// the size of the next one is corrupt, the rest of the segment is skipped up to the next
+		{"acct", spoolTestRecords[0]},
+		// whose last record is cut off
+	}, records)
+	assert.Equal(t, SpoolReadReport{Segments: 2, Records: 3, Corrupt: 4}, report)
+}
+
+func TestFileSpoolFormat(t *testing.T) {
+	// the writer of this release writes the frozen fixture of its version byte for byte
+	spool := NewFileSpool(t.TempDir())
+	n, err := spool.Spool(context.Background(), "acct", spoolTestRecords)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	written, err := os.ReadFile(spool.Path("acct"))
+	require.NoError(t, err)
+	frozen, err := os.ReadFile(filepath.Join(spoolFixtures, "v1.0-acct.spool"))
+	require.NoError(t, err)
+	assert.Equal(t, frozen, written)
+}
+
+func TestFileSpoolAppend(t *testing.T) {
+	// a rollback appends to what an older release spooled, and every record of both is read
+	spool := NewFileSpool(t.TempDir())
+	legacy, err := os.ReadFile(filepath.Join(spoolFixtures, "v0-legacy.spool"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(spool.Path("acct"), legacy, 0600))
+	for _, r := range spoolTestRecords {
+		_, err := spool.Spool(context.Background(), "acct", []map[string]string{r})
+		require.NoError(t, err)
+	}
+	_, err = spool.Spool(context.Background(), "acct", nil)
+	require.NoError(t, err)
+
+	var records []map[string]string
+	report, err := spool.Read("acct", func(record map[string]string) error {
+		records = append(records, record)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, append(append([]map[string]string(nil), spoolTestRecords...), spoolTestRecords...), records)
+	assert.Equal(t, SpoolReadReport{Segments: 2, Records: 4}, report, "spooling nothing adds no segment")
+
+	report, err = NewFileSpool(t.TempDir()).Read("acct", func(map[string]string) error { return nil })
+	assert.NoError(t, err, "a sink that spooled nothing")
+	assert.Equal(t, SpoolReadReport{}, report)
+}
@@ -8,131 +8,228 @@
 package tacquito
 
 import (
-	"github.com/prometheus/client_golang/prometheus"
+	"sort"
+	"sync/atomic"
+	"time"
 )
 
+// The metrics of the package discard their values until SetMetrics creates them with a Metrics.
+
 var (
 	// gauges and counters
-	serveAccepted = prometheus.NewGauge(prometheus.GaugeOpts{
-		Namespace: "tacquito",
-		Name:      "serve_accepted",
-		Help:      "number of accepted connections within the server",
-	})
-	serveAcceptedError = prometheus.NewCounter(prometheus.CounterOpts{
-		Namespace: "tacquito",
-		Name:      "serve_accepted_error",
-		Help:      "number of accepted connection errors within the server",
-	})
-	handlers = prometheus.NewGauge(prometheus.GaugeOpts{
-		Namespace: "tacquito",
-		Name:      "handle_handlers",
-		Help:      "number of handlers running within the server",
-	})
-	crypterRead = prometheus.NewCounter(prometheus.CounterOpts{
-		Namespace: "tacquito",
-		Name:      "crypter_read",
-		Help:      "number of crypt reads within the server",
-	})
-	crypterReadError = prometheus.NewCounter(prometheus.CounterOpts{
-		Namespace: "tacquito",
-		Name:      "crypter_read_error",
-		Help:      "number of crypt read errors within the server",
-	})
-	crypterWrite = prometheus.NewCounter(prometheus.CounterOpts{
-		Namespace: "tacquito",
-		Name:      "crypter_write",
-		Help:      "number of crypt writes within the server",
-	})
-	crypterWriteError = prometheus.NewCounter(prometheus.CounterOpts{
-		Namespace: "tacquito",
-		Name:      "crypter_write_error",
-		Help:      "number of crypt write errors within the server",
-	})
-	crypterBadSecret = prometheus.NewCounter(prometheus.CounterOpts{
-		Namespace: "tacquito",
-		Name:      "crypter_badSecret",
-		Help:      "number of bad secrets",
-	})
-	crypterUnmarshalError = prometheus.NewCounter(prometheus.CounterOpts{
-		Namespace: "tacquito",
-		Name:      "crypter_unmarshal_error",
-		Help:      "number of errors unmarshalling in crypter",
-	})
-	crypterCryptError = prometheus.NewCounter(prometheus.CounterOpts{
-		Namespace: "tacquito",
-		Name:      "crypter_crypt_error",
-		Help:      "number of errors in crypter crypt()",
-	})
-	crypterMarshalError = prometheus.NewCounter(prometheus.CounterOpts{
-		Namespace: "tacquito",
-		Name:      "crypter_marshal_error",
-		Help:      "number of errors marshalling in crypter",
-	})
-	waitgroupActive = prometheus.NewGauge(prometheus.GaugeOpts{
-		Namespace: "tacquito",
-		Name:      "waitgroup_handle_routines_active",
-		Help:      "number of active waitgroup go routines within the server",
-	})
-	sessionsActive = prometheus.NewGauge(prometheus.GaugeOpts{
-		Namespace: "tacquito",
-		Name:      "sessions_active",
-		Help:      "number of active sessions within the server",
-	})
-	sessionsGetHit = prometheus.NewCounter(prometheus.CounterOpts{
-		Namespace: "tacquito",
-		Name:      "sessions_get_hit",
-		Help:      "number of session cache hits within the server",
-	})
-	sessionsGetMiss = prometheus.NewCounter(prometheus.CounterOpts{
-		Namespace: "tacquito",
-		Name:      "sessions_get_miss",
-		Help:      "number of session cache misses within the server",
-	})
-	sessionsSet = prometheus.NewCounter(prometheus.CounterOpts{
-		Namespace: "tacquito",
-		Name:      "sessions_set",
-		Help:      "number of session set in the cache",
-	})
+	serveAccepted              = newGauge("serve_accepted", "number of accepted connections within the server")
+	serveAcceptedError         = newCounter("serve_accepted_error", "number of accepted connection errors within the server")
+	handlers                   = newGauge("handle_handlers", "number of handlers running within the server")
+	crypterRead                = newCounter("crypter_read", "number of crypt reads within the server")
+	crypterReadError           = newCounter("crypter_read_error", "number of crypt read errors within the server")
+	crypterWrite               = newCounter("crypter_write", "number of crypt writes within the server")
+	crypterWriteError          = newCounter("crypter_write_error", "number of crypt write errors within the server")
+	crypterBadSecret           = newCounter("crypter_badSecret", "number of bad secrets")
+	crypterWrongDirection      = newCounterVec("crypter_wrong_direction", "number of packets read whose body decoded only as one of the opposite direction, eg a reply sent to the server, by packet type", "type")
+	crypterProxyHeaderParsed   = newCounter("crypter_proxy_header_parsed", "number of ha-proxy style headers read and parsed")
+	crypterProxyHeaderError    = newCounterVec("crypter_proxy_header_error", "number of ha-proxy style headers that could not be read or parsed, by stage; read or parse", "stage")
+	crypterUnencryptedRejected = newCounterVec("crypter_unencrypted_rejected", "number of packets sent with the unencrypted flag that were rejected, see SetRejectUnencrypted, by packet type", "type")
+	crypterSeqError            = newCounterVec("crypter_seq_error", "number of requests whose sequence number broke their session, by reason; even, first, order or wrap", "reason")
+	crypterUnmarshalError      = newCounter("crypter_unmarshal_error", "number of errors unmarshalling in crypter")
+	crypterPadIterations       = newHistogram("crypter_pad_iterations", "number of md5 iterations computed to obfuscate or deobfuscate a body, one per 16 bytes", exponentialBuckets(1, 4, 7))
+	crypterPadCache            = newCounterVec("crypter_pad_cache", "number of pad cache lookups by result, hit or miss, see SetPadCache", "result")
+	crypterPacketsPerSecond    = newGaugeFunc("crypter_packets_per_second", "rate of bodies obfuscated or deobfuscated, averaged over at least 10 seconds", func() float64 {
+		pps, _ := cryptThroughput.rates(time.Now())
+		return pps
+	})
+	crypterBytesPerSecond = newGaugeFunc("crypter_bytes_per_second", "rate of body bytes obfuscated or deobfuscated, averaged over at least 10 seconds", func() float64 {
+		_, bps := cryptThroughput.rates(time.Now())
+		return bps
+	})
+	crypterCryptError           = newCounter("crypter_crypt_error", "number of errors in crypter crypt()")
+	crypterMarshalError         = newCounter("crypter_marshal_error", "number of errors marshalling in crypter")
+	crypterEmptyBody            = newCounterVec("crypter_empty_body", "number of packets read with a zero length body, by packet type", "type")
+	crypterBodyLengthMismatch   = newCounterVec("crypter_body_length_mismatch", "number of requests rejected because their decoded body length disagrees with the header length, by packet type", "type")
+	crypterInvalidReply         = newCounterVec("crypter_invalid_reply", "number of replies rejected before they were written because their body does not decode, by packet type", "type")
+	crypterLengthQuirk          = newCounter("crypter_length_quirk", "number of packets read using a length delta for devices that declare the wrong body length")
+	requestFieldNormalized      = newCounterVec("request_field_normalized", "number of user, port and rem_addr fields normalized, by field and action; nul, space, replace, reject or latin1, see StringNormalization", "field", "action")
+	requestBodyModified         = newCounterVec("request_body_modified", "number of requests whose body a handler modified, see SetBodyOwnershipCheck, by packet type", "type")
+	conformanceViolation        = newCounterVec("conformance_violation", "number of protocol violations seen by the conformance checker, by offending side and rule", "side", "rule")
+	replyOutcomes               = newCounterVec("reply_outcome", "number of replies sent by packet type and status; origin is handler for handler decisions and server for synthesized replies", "type", "status", "origin")
+	teeCompared                 = newCounter("tee_compared", "number of mirrored requests whose primary and secondary decisions were compared")
+	teeDivergence               = newCounterVec("tee_divergence", "number of mirrored requests where the secondary decision differed from the primary, by packet type", "type")
+	tlsHostConnections          = newCounterVec("tls_virtual_host_connections", "number of tls connections routed to each virtual host, by host and route; sni, alpn or default", "host", "route")
+	tlsHostRejected             = newCounter("tls_virtual_host_rejected", "number of tls connections no virtual host serves, which failed their handshake")
+	secretRoleSessions          = newCounterVec("secret_role_sessions", "number of sessions of device groups in a secret cutover, by group and the role of the secret the session was read with", "group", "role")
+	secretIndexSessions         = newCounterVec("secret_index_sessions", "number of sessions of device groups in a secret cutover, by group and the index of the secret the session was read with, 0 is the current secret", "group", "index")
+	crypterSecretFallback       = newCounter("crypter_secret_fallback", "number of sessions of device groups in a secret cutover read with a secret other than the current one")
+	invariantViolation          = newCounterVec("invariant_violation", "number of states reached that tacquito should never reach, by invariant; any is a bug in tacquito", "reason")
+	shutdownUndrained           = newCounter("shutdown_undrained", "number of connections still open when the shutdown drain budget ran out")
+	shutdownFlushed             = newCounterVec("shutdown_flushed", "number of records flushed on shutdown, by sink", "sink")
+	shutdownSpooled             = newCounterVec("shutdown_spooled", "number of records spooled to disk on shutdown because they could not be flushed, by sink", "sink")
+	spoolCorrupt                = newCounter("spool_corrupt_records", "number of spooled records skipped on read because they were corrupt")
+	shutdownLost                = newCounterVec("shutdown_lost", "number of records that could neither be flushed nor spooled on shutdown, by sink", "sink")
+	correlationMatched          = newCounter("correlation_matched", "number of command accounting records correlated with an authorization pass")
+	correlationUnmatched        = newCounter("correlation_unmatched", "number of command accounting records without a prior authorization pass")
+	correlationExpired          = newCounter("correlation_expired", "number of authorization passes that expired before their accounting record arrived")
+	correlationDropped          = newCounter("correlation_dropped", "number of authorization passes not correlated because too many were pending")
+	teeDropped                  = newCounter("tee_dropped", "number of requests not mirrored because the secondary queue was full")
+	teeSessionsExpired          = newCounter("tee_sessions_expired", "number of sessions the secondary continued that were dropped after waiting longer than the tee session timeout for their next request")
+	tracerSessions              = newCounter("tracer_sessions", "number of sessions traced by a tracer filter")
+	waitgroupActive             = newGauge("waitgroup_handle_routines_active", "number of active waitgroup go routines within the server")
+	serveMaintenanceDenied      = newCounter("serve_maintenance_denied", "number of authentications failed because the server is in maintenance mode")
+	denialsByUser               = newCounterVec("denials_by_user", "number of denials by packet type, cause and user; the user is obfuscated, see SetMetricsIdentity", "type", "cause", "user")
+	serveSecretGrace            = newCounter("serve_secret_grace", "number of connections whose secret was removed while they were open, which entered the secret grace period")
+	secretWarmed                = newCounter("secret_warmed", "number of devices whose secret was warmed before serving, see SetSecretWarmup")
+	featureDevicesDropped       = newCounter("feature_devices_dropped", "number of feature records of devices not tracked individually, as the device bound was reached")
+	serveLifetimeRejected       = newCounter("serve_lifetime_rejected", "number of new sessions refused on connections that outlived their maximum lifetime")
+	serveRetiredRejected        = newCounter("serve_retired_rejected", "number of new sessions refused on connections retired by a secret rotation")
+	serveRetiring               = newGauge("serve_connections_retiring", "number of connections retired by a secret rotation that are still open on the old secret")
+	argSpilled                  = newCounter("arg_spilled", "number of requests whose cmd-arg values were over the threshold and spilled to a file")
+	argSpillFailed              = newCounter("arg_spill_failed", "number of requests whose cmd-arg values could not be spilled and were kept in memory")
+	argSpillFiles               = newGauge("arg_spill_files", "number of spill files referenced by records that were not released, or left by a previous process and not yet collected")
+	argSpillCollected           = newCounter("arg_spill_collected", "number of spill files left by a previous process that were removed by ArgSpill.Collect")
+	storeFailures               = newCounterVec("store_failures", "number of requests a feature could not check because its store failed, by feature and failure policy", "feature", "policy")
+	serveInteractiveRejected    = newCounter("serve_interactive_rejected", "number of authentication starts refused as their device was at its quota of interactive sessions")
+	serveUnknownDevice          = newCounter("serve_unknown_device", "number of connections closed because no secret matched the source")
+	sinkTruncated               = newCounterVec("sink_truncated", "number of record values cut to the limits of a sink, by sink", "sink")
+	connectDecisions            = newCounterVec("serve_connect_decisions", "number of connection decisions made by connect funcs, by func and decision", "source", "decision")
+	connectFailures             = newCounterVec("serve_connect_failures", "number of connect funcs that failed to decide, by func and cause, error or timeout", "source", "cause")
+	connectionClosed            = newCounterVec("connection_closed", "number of connections closed by the server, by reason", "reason")
+	handlerTimeouts             = newCounter("handle_handlers_timeout", "number of requests where the handler exceeded the handler timeout")
+	handlerPeerDisconnected     = newCounterVec("handle_handlers_peer_disconnected", "number of requests whose device disconnected while they were handled, by event; cancelled on a reset, write_failed, and reply_dropped for the replies to them", "event")
+	sessionsActive              = newGauge("sessions_active", "number of active sessions within the server")
+	sessionsGetHit              = newCounter("sessions_get_hit", "number of session cache hits within the server")
+	sessionsGetMiss             = newCounter("sessions_get_miss", "number of session cache misses within the server")
+	sessionsSet                 = newCounter("sessions_set", "number of session set in the cache")
+	sessionsReuseSingleConnect  = newCounter("sessions_reuse_single_connect", "number of new sessions started on a connection that negotiated single-connect")
+	sessionsReuseImplicit       = newCounter("sessions_reuse_implicit", "number of new sessions started on a connection that did not negotiate single-connect")
+	sessionsReuseImplicitDenied = newCounter("sessions_reuse_implicit_denied", "number of new sessions rejected because implicit reuse is disabled for the connection")
+	sessionsReuseReplayed       = newCounter("sessions_reuse_replayed", "number of seq 1 packets that reused the sessionID of a completed session on the same connection")
 
 	// durations
-	sessionDurations = prometheus.NewSummary(
-		prometheus.SummaryOpts{
-			Namespace:  "tacquito",
-			Name:       "sessions_duration_milliseconds",
-			Help:       "the time a session is a live within tacquito, in milliseconds",
-			Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
-		},
-	)
-
-	connectionDuration = prometheus.NewSummary(
-		prometheus.SummaryOpts{
-			Namespace:  "tacquito",
-			Name:       "serve_connection_duration_milliseconds",
-			Help:       "total time time of a net.Conn, including overhead, in milliseconds",
-			Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
-		},
-	)
+	sessionDurations = newSummary("sessions_duration_milliseconds", "the time a session is a live within tacquito, in milliseconds")
+
+	// a histogram, not a summary, as every session observes it and a histogram observation is a
+	// lock free increment of one bucket
+	sessionTypeDurations = newHistogramVec("sessions_type_duration_milliseconds", "the time a session is a live within tacquito by packet type, in milliseconds", exponentialBuckets(0.25, 2, 18), "type")
+
+	connectionDuration = newSummary("serve_connection_duration_milliseconds", "total time time of a net.Conn, including overhead, in milliseconds")
 )
 
-func init() {
-	// gauges and counters
-	prometheus.MustRegister(serveAccepted)
-	prometheus.MustRegister(serveAcceptedError)
-	prometheus.MustRegister(handlers)
-	prometheus.MustRegister(crypterRead)
-	prometheus.MustRegister(crypterReadError)
-	prometheus.MustRegister(crypterWrite)
-	prometheus.MustRegister(crypterWriteError)
-	prometheus.MustRegister(crypterBadSecret)
-	prometheus.MustRegister(crypterUnmarshalError)
-	prometheus.MustRegister(crypterMarshalError)
-	prometheus.MustRegister(crypterCryptError)
-	prometheus.MustRegister(waitgroupActive)
-	prometheus.MustRegister(sessionsActive)
-	prometheus.MustRegister(sessionsGetHit)
-	prometheus.MustRegister(sessionsGetMiss)
-	prometheus.MustRegister(sessionsSet)
-	// durations
-	prometheus.MustRegister(sessionDurations)
-	prometheus.MustRegister(connectionDuration)
+// sessionTypeBuckets are the buckets of sessionTypeDurations
+var sessionTypeBuckets = exponentialBuckets(0.25, 2, 18)
+
+// typeDurations observes the durations of the sessions of a packet type, in sessionTypeDurations
+// and in buckets the package keeps for sessionQuantiles, whatever the Metrics
+type typeDurations struct {
+	label string
+	// counts are updated atomically, they are allocated on their own to be 64-bit aligned
+	counts []uint64
+}
+
+// sessionTypes are the typeDurations of each packet type
+var sessionTypes = [...]*typeDurations{
+	Authenticate: newTypeDurations(Authenticate),
+	Authorize:    newTypeDurations(Authorize),
+	Accounting:   newTypeDurations(Accounting),
+}
+
+// newTypeDurations returns the typeDurations of packet type t
+func newTypeDurations(t HeaderType) *typeDurations {
+	// the last count is of the durations above every bucket
+	return &typeDurations{label: t.String(), counts: make([]uint64, len(sessionTypeBuckets)+1)}
+}
+
+// sessionTypeObserver returns the Observer of the session durations of packet type t
+func sessionTypeObserver(t HeaderType) Observer {
+	if int(t) < len(sessionTypes) && sessionTypes[t] != nil {
+		return sessionTypes[t]
+	}
+	return sessionTypeDurations.WithLabelValues(t.String())
+}
+
+// Observe implements Observer
+func (d *typeDurations) Observe(v float64) {
+	sessionTypeDurations.WithLabelValues(d.label).Observe(v)
+	atomic.AddUint64(&d.counts[sort.SearchFloat64s(sessionTypeBuckets, v)], 1)
+}
+
+// sessionQuantiles returns the p50 and p99 of the durations of sessions of type t since the
+// server started, in milliseconds, interpolated within their histogram buckets as
+// histogram_quantile does.  ok is false until a session of t completed.
+func sessionQuantiles(t HeaderType) (p50, p99 float64, ok bool) {
+	if int(t) >= len(sessionTypes) || sessionTypes[t] == nil {
+		return 0, 0, false
+	}
+	counts := make([]uint64, len(sessionTypes[t].counts))
+	var total uint64
+	for i := range counts {
+		counts[i] = atomic.LoadUint64(&sessionTypes[t].counts[i])
+		total += counts[i]
+	}
+	if total == 0 {
+		return 0, 0, false
+	}
+	return bucketQuantile(0.5, sessionTypeBuckets, counts), bucketQuantile(0.99, sessionTypeBuckets, counts), true
+}
+
+// bucketQuantile estimates the q quantile of the observations counted in each bucket of bounds,
+// the last count being of those above every bound, by linear interpolation within the bucket it
+// falls in.  Observations above the last bucket are reported as its upper bound.
+func bucketQuantile(q float64, bounds []float64, counts []uint64) float64 {
+	var total uint64
+	for _, c := range counts {
+		total += c
+	}
+	rank := q * float64(total)
+	var lower, below float64
+	for i, bound := range bounds {
+		count := below + float64(counts[i])
+		if count >= rank {
+			return lower + (bound-lower)*(rank-below)/(count-below)
+		}
+		lower, below = bound, count
+	}
+	return lower
+}
+
+// batchedSink commits a tally with a single add to each counter it moved, and resolves each
+// labeled counter once per connection rather than once per observation
+type batchedSink struct{}
+
+func (batchedSink) commit(t *requestTally) {
+	addCount(crypterRead, t.reads)
+	addCount(crypterWrite, t.writes)
+	addCount(sessionsGetHit, t.sessionHits)
+	addCount(sessionsGetMiss, t.sessionMisses)
+	addCount(sessionsSet, t.sessionSets)
+	for _, iterations := range t.padIterations[:t.pads] {
+		crypterPadIterations.Observe(float64(iterations))
+	}
+	for _, c := range t.labeled {
+		resolved, ok := t.counters[c.tallyKey]
+		if !ok {
+			resolved = labeledCounter(c.tallyKey)
+			if t.counters == nil {
+				t.counters = make(map[tallyKey]Counter)
+			}
+			t.counters[c.tallyKey] = resolved
+		}
+		resolved.Add(float64(c.n))
+		if c.metric == tallyReplyOutcome {
+			replyTotals.add(c.values[0], c.values[1], c.n)
+		}
+	}
+}
+
+// addCount adds n to c, if n is not zero
+func addCount(c Counter, n int) {
+	if n != 0 {
+		c.Add(float64(n))
+	}
+}
+
+// labeledCounter resolves the labeled counter of k
+func labeledCounter(k tallyKey) Counter {
+	switch k.metric {
+	case tallyDenial:
+		return denialsByUser.WithLabelValues(k.values[:]...)
+	}
+	return replyOutcomes.WithLabelValues(k.values[:]...)
 }
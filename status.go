@@ -0,0 +1,107 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// statusWindow is how far back ServerStatus.RecentCloses reaches, in statusBucket sized buckets
+const (
+	statusWindow = 15 * time.Minute
+	statusBucket = time.Minute
+)
+
+// ServerStatus is a snapshot of a running server, see Server.Status.  It is served as json by the
+// admin status page, so fields are only ever added and never renamed.  It must never hold secret
+// material or usernames.
+type ServerStatus struct {
+	// Uptime is how long ago the server was created, in seconds
+	Uptime int64 `json:"uptime_seconds"`
+	// Connections is the number of open connections
+	Connections int64 `json:"connections"`
+	// Sessions is the number of sessions in flight over all connections
+	Sessions int64 `json:"sessions"`
+	// Maintenance is true while new authentications are failed, see StartMaintenance
+	Maintenance       bool   `json:"maintenance"`
+	MaintenanceDetail string `json:"maintenance_detail,omitempty"`
+	// Shutdown is the shutdown stage, ShutdownServing until the server is asked to stop
+	Shutdown ShutdownStage `json:"shutdown"`
+	// MaxConnectionLifetime and SecretGracePeriod are in seconds, zero is unset
+	MaxConnectionLifetime int64 `json:"max_connection_lifetime_seconds"`
+	SecretGracePeriod     int64 `json:"secret_grace_period_seconds"`
+	// RecentCloses counts the connections closed within RecentWindow by every reason other than
+	// CloseClientEOF, which is a client hanging up as usual
+	RecentWindow int64            `json:"recent_window_seconds"`
+	RecentCloses map[string]int64 `json:"recent_closes"`
+}
+
+// Status returns a snapshot of s.  It is safe to call while the server runs.
+func (s *Server) Status() ServerStatus {
+	detail, on := s.Maintenance()
+	return ServerStatus{
+		Uptime:                int64(time.Since(s.started) / time.Second),
+		Connections:           s.Active(),
+		Sessions:              atomic.LoadInt64(&s.sessions),
+		Maintenance:           on,
+		MaintenanceDetail:     detail,
+		Shutdown:              s.ShutdownProgress().Stage,
+		MaxConnectionLifetime: int64(s.maxLifetime / time.Second),
+		SecretGracePeriod:     int64(s.secretGrace / time.Second),
+		RecentWindow:          int64(statusWindow / time.Second),
+		RecentCloses:          s.recentCloses.counts(s.clock()),
+	}
+}
+
+// closeBucket counts the close reasons of one statusBucket
+type closeBucket struct {
+	start  time.Time
+	counts map[CloseReason]int64
+}
+
+// closeWindow counts close reasons over the last statusWindow
+type closeWindow struct {
+	mu      sync.Mutex
+	buckets []closeBucket
+}
+
+// add counts reason at now
+func (w *closeWindow) add(now time.Time, reason CloseReason) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	start := now.Truncate(statusBucket)
+	if n := len(w.buckets); n == 0 || !w.buckets[n-1].start.Equal(start) {
+		w.buckets = append(w.expire(now), closeBucket{start: start, counts: map[CloseReason]int64{}})
+	}
+	w.buckets[len(w.buckets)-1].counts[reason]++
+}
+
+// expire drops the buckets that fell out of the window, the caller holds mu
+func (w *closeWindow) expire(now time.Time) []closeBucket {
+	i := 0
+	for i < len(w.buckets) && !w.buckets[i].start.After(now.Add(-statusWindow)) {
+		i++
+	}
+	return w.buckets[i:]
+}
+
+// counts sums the buckets still within the window at now
+func (w *closeWindow) counts(now time.Time) map[string]int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buckets = w.expire(now)
+	counts := map[string]int64{}
+	for _, b := range w.buckets {
+		for reason, n := range b.counts {
+			counts[string(reason)] += n
+		}
+	}
+	return counts
+}
@@ -0,0 +1,62 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCloseWindow(t *testing.T) {
+	start := time.Date(2026, 1, 2, 3, 4, 0, 0, time.UTC)
+	var w closeWindow
+	w.add(start, CloseBadSecret)
+	w.add(start.Add(30*time.Second), CloseBadSecret)
+	w.add(start.Add(5*time.Minute), CloseIdleTimeout)
+	assert.Equal(t, map[string]int64{"bad-secret": 2, "idle-timeout": 1}, w.counts(start.Add(5*time.Minute)))
+
+	// the first bucket falls out of the window, the second is still within it
+	assert.Equal(t, map[string]int64{"idle-timeout": 1}, w.counts(start.Add(statusWindow)))
+	w.add(start.Add(statusWindow+time.Minute), CloseReadError)
+	assert.Equal(t, map[string]int64{"idle-timeout": 1, "read-error": 1}, w.counts(start.Add(statusWindow+time.Minute)))
+	assert.Equal(t, map[string]int64{}, w.counts(start.Add(3*statusWindow)))
+}
+
+func TestServerStatus(t *testing.T) {
+	closed := make(chan struct{})
+	s := NewServer(nopLogger{}, nil, SetOnClose(func(ctx context.Context, remote net.Addr, reason CloseReason) {
+		close(closed)
+	}))
+	s.StartMaintenance("retry in 5m")
+	client, server := net.Pipe()
+	go s.handle(context.Background(), newCrypter(roleServer, []byte("fooman"), server, false), promptHandler())
+
+	c := newCrypter(roleClient, []byte("fooman"), client, false)
+	_, err := c.write(proxyTestPacket())
+	require.NoError(t, err)
+	_, err = c.read()
+	require.NoError(t, err)
+
+	status := s.Status()
+	assert.Equal(t, int64(1), status.Sessions)
+	assert.True(t, status.Maintenance)
+	assert.Equal(t, "retry in 5m", status.MaintenanceDetail)
+	assert.Equal(t, ShutdownServing, status.Shutdown)
+
+	// a client hanging up is not counted as an error
+	client.Close()
+	<-closed
+	status = s.Status()
+	assert.Equal(t, int64(0), status.Sessions)
+	assert.Equal(t, map[string]int64{}, status.RecentCloses)
+}
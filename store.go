@@ -0,0 +1,190 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrStoreUnavailable is returned, wrapped, by a Store that cannot be reached
+var ErrStoreUnavailable = errors.New("store unavailable")
+
+// Store is a small key value store for the state of features that must be shared by every
+// instance of a server, eg failure counters that an attacker could otherwise spread over the
+// instances behind a load balancer.  NewMemoryStore keeps the state of a single instance; an
+// implementation backed by an external store shares it.  Keys are namespaced by the feature that
+// uses them.  A ttl of zero never expires.
+type Store interface {
+	// Get returns the value of key, ok is false if it is not set or has expired
+	Get(ctx context.Context, key string) (value []byte, ok bool, err error)
+	// Set sets key to value for ttl
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Incr adds delta to the integer at key and returns the sum.  A key that is not set starts at
+	// zero and expires after ttl; incrementing a key does not extend its ttl.
+	Incr(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error)
+	// CompareAndSwap sets key to new for ttl if its value is old, a nil old being a key that is not
+	// set, and reports if it did
+	CompareAndSwap(ctx context.Context, key string, old, new []byte, ttl time.Duration) (bool, error)
+}
+
+// StoreFailure is what a feature does when its Store fails.  Every feature that keeps its state in
+// a Store declares one, so an unavailable store never silently weakens or blocks access.
+type StoreFailure int
+
+const (
+	// StoreFailClosed denies the request the feature could not check
+	StoreFailClosed StoreFailure = iota
+	// StoreFailOpen allows the request the feature could not check
+	StoreFailOpen
+)
+
+// String returns the name of the policy
+func (f StoreFailure) String() string {
+	switch f {
+	case StoreFailClosed:
+		return "fail-closed"
+	case StoreFailOpen:
+		return "fail-open"
+	}
+	return fmt.Sprintf("unknown(%d)", int(f))
+}
+
+// allow reports if feature allows a request it could not check because its store failed with
+// err, which is logged to l.  Every failure is counted in tacquito_store_failures, by feature and
+// policy.
+func (f StoreFailure) allow(ctx context.Context, l loggerProvider, feature string, err error) bool {
+	storeFailures.WithLabelValues(feature, f.String()).Inc()
+	l.Errorf(ctx, "store of [%v] failed, applying [%v]; %v", feature, f, err)
+	return f == StoreFailOpen
+}
+
+// SetStore sets the Store of the state shared by every instance of the server, such as the
+// interactive session counts of SetMaxInteractiveSessions.  The default is NewMemoryStore, which
+// is not shared.
+func SetStore(st Store) Option {
+	return func(s *Server) {
+		s.store = st
+	}
+}
+
+// memoryStorePrune is the number of keys past which expired keys are dropped on the next write,
+// so keys that are no longer used do not hold memory
+const memoryStorePrune = 4096
+
+// NewMemoryStore returns a Store held in memory, which is not shared with other instances
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: make(map[string]storeEntry), now: time.Now}
+}
+
+// MemoryStore is a Store held in memory, see NewMemoryStore
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]storeEntry
+	now     func() time.Time
+}
+
+// storeEntry is the value of a key, and when it expires, zero for never
+type storeEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+// get returns the entry of key if it has not expired, with the lock held
+func (m *MemoryStore) get(key string, now time.Time) (storeEntry, bool) {
+	e, ok := m.entries[key]
+	if !ok || (!e.expires.IsZero() && !now.Before(e.expires)) {
+		return storeEntry{}, false
+	}
+	return e, true
+}
+
+// set sets the entry of key, with the lock held
+func (m *MemoryStore) set(key string, value []byte, ttl time.Duration, now time.Time) {
+	if len(m.entries) >= memoryStorePrune {
+		for k := range m.entries {
+			if _, ok := m.get(k, now); !ok {
+				delete(m.entries, k)
+			}
+		}
+	}
+	e := storeEntry{value: append([]byte(nil), value...)}
+	if ttl > 0 {
+		e.expires = now.Add(ttl)
+	}
+	m.entries[key] = e
+}
+
+// Get returns the value of key
+func (m *MemoryStore) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.get(key, m.now())
+	if !ok {
+		return nil, false, nil
+	}
+	return append([]byte(nil), e.value...), true, nil
+}
+
+// Set sets key to value for ttl
+func (m *MemoryStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.set(key, value, ttl, m.now())
+	return nil
+}
+
+// Incr adds delta to the integer at key, which is kept in decimal
+func (m *MemoryStore) Incr(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	e, ok := m.get(key, now)
+	if !ok {
+		m.set(key, []byte(strconv.FormatInt(delta, 10)), ttl, now)
+		return delta, nil
+	}
+	v, err := strconv.ParseInt(string(e.value), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("value of key [%v] is not an integer; %w", key, err)
+	}
+	v += delta
+	e.value = []byte(strconv.FormatInt(v, 10))
+	m.entries[key] = e
+	return v, nil
+}
+
+// CompareAndSwap sets key to new for ttl if its value is old
+func (m *MemoryStore) CompareAndSwap(ctx context.Context, key string, old, new []byte, ttl time.Duration) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	e, ok := m.get(key, now)
+	if ok != (old != nil) || (ok && !bytes.Equal(e.value, old)) {
+		return false, nil
+	}
+	m.set(key, new, ttl, now)
+	return true, nil
+}
@@ -0,0 +1,137 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// faultyStore fails every call with ErrStoreUnavailable while down is set
+type faultyStore struct {
+	Store
+	mu   sync.Mutex
+	down bool
+}
+
+func (f *faultyStore) fail() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		return fmt.Errorf("injected fault; %w", ErrStoreUnavailable)
+	}
+	return nil
+}
+
+func (f *faultyStore) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	if err := f.fail(); err != nil {
+		return nil, false, err
+	}
+	return f.Store.Get(ctx, key)
+}
+
+func (f *faultyStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if err := f.fail(); err != nil {
+		return err
+	}
+	return f.Store.Set(ctx, key, value, ttl)
+}
+
+func (f *faultyStore) Incr(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	if err := f.fail(); err != nil {
+		return 0, err
+	}
+	return f.Store.Incr(ctx, key, delta, ttl)
+}
+
+func (f *faultyStore) CompareAndSwap(ctx context.Context, key string, old, new []byte, ttl time.Duration) (bool, error) {
+	if err := f.fail(); err != nil {
+		return false, err
+	}
+	return f.Store.CompareAndSwap(ctx, key, old, new, ttl)
+}
+
+// storeTestClock is a clock moved by the test
+type storeTestClock struct {
+	now time.Time
+}
+
+func (c *storeTestClock) Now() time.Time {
+	return c.now
+}
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	clock := &storeTestClock{now: time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)}
+	m := NewMemoryStore()
+	m.now = clock.Now
+
+	require.NoError(t, m.Set(ctx, "revoked/alice", []byte("yes"), time.Minute))
+	require.NoError(t, m.Set(ctx, "forever", []byte("yes"), 0))
+	v, ok, err := m.Get(ctx, "revoked/alice")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("yes"), v)
+
+	n, err := m.Incr(ctx, "failures/alice", 1, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	clock.now = clock.now.Add(30 * time.Second)
+	n, err = m.Incr(ctx, "failures/alice", 2, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+	_, err = m.Incr(ctx, "revoked/alice", 1, time.Minute)
+	assert.Error(t, err)
+
+	// a nil old swaps a key that is not set, once
+	swapped, err := m.CompareAndSwap(ctx, "seen/1", nil, []byte("1"), time.Minute)
+	require.NoError(t, err)
+	assert.True(t, swapped)
+	swapped, err = m.CompareAndSwap(ctx, "seen/1", nil, []byte("1"), time.Minute)
+	require.NoError(t, err)
+	assert.False(t, swapped)
+	swapped, err = m.CompareAndSwap(ctx, "seen/1", []byte("1"), []byte("2"), time.Minute)
+	require.NoError(t, err)
+	assert.True(t, swapped)
+
+	// increments do not extend the ttl of a key
+	clock.now = clock.now.Add(30 * time.Second)
+	for _, key := range []string{"revoked/alice", "failures/alice"} {
+		_, ok, err = m.Get(ctx, key)
+		require.NoError(t, err)
+		assert.False(t, ok, key)
+	}
+	_, ok, err = m.Get(ctx, "forever")
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, _, err = m.Get(canceled, "forever")
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestStoreFailure(t *testing.T) {
+	s := &faultyStore{Store: NewMemoryStore(), down: true}
+	_, err := s.Incr(context.Background(), "failures/alice", 1, time.Minute)
+	require.ErrorIs(t, err, ErrStoreUnavailable)
+
+	closed := metricValue(storeFailures.WithLabelValues("test-closed", "fail-closed"))
+	open := metricValue(storeFailures.WithLabelValues("test-open", "fail-open"))
+	assert.False(t, StoreFailClosed.allow(context.Background(), nopLogger{}, "test-closed", err))
+	assert.True(t, StoreFailOpen.allow(context.Background(), nopLogger{}, "test-open", err))
+	assert.Equal(t, closed+1, metricValue(storeFailures.WithLabelValues("test-closed", "fail-closed")))
+	assert.Equal(t, open+1, metricValue(storeFailures.WithLabelValues("test-open", "fail-open")))
+	assert.Equal(t, "unknown(7)", StoreFailure(7).String())
+}
@@ -0,0 +1,329 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Direction indicates which side of a connection sent a recorded packet
+type Direction string
+
+const (
+	// DirectionClient is a packet sent from the client to the server
+	DirectionClient Direction = "client"
+	// DirectionServer is a packet sent from the server to the client
+	DirectionServer Direction = "server"
+)
+
+// RecordedPacket is a single packet within a SessionFixture.  Raw holds the entire packet, header
+// and body, as it looks after crypt has been applied to it, eg the body is not obfuscated.  Time is
+// the wall time of the packet and Offset the time since the first packet of the session on the
+// monotonic clock, which is unaffected by steps of the wall clock.
+type RecordedPacket struct {
+	Direction Direction     `json:"direction"`
+	Time      time.Time     `json:"time"`
+	Offset    time.Duration `json:"offset,omitempty"`
+	Raw       []byte        `json:"raw"`
+}
+
+// SessionFixture is a recorded exchange of packets for a single session.  Fixtures are stored
+// as json and may come from tests or from a live SessionRecorder.
+type SessionFixture struct {
+	Name    string           `json:"name"`
+	Packets []RecordedPacket `json:"packets"`
+
+	// started is when a SessionRecorder recorded the first packet
+	started time.Time
+}
+
+// ReadSessionFixture decodes a json encoded SessionFixture from r
+func ReadSessionFixture(r io.Reader) (SessionFixture, error) {
+	var f SessionFixture
+	if err := json.NewDecoder(r).Decode(&f); err != nil {
+		return f, fmt.Errorf("unable to decode session fixture; %w", err)
+	}
+	return f, nil
+}
+
+// SummaryOption is used to set optional behaviors on SummarizeSession
+type SummaryOption func(s *summary)
+
+// SetSummaryRedact controls the redaction of fields that may hold passwords.  Redaction is
+// on by default.
+func SetSummaryRedact(v bool) SummaryOption {
+	return func(s *summary) {
+		s.redact = v
+	}
+}
+
+// SetSummaryMermaid appends a mermaid sequence diagram to the text summary
+func SetSummaryMermaid(v bool) SummaryOption {
+	return func(s *summary) {
+		s.mermaid = v
+	}
+}
+
+type summary struct {
+	redact  bool
+	mermaid bool
+	// identity replaces the user field, when set
+	identity IdentityObfuscator
+}
+
+// summaryLine is a single decoded packet in a summary
+type summaryLine struct {
+	direction Direction
+	delta     time.Duration
+	seqNo     SequenceNumber
+	text      string
+}
+
+// SummarizeSession renders a text sequence summary of f, one line per packet, with the direction,
+// sequence number, packet type, status or action, key fields and the time since the previous packet.
+func SummarizeSession(f SessionFixture, opts ...SummaryOption) (string, error) {
+	s := &summary{redact: true}
+	for _, opt := range opts {
+		opt(s)
+	}
+	lines := make([]summaryLine, 0, len(f.Packets))
+	// fixtures recorded before offsets existed only have wall times
+	offsets := false
+	for _, rp := range f.Packets {
+		offsets = offsets || rp.Offset != 0
+	}
+	var last RecordedPacket
+	for i, rp := range f.Packets {
+		var p Packet
+		if err := p.UnmarshalBinary(rp.Raw); err != nil {
+			return "", fmt.Errorf("packet [%v] in fixture [%v] is malformed; %w", i, f.Name, err)
+		}
+		var delta time.Duration
+		if i > 0 {
+			delta = rp.Time.Sub(last.Time)
+			if offsets {
+				delta = rp.Offset - last.Offset
+			}
+			if delta < 0 {
+				// the wall clock stepped backwards between the packets
+				delta = 0
+			}
+		}
+		last = rp
+		lines = append(lines, summaryLine{
+			direction: rp.Direction,
+			delta:     delta,
+			seqNo:     p.Header.SeqNo,
+			text:      s.describe(rp.Direction, &p),
+		})
+	}
+
+	var b strings.Builder
+	if f.Name != "" {
+		fmt.Fprintf(&b, "session %v\n", f.Name)
+	}
+	for _, l := range lines {
+		to := DirectionServer
+		if l.direction == DirectionServer {
+			to = DirectionClient
+		}
+		fmt.Fprintf(&b, "+%-6v %v -> %v seq=%v %v\n", l.delta.Round(time.Millisecond), l.direction, to, l.seqNo, l.text)
+	}
+	if s.mermaid {
+		b.WriteString("\nsequenceDiagram\n")
+		fmt.Fprintf(&b, "    participant %v\n", DirectionClient)
+		fmt.Fprintf(&b, "    participant %v\n", DirectionServer)
+		for _, l := range lines {
+			switch l.direction {
+			case DirectionServer:
+				fmt.Fprintf(&b, "    %v-->>%v: seq=%v %v\n", DirectionServer, DirectionClient, l.seqNo, l.text)
+			default:
+				fmt.Fprintf(&b, "    %v->>%v: seq=%v %v\n", DirectionClient, DirectionServer, l.seqNo, l.text)
+			}
+		}
+	}
+	return b.String(), nil
+}
+
+// summaryKeys are the fields of each body that describe shows
+var summaryKeys = map[string][]string{
+	"AuthenReply":    {"status", "server-msg"},
+	"AuthenStart":    {"action", "type", "service", "user", "data"},
+	"AuthenContinue": {"flags", "user-msg"},
+	"AuthorReply":    {"status", "args"},
+	"AuthorRequest":  {"user", "cmd", "cmd-args"},
+	"AcctReply":      {"status", "server-msg"},
+	"AcctRequest":    {"flags", "user", "cmd", "cmd-args"},
+}
+
+// decodeBody decodes the body of p based on the header type and the direction it was sent in.  The
+// body of an unknown packet type is returned as nil without an error.
+func decodeBody(d Direction, p *Packet) (EncoderDecoder, error) {
+	var body EncoderDecoder
+	switch {
+	case p.Header.Type == Authenticate && d == DirectionServer:
+		body = &AuthenReply{}
+	case p.Header.Type == Authenticate && p.Header.SeqNo == 1:
+		body = &AuthenStart{}
+	case p.Header.Type == Authenticate:
+		body = &AuthenContinue{}
+	case p.Header.Type == Authorize && d == DirectionServer:
+		body = &AuthorReply{}
+	case p.Header.Type == Authorize:
+		body = &AuthorRequest{}
+	case p.Header.Type == Accounting && d == DirectionServer:
+		body = &AcctReply{}
+	case p.Header.Type == Accounting:
+		body = &AcctRequest{}
+	default:
+		return nil, nil
+	}
+	if err := Unmarshal(p.Body, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// fields returns the fields of body, redacted and with the user replaced as set on s
+func (s summary) fields(body EncoderDecoder) map[string]string {
+	fields := body.Fields()
+	// author and acct requests carry the cmd in their args, surface it as a key field
+	switch t := body.(type) {
+	case *AuthorRequest:
+		fields["cmd"], fields["cmd-args"] = t.Args.Command(), t.Args.CommandArgs()
+	case *AcctRequest:
+		fields["cmd"], fields["cmd-args"] = t.Args.Command(), t.Args.CommandArgs()
+	}
+	if s.identity != nil && fields["user"] != "" {
+		fields["user"] = s.identity.Obfuscate(fields["user"])
+	}
+	if s.redact {
+		for _, k := range []string{"data", "user-msg"} {
+			if fields[k] != "" {
+				fields[k] = "<redacted>"
+			}
+		}
+	}
+	return fields
+}
+
+// describe decodes the body of p based on the header type and the direction it was sent in
+func (s summary) describe(d Direction, p *Packet) string {
+	body, err := decodeBody(d, p)
+	if err != nil {
+		return fmt.Sprintf("%v undecodable body, possible bad secret; %v", p.Header.Type, err)
+	}
+	if body == nil {
+		return fmt.Sprintf("%v unknown", p.Header.Type)
+	}
+	fields := s.fields(body)
+	keys := summaryKeys[fields["packet-type"]]
+	parts := []string{p.Header.Type.String(), fields["packet-type"]}
+	for _, k := range keys {
+		if v := strings.TrimSuffix(fields[k], ", "); v != "" {
+			parts = append(parts, fmt.Sprintf("%v=%q", k, v))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// NewSessionRecorder wraps next and records every packet exchanged through it as a SessionFixture
+// keyed by SessionID.  Fixtures are held in memory until Forget is called, so this is meant for
+// debugging and tooling, not for use on every connection in a busy server.
+func NewSessionRecorder(next Handler) *SessionRecorder {
+	return &SessionRecorder{next: next, sessions: make(map[SessionID]*SessionFixture)}
+}
+
+// SessionRecorder is a middleware handler that records live sessions
+type SessionRecorder struct {
+	mu       sync.Mutex
+	next     Handler
+	sessions map[SessionID]*SessionFixture
+}
+
+// Handle records the request and registers a writer to record the reply, then calls next
+func (s *SessionRecorder) Handle(response Response, request Request) {
+	s.handle(s.next, response, request)
+}
+
+func (s *SessionRecorder) handle(next Handler, response Response, request Request) {
+	h := request.Header
+	if raw, err := NewPacket(SetPacketHeader(&h), SetPacketBody(request.Body)).MarshalBinary(); err == nil {
+		s.record(request.Header.SessionID, DirectionClient, raw)
+	}
+	response.RegisterWriter(recorderWriter{recorder: s, session: request.Header.SessionID})
+	next.Handle(&recordingResponse{Response: response, recorder: s}, request)
+}
+
+// Fixture returns a copy of the recorded fixture for id
+func (s *SessionRecorder) Fixture(id SessionID) (SessionFixture, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.sessions[id]
+	if !ok {
+		return SessionFixture{}, false
+	}
+	c := SessionFixture{Name: f.Name, Packets: make([]RecordedPacket, len(f.Packets))}
+	copy(c.Packets, f.Packets)
+	return c, true
+}
+
+// Forget removes the recorded fixture for id
+func (s *SessionRecorder) Forget(id SessionID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+}
+
+func (s *SessionRecorder) record(id SessionID, d Direction, raw []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	f, ok := s.sessions[id]
+	if !ok {
+		f = &SessionFixture{Name: fmt.Sprint(id), started: now}
+		s.sessions[id] = f
+	}
+	b := make([]byte, len(raw))
+	copy(b, raw)
+	f.Packets = append(f.Packets, RecordedPacket{Direction: d, Time: now, Offset: now.Sub(f.started), Raw: b})
+}
+
+// recorderWriter receives the marshalled replies of a response
+type recorderWriter struct {
+	recorder *SessionRecorder
+	session  SessionID
+}
+
+// Write records p as a server packet
+func (w recorderWriter) Write(p []byte) (int, error) {
+	w.recorder.record(w.session, DirectionServer, p)
+	return len(p), nil
+}
+
+// recordingResponse ensures that multi packet exchanges continue to be recorded
+type recordingResponse struct {
+	Response
+	recorder *SessionRecorder
+}
+
+// Next wraps next so subsequent packets in this session are recorded
+func (r *recordingResponse) Next(next Handler) {
+	if next == nil {
+		r.Response.Next(nil)
+		return
+	}
+	r.Response.Next(HandlerFunc(func(response Response, request Request) {
+		r.recorder.handle(next, response, request)
+	}))
+}
@@ -0,0 +1,187 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden files in testdata")
+
+// recordPacket builds a RecordedPacket from a header and body, offset from a fixed start time
+func recordPacket(t *testing.T, d Direction, offset time.Duration, h *Header, body EncoderDecoder) RecordedPacket {
+	b, err := body.MarshalBinary()
+	assert.NoError(t, err)
+	raw, err := NewPacket(SetPacketHeader(h), SetPacketBody(b)).MarshalBinary()
+	assert.NoError(t, err)
+	start := time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)
+	return RecordedPacket{Direction: d, Time: start.Add(offset), Raw: raw}
+}
+
+func summaryHeader(t HeaderType, seq int) *Header {
+	return NewHeader(
+		SetHeaderVersion(Version{MajorVersion: MajorVersion, MinorVersion: MinorVersionDefault}),
+		SetHeaderType(t),
+		SetHeaderSeqNo(seq),
+		SetHeaderSessionID(12345),
+	)
+}
+
+func asciiLoginFixture(t *testing.T) SessionFixture {
+	return SessionFixture{
+		Name: "ascii-login",
+		Packets: []RecordedPacket{
+			recordPacket(t, DirectionClient, 0, summaryHeader(Authenticate, 1), NewAuthenStart(
+				SetAuthenStartAction(AuthenActionLogin),
+				SetAuthenStartPrivLvl(PrivLvlUser),
+				SetAuthenStartType(AuthenTypeASCII),
+				SetAuthenStartService(AuthenServiceLogin),
+				SetAuthenStartPort("tty0"),
+				SetAuthenStartRemAddr("foo"),
+			)),
+			recordPacket(t, DirectionServer, 2*time.Millisecond, summaryHeader(Authenticate, 2), NewAuthenReply(
+				SetAuthenReplyStatus(AuthenStatusGetUser),
+				SetAuthenReplyServerMsg("\nUser Access Verification\n\nUsername:"),
+			)),
+			recordPacket(t, DirectionClient, 1500*time.Millisecond, summaryHeader(Authenticate, 3), NewAuthenContinue(
+				SetAuthenContinueUserMessage("cisco"),
+			)),
+			recordPacket(t, DirectionServer, 1502*time.Millisecond, summaryHeader(Authenticate, 4), NewAuthenReply(
+				SetAuthenReplyStatus(AuthenStatusGetPass),
+				SetAuthenReplyServerMsg("\nPassword: "),
+			)),
+			recordPacket(t, DirectionClient, 3*time.Second, summaryHeader(Authenticate, 5), NewAuthenContinue(
+				SetAuthenContinueUserMessage("cisco"),
+			)),
+			recordPacket(t, DirectionServer, 3010*time.Millisecond, summaryHeader(Authenticate, 6), NewAuthenReply(
+				SetAuthenReplyStatus(AuthenStatusPass),
+			)),
+		},
+	}
+}
+
+func authorBurstFixture(t *testing.T) SessionFixture {
+	f := SessionFixture{Name: "author-burst"}
+	for i, cmd := range []string{"show", "configure", "reload"} {
+		offset := time.Duration(i) * 100 * time.Millisecond
+		f.Packets = append(f.Packets,
+			recordPacket(t, DirectionClient, offset, summaryHeader(Authorize, 1), NewAuthorRequest(
+				SetAuthorRequestMethod(AuthenMethodTacacsPlus),
+				SetAuthorRequestPrivLvl(PrivLvlRoot),
+				SetAuthorRequestType(AuthenTypeASCII),
+				SetAuthorRequestService(AuthenServiceLogin),
+				SetAuthorRequestUser("cisco"),
+				SetAuthorRequestPort("tty0"),
+				SetAuthorRequestRemAddr("foo"),
+				SetAuthorRequestArgs(Args{"service=shell", Arg("cmd=" + cmd), "cmd-arg=<cr>"}),
+			)),
+		)
+		status := AuthorStatusPassAdd
+		if cmd == "reload" {
+			status = AuthorStatusFail
+		}
+		f.Packets = append(f.Packets,
+			recordPacket(t, DirectionServer, offset+5*time.Millisecond, summaryHeader(Authorize, 2), NewAuthorReply(
+				SetAuthorReplyStatus(status),
+			)),
+		)
+	}
+	return f
+}
+
+func badSecretFixture(t *testing.T) SessionFixture {
+	// the client obfuscates with a secret that does not match the server, the recorded packet is
+	// what the server sees after applying its own secret
+	start := recordPacket(t, DirectionClient, 0, summaryHeader(Authenticate, 1), NewAuthenStart(
+		SetAuthenStartAction(AuthenActionLogin),
+		SetAuthenStartPrivLvl(PrivLvlUser),
+		SetAuthenStartType(AuthenTypePAP),
+		SetAuthenStartService(AuthenServiceLogin),
+		SetAuthenStartUser("cisco"),
+		SetAuthenStartPort("tty0"),
+		SetAuthenStartRemAddr("foo"),
+		SetAuthenStartData("cisco"),
+	))
+	var p Packet
+	assert.NoError(t, p.UnmarshalBinary(start.Raw))
+	assert.NoError(t, crypt([]byte("client-secret"), &p))
+	assert.NoError(t, crypt([]byte("server-secret"), &p))
+	raw, err := p.MarshalBinary()
+	assert.NoError(t, err)
+	start.Raw = raw
+	return SessionFixture{
+		Name: "bad-secret",
+		Packets: []RecordedPacket{
+			start,
+			recordPacket(t, DirectionServer, time.Millisecond, summaryHeader(Authenticate, 2), NewAuthenReply(
+				SetAuthenReplyStatus(AuthenStatusError),
+				SetAuthenReplyServerMsg("bad secret"),
+			)),
+		},
+	}
+}
+
+func TestSummarizeSession(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture SessionFixture
+		opts    []SummaryOption
+	}{
+		{name: "ascii-login", fixture: asciiLoginFixture(t)},
+		{name: "ascii-login-unredacted", fixture: asciiLoginFixture(t), opts: []SummaryOption{SetSummaryRedact(false)}},
+		{name: "author-burst", fixture: authorBurstFixture(t), opts: []SummaryOption{SetSummaryMermaid(true)}},
+		{name: "bad-secret", fixture: badSecretFixture(t)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := SummarizeSession(test.fixture, test.opts...)
+			assert.NoError(t, err)
+			golden := filepath.Join("testdata", test.name+".golden")
+			if *updateGolden {
+				assert.NoError(t, os.WriteFile(golden, []byte(got), 0644))
+			}
+			want, err := os.ReadFile(golden)
+			assert.NoError(t, err)
+			assert.Equal(t, string(want), got)
+		})
+	}
+}
+
+func TestSummarizeSessionMalformed(t *testing.T) {
+	_, err := SummarizeSession(SessionFixture{Name: "short", Packets: []RecordedPacket{{Direction: DirectionClient, Raw: []byte{0xc1}}}})
+	assert.Error(t, err)
+}
+
+func TestSummarizeSessionClockStep(t *testing.T) {
+	request := recordPacket(t, DirectionClient, 0, summaryHeader(Authenticate, 1), NewAuthenStart(
+		SetAuthenStartAction(AuthenActionLogin),
+		SetAuthenStartType(AuthenTypePAP),
+		SetAuthenStartService(AuthenServiceLogin),
+	))
+	// the wall clock stepped back a second between the request and the reply
+	reply := recordPacket(t, DirectionServer, -time.Second, summaryHeader(Authenticate, 2), NewAuthenReply(
+		SetAuthenReplyStatus(AuthenStatusPass),
+	))
+
+	// without offsets the step is shown as no time at all rather than a negative delta
+	got, err := SummarizeSession(SessionFixture{Packets: []RecordedPacket{request, reply}})
+	assert.NoError(t, err)
+	assert.Contains(t, got, "+0s     server -> client seq=2")
+
+	// with offsets the monotonic delta is used
+	reply.Offset = 3 * time.Millisecond
+	got, err = SummarizeSession(SessionFixture{Packets: []RecordedPacket{request, reply}})
+	assert.NoError(t, err)
+	assert.Contains(t, got, "+3ms    server -> client seq=2")
+}
@@ -0,0 +1,76 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import "strings"
+
+// SystemEventKind is the kind of event a system accounting record describes
+type SystemEventKind string
+
+const (
+	// SystemEventReload is sent when a device reloads
+	SystemEventReload SystemEventKind = "reload"
+	// SystemEventConfigSave is sent when a device saves or commits its configuration
+	SystemEventConfigSave SystemEventKind = "config-save"
+	// SystemEventStart is sent when system accounting starts, eg after boot
+	SystemEventStart SystemEventKind = "start"
+	// SystemEventStop is sent when system accounting stops, eg before a shutdown
+	SystemEventStop SystemEventKind = "stop"
+	// SystemEventOther is any other system event
+	SystemEventOther SystemEventKind = "other"
+)
+
+// OneShot reports if the event is a single record.  Only start and stop come in pairs, so a
+// consumer must not wait for the other half of any other event.
+func (k SystemEventKind) OneShot() bool {
+	return k != SystemEventStart && k != SystemEventStop
+}
+
+// SystemEvent returns the kind of system event args describe.  Devices send these accounting
+// records with service=system and no cmd, and name the event in a reason or event attribute,
+// eg "service=system event=sys_acct reason=reload".  False is returned for any other record.
+func (t Args) SystemEvent() (SystemEventKind, bool) {
+	if t.Service() != "system" {
+		return "", false
+	}
+	var reason, event string
+	for _, arg := range t {
+		a, _, v := arg.ASV()
+		switch a {
+		case "reason":
+			reason = v
+		case "event":
+			event = v
+		}
+	}
+	// reason is more specific where both are sent
+	for _, v := range []string{reason, event} {
+		if k, ok := systemEventKind(v); ok {
+			return k, true
+		}
+	}
+	return SystemEventOther, true
+}
+
+// systemEventKind maps the vendor specific name of an event to its kind
+func systemEventKind(v string) (SystemEventKind, bool) {
+	v = strings.ToLower(v)
+	switch {
+	case v == "":
+		return "", false
+	case strings.Contains(v, "reload"), strings.Contains(v, "reboot"):
+		return SystemEventReload, true
+	case strings.Contains(v, "save"), strings.Contains(v, "commit"), strings.Contains(v, "write"):
+		return SystemEventConfigSave, true
+	case strings.Contains(v, "start"):
+		return SystemEventStart, true
+	case strings.Contains(v, "stop"), strings.Contains(v, "shutdown"):
+		return SystemEventStop, true
+	}
+	return "", false
+}
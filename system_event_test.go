@@ -0,0 +1,84 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// systemEventFixtures are system accounting records as sent by two vendors.  The first names the
+// event in a reason attribute, the second in an event attribute.
+var systemEventFixtures = []struct {
+	name   string
+	args   Args
+	kind   SystemEventKind
+	isSys  bool
+	isOnce bool
+}{
+	{
+		name:   "vendor a reload",
+		args:   Args{"task_id=42", "timezone=UTC", "service=system", "event=sys_acct", "reason=reload"},
+		kind:   SystemEventReload,
+		isSys:  true,
+		isOnce: true,
+	},
+	{
+		name:   "vendor a config save",
+		args:   Args{"task_id=43", "timezone=UTC", "service=system", "event=sys_acct", "reason=write memory"},
+		kind:   SystemEventConfigSave,
+		isSys:  true,
+		isOnce: true,
+	},
+	{
+		name:   "vendor a accounting start",
+		args:   Args{"task_id=44", "timezone=UTC", "service=system", "event=sys_acct", "reason=system accounting start"},
+		kind:   SystemEventStart,
+		isSys:  true,
+		isOnce: false,
+	},
+	{
+		name:   "vendor b reload",
+		args:   Args{"service=system", "event=reboot"},
+		kind:   SystemEventReload,
+		isSys:  true,
+		isOnce: true,
+	},
+	{
+		name:   "vendor b config save",
+		args:   Args{"service=system", "event=commit"},
+		kind:   SystemEventConfigSave,
+		isSys:  true,
+		isOnce: true,
+	},
+	{
+		name:   "unknown system event",
+		args:   Args{"service=system", "event=fan-failure"},
+		kind:   SystemEventOther,
+		isSys:  true,
+		isOnce: true,
+	},
+	{
+		name: "shell command",
+		args: Args{"service=shell", "cmd=write", "cmd-arg=memory"},
+	},
+}
+
+func TestSystemEvent(t *testing.T) {
+	for _, test := range systemEventFixtures {
+		t.Run(test.name, func(t *testing.T) {
+			kind, ok := test.args.SystemEvent()
+			assert.Equal(t, test.isSys, ok)
+			assert.Equal(t, test.kind, kind)
+			if ok {
+				assert.Equal(t, test.isOnce, kind.OneShot())
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquitotest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	tq "github.com/facebookincubator/tacquito"
+)
+
+// DecodeTargets are the decoders a corpus input may fail, by the name its corpus files use
+var DecodeTargets = map[string]func(data []byte) error{
+	"header":          func(data []byte) error { return tq.Unmarshal(data, &tq.Header{}) },
+	"packet":          func(data []byte) error { return tq.Unmarshal(data, &tq.Packet{}) },
+	"authen-start":    func(data []byte) error { return tq.Unmarshal(data, &tq.AuthenStart{}) },
+	"authen-continue": func(data []byte) error { return tq.Unmarshal(data, &tq.AuthenContinue{}) },
+	"authen-reply":    func(data []byte) error { return tq.Unmarshal(data, &tq.AuthenReply{}) },
+	"author-request":  func(data []byte) error { return tq.Unmarshal(data, &tq.AuthorRequest{}) },
+	"author-reply":    func(data []byte) error { return tq.Unmarshal(data, &tq.AuthorReply{}) },
+	"acct-request":    func(data []byte) error { return tq.Unmarshal(data, &tq.AcctRequest{}) },
+	"acct-reply":      func(data []byte) error { return tq.Unmarshal(data, &tq.AcctReply{}) },
+}
+
+// DecodeFailure is how a decoder failed an input.  Type is the type of the error, eg
+// *tacquito.LengthError, or panic if the decoder panicked, and Message its text.
+type DecodeFailure struct {
+	Type    string
+	Message string
+}
+
+// Decode runs the decoder of target on data and returns how it failed, ok is false if it decoded
+// data.  A panic is a failure too, as fuzzing finds those as well.
+func Decode(target string, data []byte) (failure DecodeFailure, ok bool) {
+	decode, known := DecodeTargets[target]
+	if !known {
+		return DecodeFailure{Type: "unknown", Message: fmt.Sprintf("unknown decode target [%v]", target)}, true
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			failure, ok = DecodeFailure{Type: "panic", Message: fmt.Sprint(r)}, true
+		}
+	}()
+	// decoders may keep slices of their input, so each run gets a copy
+	err := decode(append([]byte(nil), data...))
+	if err == nil {
+		return DecodeFailure{}, false
+	}
+	// the type of the innermost error, the message keeps the context of the wrapping ones
+	inner := err
+	for next := errors.Unwrap(inner); next != nil; next = errors.Unwrap(inner) {
+		inner = next
+	}
+	return DecodeFailure{Type: fmt.Sprintf("%T", inner), Message: err.Error()}, true
+}
+
+// Minimize returns the smallest input, found by delta debugging over its bytes, for which fails
+// still holds, with every byte it does not need zeroed.  fails must hold for input.  The result
+// only depends on input and fails, so a corpus promoted twice yields the same bytes.
+func Minimize(tb testing.TB, input []byte, fails func(data []byte) bool) []byte {
+	tb.Helper()
+	if !fails(input) {
+		tb.Fatalf("minimize: the failure does not hold for the input to minimize")
+	}
+	input = append([]byte(nil), input...)
+	if fails(nil) {
+		return []byte{}
+	}
+	for n := 2; len(input) >= 2; {
+		chunk := (len(input) + n - 1) / n
+		reduced := false
+		for start := 0; start < len(input) && !reduced; start += chunk {
+			end := start + chunk
+			if end > len(input) {
+				end = len(input)
+			}
+			subset := append([]byte(nil), input[start:end]...)
+			complement := append(append([]byte(nil), input[:start]...), input[end:]...)
+			switch {
+			case fails(subset):
+				input, n, reduced = subset, 2, true
+			case fails(complement):
+				input, reduced = complement, true
+				if n > 2 {
+					n--
+				}
+			}
+		}
+		if reduced {
+			continue
+		}
+		if n >= len(input) {
+			break
+		}
+		if n *= 2; n > len(input) {
+			n = len(input)
+		}
+	}
+	// bytes the failure does not depend on are incidental to it, zero them
+	for i := range input {
+		if input[i] == 0 {
+			continue
+		}
+		b := input[i]
+		input[i] = 0
+		if !fails(input) {
+			input[i] = b
+		}
+	}
+	return input
+}
+
+// CorpusCase is a promoted input and how it must keep failing its decoder
+type CorpusCase struct {
+	Target  string
+	Failure DecodeFailure
+	Input   []byte
+}
+
+// PromoteCorpus minimizes input, which fails the decoder of target, against the same failure and
+// returns it as a CorpusCase for WriteCorpus
+func PromoteCorpus(tb testing.TB, target string, input []byte) CorpusCase {
+	tb.Helper()
+	failure, ok := Decode(target, input)
+	if !ok {
+		tb.Fatalf("promote: [%v] decodes %x, there is no failure to keep", target, input)
+	}
+	minimized := Minimize(tb, input, func(data []byte) bool {
+		f, ok := Decode(target, data)
+		return ok && f == failure
+	})
+	return CorpusCase{Target: target, Failure: failure, Input: minimized}
+}
+
+// corpusHeader starts every corpus file
+const corpusHeader = "tacquito decode corpus v1"
+
+// marshal renders c as a corpus file
+func (c CorpusCase) marshal() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%v\n", corpusHeader)
+	fmt.Fprintf(&b, "target: %v\n", c.Target)
+	fmt.Fprintf(&b, "type: %v\n", c.Failure.Type)
+	fmt.Fprintf(&b, "message: %v\n", strings.ReplaceAll(c.Failure.Message, "\n", " "))
+	fmt.Fprintf(&b, "input: %x\n", c.Input)
+	return b.Bytes()
+}
+
+// parseCorpusCase reads a corpus file written by WriteCorpus
+func parseCorpusCase(data []byte) (CorpusCase, error) {
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 5 || lines[0] != corpusHeader {
+		return CorpusCase{}, fmt.Errorf("not a %v file", corpusHeader)
+	}
+	values := make(map[string]string)
+	for _, line := range lines[1:] {
+		key, value, ok := strings.Cut(line, ": ")
+		if !ok {
+			return CorpusCase{}, fmt.Errorf("malformed line [%v]", line)
+		}
+		values[key] = value
+	}
+	input, err := hex.DecodeString(values["input"])
+	if err != nil {
+		return CorpusCase{}, fmt.Errorf("malformed input; %w", err)
+	}
+	return CorpusCase{Target: values["target"], Failure: DecodeFailure{Type: values["type"], Message: values["message"]}, Input: input}, nil
+}
+
+// WriteCorpus writes c to dir as <target>-<hash>.corpus and returns its path.  The hash is of the
+// whole file, and grows where a different file already has the name, so cases never overwrite
+// each other and promoting the same case again leaves dir as it was.
+func WriteCorpus(tb testing.TB, dir string, c CorpusCase) string {
+	tb.Helper()
+	data := c.marshal()
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		tb.Fatalf("write corpus: %v", err)
+	}
+	for n := 8; n <= len(digest); n *= 2 {
+		path := filepath.Join(dir, fmt.Sprintf("%v-%v.corpus", c.Target, digest[:n]))
+		existing, err := os.ReadFile(path)
+		if err == nil {
+			if bytes.Equal(existing, data) {
+				return path
+			}
+			continue
+		}
+		if !os.IsNotExist(err) {
+			tb.Fatalf("write corpus: %v", err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			tb.Fatalf("write corpus: %v", err)
+		}
+		return path
+	}
+	tb.Fatalf("write corpus: every name of %v in [%v] is taken", c.Target, dir)
+	return ""
+}
+
+// ReadCorpus returns every case in dir, by file name
+func ReadCorpus(tb testing.TB, dir string) map[string]CorpusCase {
+	tb.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "*.corpus"))
+	if err != nil {
+		tb.Fatalf("read corpus: %v", err)
+	}
+	cases := make(map[string]CorpusCase, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			tb.Fatalf("read corpus: %v", err)
+		}
+		c, err := parseCorpusCase(data)
+		if err != nil {
+			tb.Fatalf("read corpus [%v]: %v", path, err)
+		}
+		cases[filepath.Base(path)] = c
+	}
+	return cases
+}
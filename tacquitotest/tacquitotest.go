@@ -0,0 +1,150 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+// Package tacquitotest is a harness for reproducible end to end tests of tacquito servers and
+// clients.  It replaces the sources of nondeterminism, session ids and the wall clock, with
+// deterministic ones, so a scripted exchange produces the same bytes on every run and whole
+// conversations can be compared against golden files.  Its constructors take a testing.TB, it is
+// not meant to be imported outside of tests.
+package tacquitotest
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tq "github.com/facebookincubator/tacquito"
+	"github.com/facebookincubator/tacquito/internal/testhooks"
+)
+
+// Epoch is the time the clock of Sources starts at
+var Epoch = time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// NewSources returns deterministic sources for a test.  Session ids count up from seed, and the
+// clock starts at Epoch and advances by tick every time it is read, so the times of a
+// conversation only depend on the order of the reads.  A server serving one connection at a time
+// reads its clock in the same order on every run.
+func NewSources(tb testing.TB, seed uint32, tick time.Duration) *Sources {
+	tb.Helper()
+	return &Sources{next: seed, now: Epoch, tick: tick}
+}
+
+// Sources are deterministic session ids and wall time, see NewSources
+type Sources struct {
+	mu   sync.Mutex
+	next uint32
+	now  time.Time
+	tick time.Duration
+}
+
+// SessionID returns the next session id
+func (s *Sources) SessionID() uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := s.next
+	s.next++
+	return id
+}
+
+// Now returns the time of the clock, and advances it by tick
+func (s *Sources) Now() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now
+	s.now = s.now.Add(s.tick)
+	return now
+}
+
+func (s *Sources) hooks() *testhooks.Hooks {
+	return &testhooks.Hooks{SessionID: s.SessionID, Now: s.Now}
+}
+
+// ServerOption returns the option that makes a server use the clock of s
+func (s *Sources) ServerOption() tq.Option {
+	return testhooks.ServerOption(s.hooks()).(tq.Option)
+}
+
+// ClientOption returns the option that makes a client use the session ids of s, see
+// Client.NewSessionID
+func (s *Sources) ClientOption() tq.ClientOption {
+	return testhooks.ClientOption(s.hooks()).(tq.ClientOption)
+}
+
+// NewRecorder returns a packet sink for a server, that records its conversations
+func NewRecorder(tb testing.TB) *Recorder {
+	tb.Helper()
+	return &Recorder{tb: tb, changed: make(chan struct{})}
+}
+
+// Recorder is a tq.PacketSink that records every packet of a server, see NewRecorder
+type Recorder struct {
+	tb      testing.TB
+	mu      sync.Mutex
+	packets []tq.CapturedPacket
+	// changed is closed and replaced on every capture
+	changed chan struct{}
+}
+
+// Capture records p
+func (r *Recorder) Capture(p tq.CapturedPacket) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.packets = append(r.packets, p)
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// session returns the packets of id and a channel closed on the next capture
+func (r *Recorder) session(id tq.SessionID) ([]tq.CapturedPacket, chan struct{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var packets []tq.CapturedPacket
+	for _, p := range r.packets {
+		if p.Packet != nil && p.Packet.Header.SessionID == id {
+			packets = append(packets, p)
+		}
+	}
+	return packets, r.changed
+}
+
+// Conversation waits for the server to capture n packets of session id and renders them as the
+// session summary of name, followed by the wire bytes of every packet.  The remote address is
+// left out, as the port of a test client is not reproducible.  The test fails if the packets are
+// not captured within timeout.
+func (r *Recorder) Conversation(name string, id tq.SessionID, n int, timeout time.Duration) string {
+	r.tb.Helper()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	packets, changed := r.session(id)
+	for len(packets) < n {
+		select {
+		case <-changed:
+			packets, changed = r.session(id)
+		case <-deadline.C:
+			r.tb.Fatalf("session [%v] captured %v of %v packets within %v", id, len(packets), n, timeout)
+		}
+	}
+
+	f := tq.SessionFixture{Name: name}
+	var wire strings.Builder
+	for _, p := range packets {
+		raw, err := p.Packet.MarshalBinary()
+		if err != nil {
+			r.tb.Fatalf("session [%v]: %v", id, err)
+		}
+		f.Packets = append(f.Packets, tq.RecordedPacket{Direction: p.Direction, Time: p.Time, Raw: raw})
+		fmt.Fprintf(&wire, "%-6v %v\n", p.Direction, hex.EncodeToString(p.Raw))
+	}
+	summary, err := tq.SummarizeSession(f, tq.SetSummaryRedact(false))
+	if err != nil {
+		r.tb.Fatalf("session [%v]: %v", id, err)
+	}
+	return summary + "\nwire\n" + wire.String()
+}
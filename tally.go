@@ -0,0 +1,238 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import "sync"
+
+// maxTallyPads is the number of crypts a tally holds the pad iterations of, any more are observed
+// as they are made
+const maxTallyPads = 8
+
+// tallyMetric names a labeled counter a requestTally records
+type tallyMetric uint8
+
+const (
+	tallyReplyOutcome tallyMetric = iota
+	tallyDenial
+)
+
+// tallyKey is a labeled counter and its label values
+type tallyKey struct {
+	metric tallyMetric
+	values [3]string
+}
+
+// tallyCount is the count of a labeled counter in a tally
+type tallyCount struct {
+	tallyKey
+	n int
+}
+
+// requestTally is the instrumentation scratchpad of the requests of a connection.  Reading,
+// dispatching and replying record their observations in it rather than in the metrics, and commit
+// applies them in one batch once the request is answered.  A tally is shared by the goroutine
+// serving its connection and the handlers it dispatched, which may still reply after their
+// request timed out, so every method takes its lock.  The methods of a nil tally apply each
+// observation as it is made, which is what crypters and sessions outside of a server use.
+type requestTally struct {
+	mu sync.Mutex
+	// observed counts the observations since the last commit
+	observed                                int
+	reads, writes                           int
+	sessionHits, sessionMisses, sessionSets int
+	pads                                    int
+	padIterations                           [maxTallyPads]int
+	labeled                                 []tallyCount
+	// counters caches the labeled counters a sink resolved, for the life of the connection
+	counters map[tallyKey]Counter
+	// log reports the invariant violations observed on the connection, see violated
+	log loggerProvider
+	// padHook, if set, replaces every pad of the connection before it is applied, see
+	// Server.padHook
+	padHook func(pad []byte) []byte
+}
+
+// batchSink applies the observations of a tally to the metrics.  directSink applies them one at a
+// time, as they would have been without a tally, batchedSink in as few updates as it can, see
+// stats.go.
+type batchSink interface {
+	commit(t *requestTally)
+}
+
+// metricsSink commits every tally
+var metricsSink batchSink = batchedSink{}
+
+// commit applies the observations of t to the metrics and empties t
+func (t *requestTally) commit() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.observed == 0 {
+		return
+	}
+	metricsSink.commit(t)
+	t.observed, t.reads, t.writes = 0, 0, 0
+	t.sessionHits, t.sessionMisses, t.sessionSets = 0, 0, 0
+	t.pads, t.padIterations = 0, [maxTallyPads]int{}
+	t.labeled = t.labeled[:0]
+}
+
+// logger returns the logger of invariant violations of t, nil for a nil tally
+func (t *requestTally) logger() loggerProvider {
+	if t == nil {
+		return nil
+	}
+	return t.log
+}
+
+// read records a packet read
+func (t *requestTally) read() {
+	if t == nil {
+		crypterRead.Inc()
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.reads++
+	t.observed++
+}
+
+// write records a packet written
+func (t *requestTally) write() {
+	if t == nil {
+		crypterWrite.Inc()
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.writes++
+	t.observed++
+}
+
+// sessionHit records a request of a known session
+func (t *requestTally) sessionHit() {
+	if t == nil {
+		sessionsGetHit.Inc()
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sessionHits++
+	t.observed++
+}
+
+// sessionMiss records a request of an unknown session
+func (t *requestTally) sessionMiss() {
+	if t == nil {
+		sessionsGetMiss.Inc()
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sessionMisses++
+	t.observed++
+}
+
+// sessionSet records a session set in the cache
+func (t *requestTally) sessionSet() {
+	if t == nil {
+		sessionsSet.Inc()
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sessionSets++
+	t.observed++
+}
+
+// pad records the md5 iterations of a crypt
+func (t *requestTally) pad(iterations int) {
+	if t == nil {
+		crypterPadIterations.Observe(float64(iterations))
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pads == maxTallyPads {
+		crypterPadIterations.Observe(float64(iterations))
+		return
+	}
+	t.padIterations[t.pads] = iterations
+	t.pads++
+	t.observed++
+}
+
+// outcome records a reply of packet type typ with status, from origin
+func (t *requestTally) outcome(typ, status, origin string) {
+	if t == nil {
+		replyOutcomes.WithLabelValues(typ, status, origin).Inc()
+		replyTotals.add(typ, status, 1)
+		return
+	}
+	t.count(tallyKey{metric: tallyReplyOutcome, values: [3]string{typ, status, origin}})
+}
+
+// denial records a denial of packet type typ with cause, of the obfuscated user
+func (t *requestTally) denial(typ, cause, user string) {
+	if t == nil {
+		denialsByUser.WithLabelValues(typ, cause, user).Inc()
+		return
+	}
+	t.count(tallyKey{metric: tallyDenial, values: [3]string{typ, cause, user}})
+}
+
+// count adds one to the labeled counter k
+func (t *requestTally) count(k tallyKey) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.observed++
+	for i := range t.labeled {
+		if t.labeled[i].tallyKey == k {
+			t.labeled[i].n++
+			return
+		}
+	}
+	t.labeled = append(t.labeled, tallyCount{tallyKey: k, n: 1})
+}
+
+// directSink applies each observation of a tally on its own, exactly as a nil tally does
+type directSink struct{}
+
+func (directSink) commit(t *requestTally) {
+	var unbatched *requestTally
+	for i := 0; i < t.reads; i++ {
+		unbatched.read()
+	}
+	for i := 0; i < t.writes; i++ {
+		unbatched.write()
+	}
+	for i := 0; i < t.sessionHits; i++ {
+		unbatched.sessionHit()
+	}
+	for i := 0; i < t.sessionMisses; i++ {
+		unbatched.sessionMiss()
+	}
+	for i := 0; i < t.sessionSets; i++ {
+		unbatched.sessionSet()
+	}
+	for _, iterations := range t.padIterations[:t.pads] {
+		unbatched.pad(iterations)
+	}
+	for _, c := range t.labeled {
+		for i := 0; i < c.n; i++ {
+			switch c.metric {
+			case tallyReplyOutcome:
+				unbatched.outcome(c.values[0], c.values[1], c.values[2])
+			case tallyDenial:
+				unbatched.denial(c.values[0], c.values[1], c.values[2])
+			}
+		}
+	}
+}
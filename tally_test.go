@@ -0,0 +1,150 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// tallyTotals are the values of the metrics a tally records
+type tallyTotals struct {
+	reads, writes, hits, misses, sets float64
+	passed, failed, denied            float64
+	pads                              uint64
+	padSum                            float64
+}
+
+func readTallyTotals(t *testing.T) tallyTotals {
+	pads, padSum := observations(crypterPadIterations)
+	return tallyTotals{
+		reads:  metricValue(crypterRead),
+		writes: metricValue(crypterWrite),
+		hits:   metricValue(sessionsGetHit),
+		misses: metricValue(sessionsGetMiss),
+		sets:   metricValue(sessionsSet),
+		passed: metricValue(replyOutcomes.WithLabelValues(Authenticate.String(), AuthenStatusPass.String(), originHandler)),
+		failed: metricValue(replyOutcomes.WithLabelValues(Authenticate.String(), AuthenStatusFail.String(), originHandler)),
+		denied: metricValue(denialsByUser.WithLabelValues(Authenticate.String(), string(DenialBadCredential), IdentityUnknown)),
+		pads:   pads,
+		padSum: padSum,
+	}
+}
+
+// sub returns the metrics moved since before
+func (a tallyTotals) sub(before tallyTotals) tallyTotals {
+	return tallyTotals{
+		reads: a.reads - before.reads, writes: a.writes - before.writes,
+		hits: a.hits - before.hits, misses: a.misses - before.misses, sets: a.sets - before.sets,
+		passed: a.passed - before.passed, failed: a.failed - before.failed, denied: a.denied - before.denied,
+		pads: a.pads - before.pads, padSum: a.padSum - before.padSum,
+	}
+}
+
+// TestTallyTotals checks that committing tallies moves the metrics exactly as applying each
+// observation as it is made does, over 10k simulated requests
+func TestTallyTotals(t *testing.T) {
+	const requests = 10000
+	run := func(tally *requestTally) tallyTotals {
+		before := readTallyTotals(t)
+		for i := 0; i < requests; i++ {
+			tallyRequest(tally, i)
+			tally.commit()
+		}
+		return readTallyTotals(t).sub(before)
+	}
+
+	unbatched := run(nil)
+	assert.Equal(t, float64(requests), unbatched.reads)
+	assert.Equal(t, float64(requests/10), unbatched.denied)
+	assert.Equal(t, uint64(2*requests), unbatched.pads)
+	assert.Equal(t, unbatched, run(&requestTally{}))
+
+	// the direct sink applies each observation as a nil tally does
+	metricsSink = directSink{}
+	defer func() { metricsSink = batchedSink{} }()
+	assert.Equal(t, unbatched, run(&requestTally{}))
+}
+
+func TestTallyCommit(t *testing.T) {
+	before := readTallyTotals(t)
+	tally := &requestTally{}
+	for i := 0; i < maxTallyPads+2; i++ {
+		tally.pad(1)
+	}
+	tally.outcome(Authenticate.String(), AuthenStatusPass.String(), originHandler)
+	tally.outcome(Authenticate.String(), AuthenStatusPass.String(), originHandler)
+	// pads past what a tally holds are observed at once, the rest waits for the commit
+	assert.Equal(t, uint64(2), readTallyTotals(t).sub(before).pads)
+	assert.Len(t, tally.labeled, 1)
+
+	tally.commit()
+	moved := readTallyTotals(t).sub(before)
+	assert.Equal(t, uint64(maxTallyPads+2), moved.pads)
+	assert.Equal(t, float64(2), moved.passed)
+	assert.Zero(t, tally.observed)
+	assert.Empty(t, tally.labeled)
+	assert.Len(t, tally.counters, 1)
+}
+
+// TestTallyReplyAfterTimeout replies from handlers after their request timed out, while the server
+// serves the next request of the connection with the same tally.  Run it with -race.
+func TestTallyReplyAfterTimeout(t *testing.T) {
+	const requests = 8
+	s := NewServer(nopLogger{}, nil, SetHandlerTimeout(20*time.Millisecond), SetMetricsIdentity(PassthroughIdentity{}))
+	denied := denialsByUser.WithLabelValues(Authorize.String(), string(DenialPolicy), "cisco")
+	before := metricValue(denied)
+
+	var late sync.WaitGroup
+	released := make(chan struct{}, requests)
+	handler := HandlerFunc(func(response Response, request Request) {
+		if request.Header.SessionID <= requests {
+			late.Add(1)
+			go func() {
+				defer late.Done()
+				<-released
+				_, err := response.Reply(NewDenial(Authorize, DenialPolicy, "late"))
+				assert.Error(t, err)
+			}()
+		}
+		<-request.Context.Done()
+	})
+
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		s.handle(context.Background(), newCrypter(roleServer, []byte("fooman"), server, false), handler)
+		close(done)
+	}()
+	c := newCrypter(roleClient, []byte("fooman"), client, false)
+	for i := 1; i <= requests+1; i++ {
+		p := outcomeTestRequest(Authorize)
+		p.Header.SessionID = SessionID(i)
+		p.Header.Flags = SingleConnect
+		_, err := c.write(p)
+		assert.NoError(t, err)
+		if i > 1 {
+			// the server read the next request, so it released the previous one, whose handler
+			// now replies while the server serves this one
+			released <- struct{}{}
+		}
+		_, err = c.read()
+		assert.NoError(t, err)
+	}
+	late.Wait()
+	client.Close()
+	<-done
+	// the late replies are refused, but their denials are still counted
+	assert.Equal(t, before+requests, metricValue(denied))
+}
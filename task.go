@@ -0,0 +1,229 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// taskAttributes are the attributes a Task sets on its records, which callers may not set
+var taskAttributes = map[string]bool{"task_id": true, "start_time": true, "stop_time": true, "elapsed_time": true, "timezone": true}
+
+// TaskOption is a setter type for Task
+type TaskOption func(t *Task)
+
+// SetTaskRemAddr sets the rem_addr of the records of the task, eg the host running the automation
+func SetTaskRemAddr(v string) TaskOption {
+	return func(t *Task) {
+		t.remAddr = v
+	}
+}
+
+// SetTaskPrivLvl sets the priv_lvl of the records of the task.  The default is PrivLvlUser.
+func SetTaskPrivLvl(v PrivLvl) TaskOption {
+	return func(t *Task) {
+		t.privLvl = v
+	}
+}
+
+// SetTaskRetries sets how many times a record the server answers with AcctReplyStatusError is
+// sent again, in a new session after waiting delay, before giving up.  The default is 2 times, a
+// second apart.
+func SetTaskRetries(n int, delay time.Duration) TaskOption {
+	return func(t *Task) {
+		t.retries, t.retryDelay = n, delay
+	}
+}
+
+// Task is a unit of work, eg a scripted change, accounted as rfc8907 describes: a START record
+// before it runs, WATCHDOG records while it runs, and a STOP record once it is done.  Every record
+// carries the same task_id and args, so the server, and a Correlator, can pair them with each
+// other and with the authorization of the command.  A Task uses the connection of its Client, so
+// like the client it must not be used concurrently.  Each record is a session of its own, sent
+// with the single-connect flag, so the server must support single-connect for a client to send
+// more than one session.
+//
+// A process that dies part way through a task never sends its STOP record.  The server is left
+// with a START, and any WATCHDOG records, that are never closed; nothing in the protocol can tell
+// it the task is over.  Send WATCHDOG records while the task runs so such tasks show when they
+// were last known to be alive.
+type Task struct {
+	c       *Client
+	id      string
+	user    string
+	port    string
+	remAddr string
+	privLvl PrivLvl
+	args    Args
+	started time.Time
+
+	retries    int
+	retryDelay time.Duration
+	// acknowledged is set once the server accepted a record carrying the start of the task
+	acknowledged bool
+	stopped      bool
+}
+
+// StartTask sends the START record of a new task of user on port, with args such as
+// service=shell, cmd=configure.  args may not set the task attributes the Task manages: task_id,
+// start_time, stop_time, elapsed_time and timezone.  If the server does not accept the record, the
+// task is returned along with the error, and the start is sent again with the next Watchdog, as a
+// watchdog with update.
+func (c *Client) StartTask(ctx context.Context, user, port string, args Args, opts ...TaskOption) (*Task, error) {
+	for _, arg := range args {
+		if a, _, _ := arg.ASV(); taskAttributes[a] {
+			return nil, fmt.Errorf("arg [%v] is set by the task", arg)
+		}
+	}
+	t := &Task{
+		c:          c,
+		id:         newDecisionID(),
+		user:       user,
+		port:       port,
+		privLvl:    PrivLvlUser,
+		args:       append(Args(nil), args...),
+		started:    c.now(),
+		retries:    2,
+		retryDelay: time.Second,
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	if err := t.send(ctx, AcctFlagStart, t.startArgs()); err != nil {
+		return t, err
+	}
+	t.acknowledged = true
+	return t, nil
+}
+
+// ID returns the task_id of t
+func (t *Task) ID() string {
+	return t.id
+}
+
+// Watchdog sends a WATCHDOG record with the elapsed time of t.  If the server never accepted the
+// start of t, it is a watchdog with update that carries the start again.
+func (t *Task) Watchdog(ctx context.Context) error {
+	if t.stopped {
+		return fmt.Errorf("task [%v] is stopped", t.id)
+	}
+	flags, args := AcctFlagWatchdog, Args{t.arg("task_id", t.id)}
+	if !t.acknowledged {
+		flags, args = AcctFlagWatchdogWithUpdate, t.startArgs()
+	}
+	args = append(args, t.elapsedTime(t.c.now()))
+	if err := t.send(ctx, flags, args); err != nil {
+		return err
+	}
+	t.acknowledged = true
+	return nil
+}
+
+// Stop sends the STOP record of t, with results such as reason=completed or err_msg=...  A
+// reason of completed is added if results has none.  t is stopped once the server accepts the
+// record; if it does not, Stop may be called again.
+func (t *Task) Stop(ctx context.Context, results Args) error {
+	if t.stopped {
+		return fmt.Errorf("task [%v] is stopped", t.id)
+	}
+	for _, arg := range results {
+		if a, _, _ := arg.ASV(); taskAttributes[a] {
+			return fmt.Errorf("arg [%v] is set by the task", arg)
+		}
+	}
+	now := t.c.now()
+	args := append(t.startArgs(), t.arg("stop_time", strconv.FormatInt(now.Unix(), 10)), t.elapsedTime(now))
+	reason := false
+	for _, arg := range results {
+		if a, _, _ := arg.ASV(); a == "reason" {
+			reason = true
+		}
+	}
+	if !reason {
+		args = append(args, t.arg("reason", "completed"))
+	}
+	if err := t.send(ctx, AcctFlagStop, append(args, results...)); err != nil {
+		return err
+	}
+	t.stopped = true
+	return nil
+}
+
+// startArgs returns the attributes of the start of t
+func (t *Task) startArgs() Args {
+	return Args{
+		t.arg("task_id", t.id),
+		t.arg("start_time", strconv.FormatInt(t.started.Unix(), 10)),
+		t.arg("timezone", "UTC"),
+	}
+}
+
+// elapsedTime returns the elapsed_time of t at now, in whole seconds
+func (t *Task) elapsedTime(now time.Time) Arg {
+	return t.arg("elapsed_time", strconv.FormatInt(int64(now.Sub(t.started)/time.Second), 10))
+}
+
+func (t *Task) arg(a, v string) Arg {
+	return Arg(a + "=" + v)
+}
+
+// send sends a record of t with flags and the task attributes attrs, followed by the args of t.
+// A record the server answers with an error is sent again, up to the retries of t.  A failed
+// exchange is not, the connection of the client is left part way through a packet.
+func (t *Task) send(ctx context.Context, flags AcctRequestFlag, attrs Args) error {
+	body := NewAcctRequest(
+		SetAcctRequestFlag(flags),
+		SetAcctRequestMethod(AuthenMethodTacacsPlus),
+		SetAcctRequestPrivLvl(t.privLvl),
+		SetAcctRequestType(AuthenTypeNotSet),
+		SetAcctRequestService(AuthenServiceNone),
+		SetAcctRequestUser(AuthenUser(t.user)),
+		SetAcctRequestPort(AuthenPort(t.port)),
+		SetAcctRequestRemAddr(AuthenRemAddr(t.remAddr)),
+		SetAcctRequestArgs(append(attrs, t.args...)),
+	)
+	b, err := body.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("unable to marshal the %v record of task [%v]; %w", flags, t.id, err)
+	}
+	var reply AcctReply
+	for attempt := 0; ; attempt++ {
+		p := NewPacket(
+			SetPacketHeader(NewHeader(
+				SetHeaderVersion(Version{MajorVersion: MajorVersion, MinorVersion: MinorVersionDefault}),
+				SetHeaderType(Accounting),
+				SetHeaderSeqNo(1),
+				SetHeaderFlag(SingleConnect),
+				SetHeaderSessionID(t.c.NewSessionID()),
+			)),
+			// the packet is crypted in place, so every attempt gets its own copy
+			SetPacketBody(append([]byte(nil), b...)),
+		)
+		resp, err := t.c.SendContext(ctx, p)
+		if err != nil {
+			return fmt.Errorf("unable to send the %v record of task [%v]; %w", flags, t.id, err)
+		}
+		if err := Unmarshal(resp.Body, &reply); err != nil {
+			return fmt.Errorf("unable to decode the reply to the %v record of task [%v]; %w", flags, t.id, err)
+		}
+		if reply.Status == AcctReplyStatusSuccess {
+			return nil
+		}
+		if attempt >= t.retries {
+			return fmt.Errorf("the %v record of task [%v] was refused [%v] times; last status [%v] %v", flags, t.id, attempt+1, reply.Status, reply.ServerMsg)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(t.retryDelay):
+		}
+	}
+}
@@ -0,0 +1,213 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/facebookincubator/tacquito/internal/testhooks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// taskServer is an in-process server that passes every authorization and accounts every record
+// through a Correlator, refusing the first records of a flag with AcctReplyStatusError
+type taskServer struct {
+	mu      sync.Mutex
+	refuse  map[AcctRequestFlag]int
+	records []AcctRequest
+	ids     []SessionID
+}
+
+func (s *taskServer) handle(response Response, request Request) {
+	response.Reply(NewAuthorReply(SetAuthorReplyStatus(AuthorStatusPassAdd)))
+}
+
+// recorded returns the records accounted so far and their session ids
+func (s *taskServer) recorded() ([]AcctRequest, []SessionID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]AcctRequest(nil), s.records...), append([]SessionID(nil), s.ids...)
+}
+
+func (s *taskServer) account(response Response, request Request) {
+	var body AcctRequest
+	if err := Unmarshal(request.Body, &body); err != nil {
+		response.Reply(NewAcctReply(SetAcctReplyStatus(AcctReplyStatusError)))
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, body)
+	s.ids = append(s.ids, request.Header.SessionID)
+	if s.refuse[body.Flags] > 0 {
+		s.refuse[body.Flags]--
+		response.Reply(NewAcctReply(SetAcctReplyStatus(AcctReplyStatusError), SetAcctReplyServerMsg("try again")))
+		return
+	}
+	response.Reply(NewAcctReply(SetAcctReplyStatus(AcctReplyStatusSuccess)))
+}
+
+// serve serves s with a Correlator recording to logger, and returns a client of it whose clock
+// advances by 30 seconds every time it is read
+func (s *taskServer) serve(t *testing.T, logger loggerProvider) *Client {
+	correlator := NewCorrelator(logger)
+	author := correlator.Authorizer(HandlerFunc(s.handle))
+	acct := correlator.Accounter(HandlerFunc(s.account))
+	server := NewServer(nopLogger{}, secretProviderFunc(func(ctx context.Context, remote net.Addr) ([]byte, Handler, error) {
+		return []byte("fooman"), HandlerFunc(func(response Response, request Request) {
+			if request.Header.Type == Accounting {
+				acct.Handle(response, request)
+				return
+			}
+			author.Handle(response, request)
+		}), nil
+	}))
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go server.Serve(ctx, listener.(*net.TCPListener))
+
+	now := time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)
+	c, err := NewClient(SetClientDialer("tcp6", listener.Addr().String(), []byte("fooman")), setClientTestHooks(&testhooks.Hooks{Now: func() time.Time {
+		defer func() { now = now.Add(30 * time.Second) }()
+		return now
+	}}))
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// secretProviderFunc adapts a func to a SecretProvider
+type secretProviderFunc func(ctx context.Context, remote net.Addr) ([]byte, Handler, error)
+
+func (f secretProviderFunc) Get(ctx context.Context, remote net.Addr) ([]byte, Handler, error) {
+	return f(ctx, remote)
+}
+
+// taskArgs returns the value of each attribute of args
+func taskArgs(args Args) map[string]string {
+	values := map[string]string{}
+	for _, arg := range args {
+		a, _, v := arg.ASV()
+		values[a] = v
+	}
+	return values
+}
+
+func TestTaskCorrelated(t *testing.T) {
+	logger := &recordLogger{}
+	s := &taskServer{}
+	c := s.serve(t, logger)
+	ctx := context.Background()
+	command := Args{"service=shell", "cmd=configure", "cmd-arg=replace"}
+
+	resp, err := c.Send(NewPacket(
+		SetPacketHeader(NewHeader(SetHeaderVersion(Version{MajorVersion: MajorVersion, MinorVersion: MinorVersionDefault}), SetHeaderType(Authorize), SetHeaderFlag(SingleConnect), SetHeaderSessionID(c.NewSessionID()))),
+		SetPacketBodyUnsafe(NewAuthorRequest(
+			SetAuthorRequestMethod(AuthenMethodTacacsPlus),
+			SetAuthorRequestPrivLvl(PrivLvlUser),
+			SetAuthorRequestUser("automation"),
+			SetAuthorRequestPort("change-42"),
+			SetAuthorRequestRemAddr("198.51.100.7"),
+			SetAuthorRequestArgs(command),
+		)),
+	))
+	require.NoError(t, err)
+	var reply AuthorReply
+	require.NoError(t, Unmarshal(resp.Body, &reply))
+	require.Equal(t, AuthorStatusPassAdd, reply.Status)
+
+	task, err := c.StartTask(ctx, "automation", "change-42", command, SetTaskRemAddr("198.51.100.7"))
+	require.NoError(t, err)
+	require.NoError(t, task.Watchdog(ctx))
+	require.NoError(t, task.Stop(ctx, Args{"err_msg=none"}))
+	assert.Error(t, task.Stop(ctx, nil))
+	assert.Error(t, task.Watchdog(ctx))
+
+	records, _ := s.recorded()
+	require.Len(t, records, 3)
+	start, watchdog, stop := taskArgs(records[0].Args), taskArgs(records[1].Args), taskArgs(records[2].Args)
+	assert.Equal(t, AcctFlagStart, records[0].Flags)
+	assert.Equal(t, AcctFlagWatchdog, records[1].Flags)
+	assert.Equal(t, AcctFlagStop, records[2].Flags)
+	for _, r := range []map[string]string{start, watchdog, stop} {
+		assert.Equal(t, task.ID(), r["task_id"])
+		assert.Equal(t, "configure", r["cmd"])
+	}
+	assert.Equal(t, "1609459200", start["start_time"])
+	assert.Equal(t, "UTC", start["timezone"])
+	assert.Equal(t, "30", watchdog["elapsed_time"])
+	assert.Equal(t, "1609459200", stop["start_time"])
+	assert.Equal(t, "1609459260", stop["stop_time"])
+	assert.Equal(t, "60", stop["elapsed_time"])
+	assert.Equal(t, "completed", stop["reason"])
+	assert.Equal(t, "none", stop["err_msg"])
+
+	// the correlator pairs every record with the authorization, which the stop consumes
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	require.Len(t, logger.records, 3)
+	for i, flags := range []AcctRequestFlag{AcctFlagStart, AcctFlagWatchdog, AcctFlagStop} {
+		assert.Equal(t, CorrelationAuthorizedExecuted, logger.records[i]["event"])
+		assert.Equal(t, flags.String(), logger.records[i]["acct-flags"])
+		assert.Equal(t, logger.records[0]["author-session-id"], logger.records[i]["author-session-id"])
+	}
+}
+
+func TestTaskRetries(t *testing.T) {
+	s := &taskServer{refuse: map[AcctRequestFlag]int{AcctFlagStop: 2}}
+	c := s.serve(t, nopLogger{})
+	ctx := context.Background()
+
+	task, err := c.StartTask(ctx, "automation", "change-42", Args{"service=shell"}, SetTaskRetries(0, time.Millisecond))
+	require.NoError(t, err)
+	// with no retries a refused stop is returned, and may be sent again
+	assert.Error(t, task.Stop(ctx, Args{"reason=aborted"}))
+	SetTaskRetries(1, time.Millisecond)(task)
+	require.NoError(t, task.Stop(ctx, Args{"reason=aborted"}))
+
+	records, ids := s.recorded()
+	require.Len(t, records, 4)
+	for i, r := range records[1:] {
+		assert.Equal(t, AcctFlagStop, r.Flags)
+		assert.Equal(t, task.ID(), taskArgs(r.Args)["task_id"])
+		assert.Equal(t, "aborted", taskArgs(r.Args)["reason"])
+		// every attempt is a session of its own
+		assert.NotEqual(t, ids[i], ids[i+1])
+	}
+}
+
+func TestTaskUnacknowledgedStart(t *testing.T) {
+	s := &taskServer{refuse: map[AcctRequestFlag]int{AcctFlagStart: 1}}
+	c := s.serve(t, nopLogger{})
+	ctx := context.Background()
+
+	_, err := c.StartTask(ctx, "automation", "change-42", Args{"service=shell", "task_id=mine"})
+	assert.Error(t, err)
+	task, err := c.StartTask(ctx, "automation", "change-42", Args{"service=shell"}, SetTaskRetries(0, 0))
+	require.Error(t, err)
+	require.NotNil(t, task)
+
+	// the start is sent again with the next watchdog, and only that one
+	require.NoError(t, task.Watchdog(ctx))
+	require.NoError(t, task.Watchdog(ctx))
+	records, _ := s.recorded()
+	require.Len(t, records, 3)
+	assert.Equal(t, AcctFlagWatchdogWithUpdate, records[1].Flags)
+	assert.Equal(t, taskArgs(records[0].Args)["start_time"], taskArgs(records[1].Args)["start_time"])
+	assert.Equal(t, AcctFlagWatchdog, records[2].Flags)
+	assert.NotContains(t, taskArgs(records[2].Args), "start_time")
+	assert.Equal(t, task.ID(), taskArgs(records[2].Args)["task_id"])
+}
@@ -0,0 +1,257 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// TeeOption is used to set optional behaviors on a Tee
+type TeeOption func(t *Tee)
+
+// SetTeeQueue sets how many requests may wait for the secondary handler.  Requests that arrive
+// while the queue is full are not mirrored.  The default is 128.
+func SetTeeQueue(v int) TeeOption {
+	return func(t *Tee) {
+		t.queue = make(chan teeJob, v)
+	}
+}
+
+// SetTeeTimeout sets the deadline on the context of requests sent to the secondary handler.  The
+// default is 5 seconds.
+func SetTeeTimeout(v time.Duration) TeeOption {
+	return func(t *Tee) {
+		t.timeout = v
+	}
+}
+
+// SetTeeSessionTimeout sets how long the secondary handler of a session waits for the next request
+// of the session, eg of a device that abandoned a login, before it is dropped.  The default is 15
+// minutes, the longest a connection waits for a request by default, and a timeout that is not
+// positive keeps it.
+func SetTeeSessionTimeout(v time.Duration) TeeOption {
+	return func(t *Tee) {
+		if v > 0 {
+			t.sessionTimeout = v
+		}
+	}
+}
+
+// NewTee returns a handler that serves every request with primary and mirrors it to secondary in
+// the background.  Only the reply of primary reaches the client.  The decisions of both are
+// compared and divergences are logged and counted, which allows a new backend to be vetted against
+// live traffic before it becomes authoritative.  The secondary is served until ctx is done.
+func NewTee(ctx context.Context, l loggerProvider, primary, secondary Handler, opts ...TeeOption) *Tee {
+	t := &Tee{
+		loggerProvider: l,
+		primary:        primary,
+		secondary:      secondary,
+		queue:          make(chan teeJob, 128),
+		timeout:        5 * time.Second,
+		sessionTimeout: 15 * time.Minute,
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	go t.serve(ctx)
+	return t
+}
+
+// Tee is a middleware handler that mirrors requests to a secondary handler
+type Tee struct {
+	loggerProvider
+	primary   Handler
+	secondary Handler
+	queue     chan teeJob
+	timeout   time.Duration
+	// sessionTimeout is how long a session the secondary continued waits for its next request
+	sessionTimeout time.Duration
+}
+
+// teeJob is a request to mirror along with the decision primary made for it
+type teeJob struct {
+	ctx     context.Context
+	key     teeKey
+	request Request
+	// primary is the status primary replied with, empty if it did not reply
+	primary string
+	// done is set when primary ended the session with this request
+	done bool
+}
+
+// Handle serves request with primary, then queues a copy of it for the secondary
+func (t *Tee) Handle(response Response, request Request) {
+	t.handle(t.primary, response, request)
+}
+
+func (t *Tee) handle(next Handler, response Response, request Request) {
+	// the body may be reused by the caller once Handle returns, or modified by next
+	mirror := request.Snapshot()
+
+	r := &teePrimaryResponse{Response: response, tee: t, t: request.Header.Type}
+	next.Handle(r, request)
+
+	job := teeJob{ctx: request.Context, key: teeKey{id: request.Header.SessionID}, request: mirror, primary: r.status, done: !r.next}
+	if w, ok := request.Context.Value(contextPeer).(*peerWatch); ok {
+		job.key.conn = w.c
+	}
+	select {
+	case t.queue <- job:
+	default:
+		teeDropped.Inc()
+	}
+}
+
+// teeKey is a session of a connection, as devices on two connections may use the same session id
+type teeKey struct {
+	// conn is the connection the session is on, nil for requests the server did not read
+	conn *crypter
+	id   SessionID
+}
+
+// teeSession is the handler the secondary continued a session with, and when it did
+type teeSession struct {
+	next Handler
+	seen time.Time
+}
+
+// serve runs the secondary handler for queued requests, in order, until ctx is done
+func (t *Tee) serve(ctx context.Context) {
+	// the handler for the next request of each session that the secondary continued.  sessions the
+	// primary ends are removed as they end, those a device abandons by the sweep.
+	sessions := make(map[teeKey]teeSession)
+	sweep := time.NewTicker(t.sessionTimeout)
+	defer sweep.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-sweep.C:
+			t.sweep(sessions, now)
+		case job := <-t.queue:
+			s, ok := sessions[job.key]
+			delete(sessions, job.key)
+			h := s.next
+			if job.request.Header.SeqNo == 1 {
+				h, ok = t.secondary, true
+			}
+			if !ok {
+				// the secondary already ended this session, its divergence was counted then
+				continue
+			}
+			status, next := t.mirror(ctx, h, job.request)
+			t.compare(job, status)
+			if next != nil && !job.done {
+				sessions[job.key] = teeSession{next: next, seen: time.Now()}
+			}
+		}
+	}
+}
+
+// sweep drops the sessions that waited longer than the session timeout for their next request
+func (t *Tee) sweep(sessions map[teeKey]teeSession, now time.Time) {
+	for key, s := range sessions {
+		if now.Sub(s.seen) >= t.sessionTimeout {
+			delete(sessions, key)
+			teeSessionsExpired.Inc()
+		}
+	}
+}
+
+// mirror serves request with h and returns the status it replied with and its next handler
+func (t *Tee) mirror(ctx context.Context, h Handler, request Request) (string, Handler) {
+	mctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	request.Context = mctx
+	r := &teeResponse{header: request.Header}
+	h.Handle(r, request)
+	return r.status, r.next
+}
+
+func (t *Tee) compare(job teeJob, secondary string) {
+	teeCompared.Inc()
+	if job.primary == secondary {
+		return
+	}
+	teeDivergence.WithLabelValues(job.request.Header.Type.String()).Inc()
+	t.Infof(job.ctx, "[%v] tee divergence for %v seq [%v]; primary replied [%v], secondary replied [%v]",
+		job.request.Header.SessionID, job.request.Header.Type, job.request.Header.SeqNo, job.primary, secondary)
+}
+
+// teeStatus returns the status label of a reply body of packet type t
+func teeStatus(t HeaderType, v EncoderDecoder) string {
+	b, err := v.MarshalBinary()
+	if err != nil {
+		return "unknown"
+	}
+	_, status := replyOutcome(&Packet{Header: &Header{Type: t}, Body: b})
+	return status
+}
+
+// teePrimaryResponse records the decision of the primary handler on its way to the client
+type teePrimaryResponse struct {
+	Response
+	tee    *Tee
+	t      HeaderType
+	status string
+	next   bool
+}
+
+// Reply records the status of v and sends it
+func (r *teePrimaryResponse) Reply(v EncoderDecoder) (int, error) {
+	r.status = teeStatus(r.t, v)
+	return r.Response.Reply(v)
+}
+
+// Write records the status of p and sends it
+func (r *teePrimaryResponse) Write(p *Packet) (int, error) {
+	_, r.status = replyOutcome(p)
+	return r.Response.Write(p)
+}
+
+// Next wraps next so subsequent packets in this session are mirrored
+func (r *teePrimaryResponse) Next(next Handler) {
+	if next == nil {
+		r.next = false
+		r.Response.Next(nil)
+		return
+	}
+	r.next = true
+	r.Response.Next(HandlerFunc(func(response Response, request Request) {
+		r.tee.handle(next, response, request)
+	}))
+}
+
+// teeResponse captures the reply of the secondary handler, nothing is sent to the client
+type teeResponse struct {
+	header Header
+	status string
+	next   Handler
+}
+
+// Reply records the status of v
+func (r *teeResponse) Reply(v EncoderDecoder) (int, error) {
+	r.status = teeStatus(r.header.Type, v)
+	return 0, nil
+}
+
+// Write records the status of p
+func (r *teeResponse) Write(p *Packet) (int, error) {
+	_, r.status = replyOutcome(p)
+	return 0, nil
+}
+
+// Next records the handler for the next packet of the session
+func (r *teeResponse) Next(next Handler) {
+	r.next = next
+}
+
+// RegisterWriter is a no-op, mirrored replies are never written
+func (r *teeResponse) RegisterWriter(io.Writer) {}
@@ -0,0 +1,108 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTeeDivergence(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logger := &infoLogger{}
+	compared := metricValue(teeCompared)
+	diverged := metricValue(teeDivergence.WithLabelValues("Authenticate"))
+
+	tee := NewTee(ctx, logger, authenStatusHandler(AuthenStatusPass), authenStatusHandler(AuthenStatusFail))
+	assert.Equal(t, []AuthenStatus{AuthenStatusPass}, teeExchange(t, tee, proxyTestPacket()))
+
+	assert.Eventually(t, func() bool { return metricValue(teeCompared) == compared+1 }, time.Second, time.Millisecond)
+	assert.Equal(t, diverged+1, metricValue(teeDivergence.WithLabelValues("Authenticate")))
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	var found bool
+	for _, l := range logger.logs {
+		found = found || strings.Contains(l, "primary replied [AuthenStatusPass], secondary replied [AuthenStatusFail]")
+	}
+	assert.True(t, found, logger.logs)
+}
+
+func TestTeeAgreementAcrossExchange(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	compared := metricValue(teeCompared)
+	diverged := metricValue(teeDivergence.WithLabelValues("Authenticate"))
+
+	tee := NewTee(ctx, nopLogger{}, askUserHandler(AuthenStatusPass), askUserHandler(AuthenStatusPass))
+	cont := NewPacket(
+		SetPacketHeader(NewHeader(SetHeaderType(Authenticate), SetHeaderSeqNo(3), SetHeaderSessionID(12345),
+			SetHeaderVersion(Version{MajorVersion: MajorVersion, MinorVersion: MinorVersionOne}))),
+		SetPacketBodyUnsafe(NewAuthenContinue(SetAuthenContinueUserMessage("cisco"))),
+	)
+	assert.Equal(t, []AuthenStatus{AuthenStatusGetUser, AuthenStatusPass}, teeExchange(t, tee, proxyTestPacket(), cont))
+
+	assert.Eventually(t, func() bool { return metricValue(teeCompared) == compared+2 }, time.Second, time.Millisecond)
+	assert.Equal(t, diverged, metricValue(teeDivergence.WithLabelValues("Authenticate")))
+}
+
+func TestTeeSessionsByConnection(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	compared := metricValue(teeCompared)
+	diverged := metricValue(teeDivergence.WithLabelValues("Authenticate"))
+	tee := NewTee(ctx, nopLogger{}, askUserHandler(AuthenStatusPass), askUserHandler(AuthenStatusPass))
+
+	// two devices use the same session id, each on its own connection
+	s := NewServer(nopLogger{}, nil)
+	var clients []*crypter
+	for i := 0; i < 2; i++ {
+		client, server := net.Pipe()
+		defer client.Close()
+		go s.handle(context.Background(), newCrypter(roleServer, []byte("fooman"), server, false), tee)
+		clients = append(clients, newCrypter(roleClient, []byte("fooman"), client, false))
+	}
+	cont := NewPacket(
+		SetPacketHeader(NewHeader(SetHeaderType(Authenticate), SetHeaderSeqNo(3), SetHeaderSessionID(12345),
+			SetHeaderVersion(Version{MajorVersion: MajorVersion, MinorVersion: MinorVersionOne}))),
+		SetPacketBodyUnsafe(NewAuthenContinue(SetAuthenContinueUserMessage("cisco"))),
+	)
+	for _, p := range []*Packet{proxyTestPacket(), cont} {
+		for _, c := range clients {
+			_, err := c.write(p)
+			assert.NoError(t, err)
+			_, err = c.read()
+			assert.NoError(t, err)
+		}
+	}
+
+	// the start of the second session did not take the place of the first, both continues are
+	// mirrored to the handler of their own session
+	assert.Eventually(t, func() bool { return metricValue(teeCompared) == compared+4 }, time.Second, time.Millisecond)
+	assert.Equal(t, diverged, metricValue(teeDivergence.WithLabelValues("Authenticate")))
+}
+
+func TestTeeSweep(t *testing.T) {
+	expired := metricValue(teeSessionsExpired)
+	tee := &Tee{sessionTimeout: time.Minute}
+	now := time.Now()
+	sessions := map[teeKey]teeSession{
+		{id: 1}: {next: authenStatusHandler(AuthenStatusPass), seen: now.Add(-2 * time.Minute)},
+		{id: 2}: {next: authenStatusHandler(AuthenStatusPass), seen: now.Add(-time.Second)},
+	}
+	// an abandoned session is dropped, one still in progress is kept
+	tee.sweep(sessions, now)
+	assert.Len(t, sessions, 1)
+	assert.Contains(t, sessions, teeKey{id: 2})
+	assert.Equal(t, expired+1, metricValue(teeSessionsExpired))
+}
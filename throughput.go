@@ -0,0 +1,58 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// throughputWindow is the shortest window the throughput gauges are averaged over, scrapes that
+// come sooner report the previous window again
+const throughputWindow = 10 * time.Second
+
+// throughput counts the bodies crypted by every crypter in the process and reports their rate,
+// so production throughput can be compared with the crypt benchmarks
+type throughput struct {
+	// packets and bytes are first so they are 64-bit aligned for atomic access on 32-bit platforms
+	packets uint64
+	bytes   uint64
+
+	mu          sync.Mutex
+	last        time.Time
+	lastPackets uint64
+	lastBytes   uint64
+	pps, bps    float64
+}
+
+// cryptThroughput is the throughput of crypt
+var cryptThroughput = &throughput{}
+
+// add counts a body of n bytes
+func (t *throughput) add(n int) {
+	atomic.AddUint64(&t.packets, 1)
+	atomic.AddUint64(&t.bytes, uint64(n))
+}
+
+// rates returns the packets and bytes per second of the last window that ended by now
+func (t *throughput) rates(now time.Time) (pps, bps float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	packets, bytes := atomic.LoadUint64(&t.packets), atomic.LoadUint64(&t.bytes)
+	if t.last.IsZero() {
+		t.last, t.lastPackets, t.lastBytes = now, packets, bytes
+		return 0, 0
+	}
+	if elapsed := now.Sub(t.last); elapsed >= throughputWindow {
+		t.pps = float64(packets-t.lastPackets) / elapsed.Seconds()
+		t.bps = float64(bytes-t.lastBytes) / elapsed.Seconds()
+		t.last, t.lastPackets, t.lastBytes = now, packets, bytes
+	}
+	return t.pps, t.bps
+}
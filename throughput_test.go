@@ -0,0 +1,40 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThroughputRates(t *testing.T) {
+	now := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	tp := &throughput{}
+	tp.add(100)
+	// the first scrape starts the first window
+	pps, bps := tp.rates(now)
+	assert.Zero(t, pps)
+	assert.Zero(t, bps)
+
+	for i := 0; i < 20; i++ {
+		tp.add(64)
+	}
+	// scrapes within the window report the previous window
+	pps, bps = tp.rates(now.Add(time.Second))
+	assert.Zero(t, pps)
+	assert.Zero(t, bps)
+
+	pps, bps = tp.rates(now.Add(2 * throughputWindow))
+	assert.Equal(t, 1.0, pps)
+	assert.Equal(t, 64.0, bps)
+	pps, bps = tp.rates(now.Add(2*throughputWindow + time.Second))
+	assert.Equal(t, 1.0, pps)
+	assert.Equal(t, 64.0, bps)
+}
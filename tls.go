@@ -0,0 +1,188 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// TLSOption is used to set optional behaviors on a TLSListener
+type TLSOption func(l *TLSListener)
+
+// SetTLSCertificates sets the certificates the server presents.  At least one is required.
+func SetTLSCertificates(certs ...tls.Certificate) TLSOption {
+	return func(l *TLSListener) {
+		l.config.Certificates = certs
+	}
+}
+
+// SetTLSMinVersion sets the lowest TLS version a client may negotiate, eg tls.VersionTLS13.
+// Handshakes below it are rejected.  The default, and the lowest allowed, is tls.VersionTLS12.
+func SetTLSMinVersion(v uint16) TLSOption {
+	return func(l *TLSListener) {
+		l.config.MinVersion = v
+	}
+}
+
+// SetTLSCipherSuites restricts the cipher suites a client may negotiate under TLS 1.2.  Only
+// suites from tls.CipherSuites may be used.  The default is the ECDHE suites with AEAD ciphers.
+// The cipher suites of TLS 1.3 are not configurable, they are all considered secure.
+func SetTLSCipherSuites(ids ...uint16) TLSOption {
+	return func(l *TLSListener) {
+		l.config.CipherSuites = ids
+	}
+}
+
+// defaultCipherSuites are the TLS 1.2 suites with forward secrecy and AEAD ciphers
+var defaultCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// NewTLSListener wraps listener so every connection it accepts is served over TLS.  Pass it to
+// Server.Serve in place of the tcp listener.  The proxy header is not supported over TLS.
+func NewTLSListener(listener *net.TCPListener, opts ...TLSOption) (*TLSListener, error) {
+	l := &TLSListener{
+		TCPListener: listener,
+		config: &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			CipherSuites: defaultCipherSuites,
+		},
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	if err := l.validate(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// TLSListener is a DeadlineListener that serves its connections over TLS.  The handshake of a
+// connection happens when the server first reads from it.
+type TLSListener struct {
+	*net.TCPListener
+	config *tls.Config
+	// hosts are the virtual hosts as set, and virtual the same hosts ready to serve, see
+	// SetTLSVirtualHosts.  fallback is the host named by defaultHost.
+	hosts       []TLSVirtualHost
+	defaultHost string
+	virtual     []*tlsHost
+	fallback    *tlsHost
+}
+
+// Accept waits for the next connection and returns it as a TLS server connection
+func (l *TLSListener) Accept() (net.Conn, error) {
+	conn, err := l.TCPListener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if len(l.virtual) > 0 {
+		return l.accept(conn), nil
+	}
+	return tls.Server(conn, l.config), nil
+}
+
+// SetDeadline sets the deadline of the underlying tcp listener
+func (l *TLSListener) SetDeadline(t time.Time) error {
+	return l.TCPListener.SetDeadline(t)
+}
+
+// validate checks the settings of l once all options are applied
+func (l *TLSListener) validate() error {
+	if len(l.config.Certificates) == 0 && len(l.hosts) == 0 {
+		return &OptionError{Option: "SetTLSCertificates", Value: nil, Reason: "a certificate is required"}
+	}
+	if l.config.MinVersion < tls.VersionTLS12 {
+		return &OptionError{Option: "SetTLSMinVersion", Value: tlsVersionName(l.config.MinVersion), Reason: "must be at least TLS 1.2"}
+	}
+	if len(l.config.CipherSuites) == 0 {
+		return &OptionError{Option: "SetTLSCipherSuites", Value: nil, Reason: "at least one cipher suite is required"}
+	}
+	if id, ok := insecureCipherSuite(l.config.CipherSuites); !ok {
+		return &OptionError{Option: "SetTLSCipherSuites", Value: tls.CipherSuiteName(id), Reason: "cipher suite is insecure or unknown"}
+	}
+	if l.defaultHost != "" && len(l.hosts) == 0 {
+		return &OptionError{Option: "SetTLSDefaultHost", Value: l.defaultHost, Reason: "requires SetTLSVirtualHosts"}
+	}
+	return l.validateHosts()
+}
+
+// insecureCipherSuite returns the first of ids that is not in tls.CipherSuites, ok is false if
+// there is one
+func insecureCipherSuite(ids []uint16) (id uint16, ok bool) {
+	secure := make(map[uint16]bool)
+	for _, s := range tls.CipherSuites() {
+		secure[s.ID] = true
+	}
+	for _, id := range ids {
+		if !secure[id] {
+			return id, false
+		}
+	}
+	return 0, true
+}
+
+// ParseTLSVersion parses a TLS version of the form 1.2 or 1.3
+func ParseTLSVersion(v string) (uint16, error) {
+	switch strings.TrimSpace(v) {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported tls version [%v], use 1.2 or 1.3", v)
+}
+
+// tlsVersionName returns the name of the tls version v as tls.VersionName does, which is not
+// available before go 1.21
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionSSL30:
+		return "SSLv3"
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04X", v)
+}
+
+// ParseCipherSuites parses a comma separated list of cipher suite names as named by
+// tls.CipherSuiteName, eg TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+func ParseCipherSuites(v string) ([]uint16, error) {
+	byName := make(map[string]uint16)
+	for _, s := range tls.CipherSuites() {
+		byName[s.Name] = s.ID
+	}
+	var ids []uint16
+	for _, name := range strings.Split(v, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		id, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("cipher suite [%v] is insecure or unknown", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
@@ -0,0 +1,170 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// selfSignedCertificate returns a throwaway certificate for localhost
+func selfSignedCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv6loopback},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func startTLSServer(ctx context.Context, t *testing.T, opts ...TLSOption) string {
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	assert.NoError(t, err)
+	tlsListener, err := NewTLSListener(listener.(*net.TCPListener), append([]TLSOption{SetTLSCertificates(selfSignedCertificate(t))}, opts...)...)
+	assert.NoError(t, err)
+	s := NewServer(nopLogger{}, sourceSecretProvider{source: "::1", secret: []byte("fooman")})
+	go s.Serve(ctx, tlsListener)
+	return listener.Addr().String()
+}
+
+func TestTLSListenerVersions(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []TLSOption
+		version uint16
+		ok      bool
+	}{
+		{name: "tls 1.1 below the default minimum", version: tls.VersionTLS11},
+		{name: "tls 1.2 at the default minimum", version: tls.VersionTLS12, ok: true},
+		{name: "tls 1.3", version: tls.VersionTLS13, ok: true},
+		{name: "tls 1.2 below a pinned 1.3", opts: []TLSOption{SetTLSMinVersion(tls.VersionTLS13)}, version: tls.VersionTLS12},
+		{name: "tls 1.3 at a pinned 1.3", opts: []TLSOption{SetTLSMinVersion(tls.VersionTLS13)}, version: tls.VersionTLS13, ok: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			addr := startTLSServer(ctx, t, test.opts...)
+			conn, err := tls.Dial("tcp6", addr, &tls.Config{
+				InsecureSkipVerify: true,
+				MinVersion:         test.version,
+				MaxVersion:         test.version,
+			})
+			if !test.ok {
+				// rejected by the server rather than the client
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), "remote error: tls: protocol version not supported")
+				}
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer conn.Close()
+			assert.Equal(t, test.version, conn.ConnectionState().Version)
+
+			// tacacs+ works as usual within the tls session
+			c := newCrypter(roleClient, []byte("fooman"), conn, false)
+			_, err = c.write(proxyTestPacket())
+			assert.NoError(t, err)
+			assert.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+			resp, err := c.read()
+			if assert.NoError(t, err) {
+				var body AuthenReply
+				assert.NoError(t, Unmarshal(resp.Body, &body))
+				assert.Equal(t, AuthenStatusPass, body.Status)
+			}
+		})
+	}
+}
+
+func TestTLSListenerCipherSuites(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	addr := startTLSServer(ctx, t, SetTLSCipherSuites(tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384))
+	for suite, ok := range map[uint16]bool{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384: true,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256: false,
+	} {
+		conn, err := tls.Dial("tcp6", addr, &tls.Config{
+			InsecureSkipVerify: true,
+			MaxVersion:         tls.VersionTLS12,
+			CipherSuites:       []uint16{suite},
+		})
+		if !ok {
+			assert.Error(t, err, tls.CipherSuiteName(suite))
+			continue
+		}
+		if assert.NoError(t, err, tls.CipherSuiteName(suite)) {
+			assert.Equal(t, suite, conn.ConnectionState().CipherSuite)
+			conn.Close()
+		}
+	}
+}
+
+func TestTLSListenerInvalidOptions(t *testing.T) {
+	cert := selfSignedCertificate(t)
+	tests := []struct {
+		name   string
+		opts   []TLSOption
+		option string
+	}{
+		{name: "no certificate", option: "SetTLSCertificates"},
+		{name: "tls 1.1", opts: []TLSOption{SetTLSCertificates(cert), SetTLSMinVersion(tls.VersionTLS11)}, option: "SetTLSMinVersion"},
+		{name: "no cipher suites", opts: []TLSOption{SetTLSCertificates(cert), SetTLSCipherSuites()}, option: "SetTLSCipherSuites"},
+		{name: "insecure cipher suite", opts: []TLSOption{SetTLSCertificates(cert), SetTLSCipherSuites(tls.TLS_RSA_WITH_RC4_128_SHA)}, option: "SetTLSCipherSuites"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp6", "[::1]:0")
+			assert.NoError(t, err)
+			defer listener.Close()
+			_, err = NewTLSListener(listener.(*net.TCPListener), test.opts...)
+			var oe *OptionError
+			if assert.True(t, errors.As(err, &oe), err) {
+				assert.Equal(t, test.option, oe.Option)
+			}
+		})
+	}
+}
+
+func TestParseTLS(t *testing.T) {
+	v, err := ParseTLSVersion("1.3")
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), v)
+	_, err = ParseTLSVersion("1.1")
+	assert.Error(t, err)
+	assert.Equal(t, "TLS 1.2", tlsVersionName(tls.VersionTLS12))
+	assert.Equal(t, "0x0305", tlsVersionName(0x0305))
+
+	ids, err := ParseCipherSuites("TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384")
+	assert.NoError(t, err)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}, ids)
+	_, err = ParseCipherSuites("TLS_RSA_WITH_RC4_128_SHA")
+	assert.Error(t, err)
+}
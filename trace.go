@@ -0,0 +1,175 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceFilter selects the sessions a Tracer traces.  Every set field must match.  Username only
+// matches sessions whose first packet carries the user, so an ascii login is matched by Source or
+// SessionID instead.  A filter without any set field matches nothing.
+type TraceFilter struct {
+	Source    string
+	Username  string
+	SessionID SessionID
+}
+
+// match reports if the first packet of a session, from source with username, matches f
+func (f TraceFilter) match(source, username string, id SessionID) bool {
+	if f == (TraceFilter{}) {
+		return false
+	}
+	if f.Source != "" && !sameIP(f.Source, source) {
+		return false
+	}
+	if f.Username != "" && f.Username != username {
+		return false
+	}
+	if f.SessionID != 0 && f.SessionID != id {
+		return false
+	}
+	return true
+}
+
+// sameIP compares two addresses as ips if both parse, otherwise as strings
+func sameIP(a, b string) bool {
+	ipA, ipB := net.ParseIP(strings.Trim(a, "[]")), net.ParseIP(strings.Trim(b, "[]"))
+	if ipA == nil || ipB == nil {
+		return a == b
+	}
+	return ipA.Equal(ipB)
+}
+
+// NewTracer returns a Tracer that writes the packets of the sessions matching any of filters to
+// sink.  Filters may be added and removed while the server runs.
+func NewTracer(sink io.Writer, filters ...TraceFilter) *Tracer {
+	return &Tracer{sink: sink, filters: filters}
+}
+
+// Tracer writes a decoded trace of selected sessions, one line per packet in the order they were
+// exchanged.  Fields that may hold passwords are redacted.  Set it on the server with SetTracer.
+type Tracer struct {
+	mu      sync.Mutex
+	sink    io.Writer
+	filters []TraceFilter
+	// identity replaces the usernames written to sink
+	identity IdentityObfuscator
+}
+
+// Add starts tracing the sessions matching f.  Sessions already in progress are not traced.
+func (t *Tracer) Add(f TraceFilter) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.filters = append(t.filters, f)
+}
+
+// Remove stops tracing new sessions matching f
+func (t *Tracer) Remove(f TraceFilter) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, v := range t.filters {
+		if v == f {
+			t.filters = append(t.filters[:i], t.filters[i+1:]...)
+			return
+		}
+	}
+}
+
+// SetIdentity replaces the usernames written to the trace with their identity from o.  Filters
+// still match on the raw username.
+func (t *Tracer) SetIdentity(o IdentityObfuscator) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.identity = o
+}
+
+// matches reports if the session started by request should be traced
+func (t *Tracer) matches(source string, request Request) bool {
+	username := requestUser(request)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, f := range t.filters {
+		if f.match(source, username, request.Header.SessionID) {
+			return true
+		}
+	}
+	return false
+}
+
+// Wrap returns next, tracing the sessions it starts that match a filter
+func (t *Tracer) Wrap(next Handler) Handler {
+	return HandlerFunc(func(response Response, request Request) {
+		var source string
+		if request.Context != nil {
+			source, _ = request.Context.Value(ContextConnRemoteAddr).(string)
+		}
+		if !t.matches(source, request) {
+			next.Handle(response, request)
+			return
+		}
+		tracerSessions.Inc()
+		t.handle(source, next, response, request)
+	})
+}
+
+func (t *Tracer) handle(source string, next Handler, response Response, request Request) {
+	h := request.Header
+	if raw, err := NewPacket(SetPacketHeader(&h), SetPacketBody(request.Body)).MarshalBinary(); err == nil {
+		t.write(source, DirectionClient, raw)
+	}
+	response.RegisterWriter(traceWriter{tracer: t, source: source})
+	next.Handle(&tracingResponse{Response: response, tracer: t, source: source}, request)
+}
+
+// write writes a single trace line for the packet raw
+func (t *Tracer) write(source string, d Direction, raw []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var p Packet
+	text := fmt.Sprintf("%v malformed packet", d)
+	if err := p.UnmarshalBinary(raw); err == nil {
+		text = fmt.Sprintf("session=%v %v seq=%v %v", p.Header.SessionID, d, p.Header.SeqNo, summary{redact: true, identity: t.identity}.describe(d, &p))
+	}
+	fmt.Fprintf(t.sink, "%v trace source=%v %v\n", time.Now().UTC().Format(time.RFC3339Nano), source, text)
+}
+
+// traceWriter receives the marshalled replies of a traced response
+type traceWriter struct {
+	tracer *Tracer
+	source string
+}
+
+// Write traces p as a server packet
+func (w traceWriter) Write(p []byte) (int, error) {
+	w.tracer.write(w.source, DirectionServer, p)
+	return len(p), nil
+}
+
+// tracingResponse ensures that every packet of a traced session is traced
+type tracingResponse struct {
+	Response
+	tracer *Tracer
+	source string
+}
+
+// Next wraps next so subsequent packets in this session are traced
+func (r *tracingResponse) Next(next Handler) {
+	if next == nil {
+		r.Response.Next(nil)
+		return
+	}
+	r.Response.Next(HandlerFunc(func(response Response, request Request) {
+		r.tracer.handle(r.source, next, response, request)
+	}))
+}
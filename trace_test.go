@@ -0,0 +1,126 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// lockedBuffer is a trace sink that may be read while connections write to it
+type lockedBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (l *lockedBuffer) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.Write(p)
+}
+
+func (l *lockedBuffer) lines() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return strings.Split(strings.TrimSpace(l.b.String()), "\n")
+}
+
+// fromSource makes requests to next look like they came from source
+func fromSource(source string, next Handler) HandlerFunc {
+	return func(response Response, request Request) {
+		request.Context = context.WithValue(request.Context, ContextConnRemoteAddr, source)
+		next.Handle(response, request)
+	}
+}
+
+func TestTracerSource(t *testing.T) {
+	sink := &lockedBuffer{}
+	tracer := NewTracer(sink, TraceFilter{Source: "2001:db8::1"})
+	for _, source := range []string{"192.0.2.10", "2001:db8:0::1", "192.0.2.11"} {
+		cont := NewPacket(
+			SetPacketHeader(NewHeader(SetHeaderType(Authenticate), SetHeaderSeqNo(3), SetHeaderSessionID(12345),
+				SetHeaderVersion(Version{MajorVersion: MajorVersion, MinorVersion: MinorVersionOne}))),
+			SetPacketBodyUnsafe(NewAuthenContinue(SetAuthenContinueUserMessage("hunter2"))),
+		)
+		h := fromSource(source, tracer.Wrap(askUserHandler(AuthenStatusPass)))
+		assert.Equal(t, []AuthenStatus{AuthenStatusGetUser, AuthenStatusPass}, teeExchange(t, h, proxyTestPacket(), cont))
+	}
+
+	// every packet of the matching session, and nothing else, in the order it was exchanged
+	lines := sink.lines()
+	if assert.Len(t, lines, 4, lines) {
+		for _, l := range lines {
+			assert.Contains(t, l, "trace source=2001:db8:0::1 session=12345 ")
+		}
+		assert.Contains(t, lines[0], "client seq=1 Authenticate AuthenStart")
+		assert.Contains(t, lines[1], "server seq=2 Authenticate AuthenReply status=\"AuthenStatusGetUser\"")
+		assert.Contains(t, lines[2], "client seq=3 Authenticate AuthenContinue user-msg=\"<redacted>\"")
+		assert.Contains(t, lines[3], "server seq=4 Authenticate AuthenReply status=\"AuthenStatusPass\"")
+	}
+	for _, l := range lines {
+		assert.NotContains(t, l, "hunter2")
+	}
+}
+
+func TestTracerFilters(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter TraceFilter
+		traced bool
+	}{
+		{name: "empty filter", filter: TraceFilter{}},
+		{name: "session", filter: TraceFilter{SessionID: 12345}, traced: true},
+		{name: "other session", filter: TraceFilter{SessionID: 54321}},
+		{name: "username", filter: TraceFilter{Username: "cisco"}, traced: true},
+		{name: "other username", filter: TraceFilter{Username: "juniper"}},
+		{name: "username and session", filter: TraceFilter{Username: "cisco", SessionID: 12345}, traced: true},
+		{name: "username and other session", filter: TraceFilter{Username: "cisco", SessionID: 54321}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sink := &lockedBuffer{}
+			tracer := NewTracer(sink, test.filter)
+			s := NewServer(nopLogger{}, nil, SetTracer(tracer))
+			client, server := net.Pipe()
+			done := make(chan struct{})
+			go func() {
+				s.handle(context.Background(), newCrypter(roleServer, []byte("fooman"), server, false), authenStatusHandler(AuthenStatusPass))
+				close(done)
+			}()
+			c := newCrypter(roleClient, []byte("fooman"), client, false)
+			_, err := c.write(proxyTestPacket())
+			assert.NoError(t, err)
+			_, err = c.read()
+			assert.NoError(t, err)
+			client.Close()
+			<-done
+			if test.traced {
+				assert.Len(t, sink.lines(), 2)
+				return
+			}
+			assert.Equal(t, "", strings.TrimSpace(sink.b.String()))
+		})
+	}
+}
+
+func TestTracerAddRemove(t *testing.T) {
+	tracer := NewTracer(&bytes.Buffer{})
+	request := Request{Header: *proxyTestPacket().Header, Body: proxyTestPacket().Body}
+	assert.False(t, tracer.matches("192.0.2.10", request))
+	tracer.Add(TraceFilter{Source: "192.0.2.10"})
+	assert.True(t, tracer.matches("192.0.2.10", request))
+	assert.False(t, tracer.matches("192.0.2.11", request))
+	tracer.Remove(TraceFilter{Source: "192.0.2.10"})
+	assert.False(t, tracer.matches("192.0.2.10", request))
+}
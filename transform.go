@@ -0,0 +1,169 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// errMaxBodyLength is returned when a header indicates a body larger than MaxBodyLength
+var errMaxBodyLength = errors.New("declared body length exceeds MaxBodyLength")
+
+// bodyLengthError returns errMaxBodyLength for a header that declared a body of length bytes
+func bodyLengthError(length uint32) error {
+	return fmt.Errorf("%w; declared [%v] bytes, the maximum is [%v]", errMaxBodyLength, length, MaxBodyLength)
+}
+
+// readRawPacket reads exactly one packet, header and body, from r.  It is unaware of crypt.
+func readRawPacket(r io.Reader) ([]byte, error) {
+	// allocate a tacacs header
+	h := make([]byte, MaxHeaderLength)
+	if _, err := io.ReadFull(r, h); err != nil {
+		return nil, err
+	}
+	// read the length field from the bytes of the header to know how many more bytes we need to get
+	s := binary.BigEndian.Uint32(h[8:])
+	if s > MaxBodyLength {
+		return nil, bodyLengthError(s)
+	}
+	raw := make([]byte, MaxHeaderLength+int(s))
+	copy(raw, h)
+	if _, err := io.ReadFull(r, raw[MaxHeaderLength:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return raw, nil
+}
+
+// NewDecryptReader returns a DecryptReader that reads obfuscated packets from r and
+// deobfuscates them with secret
+func NewDecryptReader(r io.Reader, secret []byte) *DecryptReader {
+	return &DecryptReader{r: r, secret: secret}
+}
+
+// DecryptReader is an io.Reader that operates packet by packet.  Every packet read from the
+// underlying reader is deobfuscated and made available, header and clear text body, to Read.
+// Bad secrets are not detected here; that is left to whatever inspects the packets.
+type DecryptReader struct {
+	r       io.Reader
+	secret  []byte
+	pending []byte
+}
+
+// ReadPacket reads and deobfuscates the next packet.  It must not be mixed with partial Reads.
+func (d *DecryptReader) ReadPacket() (*Packet, error) {
+	if len(d.pending) > 0 {
+		return nil, fmt.Errorf("cannot read a packet while [%v] bytes of the previous packet are unread", len(d.pending))
+	}
+	raw, err := readRawPacket(d.r)
+	if err != nil {
+		return nil, err
+	}
+	p, err := unmarshalRawPacket(raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := crypt(d.secret, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// unmarshalRawPacket decodes raw without altering the header flags.  Header.UnmarshalBinary sets
+// single-connect on every seq 2 header, which a transformer must not add to traffic it relays.
+func unmarshalRawPacket(raw []byte) (*Packet, error) {
+	var p Packet
+	if err := Unmarshal(raw, &p); err != nil {
+		return nil, err
+	}
+	p.Header.Flags = HeaderFlag(raw[3])
+	return &p, nil
+}
+
+// Read implements io.Reader
+func (d *DecryptReader) Read(b []byte) (int, error) {
+	if len(d.pending) == 0 {
+		p, err := d.ReadPacket()
+		if err != nil {
+			return 0, err
+		}
+		if d.pending, err = p.MarshalBinary(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, d.pending)
+	d.pending = d.pending[n:]
+	return n, nil
+}
+
+// NewEncryptWriter returns an EncryptWriter that obfuscates packets with secret and writes
+// them to w
+func NewEncryptWriter(w io.Writer, secret []byte) *EncryptWriter {
+	return &EncryptWriter{w: w, secret: secret}
+}
+
+// EncryptWriter is an io.Writer that operates packet by packet.  Bytes written to it are
+// buffered until a whole packet, header and clear text body, is available.  The packet is then
+// obfuscated and written to the underlying writer in a single call.
+type EncryptWriter struct {
+	w       io.Writer
+	secret  []byte
+	pending []byte
+}
+
+// WritePacket obfuscates p in place and writes it
+func (e *EncryptWriter) WritePacket(p *Packet) (int, error) {
+	if p == nil || p.Header == nil {
+		return 0, fmt.Errorf("packet and header cannot be nil")
+	}
+	p.Header.Length = uint32(len(p.Body))
+	if err := crypt(e.secret, p); err != nil {
+		return 0, err
+	}
+	b, err := p.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	return e.w.Write(b)
+}
+
+// Write implements io.Writer
+func (e *EncryptWriter) Write(b []byte) (int, error) {
+	e.pending = append(e.pending, b...)
+	for len(e.pending) >= MaxHeaderLength {
+		s := binary.BigEndian.Uint32(e.pending[8:MaxHeaderLength])
+		if s > MaxBodyLength {
+			return 0, bodyLengthError(s)
+		}
+		end := MaxHeaderLength + int(s)
+		if len(e.pending) < end {
+			break
+		}
+		p, err := unmarshalRawPacket(e.pending[:end])
+		if err != nil {
+			return 0, err
+		}
+		// the body is obfuscated in place, copy it so pending can be reused
+		p.Body = append([]byte(nil), p.Body...)
+		if _, err := e.WritePacket(p); err != nil {
+			return 0, err
+		}
+		e.pending = e.pending[end:]
+	}
+	return len(b), nil
+}
+
+// Buffered returns the number of bytes waiting for the rest of their packet
+func (e *EncryptWriter) Buffered() int {
+	return len(e.pending)
+}
@@ -0,0 +1,98 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func transformTestPackets() []*Packet {
+	return []*Packet{
+		NewPacket(
+			SetPacketHeader(NewHeader(SetHeaderType(Authenticate), SetHeaderSeqNo(1), SetHeaderSessionID(12345),
+				SetHeaderVersion(Version{MajorVersion: MajorVersion, MinorVersion: MinorVersionOne}))),
+			SetPacketBodyUnsafe(NewAuthenStart(
+				SetAuthenStartAction(AuthenActionLogin),
+				SetAuthenStartPrivLvl(PrivLvlUser),
+				SetAuthenStartType(AuthenTypePAP),
+				SetAuthenStartService(AuthenServiceLogin),
+				SetAuthenStartUser("cisco"),
+				SetAuthenStartPort("tty0"),
+				SetAuthenStartRemAddr("foo"),
+				SetAuthenStartData("cisco"),
+			)),
+		),
+		NewPacket(
+			SetPacketHeader(NewHeader(SetHeaderType(Authenticate), SetHeaderSeqNo(2), SetHeaderSessionID(12345),
+				SetHeaderVersion(Version{MajorVersion: MajorVersion, MinorVersion: MinorVersionOne}))),
+			SetPacketBodyUnsafe(NewAuthenReply(
+				SetAuthenReplyStatus(AuthenStatusPass),
+				SetAuthenReplyServerMsg("welcome"),
+			)),
+		),
+	}
+}
+
+func TestTransformReencrypt(t *testing.T) {
+	clientKey, upstreamKey := []byte("client-secret"), []byte("upstream-secret")
+
+	// what the client puts on the wire
+	var client bytes.Buffer
+	w := NewEncryptWriter(&client, clientKey)
+	for _, p := range transformTestPackets() {
+		_, err := w.WritePacket(p)
+		assert.NoError(t, err)
+	}
+	clientWire := append([]byte(nil), client.Bytes()...)
+
+	// the gateway, a tiny buffer forces packets to be split across reads and writes
+	var upstream bytes.Buffer
+	gw := NewEncryptWriter(&upstream, upstreamKey)
+	_, err := io.CopyBuffer(gw, NewDecryptReader(&client, clientKey), make([]byte, 7))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, gw.Buffered())
+	assert.Equal(t, len(clientWire), upstream.Len())
+	assert.NotEqual(t, clientWire, upstream.Bytes())
+
+	// what the upstream server sees
+	r := NewDecryptReader(&upstream, upstreamKey)
+	for _, want := range transformTestPackets() {
+		got, err := r.ReadPacket()
+		assert.NoError(t, err)
+		assert.Equal(t, want.Header.SeqNo, got.Header.SeqNo)
+		// relayed headers must not gain single-connect
+		assert.Equal(t, want.Header.Flags, got.Header.Flags)
+		assert.Equal(t, want.Body, got.Body)
+	}
+	_, err = r.ReadPacket()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestTransformWrongKey(t *testing.T) {
+	var client bytes.Buffer
+	_, err := NewEncryptWriter(&client, []byte("client-secret")).WritePacket(transformTestPackets()[0])
+	assert.NoError(t, err)
+
+	p, err := NewDecryptReader(&client, []byte("not-the-secret")).ReadPacket()
+	assert.NoError(t, err)
+	var body AuthenStart
+	assert.Error(t, Unmarshal(p.Body, &body))
+}
+
+func TestTransformTruncated(t *testing.T) {
+	var client bytes.Buffer
+	_, err := NewEncryptWriter(&client, []byte("client-secret")).WritePacket(transformTestPackets()[0])
+	assert.NoError(t, err)
+
+	_, err = NewDecryptReader(bytes.NewReader(client.Bytes()[:client.Len()-1]), []byte("client-secret")).ReadPacket()
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,137 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strconv"
+)
+
+// ContextTransport is the Transport of the packet of a request, see RequestTransport
+const ContextTransport ContextKey = "transport"
+
+// contextListener is the address of the listener a Serve call accepts connections on
+const contextListener ContextKey = "listener"
+
+// Transport is how the packet of a request reached the server, for audit records.  It is served
+// as json, so fields are only ever added and never renamed.
+type Transport struct {
+	// Obfuscated is false for a packet sent with the unencrypted flag
+	Obfuscated bool `json:"obfuscated"`
+	// SingleConnect is true if the connection negotiated single-connect with its first session
+	SingleConnect bool `json:"single_connect"`
+	// TLS is true for a connection of a TLSListener, the fields after it describe the session
+	TLS            bool   `json:"tls"`
+	TLSVersion     string `json:"tls_version,omitempty"`
+	TLSCipherSuite string `json:"tls_cipher_suite,omitempty"`
+	// TLSPeer is the common name of the certificate the device presented, if any
+	TLSPeer string `json:"tls_peer,omitempty"`
+	// TLSHost is the virtual host that served the connection, see SetTLSVirtualHosts
+	TLSHost string `json:"tls_host,omitempty"`
+	// Proxied is true for a connection that came through a proxy, see SetUseProxy
+	Proxied bool `json:"proxied"`
+	// Proxy is the address of the proxy, Source that of the device from its proxy header
+	Proxy string `json:"proxy,omitempty"`
+	// Source is the address of the device
+	Source string `json:"source"`
+	// Listener is the address of the listener the connection arrived on
+	Listener string `json:"listener"`
+}
+
+// Fields returns t as flat fields prefixed with transport-, for records that are not nested
+func (t Transport) Fields() map[string]string {
+	fields := map[string]string{
+		"transport-obfuscated":     strconv.FormatBool(t.Obfuscated),
+		"transport-single-connect": strconv.FormatBool(t.SingleConnect),
+		"transport-tls":            strconv.FormatBool(t.TLS),
+		"transport-proxied":        strconv.FormatBool(t.Proxied),
+		"transport-source":         t.Source,
+		"transport-listener":       t.Listener,
+	}
+	for k, v := range map[string]string{
+		"transport-tls-version":      t.TLSVersion,
+		"transport-tls-cipher-suite": t.TLSCipherSuite,
+		"transport-tls-peer":         t.TLSPeer,
+		"transport-tls-host":         t.TLSHost,
+		"transport-proxy":            t.Proxy,
+	} {
+		if v != "" {
+			fields[k] = v
+		}
+	}
+	return fields
+}
+
+// RequestTransport returns the Transport of the request with ctx
+func RequestTransport(ctx context.Context) (Transport, bool) {
+	if ctx == nil {
+		return Transport{}, false
+	}
+	t, ok := ctx.Value(ContextTransport).(Transport)
+	return t, ok
+}
+
+// tlsStater is a tls connection, plain or of a virtual host
+type tlsStater interface {
+	ConnectionState() tls.ConnectionState
+}
+
+// connTransport is the Transport of the packets of a connection
+type connTransport struct {
+	Transport
+	// tls is the connection while its handshake may not be done yet
+	tls tlsStater
+}
+
+// newConnTransport returns the transport of c, accepted by the listener of ctx
+func newConnTransport(ctx context.Context, c *crypter) *connTransport {
+	t := &connTransport{}
+	t.Listener, _ = ctx.Value(contextListener).(string)
+	t.Source = addrHost(c.RemoteAddr())
+	if c.source != nil {
+		t.Proxied, t.Proxy = true, t.Source
+		t.Source = addrHost(c.source)
+	}
+	if conn, ok := c.Conn.(tlsStater); ok {
+		t.TLS, t.tls = true, conn
+	}
+	if hc, ok := c.Conn.(*tlsHostConn); ok && hc.host != nil {
+		t.TLSHost = hc.host.name
+	}
+	return t
+}
+
+// addrHost returns the host of addr, without the brackets of an ipv6 address
+func addrHost(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// packet returns the Transport of a packet with header h, on a connection that negotiated
+// single-connect if singleConnect is set
+func (t *connTransport) packet(h *Header, singleConnect bool) Transport {
+	if t.tls != nil {
+		// the handshake is done once a packet was read
+		state := t.tls.ConnectionState()
+		t.TLSVersion = tlsVersionName(state.Version)
+		t.TLSCipherSuite = tls.CipherSuiteName(state.CipherSuite)
+		if len(state.PeerCertificates) > 0 {
+			t.TLSPeer = state.PeerCertificates[0].Subject.CommonName
+		}
+		t.tls = nil
+	}
+	v := t.Transport
+	v.Obfuscated = !h.Flags.Has(UnencryptedFlag)
+	v.SingleConnect = singleConnect
+	return v
+}
@@ -0,0 +1,216 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// transportRecorder passes every login and keeps the Transport of each request
+type transportRecorder struct {
+	mu         sync.Mutex
+	transports []Transport
+}
+
+func (r *transportRecorder) Get(ctx context.Context, remote net.Addr) ([]byte, Handler, error) {
+	return []byte("fooman"), HandlerFunc(func(response Response, request Request) {
+		t, ok := RequestTransport(request.Context)
+		if ok {
+			r.mu.Lock()
+			r.transports = append(r.transports, t)
+			r.mu.Unlock()
+		}
+		response.Reply(NewAuthenReply(SetAuthenReplyStatus(AuthenStatusPass)))
+	}), nil
+}
+
+func (r *transportRecorder) recorded() []Transport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Transport(nil), r.transports...)
+}
+
+// transportExchange logs in over conn once for each of flags, each a session of its own
+func transportExchange(t *testing.T, conn net.Conn, flags ...HeaderFlag) {
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	c := newCrypter(roleClient, []byte("fooman"), conn, false)
+	for i, flag := range flags {
+		p := proxyTestPacket()
+		p.Header.Flags = flag
+		p.Header.SessionID = SessionID(i + 1)
+		_, err := c.write(p)
+		require.NoError(t, err)
+		_, err = c.read()
+		require.NoError(t, err)
+	}
+}
+
+// serveTransport serves r on listener, as the TCPListener under it when it is tls
+func serveTransport(t *testing.T, r *transportRecorder, listener DeadlineListener, opts ...Option) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go NewServer(nopLogger{}, r, opts...).Serve(ctx, listener)
+}
+
+func TestTransportDirect(t *testing.T) {
+	r := &transportRecorder{}
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	require.NoError(t, err)
+	serveTransport(t, r, listener.(*net.TCPListener), SetImplicitSessionReuse(true))
+
+	conn, err := net.Dial("tcp6", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	transportExchange(t, conn, 0, UnencryptedFlag)
+
+	direct := Transport{Obfuscated: true, Source: "::1", Listener: listener.Addr().String()}
+	plaintext := direct
+	plaintext.Obfuscated = false
+	assert.Equal(t, []Transport{direct, plaintext}, r.recorded())
+
+	conn, err = net.Dial("tcp6", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	transportExchange(t, conn, SingleConnect, 0)
+	// single-connect is negotiated by the first session, and holds for the connection
+	single := direct
+	single.SingleConnect = true
+	assert.Equal(t, []Transport{single, single}, r.recorded()[2:])
+}
+
+func TestTransportProxied(t *testing.T) {
+	r := &transportRecorder{}
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	require.NoError(t, err)
+	serveTransport(t, r, listener.(*net.TCPListener), SetUseProxy(true))
+
+	conn, err := net.Dial("tcp6", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("PROXY TCP4 192.0.2.10 192.0.2.1 5000 49\r\n\x00"))
+	require.NoError(t, err)
+	transportExchange(t, conn, 0)
+
+	assert.Equal(t, []Transport{{
+		Obfuscated: true,
+		Proxied:    true,
+		Proxy:      "::1",
+		Source:     "192.0.2.10",
+		Listener:   listener.Addr().String(),
+	}}, r.recorded())
+}
+
+func TestTransportTLS(t *testing.T) {
+	ca := newVhostTestCA(t, "ca")
+	device := ca.issue(t, "router.prod.example", false)
+	host := vhostTestHost(t, "prod", ca, "tacacs.prod.example", nil)
+	tests := []struct {
+		name string
+		opts []TLSOption
+		peer string
+		host string
+	}{
+		{
+			// a plain tls listener asks for no client certificate
+			name: "listener",
+			opts: []TLSOption{SetTLSCertificates(host.Config.Certificates...)},
+		},
+		{
+			name: "virtual host",
+			opts: []TLSOption{SetTLSVirtualHosts(host)},
+			peer: "router.prod.example",
+			host: "prod",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := &transportRecorder{}
+			listener, err := net.Listen("tcp6", "[::1]:0")
+			require.NoError(t, err)
+			tlsListener, err := NewTLSListener(listener.(*net.TCPListener), test.opts...)
+			require.NoError(t, err)
+			serveTransport(t, r, tlsListener)
+
+			conn, err := tls.Dial("tcp6", listener.Addr().String(), &tls.Config{
+				ServerName:   "tacacs.prod.example",
+				RootCAs:      ca.pool,
+				Certificates: []tls.Certificate{device},
+				MinVersion:   tls.VersionTLS13,
+			})
+			require.NoError(t, err)
+			defer conn.Close()
+			transportExchange(t, conn, SingleConnect)
+
+			recorded := r.recorded()
+			require.Len(t, recorded, 1)
+			assert.Equal(t, Transport{
+				Obfuscated:     true,
+				SingleConnect:  true,
+				TLS:            true,
+				TLSVersion:     "TLS 1.3",
+				TLSCipherSuite: tls.CipherSuiteName(conn.ConnectionState().CipherSuite),
+				TLSPeer:        test.peer,
+				TLSHost:        test.host,
+				Source:         "::1",
+				Listener:       listener.Addr().String(),
+			}, recorded[0])
+		})
+	}
+}
+
+func TestTransportFields(t *testing.T) {
+	assert.Equal(t, map[string]string{
+		"transport-obfuscated":     "true",
+		"transport-single-connect": "false",
+		"transport-tls":            "false",
+		"transport-proxied":        "true",
+		"transport-proxy":          "::1",
+		"transport-source":         "192.0.2.10",
+		"transport-listener":       "[::1]:49",
+	}, Transport{Obfuscated: true, Proxied: true, Proxy: "::1", Source: "192.0.2.10", Listener: "[::1]:49"}.Fields())
+}
+
+func TestAcctRecordSchema(t *testing.T) {
+	body := AcctRequest{Flags: AcctFlagStart, Method: AuthenMethodTacacsPlus, Type: AuthenTypeASCII, Service: AuthenServiceLogin, User: "alice", Args: Args{"cmd=show"}}
+	older, err := json.Marshal(body)
+	require.NoError(t, err)
+
+	ctx := context.WithValue(context.Background(), ContextTransport, Transport{Obfuscated: true, Source: "::1", Listener: "[::1]:49"})
+	record, err := json.Marshal(NewAcctRecord(Request{Context: ctx}, body))
+	require.NoError(t, err)
+
+	// every field of a 1.0 record is in the 1.1 record as it was
+	var was, is map[string]interface{}
+	require.NoError(t, json.Unmarshal(older, &was))
+	require.NoError(t, json.Unmarshal(record, &is))
+	for k, v := range was {
+		assert.Equal(t, v, is[k], k)
+	}
+	assert.Equal(t, AcctRecordSchema, is["schema"])
+	assert.Equal(t, map[string]interface{}{
+		"obfuscated":     true,
+		"single_connect": false,
+		"tls":            false,
+		"proxied":        false,
+		"source":         "::1",
+		"listener":       "[::1]:49",
+	}, is["transport"])
+
+	record, err = json.Marshal(NewAcctRecord(Request{Context: context.Background()}, body))
+	require.NoError(t, err)
+	assert.NotContains(t, string(record), "transport", "a request that was not served has no transport")
+}
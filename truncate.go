@@ -0,0 +1,158 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"unicode/utf8"
+)
+
+// MinTruncateLimit is the smallest limit Truncate cuts a value to, so the marker always fits
+const MinTruncateLimit = 64
+
+// truncateMarker replaces the end of a truncated value.  It holds the length of the whole value
+// and the start of the sha256 of the part that was removed, so a reader can tell data was lost,
+// how much, and match the removed part against a full fidelity copy.
+const truncateMarker = "...[truncated from %v bytes sha256:%x]"
+
+// Truncate returns v cut to at most limit bytes at a rune boundary, ending in a marker such as
+// "...[truncated from 5000 bytes sha256:1a2b3c4d]", and true if it was cut.  A limit of zero is no
+// limit, and a limit below MinTruncateLimit is raised to it.
+func Truncate(v string, limit int) (string, bool) {
+	if limit <= 0 || len(v) <= limit {
+		return v, false
+	}
+	if limit < MinTruncateLimit {
+		limit = MinTruncateLimit
+		if len(v) <= limit {
+			return v, false
+		}
+	}
+	// the marker is the same length whatever was removed, as only its hash is held
+	keep := limit - len(fmt.Sprintf(truncateMarker, len(v), [4]byte{}))
+	for keep > 0 && !utf8.RuneStart(v[keep]) {
+		keep--
+	}
+	sum := sha256.Sum256([]byte(v[keep:]))
+	return v[:keep] + fmt.Sprintf(truncateMarker, len(v), sum[:4]), true
+}
+
+// SinkLimits are the largest values a sink of accounting records can store, eg a syslog message
+// limit.  Values past them are cut with Truncate rather than lost silently.
+type SinkLimits struct {
+	// Name names the sink in tacquito_sink_truncated
+	Name string
+	// Value is the most bytes of any one value, zero is no limit
+	Value int
+	// Record is the most bytes of all the values of a record, zero is no limit.  The longest
+	// values are cut first.
+	Record int
+}
+
+// LimitedSink may be implemented by an accounter, or any other sink of records, to declare its
+// SinkLimits so they are applied once, before it receives a record.  A sink that does not, such as
+// a full fidelity audit store, always receives records whole.
+type LimitedSink interface {
+	SinkLimits() SinkLimits
+}
+
+// TruncateFields cuts the values of fields in place to l, and returns how many were cut
+func (l SinkLimits) TruncateFields(fields map[string]string) int {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	// the longest value is cut first, the first key of those as long
+	sort.Strings(keys)
+	values := make([]string, len(keys))
+	for i, k := range keys {
+		values[i] = fields[k]
+	}
+	n := l.truncate(values)
+	for i, k := range keys {
+		fields[k] = values[i]
+	}
+	return n
+}
+
+// TruncateAcctRequest cuts the user, port, rem-addr and av pair values of body in place to l, and
+// returns how many were cut.  The names of av pairs are kept whole.
+func (l SinkLimits) TruncateAcctRequest(body *AcctRequest) int {
+	values := []string{string(body.User), string(body.Port), string(body.RemAddr)}
+	type pair struct {
+		index     int
+		attribute string
+		separator string
+	}
+	var pairs []pair
+	for i, arg := range body.Args {
+		a, sep, v := arg.ASV()
+		if sep == "" {
+			continue
+		}
+		pairs = append(pairs, pair{index: i, attribute: a, separator: sep})
+		values = append(values, v)
+	}
+	n := l.truncate(values)
+	if n == 0 {
+		return 0
+	}
+	body.User, body.Port, body.RemAddr = AuthenUser(values[0]), AuthenPort(values[1]), AuthenRemAddr(values[2])
+	args := append(Args(nil), body.Args...)
+	for i, p := range pairs {
+		args[p.index] = Arg(p.attribute + p.separator + values[3+i])
+	}
+	body.Args = args
+	return n
+}
+
+// truncate cuts values in place to l, counting those cut for the sink
+func (l SinkLimits) truncate(values []string) int {
+	originals := append([]string(nil), values...)
+	cut := make([]bool, len(values))
+	total := 0
+	for i, v := range values {
+		values[i], cut[i] = Truncate(v, l.Value)
+		total += len(values[i])
+	}
+	for l.Record > 0 && total > l.Record {
+		longest := -1
+		for i, v := range values {
+			if len(v) > MinTruncateLimit && (longest < 0 || len(v) > len(values[longest])) {
+				longest = i
+			}
+		}
+		if longest < 0 {
+			// every value is as short as it can be cut
+			break
+		}
+		// cut again from the original, so the marker holds the length and hash of all that was lost
+		limit := len(values[longest]) - (total - l.Record)
+		if limit < MinTruncateLimit {
+			limit = MinTruncateLimit
+		}
+		v, _ := Truncate(originals[longest], limit)
+		if len(v) >= len(values[longest]) {
+			break
+		}
+		total -= len(values[longest]) - len(v)
+		values[longest], cut[longest] = v, true
+	}
+	n := 0
+	for _, c := range cut {
+		if c {
+			n++
+		}
+	}
+	if n > 0 {
+		sinkTruncated.WithLabelValues(l.Name).Add(float64(n))
+	}
+	return n
+}
@@ -0,0 +1,153 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// truncatedPattern matches a truncated value, capturing what was kept, the length of the whole
+// value and the hash of what was removed
+var truncatedPattern = regexp.MustCompile(`^(?s)(.*)\.\.\.\[truncated from (\d+) bytes sha256:([0-9a-f]{8})\]$`)
+
+// assertTruncated asserts truncated is v cut to at most limit bytes with a marker that describes
+// what was removed
+func assertTruncated(t *testing.T, v, truncated string, limit int) {
+	t.Helper()
+	assert.LessOrEqual(t, len(truncated), limit)
+	assert.True(t, utf8.ValidString(truncated), "cut at a rune boundary")
+	m := truncatedPattern.FindStringSubmatch(truncated)
+	require.NotNil(t, m, truncated)
+	kept := m[1]
+	assert.True(t, strings.HasPrefix(v, kept))
+	assert.Equal(t, fmt.Sprint(len(v)), m[2])
+	sum := sha256.Sum256([]byte(v[len(kept):]))
+	assert.Equal(t, fmt.Sprintf("%x", sum[:4]), m[3])
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		name  string
+		v     string
+		limit int
+		cut   bool
+	}{
+		{name: "no limit", v: strings.Repeat("a", 1000), limit: 0},
+		{name: "within the limit", v: strings.Repeat("a", 100), limit: 100},
+		{name: "ascii", v: strings.Repeat("a", 101), limit: 100, cut: true},
+		{name: "two byte runes", v: strings.Repeat("é", 100), limit: 100, cut: true},
+		{name: "three byte runes", v: strings.Repeat("日本", 100), limit: 101, cut: true},
+		{name: "four byte runes", v: strings.Repeat("🔑", 100), limit: 102, cut: true},
+		{name: "mixed runes", v: "a" + strings.Repeat("é日🔑", 50), limit: 99, cut: true},
+		// the marker alone is most of the minimum, which the limit is raised to
+		{name: "below the minimum", v: strings.Repeat("a", 200), limit: 10, cut: true},
+		{name: "below the minimum and within it", v: strings.Repeat("a", MinTruncateLimit), limit: 10},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			truncated, cut := Truncate(test.v, test.limit)
+			assert.Equal(t, test.cut, cut)
+			if !test.cut {
+				assert.Equal(t, test.v, truncated)
+				return
+			}
+			limit := test.limit
+			if limit < MinTruncateLimit {
+				limit = MinTruncateLimit
+			}
+			assertTruncated(t, test.v, truncated, limit)
+		})
+	}
+}
+
+func TestTruncateMarker(t *testing.T) {
+	truncated, cut := Truncate(strings.Repeat("x", 64)+strings.Repeat("y", 936), 100)
+	require.True(t, cut)
+	// the marker is 46 bytes, so 54 are kept and the hash is of the 946 removed
+	sum := sha256.Sum256([]byte(strings.Repeat("x", 10) + strings.Repeat("y", 936)))
+	assert.Equal(t, strings.Repeat("x", 54)+fmt.Sprintf("...[truncated from 1000 bytes sha256:%x]", sum[:4]), truncated)
+}
+
+func TestSinkLimitsFields(t *testing.T) {
+	long := strings.Repeat("a", 400)
+	tests := []struct {
+		name   string
+		limits SinkLimits
+		// cut are the fields expected to be cut, each to at most the limit given
+		cut map[string]int
+	}{
+		{name: "no limits", limits: SinkLimits{Name: "audit"}},
+		{name: "value", limits: SinkLimits{Name: "values", Value: 100}, cut: map[string]int{"args": 100, "user": 100}},
+		// 50 + 400 + 300 bytes: the longest is cut by all that is over
+		{name: "record", limits: SinkLimits{Name: "records", Record: 500}, cut: map[string]int{"args": 150}},
+		// 50 + 250 + 250 bytes: of those as long, the first key is cut
+		{name: "value and record", limits: SinkLimits{Name: "both", Value: 250, Record: 450}, cut: map[string]int{"args": 150, "user": 250}},
+		// 50 + 400 + 300 bytes: no value can be cut below the minimum, so the record stays over
+		{name: "record below the minimum", limits: SinkLimits{Name: "floor", Record: 100}, cut: map[string]int{"args": MinTruncateLimit, "user": MinTruncateLimit}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fields := map[string]string{"port": strings.Repeat("p", 50), "args": long, "user": strings.Repeat("u", 300)}
+			original := map[string]string{}
+			for k, v := range fields {
+				original[k] = v
+			}
+			before := metricValue(sinkTruncated.WithLabelValues(test.limits.Name))
+			n := test.limits.TruncateFields(fields)
+			assert.Equal(t, len(test.cut), n)
+			assert.Equal(t, before+float64(n), metricValue(sinkTruncated.WithLabelValues(test.limits.Name)))
+			for k, v := range fields {
+				limit, ok := test.cut[k]
+				if !ok {
+					assert.Equal(t, original[k], v, k)
+					continue
+				}
+				assertTruncated(t, original[k], v, limit)
+			}
+			if test.limits.Record > MinTruncateLimit*len(fields) {
+				total := 0
+				for _, v := range fields {
+					total += len(v)
+				}
+				assert.LessOrEqual(t, total, test.limits.Record)
+			}
+		})
+	}
+}
+
+func TestSinkLimitsAcctRequest(t *testing.T) {
+	body := &AcctRequest{
+		User:    AuthenUser("alice"),
+		Port:    AuthenPort("tty0"),
+		RemAddr: AuthenRemAddr("192.0.2.1"),
+		Args:    Args{"service=shell", "cmd=show", Arg("cmd-arg=" + strings.Repeat("v", 200)), "noseparator"},
+	}
+	args := body.Args
+	assert.Equal(t, 1, SinkLimits{Name: "syslog", Value: 100}.TruncateAcctRequest(body))
+	assert.Equal(t, AuthenUser("alice"), body.User)
+	assert.Equal(t, Args{"service=shell", "cmd=show"}, body.Args[:2])
+	assert.Equal(t, Arg("noseparator"), body.Args[3])
+	// the name of the av pair is kept whole, its value is cut
+	a, sep, v := body.Args[2].ASV()
+	assert.Equal(t, "cmd-arg", a)
+	assert.Equal(t, "=", sep)
+	assertTruncated(t, strings.Repeat("v", 200), v, 100)
+	assert.Equal(t, Arg("cmd-arg="+strings.Repeat("v", 200)), args[2], "the args of the caller are not changed")
+	_, err := body.MarshalBinary()
+	assert.NoError(t, err)
+
+	assert.Equal(t, 0, SinkLimits{Name: "syslog", Value: 100}.TruncateAcctRequest(body), "a truncated request is within the limits")
+}
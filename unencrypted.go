@@ -0,0 +1,61 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import "fmt"
+
+// unencryptedRejectedMessage is the server_msg of the reply to a packet sent with UnencryptedFlag
+// to a server that rejects them
+const unencryptedRejectedMessage = "obfuscation required"
+
+// SetRejectUnencrypted, if v is true, rejects packets sent with UnencryptedFlag, which rfc8907
+// says implementations should deprecate.  Such a packet is answered with the error reply of its
+// type, obfuscated with the secret of the connection, and the connection is closed with
+// CloseUnencrypted.  The default serves them as before.  Connections served by a PacketTransport
+// are not checked, see SetPacketTransport.
+func SetRejectUnencrypted(v bool) Option {
+	return func(s *Server) {
+		s.rejectUnencrypted = v
+	}
+}
+
+// ErrUnencrypted is returned when a server that rejects them reads a packet sent with
+// UnencryptedFlag, see SetRejectUnencrypted
+type ErrUnencrypted struct {
+	Type      HeaderType
+	SessionID SessionID
+}
+
+// Error ...
+func (e ErrUnencrypted) Error() string {
+	return fmt.Sprintf("packet of type [%v] in sessionID [%v] was sent unencrypted", e.Type, e.SessionID)
+}
+
+// rejectUnobfuscated answers p, a request read as wire with UnencryptedFlag set, with an obfuscated
+// error reply and returns the ErrUnencrypted that closes the connection
+func (c *crypter) rejectUnobfuscated(p *Packet, wire []byte) error {
+	crypterUnencryptedRejected.WithLabelValues(p.Header.Type.String()).Inc()
+	// the body is in clear text, so it is captured as it is
+	c.capture(c.role.inbound(), wire, p)
+	rejected := &ErrUnencrypted{Type: p.Header.Type, SessionID: p.Header.SessionID}
+	b, err := errorReply(p.Header.Type, unencryptedRejectedMessage).MarshalBinary()
+	if err != nil {
+		crypterMarshalError.Inc()
+		return fmt.Errorf("%v; unable to marshal the reply: %v", rejected, err)
+	}
+	// the reply is obfuscated whatever the request was, as the response keeps the flags of the
+	// header it answers
+	h := *p.Header
+	h.Flags &^= UnencryptedFlag
+	h.SeqNo++
+	r := &response{crypter: c, header: h}
+	if _, err := r.write(NewPacket(SetPacketHeader(&h), SetPacketBody(b)), originServer); err != nil {
+		return fmt.Errorf("%v; unable to write the reply: %v", rejected, err)
+	}
+	return rejected
+}
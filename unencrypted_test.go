@@ -0,0 +1,92 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sendUnencrypted sends a request of type t with UnencryptedFlag to addr and returns the reply,
+// read with the secret of the server
+func sendUnencrypted(t *testing.T, addr string, typ HeaderType) (*Packet, error) {
+	conn, err := net.Dial("tcp6", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	c := newCrypter(roleClient, []byte("fooman"), conn, false)
+	p := outcomeTestRequest(typ)
+	p.Header.Flags.Set(UnencryptedFlag)
+	_, err = c.write(p)
+	require.NoError(t, err)
+	return c.read()
+}
+
+func TestRejectUnencrypted(t *testing.T) {
+	var handled int32
+	handler := HandlerFunc(func(response Response, request Request) {
+		atomic.AddInt32(&handled, 1)
+		response.Reply(errorReply(request.Header.Type, "served"))
+	})
+	addr, closed := startPeerServer(t, handler, SetRejectUnencrypted(true))
+
+	for _, typ := range []HeaderType{Authenticate, Authorize, Accounting} {
+		t.Run(typ.String(), func(t *testing.T) {
+			rejected := metricValue(crypterUnencryptedRejected.WithLabelValues(typ.String()))
+			resp, err := sendUnencrypted(t, addr, typ)
+			require.NoError(t, err)
+			// the reply is obfuscated, and decoded by the client with the secret
+			assert.False(t, resp.Header.Flags.Has(UnencryptedFlag))
+			assert.Equal(t, typ, resp.Header.Type)
+			assert.Equal(t, SequenceNumber(2), resp.Header.SeqNo)
+			switch typ {
+			case Authenticate:
+				var body AuthenReply
+				require.NoError(t, Unmarshal(resp.Body, &body))
+				assert.Equal(t, AuthenStatusError, body.Status)
+				assert.Equal(t, AuthenServerMsg(unencryptedRejectedMessage), body.ServerMsg)
+			case Authorize:
+				var body AuthorReply
+				require.NoError(t, Unmarshal(resp.Body, &body))
+				assert.Equal(t, AuthorStatusError, body.Status)
+				assert.Equal(t, AuthorServerMsg(unencryptedRejectedMessage), body.ServerMsg)
+			case Accounting:
+				var body AcctReply
+				require.NoError(t, Unmarshal(resp.Body, &body))
+				assert.Equal(t, AcctReplyStatusError, body.Status)
+				assert.Equal(t, AcctServerMsg(unencryptedRejectedMessage), body.ServerMsg)
+			}
+			select {
+			case reason := <-closed:
+				assert.Equal(t, CloseUnencrypted, reason)
+			case <-time.After(5 * time.Second):
+				t.Fatal("the connection was not closed")
+			}
+			assert.Equal(t, rejected+1, metricValue(crypterUnencryptedRejected.WithLabelValues(typ.String())))
+		})
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&handled))
+}
+
+func TestRejectUnencryptedDefault(t *testing.T) {
+	// a server without the option serves unencrypted packets as before
+	addr, _ := startPeerServer(t, HandlerFunc(func(response Response, request Request) {
+		response.Reply(NewAuthorReply(SetAuthorReplyStatus(AuthorStatusPassAdd)))
+	}))
+	resp, err := sendUnencrypted(t, addr, Authorize)
+	require.NoError(t, err)
+	assert.True(t, resp.Header.Flags.Has(UnencryptedFlag))
+	var body AuthorReply
+	require.NoError(t, Unmarshal(resp.Body, &body))
+	assert.Equal(t, AuthorStatusPassAdd, body.Status)
+}
@@ -0,0 +1,202 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// TLSVirtualHost is a virtual server on a shared TLSListener, eg one of two administrative domains
+// with their own CA hierarchy and policy.  A client is routed to the host whose ServerNames match
+// the server name it asks for (SNI), else to the first host with a protocol it offers (ALPN).
+type TLSVirtualHost struct {
+	// Name identifies the host in logs and metrics
+	Name string
+	// ServerNames are the server names routed to the host.  A name of the form *.example.com
+	// matches a single label in place of the star.
+	ServerNames []string
+	// Protocols are the application protocols routed to the host
+	Protocols []string
+	// Config is the TLS config of the host, eg its certificates, and ClientCAs and ClientAuth to
+	// verify the certificates of its devices.  The min version and cipher suites of the listener
+	// apply where it sets none.
+	Config *tls.Config
+	// SecretProvider selects the secret and handler of the devices of the host, the SecretProvider
+	// of the Server if nil
+	SecretProvider SecretProvider
+}
+
+// SetTLSVirtualHosts routes every connection of the listener to one of hosts as its handshake
+// starts, see TLSVirtualHost.  Every host presents its own certificates, those of the listener
+// are not used.
+func SetTLSVirtualHosts(hosts ...TLSVirtualHost) TLSOption {
+	return func(l *TLSListener) {
+		l.hosts = hosts
+	}
+}
+
+// SetTLSDefaultHost names the virtual host of clients that ask for no server name, or for one no
+// host serves, and offer no protocol a host serves.  Without a default host such clients fail
+// their handshake and are counted in tacquito_tls_virtual_host_rejected.
+func SetTLSDefaultHost(name string) TLSOption {
+	return func(l *TLSListener) {
+		l.defaultHost = name
+	}
+}
+
+// tlsHost is a TLSVirtualHost ready to serve
+type tlsHost struct {
+	name     string
+	names    []string
+	protos   []string
+	config   *tls.Config
+	provider SecretProvider
+}
+
+// newTLSHost returns host with the defaults of base applied to its config
+func newTLSHost(host TLSVirtualHost, base *tls.Config) *tlsHost {
+	config := host.Config.Clone()
+	if config.MinVersion == 0 {
+		config.MinVersion = base.MinVersion
+	}
+	if len(config.CipherSuites) == 0 {
+		config.CipherSuites = base.CipherSuites
+	}
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = host.Protocols
+	}
+	h := &tlsHost{name: host.Name, protos: host.Protocols, config: config, provider: host.SecretProvider}
+	for _, name := range host.ServerNames {
+		h.names = append(h.names, strings.ToLower(name))
+	}
+	return h
+}
+
+// serves reports if h serves serverName
+func (h *tlsHost) serves(serverName string) bool {
+	for _, name := range h.names {
+		if name == serverName {
+			return true
+		}
+		if suffix := strings.TrimPrefix(name, "*"); suffix != name {
+			label := strings.TrimSuffix(serverName, suffix)
+			if label != serverName && label != "" && !strings.Contains(label, ".") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tlsRoute is how a client was routed to its virtual host
+type tlsRoute string
+
+const (
+	tlsRouteServerName tlsRoute = "sni"
+	tlsRouteProtocol   tlsRoute = "alpn"
+	tlsRouteDefault    tlsRoute = "default"
+)
+
+// route returns the virtual host of the client saying hello, and how it was chosen, or nil if
+// no host serves it
+func (l *TLSListener) route(hello *tls.ClientHelloInfo) (*tlsHost, tlsRoute) {
+	if name := strings.ToLower(strings.TrimSuffix(hello.ServerName, ".")); name != "" {
+		for _, h := range l.virtual {
+			if h.serves(name) {
+				return h, tlsRouteServerName
+			}
+		}
+	}
+	for _, h := range l.virtual {
+		for _, proto := range h.protos {
+			for _, offered := range hello.SupportedProtos {
+				if proto == offered {
+					return h, tlsRouteProtocol
+				}
+			}
+		}
+	}
+	if l.fallback != nil {
+		return l.fallback, tlsRouteDefault
+	}
+	return nil, ""
+}
+
+// accept returns conn as a TLS server connection routed to its virtual host
+func (l *TLSListener) accept(conn net.Conn) *tlsHostConn {
+	hc := &tlsHostConn{}
+	hc.Conn = tls.Server(conn, &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		host, route := l.route(hello)
+		if host == nil {
+			tlsHostRejected.Inc()
+			return nil, fmt.Errorf("no virtual host serves server name [%v] or protocols %v", hello.ServerName, hello.SupportedProtos)
+		}
+		tlsHostConnections.WithLabelValues(host.name, string(route)).Inc()
+		hc.host = host
+		return host.config, nil
+	}})
+	return hc
+}
+
+// tlsHostConn is a connection of a TLSListener with virtual hosts.  Its host, and so its
+// SecretProvider, is only known once its handshake is done.
+type tlsHostConn struct {
+	*tls.Conn
+	host *tlsHost
+}
+
+// handshake runs the handshake of c, bounded by timeout, and returns the SecretProvider of its
+// host, nil for the SecretProvider of the server
+func (c *tlsHostConn) handshake(ctx context.Context, timeout time.Duration) (SecretProvider, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if err := c.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return c.host.provider, nil
+}
+
+// validateHosts checks the virtual hosts of l, and readies them to serve
+func (l *TLSListener) validateHosts() error {
+	seen := make(map[string]bool)
+	for _, host := range l.hosts {
+		if host.Name == "" || seen[host.Name] {
+			return &OptionError{Option: "SetTLSVirtualHosts", Value: host.Name, Reason: "every host needs a unique name"}
+		}
+		seen[host.Name] = true
+		if host.Config == nil || (len(host.Config.Certificates) == 0 && host.Config.GetCertificate == nil) {
+			return &OptionError{Option: "SetTLSVirtualHosts", Value: host.Name, Reason: "a certificate is required"}
+		}
+		if len(host.ServerNames) == 0 && len(host.Protocols) == 0 && host.Name != l.defaultHost {
+			return &OptionError{Option: "SetTLSVirtualHosts", Value: host.Name, Reason: "a host other than the default needs server names or protocols"}
+		}
+		h := newTLSHost(host, l.config)
+		if h.config.MinVersion < tls.VersionTLS12 {
+			return &OptionError{Option: "SetTLSVirtualHosts", Value: host.Name, Reason: "min version must be at least TLS 1.2"}
+		}
+		if id, ok := insecureCipherSuite(h.config.CipherSuites); !ok {
+			return &OptionError{Option: "SetTLSVirtualHosts", Value: tls.CipherSuiteName(id), Reason: "cipher suite is insecure or unknown"}
+		}
+		l.virtual = append(l.virtual, h)
+		if host.Name == l.defaultHost {
+			l.fallback = h
+		}
+	}
+	if l.defaultHost != "" && l.fallback == nil {
+		return &OptionError{Option: "SetTLSDefaultHost", Value: l.defaultHost, Reason: "no virtual host has this name"}
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// vhostTestCA is a throwaway CA, one per administrative domain of a test
+type vhostTestCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newVhostTestCA(t *testing.T, name string) *vhostTestCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &vhostTestCA{cert: cert, key: key, pool: pool}
+}
+
+// issue returns a certificate for name signed by ca, for a server if server is set, else for a
+// device
+func (ca *vhostTestCA) issue(t *testing.T, name string, server bool) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		// the loopback address is for clients that send no server name
+		template.DNSNames = []string{name}
+		template.IPAddresses = []net.IP{net.IPv6loopback}
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// vhostTestHost returns a host for ca that requires devices to present a certificate of ca
+func vhostTestHost(t *testing.T, name string, ca *vhostTestCA, serverName string, provider SecretProvider) TLSVirtualHost {
+	return TLSVirtualHost{
+		Name:        name,
+		ServerNames: []string{serverName},
+		Config: &tls.Config{
+			Certificates: []tls.Certificate{ca.issue(t, serverName, true)},
+			ClientCAs:    ca.pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		},
+		SecretProvider: provider,
+	}
+}
+
+// vhostExchange logs in through a tls connection to addr with config and secret
+func vhostExchange(t *testing.T, addr string, config *tls.Config, secret string) (AuthenStatus, error) {
+	conn, err := tls.Dial("tcp6", addr, config)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	c := newCrypter(roleClient, []byte(secret), conn, false)
+	if _, err := c.write(proxyTestPacket()); err != nil {
+		return 0, err
+	}
+	resp, err := c.read()
+	if err != nil {
+		return 0, err
+	}
+	var reply AuthenReply
+	if err := Unmarshal(resp.Body, &reply); err != nil {
+		return 0, err
+	}
+	return reply.Status, nil
+}
+
+func TestTLSVirtualHosts(t *testing.T) {
+	prod, lab := newVhostTestCA(t, "prod ca"), newVhostTestCA(t, "lab ca")
+	prodHost := vhostTestHost(t, "prod", prod, "tacacs.prod.example", sourceSecretProvider{source: "::1", secret: []byte("prod-secret")})
+	labHost := vhostTestHost(t, "lab", lab, "*.lab.example", nil)
+	labHost.Protocols = []string{"tacacs-lab"}
+	prodDevice, labDevice := prod.issue(t, "router.prod.example", false), lab.issue(t, "router.lab.example", false)
+
+	start := func(ctx context.Context, opts ...TLSOption) string {
+		listener, err := net.Listen("tcp6", "[::1]:0")
+		require.NoError(t, err)
+		tlsListener, err := NewTLSListener(listener.(*net.TCPListener), opts...)
+		require.NoError(t, err)
+		// the lab host has no secret provider of its own, so it is served with that of the server
+		s := NewServer(nopLogger{}, sourceSecretProvider{source: "::1", secret: []byte("lab-secret")})
+		go s.Serve(ctx, tlsListener)
+		return listener.Addr().String()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	addr := start(ctx, SetTLSVirtualHosts(prodHost, labHost))
+	defaultAddr := start(ctx, SetTLSVirtualHosts(prodHost, labHost), SetTLSDefaultHost("prod"))
+
+	connections := func(host string, route tlsRoute) float64 {
+		return metricValue(tlsHostConnections.WithLabelValues(host, string(route)))
+	}
+	tests := []struct {
+		name   string
+		addr   string
+		config *tls.Config
+		secret string
+		host   string
+		route  tlsRoute
+	}{
+		{
+			name:   "prod by server name",
+			addr:   addr,
+			config: &tls.Config{ServerName: "tacacs.prod.example", RootCAs: prod.pool, Certificates: []tls.Certificate{prodDevice}},
+			secret: "prod-secret",
+			host:   "prod",
+			route:  tlsRouteServerName,
+		},
+		{
+			name:   "lab by wildcard server name",
+			addr:   addr,
+			config: &tls.Config{ServerName: "tacacs.lab.example", RootCAs: lab.pool, Certificates: []tls.Certificate{labDevice}},
+			secret: "lab-secret",
+			host:   "lab",
+			route:  tlsRouteServerName,
+		},
+		{
+			name:   "lab by protocol",
+			addr:   addr,
+			config: &tls.Config{RootCAs: lab.pool, Certificates: []tls.Certificate{labDevice}, NextProtos: []string{"tacacs-lab"}},
+			secret: "lab-secret",
+			host:   "lab",
+			route:  tlsRouteProtocol,
+		},
+		{
+			name:   "prod by default",
+			addr:   defaultAddr,
+			config: &tls.Config{RootCAs: prod.pool, Certificates: []tls.Certificate{prodDevice}},
+			secret: "prod-secret",
+			host:   "prod",
+			route:  tlsRouteDefault,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			before := connections(test.host, test.route)
+			status, err := vhostExchange(t, test.addr, test.config, test.secret)
+			require.NoError(t, err)
+			assert.Equal(t, AuthenStatusPass, status)
+			assert.Equal(t, before+1, connections(test.host, test.route))
+		})
+	}
+
+	t.Run("no server name without a default host", func(t *testing.T) {
+		before := metricValue(tlsHostRejected)
+		_, err := vhostExchange(t, addr, &tls.Config{RootCAs: prod.pool, Certificates: []tls.Certificate{prodDevice}}, "prod-secret")
+		assert.Error(t, err)
+		assert.Equal(t, before+1, metricValue(tlsHostRejected))
+	})
+	t.Run("device of the other domain", func(t *testing.T) {
+		// routed to prod, whose CA did not sign the certificate of the device
+		_, err := vhostExchange(t, addr, &tls.Config{ServerName: "tacacs.prod.example", RootCAs: prod.pool, Certificates: []tls.Certificate{labDevice}}, "prod-secret")
+		assert.Error(t, err)
+	})
+}
+
+func TestTLSVirtualHostServes(t *testing.T) {
+	h := newTLSHost(TLSVirtualHost{ServerNames: []string{"TACACS.prod.example", "*.lab.example"}, Config: &tls.Config{}}, &tls.Config{})
+	for name, ok := range map[string]bool{
+		"tacacs.prod.example":     true,
+		"other.prod.example":      false,
+		"tacacs.lab.example":      true,
+		"a.tacacs.lab.example":    false,
+		"lab.example":             false,
+		".lab.example":            false,
+		"tacacs.lab.example.evil": false,
+	} {
+		assert.Equal(t, ok, h.serves(name), name)
+	}
+}
+
+func TestTLSVirtualHostsInvalidOptions(t *testing.T) {
+	ca := newVhostTestCA(t, "ca")
+	host := vhostTestHost(t, "prod", ca, "tacacs.prod.example", nil)
+	noCert := host
+	noCert.Config = &tls.Config{}
+	noNames := host
+	noNames.ServerNames = nil
+	tests := []struct {
+		name   string
+		opts   []TLSOption
+		option string
+	}{
+		{name: "duplicate names", opts: []TLSOption{SetTLSVirtualHosts(host, host)}, option: "SetTLSVirtualHosts"},
+		{name: "no certificate", opts: []TLSOption{SetTLSVirtualHosts(noCert)}, option: "SetTLSVirtualHosts"},
+		{name: "no server names or protocols", opts: []TLSOption{SetTLSVirtualHosts(noNames)}, option: "SetTLSVirtualHosts"},
+		{name: "tls 1.1 from the listener", opts: []TLSOption{SetTLSVirtualHosts(host), SetTLSMinVersion(tls.VersionTLS11)}, option: "SetTLSMinVersion"},
+		{name: "unknown default host", opts: []TLSOption{SetTLSVirtualHosts(host), SetTLSDefaultHost("lab")}, option: "SetTLSDefaultHost"},
+		{name: "default host without hosts", opts: []TLSOption{SetTLSCertificates(selfSignedCertificate(t)), SetTLSDefaultHost("prod")}, option: "SetTLSDefaultHost"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp6", "[::1]:0")
+			require.NoError(t, err)
+			defer listener.Close()
+			_, err = NewTLSListener(listener.(*net.TCPListener), test.opts...)
+			var oe *OptionError
+			if assert.True(t, errors.As(err, &oe), err) {
+				assert.Equal(t, test.option, oe.Option)
+			}
+		})
+	}
+	// a host without server names or protocols is fine as the default
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	_, err = NewTLSListener(listener.(*net.TCPListener), SetTLSVirtualHosts(noNames), SetTLSDefaultHost("prod"))
+	assert.NoError(t, err)
+}
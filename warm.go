@@ -0,0 +1,70 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// warmBatch is how many devices are passed to SecretWarmer.Warm at a time, progress is logged
+// after each batch
+const warmBatch = 100
+
+// SecretWarmer may be implemented by a SecretProvider whose secrets are slow to fetch the first
+// time, eg from SQL or a KMS, to fetch them ahead of the first connection of each device, see
+// SetSecretWarmup.
+type SecretWarmer interface {
+	// Warm fetches and caches the secrets of devices until ctx is done.  It returns how many
+	// devices were warmed, devices without a secret are not an error.
+	Warm(ctx context.Context, devices []net.Addr) (int, error)
+}
+
+// SetSecretWarmup warms the secrets of devices before Serve accepts its first connection, if the
+// SecretProvider is a SecretWarmer, so a restart does not pay a cache miss for every device at
+// once.  Connections that arrive meanwhile wait in the listen backlog.  budget bounds how long
+// warming may delay serving, zero is unbounded.
+func SetSecretWarmup(devices []net.Addr, budget time.Duration) Option {
+	return func(s *Server) {
+		s.warmDevices = devices
+		s.warmBudget = budget
+	}
+}
+
+// warm warms the secrets of the warmup devices in batches, logging progress, until ctx is done or
+// the warmup budget runs out
+func (s *Server) warm(ctx context.Context) {
+	w, ok := s.SecretProvider.(SecretWarmer)
+	if !ok || len(s.warmDevices) == 0 {
+		return
+	}
+	if s.warmBudget > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.warmBudget)
+		defer cancel()
+	}
+	start := time.Now()
+	var warmed, done int
+	for done < len(s.warmDevices) {
+		batch := s.warmDevices[done:]
+		if len(batch) > warmBatch {
+			batch = batch[:warmBatch]
+		}
+		n, err := w.Warm(ctx, batch)
+		warmed += n
+		done += len(batch)
+		secretWarmed.Add(float64(n))
+		if err != nil {
+			s.Errorf(ctx, "secret warmup stopped after [%v/%v] devices, [%v] warmed; %v", done, len(s.warmDevices), warmed, err)
+			return
+		}
+		s.Infof(ctx, "secret warmup [%v/%v] devices, [%v] warmed", done, len(s.warmDevices), warmed)
+	}
+	s.Infof(ctx, "secret warmup finished in [%v], [%v] of [%v] devices warmed", time.Since(start), warmed, len(s.warmDevices))
+}
@@ -0,0 +1,109 @@
+/*
+ Copyright (c) Facebook, Inc. and its affiliates.
+
+ This source code is licensed under the MIT license found in the
+ LICENSE file in the root directory of this source tree.
+*/
+
+package tacquito
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// warmingSecretProvider records the devices it was warmed for, and which of them were warmed
+// by the time Get is called
+type warmingSecretProvider struct {
+	maintenanceSecretProvider
+	mu      sync.Mutex
+	batches [][]net.Addr
+	warmed  map[string]bool
+	atGet   int
+}
+
+func (w *warmingSecretProvider) Warm(ctx context.Context, devices []net.Addr) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.batches = append(w.batches, devices)
+	for _, d := range devices {
+		w.warmed[d.String()] = true
+	}
+	return len(devices), nil
+}
+
+func (w *warmingSecretProvider) Get(ctx context.Context, remote net.Addr) ([]byte, Handler, error) {
+	w.mu.Lock()
+	w.atGet = len(w.warmed)
+	w.mu.Unlock()
+	return w.maintenanceSecretProvider.Get(ctx, remote)
+}
+
+func warmTestDevices(n int) []net.Addr {
+	devices := make([]net.Addr, n)
+	for i := range devices {
+		devices[i] = &net.TCPAddr{IP: net.ParseIP(fmt.Sprintf("2001:db8::%x", i+1))}
+	}
+	return devices
+}
+
+func TestSecretWarmup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	require.NoError(t, err)
+	devices := warmTestDevices(warmBatch + 5)
+	sp := &warmingSecretProvider{warmed: map[string]bool{}}
+	s := NewServer(nopLogger{}, sp, SetSecretWarmup(devices, 0))
+	go s.Serve(ctx, listener.(*net.TCPListener))
+
+	c, err := NewClient(SetClientDialer("tcp6", listener.Addr().String(), []byte("fooman")))
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Send(outcomeTestRequest(Authenticate))
+	require.NoError(t, err)
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	// every device was warmed before the first connection was served, a batch at a time
+	assert.Equal(t, len(devices), sp.atGet)
+	for _, d := range devices {
+		assert.True(t, sp.warmed[d.String()], "device [%v] not warmed", d)
+	}
+	require.Len(t, sp.batches, 2)
+	assert.Len(t, sp.batches[0], warmBatch)
+	assert.Len(t, sp.batches[1], 5)
+}
+
+// stuckWarmer never finishes warming until it is canceled
+type stuckWarmer struct {
+	maintenanceSecretProvider
+}
+
+func (stuckWarmer) Warm(ctx context.Context, devices []net.Addr) (int, error) {
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+func TestSecretWarmupBudget(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	require.NoError(t, err)
+	s := NewServer(nopLogger{}, stuckWarmer{}, SetSecretWarmup(warmTestDevices(1), 20*time.Millisecond))
+	go s.Serve(ctx, listener.(*net.TCPListener))
+
+	// serving starts once the budget is spent, even though warming never finished
+	c, err := NewClient(SetClientDialer("tcp6", listener.Addr().String(), []byte("fooman")))
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Send(outcomeTestRequest(Authenticate))
+	assert.NoError(t, err)
+}